@@ -2,37 +2,299 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/jeefy/slmcache/internal/cluster"
+	"github.com/jeefy/slmcache/internal/config"
 	"github.com/jeefy/slmcache/internal/server"
 	"github.com/jeefy/slmcache/internal/store"
+	"github.com/jeefy/slmcache/internal/store/milvus"
+	"github.com/jeefy/slmcache/internal/store/postgres"
+	"github.com/jeefy/slmcache/internal/store/redis"
 )
 
 func main() {
+	// load mounted config/secret files before anything reads settings, then
+	// keep polling them so ConfigMap rollouts apply without a restart
+	if w := config.WatcherFromEnv(); w != nil {
+		if _, err := w.Load(); err != nil {
+			log.Fatalf("load config: %v", err)
+		}
+		stop := make(chan struct{})
+		defer close(stop)
+		go w.Run(stop)
+	}
+	maxConns := flag.Int("max-connections", intFromEnv("SLC_MAX_CONNECTIONS", 0),
+		"most HTTP connections served at once; further clients wait in the accept backlog (0 = unlimited)")
+	check := flag.Bool("check", false,
+		"validate the config, probe the store and SLM backend, print a diagnosis and exit (non-zero on failure)")
+	dataDir := flag.String("data-dir", config.Get("SLC_DATA_DIR"),
+		"directory of the on-disk store's files with SLC_STORE=bolt (default ./data)")
+	flag.Parse()
+
+	// sidecar mode defaults to a per-pod unix socket and a tiny cache that
+	// reads through to a central instance (SLC_UPSTREAM_URL) on a miss
+	sidecar := config.Get("SLC_MODE") == "sidecar"
+	addr := config.Get("SLC_LISTEN")
+	if addr == "" {
+		addr = ":8080"
+		if sidecar {
+			addr = "unix:/var/run/slmcache/slmcache.sock"
+		}
+	}
+	opts := store.Options{MaxEntries: intFromEnv("SLC_MAX_ENTRIES", 0)}
+	if sidecar && opts.MaxEntries == 0 {
+		opts.MaxEntries = 1000
+	}
+	opts.MaxBytes = int64(intFromEnv("SLC_MAX_BYTES", 0))
+	opts.CompressAbove = intFromEnv("SLC_COMPRESS_ABOVE", 0)
+	opts.HNSW = store.HNSWOptions{
+		M:              intFromEnv("SLC_HNSW_M", 16),
+		EfConstruction: intFromEnv("SLC_HNSW_EF_CONSTRUCTION", 100),
+		EfSearch:       intFromEnv("SLC_HNSW_EF_SEARCH", 64),
+		ExactBelow:     intFromEnv("SLC_HNSW_EXACT_BELOW", 10000),
+	}
+
 	// initialize vector-backed store and an embedded (co-located) SLM
-	st, err := store.New()
+	st, err := openStore(*dataDir, opts)
 	if err != nil {
 		log.Fatalf("init store: %v", err)
 	}
+	if c, ok := st.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	// optional raft cluster mode replicates every write to the other nodes
+	var node *cluster.Node
+	if id := config.Get("SLC_RAFT_ID"); id != "" {
+		node, err = openCluster(id, st)
+		if err != nil {
+			log.Fatalf("init cluster: %v", err)
+		}
+		defer node.Close()
+		st = node.Store()
+	}
 
 	srv := server.New(st)
 	defer srv.Close()
 
-	addr := ":8080"
+	if *check {
+		rep := srv.Doctor(context.Background())
+		rep.WriteText(os.Stdout)
+		if !rep.OK {
+			srv.Close()
+			if node != nil {
+				node.Close()
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	// optional Redis-protocol facade for tools that already speak RESP
+	if respAddr := config.Get("SLC_RESP_LISTEN"); respAddr != "" {
+		rln, err := listen(respAddr)
+		if err != nil {
+			log.Fatalf("listen %s: %v", respAddr, err)
+		}
+		defer rln.Close()
+		log.Printf("serving RESP on %s", respAddr)
+		go func() {
+			if err := srv.ServeRESP(rln); err != nil {
+				log.Printf("resp server failed: %v", err)
+			}
+		}()
+	}
+
+	ln, err := listen(addr)
+	if err != nil {
+		log.Fatalf("listen %s: %v", addr, err)
+	}
+	ln = server.LimitListener(ln, *maxConns)
 	log.Printf("starting slmcache on %s", addr)
+	if node != nil {
+		srv.Handle("/cluster/status", http.HandlerFunc(node.HandleStatus))
+	}
+	handler := srv.Router()
+	if node != nil {
+		handler = node.Forward(handler)
+	}
 	s := &http.Server{
-		Addr:         addr,
-		Handler:      srv.Router(),
+		Handler:      handler,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
 
-	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	// on SIGTERM, fail readiness so load balancers move traffic away, then
+	// give in-flight requests SLC_SHUTDOWN_TIMEOUT to finish
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		srv.Drain()
+		timeout := durationFromEnv("SLC_SHUTDOWN_TIMEOUT", 30*time.Second)
+		log.Printf("draining for up to %s", timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+
+	if err := s.Serve(ln); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("server failed: %v", err)
 	}
+	<-drained
+}
+
+// openStore returns the store SLC_STORE selects: memory (the default),
+// bolt for one that keeps its contents in dir across restarts, or postgres,
+// milvus or redis for a database that replicas can share.
+func openStore(dir string, opts store.Options) (store.Store, error) {
+	kind := config.Get("SLC_STORE")
+	// raft replays its log into the store on start and applies every write
+	// on each node, which a store that persists or is shared would take
+	// more than once
+	if kind != "" && kind != "memory" && config.Get("SLC_RAFT_ID") != "" {
+		return nil, fmt.Errorf("SLC_STORE=%s can't be combined with raft cluster mode, which keeps its own log", kind)
+	}
+	// a backend replicas share runs maintenance on the lease holder only,
+	// and without leases on none unless this is its only replica
+	lazy := store.LazyOptions{Exclusive: config.Get("SLC_STORE_EXCLUSIVE") == "true"}
+	switch kind {
+	case "", "memory":
+		return store.NewWithOptions(opts)
+	case "bolt":
+		if dir == "" {
+			dir = "./data"
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		log.Printf("keeping the store in %s", dir)
+		return store.OpenBolt(filepath.Join(dir, "slmcache.db"), opts)
+	case "postgres":
+		dsn := config.Secret("SLC_POSTGRES_DSN")
+		if dsn == "" {
+			return nil, errors.New("SLC_STORE=postgres needs SLC_POSTGRES_DSN")
+		}
+		// connect in the background, so the server starts (unready) while
+		// the database is down and reconnects after outages
+		return store.NewLazy(func(ctx context.Context) (store.Store, error) {
+			return postgres.Open(ctx, dsn)
+		}, lazy), nil
+	case "milvus":
+		opts := milvus.Options{
+			URL:        config.Get("SLC_MILVUS_URL"),
+			Token:      config.Secret("SLC_MILVUS_TOKEN"),
+			Collection: config.Get("SLC_MILVUS_COLLECTION"),
+			Index:      config.Get("SLC_MILVUS_INDEX"),
+		}
+		if opts.URL == "" {
+			return nil, errors.New("SLC_STORE=milvus needs SLC_MILVUS_URL")
+		}
+		dim, err := strconv.Atoi(config.Get("SLC_MILVUS_DIM"))
+		if err != nil || dim <= 0 {
+			return nil, errors.New("SLC_STORE=milvus needs SLC_MILVUS_DIM, the embedding dimension")
+		}
+		opts.Dim = dim
+		for _, k := range strings.Split(config.Get("SLC_MILVUS_FIELDS"), ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				opts.Fields = append(opts.Fields, k)
+			}
+		}
+		if !lazy.Exclusive {
+			log.Printf("milvus can't grant maintenance leases, so the janitor and other maintenance loops are off; set SLC_STORE_EXCLUSIVE=true on a single replica")
+		}
+		return store.NewLazy(func(ctx context.Context) (store.Store, error) {
+			return milvus.Open(ctx, opts)
+		}, lazy), nil
+	case "redis":
+		opts := redis.Options{
+			Addr:     config.Get("SLC_REDIS_ADDR"),
+			Username: config.Get("SLC_REDIS_USERNAME"),
+			Password: config.Secret("SLC_REDIS_PASSWORD"),
+			TLS:      config.Get("SLC_REDIS_TLS") == "true",
+			Prefix:   config.Get("SLC_REDIS_PREFIX"),
+			Index:    config.Get("SLC_REDIS_INDEX"),
+		}
+		if opts.Addr == "" {
+			return nil, errors.New("SLC_STORE=redis needs SLC_REDIS_ADDR")
+		}
+		dim, err := strconv.Atoi(config.Get("SLC_REDIS_DIM"))
+		if err != nil || dim <= 0 {
+			return nil, errors.New("SLC_STORE=redis needs SLC_REDIS_DIM, the embedding dimension")
+		}
+		opts.Dim = dim
+		if v := config.Get("SLC_REDIS_DB"); v != "" {
+			if opts.DB, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("SLC_REDIS_DB %q is not a database number", v)
+			}
+		}
+		return store.NewLazy(func(ctx context.Context) (store.Store, error) {
+			return redis.Open(ctx, opts)
+		}, lazy), nil
+	default:
+		return nil, fmt.Errorf("unknown SLC_STORE %q (want memory, bolt, postgres, milvus or redis)", kind)
+	}
+}
 
-	// graceful shutdown example if extended
-	_ = s.Shutdown(context.Background())
+// openCluster joins the raft cluster described by SLC_RAFT_PEERS as node id,
+// keeping raft state in SLC_RAFT_DIR.
+func openCluster(id string, local store.Store) (*cluster.Node, error) {
+	peers, err := cluster.ParsePeers(config.Get("SLC_RAFT_PEERS"))
+	if err != nil {
+		return nil, err
+	}
+	dir := config.Get("SLC_RAFT_DIR")
+	if dir == "" {
+		dir = "./raft"
+	}
+	log.Printf("joining raft cluster as %s (%d peers)", id, len(peers))
+	return cluster.Open(cluster.Config{ID: id, BindAddr: config.Get("SLC_RAFT_BIND"), DataDir: dir, Peers: peers}, local)
+}
+
+// listen opens a TCP listener, or a unix domain socket for addresses of the
+// form unix:/path/to.sock (or unix:///path/to.sock).
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		path = strings.TrimPrefix(path, "//")
+		// a previous run may have left the socket file behind
+		_ = os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func intFromEnv(key string, def int) int {
+	if v := config.Get(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return def
+}
+
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	if v := config.Get(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return def
 }
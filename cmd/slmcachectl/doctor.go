@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+)
+
+// runDoctor runs a server's self-test and prints one line per check,
+// failing when any check did:
+//
+//	slmcachectl doctor --server http://slmcache:8080
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	server := fs.String("server", defaultServer(), "slmcache base URL (env SLMCACHE_URL)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: slmcachectl doctor [flags]")
+	}
+	rep, err := newClient(*server).Doctor(context.Background())
+	if err != nil {
+		return err
+	}
+	rep.WriteText(os.Stdout)
+	if !rep.OK {
+		return errors.New("self-test failed")
+	}
+	return nil
+}
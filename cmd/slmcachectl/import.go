@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/client"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// runImport streams a CSV or JSONL file into the cache in batches:
+//
+//	slmcachectl import --format=csv --map prompt=Question --map response=Answer faq.csv
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	server := fs.String("server", defaultServer(), "slmcache base URL (env SLMCACHE_URL)")
+	format := fs.String("format", "", "input format: csv or jsonl (default: from file extension)")
+	batch := fs.Int("batch", 100, "entries per /entries/batch request")
+	var maps multiFlag
+	fs.Var(&maps, "map", "target=source column mapping; targets are prompt, response, metadata.<key> (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: slmcachectl import [flags] <file|->")
+	}
+	m, err := parseMapping(maps)
+	if err != nil {
+		return err
+	}
+	if *batch <= 0 {
+		return errors.New("--batch must be positive")
+	}
+	path := fs.Arg(0)
+	f := *format
+	if f == "" {
+		f = formatFromPath(path)
+	}
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	var rows rowReader
+	switch f {
+	case "csv":
+		rows, err = newCSVReader(in)
+	case "jsonl", "ndjson":
+		rows = newJSONLReader(in)
+	default:
+		return fmt.Errorf("unknown format %q (want csv or jsonl)", f)
+	}
+	if err != nil {
+		return err
+	}
+	imp := &importer{client: newClient(*server), mapping: m, batchSize: *batch, progress: os.Stderr}
+	start := time.Now()
+	sum, err := imp.run(context.Background(), rows)
+	fmt.Fprintf(os.Stderr, "imported %d of %d rows (%d failed) in %s\n", sum.imported, sum.rows, sum.failed, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		return err
+	}
+	if sum.failed > 0 {
+		return fmt.Errorf("%d rows failed", sum.failed)
+	}
+	return nil
+}
+
+func formatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return "jsonl"
+	default:
+		return "csv"
+	}
+}
+
+// mapping says which source column feeds each entry field.
+type mapping struct {
+	prompt, response string
+	metadata         map[string]string // metadata key -> source column
+}
+
+func parseMapping(specs []string) (mapping, error) {
+	m := mapping{prompt: "prompt", response: "response", metadata: map[string]string{}}
+	for _, spec := range specs {
+		target, source, ok := strings.Cut(spec, "=")
+		target, source = strings.TrimSpace(target), strings.TrimSpace(source)
+		if !ok || target == "" || source == "" {
+			return m, fmt.Errorf("bad --map %q: want target=source", spec)
+		}
+		switch {
+		case target == "prompt":
+			m.prompt = source
+		case target == "response":
+			m.response = source
+		case strings.HasPrefix(target, "metadata.") && len(target) > len("metadata."):
+			m.metadata[strings.TrimPrefix(target, "metadata.")] = source
+		default:
+			return m, fmt.Errorf("bad --map target %q: want prompt, response or metadata.<key>", target)
+		}
+	}
+	return m, nil
+}
+
+// entry builds an Entry from one source row.
+func (m mapping) entry(row map[string]string) (models.Entry, error) {
+	e := models.Entry{Prompt: row[m.prompt], Response: row[m.response]}
+	if strings.TrimSpace(e.Prompt) == "" {
+		return e, fmt.Errorf("empty prompt (column %q)", m.prompt)
+	}
+	for key, col := range m.metadata {
+		if v, ok := row[col]; ok && v != "" {
+			if e.Metadata == nil {
+				e.Metadata = map[string]interface{}{}
+			}
+			e.Metadata[key] = v
+		}
+	}
+	return e, nil
+}
+
+// rowReader yields source rows keyed by column name along with the row's
+// position in the input for error reporting. It returns io.EOF when done.
+type rowReader interface {
+	next() (row map[string]string, line int, err error)
+}
+
+type csvReader struct {
+	r      *csv.Reader
+	header []string
+}
+
+func newCSVReader(in io.Reader) (*csvReader, error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read csv header: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\uFEFF"))
+	}
+	return &csvReader{r: r, header: header}, nil
+}
+
+func (c *csvReader) next() (map[string]string, int, error) {
+	rec, err := c.r.Read()
+	if err != nil {
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			return nil, perr.StartLine, &rowError{err}
+		}
+		return nil, 0, err
+	}
+	line, _ := c.r.FieldPos(0)
+	row := make(map[string]string, len(c.header))
+	for i, col := range c.header {
+		if i < len(rec) {
+			row[col] = rec[i]
+		}
+	}
+	return row, line, nil
+}
+
+type jsonlReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func newJSONLReader(in io.Reader) *jsonlReader {
+	s := bufio.NewScanner(in)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &jsonlReader{s: s}
+}
+
+func (j *jsonlReader) next() (map[string]string, int, error) {
+	for j.s.Scan() {
+		j.line++
+		text := strings.TrimSpace(j.s.Text())
+		if text == "" {
+			continue
+		}
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &obj); err != nil {
+			return nil, j.line, &rowError{err}
+		}
+		row := make(map[string]string, len(obj))
+		for k, v := range obj {
+			switch t := v.(type) {
+			case nil:
+			case string:
+				row[k] = t
+			default:
+				b, _ := json.Marshal(t)
+				row[k] = string(b)
+			}
+		}
+		return row, j.line, nil
+	}
+	if err := j.s.Err(); err != nil {
+		return nil, j.line, err
+	}
+	return nil, j.line, io.EOF
+}
+
+// rowError marks a malformed row that should be reported and skipped rather
+// than abort the import.
+type rowError struct{ err error }
+
+func (e *rowError) Error() string { return e.err.Error() }
+
+type importSummary struct {
+	rows, imported, failed int
+}
+
+type importer struct {
+	client    *client.Client
+	mapping   mapping
+	batchSize int
+	progress  io.Writer
+}
+
+func (imp *importer) run(ctx context.Context, rows rowReader) (importSummary, error) {
+	var sum importSummary
+	entries := make([]models.Entry, 0, imp.batchSize)
+	lines := make([]int, 0, imp.batchSize)
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		results, err := imp.client.CreateBatch(ctx, entries)
+		if err != nil {
+			return fmt.Errorf("rows %d-%d: %w", lines[0], lines[len(lines)-1], err)
+		}
+		for _, res := range results {
+			if res.Error != "" {
+				sum.failed++
+				imp.rowFailed(lines[res.Index], res.Error)
+				continue
+			}
+			sum.imported++
+		}
+		entries, lines = entries[:0], lines[:0]
+		fmt.Fprintf(imp.progress, "\r%d rows read, %d imported, %d failed", sum.rows, sum.imported, sum.failed)
+		return nil
+	}
+
+	for {
+		row, line, err := rows.next()
+		if err == io.EOF {
+			break
+		}
+		var rerr *rowError
+		if errors.As(err, &rerr) {
+			sum.rows++
+			sum.failed++
+			imp.rowFailed(line, err.Error())
+			continue
+		}
+		if err != nil {
+			return sum, err
+		}
+		sum.rows++
+		e, err := imp.mapping.entry(row)
+		if err != nil {
+			sum.failed++
+			imp.rowFailed(line, err.Error())
+			continue
+		}
+		entries = append(entries, e)
+		lines = append(lines, line)
+		if len(entries) >= imp.batchSize {
+			if err := flush(); err != nil {
+				return sum, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return sum, err
+	}
+	fmt.Fprintln(imp.progress)
+	return sum, nil
+}
+
+func (imp *importer) rowFailed(line int, msg string) {
+	fmt.Fprintf(imp.progress, "\nrow %d: %s\n", line, msg)
+}
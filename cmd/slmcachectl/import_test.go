@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jeefy/slmcache/internal/client"
+	"github.com/jeefy/slmcache/internal/server"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+func TestImportCSVWithMapping(t *testing.T) {
+	st, _ := store.New()
+	srv := server.New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	m, err := parseMapping([]string{"prompt=Question", "response=Answer", "metadata.namespace=Team"})
+	if err != nil {
+		t.Fatalf("mapping: %v", err)
+	}
+	csvData := "Question,Answer,Team\n" +
+		"How do I reset my password?,Use the portal,it\n" +
+		",orphan answer,it\n" +
+		"\"Where is the VPN guide?\",On the wiki,\n"
+	rows, err := newCSVReader(strings.NewReader(csvData))
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+	imp := &importer{client: client.New(ts.URL), mapping: m, batchSize: 1, progress: io.Discard}
+	sum, err := imp.run(context.Background(), rows)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if sum.rows != 3 || sum.imported != 2 || sum.failed != 1 {
+		t.Fatalf("expected 3 rows/2 imported/1 failed got %+v", sum)
+	}
+	if n := len(st.AllIDs()); n != 2 {
+		t.Fatalf("expected 2 stored entries got %d", n)
+	}
+	found, _ := st.FindEntriesByMetadata(context.Background(), map[string]string{"namespace": "it"})
+	if len(found) != 1 || found[0].Prompt != "How do I reset my password?" {
+		t.Fatalf("expected mapped namespace on imported entry, got %+v", found)
+	}
+}
+
+func TestJSONLReaderSkipsBadLines(t *testing.T) {
+	rows := newJSONLReader(strings.NewReader("{\"q\":\"a\",\"n\":3}\nnot json\n\n{\"q\":\"b\"}\n"))
+	var got []string
+	var bad []int
+	for {
+		row, line, err := rows.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			bad = append(bad, line)
+			continue
+		}
+		got = append(got, row["q"]+row["n"])
+	}
+	if strings.Join(got, ",") != "a3,b" || len(bad) != 1 || bad[0] != 2 {
+		t.Fatalf("expected rows a3,b with bad line 2, got %v bad=%v", got, bad)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/client"
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/slm"
+)
+
+// runLoad fills the cache with a synthetic corpus and then searches it at a
+// fixed rate, reporting hit rate and latency for capacity planning:
+//
+//	slmcachectl load --entries 100k --qps 500 --duration 5m --paraphrase
+func runLoad(args []string) error {
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	server := fs.String("server", defaultServer(), "slmcache base URL (env SLMCACHE_URL)")
+	entriesFlag := fs.String("entries", "10k", "synthetic entries to store first (suffixes k and m)")
+	qps := fs.Int("qps", 100, "searches per second")
+	duration := fs.Duration("duration", time.Minute, "how long to search")
+	concurrency := fs.Int("concurrency", 64, "most searches in flight")
+	paraphrase := fs.Bool("paraphrase", false, "search with paraphrases of the stored prompts instead of the prompts themselves")
+	novel := fs.Float64("novel", 0.1, "share of searches about topics not in the corpus; their hits are false hits")
+	namespace := fs.String("namespace", "loadtest", "namespace the corpus is stored and searched in")
+	skipFill := fs.Bool("skip-fill", false, "search a corpus stored by an earlier run")
+	batch := fs.Int("batch", 500, "entries per /entries/batch request")
+	seed := fs.Uint64("seed", 1, "seed of the query mix")
+	genModel := fs.String("generate-model", config.Get("SLM_GENERATE_MODEL"), "Ollama model that writes paraphrases (env SLM_GENERATE_MODEL); unset uses templates")
+	genURL := fs.String("generate-url", generateURL(), "Ollama endpoint of --generate-model (env SLM_GENERATE_URL)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: slmcachectl load [flags]")
+	}
+	n, err := parseCount(*entriesFlag)
+	if err != nil {
+		return fmt.Errorf("bad --entries: %w", err)
+	}
+	if *qps <= 0 || *concurrency <= 0 || *batch <= 0 {
+		return errors.New("--qps, --concurrency and --batch must be positive")
+	}
+	if *novel < 0 || *novel > 1 {
+		return errors.New("--novel must be between 0 and 1")
+	}
+	lt := &loadTest{
+		client:    newClient(*server),
+		corpus:    corpus{n: n},
+		namespace: *namespace,
+		novel:     *novel,
+		rng:       rand.New(rand.NewPCG(*seed, *seed^0x9e3779b97f4a7c15)),
+		progress:  os.Stderr,
+	}
+	if *paraphrase {
+		lt.paraphrase = templateParaphrase
+		if *genModel != "" {
+			lt.paraphrase = generatedParaphrase(slm.NewOllamaGenerator(*genURL, *genModel))
+		}
+	}
+	ctx := context.Background()
+	if !*skipFill {
+		start := time.Now()
+		if err := lt.fill(ctx, *batch); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "stored %d entries in %s\n", n, time.Since(start).Round(time.Millisecond))
+	}
+	rep := lt.drive(ctx, *qps, *concurrency, *duration)
+	rep.write(os.Stdout)
+	return nil
+}
+
+// generateURL is SLM_GENERATE_URL, falling back like the server does.
+func generateURL() string {
+	for _, key := range []string{"SLM_GENERATE_URL", "SLM_OLLAMA_URL"} {
+		if v := config.Get(key); v != "" {
+			return v
+		}
+	}
+	return "http://localhost:11434"
+}
+
+// parseCount parses a count such as 5000, 100k or 1m.
+func parseCount(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult, s = 1000, s[:len(s)-1]
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		mult, s = 1000000, s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive count", s)
+	}
+	return n * mult, nil
+}
+
+// The synthetic corpus is made of operations questions, combined from these
+// lists so every prompt is distinct. Novel queries use their own lists and
+// never match a stored prompt.
+var (
+	loadSubjects = []string{"Kubernetes", "Postgres", "Envoy", "Kafka", "Redis", "Terraform", "nginx",
+		"Prometheus", "Grafana", "Docker", "Helm", "Istio", "Vault", "Consul", "etcd", "Cilium",
+		"Elasticsearch", "RabbitMQ", "MySQL", "Argo CD"}
+	loadVerbs = []string{"configure", "upgrade", "debug", "monitor", "scale", "secure", "back up",
+		"migrate", "tune", "rotate", "audit", "restore"}
+	loadObjects = []string{"TLS certificates", "replicas", "memory limits", "log rotation",
+		"connection pools", "rate limits", "health checks", "network policies", "secrets",
+		"indexes", "storage volumes", "access tokens", "alert rules", "retention settings",
+		"load balancers", "DNS records"}
+	loadContexts = []string{"in production", "on a staging cluster", "behind a load balancer",
+		"with Helm", "on bare metal", "in a multi-tenant setup", "during a rolling update",
+		"across regions", "on ARM nodes", "with zero downtime", "in an air-gapped network",
+		"for a high-traffic service"}
+	novelTopics = []string{"bake sourdough bread", "train for a marathon", "repot an orchid",
+		"tune a guitar", "brew cold coffee", "plan a road trip", "knit a scarf", "fix a bike chain"}
+)
+
+// corpus generates the i-th synthetic prompt on demand, so a million
+// entries don't sit in memory.
+type corpus struct{ n int }
+
+// parts returns the subject, verb, object and setting of prompt i; past
+// the combinations of the lists, a variant number keeps prompts distinct.
+func (c corpus) parts(i int) (subject, verb, object, setting string, variant int) {
+	// spread neighbouring indexes over the lists so small corpora still
+	// cover every subject
+	j := i
+	subject = loadSubjects[j%len(loadSubjects)]
+	j /= len(loadSubjects)
+	verb = loadVerbs[j%len(loadVerbs)]
+	j /= len(loadVerbs)
+	object = loadObjects[j%len(loadObjects)]
+	j /= len(loadObjects)
+	setting = loadContexts[j%len(loadContexts)]
+	return subject, verb, object, setting, j / len(loadContexts)
+}
+
+func (c corpus) prompt(i int) string {
+	subject, verb, object, setting, variant := c.parts(i)
+	p := fmt.Sprintf("How do I %s %s for %s %s?", verb, object, subject, setting)
+	if variant > 0 {
+		p = fmt.Sprintf("How do I %s %s for %s %s (case %d)?", verb, object, subject, setting, variant)
+	}
+	return p
+}
+
+func (c corpus) entry(i int, namespace string) models.Entry {
+	subject, verb, object, _, _ := c.parts(i)
+	return models.Entry{
+		Prompt:   c.prompt(i),
+		Response: fmt.Sprintf("To %s %s for %s, follow the runbook in the %s documentation. (synthetic answer %d)", verb, object, subject, subject, i),
+		Metadata: map[string]interface{}{models.MetaNamespace: namespace, "source": "slmcachectl-load"},
+	}
+}
+
+// paraphraser rewords corpus prompt i; pick is a random number it may use
+// to vary the wording.
+type paraphraser func(ctx context.Context, c corpus, i int, pick uint64) (string, error)
+
+var paraphraseForms = []string{
+	"What's the best way to %[1]s %[2]s for %[3]s %[4]s?",
+	"%[3]s: how can I %[1]s %[2]s %[4]s?",
+	"Steps to %[1]s the %[2]s of %[3]s %[4]s",
+	"I need to %[1]s %[2]s for %[3]s %[4]s, how?",
+}
+
+// templateParaphrase rewords a corpus prompt without a model.
+func templateParaphrase(ctx context.Context, c corpus, i int, pick uint64) (string, error) {
+	subject, verb, object, setting, variant := c.parts(i)
+	p := fmt.Sprintf(paraphraseForms[pick%uint64(len(paraphraseForms))], verb, object, subject, setting)
+	if variant > 0 {
+		p += fmt.Sprintf(" (case %d)", variant)
+	}
+	return p, nil
+}
+
+// generatedParaphrase asks a generative model to reword corpus prompts.
+// Each prompt is paraphrased once and reused, so the model doesn't cap the
+// search rate.
+func generatedParaphrase(gen slm.Generator) paraphraser {
+	var mu sync.Mutex
+	seen := map[int]string{}
+	return func(ctx context.Context, c corpus, i int, _ uint64) (string, error) {
+		mu.Lock()
+		p, ok := seen[i]
+		mu.Unlock()
+		if ok {
+			return p, nil
+		}
+		out, err := gen.Generate(ctx, "Rewrite this question in different words, keeping its meaning. Reply with the question only.\n\n"+c.prompt(i))
+		if err != nil {
+			return "", err
+		}
+		p = strings.TrimSpace(out.Text)
+		mu.Lock()
+		seen[i] = p
+		mu.Unlock()
+		return p, nil
+	}
+}
+
+type loadTest struct {
+	client     *client.Client
+	corpus     corpus
+	namespace  string
+	novel      float64
+	paraphrase paraphraser
+	progress   io.Writer
+
+	mu  sync.Mutex // guards rng
+	rng *rand.Rand
+}
+
+// fill stores the corpus in batches.
+func (lt *loadTest) fill(ctx context.Context, batch int) error {
+	entries := make([]models.Entry, 0, batch)
+	for i := 0; i < lt.corpus.n; i++ {
+		entries = append(entries, lt.corpus.entry(i, lt.namespace))
+		if len(entries) < batch && i < lt.corpus.n-1 {
+			continue
+		}
+		results, err := lt.client.CreateBatch(ctx, entries)
+		if err != nil {
+			return fmt.Errorf("entries %d-%d: %w", i+1-len(entries), i, err)
+		}
+		for _, res := range results {
+			if res.Error != "" {
+				return fmt.Errorf("entry %d: %s", i+1-len(entries)+res.Index, res.Error)
+			}
+		}
+		entries = entries[:0]
+		fmt.Fprintf(lt.progress, "\r%d of %d entries stored", i+1, lt.corpus.n)
+	}
+	fmt.Fprintln(lt.progress)
+	return nil
+}
+
+// query picks the next search: a novel topic, or a stored prompt (or its
+// paraphrase) with the index of the entry it should find.
+func (lt *loadTest) query(ctx context.Context) (text string, want int, err error) {
+	lt.mu.Lock()
+	novel := lt.rng.Float64() < lt.novel
+	topic, i, pick := lt.rng.IntN(len(novelTopics)), lt.rng.IntN(lt.corpus.n), lt.rng.Uint64()
+	lt.mu.Unlock()
+	switch {
+	case novel:
+		return fmt.Sprintf("How do I %s?", novelTopics[topic]), -1, nil
+	case lt.paraphrase == nil:
+		return lt.corpus.prompt(i), i, nil
+	}
+	text, err = lt.paraphrase(ctx, lt.corpus, i, pick)
+	return text, i, err
+}
+
+// loadReport summarizes a run. A hit is a search returning anything; a
+// correct hit returned the entry the query was made from, and a false hit
+// answered a novel query.
+type loadReport struct {
+	duration                        time.Duration
+	sent, dropped, errors           int
+	hits, correct, novel, falseHits int
+	latencies                       []time.Duration
+	firstError                      string
+}
+
+// drive searches at qps for d. Searches that would exceed concurrency are
+// dropped and counted rather than queued, so the offered rate stays honest.
+func (lt *loadTest) drive(ctx context.Context, qps, concurrency int, d time.Duration) *loadReport {
+	rep := &loadReport{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	tick := time.NewTicker(time.Second / time.Duration(qps))
+	defer tick.Stop()
+	start := time.Now()
+	deadline := time.After(d)
+	lastProgress := start
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		case <-tick.C:
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			mu.Lock()
+			rep.dropped++
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			lt.search(ctx, rep, &mu)
+		}()
+		if time.Since(lastProgress) >= time.Second {
+			lastProgress = time.Now()
+			mu.Lock()
+			fmt.Fprintf(lt.progress, "\r%d searches, %d hits, %d errors", rep.sent, rep.hits, rep.errors)
+			mu.Unlock()
+		}
+	}
+	wg.Wait()
+	rep.duration = time.Since(start)
+	fmt.Fprintln(lt.progress)
+	return rep
+}
+
+func (lt *loadTest) search(ctx context.Context, rep *loadReport, mu *sync.Mutex) {
+	text, want, err := lt.query(ctx)
+	if err != nil {
+		mu.Lock()
+		rep.errors++
+		if rep.firstError == "" {
+			rep.firstError = "paraphrase: " + err.Error()
+		}
+		mu.Unlock()
+		return
+	}
+	start := time.Now()
+	found, err := lt.client.Search(ctx, text, 1, map[string]string{models.MetaNamespace: lt.namespace})
+	took := time.Since(start)
+	mu.Lock()
+	defer mu.Unlock()
+	rep.sent++
+	if err != nil {
+		rep.errors++
+		if rep.firstError == "" {
+			rep.firstError = err.Error()
+		}
+		return
+	}
+	rep.latencies = append(rep.latencies, took)
+	if want < 0 {
+		rep.novel++
+	}
+	if len(found) == 0 {
+		return
+	}
+	rep.hits++
+	switch {
+	case want < 0:
+		rep.falseHits++
+	case found[0].Prompt == lt.corpus.prompt(want):
+		rep.correct++
+	}
+}
+
+func (r *loadReport) write(w io.Writer) {
+	pct := func(n, of int) float64 {
+		if of == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(of)
+	}
+	ok := r.sent - r.errors
+	fmt.Fprintf(w, "searches:    %d in %s (%.1f/s), %d dropped at the concurrency limit, %d errors\n",
+		r.sent, r.duration.Round(time.Millisecond), float64(r.sent)/r.duration.Seconds(), r.dropped, r.errors)
+	fmt.Fprintf(w, "hit rate:    %.1f%% (%d of %d)\n", pct(r.hits, ok), r.hits, ok)
+	fmt.Fprintf(w, "correct:     %.1f%% of corpus queries found their entry\n", pct(r.correct, ok-r.novel))
+	fmt.Fprintf(w, "false hits:  %.1f%% of %d novel queries\n", pct(r.falseHits, r.novel), r.novel)
+	if len(r.latencies) > 0 {
+		slices.Sort(r.latencies)
+		q := func(p float64) time.Duration {
+			return r.latencies[int(p*float64(len(r.latencies)-1))].Round(10 * time.Microsecond)
+		}
+		fmt.Fprintf(w, "latency:     p50 %s  p90 %s  p99 %s  max %s\n", q(0.5), q(0.9), q(0.99), q(1))
+	}
+	if r.firstError != "" {
+		fmt.Fprintf(w, "first error: %s\n", r.firstError)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/client"
+	"github.com/jeefy/slmcache/internal/server"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+func TestParseCount(t *testing.T) {
+	for in, want := range map[string]int{"5000": 5000, "100k": 100000, "2M": 2000000} {
+		if got, err := parseCount(in); err != nil || got != want {
+			t.Errorf("parseCount(%q): expected %d got %d (%v)", in, want, got, err)
+		}
+	}
+	for _, in := range []string{"", "k", "-1", "1.5k"} {
+		if _, err := parseCount(in); err == nil {
+			t.Errorf("parseCount(%q): expected an error", in)
+		}
+	}
+}
+
+func TestCorpusDistinct(t *testing.T) {
+	c := corpus{n: 60000}
+	seen := map[string]bool{}
+	for i := 0; i < c.n; i++ {
+		p := c.prompt(i)
+		if seen[p] {
+			t.Fatalf("expected distinct prompts, %q repeats at %d", p, i)
+		}
+		seen[p] = true
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	st, _ := store.New()
+	srv := server.New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	lt := &loadTest{client: client.New(ts.URL), corpus: corpus{n: 50}, namespace: "loadtest",
+		rng: rand.New(rand.NewPCG(1, 2)), progress: io.Discard}
+	if err := lt.fill(context.Background(), 20); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(st.AllIDs()); n != 50 {
+		t.Fatalf("expected 50 entries stored got %d", n)
+	}
+	rep := lt.drive(context.Background(), 200, 4, 200*time.Millisecond)
+	if rep.sent == 0 || rep.errors != 0 || rep.correct != rep.sent || len(rep.latencies) != rep.sent {
+		t.Fatalf("expected every exact query to find its entry got %+v", rep)
+	}
+}
@@ -0,0 +1,75 @@
+// Command slmcachectl is the operator CLI for slmcache.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/client"
+	"github.com/jeefy/slmcache/internal/config"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"import", "bulk-load prompt/response pairs from CSV or JSONL", runImport},
+	{"backup", "write a consistent snapshot of the store to a file", runBackup},
+	{"restore", "replace the store with a backup, optionally to a point in time", runRestore},
+	{"load", "store a synthetic corpus and search it at a fixed rate, reporting hit rate and latency", runLoad},
+	{"doctor", "run a server's self-test of its config, store and SLM backend", runDoctor},
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "slmcachectl %s: %v\n", c.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "slmcachectl: unknown command %q\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: slmcachectl <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+}
+
+// defaultServer is the slmcache base URL unless --server is given.
+func defaultServer() string {
+	if v := strings.TrimSpace(os.Getenv("SLMCACHE_URL")); v != "" {
+		return v
+	}
+	return "http://localhost:8080"
+}
+
+// newClient returns a client for server authenticated with SLMCACHE_API_KEY
+// (or the file named by SLMCACHE_API_KEY_FILE).
+func newClient(server string) *client.Client {
+	c := client.New(server)
+	c.APIKey = config.Secret("SLMCACHE_API_KEY")
+	return c
+}
+
+// multiFlag collects a repeatable string flag.
+type multiFlag []string
+
+func (m *multiFlag) String() string     { return strings.Join(*m, ",") }
+func (m *multiFlag) Set(v string) error { *m = append(*m, v); return nil }
@@ -0,0 +1,93 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func roundTrip(t *testing.T, st Store) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := st.Get(ctx, "entry-1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing blob got %v", err)
+	}
+	for _, data := range []string{"first", "second"} {
+		if err := st.Put(ctx, "entry-1", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rc, err := st.Get(ctx, "entry-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "second" {
+		t.Fatalf("expected the replaced blob got %q", got)
+	}
+	if err := st.Delete(ctx, "entry-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete(ctx, "entry-1"); err != nil {
+		t.Fatalf("expected deleting a missing blob to succeed got %v", err)
+	}
+	if _, err := st.Get(ctx, "entry-1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the blob gone got %v", err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	st, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, st)
+	if err := st.Put(context.Background(), "../escape", []byte("x")); err == nil {
+		t.Fatalf("expected a key leaving the directory refused")
+	}
+}
+
+func TestS3(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") ||
+			!strings.Contains(auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date,") {
+			http.Error(w, "bad signature: "+auth, http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(data)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+	st, err := NewS3(S3Config{Endpoint: srv.URL, Region: "eu-west-1", Bucket: "cache", Prefix: "blobs/", AccessKey: "AKID", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, st)
+	_ = st.Put(context.Background(), "entry-2", []byte("x"))
+	if _, ok := objects["/cache/blobs/entry-2"]; !ok {
+		t.Fatalf("expected path-style keys under the prefix got %v", objects)
+	}
+}
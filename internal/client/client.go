@@ -0,0 +1,148 @@
+// Package client is a thin HTTP client for the slmcache API used by
+// slmcachectl.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// Client talks to one slmcache instance.
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	// APIKey is sent as a bearer token when set.
+	APIKey string
+}
+
+// New returns a client for baseURL (e.g. "http://localhost:8080").
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		HTTP:    &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// CreateBatch stores entries via POST /entries/batch and returns one result
+// per entry.
+func (c *Client) CreateBatch(ctx context.Context, entries []models.Entry) ([]models.BatchResult, error) {
+	var out []models.BatchResult
+	if err := c.do(ctx, http.MethodPost, "/entries/batch", entries, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Backup streams a snapshot of the store (GET /admin/backup) to w. The
+// server pauses writes while the snapshot is taken.
+func (c *Client) Backup(ctx context.Context, w io.Writer) error {
+	resp, err := c.send(ctx, http.MethodGet, "/admin/backup", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Restore replaces the store with the backup read from r (POST
+// /admin/restore). A non-zero at rolls the backup forward through the
+// server's write-ahead log to that time.
+func (c *Client) Restore(ctx context.Context, r io.Reader, at time.Time) (*models.RestoreResult, error) {
+	path := "/admin/restore"
+	if !at.IsZero() {
+		path += "?at=" + url.QueryEscape(at.UTC().Format(time.RFC3339Nano))
+	}
+	resp, err := c.send(ctx, http.MethodPost, path, r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out models.RestoreResult
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Search returns up to limit entries matching query (GET /search), limited
+// to entries whose metadata equals filters.
+func (c *Client) Search(ctx context.Context, query string, limit int, filters map[string]string) ([]models.Entry, error) {
+	v := url.Values{"q": {query}, "limit": {strconv.Itoa(limit)}}
+	for k, f := range filters {
+		v.Set("metadata."+k, f)
+	}
+	var out []models.Entry
+	if err := c.do(ctx, http.MethodGet, "/search?"+v.Encode(), nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Doctor runs the server's self-test (GET /admin/doctor).
+func (c *Client) Doctor(ctx context.Context) (*models.DoctorReport, error) {
+	var out models.DoctorReport
+	if err := c.do(ctx, http.MethodGet, "/admin/doctor", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// do sends body as JSON (when non-nil) and decodes a JSON response into out
+// (when non-nil).
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	resp, err := c.send(ctx, method, path, rd)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send issues a request with a JSON body (when non-nil) and returns the
+// response for the caller to read and close. Non-2xx responses become errors
+// carrying the body text.
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,187 @@
+// Package cluster runs slmcache as a raft cluster for teams that need high
+// availability without an external database. Every write is appended to a
+// replicated log and applied, in the same order, to each node's local store;
+// reads are served from the local copy on any node. When the leader fails
+// the remaining nodes elect a new one and writes resume.
+//
+// A cluster needs three or more nodes to survive the loss of one.
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// Peer is one cluster member: its raft ID, the address its raft transport
+// listens on, and the base URL of its HTTP API (used to forward writes to
+// the leader).
+type Peer struct {
+	ID       string
+	RaftAddr string
+	HTTPURL  string
+}
+
+// ParsePeers parses a comma-separated list of id=raft_addr=http_url, e.g.
+// "a=10.0.0.1:7000=http://10.0.0.1:8080,b=...".
+func ParsePeers(spec string) ([]Peer, error) {
+	var out []Peer
+	seen := map[string]bool{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("cluster: bad peer %q: want id=raft_addr=http_url", item)
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("cluster: duplicate peer id %q", parts[0])
+		}
+		seen[parts[0]] = true
+		out = append(out, Peer{ID: parts[0], RaftAddr: parts[1], HTTPURL: strings.TrimRight(parts[2], "/")})
+	}
+	if len(out) == 0 {
+		return nil, errors.New("cluster: no peers")
+	}
+	return out, nil
+}
+
+// Config describes the local node.
+type Config struct {
+	// ID is this node's ID; it must appear in Peers.
+	ID string
+	// BindAddr is the local raft listen address (defaults to the node's
+	// RaftAddr from Peers).
+	BindAddr string
+	// DataDir holds the raft log and snapshots.
+	DataDir string
+	// Peers is the full initial membership, identical on every node.
+	Peers []Peer
+
+	// tune adjusts the raft configuration (tests shorten timeouts).
+	tune func(*raft.Config)
+}
+
+// Node is a running cluster member.
+type Node struct {
+	raft  *raft.Raft
+	self  Peer
+	peers map[raft.ServerID]Peer
+	local store.Store
+	trans *raft.NetworkTransport
+	logs  *raftboltdb.BoltStore
+	store *replicatedStore
+}
+
+// applyTimeout bounds how long a write waits for the cluster to commit it.
+const applyTimeout = 5 * time.Second
+
+// Open starts the local node on top of local, which holds this node's copy
+// of the data and must implement store.Snapshotter. A node with no existing
+// raft state bootstraps the cluster from cfg.Peers; every node is given the
+// same membership, so it is safe for all of them to do so.
+func Open(cfg Config, local store.Store) (*Node, error) {
+	if _, ok := local.(store.Snapshotter); !ok {
+		return nil, errors.New("cluster: store does not support snapshots")
+	}
+	n := &Node{local: local, peers: map[raft.ServerID]Peer{}}
+	servers := make([]raft.Server, 0, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		n.peers[raft.ServerID(p.ID)] = p
+		servers = append(servers, raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.RaftAddr)})
+		if p.ID == cfg.ID {
+			n.self = p
+		}
+	}
+	if n.self.ID == "" {
+		return nil, fmt.Errorf("cluster: node %q is not in the peer list", cfg.ID)
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(cfg.ID)
+	if cfg.tune != nil {
+		cfg.tune(rc)
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", n.self.RaftAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: resolve %s: %w", n.self.RaftAddr, err)
+	}
+	bind := cfg.BindAddr
+	if bind == "" {
+		bind = n.self.RaftAddr
+	}
+	if n.trans, err = raft.NewTCPTransport(bind, advertise, 3, 10*time.Second, os.Stderr); err != nil {
+		return nil, err
+	}
+	if n.logs, err = raftboltdb.NewBoltStore(filepath.Join(cfg.DataDir, "raft.db")); err != nil {
+		n.trans.Close()
+		return nil, err
+	}
+	snaps, err := raft.NewFileSnapshotStore(cfg.DataDir, 2, os.Stderr)
+	if err != nil {
+		n.close()
+		return nil, err
+	}
+	existing, err := raft.HasExistingState(n.logs, n.logs, snaps)
+	if err != nil {
+		n.close()
+		return nil, err
+	}
+	if !existing {
+		if err := raft.BootstrapCluster(rc, n.logs, n.logs, snaps, n.trans, raft.Configuration{Servers: servers}); err != nil {
+			n.close()
+			return nil, err
+		}
+	}
+	if n.raft, err = raft.NewRaft(rc, &fsm{st: local}, n.logs, n.logs, snaps, n.trans); err != nil {
+		n.close()
+		return nil, err
+	}
+	n.store = &replicatedStore{Store: local, node: n}
+	return n, nil
+}
+
+// Store returns the replicated store: reads are local, writes go through
+// the raft log and fail with ErrNotLeader on followers.
+func (n *Node) Store() store.Store { return n.store }
+
+// IsLeader reports whether this node currently accepts writes.
+func (n *Node) IsLeader() bool { return n.raft.State() == raft.Leader }
+
+// Leader returns the current leader, if one is known.
+func (n *Node) Leader() (Peer, bool) {
+	_, id := n.raft.LeaderWithID()
+	p, ok := n.peers[id]
+	return p, ok
+}
+
+// Close leaves the cluster's replication loop and releases the raft log.
+// The local store is left open.
+func (n *Node) Close() error {
+	err := n.raft.Shutdown().Error()
+	n.close()
+	return err
+}
+
+func (n *Node) close() {
+	if n.trans != nil {
+		n.trans.Close()
+	}
+	if n.logs != nil {
+		n.logs.Close()
+	}
+}
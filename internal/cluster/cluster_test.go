@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func fast(c *raft.Config) {
+	c.HeartbeatTimeout = 100 * time.Millisecond
+	c.ElectionTimeout = 100 * time.Millisecond
+	c.LeaderLeaseTimeout = 50 * time.Millisecond
+	c.CommitTimeout = 5 * time.Millisecond
+	c.LogLevel = "ERROR"
+}
+
+func startCluster(t *testing.T, size int) []*Node {
+	t.Helper()
+	peers := make([]Peer, size)
+	for i := range peers {
+		peers[i] = Peer{ID: fmt.Sprintf("n%d", i), RaftAddr: freeAddr(t), HTTPURL: "http://unused"}
+	}
+	nodes := make([]*Node, size)
+	for i, p := range peers {
+		local, _ := store.New()
+		n, err := Open(Config{ID: p.ID, DataDir: t.TempDir(), Peers: peers, tune: fast}, local)
+		if err != nil {
+			t.Fatalf("open %s: %v", p.ID, err)
+		}
+		nodes[i] = n
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			if n != nil {
+				n.Close()
+			}
+		}
+	})
+	return nodes
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func leaderOf(nodes []*Node) int {
+	for i, n := range nodes {
+		if n != nil && n.IsLeader() {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestCluster_ReplicatesAndFailsOver(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+	waitFor(t, "leader", func() bool { return leaderOf(nodes) >= 0 })
+	li := leaderOf(nodes)
+	follower := nodes[(li+1)%3]
+
+	if _, err := follower.Store().CreateEntryWithVector(ctx, &models.Entry{Prompt: "p"}, []float64{1}); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader on follower got %v", err)
+	}
+	e := &models.Entry{Prompt: "What is raft?", Response: "consensus"}
+	id, err := nodes[li].Store().CreateEntryWithVector(ctx, e, []float64{1, 0})
+	if err != nil || e.ID != id || e.UpdatedAt.IsZero() {
+		t.Fatalf("create: id=%d entry=%+v err=%v", id, e, err)
+	}
+	// follower reads see the replicated entry with the same ID
+	waitFor(t, "replication", func() bool {
+		got, err := follower.Store().GetEntry(ctx, id)
+		return err == nil && got.Prompt == "What is raft?" && got.CreatedAt.Equal(e.CreatedAt)
+	})
+
+	nodes[li].Close()
+	nodes[li] = nil
+	waitFor(t, "new leader", func() bool { return leaderOf(nodes) >= 0 })
+	nl := nodes[leaderOf(nodes)]
+	if err := nl.Store().UpdateEntryMetadata(ctx, id, map[string]interface{}{"k": "v"}, false); err != nil {
+		t.Fatalf("write after failover: %v", err)
+	}
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		waitFor(t, "metadata replication", func() bool {
+			got, err := n.Store().GetEntry(ctx, id)
+			return err == nil && got.Metadata["k"] == "v"
+		})
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers("a=10.0.0.1:7000=http://10.0.0.1:8080/, b=10.0.0.2:7000=http://10.0.0.2:8080")
+	if err != nil || len(peers) != 2 || peers[0].HTTPURL != "http://10.0.0.1:8080" || peers[1].RaftAddr != "10.0.0.2:7000" {
+		t.Fatalf("unexpected peers %+v (%v)", peers, err)
+	}
+	if _, err := ParsePeers("a=10.0.0.1:7000"); err == nil {
+		t.Fatal("expected error for peer without http url")
+	}
+	if _, err := ParsePeers("a=x=y,a=x=y"); err == nil {
+		t.Fatal("expected error for duplicate id")
+	}
+}
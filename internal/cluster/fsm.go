@@ -0,0 +1,172 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+type op string
+
+const (
+	opCreate          op = "create"
+	opUpdate          op = "update"
+	opDelete          op = "delete"
+	opUpdateMetadata  op = "update_metadata"
+	opDeleteMetadata  op = "delete_metadata"
+	opUpdateWhere     op = "update_metadata_where"
+	opRestore         op = "restore"
+	opSetSynonyms     op = "set_synonyms"
+	opPutNamespace    op = "put_namespace"
+	opDeleteNamespace op = "delete_namespace"
+	opAppendOutbox    op = "append_outbox"
+	opAckOutbox       op = "ack_outbox"
+	opConsumeServe    op = "consume_serve"
+	opRecordHits      op = "record_hits"
+)
+
+// command is one replicated write. Commands are applied to every node's
+// store in log order, so entry IDs assigned by creates agree across nodes.
+type command struct {
+	Op       op                     `json:"op"`
+	ID       int64                  `json:"id,omitempty"`
+	Entry    *models.Entry          `json:"entry,omitempty"`
+	Vector   []float64              `json:"vector,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Replace  bool                   `json:"replace,omitempty"`
+	Keys     []string               `json:"keys,omitempty"`
+	// Filters selects the entries a bulk metadata update patches.
+	Filters  map[string]string `json:"filters,omitempty"`
+	Snapshot *store.Snapshot   `json:"snapshot,omitempty"`
+	// Namespace and Synonyms are a namespace's new synonym dictionary.
+	Namespace string            `json:"namespace,omitempty"`
+	Synonyms  map[string]string `json:"synonyms,omitempty"`
+	// Settings are a namespace declared or updated.
+	Settings *models.Namespace `json:"settings,omitempty"`
+	// Outbox and Seqs are outbound messages appended or acknowledged.
+	Outbox []store.OutboxMessage `json:"outbox,omitempty"`
+	Seqs   []uint64              `json:"seqs,omitempty"`
+	// Hits are entries' serves to add to their statistics.
+	Hits map[int64]store.Hits `json:"hits,omitempty"`
+}
+
+// applyResult is what fsm.Apply hands back to the writer on the leader.
+// ids lists the entries a bulk command changed.
+type applyResult struct {
+	id  int64
+	ids []int64
+	err error
+}
+
+// fsm applies committed commands to the local store.
+type fsm struct {
+	st store.Store
+}
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var c command
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		return applyResult{err: err}
+	}
+	ctx := context.Background()
+	switch c.Op {
+	case opCreate:
+		id, err := f.st.CreateEntryWithVector(ctx, c.Entry, c.Vector)
+		return applyResult{id: id, err: err}
+	case opUpdate:
+		return applyResult{id: c.ID, err: f.st.UpdateEntryWithVector(ctx, c.ID, c.Entry, c.Vector)}
+	case opDelete:
+		return applyResult{id: c.ID, err: f.st.DeleteEntry(ctx, c.ID)}
+	case opUpdateMetadata:
+		return applyResult{id: c.ID, err: f.st.UpdateEntryMetadata(ctx, c.ID, c.Metadata, c.Replace)}
+	case opDeleteMetadata:
+		return applyResult{id: c.ID, err: f.st.DeleteEntryMetadata(ctx, c.ID, c.Keys...)}
+	case opUpdateWhere:
+		ids, err := store.BulkUpdate(f.st).UpdateMetadataWhere(ctx, c.Filters, c.Metadata)
+		return applyResult{ids: ids, err: err}
+	case opConsumeServe:
+		sl, ok := f.st.(store.ServeLimiter)
+		if !ok {
+			return applyResult{err: errors.New("cluster: store does not limit serves")}
+		}
+		left, err := sl.ConsumeServe(ctx, c.ID)
+		return applyResult{id: int64(left), err: err}
+	case opRecordHits:
+		hr, ok := f.st.(store.HitRecorder)
+		if !ok {
+			return applyResult{err: errors.New("cluster: store does not record hits")}
+		}
+		return applyResult{err: hr.RecordHits(ctx, c.Hits)}
+	case opRestore:
+		return applyResult{err: f.st.(store.Snapshotter).Restore(ctx, c.Snapshot)}
+	case opSetSynonyms:
+		ss, ok := f.st.(store.SynonymStore)
+		if !ok {
+			return applyResult{err: errors.New("cluster: store does not persist synonyms")}
+		}
+		return applyResult{err: ss.SetSynonyms(ctx, c.Namespace, c.Synonyms)}
+	case opPutNamespace, opDeleteNamespace:
+		ns, ok := f.st.(store.NamespaceStore)
+		if !ok {
+			return applyResult{err: errors.New("cluster: store does not persist namespaces")}
+		}
+		if c.Op == opPutNamespace {
+			return applyResult{err: ns.PutNamespace(ctx, *c.Settings)}
+		}
+		return applyResult{err: ns.DeleteNamespace(ctx, c.Namespace)}
+	case opAppendOutbox, opAckOutbox:
+		ob, ok := f.st.(store.Outbox)
+		if !ok {
+			return applyResult{err: errors.New("cluster: store does not persist an outbox")}
+		}
+		if c.Op == opAppendOutbox {
+			return applyResult{err: ob.AppendOutbox(ctx, c.Outbox)}
+		}
+		return applyResult{err: ob.AckOutbox(ctx, c.Seqs...)}
+	}
+	return applyResult{err: errors.New("cluster: unknown command " + string(c.Op))}
+}
+
+// Snapshot only freezes the store: raft runs Persist concurrently with
+// Apply, so the copy is made there without holding up the log.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	build, err := store.Freeze(context.Background(), f.st.(store.Snapshotter))
+	if err != nil {
+		return nil, err
+	}
+	return fsmSnapshot{build}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap store.Snapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+	return f.st.(store.Snapshotter).Restore(context.Background(), &snap)
+}
+
+type fsmSnapshot struct {
+	build func() (*store.Snapshot, error)
+}
+
+func (s fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	snap, err := s.build()
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	if err := json.NewEncoder(sink).Encode(snap); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (fsmSnapshot) Release() {}
@@ -0,0 +1,62 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// forwardedHeader marks a write forwarded by a follower, so a node that
+// lost leadership in the meantime answers 503 instead of bouncing it on.
+const forwardedHeader = "X-SLMCache-Forwarded"
+
+// Forward wraps the HTTP API so followers proxy every non-GET request to
+// the leader. GET and HEAD requests are served locally (follower reads).
+func (n *Node) Forward(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || n.IsLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		leader, ok := n.Leader()
+		if !ok || r.Header.Get(forwardedHeader) != "" {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "no raft leader available", http.StatusServiceUnavailable)
+			return
+		}
+		target, err := url.Parse(leader.HTTPURL)
+		if err != nil {
+			http.Error(w, "bad leader url: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.Header.Set(forwardedHeader, n.self.ID)
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	})
+}
+
+type status struct {
+	ID        string            `json:"id"`
+	State     string            `json:"state"`
+	Leader    string            `json:"leader,omitempty"`
+	LastIndex uint64            `json:"last_index"`
+	Peers     map[string]string `json:"peers"`
+}
+
+// GET /cluster/status
+func (n *Node) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	st := status{
+		ID:        n.self.ID,
+		State:     n.raft.State().String(),
+		LastIndex: n.raft.AppliedIndex(),
+		Peers:     make(map[string]string, len(n.peers)),
+	}
+	if l, ok := n.Leader(); ok {
+		st.Leader = l.ID
+	}
+	for id, p := range n.peers {
+		st.Peers[string(id)] = p.HTTPURL
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
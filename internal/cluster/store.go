@@ -0,0 +1,261 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// ErrNotLeader is returned for writes on a follower. The HTTP API forwards
+// writes to the leader (see Node.Forward), so callers normally never see it.
+var ErrNotLeader = errors.New("cluster: not the leader")
+
+// replicatedStore serves reads from the local store and sends writes
+// through the raft log.
+type replicatedStore struct {
+	store.Store
+	node *Node
+}
+
+func (s *replicatedStore) apply(c command) (int64, error) {
+	res, err := s.commit(c)
+	if err != nil {
+		return 0, err
+	}
+	return res.id, res.err
+}
+
+// commit sends c through the raft log and returns its result on this node.
+func (s *replicatedStore) commit(c command) (applyResult, error) {
+	if !s.node.IsLeader() {
+		return applyResult{}, ErrNotLeader
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return applyResult{}, err
+	}
+	f := s.node.raft.Apply(data, applyTimeout)
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return applyResult{}, ErrNotLeader
+		}
+		return applyResult{}, err
+	}
+	return f.Response().(applyResult), nil
+}
+
+// refresh copies the applied entry back into e, matching the local store's
+// behaviour of filling in ID and timestamps on write.
+func (s *replicatedStore) refresh(ctx context.Context, id int64, e *models.Entry) {
+	if got, err := s.Store.GetEntry(ctx, id); err == nil {
+		*e = *got
+	}
+}
+
+func (s *replicatedStore) CreateEntryWithVector(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
+	if e == nil {
+		return 0, errors.New("nil entry")
+	}
+	// stamp creation time here so every node stores the same value
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	id, err := s.apply(command{Op: opCreate, Entry: e, Vector: vec})
+	if err != nil {
+		return 0, err
+	}
+	s.refresh(ctx, id, e)
+	return id, nil
+}
+
+func (s *replicatedStore) UpdateEntryWithVector(ctx context.Context, id int64, e *models.Entry, vec []float64) error {
+	if _, err := s.apply(command{Op: opUpdate, ID: id, Entry: e, Vector: vec}); err != nil {
+		return err
+	}
+	s.refresh(ctx, id, e)
+	return nil
+}
+
+func (s *replicatedStore) DeleteEntry(ctx context.Context, id int64) error {
+	_, err := s.apply(command{Op: opDelete, ID: id})
+	return err
+}
+
+func (s *replicatedStore) UpdateEntryMetadata(ctx context.Context, id int64, metadata map[string]interface{}, replace bool) error {
+	_, err := s.apply(command{Op: opUpdateMetadata, ID: id, Metadata: metadata, Replace: replace})
+	return err
+}
+
+func (s *replicatedStore) DeleteEntryMetadata(ctx context.Context, id int64, keys ...string) error {
+	_, err := s.apply(command{Op: opDeleteMetadata, ID: id, Keys: keys})
+	return err
+}
+
+// UpdateMetadataWhere replicates the filter rather than the matching IDs,
+// so every node patches the same entries in log order.
+func (s *replicatedStore) UpdateMetadataWhere(ctx context.Context, filters map[string]string, metadata map[string]interface{}) ([]int64, error) {
+	res, err := s.commit(command{Op: opUpdateWhere, Filters: filters, Metadata: metadata})
+	if err != nil {
+		return nil, err
+	}
+	return res.ids, res.err
+}
+
+// CompressionStats reads the local copy.
+func (s *replicatedStore) CompressionStats() store.CompressionStats {
+	if cr, ok := s.Store.(store.CompressionReporter); ok {
+		return cr.CompressionStats()
+	}
+	return store.CompressionStats{}
+}
+
+// GetVector reads the local copy.
+func (s *replicatedStore) GetVector(ctx context.Context, id int64) ([]float64, error) {
+	vg, ok := s.Store.(store.VectorGetter)
+	if !ok {
+		return nil, errors.New("store does not expose vectors")
+	}
+	return vg.GetVector(ctx, id)
+}
+
+// SearchByVectorFiltered reads the local copy; the server only calls it
+// when the local store reports filtered search.
+func (s *replicatedStore) SearchByVectorFiltered(ctx context.Context, vec []float64, limit int, filters map[string]string) ([]int64, []float64, error) {
+	fs, ok := s.Store.(store.FilteredSearcher)
+	if !ok {
+		return nil, nil, errors.New("store does not support filtered search")
+	}
+	return fs.SearchByVectorFiltered(ctx, vec, limit, filters)
+}
+
+// SearchByVectorFrom reads the local copy; the server only calls it when
+// the local store reports embedder search.
+func (s *replicatedStore) SearchByVectorFrom(ctx context.Context, vec []float64, limit int, embedder *models.Embedder, filters map[string]string) ([]int64, []float64, error) {
+	es, ok := s.Store.(store.EmbedderSearcher)
+	if !ok {
+		return nil, nil, errors.New("store does not support embedder search")
+	}
+	return es.SearchByVectorFrom(ctx, vec, limit, embedder, filters)
+}
+
+// Health fails while the node doesn't know a leader, since writes can't be
+// committed then, or when the local store is unhealthy.
+func (s *replicatedStore) Health(ctx context.Context) error {
+	if _, ok := s.node.Leader(); !ok {
+		return errors.New("cluster: no leader")
+	}
+	return store.Health(ctx, s.Store)
+}
+
+func (s *replicatedStore) Capabilities() store.Capabilities {
+	return store.CapabilitiesOf(s.Store)
+}
+
+// Snapshot reads the local copy.
+func (s *replicatedStore) Snapshot(ctx context.Context) (*store.Snapshot, error) {
+	return s.Store.(store.Snapshotter).Snapshot(ctx)
+}
+
+// Freeze freezes the local copy.
+func (s *replicatedStore) Freeze(ctx context.Context) (func() (*store.Snapshot, error), error) {
+	return store.Freeze(ctx, s.Store.(store.Snapshotter))
+}
+
+// Restore replaces the contents of every node's store.
+func (s *replicatedStore) Restore(ctx context.Context, snap *store.Snapshot) error {
+	_, err := s.apply(command{Op: opRestore, Snapshot: snap})
+	return err
+}
+
+// Synonyms reads the local copy.
+func (s *replicatedStore) Synonyms(ctx context.Context) (map[string]map[string]string, error) {
+	ss, ok := s.Store.(store.SynonymStore)
+	if !ok {
+		return nil, errors.New("store does not persist synonyms")
+	}
+	return ss.Synonyms(ctx)
+}
+
+// SetSynonyms replaces the dictionary on every node.
+func (s *replicatedStore) SetSynonyms(ctx context.Context, namespace string, synonyms map[string]string) error {
+	_, err := s.apply(command{Op: opSetSynonyms, Namespace: namespace, Synonyms: synonyms})
+	return err
+}
+
+// Namespaces reads the local copy.
+func (s *replicatedStore) Namespaces(ctx context.Context) ([]models.Namespace, error) {
+	ns, ok := s.Store.(store.NamespaceStore)
+	if !ok {
+		return nil, errors.New("store does not persist namespaces")
+	}
+	return ns.Namespaces(ctx)
+}
+
+// PutNamespace declares the namespace on every node.
+func (s *replicatedStore) PutNamespace(ctx context.Context, ns models.Namespace) error {
+	_, err := s.apply(command{Op: opPutNamespace, Settings: &ns})
+	return err
+}
+
+// DeleteNamespace forgets the namespace on every node.
+func (s *replicatedStore) DeleteNamespace(ctx context.Context, name string) error {
+	_, err := s.apply(command{Op: opDeleteNamespace, Namespace: name})
+	return err
+}
+
+// AppendOutbox appends msgs on every node; sequence numbers agree since
+// nodes apply appends in log order.
+func (s *replicatedStore) AppendOutbox(ctx context.Context, msgs []store.OutboxMessage) error {
+	_, err := s.apply(command{Op: opAppendOutbox, Outbox: msgs})
+	return err
+}
+
+// PendingOutbox reads the local copy.
+func (s *replicatedStore) PendingOutbox(ctx context.Context, limit int) ([]store.OutboxMessage, error) {
+	ob, ok := s.Store.(store.Outbox)
+	if !ok {
+		return nil, errors.New("store does not persist an outbox")
+	}
+	return ob.PendingOutbox(ctx, limit)
+}
+
+// AckOutbox removes delivered messages on every node.
+func (s *replicatedStore) AckOutbox(ctx context.Context, seqs ...uint64) error {
+	_, err := s.apply(command{Op: opAckOutbox, Seqs: seqs})
+	return err
+}
+
+// ConsumeServe counts serves through the raft log, so the limit holds
+// across the cluster; followers can't count and return ErrNotLeader.
+func (s *replicatedStore) ConsumeServe(ctx context.Context, id int64) (int, error) {
+	if _, ok := s.Store.(store.ServeLimiter); !ok {
+		return -1, nil
+	}
+	left, err := s.apply(command{Op: opConsumeServe, ID: id})
+	return int(left), err
+}
+
+// RecordHits adds hits through the raft log, so every node's entries
+// carry the same statistics. Followers can't write and return
+// ErrNotLeader.
+func (s *replicatedStore) RecordHits(ctx context.Context, hits map[int64]store.Hits) error {
+	if _, ok := s.Store.(store.HitRecorder); !ok {
+		return nil
+	}
+	_, err := s.apply(command{Op: opRecordHits, Hits: hits})
+	return err
+}
+
+// AcquireLease grants maintenance leases to the raft leader only, so the
+// janitor and other loops run on the node that can write.
+func (s *replicatedStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	return s.node.IsLeader(), nil
+}
+
+func (s *replicatedStore) ReleaseLease(ctx context.Context, name, holder string) error { return nil }
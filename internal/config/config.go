@@ -0,0 +1,95 @@
+// Package config resolves runtime settings. Values loaded from watched
+// config files (for example a mounted ConfigMap or Secret) take precedence
+// over the process environment and can change while the server is running.
+package config
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	mu      sync.RWMutex
+	overlay = map[string]string{}
+	subs    = map[int]func(changed []string){}
+	nextSub int
+)
+
+// Get returns the value for key, preferring values loaded from watched files
+// over the process environment. Surrounding whitespace is trimmed.
+func Get(key string) string {
+	v, _ := Lookup(key)
+	return v
+}
+
+// Lookup is like Get but also reports whether the key was set anywhere.
+func Lookup(key string) (string, bool) {
+	mu.RLock()
+	v, ok := overlay[key]
+	mu.RUnlock()
+	if ok {
+		return strings.TrimSpace(v), true
+	}
+	v, ok = os.LookupEnv(key)
+	return strings.TrimSpace(v), ok
+}
+
+// OnChange registers fn to be called with the sorted list of keys whose
+// values changed after a reload. The returned func removes the subscription.
+func OnChange(fn func(changed []string)) (cancel func()) {
+	mu.Lock()
+	id := nextSub
+	nextSub++
+	subs[id] = fn
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		delete(subs, id)
+		mu.Unlock()
+	}
+}
+
+// apply replaces the overlay with values and notifies subscribers about the
+// keys that were added, removed, or modified.
+func apply(values map[string]string) []string {
+	mu.Lock()
+	changed := []string{}
+	for k, v := range values {
+		if old, ok := overlay[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range overlay {
+		if _, ok := values[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	overlay = values
+	fns := make([]func([]string), 0, len(subs))
+	for _, fn := range subs {
+		fns = append(fns, fn)
+	}
+	mu.Unlock()
+	if len(changed) == 0 {
+		return nil
+	}
+	sort.Strings(changed)
+	for _, fn := range fns {
+		fn(changed)
+	}
+	return changed
+}
+
+// HasPrefix reports whether any of keys starts with one of the prefixes.
+func HasPrefix(keys []string, prefixes ...string) bool {
+	for _, k := range keys {
+		for _, p := range prefixes {
+			if strings.HasPrefix(k, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatcherReloadsMountedFiles(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(t.TempDir(), "slmcache.env")
+	if err := os.WriteFile(envFile, []byte("# comment\nSLC_ENTRY_TTL=1h\nSLM_MIN_SCORE=\"0.5\"\n"), 0o644); err != nil {
+		t.Fatalf("write env file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "SLM_OLLAMA_URL"), []byte("http://ollama:11434\n"), 0o644); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	t.Setenv("SLM_MIN_SCORE", "0.9")
+	t.Cleanup(func() { apply(map[string]string{}) })
+
+	var notified []string
+	cancel := OnChange(func(changed []string) { notified = changed })
+	defer cancel()
+
+	w := &Watcher{Files: []string{envFile}, Dirs: []string{dir}}
+	if _, err := w.Load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := Get("SLM_MIN_SCORE"); got != "0.5" {
+		t.Fatalf("expected file value to override env, got %q", got)
+	}
+	if got := Get("SLM_OLLAMA_URL"); got != "http://ollama:11434" {
+		t.Fatalf("expected secret dir value, got %q", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "SLM_OLLAMA_URL"), []byte("http://other:11434"), 0o644); err != nil {
+		t.Fatalf("rewrite secret: %v", err)
+	}
+	changed, err := w.Load()
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !reflect.DeepEqual(changed, []string{"SLM_OLLAMA_URL"}) || !reflect.DeepEqual(notified, changed) {
+		t.Fatalf("expected only SLM_OLLAMA_URL to change, got %v (notified %v)", changed, notified)
+	}
+	if changed, _ := w.Load(); len(changed) != 0 {
+		t.Fatalf("expected no changes on identical reload, got %v", changed)
+	}
+}
+
+func TestSecretSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peer-key")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_FILE_SECRET_FILE", path)
+	if got := Secret("TEST_FILE_SECRET"); got != "from-file" {
+		t.Fatalf("expected the _FILE secret, got %q", got)
+	}
+	t.Setenv("TEST_OTHER", "elsewhere")
+	t.Setenv("TEST_ENV_SECRET", "env:TEST_OTHER")
+	if got := Secret("TEST_ENV_SECRET"); got != "elsewhere" {
+		t.Fatalf("expected the referenced variable, got %q", got)
+	}
+	t.Setenv("TEST_PLAIN_SECRET", "not:a-scheme")
+	if got := Secret("TEST_PLAIN_SECRET"); got != "not:a-scheme" {
+		t.Fatalf("expected unknown schemes to be literal, got %q", got)
+	}
+
+	// rotation: cached values are refreshed after the TTL, and a failing
+	// provider keeps the last good value
+	calls, value, fail := 0, "v1", false
+	RegisterSecretProvider("fake", SecretProviderFunc(func(_ context.Context, ref string) (string, error) {
+		calls++
+		if fail {
+			return "", errors.New("provider down")
+		}
+		return value + "/" + ref, nil
+	}))
+	t.Setenv("TEST_FAKE_SECRET", "fake:db")
+	t.Setenv("SLC_SECRET_TTL", "1h")
+	if Secret("TEST_FAKE_SECRET") != "v1/db" || Secret("TEST_FAKE_SECRET") != "v1/db" || calls != 1 {
+		t.Fatalf("expected one cached resolution, got %d calls", calls)
+	}
+	t.Setenv("SLC_SECRET_TTL", "0s")
+	value = "v2"
+	if got := Secret("TEST_FAKE_SECRET"); got != "v2/db" {
+		t.Fatalf("expected the rotated value, got %q", got)
+	}
+	fail = true
+	if got := Secret("TEST_FAKE_SECRET"); got != "v2/db" {
+		t.Fatalf("expected the last good value while the provider fails, got %q", got)
+	}
+	calls = 0
+	if got := Secret("TEST_FAKE_SECRET"); got != "v2/db" || calls != 0 {
+		t.Fatalf("expected the last good value without retrying during the backoff, got %q after %d calls", got, calls)
+	}
+	t.Setenv("TEST_FAKE_SECRET", "fake:other")
+	if _, err := LookupSecret("TEST_FAKE_SECRET"); !errors.Is(err, ErrSecretUnavailable) {
+		t.Fatalf("expected an unresolvable secret to be unavailable, got %v", err)
+	}
+	if got := Secret("TEST_FAKE_SECRET"); got != "" || calls != 1 {
+		t.Fatalf("expected one failed resolution, got %q after %d calls", got, calls)
+	}
+
+	// concurrent lookups share one resolution
+	var resolves atomic.Int32
+	release := make(chan struct{})
+	RegisterSecretProvider("slow", SecretProviderFunc(func(_ context.Context, ref string) (string, error) {
+		resolves.Add(1)
+		<-release
+		return ref, nil
+	}))
+	t.Setenv("TEST_SLOW_SECRET", "slow:shared")
+	var wg sync.WaitGroup
+	got := make([]string, 8)
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[i] = Secret("TEST_SLOW_SECRET")
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, v := range got {
+		if v != "shared" {
+			t.Fatalf("expected every lookup to get the value, got %q", got)
+		}
+	}
+	if n := resolves.Load(); n != 1 {
+		t.Fatalf("expected 1 resolution got %d", n)
+	}
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" || r.URL.Path != "/v1/secret/data/slmcache" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"data":{"peer_key":"from-vault"},"metadata":{"version":3}}}`))
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+	t.Setenv("TEST_VAULT_SECRET", "vault:secret/data/slmcache#peer_key")
+	if got := Secret("TEST_VAULT_SECRET"); got != "from-vault" {
+		t.Fatalf("expected the vault secret, got %q", got)
+	}
+}
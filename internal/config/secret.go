@@ -0,0 +1,169 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretProvider resolves secret references of one scheme, such as
+// "vault:secret/data/slmcache#peer_key". Providers for other secret stores
+// (a cloud KMS, a sidecar) can be registered with RegisterSecretProvider.
+type SecretProvider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// SecretProviderFunc adapts a function to SecretProvider.
+type SecretProviderFunc func(ctx context.Context, ref string) (string, error)
+
+func (f SecretProviderFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+var (
+	secretMu  sync.Mutex
+	providers = map[string]SecretProvider{
+		"file":  SecretProviderFunc(readSecretFile),
+		"env":   SecretProviderFunc(func(_ context.Context, ref string) (string, error) { return Get(ref), nil }),
+		"vault": vaultProvider{},
+	}
+	secrets   = map[string]cachedSecret{}
+	resolving = map[string]*secretCall{}
+)
+
+// ErrSecretUnavailable is returned by LookupSecret for a secret that is
+// configured but can't be resolved, with no earlier value to fall back on.
+var ErrSecretUnavailable = errors.New("secret unavailable")
+
+type cachedSecret struct {
+	source string // the spec the value was resolved from
+	value  string
+	good   bool // value was resolved, rather than the zero value
+	at     time.Time
+	// failures counts the resolutions failed in a row; none is tried again
+	// before retryAt, and err is what the last one returned.
+	failures int
+	retryAt  time.Time
+	err      error
+}
+
+// secretCall is a resolution in flight, which concurrent lookups of the same
+// secret wait for rather than each making their own.
+type secretCall struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// RegisterSecretProvider makes values of the form "<scheme>:<ref>" resolve
+// through p.
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	secretMu.Lock()
+	defer secretMu.Unlock()
+	providers[scheme] = p
+}
+
+// Secret returns the credential configured for key. It is read from the file
+// named by KEY_FILE when that is set, and otherwise from KEY, which may hold
+// the value itself or a reference such as "file:/run/secrets/key",
+// "env:OTHER_VAR" or "vault:secret/data/slmcache#key". Resolved values are
+// cached for SLC_SECRET_TTL (default 5m) so rotated secrets are picked up; a
+// failed refresh keeps serving the previous value. A secret that can't be
+// resolved at all reads as "": use LookupSecret where that must not pass for
+// an unset one.
+func Secret(key string) string {
+	value, _ := LookupSecret(key)
+	return value
+}
+
+// LookupSecret is Secret, but fails with ErrSecretUnavailable when the
+// secret is configured and can't be resolved, nor was it before. Failed
+// resolutions are retried with exponential backoff, up to a minute apart,
+// and lookups made in the meantime fail without trying again.
+func LookupSecret(key string) (string, error) {
+	source := Get(key)
+	if path := Get(key + "_FILE"); path != "" {
+		source = "file:" + path
+	}
+	scheme, ref, ok := strings.Cut(source, ":")
+	secretMu.Lock()
+	p, known := providers[scheme]
+	if !ok || !known {
+		secretMu.Unlock()
+		return source, nil
+	}
+	cached, hit := secrets[key]
+	if hit && cached.source == source {
+		if cached.good && time.Since(cached.at) < secretTTL() {
+			secretMu.Unlock()
+			return cached.value, nil
+		}
+		if time.Now().Before(cached.retryAt) {
+			secretMu.Unlock()
+			return cached.lookup()
+		}
+	}
+	call, running := resolving[key]
+	if !running {
+		call = &secretCall{done: make(chan struct{})}
+		resolving[key] = call
+	}
+	secretMu.Unlock()
+	if running {
+		<-call.done
+		return call.value, call.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	value, err := p.Resolve(ctx, ref)
+	cancel()
+	secretMu.Lock()
+	if err == nil {
+		cached = cachedSecret{source: source, value: strings.TrimSpace(value), good: true, at: time.Now()}
+	} else {
+		log.Printf("config: resolving %s: %v", key, err)
+		if !hit || cached.source != source {
+			cached = cachedSecret{source: source}
+		}
+		cached.failures++
+		cached.retryAt = time.Now().Add(min(time.Second<<min(cached.failures-1, 6), time.Minute))
+		cached.err = fmt.Errorf("%w: %s: %v", ErrSecretUnavailable, key, err)
+	}
+	secrets[key] = cached
+	delete(resolving, key)
+	secretMu.Unlock()
+	call.value, call.err = cached.lookup()
+	close(call.done)
+	return call.value, call.err
+}
+
+// lookup returns the value to serve from c: the last good one, or c's error
+// when there is none.
+func (c cachedSecret) lookup() (string, error) {
+	if c.good {
+		return c.value, nil
+	}
+	return "", c.err
+}
+
+func secretTTL() time.Duration {
+	if v := Get("SLC_SECRET_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return 5 * time.Minute
+}
+
+func readSecretFile(_ context.Context, path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read secret file: %w", err)
+	}
+	return string(b), nil
+}
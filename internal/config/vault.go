@@ -0,0 +1,64 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// vaultProvider reads "vault:<path>#<field>" references from HashiCorp
+// Vault's HTTP API at VAULT_ADDR, authenticating with VAULT_TOKEN (itself a
+// secret, so VAULT_TOKEN_FILE works). Both KV version 1 and 2 paths are
+// supported; for version 2 the path includes "data/", as in
+// "secret/data/slmcache#peer_key".
+type vaultProvider struct{}
+
+func (vaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return "", fmt.Errorf("vault reference %q needs a #field", ref)
+	}
+	addr := strings.TrimRight(Get("VAULT_ADDR"), "/")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	if token := Secret("VAULT_TOKEN"); token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if ns := Get("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault: GET %s: %s", path, resp.Status)
+	}
+	var out struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	data := out.Data
+	// KV version 2 nests the secret under data.data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, isV2 := data["metadata"]; isV2 {
+			data = inner
+		}
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault: %s has no string field %q", path, field)
+	}
+	return v, nil
+}
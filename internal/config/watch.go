@@ -0,0 +1,152 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Watcher polls config sources and reloads them when their content changes.
+// Polling (rather than inotify) copes with the atomic symlink swap Kubernetes
+// performs when a mounted ConfigMap or Secret is updated.
+type Watcher struct {
+	// Files are env-style files containing KEY=VALUE lines.
+	Files []string
+	// Dirs are directories holding one file per key, where the file name is
+	// the key and the content is the value (the ConfigMap/Secret volume
+	// layout).
+	Dirs []string
+	// Interval between polls.
+	Interval time.Duration
+}
+
+// WatcherFromEnv builds a Watcher from SLC_CONFIG_FILE and SLC_CONFIG_DIRS
+// (comma separated) polled every SLC_CONFIG_POLL. It returns nil when no
+// sources are configured.
+func WatcherFromEnv() *Watcher {
+	w := &Watcher{
+		Files:    splitList(os.Getenv("SLC_CONFIG_FILE")),
+		Dirs:     splitList(os.Getenv("SLC_CONFIG_DIRS")),
+		Interval: 10 * time.Second,
+	}
+	if len(w.Files) == 0 && len(w.Dirs) == 0 {
+		return nil
+	}
+	if v := strings.TrimSpace(os.Getenv("SLC_CONFIG_POLL")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			w.Interval = d
+		}
+	}
+	return w
+}
+
+// Load reads every source and applies the merged values, returning the keys
+// that changed. Later sources win over earlier ones and directories win over
+// files.
+func (w *Watcher) Load() ([]string, error) {
+	values := map[string]string{}
+	for _, f := range w.Files {
+		if err := readEnvFile(f, values); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range w.Dirs {
+		if err := readDir(d, values); err != nil {
+			return nil, err
+		}
+	}
+	return apply(values), nil
+}
+
+// Run polls until stop is closed. Read errors keep the previous values so a
+// half-written rollout doesn't blank the configuration.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := w.Load()
+			if err != nil {
+				log.Printf("config: reload failed: %v", err)
+				continue
+			}
+			if len(changed) > 0 {
+				log.Printf("config: reloaded %s", strings.Join(changed, ", "))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func readEnvFile(path string, into map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+		key, val, ok := strings.Cut(text, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, line)
+		}
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		into[strings.TrimSpace(key)] = val
+	}
+	return sc.Err()
+}
+
+func readDir(dir string, into map[string]string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		// skip the ..data/..timestamp bookkeeping links of projected volumes
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		into[name] = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
+func splitList(raw string) []string {
+	out := []string{}
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,34 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	base := time.Date(2025, time.November, 10, 13, 7, 30, 0, time.UTC) // a Monday
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"@nightly", time.Date(2025, time.November, 11, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, time.November, 10, 13, 15, 0, 0, time.UTC)},
+		{"30 2 * * sat", time.Date(2025, time.November, 15, 2, 30, 0, 0, time.UTC)},
+		{"0 9 1 jan,jul *", time.Date(2026, time.January, 1, 9, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2025, time.November, 13, 0, 0, 0, 0, time.UTC)}, // OR of dom/dow: 13th comes first
+	}
+	for _, c := range cases {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("parse %q: %v", c.expr, err)
+		}
+		if got := s.Next(base); !got.Equal(c.want) {
+			t.Fatalf("%q: expected %s got %s", c.expr, c.want, got)
+		}
+	}
+	for _, bad := range []string{"* * *", "61 * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+)
+
+// ErrPermanent marks a message that can never be processed, such as one
+// that isn't valid JSON. It is dead-lettered without further attempts.
+var ErrPermanent = errors.New("permanent failure")
+
+// Handler processes the payload of one consumed message.
+type Handler func(ctx context.Context, value []byte) error
+
+// Consumer feeds the messages of a topic to a handler until ctx is done.
+// A message is acknowledged only after the handler succeeded or the
+// message was dead-lettered, so a crash means redelivery: consumers are
+// at-least-once, and handlers must tolerate seeing a message twice.
+type Consumer interface {
+	Run(ctx context.Context, handle Handler) error
+	Close() error
+}
+
+// RetryPolicy bounds the attempts at a message before it is dead-lettered.
+type RetryPolicy struct {
+	// MaxAttempts is how often the handler is tried (default 5).
+	MaxAttempts int
+	// Backoff is the wait after the first failure, doubled after each
+	// further one up to 30s (default 1s).
+	Backoff time.Duration
+}
+
+var consumed = metrics.NewCounter("slmcache_ingest_messages_total",
+	"Consumed messages by outcome (ok, retried, dead_lettered).", "result")
+
+// process runs handle on value with retries, and dead-letters it with
+// deadLetter once the attempts are spent. It returns an error only when the
+// message should be redelivered: ctx ended, or dead-lettering failed.
+// progress, if set, is called before each retry so brokers with ack
+// deadlines keep the message.
+func (p RetryPolicy) process(ctx context.Context, value []byte, handle Handler, deadLetter func(reason string) error, progress func()) error {
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	wait := p.Backoff
+	if wait <= 0 {
+		wait = time.Second
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = handle(ctx, value); err == nil {
+			consumed.Inc("ok")
+			return nil
+		}
+		if errors.Is(err, ErrPermanent) || attempt == attempts {
+			break
+		}
+		consumed.Inc("retried")
+		if progress != nil {
+			progress()
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait = min(2*wait, 30*time.Second)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.Printf("events: dead-lettering message: %v", err)
+	if dlErr := deadLetter(err.Error()); dlErr != nil {
+		return dlErr
+	}
+	consumed.Inc("dead_lettered")
+	return nil
+}
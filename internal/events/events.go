@@ -0,0 +1,190 @@
+// Package events connects the cache to message brokers (NATS JetStream and
+// Kafka). It publishes cache activity, so analytics pipelines can consume it
+// without scraping logs: events are queued in memory and sent in batches
+// from a background goroutine, and when the queue is full new events are
+// dropped rather than slowing requests down. It also consumes topics of
+// entries to store, with retries and a dead-letter destination.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+)
+
+// Event types.
+const (
+	EntryCreated  = "entry.created"
+	EntryUpdated  = "entry.updated"
+	EntryDeleted  = "entry.deleted"
+	EntryMetadata = "entry.metadata"
+	SearchHit     = "search.hit"
+	SearchMiss    = "search.miss"
+	// QuotaWarning is a namespace filling past a warning threshold of its
+	// quota.
+	QuotaWarning = "namespace.quota_warning"
+)
+
+// Event is one piece of cache activity. Entry events name the entry; search
+// events say which tier answered and with what, but never carry the query
+// text or payloads.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Instance  string    `json:"instance,omitempty"`
+	ID        int64     `json:"id,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Tier      string    `json:"tier,omitempty"`
+	IDs       []int64   `json:"ids,omitempty"`
+	Scores    []float64 `json:"scores,omitempty"`
+	LatencyMS float64   `json:"latency_ms,omitempty"`
+}
+
+// Message is an encoded event as handed to a Publisher.
+type Message struct {
+	// Type is the event type; NATS appends it to the subject and Kafka sets
+	// it as the "type" header.
+	Type string
+	// Key orders messages: those with the same key (the entry ID, if any)
+	// land on the same Kafka partition.
+	Key   string
+	Value []byte
+}
+
+// Publisher sends a batch of messages to a broker.
+type Publisher interface {
+	Publish(ctx context.Context, msgs []Message) error
+	Close() error
+}
+
+var (
+	published = metrics.NewCounter("slmcache_events_total",
+		"Events handed to the broker by type and result (ok, error, dropped).", "type", "result")
+)
+
+// Emitter queues events for a Publisher. A nil *Emitter discards events.
+type Emitter struct {
+	pub      Publisher
+	instance string
+	max      int
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	pending []Event
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewEmitter publishes through pub, tagging events with instance. At most
+// max events wait (default 10000); each batch gets timeout to be accepted.
+func NewEmitter(pub Publisher, instance string, max int, timeout time.Duration) *Emitter {
+	if max <= 0 {
+		max = 10000
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	e := &Emitter{
+		pub: pub, instance: instance, max: max, timeout: timeout,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// Emit queues ev, stamping its time and instance.
+func (e *Emitter) Emit(ev Event) {
+	if e == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	ev.Instance = e.instance
+	e.mu.Lock()
+	if len(e.pending) >= e.max {
+		e.mu.Unlock()
+		published.Inc(ev.Type, "dropped")
+		return
+	}
+	e.pending = append(e.pending, ev)
+	e.mu.Unlock()
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *Emitter) loop() {
+	defer close(e.done)
+	for {
+		select {
+		case <-e.wake:
+			e.flush()
+		case <-e.stop:
+			e.flush()
+			return
+		}
+	}
+}
+
+// flush publishes what is queued in batches of up to 256 events. A batch
+// the broker rejects is dropped: events are telemetry, not a ledger.
+func (e *Emitter) flush() {
+	for {
+		e.mu.Lock()
+		n := min(len(e.pending), 256)
+		batch := e.pending[:n:n]
+		e.pending = e.pending[n:]
+		e.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		msgs := make([]Message, n)
+		for i, ev := range batch {
+			msgs[i] = Encode(ev)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+		err := e.pub.Publish(ctx, msgs)
+		cancel()
+		result := "ok"
+		if err != nil {
+			log.Printf("events: publish %d events: %v", len(msgs), err)
+			result = "error"
+		}
+		for _, m := range msgs {
+			published.Inc(m.Type, result)
+		}
+	}
+}
+
+// Encode turns ev into the message published for it, keyed by its entry
+// ID if it has one.
+func Encode(ev Event) Message {
+	b, _ := json.Marshal(ev)
+	m := Message{Type: ev.Type, Value: b}
+	if ev.ID != 0 {
+		m.Key = strconv.FormatInt(ev.ID, 10)
+	}
+	return m
+}
+
+// Close publishes what is still queued and closes the publisher.
+func (e *Emitter) Close() error {
+	if e == nil {
+		return nil
+	}
+	close(e.stop)
+	<-e.done
+	return e.pub.Close()
+}
@@ -0,0 +1,83 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	msgs   []Message
+	closed bool
+}
+
+func (r *recorder) Publish(ctx context.Context, msgs []Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msgs...)
+	return nil
+}
+
+func (r *recorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestEmitter(t *testing.T) {
+	rec := &recorder{}
+	e := NewEmitter(rec, "node-1", 0, 0)
+	e.Emit(Event{Type: EntryCreated, ID: 7, Namespace: "docs"})
+	e.Emit(Event{Type: SearchMiss, Tier: "miss"})
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.msgs) != 2 || !rec.closed {
+		t.Fatalf("expected both events flushed on close got %d (closed %v)", len(rec.msgs), rec.closed)
+	}
+	m := rec.msgs[0]
+	var ev Event
+	if err := json.Unmarshal(m.Value, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != EntryCreated || m.Key != "7" || ev.Instance != "node-1" || ev.Namespace != "docs" || ev.Time.IsZero() {
+		t.Fatalf("expected a keyed, stamped entry event got %+v %+v", m, ev)
+	}
+	if rec.msgs[1].Key != "" {
+		t.Fatalf("expected search events to be unkeyed got %q", rec.msgs[1].Key)
+	}
+	var nilEmitter *Emitter
+	nilEmitter.Emit(Event{Type: SearchHit})
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	var calls int
+	var dead string
+	deadLetter := func(reason string) error { dead = reason; return nil }
+	flaky := func(ctx context.Context, value []byte) error {
+		if calls++; calls < 3 {
+			return errors.New("embed timeout")
+		}
+		return nil
+	}
+	if err := p.process(context.Background(), nil, flaky, deadLetter, nil); err != nil || calls != 3 || dead != "" {
+		t.Fatalf("expected success on the third attempt got %v after %d calls (dead %q)", err, calls, dead)
+	}
+	calls = 0
+	broken := func(ctx context.Context, value []byte) error {
+		calls++
+		return fmt.Errorf("%w: bad json", ErrPermanent)
+	}
+	if err := p.process(context.Background(), nil, broken, deadLetter, nil); err != nil || calls != 1 || dead == "" {
+		t.Fatalf("expected a permanent failure dead-lettered at once got %v after %d calls (dead %q)", err, calls, dead)
+	}
+	failing := func(ctx context.Context, value []byte) error { return errors.New("down") }
+	if err := p.process(context.Background(), nil, failing, func(string) error { return errors.New("dlq down") }, nil); err == nil {
+		t.Fatalf("expected a failed dead-letter to ask for redelivery")
+	}
+}
@@ -0,0 +1,108 @@
+package events
+
+import (
+	"context"
+	"log"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// KafkaPublisher produces events to one topic, keyed by entry ID so the
+// events of an entry stay in order, with the event type in the "type"
+// header.
+type KafkaPublisher struct {
+	cl *kgo.Client
+}
+
+// NewKafkaPublisher produces to topic through the seed brokers.
+func NewKafkaPublisher(brokers []string, topic string) (*KafkaPublisher, error) {
+	cl, err := kgo.NewClient(kgo.SeedBrokers(brokers...), kgo.DefaultProduceTopic(topic))
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaPublisher{cl: cl}, nil
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, msgs []Message) error {
+	recs := make([]*kgo.Record, len(msgs))
+	for i, m := range msgs {
+		recs[i] = &kgo.Record{Value: m.Value, Headers: []kgo.RecordHeader{{Key: "type", Value: []byte(m.Type)}}}
+		if m.Key != "" {
+			recs[i].Key = []byte(m.Key)
+		}
+	}
+	return p.cl.ProduceSync(ctx, recs...).FirstErr()
+}
+
+func (p *KafkaPublisher) Close() error {
+	p.cl.Close()
+	return nil
+}
+
+// KafkaConsumer reads a topic as a member of a consumer group, committing
+// offsets only once the records before them were processed or
+// dead-lettered. Failed records are produced to the dead-letter topic with
+// an slmcache-error header.
+type KafkaConsumer struct {
+	cl      *kgo.Client
+	dlq     string
+	retries RetryPolicy
+}
+
+// NewKafkaConsumer joins group to consume topic through the seed brokers.
+func NewKafkaConsumer(brokers []string, topic, group, dlq string, retries RetryPolicy) (*KafkaConsumer, error) {
+	cl, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumerGroup(group),
+		kgo.ConsumeTopics(topic),
+		kgo.DisableAutoCommit(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaConsumer{cl: cl, dlq: dlq, retries: retries}, nil
+}
+
+func (c *KafkaConsumer) Run(ctx context.Context, handle Handler) error {
+	for ctx.Err() == nil {
+		fetches := c.cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			log.Printf("events: fetch %s/%d: %v", topic, partition, err)
+		})
+		var done []*kgo.Record
+		var failed error
+		fetches.EachRecord(func(rec *kgo.Record) {
+			if failed != nil {
+				return
+			}
+			failed = c.retries.process(ctx, rec.Value, handle, func(reason string) error {
+				dead := &kgo.Record{Topic: c.dlq, Key: rec.Key, Value: rec.Value,
+					Headers: append(rec.Headers, kgo.RecordHeader{Key: "slmcache-error", Value: []byte(reason)})}
+				return c.cl.ProduceSync(ctx, dead).FirstErr()
+			}, nil)
+			if failed == nil {
+				done = append(done, rec)
+			}
+		})
+		if len(done) > 0 {
+			if err := c.cl.CommitRecords(ctx, done...); err != nil {
+				log.Printf("events: commit offsets: %v", err)
+			}
+		}
+		if failed != nil {
+			// the rest of the poll is redelivered after a rebalance or
+			// restart; start over from the last committed offsets
+			log.Printf("events: %v; restarting from the committed offsets", failed)
+			return failed
+		}
+	}
+	return ctx.Err()
+}
+
+func (c *KafkaConsumer) Close() error {
+	c.cl.Close()
+	return nil
+}
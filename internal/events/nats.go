@@ -0,0 +1,132 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSPublisher publishes each event to subject prefix + "." + type, e.g.
+// slmcache.entry.created. With JetStream each message waits for the
+// stream's acknowledgement; otherwise it is sent with core NATS semantics.
+type NATSPublisher struct {
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	prefix string
+}
+
+// NewNATSPublisher connects to url (e.g. nats://nats:4222). The connection
+// reconnects on its own for as long as the process runs.
+func NewNATSPublisher(url, prefix string, useJetStream bool) (*NATSPublisher, error) {
+	nc, err := nats.Connect(url, nats.Name("slmcache"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	p := &NATSPublisher{nc: nc, prefix: prefix}
+	if useJetStream {
+		if p.js, err = jetstream.New(nc); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, msgs []Message) error {
+	var errs []error
+	for _, m := range msgs {
+		subject := p.prefix + "." + m.Type
+		if p.js != nil {
+			if _, err := p.js.Publish(ctx, subject, m.Value); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := p.nc.Publish(subject, m.Value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.js == nil {
+		if err := p.nc.FlushWithContext(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *NATSPublisher) Close() error {
+	return p.nc.Drain()
+}
+
+// NATSConsumer reads a JetStream subject through a durable pull consumer,
+// shared by every replica using the same name. Messages that fail are
+// published to the dead-letter subject with an Slmcache-Error header.
+type NATSConsumer struct {
+	nc      *nats.Conn
+	cons    jetstream.Consumer
+	dlq     string
+	retries RetryPolicy
+}
+
+// NewNATSConsumer consumes subject from the JetStream stream that captures
+// it, as durable consumer name.
+func NewNATSConsumer(ctx context.Context, url, subject, name, dlq string, retries RetryPolicy) (*NATSConsumer, error) {
+	nc, err := nats.Connect(url, nats.Name("slmcache"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(nc)
+	if err == nil {
+		var stream string
+		if stream, err = js.StreamNameBySubject(ctx, subject); err == nil {
+			var cons jetstream.Consumer
+			cons, err = js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+				Durable:       name,
+				FilterSubject: subject,
+				AckPolicy:     jetstream.AckExplicitPolicy,
+				AckWait:       time.Minute,
+			})
+			if err == nil {
+				return &NATSConsumer{nc: nc, cons: cons, dlq: dlq, retries: retries}, nil
+			}
+		}
+	}
+	nc.Close()
+	return nil, err
+}
+
+func (c *NATSConsumer) Run(ctx context.Context, handle Handler) error {
+	for ctx.Err() == nil {
+		batch, err := c.cons.Fetch(16, jetstream.FetchMaxWait(5*time.Second))
+		if err != nil {
+			log.Printf("events: fetch: %v", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		for msg := range batch.Messages() {
+			err := c.retries.process(ctx, msg.Data(), handle, func(reason string) error {
+				dead := nats.NewMsg(c.dlq)
+				dead.Data = msg.Data()
+				dead.Header.Set("Slmcache-Error", reason)
+				return c.nc.PublishMsg(dead)
+			}, func() { _ = msg.InProgress() })
+			if err != nil {
+				_ = msg.Nak()
+				continue
+			}
+			_ = msg.Ack()
+		}
+	}
+	return ctx.Err()
+}
+
+func (c *NATSConsumer) Close() error {
+	return c.nc.Drain()
+}
@@ -0,0 +1,72 @@
+package lexical
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Span is a word of a text: its byte range and lower-case form.
+type Span struct {
+	Start, End int
+	Word       string
+}
+
+// Spans splits text into words like Words does, keeping their positions.
+func Spans(text string) []Span {
+	var out []Span
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsNumber(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			out = append(out, Span{Start: start, End: i, Word: strings.ToLower(text[start:i])})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		out = append(out, Span{Start: start, End: len(text), Word: strings.ToLower(text[start:])})
+	}
+	return out
+}
+
+// Highlight finds the words of text matching any of the query terms. It
+// returns their byte ranges and text with each wrapped in <em> and
+// everything else HTML-escaped. expand maps a word to the words it stands
+// for (its synonyms) before stemming; nil keeps words as they are.
+func (a Analyzer) Highlight(text string, query []string, expand func(string) []string) (string, [][2]int) {
+	var offsets [][2]int
+	for _, sp := range Spans(text) {
+		words := []string{sp.Word}
+		if expand != nil {
+			words = expand(sp.Word)
+		}
+		if matchesAny(a, query, a.Terms(words)) {
+			offsets = append(offsets, [2]int{sp.Start, sp.End})
+		}
+	}
+	var b strings.Builder
+	last := 0
+	for _, o := range offsets {
+		b.WriteString(html.EscapeString(text[last:o[0]]))
+		b.WriteString("<em>")
+		b.WriteString(html.EscapeString(text[o[0]:o[1]]))
+		b.WriteString("</em>")
+		last = o[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String(), offsets
+}
+
+func matchesAny(a Analyzer, query, terms []string) bool {
+	for _, qt := range query {
+		for _, t := range terms {
+			if a.Match(qt, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
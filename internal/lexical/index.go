@@ -0,0 +1,165 @@
+package lexical
+
+import (
+	"slices"
+	"unicode/utf8"
+)
+
+// Index finds the documents whose terms match a query's without comparing
+// the query to every document. Each distinct term is listed under its
+// trigrams, so the terms containing a query term (or within its allowed
+// typos) are found by counting shared trigrams, and each term has a posting
+// list of the documents using it. An Index is not safe for concurrent use.
+type Index struct {
+	docs     map[int64][]string
+	postings map[string]map[int64]struct{}
+	grams    map[string]map[string]struct{}
+}
+
+func NewIndex() *Index {
+	return &Index{
+		docs:     map[int64][]string{},
+		postings: map[string]map[int64]struct{}{},
+		grams:    map[string]map[string]struct{}{},
+	}
+}
+
+// Len returns the number of documents indexed.
+func (x *Index) Len() int { return len(x.docs) }
+
+// Add indexes document id under terms, replacing what it had.
+func (x *Index) Add(id int64, terms []string) {
+	x.Remove(id)
+	uniq := slices.Compact(slices.Sorted(slices.Values(terms)))
+	x.docs[id] = uniq
+	for _, t := range uniq {
+		docs, ok := x.postings[t]
+		if !ok {
+			docs = map[int64]struct{}{}
+			x.postings[t] = docs
+			for _, g := range trigrams(t) {
+				if x.grams[g] == nil {
+					x.grams[g] = map[string]struct{}{}
+				}
+				x.grams[g][t] = struct{}{}
+			}
+		}
+		docs[id] = struct{}{}
+	}
+}
+
+// Remove drops document id.
+func (x *Index) Remove(id int64) {
+	for _, t := range x.docs[id] {
+		docs := x.postings[t]
+		delete(docs, id)
+		if len(docs) > 0 {
+			continue
+		}
+		delete(x.postings, t)
+		for _, g := range trigrams(t) {
+			delete(x.grams[g], t)
+			if len(x.grams[g]) == 0 {
+				delete(x.grams, g)
+			}
+		}
+	}
+	delete(x.docs, id)
+}
+
+// Search returns, in ascending order, the documents with a term matching
+// each of the query terms under a.Match. No terms match every document.
+func (x *Index) Search(terms []string, a Analyzer) []int64 {
+	var found map[int64]struct{}
+	for i, qt := range terms {
+		docs := map[int64]struct{}{}
+		for _, t := range x.candidates(qt, a) {
+			if !a.Match(qt, t) {
+				continue
+			}
+			for id := range x.postings[t] {
+				if i == 0 {
+					docs[id] = struct{}{}
+				} else if _, ok := found[id]; ok {
+					docs[id] = struct{}{}
+				}
+			}
+		}
+		found = docs
+		if len(found) == 0 {
+			return nil
+		}
+	}
+	out := make([]int64, 0, len(x.docs))
+	if found == nil {
+		for id := range x.docs {
+			out = append(out, id)
+		}
+	} else {
+		for id := range found {
+			out = append(out, id)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// candidates lists the terms that may match qt. A term containing qt has
+// all of its trigrams, and one within k edits keeps all but at most 4k of
+// them (a transposition touches four), so only terms sharing that many are
+// candidates. Query terms too short to filter on are compared with every
+// term.
+func (x *Index) candidates(qt string, a Analyzer) []string {
+	grams := trigrams(qt)
+	need := len(grams) - 4*a.edits(qt)
+	if need <= 0 {
+		out := make([]string, 0, len(x.postings))
+		for t := range x.postings {
+			out = append(out, t)
+		}
+		return out
+	}
+	shared := map[string]int{}
+	for _, g := range grams {
+		for t := range x.grams[g] {
+			shared[t]++
+		}
+	}
+	var out []string
+	for t, n := range shared {
+		if n >= need {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// trigrams returns the distinct three-rune substrings of s.
+func trigrams(s string) []string {
+	if utf8.RuneCountInString(s) < 3 {
+		return nil
+	}
+	var out []string
+	r := []rune(s)
+	for i := 0; i+3 <= len(r); i++ {
+		g := string(r[i : i+3])
+		if !slices.Contains(out, g) {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// edits is how many typos Match allows for query term q.
+func (a Analyzer) edits(q string) int {
+	if a.Fuzziness != Auto {
+		return a.Fuzziness
+	}
+	switch n := utf8.RuneCountInString(q); {
+	case n <= 3:
+		return 0
+	case n <= 6:
+		return 1
+	}
+	return 2
+}
@@ -0,0 +1,82 @@
+// Package lexical turns text into the terms the search layer matches
+// prompts on without embeddings: words are lower-cased, stopwords dropped
+// and the rest reduced to their stems, so "deploying pods" and "how to
+// deploy a pod" share the terms "deploy" and "pod". Terms may also match
+// within a few typos.
+package lexical
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Analyzer splits text into terms. The zero value keeps every word as is.
+type Analyzer struct {
+	// Stem reduces a lower-case word to its stem; nil keeps words whole.
+	Stem func(string) string
+	// Stopwords are dropped from the terms, unless a text consists of
+	// nothing else.
+	Stopwords map[string]bool
+	// Fuzziness is how many typos Match tolerates: 0 none, 1 or 2 that
+	// many edits, or Auto.
+	Fuzziness int
+}
+
+// Auto scales Fuzziness with the length of the query term: none for terms
+// of up to 3 letters, one edit up to 6 and two beyond.
+const Auto = -1
+
+// Languages maps the supported stemming languages to their stemmers.
+var Languages = map[string]func(string) string{
+	"english": StemEnglish,
+}
+
+// EnglishStopwords is the default stopword list: articles, pronouns,
+// auxiliaries and the question words every prompt starts with.
+var EnglishStopwords = []string{
+	"a", "about", "an", "and", "any", "are", "as", "at", "be", "been", "but",
+	"by", "can", "could", "did", "do", "does", "for", "from", "had", "has",
+	"have", "how", "i", "if", "in", "into", "is", "it", "its", "me", "my",
+	"of", "on", "or", "our", "should", "so", "that", "the", "their", "them",
+	"then", "there", "these", "they", "this", "those", "to", "was", "we",
+	"were", "what", "when", "where", "which", "who", "whom", "why", "will",
+	"with", "would", "you", "your",
+}
+
+// Words splits text into lower-case words at anything that isn't a letter
+// or digit.
+func Words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Terms returns the terms of words, which are expected lower-case. A text
+// made only of stopwords keeps them, so it still matches something.
+func (a Analyzer) Terms(words []string) []string {
+	out := make([]string, 0, len(words))
+	for _, w := range words {
+		if !a.Stopwords[w] {
+			out = append(out, w)
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, words...)
+	}
+	if a.Stem != nil {
+		for i, w := range out {
+			out[i] = a.Stem(w)
+		}
+	}
+	return out
+}
+
+// Match reports whether a stored term matches a query term: it contains the
+// query term or, with Fuzziness, is within the allowed edits of it.
+func (a Analyzer) Match(query, term string) bool {
+	if strings.Contains(term, query) {
+		return true
+	}
+	edits := a.edits(query)
+	return edits > 0 && Distance(query, term, edits) <= edits
+}
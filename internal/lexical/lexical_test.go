@@ -0,0 +1,140 @@
+package lexical
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStemEnglish(t *testing.T) {
+	cases := map[string]string{
+		"consign": "consign", "consigned": "consign", "consigning": "consign",
+		"consignment": "consign", "consistency": "consist", "consistently": "consist",
+		"consolation": "consol", "consolatory": "consolatori", "consolingly": "consol",
+		"conspicuously": "conspicu", "conspiracy": "conspiraci", "conspirators": "conspir",
+		"constables": "constabl", "constancy": "constanc", "knackeries": "knackeri",
+		"kneeling": "kneel", "knightly": "knight", "knitting": "knit", "knives": "knive",
+		"running": "run", "hopping": "hop", "hoped": "hope", "caresses": "caress",
+		"ponies": "poni", "ties": "tie", "generously": "generous", "cities": "citi",
+		"deployments": "deploy", "deploying": "deploy", "pods": "pod", "skies": "sky",
+		"proceed": "proceed", "k8s": "k8s", "is": "is",
+	}
+	for word, want := range cases {
+		if got := StemEnglish(word); got != want {
+			t.Errorf("StemEnglish(%q): expected %q got %q", word, want, got)
+		}
+	}
+}
+
+func TestAnalyzerTerms(t *testing.T) {
+	a := Analyzer{Stem: StemEnglish, Stopwords: map[string]bool{}}
+	for _, w := range EnglishStopwords {
+		a.Stopwords[w] = true
+	}
+	if got := a.Terms(Words("How do I deploy the Pods?")); !reflect.DeepEqual(got, []string{"deploy", "pod"}) {
+		t.Fatalf("expected stopwords dropped and words stemmed got %q", got)
+	}
+	if got := a.Terms(Words("What is it")); !reflect.DeepEqual(got, []string{"what", "is", "it"}) {
+		t.Fatalf("expected a text of stopwords to keep them got %q", got)
+	}
+	if got := (Analyzer{}).Terms(Words("Running pods")); !reflect.DeepEqual(got, []string{"running", "pods"}) {
+		t.Fatalf("expected the zero analyzer to keep words got %q", got)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"quantum", "quantum", 0},
+		{"quantun", "quantum", 1},
+		{"entanglment", "entanglement", 1},
+		{"qauntum", "quantum", 1},
+		{"kubernetse", "kubernetes", 1},
+		{"kitten", "sitting", 3},
+		{"", "abc", 3},
+	}
+	for _, c := range cases {
+		if got := Distance(c.a, c.b, 5); got != c.want {
+			t.Errorf("Distance(%q, %q): expected %d got %d", c.a, c.b, c.want, got)
+		}
+	}
+	if got := Distance("kitten", "sitting", 1); got != 2 {
+		t.Fatalf("expected the distance capped at max+1 got %d", got)
+	}
+}
+
+func TestAnalyzerMatch(t *testing.T) {
+	a := Analyzer{Fuzziness: Auto}
+	for _, c := range []struct {
+		query, term string
+		want        bool
+	}{
+		{"deploy", "redeploy", true},
+		{"quantun", "quantum", true},
+		{"entangl", "entangel", true},
+		{"cat", "cot", false},
+		{"kubernetse", "kubernetes", true},
+		{"kuberntse", "kubernetes", true},
+		{"gpu", "tpu", false},
+	} {
+		if got := a.Match(c.query, c.term); got != c.want {
+			t.Errorf("Match(%q, %q): expected %v got %v", c.query, c.term, c.want, got)
+		}
+	}
+	if (Analyzer{}).Match("quantun", "quantum") {
+		t.Fatalf("expected no typo tolerance without fuzziness")
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	a := Analyzer{Fuzziness: Auto}
+	x := NewIndex()
+	x.Add(1, []string{"quantum", "entangl"})
+	x.Add(2, []string{"quantum", "comput", "comput"})
+	x.Add(3, []string{"deploy", "pod"})
+	cases := []struct {
+		terms []string
+		want  []int64
+	}{
+		{[]string{"quantum"}, []int64{1, 2}},
+		{[]string{"quantun", "entangl"}, []int64{1}},
+		{[]string{"ploy"}, []int64{3}},
+		{[]string{"po"}, []int64{3}},
+		{[]string{"quantum", "pod"}, nil},
+		{nil, []int64{1, 2, 3}},
+	}
+	for _, c := range cases {
+		if got := x.Search(c.terms, a); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Search(%q): expected %v got %v", c.terms, c.want, got)
+		}
+	}
+	x.Add(2, []string{"classic"})
+	x.Remove(3)
+	if got := x.Search([]string{"quantum"}, a); !reflect.DeepEqual(got, []int64{1}) {
+		t.Fatalf("expected a replaced document to leave its old terms got %v", got)
+	}
+	if got := x.Search([]string{"deploy"}, a); got != nil || x.Len() != 2 {
+		t.Fatalf("expected a removed document to be gone got %v (%d docs)", got, x.Len())
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	a := Analyzer{Stem: StemEnglish, Fuzziness: Auto}
+	marked, offsets := a.Highlight("How do I deploy <b>Pods</b>?", []string{"deploy", "pod"}, nil)
+	if want := "How do I <em>deploy</em> &lt;b&gt;<em>Pods</em>&lt;/b&gt;?"; marked != want {
+		t.Fatalf("expected %q got %q", want, marked)
+	}
+	if !reflect.DeepEqual(offsets, [][2]int{{9, 15}, {19, 23}}) {
+		t.Fatalf("expected byte ranges of the matched words got %v", offsets)
+	}
+	expand := func(w string) []string {
+		if w == "k8s" {
+			return []string{"kubernetes"}
+		}
+		return []string{w}
+	}
+	if marked, _ := a.Highlight("Upgrading k8s", []string{"kubernet"}, expand); marked != "Upgrading <em>k8s</em>" {
+		t.Fatalf("expected the alias highlighted got %q", marked)
+	}
+}
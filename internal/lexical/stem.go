@@ -0,0 +1,266 @@
+package lexical
+
+import "strings"
+
+// This file implements the Snowball English ("Porter2") stemmer as
+// described at https://snowballstem.org/algorithms/english/stemmer.html.
+// Words are expected in lower case.
+
+// stemExceptions are stemmed irregularly (or not at all) by Porter2.
+var stemExceptions = map[string]string{
+	"skies": "sky", "dying": "die", "lying": "lie", "tying": "tie",
+	"idly": "idl", "gently": "gentl", "ugly": "ugli", "early": "earli",
+	"only": "onli", "singly": "singl",
+	"sky": "sky", "news": "news", "howe": "howe", "atlas": "atlas",
+	"cosmos": "cosmos", "bias": "bias", "andes": "andes",
+}
+
+// step2 maps the derivational suffixes of step 2 to their replacements;
+// "ogi" and "li" have conditions of their own.
+var step2 = map[string]string{
+	"tional": "tion", "enci": "ence", "anci": "ance", "abli": "able",
+	"entli": "ent", "izer": "ize", "ization": "ize", "ational": "ate",
+	"ation": "ate", "ator": "ate", "alism": "al", "aliti": "al",
+	"alli": "al", "fulness": "ful", "ousli": "ous", "ousness": "ous",
+	"iveness": "ive", "iviti": "ive", "biliti": "ble", "bli": "ble",
+	"fulli": "ful", "lessli": "less",
+}
+
+var step2Suffixes = func() []string {
+	out := []string{"ogi", "li"}
+	for s := range step2 {
+		out = append(out, s)
+	}
+	return out
+}()
+
+// step1aExceptions are left alone once step 1a has run.
+var step1aExceptions = map[string]bool{
+	"inning": true, "outing": true, "canning": true, "herring": true,
+	"earring": true, "proceed": true, "exceed": true, "succeed": true,
+}
+
+func isVowel(c byte) bool {
+	switch c {
+	case 'a', 'e', 'i', 'o', 'u', 'y':
+		return true
+	}
+	return false
+}
+
+func isDouble(w []byte) bool {
+	n := len(w)
+	if n < 2 || w[n-1] != w[n-2] {
+		return false
+	}
+	switch w[n-1] {
+	case 'b', 'd', 'f', 'g', 'm', 'n', 'p', 'r', 't':
+		return true
+	}
+	return false
+}
+
+func isValidLiEnding(c byte) bool {
+	switch c {
+	case 'c', 'd', 'e', 'g', 'h', 'k', 'm', 'n', 'r', 't':
+		return true
+	}
+	return false
+}
+
+// endsShortSyllable reports whether w ends in a short syllable: a vowel
+// followed by a non-vowel other than w, x or Y and preceded by a non-vowel,
+// or a vowel at the start of the word followed by a non-vowel.
+func endsShortSyllable(w []byte) bool {
+	n := len(w)
+	if n == 2 {
+		return isVowel(w[0]) && !isVowel(w[1])
+	}
+	if n >= 3 {
+		c := w[n-1]
+		return !isVowel(w[n-3]) && isVowel(w[n-2]) && !isVowel(c) && c != 'w' && c != 'x' && c != 'Y'
+	}
+	return false
+}
+
+// region returns the start of the region after the first non-vowel that
+// follows a vowel, at or after from.
+func region(w []byte, from int) int {
+	for i := from + 1; i < len(w); i++ {
+		if !isVowel(w[i]) && isVowel(w[i-1]) {
+			return i + 1
+		}
+	}
+	return len(w)
+}
+
+func hasVowel(w []byte) bool {
+	for _, c := range w {
+		if isVowel(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// longestSuffix returns the longest of suffixes w ends with, or "".
+func longestSuffix(w []byte, suffixes ...string) string {
+	best := ""
+	for _, s := range suffixes {
+		if len(s) > len(best) && strings.HasSuffix(string(w), s) {
+			best = s
+		}
+	}
+	return best
+}
+
+// StemEnglish returns the Porter2 stem of a lower-case English word.
+func StemEnglish(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	if s, ok := stemExceptions[word]; ok {
+		return s
+	}
+	w := []byte(strings.TrimPrefix(word, "'"))
+	if len(w) == 0 {
+		return word
+	}
+	// y at the start or after a vowel is a consonant
+	for i := range w {
+		if w[i] == 'y' && (i == 0 || isVowel(w[i-1])) {
+			w[i] = 'Y'
+		}
+	}
+	r1 := region(w, 0)
+	for _, prefix := range []string{"gener", "commun", "arsen"} {
+		if strings.HasPrefix(string(w), prefix) {
+			r1 = len(prefix)
+			break
+		}
+	}
+	r2 := region(w, r1)
+
+	// step 0: possessives
+	if s := longestSuffix(w, "'", "'s", "'s'"); s != "" {
+		w = w[:len(w)-len(s)]
+	}
+
+	// step 1a: plurals
+	switch s := longestSuffix(w, "sses", "ied", "ies", "us", "ss", "s"); s {
+	case "sses":
+		w = w[:len(w)-2]
+	case "ied", "ies":
+		if len(w) > 4 {
+			w = append(w[:len(w)-3], 'i')
+		} else {
+			w = append(w[:len(w)-3], 'i', 'e')
+		}
+	case "s":
+		if len(w) >= 3 && hasVowel(w[:len(w)-2]) {
+			w = w[:len(w)-1]
+		}
+	}
+	if step1aExceptions[string(w)] {
+		return string(w)
+	}
+
+	// step 1b: past tenses and gerunds
+	switch s := longestSuffix(w, "eed", "eedly", "ed", "edly", "ing", "ingly"); s {
+	case "eed", "eedly":
+		if len(w)-len(s) >= r1 {
+			w = append(w[:len(w)-len(s)], 'e', 'e')
+		}
+	case "ed", "edly", "ing", "ingly":
+		if stem := w[:len(w)-len(s)]; hasVowel(stem) {
+			w = stem
+			switch {
+			case longestSuffix(w, "at", "bl", "iz") != "":
+				w = append(w, 'e')
+			case isDouble(w):
+				w = w[:len(w)-1]
+			case r1 >= len(w) && endsShortSyllable(w):
+				w = append(w, 'e')
+			}
+		}
+	}
+
+	// step 1c: a final y after a consonant
+	if n := len(w); n > 2 && (w[n-1] == 'y' || w[n-1] == 'Y') && !isVowel(w[n-2]) {
+		w[n-1] = 'i'
+	}
+
+	// step 2: derivational suffixes in R1
+	inR1 := func(s string) bool { return len(w)-len(s) >= r1 }
+	inR2 := func(s string) bool { return len(w)-len(s) >= r2 }
+	replace := func(s, with string) { w = append(w[:len(w)-len(s)], with...) }
+	switch s := longestSuffix(w, step2Suffixes...); s {
+	case "":
+	case "ogi":
+		if inR1(s) && len(w) > 3 && w[len(w)-4] == 'l' {
+			replace(s, "og")
+		}
+	case "li":
+		if inR1(s) && len(w) > 2 && isValidLiEnding(w[len(w)-3]) {
+			replace(s, "")
+		}
+	default:
+		if inR1(s) {
+			replace(s, step2[s])
+		}
+	}
+
+	// step 3
+	switch s := longestSuffix(w, "tional", "ational", "alize", "icate", "iciti", "ical", "ful", "ness", "ative"); s {
+	case "":
+	case "tional":
+		if inR1(s) {
+			replace(s, "tion")
+		}
+	case "ational":
+		if inR1(s) {
+			replace(s, "ate")
+		}
+	case "alize":
+		if inR1(s) {
+			replace(s, "al")
+		}
+	case "icate", "iciti", "ical":
+		if inR1(s) {
+			replace(s, "ic")
+		}
+	case "ful", "ness":
+		if inR1(s) {
+			replace(s, "")
+		}
+	case "ative":
+		if inR2(s) {
+			replace(s, "")
+		}
+	}
+
+	// step 4: suffixes in R2
+	switch s := longestSuffix(w, "al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement",
+		"ment", "ent", "ism", "ate", "iti", "ous", "ive", "ize", "ion"); s {
+	case "":
+	case "ion":
+		if inR2(s) && len(w) > 3 && (w[len(w)-4] == 's' || w[len(w)-4] == 't') {
+			replace(s, "")
+		}
+	default:
+		if inR2(s) {
+			replace(s, "")
+		}
+	}
+
+	// step 5
+	if n := len(w); n > 0 {
+		switch {
+		case w[n-1] == 'e' && (n-1 >= r2 || (n-1 >= r1 && !endsShortSyllable(w[:n-1]))):
+			w = w[:n-1]
+		case w[n-1] == 'l' && n-1 >= r2 && n > 1 && w[n-2] == 'l':
+			w = w[:n-1]
+		}
+	}
+	return strings.ReplaceAll(string(w), "Y", "y")
+}
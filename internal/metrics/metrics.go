@@ -0,0 +1,412 @@
+// Package metrics is a small, dependency-free metrics registry that renders
+// the Prometheus text exposition format, or OpenMetrics with histogram
+// exemplars for scrapers that ask for it. Metrics are registered once
+// (usually as package-level variables) and are safe for concurrent use.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry holds registered metric families.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family
+}
+
+type family interface {
+	write(w io.Writer, openMetrics bool)
+}
+
+// Default is the registry used by the New* helpers and Handler.
+var Default = NewRegistry()
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]family{}}
+}
+
+// register returns the existing family for name or stores f. Registering the
+// same name twice returns the first instance so repeated construction (for
+// example one Server per test) shares counters instead of panicking.
+func (r *Registry) register(name string, f family) family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.families[name]; ok {
+		return existing
+	}
+	r.families[name] = f
+	return f
+}
+
+// WritePrometheus renders every family in the text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) { r.writeAll(w, false) }
+
+// WriteOpenMetrics renders every family in the OpenMetrics text format,
+// which carries histogram exemplars.
+func (r *Registry) WriteOpenMetrics(w io.Writer) {
+	r.writeAll(w, true)
+	fmt.Fprintln(w, "# EOF")
+}
+
+func (r *Registry) writeAll(w io.Writer, openMetrics bool) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for n := range r.families {
+		names = append(names, n)
+	}
+	fams := make([]family, 0, len(names))
+	sort.Strings(names)
+	for _, n := range names {
+		fams = append(fams, r.families[n])
+	}
+	r.mu.Unlock()
+	for _, f := range fams {
+		f.write(w, openMetrics)
+	}
+}
+
+// Handler serves the Default registry, as OpenMetrics when the scraper
+// accepts it (Prometheus does once exemplar storage is enabled).
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+			Default.WriteOpenMetrics(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Default.WritePrometheus(w)
+	})
+}
+
+// vec stores one value per label combination.
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	// histogram state
+	counts    []uint64
+	sum       float64
+	count     uint64
+	exemplars []*exemplar // latest per bucket, +Inf last
+}
+
+// exemplar links one observation to the trace it came from.
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+func (v *vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) sorted() []*series {
+	out := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].values, "\xff") < strings.Join(out[j].values, "\xff")
+	})
+	return out
+}
+
+// header writes HELP and TYPE. OpenMetrics names a counter family without
+// its _total suffix, which samples then carry.
+func (v *vec) header(w io.Writer, openMetrics bool) {
+	name := v.name
+	if openMetrics && v.kind == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, v.help, name, v.kind)
+}
+
+func labelString(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+len(extra)/2)
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", n, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value per label combination.
+type Counter struct{ v *vec }
+
+// NewCounter registers a counter in the Default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	f := Default.register(name, &Counter{v: &vec{name: name, help: help, kind: "counter", labels: labels, series: map[string]*series{}}})
+	return f.(*Counter)
+}
+
+// Inc adds one.
+func (c *Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+// Add adds delta, which must not be negative.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.v.mu.Lock()
+	c.v.get(labelValues).value += delta
+	c.v.mu.Unlock()
+}
+
+// Value returns the current value for the label combination.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	return c.v.get(labelValues).value
+}
+
+// Sum returns the total over the label combinations matching the given
+// name, value pairs; without pairs, over every combination.
+func (c *Counter) Sum(match ...string) float64 {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	var total float64
+series:
+	for _, s := range c.v.series {
+		for i := 0; i+1 < len(match); i += 2 {
+			for j, name := range c.v.labels {
+				if name == match[i] && s.values[j] != match[i+1] {
+					continue series
+				}
+			}
+		}
+		total += s.value
+	}
+	return total
+}
+
+func (c *Counter) write(w io.Writer, openMetrics bool) {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	c.v.header(w, openMetrics)
+	name := c.v.name
+	if openMetrics && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	for _, s := range c.v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", name, labelString(c.v.labels, s.values), formatFloat(s.value))
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ v *vec }
+
+// NewGauge registers a gauge in the Default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	f := Default.register(name, &Gauge{v: &vec{name: name, help: help, kind: "gauge", labels: labels, series: map[string]*series{}}})
+	return f.(*Gauge)
+}
+
+// Set replaces the value.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.v.mu.Lock()
+	g.v.get(labelValues).value = value
+	g.v.mu.Unlock()
+}
+
+// Add adjusts the value by delta (which may be negative).
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.v.mu.Lock()
+	g.v.get(labelValues).value += delta
+	g.v.mu.Unlock()
+}
+
+// Value returns the current value for the label combination.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	return g.v.get(labelValues).value
+}
+
+func (g *Gauge) write(w io.Writer, openMetrics bool) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	g.v.header(w, openMetrics)
+	for _, s := range g.v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", g.v.name, labelString(g.v.labels, s.values), formatFloat(s.value))
+	}
+}
+
+// DefaultBuckets suits request latencies in seconds, from 1ms to 10s.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	v       *vec
+	buckets []float64
+}
+
+// NewHistogram registers a histogram in the Default registry. Nil buckets
+// selects DefaultBuckets.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	f := Default.register(name, &Histogram{v: &vec{name: name, help: help, kind: "histogram", labels: labels, series: map[string]*series{}}, buckets: b})
+	return f.(*Histogram)
+}
+
+// Observe records one value.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.ObserveExemplar(value, "", labelValues...)
+}
+
+// ObserveExemplar records one value and, when traceID is set, keeps it as
+// the exemplar of the bucket the value falls in.
+func (h *Histogram) ObserveExemplar(value float64, traceID string, labelValues ...string) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+	s := h.v.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+		s.exemplars = make([]*exemplar, len(h.buckets)+1)
+	}
+	bucket := len(h.buckets)
+	for i, ub := range h.buckets {
+		if value <= ub {
+			s.counts[i]++
+			bucket = min(bucket, i)
+		}
+	}
+	s.sum += value
+	s.count++
+	if traceID != "" {
+		s.exemplars[bucket] = &exemplar{traceID: traceID, value: value, at: time.Now()}
+	}
+}
+
+// Count returns the number of observations for the label combination.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+	return h.v.get(labelValues).count
+}
+
+// Snapshot returns the cumulative bucket counts for the label combination.
+func (h *Histogram) Snapshot(labelValues ...string) HistogramSnapshot {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+	s := h.v.get(labelValues)
+	snap := HistogramSnapshot{Buckets: h.buckets, Counts: make([]uint64, len(h.buckets)), Count: s.count, Sum: s.sum}
+	copy(snap.Counts, s.counts)
+	return snap
+}
+
+// HistogramSnapshot is a histogram series at one point in time.
+type HistogramSnapshot struct {
+	Buckets []float64 // upper bounds, without +Inf
+	Counts  []uint64  // cumulative, per bucket
+	Count   uint64
+	Sum     float64
+}
+
+// Sub returns the observations made between prev and s.
+func (s HistogramSnapshot) Sub(prev HistogramSnapshot) HistogramSnapshot {
+	out := HistogramSnapshot{Buckets: s.Buckets, Counts: make([]uint64, len(s.Counts)), Count: s.Count - prev.Count, Sum: s.Sum - prev.Sum}
+	for i := range s.Counts {
+		out.Counts[i] = s.Counts[i]
+		if i < len(prev.Counts) {
+			out.Counts[i] -= prev.Counts[i]
+		}
+	}
+	return out
+}
+
+// Quantile estimates the q-quantile (0 < q < 1) by linear interpolation
+// within buckets, as PromQL's histogram_quantile does. It returns NaN
+// without observations, and the highest bound when the quantile falls in
+// the +Inf bucket.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 || len(s.Buckets) == 0 {
+		return math.NaN()
+	}
+	rank := q * float64(s.Count)
+	lower, below := 0.0, uint64(0)
+	for i, ub := range s.Buckets {
+		if float64(s.Counts[i]) >= rank {
+			in := s.Counts[i] - below
+			if in == 0 {
+				return ub
+			}
+			return lower + (ub-lower)*(rank-float64(below))/float64(in)
+		}
+		lower, below = ub, s.Counts[i]
+	}
+	return s.Buckets[len(s.Buckets)-1]
+}
+
+func (h *Histogram) write(w io.Writer, openMetrics bool) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+	h.v.header(w, openMetrics)
+	for _, s := range h.v.sorted() {
+		// exemplar returns the bucket's exemplar suffix, OpenMetrics only
+		exemplar := func(i int) string {
+			if !openMetrics || s.exemplars == nil || s.exemplars[i] == nil {
+				return ""
+			}
+			e := s.exemplars[i]
+			return fmt.Sprintf(" # {trace_id=%q} %s %.3f", e.traceID, formatFloat(e.value), float64(e.at.UnixMilli())/1000)
+		}
+		for i, ub := range h.buckets {
+			var n uint64
+			if s.counts != nil {
+				n = s.counts[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.v.name, labelString(h.v.labels, s.values, "le", formatFloat(ub)), n, exemplar(i))
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.v.name, labelString(h.v.labels, s.values, "le", "+Inf"), s.count, exemplar(len(h.buckets)))
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.v.name, labelString(h.v.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.v.name, labelString(h.v.labels, s.values), s.count)
+	}
+}
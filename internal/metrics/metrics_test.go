@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	c := NewCounter("test_lookups_total", "Lookups.", "tier", "result")
+	c.Inc("l1", "hit")
+	c.Add(2, "l2", "miss")
+	if again := NewCounter("test_lookups_total", "Lookups.", "tier", "result"); again != c {
+		t.Fatalf("expected re-registration to return the existing counter")
+	}
+	h := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "tier")
+	h.Observe(0.05, "l1")
+	h.Observe(0.5, "l1")
+
+	var buf bytes.Buffer
+	Default.WritePrometheus(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_lookups_total counter",
+		`test_lookups_total{tier="l1",result="hit"} 1`,
+		`test_lookups_total{tier="l2",result="miss"} 2`,
+		`test_latency_seconds_bucket{tier="l1",le="0.1"} 1`,
+		`test_latency_seconds_bucket{tier="l1",le="1"} 2`,
+		`test_latency_seconds_bucket{tier="l1",le="+Inf"} 2`,
+		`test_latency_seconds_count{tier="l1"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected output to contain %q\n%s", want, out)
+		}
+	}
+}
+
+func TestOpenMetricsExemplars(t *testing.T) {
+	c := NewCounter("test_om_requests_total", "Requests.")
+	c.Inc()
+	h := NewHistogram("test_om_latency_seconds", "Latency.", []float64{0.1, 1})
+	h.ObserveExemplar(0.05, "4bf92f3577b34da6a3ce929d0e0e4736")
+	h.ObserveExemplar(0.5, "")
+	h.ObserveExemplar(3, "00f067aa0ba902b7a3ce929d0e0e4736")
+
+	var buf bytes.Buffer
+	Default.WriteOpenMetrics(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_om_requests counter",
+		"test_om_requests_total 1",
+		`test_om_latency_seconds_bucket{le="0.1"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 0.05 `,
+		`test_om_latency_seconds_bucket{le="1"} 2` + "\n",
+		`test_om_latency_seconds_bucket{le="+Inf"} 3 # {trace_id="00f067aa0ba902b7a3ce929d0e0e4736"} 3 `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected output to contain %q\n%s", want, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Fatalf("expected OpenMetrics output to end with # EOF")
+	}
+	buf.Reset()
+	Default.WritePrometheus(&buf)
+	if strings.Contains(buf.String(), "trace_id") {
+		t.Fatalf("expected no exemplars in the Prometheus text format")
+	}
+
+	before := h.Snapshot()
+	for i := 0; i < 10; i++ {
+		h.Observe(0.08)
+	}
+	delta := h.Snapshot().Sub(before)
+	if delta.Count != 10 {
+		t.Fatalf("expected 10 observations in the delta got %d", delta.Count)
+	}
+	if p := delta.Quantile(0.5); p != 0.05 {
+		t.Fatalf("expected the median interpolated to 0.05 got %v", p)
+	}
+}
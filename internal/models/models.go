@@ -1,6 +1,17 @@
 package models
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Entry struct {
 	ID        int64                  `json:"id"`
@@ -9,4 +20,459 @@ type Entry struct {
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
 	CreatedAt time.Time              `json:"created_at,omitempty"`
 	UpdatedAt time.Time              `json:"updated_at,omitempty"`
+	// Provenance describes how the response was produced, for attributing
+	// savings. Optional.
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// Embedder identifies the model the vector was embedded with. The
+	// server sets it on every write that embeds; entries without one
+	// predate tracking.
+	Embedder *Embedder `json:"embedder,omitempty"`
+	// HitCount and LastHitAt are how often and when the entry was last
+	// served, as flushed to the store; hits since the last flush aren't
+	// counted yet. CreatedBy is the fingerprint of the API key that wrote
+	// the entry. The server maintains all three and ignores them on writes.
+	HitCount  int64     `json:"hit_count,omitempty"`
+	LastHitAt time.Time `json:"last_hit_at,omitzero"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	// Adapted is set on responses synthesized from a near-miss entry. The
+	// entry stored from one keeps it as metadata.adapted instead.
+	Adapted bool `json:"adapted,omitempty"`
+	// Score is the similarity to the query on search results and Region the
+	// federated peer that answered; neither is persisted.
+	Score  float64 `json:"score,omitempty"`
+	Region string  `json:"region,omitempty"`
+	// Scope binds the entry to the generation settings it was produced
+	// under. Only its hash is persisted, in metadata.scope.
+	Scope *Scope `json:"scope,omitempty"`
+	// Highlight marks the prompt words a lexical match was found on, when a
+	// search asked for it; it is never persisted.
+	Highlight *Highlight `json:"highlight,omitempty"`
+	// Variant labels which response a hit on an entry with a canary
+	// served: control for its own, or the canary's label. It is never
+	// persisted.
+	Variant string `json:"variant,omitempty"`
+}
+
+// Embedder identifies an embedding model. Vectors from different models
+// live in different spaces, so their similarity means nothing.
+type Embedder struct {
+	Backend string `json:"backend"`
+	Model   string `json:"model,omitempty"`
+	// Version identifies the model's weights, such as an Ollama digest.
+	Version string `json:"version,omitempty"`
+	// Fallback is set when the mock stood in for the configured backend.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// Comparable reports whether vectors embedded by e and o can be scored
+// against each other. An unknown embedder or version is taken to match.
+func (e *Embedder) Comparable(o *Embedder) bool {
+	if e == nil || o == nil {
+		return true
+	}
+	if e.Backend != o.Backend || e.Model != o.Model {
+		return false
+	}
+	return e.Version == "" || o.Version == "" || e.Version == o.Version
+}
+
+// Highlight is the prompt of a search result with its matched words
+// wrapped in <em> (the rest HTML-escaped), and the byte ranges of those
+// words in the raw prompt.
+type Highlight struct {
+	Prompt  string   `json:"prompt"`
+	Offsets [][2]int `json:"offsets"`
+}
+
+// Scope is the system prompt and model parameters a response depends on.
+// Entries stored with a scope are only served to lookups with the same one.
+type Scope struct {
+	SystemPrompt string   `json:"system_prompt,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	Temperature  *float64 `json:"temperature,omitempty"`
+	// Params holds any other parameters that change the answer (top_p,
+	// tools, ...).
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// Hash returns a stable digest of the scope, or "" for an empty scope.
+func (s *Scope) Hash() string {
+	if s == nil || (s.SystemPrompt == "" && s.Model == "" && s.Temperature == nil && len(s.Params) == 0) {
+		return ""
+	}
+	// encoding/json sorts map keys, so equal scopes encode identically
+	b, _ := json.Marshal(s)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Provenance records the generation that produced a cached response.
+type Provenance struct {
+	// Model is the generator model name (e.g. "gpt-4o", "llama3.2").
+	Model string `json:"model,omitempty"`
+	// LatencyMS is how long the original generation took.
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	// PromptTokens and CompletionTokens are the token counts billed for it.
+	PromptTokens     int `json:"prompt_tokens,omitempty"`
+	CompletionTokens int `json:"completion_tokens,omitempty"`
+	// CostUSD is the price of the generation, when the caller knows it.
+	CostUSD float64 `json:"cost_usd,omitempty"`
+	// RequestID is the upstream provider's request identifier.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Validate rejects negative measurements.
+func (p *Provenance) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.LatencyMS < 0 || p.PromptTokens < 0 || p.CompletionTokens < 0 || p.CostUSD < 0 {
+		return errors.New("provenance values must not be negative")
+	}
+	return nil
+}
+
+// Reserved metadata keys interpreted by the server. They live in metadata so
+// they round-trip through every store and can be used in metadata filters.
+const (
+	// MetaStale marks an entry whose answer is known to be outdated. Stale
+	// entries are skipped by search unless explicitly requested.
+	MetaStale = "stale"
+	// MetaNamespace partitions entries into namespaces. Entries without it
+	// belong to DefaultNamespace.
+	MetaNamespace = "namespace"
+	// MetaLLMString records the LLM configuration an answer was produced
+	// with (LangChain's llm_string) so cache lookups don't mix models.
+	MetaLLMString = "llm_string"
+	// MetaAdapted marks an entry stored from an adapted answer, and
+	// MetaAdaptedFrom and MetaAdaptedScore record the entry it was derived
+	// from and its similarity to the new query.
+	MetaAdapted      = "adapted"
+	MetaAdaptedFrom  = "adapted_from"
+	MetaAdaptedScore = "adapted_score"
+	// MetaRelated lists follow-up questions (a string or an array of
+	// strings) the server may prefetch when the entry is served.
+	MetaRelated = "related"
+	// MetaContextual marks an entry stored as a turn of a conversation
+	// (session_id); its vector blends the earlier turns, so it is neither
+	// served by exact prompt match nor re-embedded on its own.
+	MetaContextual = "contextual"
+	// MetaState holds the editorial lifecycle state of an entry (one of
+	// the State constants). Entries without it are published.
+	MetaState = "state"
+	// MetaPinned exempts a curated entry from TTL expiry, store eviction,
+	// garbage cleanup and scheduled purges.
+	MetaPinned = "pinned"
+	// MetaSources maps the IDs of the documents an answer was derived from
+	// to their content hash, so POST /revalidate can find the answers a
+	// document refresh outdates.
+	MetaSources = "sources"
+	// MetaSafety records why a safety check blocked a cached response.
+	MetaSafety = "safety"
+	// MetaScope holds the Scope hash of an entry stored with one.
+	MetaScope = "scope"
+	// MetaBlob references the entry's binary attachment (a BlobRef).
+	MetaBlob = "blob"
+	// MetaImage holds the SHA-256 of the image an entry's prompt refers
+	// to. Its vector combines the prompt's and the image's embeddings, so
+	// it only matches searches with an image, and is never served by exact
+	// prompt match or re-embedded from the prompt alone.
+	MetaImage = "image"
+	// MetaTool names the function whose result an entry caches, and
+	// MetaToolArgs holds the call's arguments as canonical JSON. Tool
+	// entries are only served to lookups for that tool.
+	MetaTool     = "tool"
+	MetaToolArgs = "tool_args"
+	// MetaSchema declares the JSON Schema the response conforms to, as an
+	// object or JSON text. A response that stops conforming is not served.
+	MetaSchema = "json_schema"
+	// MetaMaxHits limits how many times an entry is served; the serve that
+	// uses the last one expires it. MetaServed counts the serves so far and
+	// is maintained by the store.
+	MetaMaxHits = "max_hits"
+	MetaServed  = "served"
+	// MetaRefresh declares how to regenerate an entry's response upstream
+	// and how often: {"every", "target", "request"}.
+	MetaRefresh = "refresh"
+	// MetaCanary holds an alternate response served to a share of hits:
+	// {"response", "percent", "label"}.
+	MetaCanary = "canary"
+	// MetaQuality holds the quality score of the response from 0 to 1,
+	// e.g. an evaluator model's; it breaks ties on similarity.
+	MetaQuality = "quality"
+	// MetaCacheability holds the classifier's score from 0 to 1 of how
+	// stable the answer to the prompt is; set by the server when
+	// SLC_CACHEABILITY is on.
+	MetaCacheability = "cacheability"
+	// MetaSummarized marks a response the server summarized before storing
+	// it: {"tokens", "size", "sha256"} of the original, which is kept in
+	// the blob store.
+	MetaSummarized = "summarized"
+	// MetaEncrypted marks an entry written to an encrypted namespace: its
+	// prompt is a client-side hash, its response ciphertext and its vector
+	// the client's, so the server never embeds, indexes or reads either.
+	MetaEncrypted = "encrypted"
+)
+
+// Entry lifecycle states. Search only serves published entries, and drafts
+// when asked to.
+const (
+	StateDraft     = "draft"
+	StatePublished = "published"
+	StateArchived  = "archived"
+)
+
+// DefaultNamespace is the namespace of entries that don't declare one.
+const DefaultNamespace = "default"
+
+// Namespace returns the entry's namespace.
+func (e *Entry) Namespace() string {
+	if e != nil && e.Metadata != nil {
+		if ns, ok := e.Metadata[MetaNamespace].(string); ok && ns != "" {
+			return ns
+		}
+	}
+	return DefaultNamespace
+}
+
+// Namespace holds the settings of a namespace declared through
+// /namespaces. Settings left unset fall back to the server's.
+type Namespace struct {
+	Name string `json:"name"`
+	// TTL overrides SLC_TTL for the namespace's entries, as a Go duration
+	// such as "24h".
+	TTL string `json:"ttl,omitempty"`
+	// MinScore is the similarity its entries need to be served.
+	MinScore *float64 `json:"min_score,omitempty"`
+	// MaxEntries caps its entries; beyond it the oldest unpinned ones are
+	// evicted.
+	MaxEntries int `json:"max_entries,omitempty"`
+	// Quota caps its entries too, but writes beyond it are refused instead
+	// of evicting; warnings are sent as it fills up.
+	Quota int `json:"quota,omitempty"`
+	// Schema is the JSON Schema responses must conform to when an entry
+	// declares none in metadata.json_schema.
+	Schema interface{} `json:"json_schema,omitempty"`
+	// SummarizeAbove overrides SLC_SUMMARIZE_ABOVE for its entries: their
+	// responses over this many tokens are stored summarized; 0 turns it
+	// off.
+	SummarizeAbove *int `json:"summarize_above,omitempty"`
+	// Encrypted keeps plaintext out of the namespace: clients write prompt
+	// hashes and ciphertext with vectors they embedded themselves, and look
+	// entries up by vector only.
+	Encrypted bool      `json:"encrypted,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate rejects malformed names and settings. The schema is checked by
+// the server, which parses it.
+func (n *Namespace) Validate() error {
+	if n.Name == "" || strings.ContainsAny(n.Name, "/?#") {
+		return errors.New("name is required and may not contain /, ? or #")
+	}
+	if n.TTL != "" {
+		if d, err := time.ParseDuration(n.TTL); err != nil || d <= 0 {
+			return fmt.Errorf("ttl %q is not a positive duration", n.TTL)
+		}
+	}
+	if n.MinScore != nil && (*n.MinScore < 0 || *n.MinScore > 1) {
+		return errors.New("min_score must be between 0 and 1")
+	}
+	if n.MaxEntries < 0 {
+		return errors.New("max_entries must not be negative")
+	}
+	if n.Quota < 0 {
+		return errors.New("quota must not be negative")
+	}
+	if n.SummarizeAbove != nil && *n.SummarizeAbove < 0 {
+		return errors.New("summarize_above must not be negative")
+	}
+	if n.Encrypted && n.Name == DefaultNamespace {
+		return errors.New("the default namespace can't be encrypted")
+	}
+	if n.Encrypted && n.Schema != nil {
+		return errors.New("json_schema can't be checked against an encrypted namespace's ciphertext")
+	}
+	return nil
+}
+
+// State returns the entry's lifecycle state.
+func (e *Entry) State() string {
+	if e != nil && e.Metadata != nil {
+		if st, ok := e.Metadata[MetaState].(string); ok && st != "" {
+			return st
+		}
+	}
+	return StatePublished
+}
+
+// ScopeHash returns the entry's scope hash, "" when it is unscoped.
+func (e *Entry) ScopeHash() string {
+	if e != nil && e.Metadata != nil {
+		if h, ok := e.Metadata[MetaScope].(string); ok {
+			return h
+		}
+	}
+	return ""
+}
+
+// Tool returns the function whose result the entry caches, "" for an
+// ordinary entry.
+func (e *Entry) Tool() string {
+	if e != nil && e.Metadata != nil {
+		if t, ok := e.Metadata[MetaTool].(string); ok {
+			return t
+		}
+	}
+	return ""
+}
+
+// ImageHash returns the hash of the image the entry is conditioned on, ""
+// for a text-only entry.
+func (e *Entry) ImageHash() string {
+	if e != nil && e.Metadata != nil {
+		if h, ok := e.Metadata[MetaImage].(string); ok {
+			return h
+		}
+	}
+	return ""
+}
+
+// Opaque reports whether e's vector can't be recomputed from its prompt
+// alone: it blends earlier turns of a conversation (MetaContextual) or an
+// image, or the prompt is encrypted. Such entries are neither re-embedded
+// nor served by exact prompt match.
+func (e *Entry) Opaque() bool {
+	return e.Flag(MetaContextual) || e.ImageHash() != "" || e.Flag(MetaEncrypted)
+}
+
+// BlobRef describes a binary attachment kept in the blob store under Key.
+type BlobRef struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// Blob returns the entry's attachment, nil when it has none.
+func (e *Entry) Blob() *BlobRef {
+	if e == nil || e.Metadata == nil || e.Metadata[MetaBlob] == nil {
+		return nil
+	}
+	// the reference is a map in memory and whatever JSON made of it in
+	// other stores
+	raw, err := json.Marshal(e.Metadata[MetaBlob])
+	if err != nil {
+		return nil
+	}
+	var ref BlobRef
+	if json.Unmarshal(raw, &ref) != nil || ref.Key == "" {
+		return nil
+	}
+	return &ref
+}
+
+// Flag reports whether the metadata key holds a true boolean (or the string
+// "true"), the form used by reserved flag keys such as MetaStale.
+func (e *Entry) Flag(key string) bool {
+	if e == nil || e.Metadata == nil {
+		return false
+	}
+	switch v := e.Metadata[key].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Quality returns the entry's quality score and whether it has one.
+func (e *Entry) Quality() (float64, bool) {
+	if e == nil || e.Metadata == nil {
+		return 0, false
+	}
+	switch v := e.Metadata[MetaQuality].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Count returns the metadata key as a whole number (a JSON number, a Go
+// integer or a numeric string), 0 when it is absent, negative or not a
+// whole number; the form used by counter keys such as MetaMaxHits.
+func (e *Entry) Count(key string) int {
+	if e == nil || e.Metadata == nil {
+		return 0
+	}
+	var n int
+	switch v := e.Metadata[key].(type) {
+	case int:
+		n = v
+	case int64:
+		n = int(v)
+	case float64:
+		if v == math.Trunc(v) {
+			n = int(v)
+		}
+	case json.Number:
+		i, _ := v.Int64()
+		n = int(i)
+	case string:
+		n, _ = strconv.Atoi(v)
+	}
+	return max(n, 0)
+}
+
+// BatchResult reports the outcome of one item of a bulk request.
+type BatchResult struct {
+	Index int    `json:"index"`
+	ID    int64  `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// RestoreResult reports what a restore loaded. Replayed counts journal
+// records applied on top of the backup for a point-in-time restore.
+type RestoreResult struct {
+	Entries    int       `json:"entries"`
+	Replayed   int       `json:"replayed"`
+	RestoredTo time.Time `json:"restored_to"`
+}
+
+// Check statuses of a DoctorReport.
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// DoctorCheck is the outcome of one self-test. Detail says what was found
+// and, for warnings and failures, what to do about it.
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// DoctorReport is the result of a self-test. OK is false when any check
+// failed; warnings don't stop a server from serving.
+type DoctorReport struct {
+	OK     bool          `json:"ok"`
+	Checks []DoctorCheck `json:"checks"`
+}
+
+// WriteText prints one line per check, as the CLIs show the report.
+func (r DoctorReport) WriteText(w io.Writer) {
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "%-4s  %-10s  %s\n", c.Status, c.Name, c.Detail)
+	}
 }
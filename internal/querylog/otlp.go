@@ -0,0 +1,146 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLPSink ships records to an OpenTelemetry collector using OTLP/HTTP with
+// JSON encoding. Records are buffered and sent in batches from a background
+// goroutine; when the buffer is full new records are dropped rather than
+// slowing searches down.
+type OTLPSink struct {
+	endpoint string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []otlpRecord
+	dropped int
+	max     int
+
+	flush chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type otlpRecord struct {
+	at   time.Time
+	line string
+}
+
+// NewOTLPSink sends to endpoint, the collector's logs URL (for example
+// http://otel-collector:4318/v1/logs), every interval.
+func NewOTLPSink(endpoint string, interval time.Duration) *OTLPSink {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	s := &OTLPSink{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		max:      10000,
+		flush:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.loop(interval)
+	return s
+}
+
+func (s *OTLPSink) Write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= s.max {
+		s.dropped++
+		return nil
+	}
+	s.pending = append(s.pending, otlpRecord{at: time.Now(), line: string(line)})
+	if len(s.pending) >= 512 {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *OTLPSink) loop(interval time.Duration) {
+	defer close(s.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.flush:
+		case <-s.stop:
+			_ = s.send()
+			return
+		}
+		if err := s.send(); err != nil {
+			// the next tick retries with whatever is buffered by then
+			log.Printf("querylog: otlp export: %v", err)
+		}
+	}
+}
+
+func (s *OTLPSink) send() error {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	dropped := s.dropped
+	s.dropped = 0
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	body, _ := json.Marshal(otlpPayload(batch, dropped))
+	resp, err := s.client.Post(s.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *OTLPSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+type kv = map[string]interface{}
+
+func attr(key string, v kv) kv { return kv{"key": key, "value": v} }
+
+// otlpPayload builds an ExportLogsServiceRequest in OTLP's JSON mapping.
+func otlpPayload(batch []otlpRecord, dropped int) kv {
+	records := make([]kv, 0, len(batch))
+	for _, r := range batch {
+		records = append(records, kv{
+			"timeUnixNano":   strconv.FormatInt(r.at.UnixNano(), 10),
+			"severityNumber": 9,
+			"severityText":   "INFO",
+			"body":           kv{"stringValue": r.line},
+			"attributes":     []kv{attr("event.name", kv{"stringValue": "slmcache.search"})},
+		})
+	}
+	scope := kv{"scope": kv{"name": "slmcache.querylog"}, "logRecords": records}
+	res := kv{"attributes": []kv{attr("service.name", kv{"stringValue": "slmcache"})}}
+	if dropped > 0 {
+		scope["logRecords"] = append(records, kv{
+			"timeUnixNano":   strconv.FormatInt(time.Now().UnixNano(), 10),
+			"severityNumber": 13,
+			"severityText":   "WARN",
+			"body":           kv{"stringValue": fmt.Sprintf("querylog: dropped %d records (buffer full)", dropped)},
+		})
+	}
+	return kv{"resourceLogs": []kv{{"resource": res, "scopeLogs": []kv{scope}}}}
+}
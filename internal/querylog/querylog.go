@@ -0,0 +1,139 @@
+// Package querylog writes structured search logs for offline evaluation.
+// Query text passes through a privacy filter before it reaches any sink.
+package querylog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Record is one logged search.
+type Record struct {
+	Time      time.Time         `json:"ts"`
+	Source    string            `json:"source"`
+	Query     string            `json:"query,omitempty"`
+	QueryHash string            `json:"query_hash,omitempty"`
+	Filters   map[string]string `json:"filters,omitempty"`
+	Tier      string            `json:"tier"`
+	IDs       []int64           `json:"ids"`
+	Scores    []float64         `json:"scores"`
+	LatencyMS float64           `json:"latency_ms"`
+}
+
+// TextMode controls how much of the query text is logged.
+type TextMode string
+
+const (
+	// TextHash logs a salted SHA-256 of the query, enough to group repeats.
+	TextHash TextMode = "hash"
+	// TextTruncate logs the first Truncate characters and the hash.
+	TextTruncate TextMode = "truncate"
+	// TextFull logs the query verbatim.
+	TextFull TextMode = "full"
+	// TextNone logs neither text nor hash.
+	TextNone TextMode = "none"
+)
+
+// Privacy is the filter applied to query text.
+type Privacy struct {
+	Mode     TextMode
+	Truncate int
+	Salt     string
+}
+
+// Apply fills rec's Query and QueryHash from text according to p.
+func (p Privacy) Apply(rec *Record, text string) {
+	switch p.Mode {
+	case TextNone:
+		return
+	case TextFull:
+		rec.Query = text
+		return
+	case TextTruncate:
+		n := p.Truncate
+		if n <= 0 {
+			n = 32
+		}
+		if utf8.RuneCountInString(text) > n {
+			text2 := []rune(text)[:n]
+			rec.Query = string(text2) + "…"
+		} else {
+			rec.Query = text
+		}
+	}
+	sum := sha256.Sum256([]byte(p.Salt + text))
+	rec.QueryHash = hex.EncodeToString(sum[:])
+}
+
+// ParseTextMode validates a configured mode, defaulting to TextHash.
+func ParseTextMode(v string) (TextMode, error) {
+	switch m := TextMode(strings.ToLower(strings.TrimSpace(v))); m {
+	case "":
+		return TextHash, nil
+	case TextHash, TextTruncate, TextFull, TextNone:
+		return m, nil
+	default:
+		return "", fmt.Errorf("querylog: unknown text mode %q (want hash, truncate, full or none)", v)
+	}
+}
+
+// Sink receives encoded records.
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Logger fans records out to its sinks. A nil *Logger discards records.
+type Logger struct {
+	Privacy Privacy
+
+	mu    sync.Mutex
+	sinks []Sink
+}
+
+func New(p Privacy, sinks ...Sink) *Logger {
+	return &Logger{Privacy: p, sinks: sinks}
+}
+
+// Log applies the privacy filter to text and writes rec to every sink.
+// Sink errors are logged, never returned: query logging must not fail a
+// search.
+func (l *Logger) Log(rec Record, text string) {
+	if l == nil {
+		return
+	}
+	l.Privacy.Apply(&rec, text)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.sinks {
+		if err := s.Write(line); err != nil {
+			log.Printf("querylog: %v", err)
+		}
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var first error
+	for _, s := range l.sinks {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,88 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrivacyModes(t *testing.T) {
+	text := "what is my account balance for 4111-1111"
+	cases := []struct {
+		p         Privacy
+		query     string
+		wantsHash bool
+	}{
+		{Privacy{Mode: TextHash}, "", true},
+		{Privacy{Mode: TextTruncate, Truncate: 7}, "what is…", true},
+		{Privacy{Mode: TextFull}, text, false},
+		{Privacy{Mode: TextNone}, "", false},
+	}
+	for _, c := range cases {
+		var rec Record
+		c.p.Apply(&rec, text)
+		if rec.Query != c.query || (rec.QueryHash != "") != c.wantsHash {
+			t.Fatalf("%s: expected query %q hash=%v got %+v", c.p.Mode, c.query, c.wantsHash, rec)
+		}
+	}
+	var a, b Record
+	Privacy{Mode: TextHash, Salt: "x"}.Apply(&a, text)
+	Privacy{Mode: TextHash, Salt: "y"}.Apply(&b, text)
+	if a.QueryHash == b.QueryHash {
+		t.Fatalf("expected salt to change the hash")
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	sink, err := NewFileSink(path, 256, 2)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	l := New(Privacy{Mode: TextNone}, sink)
+	for i := 0; i < 10; i++ {
+		l.Log(Record{Source: "search", Tier: "l2"}, "q")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		st, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+		if st.Size() > 256 {
+			t.Fatalf("expected %s within 256 bytes, got %d", name, st.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 rotated files")
+	}
+}
+
+func TestOTLPSinkExports(t *testing.T) {
+	got := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		got <- body
+	}))
+	defer srv.Close()
+	sink := NewOTLPSink(srv.URL+"/v1/logs", time.Hour)
+	New(Privacy{Mode: TextHash}, sink).Log(Record{Source: "search", Tier: "l1", IDs: []int64{7}}, "hello")
+	_ = sink.Close()
+	select {
+	case body := <-got:
+		b, _ := json.Marshal(body)
+		if !strings.Contains(string(b), `\"ids\":[7]`) || strings.Contains(string(b), "hello") {
+			t.Fatalf("unexpected payload %s", b)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected export on close")
+	}
+}
@@ -0,0 +1,343 @@
+// Package resp implements the subset of the Redis serialization protocol
+// (RESP2) needed to serve Redis-speaking clients: reading commands and
+// values, writing replies, and a connection loop.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Value types as they appear on the wire.
+const (
+	SimpleString = '+'
+	Error        = '-'
+	Integer      = ':'
+	BulkString   = '$'
+	Array        = '*'
+)
+
+// maxBulk bounds bulk strings and arrays read from the wire so a malformed
+// length cannot make us allocate unbounded memory. maxLine bounds a line,
+// such as an inline command, and maxDepth the nesting of arrays.
+const (
+	maxBulk  = 512 * 1024 * 1024
+	maxArgs  = 1024 * 1024
+	maxLine  = 64 * 1024
+	maxDepth = 32
+)
+
+// Value is a decoded RESP value. Null bulk strings and arrays have Null set.
+type Value struct {
+	Type  byte
+	Str   string
+	Int   int64
+	Array []Value
+	Null  bool
+}
+
+// Reader decodes RESP values from a stream.
+type Reader struct {
+	r *bufio.Reader
+	// MaxBulk and MaxArgs bound the commands ReadCommand accepts: the length
+	// of each argument and how many there are. Zero means 512MiB and 1Mi.
+	MaxBulk, MaxArgs int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+func (r *Reader) line() (string, error) {
+	var b []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if len(b)+len(chunk) > maxLine {
+			return "", errors.New("resp: line too long")
+		}
+		b = append(b, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+}
+
+// ReadValue reads one value of any type.
+func (r *Reader) ReadValue() (Value, error) {
+	return r.value(0)
+}
+
+func (r *Reader) value(depth int) (Value, error) {
+	l, err := r.line()
+	if err != nil {
+		return Value{}, err
+	}
+	if l == "" {
+		// blank inline command
+		return Value{Type: Array}, nil
+	}
+	v := Value{Type: l[0]}
+	body := l[1:]
+	switch v.Type {
+	case SimpleString, Error:
+		v.Str = body
+	case Integer:
+		if v.Int, err = strconv.ParseInt(body, 10, 64); err != nil {
+			return v, fmt.Errorf("resp: bad integer %q", body)
+		}
+	case BulkString:
+		n, err := strconv.Atoi(body)
+		if err != nil || n > maxBulk {
+			return v, fmt.Errorf("resp: bad bulk length %q", body)
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			return v, err
+		}
+		v.Str = string(buf[:n])
+	case Array:
+		n, err := strconv.Atoi(body)
+		if err != nil || n > maxBulk {
+			return v, fmt.Errorf("resp: bad array length %q", body)
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		if depth == maxDepth {
+			return v, errors.New("resp: arrays nested too deeply")
+		}
+		v.Array = make([]Value, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			item, err := r.value(depth + 1)
+			if err != nil {
+				return v, err
+			}
+			v.Array = append(v.Array, item)
+		}
+	default:
+		// inline command (e.g. typed into telnet)
+		v = Value{Type: Array}
+		for _, f := range strings.Fields(l) {
+			v.Array = append(v.Array, Value{Type: BulkString, Str: f})
+		}
+	}
+	return v, nil
+}
+
+// ReadCommand reads a command as its argument list: an array of bulk
+// strings, or an inline command. Blank inline lines are skipped. Arguments
+// are held to MaxBulk and MaxArgs.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		l, err := r.line()
+		if err != nil {
+			return nil, err
+		}
+		if l == "" {
+			continue
+		}
+		switch l[0] {
+		case SimpleString, Error, Integer, BulkString:
+			return nil, fmt.Errorf("resp: expected command array, got %q", l[0])
+		case Array:
+		default:
+			// inline command (e.g. typed into telnet)
+			args := strings.Fields(l)
+			if len(args) > r.maxArgs() {
+				return nil, errors.New("resp: too many arguments")
+			}
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+		n, err := strconv.Atoi(l[1:])
+		if err != nil || n > r.maxArgs() {
+			return nil, fmt.Errorf("resp: bad array length %q", l[1:])
+		}
+		if n <= 0 {
+			continue
+		}
+		args := make([]string, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			if args, err = r.arg(args); err != nil {
+				return nil, err
+			}
+		}
+		return args, nil
+	}
+}
+
+// arg reads a command argument, which must be a bulk string, onto args.
+func (r *Reader) arg(args []string) ([]string, error) {
+	l, err := r.line()
+	if err != nil {
+		return nil, err
+	}
+	if l == "" || l[0] != BulkString {
+		return nil, fmt.Errorf("resp: expected bulk string argument, got %q", l)
+	}
+	n, err := strconv.Atoi(l[1:])
+	if err != nil || n < 0 || n > r.maxBulk() {
+		return nil, fmt.Errorf("resp: bad bulk length %q", l[1:])
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	return append(args, string(buf[:n])), nil
+}
+
+func (r *Reader) maxBulk() int {
+	if r.MaxBulk > 0 {
+		return min(r.MaxBulk, maxBulk)
+	}
+	return maxBulk
+}
+
+func (r *Reader) maxArgs() int {
+	if r.MaxArgs > 0 {
+		return min(r.MaxArgs, maxArgs)
+	}
+	return maxArgs
+}
+
+// Writer encodes replies. Writes are buffered until Flush.
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+func (w *Writer) WriteSimple(s string) { fmt.Fprintf(w.w, "+%s\r\n", s) }
+func (w *Writer) WriteError(s string)  { fmt.Fprintf(w.w, "-%s\r\n", s) }
+func (w *Writer) WriteInt(n int64)     { fmt.Fprintf(w.w, ":%d\r\n", n) }
+func (w *Writer) WriteNull()           { w.w.WriteString("$-1\r\n") }
+func (w *Writer) WriteArray(n int)     { fmt.Fprintf(w.w, "*%d\r\n", n) }
+
+func (w *Writer) WriteBulk(s string) {
+	fmt.Fprintf(w.w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+// WriteCommand encodes args as a command array (the client side of the
+// protocol).
+func (w *Writer) WriteCommand(args ...string) {
+	w.WriteArray(len(args))
+	for _, a := range args {
+		w.WriteBulk(a)
+	}
+}
+
+func (w *Writer) Flush() error { return w.w.Flush() }
+
+// Handler serves one command. Returning false closes the connection after
+// the reply is flushed (QUIT).
+type Handler func(w *Writer, args []string) bool
+
+// Server accepts RESP connections and dispatches their commands to Handler.
+type Server struct {
+	Handler Handler
+	// NewHandler, when set, makes a Handler for each connection instead,
+	// so commands can depend on earlier ones on it, such as AUTH. r is the
+	// connection's reader, whose limits the handler may change, e.g. keep
+	// them small until the client authenticates.
+	NewHandler func(r *Reader) Handler
+	// Allow, when set, decides whether a connection from addr is served;
+	// refused connections are closed straight away.
+	Allow func(addr net.Addr) bool
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// Serve accepts connections on ln until it is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if s.Allow != nil && !s.Allow(conn.RemoteAddr()) {
+			_ = conn.Close()
+			continue
+		}
+		s.track(conn, true)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.track(conn, false)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close drops open connections and waits for their handlers to return. The
+// listener passed to Serve must be closed by the caller.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) track(c net.Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.conns == nil {
+			s.conns = map[net.Conn]struct{}{}
+		}
+		s.conns[c] = struct{}{}
+		return
+	}
+	delete(s.conns, c)
+	_ = c.Close()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	r := NewReader(conn)
+	w := NewWriter(conn)
+	handle := s.Handler
+	if s.NewHandler != nil {
+		handle = s.NewHandler(r)
+	}
+	for {
+		args, err := r.ReadCommand()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				w.WriteError("ERR protocol error: " + err.Error())
+				_ = w.Flush()
+				log.Printf("resp: %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		keep := handle(w, args)
+		if err := w.Flush(); err != nil || !keep {
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package resp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	r := NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$12\r\nhello\r\nworld\r\n$1\r\nx\r\n\r\nPING  now\r\n"))
+	args, err := r.ReadCommand()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(args) != 3 || args[1] != "hello\r\nworld" {
+		t.Fatalf("expected binary-safe bulk args, got %q", args)
+	}
+	if args, err = r.ReadCommand(); err != nil || strings.Join(args, " ") != "PING now" {
+		t.Fatalf("expected inline PING now, got %q err=%v", args, err)
+	}
+	if _, err := NewReader(strings.NewReader("*1\r\n$x\r\n")).ReadCommand(); err == nil {
+		t.Fatalf("expected error for bad bulk length")
+	}
+	if _, err := NewReader(strings.NewReader("*1\r\n*1\r\n$4\r\nPING\r\n")).ReadCommand(); err == nil {
+		t.Fatalf("expected error for a nested array")
+	}
+	if _, err := NewReader(strings.NewReader(strings.Repeat("*1\r\n", 100000))).ReadValue(); err == nil {
+		t.Fatalf("expected error for arrays nested too deeply")
+	}
+	if _, err := NewReader(strings.NewReader(strings.Repeat("x", 100000) + "\r\n")).ReadCommand(); err == nil {
+		t.Fatalf("expected error for an inline command too long")
+	}
+	limited := NewReader(strings.NewReader("*2\r\n$4\r\nAUTH\r\n$10\r\n0123456789\r\n*4\r\n"))
+	limited.MaxBulk, limited.MaxArgs = 8, 3
+	if _, err := limited.ReadCommand(); err == nil {
+		t.Fatalf("expected error for an argument past MaxBulk")
+	}
+	limited = NewReader(strings.NewReader("*4\r\n"))
+	limited.MaxArgs = 3
+	if _, err := limited.ReadCommand(); err == nil {
+		t.Fatalf("expected error for more arguments than MaxArgs")
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteSimple("OK")
+	w.WriteBulk("hi")
+	w.WriteNull()
+	w.WriteInt(7)
+	w.WriteError("ERR nope")
+	_ = w.Flush()
+
+	r := NewReader(&buf)
+	want := []Value{{Type: SimpleString, Str: "OK"}, {Type: BulkString, Str: "hi"}, {Type: BulkString, Null: true}, {Type: Integer, Int: 7}, {Type: Error, Str: "ERR nope"}}
+	for i, exp := range want {
+		got, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+		if got.Type != exp.Type || got.Str != exp.Str || got.Int != exp.Int || got.Null != exp.Null {
+			t.Fatalf("value %d: expected %+v got %+v", i, exp, got)
+		}
+	}
+}
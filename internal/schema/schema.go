@@ -0,0 +1,280 @@
+// Package schema validates JSON documents against the commonly used subset
+// of JSON Schema that structured-output APIs accept: type, enum, const,
+// properties, required, additionalProperties, items, the length, size and
+// range bounds, pattern, and allOf/anyOf/oneOf/not. References ($ref) and
+// format are not supported; unknown keywords are ignored, as the
+// specification asks.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Parse decodes a schema given as a decoded JSON value (an object or a
+// boolean) or as JSON text.
+func Parse(v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return nil, fmt.Errorf("schema: %w", err)
+		}
+	}
+	switch v.(type) {
+	case map[string]interface{}, bool:
+		return v, nil
+	}
+	return nil, fmt.Errorf("schema: must be an object or a boolean, not %T", v)
+}
+
+// ValidateJSON checks that doc is JSON text conforming to schema.
+func ValidateJSON(schema interface{}, doc string) error {
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		return fmt.Errorf("not JSON: %w", err)
+	}
+	return Validate(schema, v)
+}
+
+// Validate checks a decoded JSON value against schema. The error names the
+// first violation and where in the document it is.
+func Validate(schema, v interface{}) error {
+	return validate(schema, v, "$")
+}
+
+func validate(schema, v interface{}, path string) error {
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			return fmt.Errorf("%s: not allowed", path)
+		}
+		return nil
+	case map[string]interface{}:
+		return validateObject(s, v, path)
+	}
+	return fmt.Errorf("%s: invalid schema %T", path, schema)
+}
+
+func validateObject(s map[string]interface{}, v interface{}, path string) error {
+	if t, ok := s["type"]; ok && !typeMatches(t, v) {
+		return fmt.Errorf("%s: expected %v, got %s", path, t, typeOf(v))
+	}
+	if c, ok := s["const"]; ok && !equal(c, v) {
+		return fmt.Errorf("%s: expected %v", path, c)
+	}
+	if e, ok := s["enum"].([]interface{}); ok && !slices.ContainsFunc(e, func(x interface{}) bool { return equal(x, v) }) {
+		return fmt.Errorf("%s: %v is not one of %v", path, v, e)
+	}
+	switch t := v.(type) {
+	case string:
+		if err := validateString(s, t, path); err != nil {
+			return err
+		}
+	case float64:
+		if err := validateNumber(s, t, path); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := validateArray(s, t, path); err != nil {
+			return err
+		}
+	case map[string]interface{}:
+		if err := validateProperties(s, t, path); err != nil {
+			return err
+		}
+	}
+	return validateCombinators(s, v, path)
+}
+
+func validateString(s map[string]interface{}, v, path string) error {
+	n := len([]rune(v))
+	if min, ok := number(s["minLength"]); ok && float64(n) < min {
+		return fmt.Errorf("%s: shorter than %v characters", path, min)
+	}
+	if max, ok := number(s["maxLength"]); ok && float64(n) > max {
+		return fmt.Errorf("%s: longer than %v characters", path, max)
+	}
+	if p, ok := s["pattern"].(string); ok {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern %q", path, p)
+		}
+		if !re.MatchString(v) {
+			return fmt.Errorf("%s: does not match %q", path, p)
+		}
+	}
+	return nil
+}
+
+func validateNumber(s map[string]interface{}, v float64, path string) error {
+	if min, ok := number(s["minimum"]); ok && v < min {
+		return fmt.Errorf("%s: %v is less than %v", path, v, min)
+	}
+	if max, ok := number(s["maximum"]); ok && v > max {
+		return fmt.Errorf("%s: %v is greater than %v", path, v, max)
+	}
+	if min, ok := number(s["exclusiveMinimum"]); ok && v <= min {
+		return fmt.Errorf("%s: %v is not greater than %v", path, v, min)
+	}
+	if max, ok := number(s["exclusiveMaximum"]); ok && v >= max {
+		return fmt.Errorf("%s: %v is not less than %v", path, v, max)
+	}
+	if m, ok := number(s["multipleOf"]); ok && m > 0 {
+		if q := v / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			return fmt.Errorf("%s: %v is not a multiple of %v", path, v, m)
+		}
+	}
+	return nil
+}
+
+func validateArray(s map[string]interface{}, v []interface{}, path string) error {
+	if min, ok := number(s["minItems"]); ok && float64(len(v)) < min {
+		return fmt.Errorf("%s: fewer than %v items", path, min)
+	}
+	if max, ok := number(s["maxItems"]); ok && float64(len(v)) > max {
+		return fmt.Errorf("%s: more than %v items", path, max)
+	}
+	if u, _ := s["uniqueItems"].(bool); u {
+		for i := range v {
+			for j := i + 1; j < len(v); j++ {
+				if equal(v[i], v[j]) {
+					return fmt.Errorf("%s: items %d and %d are equal", path, i, j)
+				}
+			}
+		}
+	}
+	if items, ok := s["items"]; ok {
+		for i, x := range v {
+			if err := validate(items, x, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateProperties(s map[string]interface{}, v map[string]interface{}, path string) error {
+	if req, ok := s["required"].([]interface{}); ok {
+		for _, k := range req {
+			if name, ok := k.(string); ok {
+				if _, present := v[name]; !present {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+	}
+	if min, ok := number(s["minProperties"]); ok && float64(len(v)) < min {
+		return fmt.Errorf("%s: fewer than %v properties", path, min)
+	}
+	if max, ok := number(s["maxProperties"]); ok && float64(len(v)) > max {
+		return fmt.Errorf("%s: more than %v properties", path, max)
+	}
+	props, _ := s["properties"].(map[string]interface{})
+	additional, hasAdditional := s["additionalProperties"]
+	// check in key order so the reported violation doesn't vary
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		sub, ok := props[k]
+		if !ok {
+			if !hasAdditional {
+				continue
+			}
+			sub = additional
+		}
+		if err := validate(sub, v[k], path+"."+k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCombinators(s map[string]interface{}, v interface{}, path string) error {
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := validate(sub, v, path); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		if matching(anyOf, v, path) == 0 {
+			return fmt.Errorf("%s: matches none of anyOf", path)
+		}
+	}
+	if one, ok := s["oneOf"].([]interface{}); ok {
+		if n := matching(one, v, path); n != 1 {
+			return fmt.Errorf("%s: matches %d of oneOf, not exactly 1", path, n)
+		}
+	}
+	if not, ok := s["not"]; ok && validate(not, v, path) == nil {
+		return fmt.Errorf("%s: matches a schema under not", path)
+	}
+	return nil
+}
+
+func matching(schemas []interface{}, v interface{}, path string) int {
+	n := 0
+	for _, sub := range schemas {
+		if validate(sub, v, path) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// typeMatches reports whether v is of the type, or one of the types, t
+// names. Integers are numbers without a fractional part.
+func typeMatches(t, v interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		got := typeOf(v)
+		return got == t || (t == "number" && got == "integer")
+	case []interface{}:
+		for _, x := range t {
+			if typeMatches(x, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if t == math.Trunc(t) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return strings.ToLower(fmt.Sprintf("%T", v))
+}
+
+func number(v interface{}) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// equal compares decoded JSON values.
+func equal(a, b interface{}) bool {
+	ja, err1 := json.Marshal(a)
+	jb, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(ja) == string(jb)
+}
@@ -0,0 +1,47 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	s, err := Parse(`{
+		"type": "object",
+		"required": ["name", "tags"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "pattern": "^[a-z]+$"},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "uniqueItems": true},
+			"score": {"anyOf": [{"type": "number", "maximum": 1}, {"type": "null"}]}
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for doc, want := range map[string]string{
+		`{"name":"ada","tags":["a"],"age":36,"score":null}`: "",
+		`{"name":"ada","tags":[],"score":0.5}`:              "",
+		`{"tags":["a"]}`:                                    `missing required property "name"`,
+		`{"name":"ada","tags":["c"]}`:                       "$.tags[0]: c is not one of",
+		`{"name":"ada","tags":["a","a"]}`:                   "are equal",
+		`{"name":"Ada","tags":[]}`:                          "does not match",
+		`{"name":"ada","tags":[],"age":1.5}`:                "$.age: expected integer, got number",
+		`{"name":"ada","tags":[],"score":2}`:                "matches none of anyOf",
+		`{"name":"ada","tags":[],"extra":true}`:             "$.extra: not allowed",
+		`["ada"]`:                                           "expected object, got array",
+		`{"name":`:                                          "not JSON",
+	} {
+		err := ValidateJSON(s, doc)
+		switch {
+		case want == "" && err != nil:
+			t.Errorf("%s: expected valid got %v", doc, err)
+		case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+			t.Errorf("%s: expected %q got %v", doc, want, err)
+		}
+	}
+	if _, err := Parse(`[1]`); err == nil {
+		t.Fatalf("expected an array schema to be rejected")
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var adaptations = metrics.NewCounter("slmcache_adaptations_total",
+	"Near-miss answers adapted by the generative model, by outcome.", "result")
+
+// adaptMargin is how far under the similarity threshold a candidate may be
+// and still be adapted (SLC_ADAPT_MARGIN, default 0.1). Adaptation is off
+// unless a generator is configured.
+func (s *Server) adaptMargin() float64 {
+	if s.getGenerator() == nil {
+		return 0
+	}
+	if v := config.Get("SLC_ADAPT_MARGIN"); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return 0.1
+}
+
+const adaptTemplate = `A cached answer was written for a similar but different question.
+Rewrite the cached answer so it correctly answers the new question. Keep what
+still applies, change only what differs, and reply with the answer only.
+
+Cached question: %s
+Cached answer: %s
+
+New question: %s`
+
+// adapt asks the generator to rewrite a near-miss entry's response for
+// query. The result is stored as a new entry flagged adapted and noting its
+// source and score in metadata, and returned with Adapted set. It returns
+// nil if adaptation is unavailable, fails, or takes longer than
+// SLC_ADAPT_TIMEOUT (default 5s), which bounds storing the answer, too.
+func (s *Server) adapt(ctx context.Context, query string, from *models.Entry, score float64) *models.Entry {
+	gen := s.getGenerator()
+	if gen == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, durationFromEnv("SLC_ADAPT_TIMEOUT", 5*time.Second))
+	defer cancel()
+	started := time.Now()
+	g, err := gen.Generate(ctx, fmt.Sprintf(adaptTemplate, from.Prompt, from.Response, query))
+	if err == nil && g.Text == "" {
+		err = fmt.Errorf("empty generation")
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		adaptations.Inc("timeout")
+		log.Printf("server: adapt entry %d: timed out", from.ID)
+		return nil
+	}
+	if err != nil {
+		adaptations.Inc("error")
+		log.Printf("server: adapt entry %d: %v", from.ID, err)
+		return nil
+	}
+	adaptations.Inc("ok")
+	meta := make(map[string]interface{}, len(from.Metadata)+2)
+	for k, v := range from.Metadata {
+		meta[k] = v
+	}
+	delete(meta, models.MetaStale)
+	meta[models.MetaAdapted] = true
+	meta[models.MetaAdaptedFrom] = from.ID
+	meta[models.MetaAdaptedScore] = score
+	e := &models.Entry{Prompt: query, Response: g.Text, Metadata: meta, Provenance: &models.Provenance{
+		Model:            g.Model,
+		LatencyMS:        float64(time.Since(started).Microseconds()) / 1000,
+		PromptTokens:     g.PromptTokens,
+		CompletionTokens: g.CompletionTokens,
+	}}
+	if vec, err := s.embedEntry(ctx, e, nil, stageInsert); err == nil {
+		if _, err := s.createEntry(ctx, e, vec); err != nil {
+			log.Printf("server: store adapted answer: %v", err)
+		}
+	}
+	served := *e
+	served.Adapted = true
+	return &served
+}
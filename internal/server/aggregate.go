@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// aggregateResponse holds entry counts per bucket: metadata values for
+// by=metadata.<key> (entries without the key under ""), or UTC creation days
+// for by=day.
+type aggregateResponse struct {
+	By      string         `json:"by"`
+	Total   int            `json:"total"`
+	Buckets map[string]int `json:"buckets"`
+}
+
+// GET /entries/count?metadata.<key>=...
+func (s *Server) handleEntriesCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := s.aggregator(r.Context()).CountEntries(r.Context(), metadataFiltersFromQuery(r.URL.Query()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"count": n})
+}
+
+// GET /entries/aggregate?by=metadata.<key>|day[&metadata.<key>=...]
+func (s *Server) handleEntriesAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	filters := metadataFiltersFromQuery(r.URL.Query())
+	agg := s.aggregator(r.Context())
+	var buckets map[string]int
+	var err error
+	switch {
+	case by == "day":
+		buckets, err = agg.CountByDay(r.Context(), filters)
+	case strings.HasPrefix(by, "metadata.") && len(by) > len("metadata."):
+		buckets, err = agg.CountByMetadata(r.Context(), strings.TrimPrefix(by, "metadata."), filters)
+	default:
+		http.Error(w, "by must be day or metadata.<key>", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := aggregateResponse{By: by, Buckets: buckets}
+	for _, n := range buckets {
+		resp.Total += n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
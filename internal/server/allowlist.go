@@ -0,0 +1,132 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+)
+
+var allowlistDenials = metrics.NewCounter("slmcache_allowlist_denials_total",
+	"Requests refused because the client address is outside the route group's allowlist.", "group")
+
+// Route groups with separate allowlists. The admin group covers /metrics
+// and every request that needs an admin key (see requiredRole); everything
+// else, including the Redis protocol listener, is data.
+const (
+	groupData  = "data"
+	groupAdmin = "admin"
+)
+
+func routeGroup(r *http.Request) string {
+	if r.URL.Path == "/metrics" || requiredRole(r) == roleAdmin {
+		return groupAdmin
+	}
+	return groupData
+}
+
+// parsePrefixes reads a comma-separated list of CIDRs and bare addresses
+// from key. It returns nil when key is unset, meaning no restriction.
+func parsePrefixes(key string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, item := range strings.Split(config.Get(key), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(item); err == nil {
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			log.Printf("server: ignoring %s entry %q: %v", key, item, err)
+			continue
+		}
+		out = append(out, p.Masked())
+	}
+	return out
+}
+
+func inPrefixes(addr netip.Addr, prefixes []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedAddr reports whether addr may use route group (SLC_ALLOW_DATA or
+// SLC_ALLOW_ADMIN). An unset list allows everyone; an unparseable address
+// is refused when a list is set.
+func allowedAddr(group string, addr netip.Addr, ok bool) bool {
+	key := "SLC_ALLOW_DATA"
+	if group == groupAdmin {
+		key = "SLC_ALLOW_ADMIN"
+	}
+	prefixes := parsePrefixes(key)
+	if prefixes == nil {
+		return true
+	}
+	return ok && inPrefixes(addr, prefixes)
+}
+
+// clientAddr returns the address r came from. X-Forwarded-For is only
+// believed when the connection comes from SLC_TRUSTED_PROXIES, and then the
+// rightmost address that isn't itself a trusted proxy is the client.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr := peer.Addr().Unmap()
+	proxies := parsePrefixes("SLC_TRUSTED_PROXIES")
+	if !inPrefixes(addr, proxies) {
+		return addr, true
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		if addr = hop.Unmap(); !inPrefixes(addr, proxies) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// allowlist refuses requests from addresses outside the allowlist of their
+// route group with 403, before any authentication.
+func allowlist(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := routeGroup(r)
+		addr, ok := clientAddr(r)
+		if !allowedAddr(group, addr, ok) {
+			allowlistDenials.Inc(group)
+			log.Printf("audit: %s %s from %s refused by the %s allowlist", r.Method, r.URL.Path, r.RemoteAddr, group)
+			http.Error(w, "forbidden: address not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowRESP applies the data allowlist to Redis protocol connections.
+func allowRESP(remote net.Addr) bool {
+	addr, ok := netip.Addr{}, false
+	if ap, err := netip.ParseAddrPort(remote.String()); err == nil {
+		addr, ok = ap.Addr(), true
+	}
+	if !allowedAddr(groupData, addr, ok) {
+		allowlistDenials.Inc(groupData)
+		return false
+	}
+	return true
+}
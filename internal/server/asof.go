@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+	"github.com/jeefy/slmcache/internal/wal"
+)
+
+// errNoHistory is returned by as-of reads without a journal to rebuild the
+// past from.
+var errNoHistory = errors.New("as-of reads need WAL archiving (SLC_WAL_DIR)")
+
+// parseAsOf reads the as_of query parameter, an RFC 3339 time. ok is false
+// when it is absent.
+func parseAsOf(r *http.Request) (at time.Time, ok bool, err error) {
+	v := r.URL.Query().Get("as_of")
+	if v == "" {
+		return time.Time{}, false, nil
+	}
+	at, err = time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, true, errors.New("bad request: as_of must be an RFC 3339 time")
+	}
+	return at, true, nil
+}
+
+// asOfCached is how many rebuilt stores as-of reads keep.
+const asOfCached = 4
+
+// asOfStates caches the stores rebuilt for as-of reads, oldest first, so
+// reads of the same moment don't replay the journal again and reads of a
+// later one replay only the records since the nearest. mu also makes
+// rebuilds run one at a time.
+type asOfStates struct {
+	mu     sync.Mutex
+	states []asOfState
+}
+
+type asOfState struct {
+	at  time.Time
+	seq uint64 // the last journal record applied
+	st  store.Store
+}
+
+// asOfResolution is SLC_AS_OF_RESOLUTION (default 1m): as-of reads see the
+// store as it was at the start of their time's interval, which lets them
+// share rebuilt stores.
+func asOfResolution() time.Duration {
+	return durationFromEnv("SLC_AS_OF_RESOLUTION", time.Minute)
+}
+
+// storeAsOf rebuilds the store as it was at at, rounded down to
+// asOfResolution, into a scratch in-memory store, which nothing else sees
+// and which must not be written. It replays the journal from the nearest
+// earlier state cached, or else from the first write, so the journal must
+// reach back that far or ErrGap is returned.
+func (s *Server) storeAsOf(ctx context.Context, at time.Time) (store.Store, error) {
+	journal := s.observed.journal
+	if journal == nil {
+		return nil, errNoHistory
+	}
+	// records may still be appended at any time from now on
+	if now := time.Now(); at.After(now) {
+		at = now
+	}
+	at = at.Truncate(asOfResolution())
+	c := &s.asOf
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var from *asOfState
+	for i := range c.states {
+		state := &c.states[i]
+		if state.at.Equal(at) {
+			return state.st, nil
+		}
+		if state.at.Before(at) && (from == nil || state.at.After(from.at)) {
+			from = state
+		}
+	}
+	base, seq := &store.Snapshot{}, uint64(0)
+	if from != nil {
+		var err error
+		if base, err = from.st.(store.Snapshotter).Snapshot(ctx); err != nil {
+			return nil, err
+		}
+		seq = from.seq
+	}
+	snap, _, seq, err := rollForward(*base, journal, seq, at)
+	if err != nil {
+		return nil, err
+	}
+	scratch, err := store.New()
+	if err != nil {
+		return nil, err
+	}
+	if err := scratch.(store.Snapshotter).Restore(ctx, &snap); err != nil {
+		return nil, err
+	}
+	c.states = append(c.states, asOfState{at: at, seq: seq, st: scratch})
+	if len(c.states) > asOfCached {
+		c.states = c.states[1:]
+	}
+	return scratch, nil
+}
+
+// expiredAsOf reports whether e's TTL had run out by at.
+func (s *Server) expiredAsOf(e *models.Entry, at time.Time) bool {
+	ttl := s.ttlOf(e, s.toolTTL())
+	return ttl > 0 && entryExpiredAt(e, at.Add(-ttl))
+}
+
+// respondAsOfError writes the status for a failed as-of read.
+func (s *Server) respondAsOfError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoHistory), errors.Is(err, wal.ErrGap):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		s.respondStoreError(w, err)
+	}
+}
+
+// GET /entries/{id}?as_of=2024-05-01T00:00:00Z
+//
+// Returns the entry as it was at as_of, or 404 when it didn't exist then.
+func (s *Server) handleEntryAsOf(w http.ResponseWriter, r *http.Request, id int64, at time.Time) {
+	past, err := s.storeAsOf(r.Context(), at)
+	if err != nil {
+		s.respondAsOfError(w, err)
+		return
+	}
+	e, err := past.GetEntry(r.Context(), id)
+	if err != nil || s.expiredAsOf(e, at) || !principalFrom(r.Context()).allows(e.Namespace()) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	redact(r, e)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+// GET /search?q=...&as_of=2024-05-01T00:00:00Z
+//
+// Searches the entries as they were at as_of by vector alone, with the
+// thresholds and filters of a live search. Nothing is recorded: no serves
+// are consumed and no hits, query log or cached results are written.
+func (s *Server) handleSearchAsOf(w http.ResponseWriter, r *http.Request, at time.Time) {
+	ctx := r.Context()
+	q := searchQuery{
+		Text:          r.URL.Query().Get("q"),
+		Filters:       metadataFiltersFromQuery(r.URL.Query()),
+		Limit:         10,
+		IncludeStale:  r.URL.Query().Get("include_stale") == "true",
+		IncludeDrafts: r.URL.Query().Get("include_drafts") == "true",
+		Scope:         scopeFromQuery(r.URL.Query()),
+		Oversample:    parseOversample(r.URL.Query().Get("oversample")),
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+		q.Limit = v
+	}
+	past, err := s.storeAsOf(ctx, at)
+	if err != nil {
+		s.respondAsOfError(w, err)
+		return
+	}
+	vec, err := s.embed(ctx, q.Text, stageQuery)
+	if err != nil {
+		embedError(w, err)
+		return
+	}
+	ids, scores, err := past.(store.EmbedderSearcher).SearchByVectorFrom(ctx, vec, s.searchK(q), embedderOf(s.getSLM()), q.Filters)
+	if err != nil {
+		s.respondStoreError(w, err)
+		return
+	}
+	thresholds := s.thresholds()
+	p := principalFrom(ctx)
+	entries := []*models.Entry{}
+	for i, id := range ids {
+		if q.Limit > 0 && len(entries) >= q.Limit {
+			break
+		}
+		e, err := past.GetEntry(ctx, id)
+		if err != nil || s.expiredAsOf(e, at) || !q.matches(e) || scores[i] < thresholds.of(e) {
+			continue
+		}
+		if (!q.IncludeStale && e.Flag(models.MetaStale)) || !p.allows(e.Namespace()) {
+			continue
+		}
+		e.Score = scores[i]
+		entries = append(entries, e)
+	}
+	redact(r, entries...)
+	out, err := selectFields(entries, r.URL.Query().Get("fields"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
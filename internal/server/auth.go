@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var authDecisions = metrics.NewCounter("slmcache_auth_decisions_total",
+	"Authenticated requests by API key fingerprint (or jwt:<role> for tokens) and decision (allow, deny).", "key", "result")
+
+// apiKeys parses SLC_API_KEYS: comma-separated key=role pairs, where the
+// role may be limited to namespaces as role@ns1|ns2 and a bare key is an
+// admin key for every namespace. SLC_API_KEY_PRIORITIES (key=priority pairs)
+// sets keys' default priority. It is read per request, through the secret
+// cache, so keys can be rotated through a config reload or the secret store.
+// It fails when the keys are configured but can't be resolved, so callers
+// deny rather than take an unreachable secret store for auth being off.
+func apiKeys() (map[string]*principal, error) {
+	raw, err := config.LookupSecret("SLC_API_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]*principal{}
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, grant, _ := strings.Cut(item, "=")
+		role, nsList, scoped := strings.Cut(grant, "@")
+		if role == "" {
+			role = roleAdmin
+		}
+		if roleRank[role] == 0 {
+			log.Printf("server: ignoring API key with unknown role %q", role)
+			continue
+		}
+		sum := sha256.Sum256([]byte(key))
+		p := &principal{id: hex.EncodeToString(sum[:4]), role: role}
+		if scoped {
+			p.namespaces = map[string]bool{}
+			for _, ns := range strings.Split(nsList, "|") {
+				if ns = strings.TrimSpace(ns); ns != "" {
+					p.namespaces[ns] = true
+				}
+			}
+		}
+		keys[key] = p
+	}
+	for _, item := range strings.Split(config.Get("SLC_API_KEY_PRIORITIES"), ",") {
+		key, name, _ := strings.Cut(strings.TrimSpace(item), "=")
+		if p, ok := keys[key]; ok {
+			if prio, ok := parsePriority(name); ok {
+				p.priority = &prio
+			}
+		}
+	}
+	return keys, nil
+}
+
+// requestKey returns the API key of r from "Authorization: Bearer" or
+// X-API-Key.
+func requestKey(r *http.Request) string {
+	if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(v)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// readAllowed reports whether a read key may make request r: GETs outside
+// /admin/, and the POST lookups that don't modify the cache.
+func readAllowed(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		return false
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	return r.Method == http.MethodPost && (r.URL.Path == "/get" || r.URL.Path == "/search" || r.URL.Path == "/search/batch" || r.URL.Path == "/tools/get" || r.URL.Path == "/encrypted/search")
+}
+
+// resolveKey returns the API key or JWT given authenticates as, nil when
+// it is neither; err says why a token was rejected.
+func resolveKey(ctx context.Context, keys map[string]*principal, verifier *jwtVerifier, given string) (*principal, error) {
+	var p *principal
+	for key, candidate := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(given)) == 1 {
+			p = candidate
+		}
+	}
+	if p == nil && verifier != nil && looksLikeJWT(given) {
+		return verifier.verify(ctx, given)
+	}
+	return p, nil
+}
+
+// authenticate requires a known API key or a valid JWT on every request
+// but /metrics and /readyz when SLC_API_KEYS or SLC_JWT_ISSUER is set,
+// checks the caller's role against the route and records it in the request
+// context, where the store enforces its namespaces. Denials and every
+// request that may change the cache are written to the audit log.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		keys, err := apiKeys()
+		if err != nil {
+			log.Printf("audit: %s %s refused: %v", r.Method, r.URL.Path, err)
+			http.Error(w, "service unavailable: API keys can't be resolved", http.StatusServiceUnavailable)
+			return
+		}
+		verifier := s.getJWT()
+		if len(keys) == 0 && verifier == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := resolveKey(r.Context(), keys, verifier, requestKey(r))
+		if err != nil {
+			log.Printf("audit: %s %s rejected token: %v", r.Method, r.URL.Path, err)
+		}
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		need := requiredRole(r)
+		deny := ""
+		switch {
+		case !p.can(need):
+			deny = "forbidden: " + p.role + " API key"
+		case (strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/cluster/")) && p.namespaces != nil:
+			deny = "forbidden: API key limited to namespaces"
+		}
+		if deny != "" {
+			authDecisions.Inc(p.label(), "deny")
+			log.Printf("audit: key=%s role=%s %s %s denied", p.id, p.role, r.Method, r.URL.Path)
+			http.Error(w, deny, http.StatusForbidden)
+			return
+		}
+		authDecisions.Inc(p.label(), "allow")
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		if need == roleRead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		log.Printf("audit: key=%s role=%s %s %s %d", p.id, p.role, r.Method, r.URL.Path, sw.status)
+	})
+}
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// redacted reports whether responses must be withheld from r: the request
+// was made with a read key and SLC_REDACT_READ=true. Such clients learn
+// whether an answer is cached, not what it is.
+func redacted(r *http.Request) bool {
+	p := principalFrom(r.Context())
+	return p != nil && p.role == roleRead && config.Get("SLC_REDACT_READ") == "true"
+}
+
+// redact blanks the responses of entries when r must not see them.
+func redact(r *http.Request, entries ...*models.Entry) {
+	if !redacted(r) {
+		return
+	}
+	for _, e := range entries {
+		e.Response = ""
+	}
+}
+
+// setPeerKey authenticates a request to a peer instance (upstream, federated
+// region or sync peer) with SLC_PEER_API_KEY.
+func setPeerKey(req *http.Request) {
+	if key := config.Secret("SLC_PEER_API_KEY"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+}
+
+// entryFields are the JSON field names of models.Entry, the names
+// selectFields accepts.
+var entryFields = func() map[string]bool {
+	out := map[string]bool{}
+	t := reflect.TypeOf(models.Entry{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			out[name] = true
+		}
+	}
+	return out
+}()
+
+// selectFields encodes entries keeping only the listed JSON fields (e.g.
+// "id,prompt,score"); an empty list keeps them all.
+func selectFields(entries []*models.Entry, fields string) (interface{}, error) {
+	if fields == "" {
+		return entries, nil
+	}
+	var keep []string
+	for _, f := range strings.Split(fields, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if !entryFields[f] {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+		keep = append(keep, f)
+	}
+	out := make([]map[string]json.RawMessage, 0, len(entries))
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(b, &all); err != nil {
+			return nil, err
+		}
+		m := make(map[string]json.RawMessage, len(keep))
+		for _, f := range keep {
+			if v, ok := all[f]; ok {
+				m[f] = v
+			}
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// API key roles (SLC_API_KEYS), each allowed what the previous one is.
+// Read keys look entries up, write keys add, change and delete them, and
+// admin keys also invalidate in bulk, pin and publish entries, read the
+// store as it was (as_of) and, when not limited to namespaces, use /admin/
+// and /cluster/.
+const (
+	roleRead  = "read"
+	roleWrite = "write"
+	roleAdmin = "admin"
+)
+
+var roleRank = map[string]int{roleRead: 1, roleWrite: 2, roleAdmin: 3}
+
+// errForbidden is returned by writes into a namespace the caller's key
+// doesn't cover.
+var errForbidden = errors.New("forbidden: namespace not allowed for this API key")
+
+// principal is the API key a request was authenticated with.
+type principal struct {
+	id         string // key fingerprint, for audit logs and metrics
+	role       string
+	namespaces map[string]bool // nil: every namespace
+	priority   *priority       // default and ceiling for X-Priority; nil: none
+}
+
+type principalKey struct{}
+
+// principalFrom returns the key ctx was authenticated with, or nil when API
+// keys are off or ctx belongs to background work, which may touch any entry.
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// label is p's key label in metrics: the fingerprint of an API key, of
+// which SLC_API_KEYS lists few, and only the role of a JWT, whose subjects
+// are unbounded.
+func (p *principal) label() string {
+	if strings.HasPrefix(p.id, "jwt:") {
+		return "jwt:" + p.role
+	}
+	return p.id
+}
+
+func (p *principal) can(role string) bool {
+	return p == nil || roleRank[p.role] >= roleRank[role]
+}
+
+func (p *principal) allows(ns string) bool {
+	return p == nil || p.namespaces == nil || p.namespaces[ns]
+}
+
+// requiredRole returns the least role that may make request r.
+func requiredRole(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/admin/"), strings.HasPrefix(path, "/cluster/"), path == "/invalidate", path == "/revalidate",
+		// as-of reads replay the journal, too costly for every reader
+		r.URL.Query().Has("as_of"):
+		return roleAdmin
+	case readAllowed(r):
+		return roleRead
+	case r.Method == http.MethodPatch && strings.HasPrefix(path, "/entries/"),
+		r.Method == http.MethodPost && strings.HasPrefix(path, "/entries/") && strings.HasSuffix(path, "/state"),
+		r.Method == http.MethodPost && strings.HasPrefix(path, "/ns/") && strings.HasSuffix(path, "/copy"),
+		strings.HasPrefix(path, "/namespaces"):
+		return roleAdmin
+	}
+	return roleWrite
+}
+
+// authzStore limits store access to the namespaces of the request's key:
+// entries outside them read as not found and writes into them fail with
+// errForbidden. Every handler reaches the store through it, so no path can
+// leak or modify another tenant's entries.
+type authzStore struct {
+	store.Store
+	// admit returns why another entry may not go into a namespace: it is
+	// undeclared while SLC_REQUIRE_NAMESPACES is set, or at its quota.
+	admit func(ctx context.Context, ns string) error
+	// encrypted reports whether a namespace is declared encrypted; see
+	// sealed.
+	encrypted func(ns string) bool
+}
+
+// writable returns why ctx may not write entries into namespace ns, if it
+// may not. grows is set for writes adding an entry to ns, creating it or
+// moving it there.
+func (a authzStore) writable(ctx context.Context, ns string, grows bool) error {
+	if !principalFrom(ctx).allows(ns) {
+		return errForbidden
+	}
+	if grows && a.admit != nil {
+		return a.admit(ctx, ns)
+	}
+	return nil
+}
+
+func (a authzStore) GetEntry(ctx context.Context, id int64) (*models.Entry, error) {
+	e, err := a.Store.GetEntry(ctx, id)
+	if err == nil && !principalFrom(ctx).allows(e.Namespace()) {
+		return nil, errors.New("not found")
+	}
+	return e, err
+}
+
+func (a authzStore) CreateEntryWithVector(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
+	if err := a.writable(ctx, e.Namespace(), true); err != nil {
+		return 0, err
+	}
+	if err := a.sealed(e.Namespace(), e.Flag(models.MetaEncrypted)); err != nil {
+		return 0, err
+	}
+	if p := principalFrom(ctx); p != nil {
+		e.CreatedBy = p.id
+	}
+	return a.Store.CreateEntryWithVector(ctx, e, vec)
+}
+
+func (a authzStore) UpdateEntryWithVector(ctx context.Context, id int64, e *models.Entry, vec []float64) error {
+	old, err := a.GetEntry(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := a.writable(ctx, e.Namespace(), e.Namespace() != old.Namespace()); err != nil {
+		return err
+	}
+	if err := a.sealed(e.Namespace(), e.Flag(models.MetaEncrypted)); err != nil {
+		return err
+	}
+	return a.Store.UpdateEntryWithVector(ctx, id, e, vec)
+}
+
+func (a authzStore) DeleteEntry(ctx context.Context, id int64) error {
+	if _, err := a.GetEntry(ctx, id); err != nil {
+		return err
+	}
+	return a.Store.DeleteEntry(ctx, id)
+}
+
+func (a authzStore) UpdateEntryMetadata(ctx context.Context, id int64, metadata map[string]interface{}, replace bool) error {
+	old, err := a.GetEntry(ctx, id)
+	if err != nil {
+		return err
+	}
+	// replacing the metadata or setting the key moves the entry
+	ns, encrypted := old.Namespace(), old.Flag(models.MetaEncrypted)
+	if _, ok := metadata[models.MetaNamespace]; ok || replace {
+		ns = (&models.Entry{Metadata: metadata}).Namespace()
+		if err := a.writable(ctx, ns, ns != old.Namespace()); err != nil {
+			return err
+		}
+	}
+	if _, ok := metadata[models.MetaEncrypted]; ok || replace {
+		encrypted = (&models.Entry{Metadata: metadata}).Flag(models.MetaEncrypted)
+	}
+	if err := a.sealed(ns, encrypted); err != nil {
+		return err
+	}
+	return a.Store.UpdateEntryMetadata(ctx, id, metadata, replace)
+}
+
+func (a authzStore) DeleteEntryMetadata(ctx context.Context, id int64, keys ...string) error {
+	old, err := a.GetEntry(ctx, id)
+	if err != nil {
+		return err
+	}
+	moves, unseals := len(keys) == 0, len(keys) == 0
+	for _, k := range keys {
+		moves = moves || k == models.MetaNamespace
+		unseals = unseals || k == models.MetaEncrypted
+	}
+	if moves && !principalFrom(ctx).allows(models.DefaultNamespace) {
+		return errForbidden
+	}
+	ns := old.Namespace()
+	if moves {
+		ns = models.DefaultNamespace
+	}
+	if err := a.sealed(ns, old.Flag(models.MetaEncrypted) && !unseals); err != nil {
+		return err
+	}
+	return a.Store.DeleteEntryMetadata(ctx, id, keys...)
+}
+
+func (a authzStore) FindEntriesByMetadata(ctx context.Context, filters map[string]string) ([]*models.Entry, error) {
+	entries, err := a.Store.FindEntriesByMetadata(ctx, filters)
+	if err != nil || principalFrom(ctx) == nil {
+		return entries, err
+	}
+	return visible(ctx, entries), nil
+}
+
+// visible returns the entries of namespaces the request's key covers, for
+// results that don't come from the local store (peer regions, upstream).
+func visible(ctx context.Context, entries []*models.Entry) []*models.Entry {
+	p := principalFrom(ctx)
+	if p == nil || p.namespaces == nil {
+		return entries
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		if p.allows(e.Namespace()) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// aggregator counts the entries visible to the request: a namespaced key
+// can't use the backend's own aggregation, which sees every namespace.
+func (s *Server) aggregator(ctx context.Context) store.Aggregator {
+	if p := principalFrom(ctx); p != nil && p.namespaces != nil {
+		return store.Aggregate(s.store)
+	}
+	return store.Aggregate(s.backend)
+}
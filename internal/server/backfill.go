@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/slm"
+)
+
+var (
+	backfills = metrics.NewCounter("slmcache_vector_backfills_total",
+		"Entries re-embedded because the mock fallback or another model made their vectors, by result (ok, error).", "result")
+	pendingVectors = metrics.NewGauge("slmcache_backfill_pending",
+		"Entries whose vectors the mock fallback or another model made, as of the last backfill run.")
+)
+
+// errFallbackActive is returned by a backfill while the mock still stands
+// in for the configured backend.
+var errFallbackActive = errors.New("the configured SLM backend is unavailable; the mock fallback is embedding")
+
+// embedderOf identifies the model m embeds with, nil when m doesn't say. A
+// replay stands in for the backend its fixture was recorded from.
+func embedderOf(m slm.SLM) *models.Embedder {
+	e := &models.Embedder{Fallback: slm.Fallback(m) != ""}
+	if n, ok := m.(interface{ BackendName() string }); ok {
+		e.Backend = n.BackendName()
+	}
+	if r, ok := m.(interface{ RecordedBackend() string }); ok && r.RecordedBackend() != "" {
+		e.Backend = r.RecordedBackend()
+	}
+	if n, ok := m.(interface{ ModelName() string }); ok {
+		e.Model = n.ModelName()
+	}
+	if v, ok := m.(interface{ ModelVersion() string }); ok {
+		e.Version = v.ModelVersion()
+	}
+	if e.Backend == "" {
+		return nil
+	}
+	return e
+}
+
+// backfillReport is the outcome of a backfill run.
+type backfillReport struct {
+	Backend    string `json:"backend"`
+	Pending    int    `json:"pending"`
+	ReEmbedded int    `json:"re_embedded"`
+	Failed     int    `json:"failed"`
+	// Skipped counts conversation turns and image entries, whose vectors
+	// can't be rebuilt from the prompt alone.
+	Skipped int `json:"skipped"`
+}
+
+// backfillVectors re-embeds with the model now configured the entries
+// another model made the vectors of, which search leaves out: those the mock
+// made while standing in for Ollama, say, or those from before a model
+// upgrade. It does nothing while the fallback is active and returns
+// errFallbackActive with the entries pending. Entries are re-embedded one
+// at a time, at low priority.
+func (s *Server) backfillVectors(ctx context.Context) (*backfillReport, error) {
+	current := embedderOf(s.getSLM())
+	entries := s.backfillPending(ctx, current)
+	rep := &backfillReport{Pending: len(entries)}
+	if current != nil {
+		rep.Backend = current.Backend
+	}
+	defer func() { pendingVectors.Set(float64(rep.Pending)) }()
+	if current != nil && current.Fallback {
+		return rep, errFallbackActive
+	}
+	ctx = withPriority(ctx, priorityLow)
+	for _, e := range entries {
+		if e.Opaque() {
+			rep.Skipped++
+			continue
+		}
+		err := s.reembed(ctx, e)
+		if errors.Is(err, errFallbackActive) {
+			return rep, err
+		}
+		if err != nil {
+			backfills.Inc("error")
+			log.Printf("server: backfilling the vector of entry %d: %v", e.ID, err)
+			rep.Failed++
+			continue
+		}
+		backfills.Inc("ok")
+		rep.ReEmbedded++
+		rep.Pending--
+	}
+	return rep, nil
+}
+
+// backfillPending lists the entries embedded by the fallback or by a model
+// that isn't comparable with current.
+func (s *Server) backfillPending(ctx context.Context, current *models.Embedder) []*models.Entry {
+	var out []*models.Entry
+	for _, id := range s.store.AllIDs() {
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil || e.Embedder == nil {
+			continue
+		}
+		if e.Embedder.Fallback || !current.Comparable(e.Embedder) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// reembed replaces e's vector with one from the current model.
+func (s *Server) reembed(ctx context.Context, e *models.Entry) error {
+	// identified before embedding: a model swapped meanwhile leaves the
+	// entry pending for the next run rather than mislabelled
+	embedder := embedderOf(s.getSLM())
+	if embedder != nil && embedder.Fallback {
+		return errFallbackActive
+	}
+	vec, err := s.embed(ctx, e.Prompt, stageInsert)
+	if err != nil {
+		return err
+	}
+	// an entry rewritten meanwhile was embedded by that write
+	current, err := s.store.GetEntry(ctx, e.ID)
+	if err != nil {
+		return err
+	}
+	if !entryWritten(current).Equal(entryWritten(e)) {
+		return nil
+	}
+	current.Embedder = embedder
+	return s.store.UpdateEntryWithVector(ctx, e.ID, current, vec)
+}
+
+// GET  /admin/backfill  -> count the entries to re-embed
+// POST /admin/backfill  -> re-embed them now
+func (s *Server) handleBackfill(w http.ResponseWriter, r *http.Request) {
+	var rep *backfillReport
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		current := embedderOf(s.getSLM())
+		rep = &backfillReport{Pending: len(s.backfillPending(r.Context(), current))}
+		if current != nil {
+			rep.Backend = current.Backend
+		}
+	case http.MethodPost:
+		rep, err = s.backfillVectors(r.Context())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case errors.Is(err, errFallbackActive):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(rep)
+		return
+	case err != nil:
+		s.respondStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
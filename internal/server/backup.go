@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+	"github.com/jeefy/slmcache/internal/wal"
+)
+
+// backupFormat is bumped when the backup document changes incompatibly.
+const backupFormat = 1
+
+// backup is the document served by GET /admin/backup: a store snapshot plus
+// the journal position it corresponds to.
+type backup struct {
+	Format int `json:"format"`
+	// WALSeq is the last journal record included in the snapshot (0 when
+	// WAL archiving is disabled).
+	WALSeq uint64 `json:"wal_seq,omitempty"`
+	store.Snapshot
+}
+
+// openJournal opens the write-ahead log in SLC_WAL_DIR, rotating segments at
+// SLC_WAL_SEGMENT_MB (default 64). It returns nil when WAL archiving is
+// disabled or the directory is unusable.
+func openJournal() *wal.Log {
+	dir := config.Get("SLC_WAL_DIR")
+	if dir == "" {
+		return nil
+	}
+	l, err := wal.Open(dir, int64(intFromEnv("SLC_WAL_SEGMENT_MB", 64))<<20)
+	if err != nil {
+		log.Printf("server: wal disabled: %v", err)
+		return nil
+	}
+	return l
+}
+
+// GET /admin/backup
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snapper, ok := s.backend.(store.Snapshotter)
+	if !ok {
+		http.Error(w, "store does not support backups", http.StatusNotImplemented)
+		return
+	}
+	// quiesce so the snapshot and journal position describe the same state;
+	// stores that can freeze their state hold writes back only while they do
+	resume := s.observed.quiesce()
+	build, err := store.Freeze(r.Context(), snapper)
+	var seq uint64
+	if s.observed.journal != nil {
+		seq = s.observed.journal.Seq()
+	}
+	resume()
+	var snap *store.Snapshot
+	if err == nil {
+		snap, err = build()
+	}
+	if err != nil {
+		http.Error(w, "snapshot failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// deliveries in flight belong to this instance, not to the backup
+	snap.Outbox = nil
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(backup{Format: backupFormat, WALSeq: seq, Snapshot: *snap})
+}
+
+// POST /admin/restore?at=<RFC3339>
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.backend.(store.Snapshotter); !ok {
+		http.Error(w, "store does not support restores", http.StatusNotImplemented)
+		return
+	}
+	var at time.Time
+	if v := r.URL.Query().Get("at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "bad request: at must be RFC3339", http.StatusBadRequest)
+			return
+		}
+		at = t
+	}
+	var b backup
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b.Format != backupFormat {
+		http.Error(w, "bad request: unsupported backup format", http.StatusBadRequest)
+		return
+	}
+	for _, se := range b.Entries {
+		if se.Entry == nil {
+			http.Error(w, "bad request: backup entry without entry data", http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := s.restore(r.Context(), &b, at)
+	switch {
+	case errors.Is(err, errNoJournal), errors.Is(err, wal.ErrGap):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errRestoreBeforeBackup):
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "restore failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+var (
+	errNoJournal           = errors.New("point-in-time restore needs WAL archiving (SLC_WAL_DIR)")
+	errRestoreBeforeBackup = errors.New("restore time is before the backup was taken")
+)
+
+// restore replaces the store with b, first rolling it forward through the
+// journal to at when at is set. The restore itself is journaled as a reset
+// followed by the restored entries, so later point-in-time restores from an
+// older backup replay through it correctly.
+func (s *Server) restore(ctx context.Context, b *backup, at time.Time) (*models.RestoreResult, error) {
+	snap := b.Snapshot
+	res := &models.RestoreResult{RestoredTo: b.TakenAt}
+	journal := s.observed.journal
+	if !at.IsZero() {
+		if journal == nil {
+			return nil, errNoJournal
+		}
+		if at.Before(b.TakenAt) {
+			return nil, errRestoreBeforeBackup
+		}
+		rolled, n, _, err := rollForward(snap, journal, b.WALSeq, at)
+		if err != nil {
+			return nil, err
+		}
+		snap, res.Replayed, res.RestoredTo = rolled, n, at
+	}
+
+	resume := s.observed.quiesce()
+	defer resume()
+	before := s.backend.AllIDs()
+	// undelivered messages outlive the restore
+	if ob, ok := s.backend.(store.Outbox); ok {
+		pending, err := ob.PendingOutbox(ctx, 0)
+		if err != nil {
+			return nil, err
+		}
+		snap.Outbox = pending
+	}
+	if err := s.backend.(store.Snapshotter).Restore(ctx, &snap); err != nil {
+		return nil, err
+	}
+	if journal != nil {
+		s.journalRestore(journal, &snap)
+	}
+	// drop derived state (L1, hit counts) for everything that was replaced
+	for _, id := range before {
+		s.emit(change{kind: changeDeleted, id: id})
+	}
+	for _, se := range snap.Entries {
+		s.emit(change{kind: changeDeleted, id: se.Entry.ID})
+	}
+	s.loadSynonyms(ctx)
+	s.lexicon.invalidate()
+	s.results.reset()
+	res.Entries = len(snap.Entries)
+	return res, nil
+}
+
+func (s *Server) journalRestore(journal *wal.Log, snap *store.Snapshot) {
+	if _, err := journal.Append(wal.Record{Op: wal.OpReset}); err != nil {
+		log.Printf("server: wal append failed: %v", err)
+		return
+	}
+	for _, se := range snap.Entries {
+		if _, err := journal.Append(wal.Record{Op: wal.OpPut, ID: se.Entry.ID, Entry: se.Entry, Vector: se.Vector}); err != nil {
+			log.Printf("server: wal append failed: %v", err)
+			return
+		}
+	}
+}
+
+// rollForward applies journal records after seq and up to at to snap and
+// returns the result with the number of records applied and the sequence
+// number of the last one (seq when there were none).
+func rollForward(snap store.Snapshot, journal *wal.Log, seq uint64, at time.Time) (store.Snapshot, int, uint64, error) {
+	byID := make(map[int64]store.SnapshotEntry, len(snap.Entries))
+	for _, se := range snap.Entries {
+		if se.Entry != nil {
+			byID[se.Entry.ID] = se
+		}
+	}
+	applied := 0
+	err := journal.Replay(seq, func(rec wal.Record) error {
+		if rec.Time.After(at) {
+			return io.EOF
+		}
+		switch rec.Op {
+		case wal.OpPut:
+			if rec.Entry != nil {
+				byID[rec.ID] = store.SnapshotEntry{Entry: rec.Entry, Vector: rec.Vector}
+			}
+		case wal.OpDelete:
+			delete(byID, rec.ID)
+		case wal.OpReset:
+			clear(byID)
+		}
+		if rec.ID >= snap.NextID {
+			snap.NextID = rec.ID + 1
+		}
+		applied++
+		seq = rec.Seq
+		return nil
+	})
+	if err != nil {
+		return snap, 0, 0, err
+	}
+	snap.TakenAt = at
+	snap.Entries = make([]store.SnapshotEntry, 0, len(byID))
+	for _, se := range byID {
+		snap.Entries = append(snap.Entries, se)
+	}
+	sort.Slice(snap.Entries, func(i, j int) bool { return snap.Entries[i].Entry.ID < snap.Entries[j].Entry.ID })
+	return snap, applied, seq, nil
+}
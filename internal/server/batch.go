@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/slm"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// POST /entries/batch
+//
+// Creates every entry in a JSON array, embedding the prompts in one batch.
+// The response lists a result per input index so clients can report
+// per-row errors without failing the whole batch.
+func (s *Server) handleEntriesBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var entries []models.Entry
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		http.Error(w, "bad request: expected JSON array of {prompt,response,metadata?}; "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if max := intFromEnv("SLC_MAX_BATCH", 1000); max > 0 && len(entries) > max {
+		http.Error(w, fmt.Sprintf("batch too large: %d entries (max %d)", len(entries), max), http.StatusRequestEntityTooLarge)
+		return
+	}
+	results := make([]models.BatchResult, len(entries))
+	prompts := []string{}
+	idx := []int{}
+	for i := range entries {
+		results[i].Index = i
+		if entries[i].Prompt == "" {
+			results[i].Error = "prompt required"
+			continue
+		}
+		if err := entries[i].Provenance.Validate(); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := checkReserved(&entries[i]); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := admitQuality(&entries[i], "/entries/batch"); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := s.admitUncacheable(&entries[i]); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := s.admitThrash(&entries[i], "/entries/batch"); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		s.classify(r.Context(), &entries[i])
+		if err := initialState(&entries[i]); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		bindScope(&entries[i])
+		prompts = append(prompts, entries[i].Prompt)
+		idx = append(idx, i)
+	}
+	if !s.embedGate.acquire(r.Context(), priorityFrom(r.Context()), -1) {
+		http.Error(w, "embed error", http.StatusInternalServerError)
+		return
+	}
+	m := s.getSLM()
+	embedder := embedderOf(m)
+	vecs, err := slm.EmbedAll(m, prompts)
+	s.embedGate.release()
+	if err != nil {
+		http.Error(w, "embed error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for j, i := range idx {
+		vec := vecs[j]
+		if degenerateReason(vec) != "" {
+			// retry the odd one out individually before giving up on it
+			if vec, err = s.embed(r.Context(), entries[i].Prompt, stageInsert); err != nil {
+				results[i].Error = err.Error()
+				continue
+			}
+		}
+		entries[i].Embedder = embedder
+		id, err := s.createEntry(r.Context(), &entries[i], vec)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].ID = id
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+// searchBatchRequest is the body of POST /search/batch: the limit and
+// filters apply to every query.
+type searchBatchRequest struct {
+	Queries       []string          `json:"queries"`
+	Limit         int               `json:"limit,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	IncludeStale  bool              `json:"include_stale,omitempty"`
+	IncludeDrafts bool              `json:"include_drafts,omitempty"`
+	Scope         string            `json:"scope,omitempty"`
+	Highlight     bool              `json:"highlight,omitempty"`
+	Oversample    float64           `json:"oversample,omitempty"`
+}
+
+// POST /search/batch
+//
+// Runs several searches in one request, embedding the queries in one batch.
+// The response holds one result array per query, in order.
+func (s *Server) handleSearchBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req searchBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request: expected {queries, limit?, metadata?}; "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Queries) == 0 {
+		http.Error(w, "queries required", http.StatusBadRequest)
+		return
+	}
+	if max := intFromEnv("SLC_MAX_SEARCH_BATCH", 32); max > 0 && len(req.Queries) > max {
+		http.Error(w, fmt.Sprintf("batch too large: %d queries (max %d)", len(req.Queries), max), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = 10
+	}
+	fields := r.URL.Query().Get("fields")
+	if _, err := selectFields(nil, fields); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.embedGate.acquire(r.Context(), priorityFrom(r.Context()), -1) {
+		http.Error(w, "embed error", http.StatusInternalServerError)
+		return
+	}
+	vecs, err := slm.EmbedAll(s.getSLM(), req.Queries)
+	s.embedGate.release()
+	if err != nil {
+		http.Error(w, "embed error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out := make([]interface{}, len(req.Queries))
+	for i, text := range req.Queries {
+		q := searchQuery{
+			Text:          text,
+			Filters:       req.Metadata,
+			Limit:         req.Limit,
+			IncludeStale:  req.IncludeStale,
+			IncludeDrafts: req.IncludeDrafts,
+			FromUpstream:  r.Header.Get(upstreamHeader) != "",
+			Source:        "search",
+			Scope:         req.Scope,
+			Vector:        vecs[i],
+			Highlight:     req.Highlight,
+			Oversample:    req.Oversample,
+		}
+		if degenerateReason(q.Vector) != "" {
+			// let search retry the odd one out on its own
+			q.Vector = nil
+		}
+		res, err := s.search(r.Context(), q)
+		if errors.Is(err, store.ErrUnavailable) {
+			storeUnavailable(w)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		redact(r, res.Entries...)
+		if out[i], err = selectFields(res.Entries, fields); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/blob"
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// defaultBlobMaxBytes bounds an attachment: blobs are meant for small
+// generated images and audio clips, not files.
+const defaultBlobMaxBytes = 10 << 20
+
+// newBlobStore builds the attachment store from SLC_BLOB_STORE: fs keeps
+// blobs under SLC_BLOB_DIR (default ./blobs), s3 in SLC_BLOB_S3_BUCKET. It
+// returns nil when SLC_BLOB_STORE is unset or the store can't be set up.
+func newBlobStore() blob.Store {
+	var (
+		st  blob.Store
+		err error
+	)
+	switch kind := config.Get("SLC_BLOB_STORE"); kind {
+	case "":
+		return nil
+	case "fs":
+		dir := config.Get("SLC_BLOB_DIR")
+		if dir == "" {
+			dir = "./blobs"
+		}
+		st, err = blob.NewFS(dir)
+	case "s3":
+		st, err = blob.NewS3(blob.S3Config{
+			Endpoint:     config.Get("SLC_BLOB_S3_ENDPOINT"),
+			Region:       config.Get("SLC_BLOB_S3_REGION"),
+			Bucket:       config.Get("SLC_BLOB_S3_BUCKET"),
+			Prefix:       config.Get("SLC_BLOB_S3_PREFIX"),
+			AccessKey:    config.Get("AWS_ACCESS_KEY_ID"),
+			SecretKey:    config.Get("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: config.Get("AWS_SESSION_TOKEN"),
+		})
+	default:
+		log.Printf("server: unknown SLC_BLOB_STORE %q (want fs or s3); attachments disabled", kind)
+		return nil
+	}
+	if err != nil {
+		log.Printf("server: attachments disabled: %v", err)
+		return nil
+	}
+	return st
+}
+
+// blobKey is where the attachment of entry id is kept. Replacing it
+// overwrites the same key, so an entry never leaves older blobs behind.
+func blobKey(id int64) string {
+	return "entry-" + strconv.FormatInt(id, 10)
+}
+
+// onBlobChange removes the attachment and the full response of a deleted
+// entry.
+func (s *Server) onBlobChange(c change) {
+	if c.kind != changeDeleted {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		for _, key := range []string{blobKey(c.id), fullResponseKey(c.id)} {
+			if err := s.blobs.Delete(ctx, key); err != nil {
+				log.Printf("server: delete blob %s of entry %d: %v", key, c.id, err)
+			}
+		}
+	}()
+}
+
+// keepBlob carries the attachment over to a full update that doesn't
+// mention it.
+func keepBlob(current, e *models.Entry) {
+	ref, ok := current.Metadata[models.MetaBlob]
+	if _, set := e.Metadata[models.MetaBlob]; !ok || set {
+		return
+	}
+	if e.Metadata == nil {
+		e.Metadata = map[string]interface{}{}
+	}
+	e.Metadata[models.MetaBlob] = ref
+}
+
+// GET|PUT|DELETE /entries/{id}/blob
+func (s *Server) handleEntryBlob(w http.ResponseWriter, r *http.Request, id int64) {
+	if s.blobs == nil {
+		http.Error(w, "attachments are disabled; set SLC_BLOB_STORE", http.StatusNotFound)
+		return
+	}
+	ctx := r.Context()
+	e, err := s.store.GetEntry(ctx, id)
+	if err != nil || s.expireIfNeeded(ctx, e) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	ref := e.Blob()
+	switch r.Method {
+	case http.MethodGet:
+		if ref == nil {
+			http.Error(w, "entry has no blob", http.StatusNotFound)
+			return
+		}
+		etag := `"` + ref.SHA256 + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		body, err := s.blobs.Get(ctx, ref.Key)
+		if errors.Is(err, blob.ErrNotFound) {
+			http.Error(w, "blob is missing from the blob store", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "blob store: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer body.Close()
+		w.Header().Set("Content-Type", ref.ContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(ref.Size, 10))
+		w.Header().Set("ETag", etag)
+		_, _ = io.Copy(w, body)
+	case http.MethodPut:
+		limit := intFromEnv("SLC_BLOB_MAX_BYTES", defaultBlobMaxBytes)
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			http.Error(w, "blob exceeds SLC_BLOB_MAX_BYTES", http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		case len(data) == 0:
+			http.Error(w, "empty blob", http.StatusBadRequest)
+			return
+		}
+		contentType := r.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		sum := sha256.Sum256(data)
+		ref := models.BlobRef{Key: blobKey(id), ContentType: contentType, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+		if err := s.blobs.Put(ctx, ref.Key, data); err != nil {
+			http.Error(w, "blob store: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		meta := map[string]interface{}{models.MetaBlob: map[string]interface{}{
+			"key": ref.Key, "content_type": ref.ContentType, "size": ref.Size, "sha256": ref.SHA256,
+		}}
+		if err := s.store.UpdateEntryMetadata(ctx, id, meta, false); err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ref)
+	case http.MethodDelete:
+		if ref == nil {
+			http.Error(w, "entry has no blob", http.StatusNotFound)
+			return
+		}
+		if err := s.store.DeleteEntryMetadata(ctx, id, models.MetaBlob); err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+		if err := s.blobs.Delete(ctx, ref.Key); err != nil {
+			log.Printf("server: delete blob of entry %d: %v", id, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+)
+
+var budgetSkips = metrics.NewCounter("slmcache_budget_skips_total",
+	"Search stages skipped because they wouldn't fit the request's budget_ms, by stage.", "stage")
+
+// Search stages a latency budget can skip, as reported in the decision
+// header.
+const (
+	stageEmbed      = "embed"
+	stageExpand     = "expand"
+	stageRerank     = "rerank"
+	stageLexical    = "lexical"
+	stageFederation = "federation"
+	stageUpstream   = "upstream"
+	stageAdapt      = "adapt"
+)
+
+// parseBudget reads the budget_ms query parameter; 0 when it is absent.
+func parseBudget(v url.Values) (time.Duration, error) {
+	s := v.Get("budget_ms")
+	if s == "" {
+		return 0, nil
+	}
+	ms, err := strconv.Atoi(s)
+	if err != nil || ms <= 0 {
+		return 0, errors.New("bad request: budget_ms must be a positive number of milliseconds")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// expectedEmbed is the median of recent query embeds, 0 before any.
+func expectedEmbed() time.Duration {
+	ms := quantileMs(embedLatency.Snapshot(stageQuery), 0.5)
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// fits reports whether a stage expected to take cost fits in what is left
+// of q's budget, counting from start, and records it in res as skipped when
+// it doesn't. Queries without a budget run every stage. Stages whose cost
+// isn't known are passed 0, so they only run while there is time left.
+func (q searchQuery) fits(res *searchResult, start time.Time, stage string, cost time.Duration) bool {
+	if q.Budget <= 0 || time.Until(start.Add(q.Budget)) > cost {
+		return true
+	}
+	budgetSkips.Inc(stage)
+	res.Skipped = append(res.Skipped, stage)
+	return false
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// bulkUpdater patches the entries visible to the request: a namespaced key
+// can't use the backend's own bulk update, which sees every namespace.
+func (s *Server) bulkUpdater(ctx context.Context) store.BulkUpdater {
+	if p := principalFrom(ctx); p != nil && p.namespaces != nil {
+		return store.BulkUpdate(s.store)
+	}
+	return s.observed
+}
+
+// PATCH /entries/metadata?metadata.<key>=... {"metadata": {...}}
+//
+// Merges the metadata into every entry matching the filters, for relabeling
+// campaigns such as renaming a category, and returns how many changed.
+// Archived entries are left alone.
+func (s *Server) handleEntriesMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filters := metadataFiltersFromQuery(r.URL.Query())
+	if len(filters) == 0 {
+		http.Error(w, "at least one metadata.<key> filter required", http.StatusBadRequest)
+		return
+	}
+	var payload metadataRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Metadata) == 0 {
+		http.Error(w, "metadata payload required", http.StatusBadRequest)
+		return
+	}
+	if payload.Replace {
+		http.Error(w, "bad request: replace applies to a single entry's metadata", http.StatusBadRequest)
+		return
+	}
+	patch := &models.Entry{Metadata: payload.Metadata}
+	if _, ok := payload.Metadata[models.MetaState]; ok {
+		http.Error(w, fmt.Sprintf("bad request: %s changes through POST /entries/{id}/state", models.MetaState), http.StatusBadRequest)
+		return
+	}
+	if err := checkReserved(patch); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// refused up front rather than part-way through the matches
+	if _, ok := payload.Metadata[models.MetaNamespace]; ok {
+		if !principalFrom(r.Context()).allows(patch.Namespace()) {
+			http.Error(w, errForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		if err := s.admitEntry(r.Context(), patch.Namespace()); err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+	}
+	ids, err := s.bulkUpdater(r.Context()).UpdateMetadataWhere(r.Context(), filters, payload.Metadata)
+	if err != nil {
+		log.Printf("server: bulk metadata update stopped after %d entries: %v", len(ids), err)
+		s.respondStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"updated": len(ids)})
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var cacheabilityVerdicts = metrics.NewCounter("slmcache_cacheability_verdicts_total",
+	"Prompts classified for cacheability, by classifier (rules, model) and verdict (stable, volatile, error).", "by", "verdict")
+
+// volatileCues are phrases whose answers depend on when they are asked.
+// Each one a prompt contains takes 0.4 off its score.
+var volatileCues = regexp.MustCompile(`(?i)\b(now|today|tonight|tomorrow|yesterday|currently|current|latest|recent|this (week|month|year)|what time|what day|weather|forecast|price|stock|news|traffic|exchange rate|score)\b`)
+
+const cacheabilityTemplate = `Will the answer to the question below stay correct for weeks, or does it
+depend on when it is asked? Reply with a single number from 0 (changes
+constantly) to 1 (never changes) and nothing else.
+
+Question: %s`
+
+// cacheabilityVerdict is a classified prompt's score and how many times it
+// was found volatile.
+type cacheabilityVerdict struct {
+	score    float64
+	by       string
+	volatile int
+}
+
+// cacheability scores how stable the answers to prompts are, so volatile
+// ones can be kept out of the cache. Verdicts are remembered per prompt;
+// a prompt found volatile learn times joins the deny list.
+type cacheability struct {
+	mode  string // rules or model
+	min   float64
+	learn int
+
+	mu       sync.Mutex
+	verdicts map[string]*cacheabilityVerdict
+	learned  map[string]string // key -> prompt
+}
+
+// maxVerdicts bounds the verdict memory; it is cleared when full. Learned
+// prompts stop being added at the same size.
+const maxVerdicts = 10000
+
+// newCacheability reads SLC_CACHEABILITY: off (the default), rules, or
+// model, which asks the generator about prompts the rules find nothing
+// volatile in. Scores under SLC_CACHEABILITY_MIN (default 0.5) are
+// volatile, and SLC_CACHEABILITY_LEARN (default 3, 0 = never) volatile
+// verdicts put a prompt on the deny list.
+func newCacheability() *cacheability {
+	c := &cacheability{
+		mode:     config.Get("SLC_CACHEABILITY"),
+		min:      0.5,
+		learn:    intFromEnv("SLC_CACHEABILITY_LEARN", 3),
+		verdicts: make(map[string]*cacheabilityVerdict),
+		learned:  make(map[string]string),
+	}
+	switch c.mode {
+	case "rules", "model":
+	case "", "off":
+		return nil
+	default:
+		noteInvalid("SLC_CACHEABILITY", "off, rules or model")
+		return nil
+	}
+	if v := config.Get("SLC_CACHEABILITY_MIN"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			c.min = f
+		} else {
+			noteInvalid("SLC_CACHEABILITY_MIN", "number from 0 to 1")
+		}
+	}
+	return c
+}
+
+// ruleScore scores prompt by the volatile cues it contains; found reports
+// whether it contained any.
+func ruleScore(prompt string) (score float64, found bool) {
+	cues := volatileCues.FindAllString(prompt, -1)
+	return max(0, 1-0.4*float64(len(cues))), len(cues) > 0
+}
+
+// parseScore reads the first number of a generated reply.
+func parseScore(text string) (float64, error) {
+	for _, f := range strings.Fields(text) {
+		if v, err := strconv.ParseFloat(strings.Trim(f, ".,;:\"'"), 64); err == nil {
+			if v < 0 || v > 1 {
+				break
+			}
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("no score in %q", text)
+}
+
+// cacheabilityScore classifies prompt, asking the generator when the mode
+// says so.
+func (s *Server) cacheabilityScore(ctx context.Context, prompt string) (float64, string, error) {
+	score, found := ruleScore(prompt)
+	gen := s.getGenerator()
+	if found || s.classifier.mode != "model" || gen == nil {
+		return score, "rules", nil
+	}
+	g, err := gen.Generate(ctx, fmt.Sprintf(cacheabilityTemplate, prompt))
+	if err != nil {
+		return 0, "model", err
+	}
+	score, err = parseScore(g.Text)
+	return score, "model", err
+}
+
+// cacheabilityKey identifies a prompt for the verdicts and the deny list.
+func (s *Server) cacheabilityKey(ns, prompt string) string {
+	return ns + "\x00" + s.canonical(ns, prompt)
+}
+
+// classify stores the cacheability verdict on e's prompt in
+// metadata.cacheability, classifying it the first time it is seen. A
+// classifier error leaves e unscored. Writes are never refused here; a
+// prompt that keeps being found volatile is refused by the deny list.
+func (s *Server) classify(ctx context.Context, e *models.Entry) {
+	c := s.classifier
+	if c == nil {
+		return
+	}
+	key := s.cacheabilityKey(e.Namespace(), e.Prompt)
+	c.mu.Lock()
+	v, ok := c.verdicts[key]
+	c.mu.Unlock()
+	if !ok {
+		score, by, err := s.cacheabilityScore(ctx, e.Prompt)
+		if err != nil {
+			cacheabilityVerdicts.Inc(by, "error")
+			log.Printf("server: classify cacheability: %v", err)
+			return
+		}
+		v = &cacheabilityVerdict{score: score, by: by}
+	}
+	verdict := "stable"
+	if v.score < c.min {
+		verdict = "volatile"
+	}
+	cacheabilityVerdicts.Inc(v.by, verdict)
+
+	c.mu.Lock()
+	if len(c.verdicts) >= maxVerdicts {
+		c.verdicts = make(map[string]*cacheabilityVerdict)
+	}
+	c.verdicts[key] = v
+	if verdict == "volatile" {
+		v.volatile++
+		if c.learn > 0 && v.volatile >= c.learn && len(c.learned) < maxVerdicts {
+			if _, ok := c.learned[key]; !ok {
+				log.Printf("server: prompt %q is volatile; no longer caching it", e.Prompt)
+			}
+			c.learned[key] = e.Prompt
+		}
+	}
+	c.mu.Unlock()
+
+	if e.Metadata == nil {
+		e.Metadata = map[string]interface{}{}
+	}
+	e.Metadata[models.MetaCacheability] = v.score
+}
+
+// learnedUncacheable reports whether the prompt in namespace ns is on the
+// learned deny list.
+func (s *Server) learnedUncacheable(ns, prompt string) bool {
+	c := s.classifier
+	if c == nil {
+		return false
+	}
+	key := s.cacheabilityKey(ns, prompt)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.learned[key]
+	return ok
+}
+
+// learnedPrompt is a prompt in GET /admin/uncacheable.
+type learnedPrompt struct {
+	Namespace string `json:"namespace"`
+	Prompt    string `json:"prompt"`
+}
+
+// GET, DELETE /admin/uncacheable
+//
+// Lists the SLC_UNCACHEABLE rules and the prompts the classifier added to
+// the deny list; DELETE forgets the learned prompts and their verdicts.
+func (s *Server) handleUncacheable(w http.ResponseWriter, r *http.Request) {
+	c := s.classifier
+	switch r.Method {
+	case http.MethodGet:
+		out := struct {
+			Rules   []uncacheableRule `json:"rules"`
+			Learned []learnedPrompt   `json:"learned"`
+		}{Rules: s.getUncacheable(), Learned: []learnedPrompt{}}
+		if out.Rules == nil {
+			out.Rules = []uncacheableRule{}
+		}
+		if c != nil {
+			c.mu.Lock()
+			for key, prompt := range c.learned {
+				ns, _, _ := strings.Cut(key, "\x00")
+				out.Learned = append(out.Learned, learnedPrompt{Namespace: ns, Prompt: prompt})
+			}
+			c.mu.Unlock()
+		}
+		sort.Slice(out.Learned, func(i, j int) bool {
+			a, b := out.Learned[i], out.Learned[j]
+			if a.Namespace != b.Namespace {
+				return a.Namespace < b.Namespace
+			}
+			return a.Prompt < b.Prompt
+		})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	case http.MethodDelete:
+		if c != nil {
+			c.mu.Lock()
+			c.learned = make(map[string]string)
+			c.verdicts = make(map[string]*cacheabilityVerdict)
+			c.mu.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
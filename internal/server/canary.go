@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"strconv"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var variantServes = metrics.NewCounter("slmcache_variant_serves_total",
+	"Hits on entries with a canary response, by the variant served.", "variant")
+
+// Variant labels of an entry's responses when none is given.
+const (
+	variantControl = "control"
+	variantCanary  = "canary"
+)
+
+// canary is metadata.canary: an alternate response served to Percent of
+// the entry's hits under Label.
+type canary struct {
+	Response string  `json:"response"`
+	Percent  float64 `json:"percent"`
+	Label    string  `json:"label,omitempty"`
+}
+
+// canaryOf returns e's canary, nil when it has none.
+func canaryOf(e *models.Entry) (*canary, error) {
+	v, ok := e.Metadata[models.MetaCanary]
+	if !ok {
+		return nil, nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var c canary
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("canary: %w", err)
+	}
+	if c.Response == "" {
+		return nil, errors.New("canary: response required")
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return nil, errors.New("canary: percent must be between 0 and 100")
+	}
+	if c.Label == "" {
+		c.Label = variantCanary
+	}
+	if c.Label == variantControl {
+		return nil, errors.New("canary: label control names the entry's own response")
+	}
+	return &c, nil
+}
+
+// checkCanary rejects entries declaring a malformed metadata.canary.
+func checkCanary(e *models.Entry) error {
+	_, err := canaryOf(e)
+	return err
+}
+
+// pickVariants serves the canary response of the results that have one to
+// its share of hits, and labels every such result with the variant served.
+// A query in a session always gets the same variant of an entry, so a
+// conversation doesn't flip between answers. Lookups made by a sidecar get
+// the entry as stored, so the sidecar picks variants itself.
+func pickVariants(q searchQuery, res *searchResult) {
+	if q.FromUpstream {
+		return
+	}
+	for _, e := range res.Entries {
+		c, err := canaryOf(e)
+		if err != nil || c == nil {
+			continue
+		}
+		roll := rand.Float64() * 100
+		if q.Session != "" {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(q.Session + "\x00" + strconv.FormatInt(e.ID, 10)))
+			roll = float64(h.Sum64()%10000) / 100
+		}
+		e.Variant = variantControl
+		if roll < c.Percent {
+			e.Response, e.Variant = c.Response, c.Label
+		}
+		variantServes.Inc(e.Variant)
+	}
+}
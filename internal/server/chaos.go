@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var faultsInjected = metrics.NewCounter("slmcache_faults_injected_total",
+	"Faults injected into requests by /admin/chaos, by kind (latency, error, partial).", "kind")
+
+// faultHeader lists the faults injected into a response, so a client under
+// test can tell them from real failures.
+const faultHeader = "X-SLMCache-Fault"
+
+// defaultFaultDuration bounds faults set without a duration, so a forgotten
+// experiment doesn't degrade the cache for good.
+const defaultFaultDuration = 10 * time.Minute
+
+// faults is the body of /admin/chaos: what to inject into requests to the
+// listed routes (path prefixes; all routes when empty) until ExpiresAt.
+// Admin routes, /readyz and /metrics are never affected.
+type faults struct {
+	Routes      []string `json:"routes,omitempty"`
+	LatencyMS   int      `json:"latency_ms,omitempty"`
+	JitterMS    int      `json:"jitter_ms,omitempty"`
+	ErrorRate   float64  `json:"error_rate,omitempty"`
+	ErrorStatus int      `json:"error_status,omitempty"`
+	// PartialRate is the share of /search responses that lose a random
+	// half of their results.
+	PartialRate float64 `json:"partial_rate,omitempty"`
+	// Duration is how long the faults last (default 10m).
+	Duration  string    `json:"duration,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// chaos holds the active faults of this instance.
+type chaos struct {
+	mu     sync.Mutex
+	active *faults
+}
+
+func (c *chaos) get(now time.Time) *faults {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active != nil && now.After(c.active.ExpiresAt) {
+		c.active = nil
+	}
+	return c.active
+}
+
+func (c *chaos) set(f *faults) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = f
+}
+
+// applies reports whether the faults cover path.
+func (f *faults) applies(path string) bool {
+	if strings.HasPrefix(path, "/admin/") || path == "/readyz" || path == "/metrics" {
+		return false
+	}
+	if len(f.Routes) == 0 {
+		return true
+	}
+	for _, p := range f.Routes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+type partialKey struct{}
+
+// injectFaults delays or fails requests as the active faults say, and marks
+// the ones whose search results should be cut short.
+func (s *Server) injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := s.chaos.get(time.Now())
+		// turning SLC_CHAOS off also stops faults already set
+		if f == nil || !f.applies(r.URL.Path) || config.Get("SLC_CHAOS") != "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var kinds []string
+		if delay := time.Duration(f.LatencyMS) * time.Millisecond; delay > 0 || f.JitterMS > 0 {
+			if f.JitterMS > 0 {
+				delay += time.Duration(rand.IntN(f.JitterMS+1)) * time.Millisecond
+			}
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			kinds = append(kinds, "latency")
+		}
+		if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+			kinds = append(kinds, "error")
+			markFaults(w, kinds)
+			http.Error(w, "injected fault", f.ErrorStatus)
+			return
+		}
+		if f.PartialRate > 0 && rand.Float64() < f.PartialRate {
+			kinds = append(kinds, "partial")
+			r = r.WithContext(context.WithValue(r.Context(), partialKey{}, true))
+		}
+		markFaults(w, kinds)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func markFaults(w http.ResponseWriter, kinds []string) {
+	for _, k := range kinds {
+		faultsInjected.Inc(k)
+	}
+	if len(kinds) > 0 {
+		w.Header().Set(faultHeader, strings.Join(kinds, ","))
+	}
+}
+
+// dropPartial removes a random half of entries from a response marked for
+// partial results.
+func dropPartial(ctx context.Context, entries []*models.Entry) []*models.Entry {
+	if ctx.Value(partialKey{}) == nil || len(entries) == 0 {
+		return entries
+	}
+	// keep the rank order of what's left
+	idx := rand.Perm(len(entries))[:len(entries)/2]
+	slices.Sort(idx)
+	out := make([]*models.Entry, len(idx))
+	for i, j := range idx {
+		out[i] = entries[j]
+	}
+	return out
+}
+
+// GET|PUT|DELETE /admin/chaos
+func (s *Server) handleChaos(w http.ResponseWriter, r *http.Request) {
+	if config.Get("SLC_CHAOS") != "true" {
+		http.Error(w, "fault injection is disabled; set SLC_CHAOS=true", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		f := s.chaos.get(time.Now())
+		if f == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(f)
+	case http.MethodPut:
+		var f faults
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		d := defaultFaultDuration
+		if f.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(f.Duration); err != nil || d <= 0 {
+				http.Error(w, "duration must be a positive duration such as 5m", http.StatusBadRequest)
+				return
+			}
+		}
+		if f.LatencyMS < 0 || f.JitterMS < 0 || f.ErrorRate < 0 || f.ErrorRate > 1 || f.PartialRate < 0 || f.PartialRate > 1 {
+			http.Error(w, "latencies must be non-negative and rates between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		if f.ErrorStatus == 0 {
+			f.ErrorStatus = http.StatusServiceUnavailable
+		}
+		if f.ErrorStatus < 400 || f.ErrorStatus > 599 {
+			http.Error(w, "error_status must be a 4xx or 5xx code", http.StatusBadRequest)
+			return
+		}
+		f.ExpiresAt = time.Now().Add(d).UTC()
+		s.chaos.set(&f)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(f)
+	case http.MethodDelete:
+		s.chaos.set(nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// cacheData is the body of the GPTCache-style /get and /put endpoints.
+// llm_string is the LangChain cache key component identifying the model and
+// its parameters; answers are only served to lookups with the same value.
+type cacheData struct {
+	Prompt    string  `json:"prompt"`
+	LLMString string  `json:"llm_string,omitempty"`
+	Answer    *string `json:"answer"`
+	// Quality optionally scores the answer on /put, from 0 to 1; answers
+	// below SLC_MIN_QUALITY aren't cached.
+	Quality *float64 `json:"quality,omitempty"`
+	// Variant is the response variant answered, on hits on entries with a
+	// canary.
+	Variant string `json:"variant,omitempty"`
+}
+
+func decodeCacheData(w http.ResponseWriter, r *http.Request) (*cacheData, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	var req cacheData
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if strings.TrimSpace(req.Prompt) == "" {
+		http.Error(w, "prompt required", http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+// POST /get
+//
+// Returns the best semantic match for prompt as {prompt, llm_string, answer};
+// answer is null on a miss.
+func (s *Server) handleCacheGet(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeCacheData(w, r)
+	if !ok {
+		return
+	}
+	q := searchQuery{Text: req.Prompt, Limit: 1, FromUpstream: r.Header.Get(upstreamHeader) != "", Source: "get"}
+	if req.LLMString != "" {
+		q.Filters = map[string]string{models.MetaLLMString: req.LLMString}
+	}
+	res, err := s.search(r.Context(), q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out := cacheData{Prompt: req.Prompt, LLMString: req.LLMString}
+	redact(r, res.Entries...)
+	if len(res.Entries) > 0 {
+		out.Answer = &res.Entries[0].Response
+		out.Variant = res.Entries[0].Variant
+	}
+	setSearchDecision(w, res)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// POST /put
+//
+// Stores answer for prompt (and llm_string), replacing a previous answer for
+// the same pair.
+func (s *Server) handleCachePut(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeCacheData(w, r)
+	if !ok {
+		return
+	}
+	if req.Answer == nil {
+		http.Error(w, "answer required", http.StatusBadRequest)
+		return
+	}
+	if req.Quality != nil {
+		scored := &models.Entry{Metadata: map[string]interface{}{models.MetaQuality: *req.Quality}}
+		if err := checkQuality(scored); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := admitQuality(scored, "/put"); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	e := &models.Entry{Prompt: req.Prompt, Response: *req.Answer}
+	if err := s.admitUncacheable(e); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := s.admitThrash(e, "/put"); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := s.putCached(r.Context(), req.Prompt, req.LLMString, *req.Answer, req.Quality); err != nil {
+		if err == errEmbed || errors.Is(err, errDegenerate) {
+			embedError(w, err)
+			return
+		}
+		s.respondStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode("successfully update the cache")
+}
+
+// putCached stores answer for prompt and llmString, replacing the entry
+// previously stored for the same pair. quality, when given, is stored as the
+// answer's quality score.
+func (s *Server) putCached(ctx context.Context, prompt, llmString, answer string, quality *float64) error {
+	embedder := embedderOf(s.getSLM())
+	vec, err := s.embed(ctx, prompt, stageInsert)
+	if err != nil {
+		return err
+	}
+	existing, err := s.findCached(ctx, prompt, llmString, vec)
+	if err != nil {
+		return err
+	}
+	e := &models.Entry{Prompt: prompt, Response: answer}
+	if existing != nil {
+		e.Metadata = existing.Metadata
+		if quality != nil {
+			if e.Metadata == nil {
+				e.Metadata = map[string]interface{}{}
+			}
+			e.Metadata[models.MetaQuality] = *quality
+		}
+		e.Embedder = embedder
+		return s.updateEntry(ctx, existing.ID, existing, e, vec)
+	}
+	if llmString != "" || quality != nil {
+		e.Metadata = map[string]interface{}{}
+	}
+	if llmString != "" {
+		e.Metadata[models.MetaLLMString] = llmString
+	}
+	if quality != nil {
+		e.Metadata[models.MetaQuality] = *quality
+	}
+	e.Embedder = embedder
+	_, err = s.createEntry(ctx, e, vec)
+	return err
+}
+
+// cachedNeighbours is how many of a prompt's nearest neighbours findCached
+// looks through, enough for the same prompt stored under several
+// llm_strings.
+const cachedNeighbours = 10
+
+// findCached returns the entry stored for exactly this prompt and
+// llm_string, if any. vec is the prompt's embedding: without an llm_string
+// to look entries up by, the entry is among vec's nearest neighbours, since
+// the same prompt embeds to the same vector, rather than found by scanning
+// the store.
+func (s *Server) findCached(ctx context.Context, prompt, llmString string, vec []float64) (*models.Entry, error) {
+	var entries []*models.Entry
+	if llmString != "" {
+		found, err := s.findEntries(ctx, "", map[string]string{models.MetaLLMString: llmString})
+		if err != nil {
+			return nil, err
+		}
+		entries = found
+	} else {
+		ids, _, err := s.store.SearchByVector(ctx, vec, cachedNeighbours)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if e, err := s.store.GetEntry(ctx, id); err == nil {
+				entries = append(entries, e)
+			}
+		}
+	}
+	for _, e := range entries {
+		stored, _ := e.Metadata[models.MetaLLMString].(string)
+		if e.Prompt != prompt || stored != llmString {
+			continue
+		}
+		if s.isExpired(e) {
+			continue
+		}
+		return e, nil
+	}
+	return nil, nil
+}
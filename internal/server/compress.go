@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var (
+	compressedEntries = metrics.NewGauge("slmcache_store_compressed_entries",
+		"Responses the store keeps compressed at rest (SLC_COMPRESS_ABOVE).")
+	compressedBytes = metrics.NewGauge("slmcache_store_compressed_bytes",
+		"Size of the responses kept compressed, before (raw) and after (stored) compression.", "form")
+)
+
+// exportCompression publishes the store's compression stats; it observes
+// writes, which are what change them.
+func (s *Server) exportCompression(change) {
+	cr, ok := s.backend.(store.CompressionReporter)
+	if !ok {
+		return
+	}
+	st := cr.CompressionStats()
+	compressedEntries.Set(float64(st.Entries))
+	compressedBytes.Set(float64(st.RawBytes), "raw")
+	compressedBytes.Set(float64(st.StoredBytes), "stored")
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+)
+
+var (
+	openConns = metrics.NewGauge("slmcache_http_connections",
+		"Open HTTP connections.")
+	connLimit = metrics.NewGauge("slmcache_http_connection_limit",
+		"Most HTTP connections served at once (0 = unlimited).")
+	connWaits = metrics.NewCounter("slmcache_http_connection_waits_total",
+		"Connections that waited in the accept backlog because the connection limit was reached.")
+	inFlight = metrics.NewGauge("slmcache_http_requests_in_flight",
+		"HTTP requests being served; watch it fall to 0 while draining.")
+	draining = metrics.NewGauge("slmcache_draining",
+		"1 while the server drains requests before shutting down.")
+)
+
+// LimitListener counts the connections accepted from ln and, when max > 0,
+// stops accepting while max of them are open. Further clients wait in the
+// kernel's accept backlog instead of starving the ones being served.
+func LimitListener(ln net.Listener, max int) net.Listener {
+	l := &limitListener{Listener: ln}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	connLimit.Set(float64(max))
+	return l
+}
+
+type limitListener struct {
+	net.Listener
+	slots chan struct{} // nil: unlimited
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			connWaits.Inc()
+			l.slots <- struct{}{}
+		}
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		if l.slots != nil {
+			<-l.slots
+		}
+		return nil, err
+	}
+	openConns.Add(1)
+	return &limitConn{Conn: c, release: l.release}, nil
+}
+
+func (l *limitListener) release() {
+	openConns.Add(-1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// countInFlight tracks the requests being served.
+func countInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Drain marks the server as shutting down: /readyz answers 503 so load
+// balancers stop sending traffic while in-flight requests finish.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+	draining.Set(1)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var entryCopies = metrics.NewCounter("slmcache_entry_copies_total",
+	"Entries copied between namespaces, by result (reused, reembedded, error).", "result")
+
+var (
+	errCopyArchived = errors.New("entry is archived; reopen it as a draft to copy it")
+	// errCopyReembed is returned for entries whose vector can't be reused
+	// and can't be rebuilt from the prompt alone either.
+	errCopyReembed = errors.New("the entry's vector is from another model, and its image or conversation can't be re-embedded from the prompt alone")
+)
+
+// copyReport is the outcome of a bulk copy.
+type copyReport struct {
+	Copied int `json:"copied"`
+	// Reused counts the copies that kept the source's vector rather than
+	// being embedded again.
+	Reused int `json:"reused"`
+	Failed int `json:"failed"`
+}
+
+// copyEntry copies e into namespace dst, replacing an entry there with the
+// same prompt, scope and LLM string so promoting again doesn't duplicate
+// it. The vector is reused when the model now configured made it, and
+// embedded again otherwise. The copy starts with fresh timestamps, no
+// serves counted, and no attachment.
+func (s *Server) copyEntry(ctx context.Context, e *models.Entry, dst string) (c *models.Entry, replaced, reused bool, err error) {
+	if e.State() == models.StateArchived {
+		return nil, false, false, errCopyArchived
+	}
+	c = &models.Entry{
+		Prompt:     e.Prompt,
+		Response:   e.Response,
+		Metadata:   maps.Clone(e.Metadata),
+		Provenance: e.Provenance,
+		Embedder:   e.Embedder,
+	}
+	if c.Metadata == nil {
+		c.Metadata = map[string]interface{}{}
+	}
+	delete(c.Metadata, models.MetaServed)
+	delete(c.Metadata, models.MetaBlob)
+	if dst == models.DefaultNamespace {
+		delete(c.Metadata, models.MetaNamespace)
+	} else {
+		c.Metadata[models.MetaNamespace] = dst
+	}
+	var vec []float64
+	if current := embedderOf(s.getSLM()); e.Embedder == nil || (!e.Embedder.Fallback && current.Comparable(e.Embedder)) {
+		if vg, ok := s.backend.(store.VectorGetter); ok {
+			vec, _ = vg.GetVector(ctx, e.ID)
+		}
+	}
+	reused = vec != nil
+	if !reused {
+		if e.Opaque() {
+			return nil, false, false, errCopyReembed
+		}
+		if vec, err = s.embedEntry(ctx, c, nil, stageInsert); err != nil {
+			return nil, false, false, err
+		}
+	}
+	id, replaced, err := s.storeOnce(ctx, c, vec)
+	if err != nil {
+		return nil, false, false, err
+	}
+	c.ID = id
+	return c, replaced, reused, nil
+}
+
+// POST /ns/{src}/entries/{id}/copy?to={dst}
+// POST /ns/{src}/entries/copy?to={dst}&metadata.<key>=...
+//
+// Copies an entry, or every entry matching the metadata filters, from
+// namespace src to dst, to promote curated answers from staging to
+// production.
+func (s *Server) handleNamespaceEntries(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/ns/"), "/"), "/")
+	if len(parts) < 3 || parts[0] == "" || parts[1] != "entries" || parts[len(parts)-1] != "copy" || len(parts) > 4 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	src, dst := parts[0], r.URL.Query().Get("to")
+	if dst == "" || dst == src {
+		http.Error(w, "bad request: to must name another namespace", http.StatusBadRequest)
+		return
+	}
+	if !principalFrom(r.Context()).allows(dst) {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	if len(parts) == 4 {
+		id, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		s.copyOne(w, r, src, dst, id)
+		return
+	}
+	s.copyMatching(w, r, src, dst)
+}
+
+func (s *Server) copyOne(w http.ResponseWriter, r *http.Request, src, dst string, id int64) {
+	ctx := r.Context()
+	e, err := s.store.GetEntry(ctx, id)
+	if err != nil || e.Namespace() != src || s.expireIfNeeded(ctx, e) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	c, replaced, reused, err := s.copyEntry(ctx, e, dst)
+	switch {
+	case errors.Is(err, errCopyArchived), errors.Is(err, errCopyReembed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errDegenerate):
+		embedError(w, err)
+		return
+	case err != nil:
+		entryCopies.Inc("error")
+		s.respondStoreError(w, err)
+		return
+	}
+	entryCopies.Inc(copyResult(reused))
+	w.Header().Set("Content-Type", "application/json")
+	if !replaced {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(c)
+}
+
+func (s *Server) copyMatching(w http.ResponseWriter, r *http.Request, src, dst string) {
+	ctx := r.Context()
+	filters := metadataFiltersFromQuery(r.URL.Query())
+	if filters == nil {
+		filters = map[string]string{}
+	}
+	if src != models.DefaultNamespace {
+		// entries of the default namespace may not carry the key at all
+		filters[models.MetaNamespace] = src
+	}
+	entries, err := s.store.FindEntriesByMetadata(ctx, filters)
+	if err != nil {
+		s.respondStoreError(w, err)
+		return
+	}
+	rep := copyReport{}
+	for _, e := range entries {
+		if e.Namespace() != src || e.State() == models.StateArchived || s.expireIfNeeded(ctx, e) {
+			continue
+		}
+		_, _, reused, err := s.copyEntry(ctx, e, dst)
+		if errors.Is(err, errForbidden) || errors.Is(err, store.ErrUnavailable) {
+			s.respondStoreError(w, err)
+			return
+		}
+		if err != nil {
+			entryCopies.Inc("error")
+			log.Printf("server: copying entry %d to namespace %s: %v", e.ID, dst, err)
+			rep.Failed++
+			continue
+		}
+		entryCopies.Inc(copyResult(reused))
+		rep.Copied++
+		if reused {
+			rep.Reused++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+func copyResult(reused bool) string {
+	if reused {
+		return "reused"
+	}
+	return "reembedded"
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+)
+
+// grafanaDashboard is a Grafana dashboard over the exported metrics, with
+// exemplars enabled on the latency panel; import it and pick a Prometheus
+// data source.
+//
+//go:embed dashboard.json
+var grafanaDashboard []byte
+
+const dashboardPoints = 360
+
+// dashboardPoint summarizes one sampling interval.
+type dashboardPoint struct {
+	Time             time.Time        `json:"time"`
+	LookupsPerSecond float64          `json:"lookups_per_second"`
+	HitRatio         float64          `json:"hit_ratio"`
+	L1HitRatio       float64          `json:"l1_hit_ratio"`
+	LatencyMs        dashboardLatency `json:"latency_ms"`
+	ShedPerSecond    float64          `json:"shed_per_second"`
+	LimitedPerSecond float64          `json:"rate_limited_per_second"`
+}
+
+type dashboardLatency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// dashboardTotals are the cumulative counters a point is the difference of.
+type dashboardTotals struct {
+	at                     time.Time
+	l1Hits, l2Hits, l2Miss float64
+	shed, limited          float64
+	l1Latency, l2Latency   metrics.HistogramSnapshot
+}
+
+// dashboard samples the cache's own metrics every interval and keeps the
+// last dashboardPoints intervals, so dashboards without Prometheus can draw
+// recent history. A nil *dashboard records nothing.
+type dashboard struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	last   dashboardTotals
+	points []dashboardPoint // ring, oldest at next once full
+	next   int
+}
+
+// newDashboard samples every SLC_DASHBOARD_INTERVAL (default 10s, so an
+// hour of history). It returns nil when the interval is 0.
+func newDashboard() *dashboard {
+	interval := durationFromEnv("SLC_DASHBOARD_INTERVAL", 10*time.Second)
+	if interval <= 0 {
+		return nil
+	}
+	return &dashboard{interval: interval, last: dashboardTotals{at: time.Now()}}
+}
+
+func readDashboardTotals(now time.Time) dashboardTotals {
+	return dashboardTotals{
+		at:        now,
+		l1Hits:    tierLookups.Value("l1", "hit"),
+		l2Hits:    tierLookups.Value("l2", "hit"),
+		l2Miss:    tierLookups.Value("l2", "miss"),
+		shed:      shedRequests.Sum(),
+		limited:   rateLimitDecisions.Sum("result", "limit"),
+		l1Latency: tierLatency.Snapshot("l1"),
+		l2Latency: tierLatency.Snapshot("l2"),
+	}
+}
+
+// sample appends the point for the interval ending now.
+func (d *dashboard) sample(now time.Time) {
+	cur := readDashboardTotals(now)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev := d.last
+	d.last = cur
+	secs := cur.at.Sub(prev.at).Seconds()
+	if secs <= 0 {
+		return
+	}
+	l1Hits := cur.l1Hits - prev.l1Hits
+	hits := l1Hits + cur.l2Hits - prev.l2Hits
+	lookups := hits + cur.l2Miss - prev.l2Miss
+	p := dashboardPoint{
+		Time:             now.UTC(),
+		LookupsPerSecond: lookups / secs,
+		ShedPerSecond:    (cur.shed - prev.shed) / secs,
+		LimitedPerSecond: (cur.limited - prev.limited) / secs,
+	}
+	if lookups > 0 {
+		p.HitRatio = hits / lookups
+		p.L1HitRatio = l1Hits / lookups
+	}
+	latency := cur.l1Latency.Sub(prev.l1Latency)
+	l2 := cur.l2Latency.Sub(prev.l2Latency)
+	latency.Count += l2.Count
+	for i := range latency.Counts {
+		latency.Counts[i] += l2.Counts[i]
+	}
+	p.LatencyMs = dashboardLatency{P50: quantileMs(latency, 0.5), P95: quantileMs(latency, 0.95), P99: quantileMs(latency, 0.99)}
+	if len(d.points) < dashboardPoints {
+		d.points = append(d.points, p)
+		return
+	}
+	d.points[d.next] = p
+	d.next = (d.next + 1) % dashboardPoints
+}
+
+// quantileMs estimates a latency quantile in milliseconds, 0 for an
+// interval without lookups.
+func quantileMs(h metrics.HistogramSnapshot, q float64) float64 {
+	v := h.Quantile(q)
+	if math.IsNaN(v) {
+		return 0
+	}
+	return v * 1000
+}
+
+// series returns the points, oldest first.
+func (d *dashboard) series() []dashboardPoint {
+	if d == nil {
+		return []dashboardPoint{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append(append([]dashboardPoint{}, d.points[d.next:]...), d.points[:d.next]...)
+}
+
+func (s *Server) startDashboard() {
+	if s.dashboard == nil {
+		return
+	}
+	s.janitorWG.Add(1)
+	go func() {
+		defer s.janitorWG.Done()
+		ticker := time.NewTicker(s.dashboard.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.dashboard.sample(now)
+			case <-s.janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+// GET /stats/dashboard
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	out := struct {
+		Interval string           `json:"interval"`
+		Points   []dashboardPoint `json:"points"`
+		SLOs     []sloStatus      `json:"slos"`
+	}{Points: s.dashboard.series(), SLOs: s.slo.status(time.Now())}
+	if s.dashboard != nil {
+		out.Interval = s.dashboard.interval.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// GET /stats/dashboard/grafana
+func handleGrafanaDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(grafanaDashboard)
+}
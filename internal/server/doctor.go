@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/slm"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// doctorSample is how many stored vectors the dimension check compares
+// with the backend's.
+const doctorSample = 100
+
+// invalidSettings records the settings that didn't parse and fell back to
+// their defaults, by the kind of value expected. A silently ignored typo in
+// a duration is the kind of thing only the doctor would catch.
+var invalidSettings sync.Map // key -> kind
+
+func noteInvalid(key, kind string) {
+	invalidSettings.Store(key, kind)
+}
+
+// Doctor checks the configuration, the store, the SLM backend and that the
+// backend's embeddings line up with the stored ones, so a misconfiguration
+// shows before traffic does.
+func (s *Server) Doctor(ctx context.Context) models.DoctorReport {
+	rep := models.DoctorReport{OK: true}
+	add := func(c models.DoctorCheck) {
+		rep.Checks = append(rep.Checks, c)
+		if c.Status == models.CheckFail {
+			rep.OK = false
+		}
+	}
+	add(checkConfig())
+	add(s.doctorStore(ctx))
+	backend, vec := s.doctorSLM()
+	add(backend)
+	if vec != nil {
+		add(s.doctorDimensions(ctx, len(vec)))
+	}
+	return rep
+}
+
+// checkConfig reports settings that failed to parse or name nothing known.
+func checkConfig() models.DoctorCheck {
+	var problems []string
+	invalidSettings.Range(func(k, v any) bool {
+		key, kind := k.(string), v.(string)
+		val := config.Get(key)
+		var err error
+		switch kind {
+		case "duration":
+			_, err = time.ParseDuration(val)
+		default:
+			var n int
+			if n, err = strconv.Atoi(val); err == nil && n < 0 {
+				err = fmt.Errorf("negative")
+			}
+		}
+		if val != "" && err != nil {
+			problems = append(problems, fmt.Sprintf("%s=%q is not a valid %s; the default is used", key, val, kind))
+		} else {
+			invalidSettings.Delete(key)
+		}
+		return true
+	})
+	for key, allowed := range map[string][]string{
+		"SLM_BACKEND":  {"ollama", "mock", "replay"},
+		"SLM_FALLBACK": {"mock", "none"},
+	} {
+		if v := strings.ToLower(config.Get(key)); v != "" && !slices.Contains(allowed, v) {
+			problems = append(problems, fmt.Sprintf("%s=%q is not one of %s", key, v, strings.Join(allowed, ", ")))
+		}
+	}
+	if len(problems) == 0 {
+		return models.DoctorCheck{Name: "config", Status: models.CheckOK, Detail: "all settings read so far are valid"}
+	}
+	slices.Sort(problems)
+	return models.DoctorCheck{Name: "config", Status: models.CheckFail, Detail: strings.Join(problems, "; ")}
+}
+
+func (s *Server) doctorStore(ctx context.Context) models.DoctorCheck {
+	c := models.DoctorCheck{Name: "store"}
+	if err := s.checkStore(ctx); err != nil {
+		c.Status, c.Detail = models.CheckFail, fmt.Sprintf("health check failed: %v", err)
+		return c
+	}
+	c.Status, c.Detail = models.CheckOK, fmt.Sprintf("healthy, %d entries", len(s.store.AllIDs()))
+	return c
+}
+
+// doctorSLM embeds a test prompt and returns the vector, or nil when the
+// backend can't embed.
+func (s *Server) doctorSLM() (models.DoctorCheck, []float64) {
+	c := models.DoctorCheck{Name: "slm"}
+	m := s.getSLM()
+	name := "unknown"
+	if n, ok := m.(interface{ BackendName() string }); ok {
+		name = n.BackendName()
+	}
+	start := time.Now()
+	vec, err := m.Embed("slmcache doctor self-test")
+	took := time.Since(start).Round(time.Millisecond)
+	switch {
+	case err != nil:
+		c.Status, c.Detail = models.CheckFail, fmt.Sprintf("%s backend can't embed: %v", name, err)
+		return c, nil
+	case degenerateReason(vec) != "":
+		c.Status, c.Detail = models.CheckFail, fmt.Sprintf("%s backend returned a degenerate vector (%s)", name, degenerateReason(vec))
+		return c, nil
+	}
+	c.Status, c.Detail = models.CheckOK, fmt.Sprintf("%s backend, %d dimensions, test embed took %s", name, len(vec), took)
+	if name == "mock" {
+		c.Status = models.CheckWarn
+		c.Detail += "; the mock backend hashes words and is meant for tests and local runs"
+	}
+	if reason := slm.Fallback(m); reason != "" {
+		url := config.Get("SLM_OLLAMA_URL")
+		if url == "" {
+			url = "http://localhost:11434"
+		}
+		c.Status = models.CheckFail
+		c.Detail = fmt.Sprintf("the mock backend replaced Ollama after its %s check failed; make sure Ollama is reachable at %s (SLM_OLLAMA_URL) and serves SLM_OLLAMA_MODEL, or set SLM_BACKEND=mock deliberately", reason, url)
+	}
+	return c, vec
+}
+
+// doctorDimensions compares the dimension of a sample of stored vectors with
+// the backend's: a model switched behind the same data matches nothing.
+func (s *Server) doctorDimensions(ctx context.Context, dim int) models.DoctorCheck {
+	c := models.DoctorCheck{Name: "dimensions", Status: models.CheckOK}
+	vg, ok := s.backend.(store.VectorGetter)
+	if !ok {
+		c.Detail = "the store doesn't expose vectors; skipped"
+		return c
+	}
+	ids := s.store.AllIDs()
+	if len(ids) > doctorSample {
+		ids = ids[:doctorSample]
+	}
+	var checked, mismatched int
+	found := map[int]bool{}
+	for _, id := range ids {
+		// image-conditioned vectors also hold the image's embedding
+		if e, err := s.backend.GetEntry(ctx, id); err != nil || e.ImageHash() != "" {
+			continue
+		}
+		v, err := vg.GetVector(ctx, id)
+		if err != nil {
+			continue
+		}
+		checked++
+		if len(v) != dim {
+			mismatched++
+			found[len(v)] = true
+		}
+	}
+	switch {
+	case checked == 0:
+		c.Detail = "no stored vectors to compare"
+	case mismatched > 0:
+		var dims []string
+		for _, d := range slices.Sorted(maps.Keys(found)) {
+			dims = append(dims, strconv.Itoa(d))
+		}
+		c.Status = models.CheckFail
+		c.Detail = fmt.Sprintf("%d of %d sampled entries have %s-dimensional vectors but the backend embeds %d; restore the model they were embedded with or re-embed the cache", mismatched, checked, strings.Join(dims, "/"), dim)
+	default:
+		c.Detail = fmt.Sprintf("%d sampled entries match the backend's %d dimensions", checked, dim)
+	}
+	return c
+}
+
+// GET /admin/doctor
+func (s *Server) handleDoctor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.Doctor(r.Context()))
+}
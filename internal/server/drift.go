@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var (
+	driftMean = metrics.NewGauge("slmcache_embedding_drift",
+		"Mean cosine distance between stored and freshly computed embeddings in the last drift sample.")
+	driftMax = metrics.NewGauge("slmcache_embedding_drift_max",
+		"Largest cosine distance between a stored and a fresh embedding in the last drift sample.")
+	driftAlerts = metrics.NewCounter("slmcache_embedding_drift_alerts_total",
+		"Drift checks whose mean distance exceeded SLC_DRIFT_THRESHOLD.")
+)
+
+// driftReport is the outcome of one drift check. It is served by
+// /admin/drift and posted to SLC_DRIFT_WEBHOOK when Drifted is set.
+type driftReport struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Backend   string    `json:"backend"`
+	Sampled   int       `json:"sampled"`
+	Mean      float64   `json:"mean"`
+	Max       float64   `json:"max"`
+	Threshold float64   `json:"threshold"`
+	Drifted   bool      `json:"drifted"`
+	// WorstID is the sampled entry whose embedding moved the most.
+	WorstID int64 `json:"worst_id,omitempty"`
+}
+
+func driftThreshold() float64 {
+	if v := config.Get("SLC_DRIFT_THRESHOLD"); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return 0.05
+}
+
+// checkDrift re-embeds a random sample of stored prompts (SLC_DRIFT_SAMPLE,
+// default 20) and compares them with their stored vectors. A model updated
+// behind the same name produces vectors that no longer line up with the
+// stored ones, silently degrading hit rates until entries are re-embedded.
+func (s *Server) checkDrift(ctx context.Context) *driftReport {
+	vg, ok := s.backend.(store.VectorGetter)
+	if !ok {
+		return nil
+	}
+	sample := intFromEnv("SLC_DRIFT_SAMPLE", 20)
+	ids := s.store.AllIDs()
+	if sample == 0 || len(ids) == 0 {
+		return nil
+	}
+	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	if len(ids) > sample {
+		ids = ids[:sample]
+	}
+	m := s.getSLM()
+	rep := &driftReport{CheckedAt: time.Now().UTC(), Threshold: driftThreshold()}
+	if n, ok := m.(interface{ BackendName() string }); ok {
+		rep.Backend = n.BackendName()
+	}
+	var sum float64
+	for _, id := range ids {
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil || e.Opaque() {
+			continue
+		}
+		stored, err := vg.GetVector(ctx, id)
+		if err != nil {
+			continue
+		}
+		fresh, err := m.Embed(e.Prompt)
+		if err != nil {
+			log.Printf("server: drift embed entry %d: %v", id, err)
+			continue
+		}
+		d := 1 - cosineSimilarity(stored, fresh)
+		sum += d
+		rep.Sampled++
+		if d > rep.Max || rep.WorstID == 0 {
+			rep.Max, rep.WorstID = d, id
+		}
+	}
+	if rep.Sampled == 0 {
+		return nil
+	}
+	rep.Mean = sum / float64(rep.Sampled)
+	rep.Drifted = rep.Mean > rep.Threshold
+	driftMean.Set(rep.Mean)
+	driftMax.Set(rep.Max)
+	s.driftMu.Lock()
+	s.lastDrift = rep
+	s.driftMu.Unlock()
+	if rep.Drifted {
+		driftAlerts.Inc()
+		log.Printf("server: embedding drift %.4f exceeds %.4f over %d entries; re-embed the cache", rep.Mean, rep.Threshold, rep.Sampled)
+		s.notifyDrift(ctx, rep)
+	}
+	return rep
+}
+
+func (s *Server) notifyDrift(ctx context.Context, rep *driftReport) {
+	url := config.Get("SLC_DRIFT_WEBHOOK")
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(rep)
+	if s.outbox != nil {
+		s.outbox.enqueue(ctx, store.OutboxMessage{Sink: sinkWebhook, Target: url, Type: "drift", Payload: body})
+		return
+	}
+	if err := postWebhook(ctx, url, body); err != nil {
+		log.Printf("server: drift webhook: %v", err)
+	}
+}
+
+// GET  /admin/drift  -> last drift report
+// POST /admin/drift  -> run a drift check now
+func (s *Server) handleDrift(w http.ResponseWriter, r *http.Request) {
+	var rep *driftReport
+	switch r.Method {
+	case http.MethodGet:
+		s.driftMu.Lock()
+		rep = s.lastDrift
+		s.driftMu.Unlock()
+	case http.MethodPost:
+		rep = s.checkDrift(r.Context())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rep == nil {
+		http.Error(w, "no drift report available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// cosineSimilarity returns 0 for vectors of different lengths, which a
+// changed model dimension produces.
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		if na == nb {
+			return 1
+		}
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var (
+	// errEncryptedNamespace is returned by plaintext writes into an
+	// encrypted namespace, and errNotEncrypted by encrypted writes into
+	// one that isn't.
+	errEncryptedNamespace = errors.New("namespace is encrypted; write it with POST /encrypted/entries")
+	errNotEncrypted       = errors.New("namespace is not declared encrypted")
+)
+
+// encryptedNamespace reports whether namespace ns is declared encrypted.
+func (s *Server) encryptedNamespace(ns string) bool {
+	n, ok := s.namespaces.get(ns)
+	return ok && n.Encrypted
+}
+
+// sealed returns why an entry may not be in namespace ns with its
+// encrypted flag as given: encrypted namespaces hold encrypted entries
+// only, and other namespaces none.
+func (a authzStore) sealed(ns string, encrypted bool) error {
+	if a.encrypted == nil || a.encrypted(ns) == encrypted {
+		return nil
+	}
+	if encrypted {
+		return fmt.Errorf("%w: %s", errNotEncrypted, ns)
+	}
+	return fmt.Errorf("%w: %s", errEncryptedNamespace, ns)
+}
+
+// needsPlaintext lists the metadata keys that make the server read an
+// entry's prompt or response, which it can't for an encrypted one.
+var needsPlaintext = []string{models.MetaSchema, models.MetaRefresh, models.MetaCanary, models.MetaRelated, models.MetaTool}
+
+// encryptedEntry is the body of POST /encrypted/entries.
+type encryptedEntry struct {
+	Namespace string `json:"namespace"`
+	// PromptHash identifies the prompt without revealing it, e.g. an HMAC
+	// under a client-held key.
+	PromptHash string `json:"prompt_hash"`
+	// Ciphertext is the encrypted response, in whatever text encoding the
+	// client chose.
+	Ciphertext string `json:"ciphertext"`
+	// Vector is the prompt's embedding, computed by the client.
+	Vector   []float64              `json:"vector"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// POST /encrypted/entries
+//
+// Stores an entry of an encrypted namespace as the client sent it: the
+// prompt hash as its prompt, the ciphertext as its response and the
+// client's vector. Nothing is embedded, classified or summarized.
+func (s *Server) handleEncryptedEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req encryptedEntry
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request: expected JSON {namespace,prompt_hash,ciphertext,vector,metadata?}; "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.encryptedNamespace(req.Namespace) {
+		http.Error(w, fmt.Sprintf("bad request: %v: %q", errNotEncrypted, req.Namespace), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.PromptHash) == "" || req.Ciphertext == "" {
+		http.Error(w, "bad request: prompt_hash and ciphertext are required", http.StatusBadRequest)
+		return
+	}
+	if reason := degenerateReason(req.Vector); reason != "" {
+		http.Error(w, "bad request: vector is "+reason, http.StatusBadRequest)
+		return
+	}
+	for _, k := range needsPlaintext {
+		if _, ok := req.Metadata[k]; ok {
+			http.Error(w, "bad request: metadata."+k+" needs the plaintext", http.StatusBadRequest)
+			return
+		}
+	}
+	e := models.Entry{Prompt: req.PromptHash, Response: req.Ciphertext, Metadata: req.Metadata}
+	if err := checkReserved(&e); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := initialState(&e); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e.Metadata == nil {
+		e.Metadata = map[string]interface{}{}
+	}
+	e.Metadata[models.MetaNamespace] = req.Namespace
+	e.Metadata[models.MetaEncrypted] = true
+	delete(e.Metadata, models.MetaImage)
+	delete(e.Metadata, models.MetaScope)
+	id, err := s.store.CreateEntryWithVector(r.Context(), &e, req.Vector)
+	if err != nil {
+		s.respondStoreError(w, err)
+		return
+	}
+	e.ID = id
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+// encryptedSearch is the body of POST /encrypted/search.
+type encryptedSearch struct {
+	Namespace string            `json:"namespace"`
+	Vector    []float64         `json:"vector"`
+	Limit     int               `json:"limit,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// POST /encrypted/search
+//
+// Looks an encrypted namespace up by the client's query vector and
+// returns the matching entries, ciphertext and all, best first. There is
+// no exact-match or lexical tier: the server has no text to match.
+func (s *Server) handleEncryptedSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req encryptedSearch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request: expected JSON {namespace,vector,limit?,metadata?}; "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.encryptedNamespace(req.Namespace) {
+		http.Error(w, fmt.Sprintf("bad request: %v: %q", errNotEncrypted, req.Namespace), http.StatusBadRequest)
+		return
+	}
+	if reason := degenerateReason(req.Vector); reason != "" {
+		http.Error(w, "bad request: vector is "+reason, http.StatusBadRequest)
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = 10
+	}
+	filters := map[string]string{}
+	for k, v := range req.Metadata {
+		filters[k] = v
+	}
+	filters[models.MetaNamespace] = req.Namespace
+	q := searchQuery{Filters: filters, Limit: req.Limit, Vector: req.Vector, Encrypted: true, Source: "encrypted"}
+	ctx := r.Context()
+	start := time.Now()
+	ids, scores, err := s.searchVector(ctx, q, req.Vector)
+	if err != nil {
+		s.respondStoreError(w, err)
+		return
+	}
+	thresholds := s.thresholds()
+	res := &searchResult{Entries: []*models.Entry{}, Scores: []float64{}, Tier: "l2"}
+	for i, id := range ids {
+		if len(res.Entries) >= q.Limit {
+			break
+		}
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil || s.expireIfNeeded(ctx, e) || e.Flag(models.MetaStale) || !q.matches(e) {
+			continue
+		}
+		if scores[i] < thresholds.of(e) {
+			continue
+		}
+		res.add(e, scores[i])
+	}
+	s.consume(ctx, res)
+	for _, e := range res.Entries {
+		s.hits.record(e.ID, start)
+	}
+	redact(r, res.Entries...)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res.Entries)
+}
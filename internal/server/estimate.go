@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// searchEstimate is the body of GET /estimate.
+type searchEstimate struct {
+	// Tier is the tier expected to answer: cached or l1 without embedding,
+	// l2 for a vector search.
+	Tier string `json:"tier"`
+	// Embeds is whether the query has to be embedded first.
+	Embeds bool `json:"embeds"`
+	// EmbedLatencyMS and EmbedLatencyP95MS are the median and 95th
+	// percentile of recent query embeds; 0 when none were timed yet.
+	EmbedLatencyMS    float64 `json:"embed_latency_ms"`
+	EmbedLatencyP95MS float64 `json:"embed_latency_p95_ms"`
+	// Candidates is how many stored vectors the vector search scores.
+	Candidates int `json:"candidates"`
+	// K is how many neighbours it asks for, oversampling included.
+	K int `json:"k"`
+}
+
+// GET /estimate?q=...&metadata.<key>=...
+//
+// Predicts what GET /search with the same parameters would cost, without
+// embedding or searching, so a client under a tight latency budget can
+// choose between a lookup and generating directly. The exact and cached
+// tiers are checked for real, since that is cheap; nothing is consumed.
+func (s *Server) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	q := searchQuery{
+		Text:          r.URL.Query().Get("q"),
+		Filters:       metadataFiltersFromQuery(r.URL.Query()),
+		Limit:         10,
+		IncludeStale:  r.URL.Query().Get("include_stale") == "true",
+		IncludeDrafts: r.URL.Query().Get("include_drafts") == "true",
+		Session:       r.URL.Query().Get("session_id"),
+		Scope:         scopeFromQuery(r.URL.Query()),
+		Oversample:    parseOversample(r.URL.Query().Get("oversample")),
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+		q.Limit = v
+	}
+	if q.Text == "" {
+		http.Error(w, "q required", http.StatusBadRequest)
+		return
+	}
+	est := searchEstimate{Tier: "l2", Embeds: true, K: s.searchK(q)}
+	var cached *searchResult
+	if s.results != nil && q.cacheable() {
+		cached, _ = s.results.get(s.resultKey(q, principalFrom(ctx)), time.Now())
+	}
+	if cached != nil {
+		est = searchEstimate{Tier: "cached"}
+	} else if s.sessions.history(q.Session) == 0 {
+		if e := s.lookupExact(ctx, q); e != nil && q.matches(e) && (q.IncludeStale || !e.Flag(models.MetaStale)) {
+			est = searchEstimate{Tier: "l1"}
+		}
+	}
+	if est.Embeds {
+		latency := embedLatency.Snapshot(stageQuery)
+		est.EmbedLatencyMS = quantileMs(latency, 0.5)
+		est.EmbedLatencyP95MS = quantileMs(latency, 0.95)
+		// stores that can't narrow the search by metadata score every vector
+		scanned := q.Filters
+		if !s.filtersPushedDown() && !store.CapabilitiesOf(s.backend).EmbedderSearch {
+			scanned = nil
+		}
+		n, err := s.aggregator(ctx).CountEntries(ctx, scanned)
+		if err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+		est.Candidates = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(est)
+}
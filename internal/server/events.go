@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/events"
+)
+
+// newEventPublisher builds the optional activity publisher from SLC_EVENTS
+// (nats or kafka) and SLC_EVENTS_URL (the NATS server URL, or comma-separated
+// Kafka brokers). NATS subjects start with SLC_EVENTS_TOPIC (default
+// slmcache) and Kafka produces to that topic (default slmcache-events). It
+// returns nil when SLC_EVENTS is unset or the broker can't be set up.
+func newEventPublisher() events.Publisher {
+	kind := config.Get("SLC_EVENTS")
+	if kind == "" {
+		return nil
+	}
+	url := config.Get("SLC_EVENTS_URL")
+	topic := config.Get("SLC_EVENTS_TOPIC")
+	var pub events.Publisher
+	var err error
+	switch kind {
+	case "nats":
+		if topic == "" {
+			topic = "slmcache"
+		}
+		pub, err = events.NewNATSPublisher(url, topic, config.Get("SLC_EVENTS_JETSTREAM") == "true")
+	case "kafka":
+		if topic == "" {
+			topic = "slmcache-events"
+		}
+		pub, err = events.NewKafkaPublisher(strings.Split(url, ","), topic)
+	default:
+		log.Printf("server: unknown SLC_EVENTS %q (want nats or kafka); events disabled", kind)
+		return nil
+	}
+	if err != nil {
+		log.Printf("server: events disabled: %v", err)
+		return nil
+	}
+	return pub
+}
+
+// startEvents wires the event publisher: search events are best-effort
+// telemetry and go through the in-memory emitter, while entry events go
+// through the outbox when it is enabled.
+func (s *Server) startEvents() {
+	pub := newEventPublisher()
+	if pub == nil {
+		return
+	}
+	s.events = events.NewEmitter(pub, s.instanceID, intFromEnv("SLC_EVENTS_BUFFER", 10000), 0)
+	if s.outbox != nil {
+		s.outbox.events = pub
+	}
+	s.observe(s.onEventChange)
+}
+
+// onEventChange publishes entry lifecycle events.
+func (s *Server) onEventChange(c change) {
+	ev := events.Event{ID: c.id}
+	switch c.kind {
+	case changeCreated:
+		ev.Type = events.EntryCreated
+	case changeUpdated:
+		ev.Type = events.EntryUpdated
+	case changeDeleted:
+		ev.Type = events.EntryDeleted
+	default:
+		ev.Type = events.EntryMetadata
+	}
+	if c.entry != nil {
+		ev.Namespace = c.entry.Namespace()
+	}
+	if s.outbox != nil {
+		ev.Time, ev.Instance = time.Now().UTC(), s.instanceID
+		s.outbox.enqueueEvent(context.Background(), ev)
+		return
+	}
+	s.events.Emit(ev)
+}
+
+// emitSearch publishes the outcome of a lookup.
+func (s *Server) emitSearch(q searchQuery, res *searchResult, start time.Time) {
+	if s.events == nil {
+		return
+	}
+	ev := events.Event{
+		Type:      events.SearchMiss,
+		Time:      start.UTC(),
+		Namespace: q.namespace(),
+		Source:    q.Source,
+		Tier:      res.Tier,
+		Scores:    res.Scores,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if len(res.Entries) > 0 {
+		ev.Type = events.SearchHit
+		ev.IDs = make([]int64, len(res.Entries))
+		for i, e := range res.Entries {
+			ev.IDs[i] = e.ID
+		}
+	}
+	s.events.Emit(ev)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/slm"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var queryExpansions = metrics.NewCounter("slmcache_query_expansions_total",
+	"Queries expanded with generated paraphrases, by outcome (ok, cached, error).", "result")
+
+const expandTemplate = `Rewrite the search query below in %d different ways that mean the same
+thing. Spell out abbreviations and add the words a full question would use.
+Reply with one rewrite per line and nothing else.
+
+Query: %s`
+
+// expansionCacheSize bounds the paraphrases remembered per process, so a
+// repeated terse query costs one generation.
+const expansionCacheSize = 1000
+
+// expansionCache maps canonical queries to their paraphrases, forgetting
+// the oldest first.
+type expansionCache struct {
+	mu    sync.Mutex
+	m     map[string][]string
+	order []string
+}
+
+func (c *expansionCache) get(key string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.m[key]
+	return v, ok
+}
+
+func (c *expansionCache) put(key string, v []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = map[string][]string{}
+	}
+	if _, ok := c.m[key]; !ok {
+		if len(c.order) >= expansionCacheSize {
+			delete(c.m, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, key)
+	}
+	c.m[key] = v
+}
+
+// expansionCount is how many paraphrases to search alongside text:
+// SLC_QUERY_EXPANSION (0 to 3, default 0 = off) for queries of at most
+// SLC_QUERY_EXPANSION_MAX_WORDS words (default 6), since long queries
+// already say enough. It is 0 without a generator.
+func (s *Server) expansionCount(text string) int {
+	n := min(intFromEnv("SLC_QUERY_EXPANSION", 0), 3)
+	if n == 0 || s.getGenerator() == nil {
+		return 0
+	}
+	if words := len(strings.Fields(text)); words == 0 || words > intFromEnv("SLC_QUERY_EXPANSION_MAX_WORDS", 6) {
+		return 0
+	}
+	return n
+}
+
+// expand asks the generator for up to n paraphrases of text. Failures are
+// logged and yield none, leaving the plain search.
+func (s *Server) expand(ctx context.Context, text string, n int) []string {
+	key := fmt.Sprintf("%d:%s", n, canonicalize(text))
+	if v, ok := s.expansions.get(key); ok {
+		queryExpansions.Inc("cached")
+		return v
+	}
+	g, err := s.getGenerator().Generate(ctx, fmt.Sprintf(expandTemplate, n, text))
+	if err != nil {
+		queryExpansions.Inc("error")
+		log.Printf("server: expand query: %v", err)
+		return nil
+	}
+	seen := map[string]bool{canonicalize(text): true}
+	var out []string
+	for _, line := range strings.Split(g.Text, "\n") {
+		// models number or bullet their lists despite being told not to
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*•0123456789.)"))
+		if key := canonicalize(line); key != "" && !seen[key] && len(out) < n {
+			seen[key] = true
+			out = append(out, line)
+		}
+	}
+	queryExpansions.Inc("ok")
+	s.expansions.put(key, out)
+	return out
+}
+
+// searchVector ranks the entries nearest vec, only among those passing the
+// filters when the store supports it.
+func (s *Server) searchVector(ctx context.Context, q searchQuery, vec []float64) ([]int64, []float64, error) {
+	k := s.searchK(q)
+	embedder := embedderOf(s.getSLM())
+	if es, ok := s.backend.(store.EmbedderSearcher); ok && store.CapabilitiesOf(s.backend).EmbedderSearch {
+		return es.SearchByVectorFrom(ctx, vec, k, embedder, q.Filters)
+	}
+	var ids []int64
+	var scores []float64
+	var err error
+	if len(q.Filters) > 0 && s.filtersPushedDown() {
+		ids, scores, err = s.backend.(store.FilteredSearcher).SearchByVectorFiltered(ctx, vec, k, q.Filters)
+	} else {
+		ids, scores, err = s.store.SearchByVector(ctx, vec, k)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, scores = s.dropIncomparable(ctx, ids, scores, embedder)
+	return ids, scores, nil
+}
+
+// dropIncomparable removes the candidates another model embedded, for
+// stores that can't leave them out of the search themselves.
+func (s *Server) dropIncomparable(ctx context.Context, ids []int64, scores []float64, embedder *models.Embedder) ([]int64, []float64) {
+	keptIDs, keptScores := ids[:0], scores[:0]
+	for i, id := range ids {
+		if e, err := s.store.GetEntry(ctx, id); err == nil && !embedder.Comparable(e.Embedder) {
+			continue
+		}
+		keptIDs = append(keptIDs, id)
+		keptScores = append(keptScores, scores[i])
+	}
+	return keptIDs, keptScores
+}
+
+// searchExpanded adds the neighbours of the query's paraphrases to ids and
+// scores. An entry found by several keeps its best score, so the similarity
+// threshold still means the same thing, and the union is cut to the limit.
+func (s *Server) searchExpanded(ctx context.Context, q searchQuery, ids []int64, scores []float64) ([]int64, []float64) {
+	n := s.expansionCount(q.Text)
+	if n == 0 {
+		return ids, scores
+	}
+	variants := s.expand(ctx, q.Text, n)
+	if len(variants) == 0 {
+		return ids, scores
+	}
+	if !s.embedGate.acquire(ctx, priorityFrom(ctx), -1) {
+		return ids, scores
+	}
+	vecs, err := slm.EmbedAll(s.getSLM(), variants)
+	s.embedGate.release()
+	if err != nil {
+		log.Printf("server: embed query paraphrases: %v", err)
+		return ids, scores
+	}
+	best := make(map[int64]float64, len(ids))
+	for i, id := range ids {
+		best[id] = scores[i]
+	}
+	for _, vec := range vecs {
+		if degenerateReason(vec) != "" {
+			continue
+		}
+		more, moreScores, err := s.searchVector(ctx, q, vec)
+		if err != nil {
+			continue
+		}
+		for i, id := range more {
+			if cur, ok := best[id]; !ok || moreScores[i] > cur {
+				best[id] = moreScores[i]
+			}
+		}
+	}
+	ids, scores = make([]int64, 0, len(best)), make([]float64, 0, len(best))
+	for id := range best {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if best[ids[i]] != best[ids[j]] {
+			return best[ids[i]] > best[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if k := s.searchK(q); k > 0 && len(ids) > k {
+		ids = ids[:k]
+	}
+	for _, id := range ids {
+		scores = append(scores, best[id])
+	}
+	return ids, scores
+}
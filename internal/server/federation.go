@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// federatedHeader marks searches fanned out by a peer region, which are
+// answered locally only.
+const federatedHeader = "X-SLMCache-Federated"
+
+// Federation modes (SLC_FEDERATION or ?federate=).
+const (
+	federationOff    = "off"
+	federationMiss   = "miss"
+	federationAlways = "always"
+)
+
+var federationRequests = metrics.NewCounter("slmcache_federation_requests_total",
+	"Federated searches sent to peer regions, by peer and outcome (ok, error, timeout).", "peer", "result")
+
+type federationPeer struct {
+	name, url string
+}
+
+// federationPeers parses SLC_FEDERATION_PEERS: comma-separated base URLs,
+// each optionally named as region=url.
+func federationPeers() []federationPeer {
+	var out []federationPeer
+	for _, item := range strings.Split(config.Get("SLC_FEDERATION_PEERS"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		p := federationPeer{url: item}
+		if name, u, ok := strings.Cut(item, "="); ok {
+			p.name, p.url = name, u
+		}
+		p.url = strings.TrimRight(p.url, "/")
+		if p.name == "" {
+			if u, err := url.Parse(p.url); err == nil {
+				p.name = u.Host
+			}
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// shouldFederate decides whether q fans out given how many local matches it
+// found. The default mode, miss, only asks other regions when nothing
+// matched locally.
+func (s *Server) shouldFederate(q searchQuery, local int) bool {
+	mode := q.Federation
+	if mode == "" {
+		mode = config.Get("SLC_FEDERATION")
+	}
+	switch mode {
+	case federationOff:
+		return false
+	case federationAlways:
+	default:
+		if local > 0 {
+			return false
+		}
+	}
+	return len(federationPeers()) > 0
+}
+
+// federate sends q to every peer region at once and returns the results
+// that arrive within SLC_FEDERATION_BUDGET (default 200ms), each tagged with
+// the region that answered. Slow regions are simply left out.
+func (s *Server) federate(ctx context.Context, q searchQuery) []*models.Entry {
+	peers := federationPeers()
+	ctx, cancel := context.WithTimeout(ctx, durationFromEnv("SLC_FEDERATION_BUDGET", 200*time.Millisecond))
+	defer cancel()
+	results := make(chan []*models.Entry, len(peers))
+	query := q.values()
+	for _, p := range peers {
+		go func(p federationPeer) {
+			found, err := fetchUpstream(ctx, p.url, query, federatedHeader)
+			switch {
+			case err == nil:
+				federationRequests.Inc(p.name, "ok")
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				federationRequests.Inc(p.name, "timeout")
+			default:
+				federationRequests.Inc(p.name, "error")
+			}
+			for _, e := range found {
+				e.Region = p.name
+			}
+			results <- found
+		}(p)
+	}
+	var out []*models.Entry
+	for range peers {
+		out = append(out, <-results...)
+	}
+	return out
+}
+
+// merge folds remote matches into r, keeping the best-scoring limit results
+// and dropping remote copies of answers already present.
+func (r *searchResult) merge(remote []*models.Entry, limit int) {
+	type key struct{ prompt, response string }
+	seen := map[key]bool{}
+	for _, e := range r.Entries {
+		seen[key{e.Prompt, e.Response}] = true
+	}
+	for _, e := range remote {
+		k := key{e.Prompt, e.Response}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		r.add(e, e.Score)
+	}
+	idx := make([]int, len(r.Entries))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return r.Scores[idx[a]] > r.Scores[idx[b]] })
+	if limit > 0 && len(idx) > limit {
+		idx = idx[:limit]
+	}
+	entries := make([]*models.Entry, len(idx))
+	scores := make([]float64, len(idx))
+	for i, j := range idx {
+		entries[i], scores[i] = r.Entries[j], r.Scores[j]
+		if entries[i].Region != "" {
+			r.Tier = "federated"
+		}
+	}
+	r.Entries, r.Scores = entries, scores
+}
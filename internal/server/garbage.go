@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var garbageDeleted = metrics.NewCounter("slmcache_garbage_deleted_total",
+	"Entries removed by the garbage cleanup policy, by reason.", "reason")
+
+// Garbage categories, also the values accepted by SLC_GARBAGE_CLEANUP.
+const (
+	garbageNeverHit   = "never_hit"
+	garbageDuplicate  = "duplicates"
+	garbageDegenerate = "degenerate"
+)
+
+type garbageEntry struct {
+	ID        int64     `json:"id"`
+	Prompt    string    `json:"prompt"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// garbageReport lists low-value entries. Hit counts are tracked since the
+// process started, so never-hit entries are only reported once both the
+// entry and the process are older than MinAge.
+type garbageReport struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Entries     int              `json:"entries"`
+	MinAge      string           `json:"min_age"`
+	NeverHit    []garbageEntry   `json:"never_hit"`
+	Duplicates  [][]garbageEntry `json:"duplicates"`
+	Degenerate  []garbageEntry   `json:"degenerate"`
+	Deleted     []int64          `json:"deleted,omitempty"`
+}
+
+// analyzeGarbage scores every entry. Near-duplicate clusters need stored
+// vectors and are skipped for stores that can't return them.
+func (s *Server) analyzeGarbage(ctx context.Context, now time.Time) *garbageReport {
+	minAge := durationFromEnv("SLC_GARBAGE_MIN_AGE", 7*24*time.Hour)
+	dupScore := 0.97
+	if v := config.Get("SLC_GARBAGE_DUP_SCORE"); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed > 0 {
+			dupScore = parsed
+		}
+	}
+	rep := &garbageReport{
+		GeneratedAt: now.UTC(),
+		MinAge:      minAge.String(),
+		NeverHit:    []garbageEntry{},
+		Duplicates:  [][]garbageEntry{},
+		Degenerate:  []garbageEntry{},
+	}
+	vg, _ := s.backend.(store.VectorGetter)
+	trackedSince := s.hits.started
+	entries := map[int64]*models.Entry{}
+	vectors := map[int64][]float64{}
+	ids := s.store.AllIDs()
+	for _, id := range ids {
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil {
+			continue
+		}
+		entries[id] = e
+		rep.Entries++
+		ref := garbageEntry{ID: id, Prompt: e.Prompt, CreatedAt: e.CreatedAt}
+		since := e.CreatedAt
+		if since.Before(trackedSince) {
+			since = trackedSince
+		}
+		if s.hits.total(e) == 0 && now.Sub(since) >= minAge {
+			rep.NeverHit = append(rep.NeverHit, ref)
+		}
+		if vg == nil {
+			continue
+		}
+		vec, err := vg.GetVector(ctx, id)
+		if err != nil {
+			continue
+		}
+		if reason := degenerateReason(vec); reason != "" {
+			ref.Reason = reason
+			rep.Degenerate = append(rep.Degenerate, ref)
+			continue
+		}
+		vectors[id] = vec
+	}
+	// cluster near-duplicates with union-find over nearest neighbours, only
+	// ever joining entries of the same namespace, scope and LLM string: the
+	// same answer stored for another tenant or model is no duplicate
+	parent := map[int64]int64{}
+	var find func(int64) int64
+	find = func(id int64) int64 {
+		p, ok := parent[id]
+		if !ok || p == id {
+			return id
+		}
+		root := find(p)
+		parent[id] = root
+		return root
+	}
+	for _, id := range ids {
+		vec, ok := vectors[id]
+		if !ok {
+			continue
+		}
+		key, filters := duplicatePartition(entries[id])
+		var near []int64
+		var scores []float64
+		var err error
+		if len(filters) > 0 && s.filtersPushedDown() {
+			near, scores, err = s.backend.(store.FilteredSearcher).SearchByVectorFiltered(ctx, vec, 5, filters)
+		} else {
+			near, scores, err = s.store.SearchByVector(ctx, vec, 5)
+		}
+		if err != nil {
+			continue
+		}
+		for i, other := range near {
+			if other == id || scores[i] < dupScore {
+				continue
+			}
+			if _, ok := vectors[other]; !ok {
+				continue
+			}
+			if k, _ := duplicatePartition(entries[other]); k != key {
+				continue
+			}
+			a, b := find(id), find(other)
+			if a != b {
+				parent[b] = a
+			}
+		}
+	}
+	clusters := map[int64][]garbageEntry{}
+	for _, id := range ids {
+		if _, ok := vectors[id]; !ok {
+			continue
+		}
+		root := find(id)
+		e := entries[id]
+		clusters[root] = append(clusters[root], garbageEntry{ID: id, Prompt: e.Prompt, CreatedAt: e.CreatedAt})
+	}
+	for _, c := range clusters {
+		if len(c) > 1 {
+			rep.Duplicates = append(rep.Duplicates, c)
+		}
+	}
+	sort.Slice(rep.Duplicates, func(i, j int) bool { return rep.Duplicates[i][0].ID < rep.Duplicates[j][0].ID })
+	return rep
+}
+
+// duplicatePartition returns the namespace, scope and LLM string of e, as a
+// key and as the filters matching them, which leave out those e has none of.
+func duplicatePartition(e *models.Entry) (string, map[string]string) {
+	filters := map[string]string{}
+	if ns := e.Namespace(); ns != models.DefaultNamespace {
+		filters[models.MetaNamespace] = ns
+	}
+	if scope := e.ScopeHash(); scope != "" {
+		filters[models.MetaScope] = scope
+	}
+	llm, _ := e.Metadata[models.MetaLLMString].(string)
+	if llm != "" {
+		filters[models.MetaLLMString] = llm
+	}
+	return e.Namespace() + "\x00" + e.ScopeHash() + "\x00" + llm, filters
+}
+
+// cleanupGarbage deletes the report's entries in the given categories. Each
+// duplicate cluster keeps its most-hit member (the oldest on ties); pinned
+// entries are never deleted.
+func (s *Server) cleanupGarbage(ctx context.Context, rep *garbageReport, categories []string) {
+	del := func(id int64, reason string) {
+		if e, err := s.store.GetEntry(ctx, id); err == nil && e.Flag(models.MetaPinned) {
+			return
+		}
+		if err := s.store.DeleteEntry(ctx, id); err == nil {
+			rep.Deleted = append(rep.Deleted, id)
+			garbageDeleted.Inc(reason)
+		}
+	}
+	for _, c := range categories {
+		switch c {
+		case garbageDegenerate:
+			for _, g := range rep.Degenerate {
+				del(g.ID, c)
+			}
+		case garbageNeverHit:
+			for _, g := range rep.NeverHit {
+				del(g.ID, c)
+			}
+		case garbageDuplicate:
+			for _, cluster := range rep.Duplicates {
+				keep := 0
+				hits := make([]int64, len(cluster))
+				for i, g := range cluster {
+					if e, err := s.store.GetEntry(ctx, g.ID); err == nil {
+						hits[i] = s.hits.total(e)
+					}
+					if hits[i] > hits[keep] || (hits[i] == hits[keep] && g.ID < cluster[keep].ID) {
+						keep = i
+					}
+				}
+				for i, g := range cluster {
+					if i != keep {
+						del(g.ID, c)
+					}
+				}
+			}
+		}
+	}
+}
+
+// garbageCleanupPolicy parses SLC_GARBAGE_CLEANUP (comma-separated
+// categories). Empty means report only.
+func garbageCleanupPolicy() []string {
+	return splitCategories(config.Get("SLC_GARBAGE_CLEANUP"))
+}
+
+func splitCategories(v string) []string {
+	var out []string
+	for _, c := range strings.Split(v, ",") {
+		switch c = strings.TrimSpace(c); c {
+		case garbageNeverHit, garbageDuplicate, garbageDegenerate:
+			out = append(out, c)
+		case "":
+		default:
+			log.Printf("server: ignoring unknown garbage category %q", c)
+		}
+	}
+	return out
+}
+
+// GET  /admin/garbage                          -> report
+// POST /admin/garbage?cleanup=degenerate,...   -> report and delete the listed categories
+func (s *Server) handleGarbage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rep := s.analyzeGarbage(r.Context(), time.Now())
+	if r.Method == http.MethodPost {
+		s.cleanupGarbage(r.Context(), rep, splitCategories(r.URL.Query().Get("cleanup")))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// collectGarbage is the periodic cleanup run by the janitor leader.
+func (s *Server) collectGarbage(ctx context.Context) {
+	policy := garbageCleanupPolicy()
+	if len(policy) == 0 {
+		return
+	}
+	rep := s.analyzeGarbage(ctx, time.Now())
+	s.cleanupGarbage(ctx, rep, policy)
+	if len(rep.Deleted) > 0 {
+		log.Printf("server: garbage cleanup removed %d entries", len(rep.Deleted))
+	}
+}
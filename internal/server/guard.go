@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+)
+
+var (
+	degenerateVectors = metrics.NewCounter("slmcache_degenerate_vectors_total",
+		"Embeddings that were zero-norm, empty or non-finite after retries, by stage and reason.", "stage", "reason")
+	embedLatency = metrics.NewHistogram("slmcache_embed_duration_seconds",
+		"Time the SLM took to embed a prompt, by stage.", nil, "stage")
+)
+
+// errDegenerate is returned when the SLM keeps producing vectors that can
+// never match anything. Such vectors used to be stored silently.
+var errDegenerate = errors.New("degenerate embedding")
+
+// Embedding stages, used as the metric label.
+const (
+	stageInsert = "insert"
+	stageQuery  = "query"
+)
+
+// embed embeds prompt and guards against degenerate vectors, retrying up to
+// SLC_EMBED_RETRIES times (default 1) since failed remote embeds can return
+// zeros transiently. Embeds wait their turn at the embed gate by the
+// priority of ctx.
+func (s *Server) embed(ctx context.Context, prompt, stage string) ([]float64, error) {
+	if !s.embedGate.acquire(ctx, priorityFrom(ctx), -1) {
+		return nil, errEmbed
+	}
+	defer s.embedGate.release()
+	retries := intFromEnv("SLC_EMBED_RETRIES", 1)
+	var reason string
+	for attempt := 0; attempt <= retries; attempt++ {
+		start := time.Now()
+		vec, err := s.getSLM().Embed(prompt)
+		embedLatency.Observe(time.Since(start).Seconds(), stage)
+		if err != nil {
+			return nil, errEmbed
+		}
+		if reason = degenerateReason(vec); reason == "" {
+			return vec, nil
+		}
+	}
+	degenerateVectors.Inc(stage, reason)
+	return nil, fmt.Errorf("%w: %s", errDegenerate, reason)
+}
+
+// embedError writes the HTTP error for a failed embed.
+func embedError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDegenerate) {
+		http.Error(w, err.Error()+"; check the prompt and the SLM backend", http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, errNoImageModel) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	http.Error(w, "embed error", http.StatusInternalServerError)
+}
+
+// degenerateReason explains why vec can never produce a meaningful match,
+// or returns "" for a healthy vector.
+func degenerateReason(vec []float64) string {
+	if len(vec) == 0 {
+		return "empty vector"
+	}
+	var norm float64
+	for _, x := range vec {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return "non-finite component"
+		}
+		norm += x * x
+	}
+	if math.Sqrt(norm) < 1e-6 {
+		return "zero norm"
+	}
+	return ""
+}
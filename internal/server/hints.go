@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// decisionHeader carries the cache decision of a lookup, so load balancer
+// logs, service meshes and other HTTP tooling can see hit behaviour without
+// parsing bodies: "HIT; score=0.91; id=42; age=3600; tier=l2", or "MISS".
+const decisionHeader = "X-SLMCache"
+
+// setDecision describes the best match of a lookup, e (nil on a miss),
+// answered by tier, in the decision header.
+func setDecision(w http.ResponseWriter, e *models.Entry, tier string) {
+	if e == nil {
+		w.Header().Set(decisionHeader, "MISS")
+		return
+	}
+	parts := []string{"HIT", "score=" + strconv.FormatFloat(e.Score, 'f', 2, 64)}
+	if e.ID != 0 {
+		parts = append(parts, "id="+strconv.FormatInt(e.ID, 10))
+	}
+	if written := entryWritten(e); !written.IsZero() {
+		parts = append(parts, "age="+strconv.FormatInt(int64(time.Since(written).Seconds()), 10))
+	}
+	if tier != "" {
+		parts = append(parts, "tier="+tier)
+	}
+	if e.Variant != "" {
+		parts = append(parts, "variant="+e.Variant)
+	}
+	if e.Region != "" {
+		parts = append(parts, "region="+e.Region)
+	}
+	w.Header().Set(decisionHeader, strings.Join(parts, "; "))
+}
+
+// setSearchDecision sets the decision header for the results of a search,
+// listing the stages its budget skipped, "MISS; skipped=embed,lexical", or
+// the rule that made it uncacheable, "MISS; uncacheable=clock".
+func setSearchDecision(w http.ResponseWriter, res *searchResult) {
+	if len(res.Entries) == 0 {
+		setDecision(w, nil, "")
+	} else {
+		setDecision(w, res.Entries[0], res.Tier)
+	}
+	if len(res.Skipped) > 0 {
+		w.Header().Set(decisionHeader, w.Header().Get(decisionHeader)+"; skipped="+strings.Join(res.Skipped, ","))
+	}
+	if res.Uncacheable != "" {
+		w.Header().Set(decisionHeader, w.Header().Get(decisionHeader)+"; uncacheable="+res.Uncacheable)
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// hitStat is what the server knows about how often an entry was served.
+type hitStat struct {
+	Count   int64
+	LastHit time.Time
+}
+
+// hitTracker counts search hits per entry since the process started. It is
+// kept in memory so serving a hit never costs a store write; stores that
+// keep hit statistics get the counts in batches, from pending.
+type hitTracker struct {
+	mu      sync.Mutex
+	started time.Time
+	stats   map[int64]*hitStat
+	// pending holds the hits not recorded in the store yet; nil when the
+	// store doesn't keep statistics.
+	pending map[int64]store.Hits
+}
+
+func newHitTracker() *hitTracker {
+	return &hitTracker{started: time.Now(), stats: make(map[int64]*hitStat)}
+}
+
+func (h *hitTracker) record(id int64, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.stats[id]
+	if !ok {
+		st = &hitStat{}
+		h.stats[id] = st
+	}
+	st.Count++
+	st.LastHit = at
+	if h.pending != nil {
+		p := h.pending[id]
+		p.Count++
+		p.Last = at
+		h.pending[id] = p
+	}
+}
+
+func (h *hitTracker) get(id int64) hitStat {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if st, ok := h.stats[id]; ok {
+		return *st
+	}
+	return hitStat{}
+}
+
+// total is how often e was served: its recorded hit_count plus the hits
+// not flushed yet or, when the store keeps no statistics, the hits since
+// the process started.
+func (h *hitTracker) total(e *models.Entry) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending == nil {
+		if st, ok := h.stats[e.ID]; ok {
+			return st.Count
+		}
+		return 0
+	}
+	return e.HitCount + h.pending[e.ID].Count
+}
+
+// persist starts keeping the hits the store hasn't recorded.
+func (h *hitTracker) persist() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending == nil {
+		h.pending = make(map[int64]store.Hits)
+	}
+}
+
+// drain returns the pending hits and starts over.
+func (h *hitTracker) drain() map[int64]store.Hits {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := h.pending
+	if len(out) > 0 {
+		h.pending = make(map[int64]store.Hits)
+	}
+	return out
+}
+
+// restore puts back hits a flush failed to record.
+func (h *hitTracker) restore(hits map[int64]store.Hits) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, old := range hits {
+		p := h.pending[id]
+		p.Count += old.Count
+		if old.Last.After(p.Last) {
+			p.Last = old.Last
+		}
+		h.pending[id] = p
+	}
+}
+
+func (h *hitTracker) onChange(c change) {
+	if c.kind != changeDeleted && c.kind != changeCreated {
+		return
+	}
+	h.mu.Lock()
+	delete(h.stats, c.id)
+	delete(h.pending, c.id)
+	h.mu.Unlock()
+}
+
+// recordHits adds hits to the entries' statistics and journals the
+// entries. Like a serve count, observers aren't told.
+func (o *observedStore) recordHits(ctx context.Context, hits map[int64]store.Hits) error {
+	hr, ok := o.Store.(store.HitRecorder)
+	if !ok {
+		return nil
+	}
+	o.gate.RLock()
+	defer o.gate.RUnlock()
+	if err := hr.RecordHits(ctx, hits); err != nil {
+		return err
+	}
+	for id := range hits {
+		o.record(ctx, id, false)
+	}
+	return nil
+}
+
+// flushHits records the hits counted since the last flush in the store.
+// Hits it refuses, such as while it is unreachable or on a cluster
+// follower, are kept for the next flush.
+func (s *Server) flushHits(ctx context.Context) {
+	hits := s.hits.drain()
+	if len(hits) == 0 {
+		return
+	}
+	if err := s.observed.recordHits(ctx, hits); err != nil {
+		s.hits.restore(hits)
+		if !errors.Is(err, store.ErrUnavailable) {
+			log.Printf("server: record hits: %v", err)
+		}
+	}
+}
+
+// startHitFlush flushes the hits to stores that keep them every
+// SLC_HIT_FLUSH_INTERVAL (default 30s), and once more on Close. Every
+// replica counts its own hits, so this doesn't use startLoop's lease.
+func (s *Server) startHitFlush() {
+	if _, ok := s.backend.(store.HitRecorder); !ok {
+		return
+	}
+	s.hits.persist()
+	interval := durationFromEnv("SLC_HIT_FLUSH_INTERVAL", 30*time.Second)
+	s.janitorWG.Add(1)
+	go func() {
+		defer s.janitorWG.Done()
+		// with no interval, hits are only flushed on Close
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-tick:
+				s.flushHits(context.Background())
+			case <-s.janitorStop:
+				s.flushHits(context.Background())
+				return
+			}
+		}
+	}()
+}
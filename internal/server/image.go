@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/slm"
+)
+
+// defaultImageMaxBytes bounds an uploaded image.
+const defaultImageMaxBytes = 5 << 20
+
+var (
+	// errNoImageModel is returned for an image upload when no backend can
+	// embed images.
+	errNoImageModel  = errors.New("no image embedding model; set SLM_IMAGE_URL")
+	errImageTooLarge = errors.New("image exceeds SLC_IMAGE_MAX_BYTES")
+)
+
+// imageEmbedder returns the SLM_IMAGE_URL service, or the SLM backend when
+// it embeds images itself (the mock does), or nil.
+func (s *Server) imageEmbedder() slm.ImageEmbedder {
+	if s.img != nil {
+		return s.img
+	}
+	ie, _ := s.getSLM().(slm.ImageEmbedder)
+	return ie
+}
+
+// imageWeight is the share of an image-conditioned match's score that
+// comes from the image (SLC_IMAGE_WEIGHT, default 0.5).
+func imageWeight() float64 {
+	w, err := strconv.ParseFloat(config.Get("SLC_IMAGE_WEIGHT"), 64)
+	if err != nil || w < 0 || w > 1 {
+		return 0.5
+	}
+	return w
+}
+
+// embedWithImage embeds prompt and, when image is set, combines it with
+// the image's embedding.
+func (s *Server) embedWithImage(ctx context.Context, prompt string, image []byte, stage string) ([]float64, error) {
+	vec, err := s.embed(ctx, prompt, stage)
+	if err != nil || image == nil {
+		return vec, err
+	}
+	ie := s.imageEmbedder()
+	if ie == nil {
+		return nil, errNoImageModel
+	}
+	if !s.embedGate.acquire(ctx, priorityFrom(ctx), -1) {
+		return nil, errEmbed
+	}
+	iv, err := ie.EmbedImage(image)
+	s.embedGate.release()
+	if err != nil {
+		return nil, errEmbed
+	}
+	if reason := degenerateReason(iv); reason != "" {
+		degenerateVectors.Inc(stage, reason)
+		return nil, fmt.Errorf("%w: image %s", errDegenerate, reason)
+	}
+	return slm.CombineImage(vec, iv, imageWeight()), nil
+}
+
+// embedEntry embeds e for storage, recording the hash of its image in
+// metadata.image (and dropping a client-set one from text-only entries) and
+// the model that embedded it.
+func (s *Server) embedEntry(ctx context.Context, e *models.Entry, image []byte, stage string) ([]float64, error) {
+	embedder := embedderOf(s.getSLM())
+	vec, err := s.embedWithImage(ctx, e.Prompt, image, stage)
+	if err != nil {
+		return nil, err
+	}
+	e.Embedder = embedder
+	switch {
+	case image != nil:
+		if e.Metadata == nil {
+			e.Metadata = map[string]interface{}{}
+		}
+		sum := sha256.Sum256(image)
+		e.Metadata[models.MetaImage] = hex.EncodeToString(sum[:])
+	case e.Metadata != nil:
+		delete(e.Metadata, models.MetaImage)
+	}
+	return vec, nil
+}
+
+func isMultipart(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "multipart/form-data"
+}
+
+// readImage parses a multipart/form-data request and returns its image
+// field, or nil when the request isn't multipart or has no image.
+func readImage(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if !isMultipart(r) {
+		return nil, nil
+	}
+	limit := int64(intFromEnv("SLC_IMAGE_MAX_BYTES", defaultImageMaxBytes))
+	// leave room for the other fields
+	r.Body = http.MaxBytesReader(w, r.Body, limit+64<<10)
+	if err := r.ParseMultipartForm(limit); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errImageTooLarge
+		}
+		return nil, err
+	}
+	f, hdr, err := r.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if hdr.Size > limit {
+		return nil, errImageTooLarge
+	}
+	return io.ReadAll(f)
+}
+
+// decodeEntry reads an entry from a JSON body, or from the entry field of
+// a multipart one along with its image.
+func decodeEntry(w http.ResponseWriter, r *http.Request, e *models.Entry) ([]byte, error) {
+	if !isMultipart(r) {
+		return nil, json.NewDecoder(r.Body).Decode(e)
+	}
+	image, err := readImage(w, r)
+	if err != nil {
+		return nil, err
+	}
+	return image, json.Unmarshal([]byte(r.FormValue("entry")), e)
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/events"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// newIngestConsumer builds the queue consumer configured by SLC_INGEST
+// (nats or kafka), or returns nil when it is unset. SLC_INGEST_URL is the
+// NATS server URL or comma-separated Kafka brokers, SLC_INGEST_TOPIC the
+// subject or topic, and SLC_INGEST_GROUP (default slmcache) the durable
+// consumer or consumer group the replicas share. Messages that fail
+// SLC_INGEST_MAX_ATTEMPTS times (default 5) go to SLC_INGEST_DLQ (default
+// the topic plus ".dlq").
+func (s *Server) newIngestConsumer(ctx context.Context) (events.Consumer, error) {
+	kind := config.Get("SLC_INGEST")
+	topic := config.Get("SLC_INGEST_TOPIC")
+	url := config.Get("SLC_INGEST_URL")
+	group := config.Get("SLC_INGEST_GROUP")
+	if group == "" {
+		group = "slmcache"
+	}
+	dlq := config.Get("SLC_INGEST_DLQ")
+	if dlq == "" {
+		dlq = topic + ".dlq"
+	}
+	retries := events.RetryPolicy{
+		MaxAttempts: intFromEnv("SLC_INGEST_MAX_ATTEMPTS", 5),
+		Backoff:     durationFromEnv("SLC_INGEST_BACKOFF", time.Second),
+	}
+	switch kind {
+	case "nats":
+		return events.NewNATSConsumer(ctx, url, topic, group, dlq, retries)
+	case "kafka":
+		return events.NewKafkaConsumer(strings.Split(url, ","), topic, group, dlq, retries)
+	}
+	return nil, fmt.Errorf("unknown SLC_INGEST %q (want nats or kafka)", kind)
+}
+
+// startIngest runs the queue consumer until Close, reconnecting with
+// backoff when it fails.
+func (s *Server) startIngest() {
+	if config.Get("SLC_INGEST") == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(withPriority(context.Background(), priorityLow))
+	s.janitorWG.Add(2)
+	go func() {
+		defer s.janitorWG.Done()
+		<-s.janitorStop
+		cancel()
+	}()
+	go func() {
+		defer s.janitorWG.Done()
+		wait := time.Second
+		for ctx.Err() == nil {
+			c, err := s.newIngestConsumer(ctx)
+			if err == nil {
+				log.Printf("server: ingesting from %s %s", config.Get("SLC_INGEST"), config.Get("SLC_INGEST_TOPIC"))
+				err = c.Run(ctx, s.ingest)
+				_ = c.Close()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("server: ingest consumer stopped, restarting in %s: %v", wait, err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+			wait = min(2*wait, time.Minute)
+		}
+	}()
+}
+
+// ingest stores one consumed entry, a JSON object shaped like the body of
+// POST /entries. Messages that can never be stored fail permanently; the
+// rest are retried. A redelivered message replaces the entry its first
+// delivery stored rather than adding a duplicate.
+func (s *Server) ingest(ctx context.Context, value []byte) error {
+	var e models.Entry
+	if err := json.Unmarshal(value, &e); err != nil {
+		return fmt.Errorf("%w: %v", events.ErrPermanent, err)
+	}
+	if e.Prompt == "" {
+		return fmt.Errorf("%w: prompt required", events.ErrPermanent)
+	}
+	if err := e.Provenance.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", events.ErrPermanent, err)
+	}
+	if err := checkReserved(&e); err != nil {
+		return fmt.Errorf("%w: %v", events.ErrPermanent, err)
+	}
+	if err := admitQuality(&e, "ingest"); err != nil {
+		return fmt.Errorf("%w: %v", events.ErrPermanent, err)
+	}
+	if err := s.admitUncacheable(&e); err != nil {
+		return fmt.Errorf("%w: %v", events.ErrPermanent, err)
+	}
+	if err := s.admitThrash(&e, "ingest"); err != nil {
+		return fmt.Errorf("%w: %v", events.ErrPermanent, err)
+	}
+	s.classify(ctx, &e)
+	if err := initialState(&e); err != nil {
+		return fmt.Errorf("%w: %v", events.ErrPermanent, err)
+	}
+	bindScope(&e)
+	vec, err := s.embedEntry(ctx, &e, nil, stageInsert)
+	if errors.Is(err, errDegenerate) {
+		return fmt.Errorf("%w: %v", events.ErrPermanent, err)
+	}
+	if err != nil {
+		return err
+	}
+	// unlike a copy's, an ingested response is new and may be summarized
+	existing, err := s.findSynced(ctx, &e, vec)
+	if err == nil && existing != nil {
+		err = s.updateEntry(ctx, existing.ID, existing, &e, vec)
+	} else if err == nil {
+		_, err = s.createEntry(ctx, &e, vec)
+	}
+	if errors.Is(err, errUndeclaredNamespace) {
+		return fmt.Errorf("%w: %v", events.ErrPermanent, err)
+	}
+	return err
+}
+
+// storeOnce creates e, or replaces the entry with the same sync key if one
+// exists, and reports which.
+func (s *Server) storeOnce(ctx context.Context, e *models.Entry, vec []float64) (id int64, replaced bool, err error) {
+	existing, err := s.findSynced(ctx, e, vec)
+	if err != nil {
+		return 0, false, err
+	}
+	if existing != nil {
+		return existing.ID, true, s.store.UpdateEntryWithVector(ctx, existing.ID, e, vec)
+	}
+	id, err = s.store.CreateEntryWithVector(ctx, e, vec)
+	return id, false, err
+}
+
+// findSynced returns the entry with e's sync key, nil when there is none.
+// The same prompt embeds to the same vector, so such an entry is among
+// vec's nearest neighbours.
+func (s *Server) findSynced(ctx context.Context, e *models.Entry, vec []float64) (*models.Entry, error) {
+	key := syncKey(e)
+	ids, _, err := s.store.SearchByVector(ctx, vec, 5)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if existing, err := s.store.GetEntry(ctx, id); err == nil && syncKey(existing) == key {
+			return existing, nil
+		}
+	}
+	return nil, nil
+}
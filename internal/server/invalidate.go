@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+type invalidateRequest struct {
+	// Prompt is embedded to find the entries to invalidate; Vector may be
+	// sent instead when the caller already has an embedding.
+	Prompt string    `json:"prompt,omitempty"`
+	Vector []float64 `json:"vector,omitempty"`
+	// Radius is the cosine distance (1 - similarity) around the query within
+	// which entries are invalidated.
+	Radius   *float64          `json:"radius,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Action is "delete" (default) or "stale".
+	Action string `json:"action,omitempty"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+type invalidateResponse struct {
+	Action  string    `json:"action"`
+	Matched int       `json:"matched"`
+	IDs     []int64   `json:"ids"`
+	Scores  []float64 `json:"scores"`
+	DryRun  bool      `json:"dry_run,omitempty"`
+}
+
+const defaultInvalidateRadius = 0.2
+
+// POST /invalidate
+func (s *Server) handleInvalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req invalidateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request: expected JSON {prompt|vector,radius?,metadata?,action?}; "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Prompt == "" && len(req.Vector) == 0 {
+		http.Error(w, "prompt or vector required", http.StatusBadRequest)
+		return
+	}
+	if req.Action == "" {
+		req.Action = "delete"
+	}
+	if req.Action != "delete" && req.Action != "stale" {
+		http.Error(w, "action must be delete or stale", http.StatusBadRequest)
+		return
+	}
+	radius := defaultInvalidateRadius
+	if req.Radius != nil {
+		radius = *req.Radius
+	}
+	if radius < 0 || radius > 2 {
+		http.Error(w, "radius must be between 0 and 2", http.StatusBadRequest)
+		return
+	}
+	vec := req.Vector
+	if len(vec) == 0 {
+		var err error
+		if vec, err = s.embed(r.Context(), req.Prompt, stageQuery); err != nil {
+			embedError(w, err)
+			return
+		}
+	} else if reason := degenerateReason(vec); reason != "" {
+		degenerateVectors.Inc(stageQuery, reason)
+		http.Error(w, "degenerate vector: "+reason, http.StatusUnprocessableEntity)
+		return
+	}
+	ctx := r.Context()
+	ids, scores, err := s.store.SearchByVector(ctx, vec, len(s.store.AllIDs()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := invalidateResponse{Action: req.Action, IDs: []int64{}, Scores: []float64{}, DryRun: req.DryRun}
+	for i, id := range ids {
+		if 1-scores[i] > radius {
+			continue
+		}
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil || !matchesFilters(e, req.Metadata) {
+			continue
+		}
+		if !req.DryRun {
+			if req.Action == "stale" {
+				err = s.store.UpdateEntryMetadata(ctx, id, map[string]interface{}{models.MetaStale: true}, false)
+			} else {
+				err = s.store.DeleteEntry(ctx, id)
+			}
+			if err != nil {
+				continue
+			}
+		}
+		resp.IDs = append(resp.IDs, id)
+		resp.Scores = append(resp.Scores, scores[i])
+	}
+	resp.Matched = len(resp.IDs)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
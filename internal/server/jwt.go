@@ -0,0 +1,406 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+)
+
+var jwksClient = &http.Client{Timeout: 5 * time.Second}
+
+// jwtVerifier validates bearer JWTs issued by an OIDC provider and maps
+// their claims to a role and namespaces. The provider's signing keys are
+// cached and refetched every SLC_JWT_JWKS_REFRESH, or sooner when a token
+// names a key the cache doesn't have (rotation). A nil *jwtVerifier means
+// JWTs are not accepted.
+type jwtVerifier struct {
+	issuer    string
+	audience  string
+	jwksURL   string
+	roleClaim string
+	nsClaim   string
+	roleMap   map[string]string // claim value -> role
+	leeway    time.Duration
+	refresh   time.Duration
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey // by kid
+	fetched  time.Time
+	fetching *jwksFetch // the fetch in flight, nil when none
+}
+
+// jwksFetch is a key set fetch that concurrent verifications wait on
+// rather than each fetching it.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// minJWKSRefetch rate-limits refetches triggered by unknown key IDs.
+const minJWKSRefetch = time.Minute
+
+// newJWTVerifier returns a verifier when SLC_JWT_ISSUER or SLC_JWT_JWKS_URL
+// is set. Without SLC_JWT_JWKS_URL the key set is found through the
+// issuer's OIDC discovery document.
+func newJWTVerifier() *jwtVerifier {
+	issuer := strings.TrimRight(config.Get("SLC_JWT_ISSUER"), "/")
+	jwksURL := config.Get("SLC_JWT_JWKS_URL")
+	if issuer == "" && jwksURL == "" {
+		return nil
+	}
+	v := &jwtVerifier{
+		issuer:    issuer,
+		audience:  config.Get("SLC_JWT_AUDIENCE"),
+		jwksURL:   jwksURL,
+		roleClaim: config.Get("SLC_JWT_ROLE_CLAIM"),
+		nsClaim:   config.Get("SLC_JWT_NAMESPACE_CLAIM"),
+		roleMap:   map[string]string{},
+		leeway:    durationFromEnv("SLC_JWT_LEEWAY", time.Minute),
+		refresh:   durationFromEnv("SLC_JWT_JWKS_REFRESH", time.Hour),
+	}
+	if v.roleClaim == "" {
+		v.roleClaim = "slmcache_role"
+	}
+	if v.nsClaim == "" {
+		v.nsClaim = "slmcache_namespaces"
+	}
+	for _, item := range strings.Split(config.Get("SLC_JWT_ROLE_MAP"), ",") {
+		if value, role, ok := strings.Cut(strings.TrimSpace(item), "="); ok {
+			v.roleMap[value] = role
+		}
+	}
+	return v
+}
+
+func (s *Server) getJWT() *jwtVerifier {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.jwt
+}
+
+// looksLikeJWT tells a compact JWS apart from a static API key.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verify checks token's signature, issuer, audience and validity window and
+// returns the principal its claims grant.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if v.issuer != "" && strings.TrimRight(toString(claims["iss"]), "/") != v.issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if v.audience != "" && !contains(claimStrings(claims["aud"]), v.audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return v.principal(claims)
+}
+
+// principal maps claims to a role and namespaces. The role claim may hold
+// several values (e.g. IdP groups), translated through SLC_JWT_ROLE_MAP when
+// set; the highest role wins. A token without the namespace claim may use
+// every namespace, and slmcache_priority sets its default priority.
+func (v *jwtVerifier) principal(claims map[string]interface{}) (*principal, error) {
+	p := &principal{id: "jwt:" + toString(claims["sub"])}
+	for _, value := range claimStrings(claims[v.roleClaim]) {
+		role := value
+		if len(v.roleMap) > 0 {
+			role = v.roleMap[value]
+		}
+		if roleRank[role] > roleRank[p.role] {
+			p.role = role
+		}
+	}
+	if p.role == "" {
+		return nil, errors.New("token grants no role")
+	}
+	if prio, ok := parsePriority(toString(claims["slmcache_priority"])); ok {
+		p.priority = &prio
+	}
+	if raw, ok := claims[v.nsClaim]; ok {
+		p.namespaces = map[string]bool{}
+		for _, ns := range claimStrings(raw) {
+			p.namespaces[ns] = true
+		}
+	}
+	return p, nil
+}
+
+// key returns the signing key kid, refetching the key set when it is due or
+// doesn't have kid. The fetch runs outside v.mu, once for every
+// verification waiting on it.
+func (v *jwtVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	since := time.Since(v.fetched)
+	k, ok := v.keys[kid]
+	if v.keys != nil && since <= v.refresh && (ok || since <= minJWKSRefetch) {
+		v.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return k, nil
+	}
+	call := v.fetching
+	if call == nil {
+		call = &jwksFetch{done: make(chan struct{})}
+		v.fetching, v.fetched = call, time.Now()
+		jwksURL := v.jwksURL
+		v.mu.Unlock()
+		// the fetch is shared, so one caller going away mustn't fail it
+		keys, jwksURL, err := v.fetch(context.WithoutCancel(ctx), jwksURL)
+		v.mu.Lock()
+		if err == nil {
+			v.keys, v.jwksURL = keys, jwksURL
+		}
+		call.err, v.fetching = err, nil
+		close(call.done)
+	} else {
+		v.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		v.mu.Lock()
+	}
+	// a failed fetch keeps the keys already cached
+	k, ok = v.keys[kid]
+	cached := v.keys != nil
+	v.mu.Unlock()
+	if !cached {
+		return nil, call.err
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return k, nil
+}
+
+// fetch loads the JWKS from jwksURL, discovering the URL from the issuer
+// first when it is empty, and returns it with the URL.
+func (v *jwtVerifier) fetch(ctx context.Context, jwksURL string) (map[string]crypto.PublicKey, string, error) {
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, "", fmt.Errorf("oidc discovery: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, "", errors.New("oidc discovery: no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(ctx, jwksURL, &set); err != nil {
+		return nil, "", fmt.Errorf("jwks: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	return keys, jwksURL, nil
+}
+
+// jwk is a JSON Web Key; only RSA and EC signing keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := num(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := num(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifySignature checks a JWS signature for the RS* and ES* algorithms.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			hash = crypto.SHA256
+		case "384":
+			hash = crypto.SHA384
+		case "512":
+			hash = crypto.SHA512
+		}
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			break
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q doesn't match the signing key", alg)
+}
+
+func decodeSegment(seg string, out interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+func getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// claimStrings reads a claim that may be a string, a space-separated
+// string (OAuth scope style) or a list of strings.
+func claimStrings(v interface{}) []string {
+	switch c := v.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		out := make([]string, 0, len(c))
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// instanceID identifies this replica when competing for maintenance leases.
+// SLC_INSTANCE_ID overrides the generated host/pid based identifier (useful
+// with StatefulSet pod names).
+func instanceID() string {
+	if v := config.Get("SLC_INSTANCE_ID"); v != "" {
+		return v
+	}
+	host, _ := os.Hostname()
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("%s-%d-%x", host, os.Getpid(), b)
+}
+
+// isLeader reports whether this replica should run the named maintenance
+// loop. Stores that cannot grant leases are assumed to be private to this
+// process, so every caller is the leader.
+func (s *Server) isLeader(ctx context.Context, name string, ttl time.Duration) bool {
+	l, ok := s.backend.(store.Leaser)
+	if !ok {
+		return true
+	}
+	held, err := l.AcquireLease(ctx, name, s.instanceID, ttl)
+	if err != nil {
+		log.Printf("server: acquire %s lease: %v", name, err)
+		return false
+	}
+	s.leaseMu.Lock()
+	if held {
+		s.leases[name] = struct{}{}
+	} else {
+		delete(s.leases, name)
+	}
+	s.leaseMu.Unlock()
+	return held
+}
+
+// releaseLeases hands any held maintenance leases back so another replica
+// can take over without waiting for them to expire.
+func (s *Server) releaseLeases() {
+	l, ok := s.backend.(store.Leaser)
+	if !ok {
+		return
+	}
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	for name := range s.leases {
+		_ = l.ReleaseLease(context.Background(), name, s.instanceID)
+		delete(s.leases, name)
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/lexical"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// newAnalyzer builds the token fallback's analyzer. SLC_LEXICAL_LANGUAGE
+// selects the stemmer (english, the default, or none) and
+// SLC_LEXICAL_STOPWORDS replaces the built-in English stopwords with a
+// comma-separated list, or drops none when set to "none".
+// SLC_LEXICAL_FUZZINESS is the typo tolerance: auto (the default), 0, 1 or 2
+// edits.
+func newAnalyzer() lexical.Analyzer {
+	a := lexical.Analyzer{Fuzziness: lexical.Auto}
+	switch v := strings.ToLower(config.Get("SLC_LEXICAL_FUZZINESS")); v {
+	case "", "auto":
+	case "0", "1", "2":
+		a.Fuzziness = int(v[0] - '0')
+	default:
+		log.Printf("server: ignoring SLC_LEXICAL_FUZZINESS %q, expected auto, 0, 1 or 2", v)
+	}
+	switch lang := strings.ToLower(config.Get("SLC_LEXICAL_LANGUAGE")); lang {
+	case "":
+		a.Stem = lexical.StemEnglish
+	case "none":
+	default:
+		if a.Stem = lexical.Languages[lang]; a.Stem == nil {
+			log.Printf("server: unknown SLC_LEXICAL_LANGUAGE %q, not stemming", lang)
+		}
+	}
+	words := lexical.EnglishStopwords
+	switch v := config.Get("SLC_LEXICAL_STOPWORDS"); v {
+	case "":
+	case "none":
+		words = nil
+	default:
+		words = lexical.Words(v)
+	}
+	a.Stopwords = make(map[string]bool, len(words))
+	for _, w := range words {
+		a.Stopwords[w] = true
+	}
+	return a
+}
+
+func (s *Server) getAnalyzer() lexical.Analyzer {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.analyzer
+}
+
+// lexicalTerms are the terms of text the token fallback compares: its
+// words with namespace ns's synonyms applied, without stopwords, stemmed.
+func (s *Server) lexicalTerms(ns, text string) []string {
+	return s.getAnalyzer().Terms(s.synonymTokens(ns, lexical.Words(text)))
+}
+
+// lexIndex is the token fallback's trigram index over entry prompts. It is
+// kept current by store changes made through this server and rebuilt when
+// it goes stale (the analyzer or synonyms changed, a restore replaced the
+// store) and every SLC_LEXICAL_REINDEX, which picks up writes made through
+// other replicas.
+type lexIndex struct {
+	mu  sync.RWMutex
+	idx *lexical.Index
+	// dirty entries changed metadata, so their namespace and with it their
+	// synonyms may have changed; they are re-read before the next search.
+	dirty map[int64]struct{}
+	// staleGen counts invalidations and builtGen the one the index was last
+	// built for.
+	staleGen, builtGen int
+	// pending replays the changes made while a rebuild runs on the new index.
+	building bool
+	pending  []func(*lexical.Index)
+}
+
+func newLexIndex() *lexIndex {
+	return &lexIndex{idx: lexical.NewIndex(), dirty: map[int64]struct{}{}, staleGen: 1}
+}
+
+// apply runs fn on the index, and on the one being rebuilt.
+func (l *lexIndex) apply(fn func(*lexical.Index)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fn(l.idx)
+	if l.building {
+		l.pending = append(l.pending, fn)
+	}
+}
+
+// invalidate schedules a rebuild before the next search.
+func (l *lexIndex) invalidate() {
+	l.mu.Lock()
+	l.staleGen++
+	l.mu.Unlock()
+}
+
+func (l *lexIndex) stale() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.builtGen != l.staleGen
+}
+
+// onLexicalChange keeps the index consistent with the store.
+func (s *Server) onLexicalChange(c change) {
+	switch c.kind {
+	case changeCreated, changeUpdated:
+		if c.entry == nil {
+			return
+		}
+		terms := s.entryTerms(c.entry)
+		s.lexicon.apply(func(x *lexical.Index) { x.Add(c.id, terms) })
+	case changeDeleted:
+		s.lexicon.apply(func(x *lexical.Index) { x.Remove(c.id) })
+	case changeMetadata:
+		s.lexicon.mu.Lock()
+		s.lexicon.dirty[c.id] = struct{}{}
+		s.lexicon.mu.Unlock()
+	}
+}
+
+// entryTerms returns the terms e's prompt is indexed under; none for an
+// encrypted entry, whose prompt is a hash.
+func (s *Server) entryTerms(e *models.Entry) []string {
+	if e.Flag(models.MetaEncrypted) {
+		return nil
+	}
+	return s.lexicalTerms(e.Namespace(), e.Prompt)
+}
+
+// reindex rebuilds the index from every entry in the store. Changes made
+// meanwhile are replayed onto the new index before it replaces the old.
+func (s *Server) reindex(ctx context.Context) {
+	l := s.lexicon
+	if !store.Available(s.backend) {
+		return
+	}
+	l.mu.Lock()
+	if l.building {
+		l.mu.Unlock()
+		return
+	}
+	l.building, l.pending = true, nil
+	gen := l.staleGen
+	l.mu.Unlock()
+
+	next := lexical.NewIndex()
+	for _, id := range s.backend.AllIDs() {
+		if e, err := s.backend.GetEntry(ctx, id); err == nil {
+			next.Add(id, s.entryTerms(e))
+		}
+	}
+	l.mu.Lock()
+	for _, fn := range l.pending {
+		fn(next)
+	}
+	l.idx, l.builtGen = next, gen
+	l.building, l.pending = false, nil
+	l.mu.Unlock()
+}
+
+// startReindex rebuilds the index every SLC_LEXICAL_REINDEX (default 5m,
+// 0 disables) on every replica.
+func (s *Server) startReindex() {
+	interval := durationFromEnv("SLC_LEXICAL_REINDEX", 5*time.Minute)
+	if interval <= 0 {
+		return
+	}
+	s.janitorWG.Add(1)
+	go func() {
+		defer s.janitorWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.reindex(withPriority(context.Background(), priorityLow))
+			case <-s.janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+// lexicalCandidates returns the IDs of the entries whose terms match every
+// term of the query, from the index.
+func (s *Server) lexicalCandidates(ctx context.Context, a lexical.Analyzer, terms []string) []int64 {
+	l := s.lexicon
+	if l.stale() {
+		s.reindex(ctx)
+	}
+	l.mu.Lock()
+	dirty := l.dirty
+	l.dirty = map[int64]struct{}{}
+	l.mu.Unlock()
+	for id := range dirty {
+		e, err := s.backend.GetEntry(ctx, id)
+		if err != nil {
+			continue
+		}
+		terms := s.entryTerms(e)
+		l.apply(func(x *lexical.Index) { x.Add(id, terms) })
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.idx.Search(terms, a)
+}
+
+// lexicalMatch reports whether every query term matches one of the
+// entry's terms.
+func lexicalMatch(a lexical.Analyzer, query, terms []string) bool {
+	for _, qt := range query {
+		if !slices.ContainsFunc(terms, func(t string) bool { return a.Match(qt, t) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// highlight marks the words of e's prompt that matched the query terms.
+func (s *Server) highlight(e *models.Entry, a lexical.Analyzer, terms []string) {
+	ns := e.Namespace()
+	prompt, offsets := a.Highlight(e.Prompt, terms, func(w string) []string { return s.synonymTokens(ns, []string{w}) })
+	e.Highlight = &models.Highlight{Prompt: prompt, Offsets: offsets}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// transitions lists the lifecycle states each state may move to. Drafts are
+// published after review; archived entries can be reopened as drafts.
+var transitions = map[string][]string{
+	models.StateDraft:     {models.StatePublished, models.StateArchived},
+	models.StatePublished: {models.StateArchived},
+	models.StateArchived:  {models.StateDraft},
+}
+
+func validTransition(from, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+var errArchived = errors.New("entry is archived; reopen it as a draft to edit it")
+
+// initialState rejects new entries claiming a lifecycle state other than
+// draft: publication only happens through POST /entries/{id}/state.
+func initialState(e *models.Entry) error {
+	if v, ok := e.Metadata[models.MetaState]; ok && v != models.StateDraft {
+		return fmt.Errorf("new entries may only set %s to %q", models.MetaState, models.StateDraft)
+	}
+	return nil
+}
+
+// keepState carries the lifecycle state of current over to e, which is
+// replacing it, and rejects replacements that would change the state or
+// edit an archived entry.
+func keepState(current, e *models.Entry) error {
+	if current.State() == models.StateArchived {
+		return errArchived
+	}
+	state, ok := current.Metadata[models.MetaState]
+	if v, set := e.Metadata[models.MetaState]; set && (!ok || v != state) {
+		return fmt.Errorf("%s changes through POST /entries/{id}/state", models.MetaState)
+	}
+	if ok {
+		if e.Metadata == nil {
+			e.Metadata = map[string]interface{}{}
+		}
+		e.Metadata[models.MetaState] = state
+	}
+	return nil
+}
+
+// POST /entries/{id}/state {"state": "published"}
+func (s *Server) handleEntryState(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request: expected JSON {state}", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	e, err := s.store.GetEntry(ctx, id)
+	if err != nil || s.expireIfNeeded(ctx, e) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	from := e.State()
+	if !validTransition(from, req.State) {
+		http.Error(w, fmt.Sprintf("cannot move a %s entry to %q", from, req.State), http.StatusConflict)
+		return
+	}
+	if err := s.store.UpdateEntryMetadata(ctx, id, map[string]interface{}{models.MetaState: req.State}, false); err != nil {
+		s.respondStoreError(w, err)
+		return
+	}
+	if e, err = s.store.GetEntry(ctx, id); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/schema"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var namespaceEvictions = metrics.NewCounter("slmcache_namespace_evictions_total",
+	"Entries evicted because their namespace held more than its max_entries.", "namespace")
+
+// errUndeclaredNamespace is returned by writes into a namespace that wasn't
+// declared while SLC_REQUIRE_NAMESPACES is set.
+var errUndeclaredNamespace = errors.New("namespace not declared; create it with POST /namespaces")
+
+// namespaceCache holds the declared namespaces with their TTLs parsed.
+// Stores implementing store.NamespaceStore persist them and the cache is
+// refreshed from there; other stores keep them on each instance only.
+type namespaceCache struct {
+	mu   sync.RWMutex
+	m    map[string]models.Namespace
+	ttls map[string]time.Duration
+}
+
+func (c *namespaceCache) get(name string) (models.Namespace, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ns, ok := c.m[name]
+	return ns, ok
+}
+
+// ttl is the TTL namespace name sets, 0 when it sets none.
+func (c *namespaceCache) ttl(name string) time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ttls[name]
+}
+
+func (c *namespaceCache) anyTTL() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.ttls) > 0
+}
+
+// all returns the namespaces ordered by name.
+func (c *namespaceCache) all() []models.Namespace {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]models.Namespace, 0, len(c.m))
+	for _, ns := range c.m {
+		out = append(out, ns)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (c *namespaceCache) set(list []models.Namespace) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = make(map[string]models.Namespace, len(list))
+	c.ttls = make(map[string]time.Duration)
+	for _, ns := range list {
+		c.putLocked(ns)
+	}
+}
+
+func (c *namespaceCache) put(ns models.Namespace) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m, c.ttls = map[string]models.Namespace{}, map[string]time.Duration{}
+	}
+	c.putLocked(ns)
+}
+
+func (c *namespaceCache) putLocked(ns models.Namespace) {
+	c.m[ns.Name] = ns
+	delete(c.ttls, ns.Name)
+	if d, err := time.ParseDuration(ns.TTL); err == nil && d > 0 {
+		c.ttls[ns.Name] = d
+	}
+}
+
+func (c *namespaceCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, name)
+	delete(c.ttls, name)
+}
+
+// namespaceDeclared reports whether entries may be written into ns: with
+// SLC_REQUIRE_NAMESPACES=true only the default namespace and declared ones
+// take writes.
+func (s *Server) namespaceDeclared(ns string) bool {
+	if config.Get("SLC_REQUIRE_NAMESPACES") != "true" || ns == models.DefaultNamespace {
+		return true
+	}
+	_, ok := s.namespaces.get(ns)
+	return ok
+}
+
+// namespaceSchema is the JSON Schema e's namespace declares, nil if none.
+func (s *Server) namespaceSchema(e *models.Entry) interface{} {
+	ns, _ := s.namespaces.get(e.Namespace())
+	return ns.Schema
+}
+
+// namespaceProfiles are the thresholds the declared namespaces set.
+func (s *Server) namespaceProfiles() []scoreProfile {
+	var out []scoreProfile
+	for _, ns := range s.namespaces.all() {
+		if ns.MinScore != nil {
+			out = append(out, scoreProfile{key: models.MetaNamespace, value: ns.Name, minScore: *ns.MinScore})
+		}
+	}
+	return out
+}
+
+// loadNamespaces refreshes the declared namespaces from the store.
+func (s *Server) loadNamespaces(ctx context.Context) {
+	ns, ok := s.backend.(store.NamespaceStore)
+	if !ok {
+		return
+	}
+	list, err := ns.Namespaces(ctx)
+	if err != nil {
+		if !errors.Is(err, store.ErrUnavailable) {
+			log.Printf("server: load namespaces: %v", err)
+		}
+		return
+	}
+	s.namespaces.set(list)
+}
+
+// startNamespaceRefresh reloads the namespaces every SLC_NAMESPACE_REFRESH
+// (default 30s), picking up changes made through other replicas. Every
+// replica refreshes, so this doesn't use startLoop's lease.
+func (s *Server) startNamespaceRefresh() {
+	if _, ok := s.backend.(store.NamespaceStore); !ok {
+		return
+	}
+	s.loadNamespaces(context.Background())
+	interval := durationFromEnv("SLC_NAMESPACE_REFRESH", 30*time.Second)
+	if interval <= 0 {
+		return
+	}
+	s.janitorWG.Add(1)
+	go func() {
+		defer s.janitorWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.loadNamespaces(context.Background())
+			case <-s.janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+// putNamespace stores ns and applies it.
+func (s *Server) putNamespace(ctx context.Context, ns models.Namespace) error {
+	if st, ok := s.backend.(store.NamespaceStore); ok {
+		if err := st.PutNamespace(ctx, ns); err != nil {
+			return err
+		}
+	}
+	s.namespaces.put(ns)
+	s.results.reset()
+	return nil
+}
+
+// deleteNamespace deletes every entry of namespace name and then forgets
+// its settings and synonyms, returning how many entries were deleted.
+func (s *Server) deleteNamespace(ctx context.Context, name string) (int, error) {
+	entries, err := s.findEntries(ctx, name, nil)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, e := range entries {
+		if err := s.store.DeleteEntry(ctx, e.ID); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	if s.synonyms.get(name) != nil {
+		if err := s.putSynonyms(ctx, name, nil); err != nil {
+			return deleted, err
+		}
+	}
+	if st, ok := s.backend.(store.NamespaceStore); ok {
+		if err := st.DeleteNamespace(ctx, name); err != nil && !errors.Is(err, store.ErrNamespaceNotFound) {
+			return deleted, err
+		}
+	}
+	s.namespaces.remove(name)
+	s.results.reset()
+	return deleted, nil
+}
+
+// evictNamespaces deletes the oldest unpinned entries of every namespace
+// holding more than its max_entries.
+func (s *Server) evictNamespaces(ctx context.Context) {
+	for _, ns := range s.namespaces.all() {
+		if ns.MaxEntries <= 0 {
+			continue
+		}
+		entries, err := s.findEntries(ctx, ns.Name, nil)
+		if err != nil || len(entries) <= ns.MaxEntries {
+			continue
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			if !entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+				return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+			}
+			return entries[i].ID < entries[j].ID
+		})
+		over := len(entries) - ns.MaxEntries
+		for _, e := range entries {
+			if over == 0 {
+				break
+			}
+			if e.Flag(models.MetaPinned) {
+				continue
+			}
+			if err := s.store.DeleteEntry(ctx, e.ID); err == nil {
+				namespaceEvictions.Inc(ns.Name)
+				over--
+			}
+		}
+	}
+}
+
+// checkNamespace validates ns as declared through the API.
+func checkNamespace(ns *models.Namespace) error {
+	if err := ns.Validate(); err != nil {
+		return err
+	}
+	if ns.Schema != nil {
+		if _, err := schema.Parse(ns.Schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GET    /namespaces         -> list the declared namespaces
+// POST   /namespaces         -> declare one
+// GET    /namespaces/{name}  -> its settings
+// PUT    /namespaces/{name}  -> replace its settings
+// DELETE /namespaces/{name}  -> delete it and all its entries
+func (s *Server) handleNamespaces(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/namespaces"), "/")
+	p := principalFrom(r.Context())
+	if name != "" && !p.allows(name) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		out := []models.Namespace{}
+		for _, ns := range s.namespaces.all() {
+			if p.allows(ns.Name) {
+				out = append(out, ns)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	case r.Method == http.MethodGet:
+		ns, ok := s.namespaces.get(name)
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ns)
+	case r.Method == http.MethodPost && name == "", r.Method == http.MethodPut && name != "":
+		var ns models.Namespace
+		if err := json.NewDecoder(r.Body).Decode(&ns); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		existing, exists := s.namespaces.get(ns.Name)
+		if r.Method == http.MethodPut {
+			if ns.Name != "" && ns.Name != name {
+				http.Error(w, "bad request: the name can't be changed", http.StatusBadRequest)
+				return
+			}
+			ns.Name = name
+			existing, exists = s.namespaces.get(name)
+		}
+		if err := checkNamespace(&ns); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !p.allows(ns.Name) {
+			http.Error(w, errForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPost && exists {
+			http.Error(w, "namespace already exists; PUT /namespaces/"+ns.Name+" changes its settings", http.StatusConflict)
+			return
+		}
+		// an entry is written encrypted or not, so only an empty namespace
+		// can change sides
+		if ns.Encrypted != existing.Encrypted {
+			if used, err := s.namespaceSize(r.Context(), ns.Name); err != nil {
+				s.respondStoreError(w, err)
+				return
+			} else if used > 0 {
+				http.Error(w, "namespace holds entries; encrypted can only change while it is empty", http.StatusConflict)
+				return
+			}
+		}
+		ns.CreatedAt = existing.CreatedAt
+		if !exists {
+			ns.CreatedAt = time.Now().UTC()
+		}
+		if err := s.putNamespace(r.Context(), ns); err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !exists {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_ = json.NewEncoder(w).Encode(ns)
+	case r.Method == http.MethodDelete && name != "":
+		if name == models.DefaultNamespace {
+			http.Error(w, "bad request: the default namespace can't be deleted", http.StatusBadRequest)
+			return
+		}
+		deleted, err := s.deleteNamespace(r.Context(), name)
+		if err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
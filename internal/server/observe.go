@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+	"github.com/jeefy/slmcache/internal/wal"
+)
+
+type changeKind int
+
+const (
+	changeCreated changeKind = iota
+	changeUpdated
+	changeDeleted
+	changeMetadata
+)
+
+// change describes a successful store mutation. entry is the written entry
+// for creates and updates and nil otherwise.
+type change struct {
+	kind  changeKind
+	id    int64
+	entry *models.Entry
+}
+
+// observedStore wraps the configured store and reports every successful
+// mutation, so derived state (cache tiers, indexes) stays consistent no
+// matter which code path changed an entry. It also journals mutations to the
+// write-ahead log when one is configured.
+type observedStore struct {
+	store.Store
+	notify  func(change)
+	journal *wal.Log
+
+	// gate is held shared by every mutation and exclusively by quiesce, so
+	// backups see a store and journal position that agree.
+	gate sync.RWMutex
+}
+
+// quiesce blocks new mutations and waits for in-flight ones to finish. The
+// returned func resumes writes.
+func (o *observedStore) quiesce() func() {
+	o.gate.Lock()
+	return o.gate.Unlock
+}
+
+// record journals the state of id after a mutation: the entry and vector as
+// stored, or a delete.
+func (o *observedStore) record(ctx context.Context, id int64, deleted bool) {
+	if o.journal == nil {
+		return
+	}
+	rec := wal.Record{Op: wal.OpDelete, ID: id}
+	if !deleted {
+		// a miss means the write was evicted by a size limit straight away
+		if e, err := o.Store.GetEntry(ctx, id); err == nil {
+			rec.Op, rec.Entry = wal.OpPut, e
+			if vg, ok := o.Store.(store.VectorGetter); ok {
+				rec.Vector, _ = vg.GetVector(ctx, id)
+			}
+		}
+	}
+	if _, err := o.journal.Append(rec); err != nil {
+		log.Printf("server: wal append failed: %v", err)
+	}
+}
+
+// dropEvicted journals and reports the entries the store evicted to make
+// room for a write as deletes, so replays, backups and as_of reads don't
+// bring them back.
+func (o *observedStore) dropEvicted(ctx context.Context) {
+	ev, ok := o.Store.(store.Evicter)
+	if !ok {
+		return
+	}
+	for _, id := range ev.Evicted() {
+		o.record(ctx, id, true)
+		o.notify(change{kind: changeDeleted, id: id})
+	}
+}
+
+func (o *observedStore) CreateEntryWithVector(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
+	o.gate.RLock()
+	defer o.gate.RUnlock()
+	id, err := o.Store.CreateEntryWithVector(ctx, e, vec)
+	if err == nil {
+		o.record(ctx, id, false)
+		o.notify(change{kind: changeCreated, id: id, entry: e})
+		o.dropEvicted(ctx)
+	}
+	return id, err
+}
+
+func (o *observedStore) UpdateEntryWithVector(ctx context.Context, id int64, e *models.Entry, vec []float64) error {
+	o.gate.RLock()
+	defer o.gate.RUnlock()
+	err := o.Store.UpdateEntryWithVector(ctx, id, e, vec)
+	if err == nil {
+		o.record(ctx, id, false)
+		o.notify(change{kind: changeUpdated, id: id, entry: e})
+		o.dropEvicted(ctx)
+	}
+	return err
+}
+
+func (o *observedStore) DeleteEntry(ctx context.Context, id int64) error {
+	o.gate.RLock()
+	defer o.gate.RUnlock()
+	err := o.Store.DeleteEntry(ctx, id)
+	if err == nil {
+		o.record(ctx, id, true)
+		o.notify(change{kind: changeDeleted, id: id})
+	}
+	return err
+}
+
+func (o *observedStore) UpdateEntryMetadata(ctx context.Context, id int64, metadata map[string]interface{}, replace bool) error {
+	o.gate.RLock()
+	defer o.gate.RUnlock()
+	err := o.Store.UpdateEntryMetadata(ctx, id, metadata, replace)
+	if err == nil {
+		o.record(ctx, id, false)
+		o.notify(change{kind: changeMetadata, id: id})
+	}
+	return err
+}
+
+func (o *observedStore) DeleteEntryMetadata(ctx context.Context, id int64, keys ...string) error {
+	o.gate.RLock()
+	defer o.gate.RUnlock()
+	err := o.Store.DeleteEntryMetadata(ctx, id, keys...)
+	if err == nil {
+		o.record(ctx, id, false)
+		o.notify(change{kind: changeMetadata, id: id})
+	}
+	return err
+}
+
+// UpdateMetadataWhere runs the backend's bulk update, or patches entries one
+// at a time without one, and reports every entry it changed.
+func (o *observedStore) UpdateMetadataWhere(ctx context.Context, filters map[string]string, metadata map[string]interface{}) ([]int64, error) {
+	o.gate.RLock()
+	defer o.gate.RUnlock()
+	ids, err := store.BulkUpdate(o.Store).UpdateMetadataWhere(ctx, filters, metadata)
+	for _, id := range ids {
+		o.record(ctx, id, false)
+		o.notify(change{kind: changeMetadata, id: id})
+	}
+	return ids, err
+}
+
+// observe registers fn to receive every store mutation. Observers run
+// synchronously on the mutating goroutine and must be cheap.
+func (s *Server) observe(fn func(change)) {
+	s.observers = append(s.observers, fn)
+}
+
+func (s *Server) emit(c change) {
+	for _, fn := range s.observers {
+		fn(c)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/events"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// Outbox sinks.
+const (
+	sinkEvents  = "events"
+	sinkWebhook = "webhook"
+)
+
+var (
+	outboxPending = metrics.NewGauge("slmcache_outbox_pending",
+		"Outbound messages waiting in the outbox at the last delivery pass.")
+	outboxDeliveries = metrics.NewCounter("slmcache_outbox_deliveries_total",
+		"Outbox delivery attempts by sink and result (ok, error).", "sink", "result")
+)
+
+// outbox delivers entry events and webhooks through messages persisted in
+// the store rather than in memory: they are appended with the write that
+// caused them and removed once delivered, so a restart or a leader change
+// resends what was pending instead of losing it. Messages of one lane (a
+// sink and target) are delivered in order; a failed message holds back
+// the rest of its lane, retried with backoff.
+type outbox struct {
+	st     store.Outbox
+	events events.Publisher // nil unless SLC_EVENTS is set
+
+	mu      sync.Mutex
+	backoff map[string]time.Duration
+	retryAt map[string]time.Time
+}
+
+// newOutbox enables the outbox with SLC_OUTBOX=true when the store can
+// persist one, and returns nil otherwise.
+func newOutbox(st store.Store) *outbox {
+	if config.Get("SLC_OUTBOX") != "true" {
+		return nil
+	}
+	ob, ok := st.(store.Outbox)
+	if !ok {
+		log.Printf("server: SLC_OUTBOX is set but the store can't persist an outbox; delivering from memory")
+		return nil
+	}
+	return &outbox{st: ob, backoff: map[string]time.Duration{}, retryAt: map[string]time.Time{}}
+}
+
+// enqueue appends one message, logging rather than failing the write that
+// caused it.
+func (o *outbox) enqueue(ctx context.Context, m store.OutboxMessage) {
+	m.Created = time.Now().UTC()
+	if err := o.st.AppendOutbox(ctx, []store.OutboxMessage{m}); err != nil {
+		log.Printf("server: outbox append %s: %v", m.Sink, err)
+	}
+}
+
+// deliverOutbox sends what is pending, oldest first, and acknowledges what
+// was delivered.
+func (s *Server) deliverOutbox(ctx context.Context) {
+	o := s.outbox
+	pending, err := o.st.PendingOutbox(ctx, 0)
+	if err != nil {
+		log.Printf("server: outbox: %v", err)
+		return
+	}
+	outboxPending.Set(float64(len(pending)))
+	now := time.Now()
+	blocked := map[string]bool{}
+	var acked []uint64
+	for i := 0; i < len(pending); {
+		m := pending[i]
+		lane := m.Sink + "\x00" + m.Target
+		if blocked[lane] || now.Before(o.retryAt[lane]) {
+			blocked[lane] = true
+			i++
+			continue
+		}
+		// consecutive events go to the broker as one batch
+		batch := []store.OutboxMessage{m}
+		for m.Sink == sinkEvents && i+len(batch) < len(pending) && pending[i+len(batch)].Sink == sinkEvents && len(batch) < 256 {
+			batch = append(batch, pending[i+len(batch)])
+		}
+		i += len(batch)
+		if err := o.deliver(ctx, batch); err != nil {
+			log.Printf("server: outbox %s %s: %v; holding its later messages back", m.Sink, m.Target, err)
+			outboxDeliveries.Inc(m.Sink, "error")
+			blocked[lane] = true
+			o.failed(lane, now)
+			continue
+		}
+		outboxDeliveries.Inc(m.Sink, "ok")
+		o.delivered(lane)
+		for _, d := range batch {
+			acked = append(acked, d.Seq)
+		}
+	}
+	if len(acked) > 0 {
+		if err := o.st.AckOutbox(ctx, acked...); err != nil {
+			log.Printf("server: outbox ack: %v", err)
+		}
+	}
+}
+
+func (o *outbox) deliver(ctx context.Context, batch []store.OutboxMessage) error {
+	switch batch[0].Sink {
+	case sinkEvents:
+		if o.events == nil {
+			return fmt.Errorf("no event broker configured (SLC_EVENTS)")
+		}
+		msgs := make([]events.Message, len(batch))
+		for i, m := range batch {
+			msgs[i] = events.Message{Type: m.Type, Key: m.Key, Value: m.Payload}
+		}
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		return o.events.Publish(ctx, msgs)
+	case sinkWebhook:
+		return postWebhook(ctx, batch[0].Target, batch[0].Payload)
+	}
+	return fmt.Errorf("unknown outbox sink %q", batch[0].Sink)
+}
+
+// failed backs lane off: 1s after the first failure, doubling up to 1m.
+func (o *outbox) failed(lane string, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	b := min(max(2*o.backoff[lane], time.Second), time.Minute)
+	o.backoff[lane], o.retryAt[lane] = b, now.Add(b)
+}
+
+func (o *outbox) delivered(lane string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.backoff, lane)
+	delete(o.retryAt, lane)
+}
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// postWebhook POSTs a JSON body to url; statuses of 300 and up fail.
+func postWebhook(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// enqueueEvent persists ev for delivery to the event broker.
+func (o *outbox) enqueueEvent(ctx context.Context, ev events.Event) {
+	m := events.Encode(ev)
+	o.enqueue(ctx, store.OutboxMessage{Sink: sinkEvents, Type: m.Type, Key: m.Key, Payload: json.RawMessage(m.Value)})
+}
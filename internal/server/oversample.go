@@ -0,0 +1,61 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// maxOversample caps the oversampling factor, so a request can't turn a
+// search into a scan of the whole index.
+const maxOversample = 20
+
+// oversample is the factor the vector search's k is multiplied by for q.
+// Matches dropped after the vector search (metadata filters the store
+// can't apply, scopes, per-category thresholds) would otherwise leave fewer
+// than q.Limit results, so such searches ask for SLC_SEARCH_OVERSAMPLE
+// (default 3) times the limit. A global threshold cuts the tail of the
+// ranking, where extra candidates can't pass it, so it needs none. The
+// request's own factor, when set, always applies.
+func (s *Server) oversample(q searchQuery) float64 {
+	if q.Oversample > 0 {
+		return min(max(q.Oversample, 1), maxOversample)
+	}
+	pushed := len(q.Filters) > 0 && s.filtersPushedDown()
+	if (len(q.Filters) == 0 || pushed) && q.Scope == "" && len(s.getScoreProfiles()) == 0 {
+		return 1
+	}
+	factor := 3.0
+	if v := config.Get("SLC_SEARCH_OVERSAMPLE"); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed >= 1 {
+			factor = parsed
+		}
+	}
+	return min(factor, maxOversample)
+}
+
+// filtersPushedDown reports whether the store applies metadata filters
+// during the vector search itself.
+func (s *Server) filtersPushedDown() bool {
+	_, ok := s.backend.(store.FilteredSearcher)
+	return ok && store.CapabilitiesOf(s.backend).FilteredSearch
+}
+
+// searchK is how many neighbours the vector search of q asks for.
+func (s *Server) searchK(q searchQuery) int {
+	if q.Limit <= 0 {
+		return q.Limit
+	}
+	return int(float64(q.Limit)*s.oversample(q) + 0.5)
+}
+
+// parseOversample reads a request's oversampling factor; "" and invalid
+// values leave the server's choice.
+func parseOversample(v string) float64 {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 1 {
+		return 0
+	}
+	return f
+}
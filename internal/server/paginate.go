@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// nextCursorHeader carries the cursor of the next page of a paged search.
+const nextCursorHeader = "X-SLMCache-Next-Cursor"
+
+var errBadCursor = errors.New("invalid cursor")
+
+// searchCursor marks where a page of search results ended. Results are
+// ordered by score, then ID, so a page continues after the last (score, ID)
+// pair rather than at an offset: entries stored meanwhile above the cursor
+// don't shift later pages, and no result repeats or goes missing.
+type searchCursor struct {
+	Query string  `json:"q"` // pageKey of the search the cursor belongs to
+	Score float64 `json:"s"`
+	ID    int64   `json:"id"`
+}
+
+func (c searchCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses a cursor of the search with key; "" starts at the
+// first page.
+func decodeCursor(v, key string) (*searchCursor, error) {
+	if v == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var c searchCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errBadCursor
+	}
+	if c.Query != key {
+		return nil, fmt.Errorf("%w: it belongs to another search", errBadCursor)
+	}
+	return &c, nil
+}
+
+// after reports whether a result with score and id comes after the cursor.
+func (c *searchCursor) after(score float64, id int64) bool {
+	return c == nil || score < c.Score || (score == c.Score && id > c.ID)
+}
+
+// pageKey identifies what a paged search matches, so a cursor can't be
+// replayed against another query. The limit may change between pages.
+func (s *Server) pageKey(q searchQuery) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%t\x00%t\x00%s", s.canonical(q.namespace(), q.Text), q.IncludeStale, q.IncludeDrafts, q.Scope)
+	for _, k := range slices.Sorted(maps.Keys(q.Filters)) {
+		fmt.Fprintf(h, "\x00%s=%s", k, q.Filters[k])
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// searchPage returns the page of q's vector matches that follows cursor,
+// and the cursor of the next page (nil on the last). Only vector matches
+// above their threshold are paged; the L1 tier, token fallback, federation
+// and read-through don't take part, since their results have no stable
+// rank. The vector search widens until it holds a full page past the
+// cursor, or SLC_SEARCH_MAX_CANDIDATES (default 10000) neighbours.
+func (s *Server) searchPage(ctx context.Context, q searchQuery, cursor *searchCursor) (*searchResult, *searchCursor, error) {
+	vec, err := q.Vector, error(nil)
+	if vec == nil {
+		if vec, err = s.embed(ctx, q.Text, stageQuery); err != nil {
+			return nil, nil, err
+		}
+	}
+	thresholds := s.thresholds()
+	maxK := intFromEnv("SLC_SEARCH_MAX_CANDIDATES", 10000)
+	entries := map[int64]*models.Entry{}
+	var page []int64
+	var pageScores []float64
+	more := false
+	for k := max(s.searchK(q), q.Limit+1); ; k = min(2*k, maxK) {
+		wide := q
+		wide.Limit, wide.Oversample = k, 1
+		ids, scores, err := s.searchVector(ctx, wide, vec)
+		if err != nil {
+			return nil, nil, err
+		}
+		order := make([]int, len(ids))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(a, b int) bool {
+			i, j := order[a], order[b]
+			if scores[i] != scores[j] {
+				return scores[i] > scores[j]
+			}
+			return ids[i] < ids[j]
+		})
+		page, pageScores, more = page[:0], pageScores[:0], false
+		for _, i := range order {
+			id, score := ids[i], scores[i]
+			if score < thresholds.lowest() || !cursor.after(score, id) {
+				continue
+			}
+			e, ok := entries[id]
+			if !ok {
+				if e, err = s.store.GetEntry(ctx, id); err != nil || s.expireIfNeeded(ctx, e) {
+					e = nil
+				}
+				entries[id] = e
+			}
+			if e == nil || (!q.IncludeStale && e.Flag(models.MetaStale)) || !q.matches(e) || score < thresholds.of(e) {
+				continue
+			}
+			if len(page) == q.Limit {
+				more = true
+				break
+			}
+			page, pageScores = append(page, id), append(pageScores, score)
+		}
+		// done with a full page and one to spare, or once the index has
+		// nothing more above the threshold
+		exhausted := len(ids) < k || (len(order) > 0 && scores[order[len(order)-1]] < thresholds.lowest())
+		if more || exhausted || k >= maxK {
+			break
+		}
+	}
+	res := &searchResult{Entries: []*models.Entry{}, Scores: []float64{}, Tier: "l2"}
+	for i, id := range page {
+		res.add(entries[id], pageScores[i])
+	}
+	// entries failing a safety check or out of serves are dropped from the
+	// page rather than replaced, so the cursor stays where the ranking left
+	// off
+	s.screen(ctx, res)
+	s.consume(ctx, res)
+	pickVariants(q, res)
+	var next *searchCursor
+	if more && len(page) > 0 {
+		last := len(page) - 1
+		next = &searchCursor{Query: s.pageKey(q), Score: pageScores[last], ID: page[last]}
+	}
+	return res, next, nil
+}
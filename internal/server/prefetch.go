@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var prefetches = metrics.NewCounter("slmcache_prefetch_total",
+	"Related queries considered for prefetch by outcome (warmed, cached, miss, dropped).", "result")
+
+// prefetcher warms the L1 tier with queries likely to follow a hit, such as
+// the follow-up questions listed in an entry's metadata.related, so a
+// conversation's next turn is answered without embedding. A nil
+// *prefetcher is disabled.
+type prefetcher struct {
+	queue     chan []string
+	templates []string
+}
+
+// newPrefetcher returns a prefetcher when SLC_PREFETCH=true. Besides
+// metadata.related, SLC_PREFETCH_TEMPLATES (a JSON array) adds queries
+// derived from every hit, with {prompt} and {metadata.<key>} placeholders.
+func newPrefetcher() *prefetcher {
+	if config.Get("SLC_PREFETCH") != "true" {
+		return nil
+	}
+	p := &prefetcher{queue: make(chan []string, intFromEnv("SLC_PREFETCH_QUEUE", 256))}
+	if raw := config.Get("SLC_PREFETCH_TEMPLATES"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &p.templates); err != nil {
+			log.Printf("server: ignoring SLC_PREFETCH_TEMPLATES: %v", err)
+		}
+	}
+	return p
+}
+
+// startPrefetcher runs the warming worker until Close.
+func (s *Server) startPrefetcher() {
+	if s.prefetch == nil || s.exact == nil {
+		return
+	}
+	s.janitorWG.Add(1)
+	go func() {
+		defer s.janitorWG.Done()
+		for {
+			select {
+			case queries := <-s.prefetch.queue:
+				for _, q := range queries {
+					prefetches.Inc(s.warm(withPriority(context.Background(), priorityLow), q))
+				}
+			case <-s.janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+// prefetchRelated queues the queries related to a served entry. It never
+// blocks the search; when the queue is full the queries are dropped.
+func (s *Server) prefetchRelated(e *models.Entry) {
+	if s.prefetch == nil || s.exact == nil || e == nil || e.Region != "" {
+		return
+	}
+	queries := relatedQueries(e, s.prefetch.templates)
+	if len(queries) == 0 {
+		return
+	}
+	select {
+	case s.prefetch.queue <- queries:
+	default:
+		prefetches.Add(float64(len(queries)), "dropped")
+	}
+}
+
+var placeholder = regexp.MustCompile(`\{(prompt|metadata\.[^}]+)\}`)
+
+// relatedQueries lists metadata.related followed by the expanded templates.
+// Templates referencing metadata the entry doesn't have are skipped.
+func relatedQueries(e *models.Entry, templates []string) []string {
+	var out []string
+	switch v := e.Metadata[models.MetaRelated].(type) {
+	case string:
+		out = append(out, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+	}
+	for _, tmpl := range templates {
+		missing := false
+		q := placeholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+			name := m[1 : len(m)-1]
+			if name == "prompt" {
+				return e.Prompt
+			}
+			v, ok := e.Metadata[name[len("metadata."):]]
+			if !ok {
+				missing = true
+				return ""
+			}
+			return fmt.Sprint(v)
+		})
+		if !missing {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+// warm resolves query to a stored entry with the same canonical prompt and
+// puts it in L1. It returns the prefetch outcome for metrics.
+func (s *Server) warm(ctx context.Context, query string) string {
+	key := canonicalize(query)
+	if key == "" {
+		return "miss"
+	}
+	if _, ok := s.exact.get(key); ok {
+		return "cached"
+	}
+	vec, err := s.embed(ctx, query, stageQuery)
+	if err != nil {
+		return "miss"
+	}
+	ids, _, err := s.store.SearchByVector(ctx, vec, 5)
+	if err != nil {
+		return "miss"
+	}
+	for _, id := range ids {
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil || s.entryKey(e) != s.canonical(e.Namespace(), query) || s.isExpired(e) || e.Flag(models.MetaStale) || e.Opaque() || e.State() != models.StatePublished {
+			continue
+		}
+		s.exact.put(s.entryKey(e), id)
+		return "warmed"
+	}
+	return "miss"
+}
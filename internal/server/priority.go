@@ -0,0 +1,176 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+)
+
+var requestPriorities = metrics.NewCounter("slmcache_requests_by_priority_total",
+	"Requests by the priority class they were served with.", "priority")
+
+// priority orders work competing for the same capacity: interactive
+// lookups ahead of bulk ingestion and background jobs.
+type priority int
+
+const (
+	priorityHigh priority = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+func (p priority) String() string { return priorityNames[p] }
+
+func parsePriority(s string) (priority, bool) {
+	for p, name := range priorityNames {
+		if strings.EqualFold(strings.TrimSpace(s), name) {
+			return priority(p), true
+		}
+	}
+	return priorityNormal, false
+}
+
+type priorityKey struct{}
+
+func withPriority(ctx context.Context, p priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFrom returns the priority of the work ctx belongs to; requests
+// that didn't set one are normal.
+func priorityFrom(ctx context.Context) priority {
+	if p, ok := ctx.Value(priorityKey{}).(priority); ok {
+		return p
+	}
+	return priorityNormal
+}
+
+// prioritize assigns each request its class: the X-Priority header, else
+// the API key's default, else low for bulk ingestion and normal otherwise.
+// A key with a default may lower its priority but not raise it above that.
+func prioritize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := priorityNormal
+		if r.URL.Path == "/entries/batch" {
+			p = priorityLow
+		}
+		var ceiling priority
+		if k := principalFrom(r.Context()); k != nil && k.priority != nil {
+			p, ceiling = *k.priority, *k.priority
+		}
+		if h, ok := parsePriority(r.Header.Get("X-Priority")); ok {
+			p = max(h, ceiling)
+		}
+		requestPriorities.Inc(p.String())
+		next.ServeHTTP(w, r.WithContext(withPriority(r.Context(), p)))
+	})
+}
+
+// priorityGate admits at most limit holders at a time. Waiters queue per
+// priority and a freed slot goes to the oldest waiter of the highest
+// priority present. A nil *priorityGate admits everything.
+type priorityGate struct {
+	limit int
+
+	mu      sync.Mutex
+	inUse   int
+	waiters [numPriorities]*list.List // of *waiter, oldest first
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newPriorityGate(limit int) *priorityGate {
+	g := &priorityGate{limit: limit}
+	for i := range g.waiters {
+		g.waiters[i] = list.New()
+	}
+	return g
+}
+
+func (g *priorityGate) queued() int {
+	n := 0
+	for _, l := range g.waiters {
+		n += l.Len()
+	}
+	return n
+}
+
+// acquire takes a slot, queueing for up to wait (until ctx ends when wait is
+// negative, not at all when it is 0). When it returns true the caller must
+// call release.
+func (g *priorityGate) acquire(ctx context.Context, p priority, wait time.Duration) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	if g.inUse < g.limit && g.queued() == 0 {
+		g.inUse++
+		g.mu.Unlock()
+		return true
+	}
+	if wait == 0 {
+		g.mu.Unlock()
+		return false
+	}
+	w := &waiter{ready: make(chan struct{})}
+	el := g.waiters[p].PushBack(w)
+	g.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-w.ready:
+	case <-timeout:
+	case <-ctx.Done():
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if w.granted {
+		return true
+	}
+	g.waiters[p].Remove(el)
+	return false
+}
+
+// release frees a slot, handing it straight to the next waiter.
+func (g *priorityGate) release() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, l := range g.waiters {
+		if el := l.Front(); el != nil {
+			w := l.Remove(el).(*waiter)
+			w.granted = true
+			close(w.ready)
+			return
+		}
+	}
+	g.inUse--
+}
+
+// newEmbedGate limits embedding to SLC_EMBED_CONCURRENCY calls at a time,
+// so a batch import can't keep interactive queries waiting on the SLM. It
+// returns nil (no limit) when the setting is unset or 0.
+func newEmbedGate() *priorityGate {
+	if n := intFromEnv("SLC_EMBED_CONCURRENCY", 0); n > 0 {
+		return newPriorityGate(n)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var qualityRejections = metrics.NewCounter("slmcache_quality_rejections_total",
+	"Writes refused because their quality score is below SLC_MIN_QUALITY, by route.", "route")
+
+// errLowQuality is returned for writes scored below SLC_MIN_QUALITY.
+var errLowQuality = errors.New("quality is below SLC_MIN_QUALITY; not cached")
+
+// minQuality is the quality score a scored response needs to be cached
+// (SLC_MIN_QUALITY, 0 = any).
+func minQuality() float64 {
+	f, err := strconv.ParseFloat(config.Get("SLC_MIN_QUALITY"), 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
+// checkQuality rejects a metadata.quality that isn't a number from 0 to 1.
+func checkQuality(e *models.Entry) error {
+	if _, ok := e.Metadata[models.MetaQuality]; !ok {
+		return nil
+	}
+	if q, ok := e.Quality(); !ok || q < 0 || q > 1 {
+		return fmt.Errorf("quality must be a number from 0 to 1")
+	}
+	return nil
+}
+
+// admitQuality refuses entries whose quality score, when they carry one,
+// is below the floor. Unscored entries are always admitted.
+func admitQuality(e *models.Entry, route string) error {
+	if q, ok := e.Quality(); ok && q < minQuality() {
+		qualityRejections.Inc(route)
+		return errLowQuality
+	}
+	return nil
+}
+
+// qualityTie is how close two similarity scores must be for the candidates
+// to count as tied (SLC_QUALITY_TIE).
+func qualityTie() float64 {
+	f, err := strconv.ParseFloat(config.Get("SLC_QUALITY_TIE"), 64)
+	if err != nil || f < 0 {
+		return 0.01
+	}
+	return f
+}
+
+// preferQuality reorders runs of vector candidates whose scores tie, within
+// SLC_QUALITY_TIE of the run's best, by quality score, highest first.
+// Unscored entries count as 0, and every candidate keeps its own score.
+func (s *Server) preferQuality(ctx context.Context, ids []int64, scores []float64) {
+	tie := qualityTie()
+	for start := 0; start < len(ids); {
+		end := start + 1
+		for end < len(ids) && scores[start]-scores[end] <= tie {
+			end++
+		}
+		if end-start > 1 {
+			s.sortByQuality(ctx, ids[start:end], scores[start:end])
+		}
+		start = end
+	}
+}
+
+func (s *Server) sortByQuality(ctx context.Context, ids []int64, scores []float64) {
+	type candidate struct {
+		id      int64
+		score   float64
+		quality float64
+	}
+	group := make([]candidate, len(ids))
+	rated := false
+	for i, id := range ids {
+		group[i] = candidate{id: id, score: scores[i]}
+		if e, err := s.store.GetEntry(ctx, id); err == nil {
+			group[i].quality, _ = e.Quality()
+			rated = rated || group[i].quality > 0
+		}
+	}
+	if !rated {
+		return
+	}
+	slices.SortStableFunc(group, func(a, b candidate) int {
+		switch {
+		case a.quality > b.quality:
+			return -1
+		case a.quality < b.quality:
+			return 1
+		}
+		return 0
+	})
+	for i, c := range group {
+		ids[i], scores[i] = c.id, c.score
+	}
+}
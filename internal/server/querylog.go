@@ -0,0 +1,67 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/querylog"
+)
+
+// newQueryLogger builds the optional search log from SLC_QUERY_LOG (file
+// path) and/or SLC_QUERY_LOG_OTLP (collector logs URL). It returns nil when
+// neither is set. Query text is hashed unless SLC_QUERY_LOG_TEXT says
+// otherwise.
+func newQueryLogger() *querylog.Logger {
+	path := config.Get("SLC_QUERY_LOG")
+	otlp := config.Get("SLC_QUERY_LOG_OTLP")
+	if path == "" && otlp == "" {
+		return nil
+	}
+	mode, err := querylog.ParseTextMode(config.Get("SLC_QUERY_LOG_TEXT"))
+	if err != nil {
+		log.Printf("server: %v; hashing query text", err)
+		mode = querylog.TextHash
+	}
+	privacy := querylog.Privacy{
+		Mode:     mode,
+		Truncate: intFromEnv("SLC_QUERY_LOG_TRUNCATE", 32),
+		Salt:     config.Get("SLC_QUERY_LOG_SALT"),
+	}
+	var sinks []querylog.Sink
+	if path != "" {
+		maxBytes := int64(intFromEnv("SLC_QUERY_LOG_MAX_MB", 100)) << 20
+		f, err := querylog.NewFileSink(path, maxBytes, intFromEnv("SLC_QUERY_LOG_MAX_FILES", 5))
+		if err != nil {
+			log.Printf("server: query log disabled: %v", err)
+		} else {
+			sinks = append(sinks, f)
+		}
+	}
+	if otlp != "" {
+		sinks = append(sinks, querylog.NewOTLPSink(otlp, 0))
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	return querylog.New(privacy, sinks...)
+}
+
+func (s *Server) logQuery(q searchQuery, res *searchResult, start time.Time) {
+	if s.queryLog == nil {
+		return
+	}
+	rec := querylog.Record{
+		Time:      start.UTC(),
+		Source:    q.Source,
+		Filters:   q.Filters,
+		Tier:      res.Tier,
+		IDs:       make([]int64, len(res.Entries)),
+		Scores:    res.Scores,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	for i, e := range res.Entries {
+		rec.IDs[i] = e.ID
+	}
+	s.queryLog.Log(rec, q.Text)
+}
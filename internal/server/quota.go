@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/events"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var (
+	quotaUtilization = metrics.NewGauge("slmcache_namespace_quota_utilization",
+		"Entries of each namespace with a quota, as a fraction of it.", "namespace")
+	quotaWarnings = metrics.NewCounter("slmcache_quota_warnings_total",
+		"Namespaces filling past a SLC_QUOTA_WARN_AT threshold of their quota, by threshold percent.", "namespace", "threshold")
+	quotaRejections = metrics.NewCounter("slmcache_quota_rejections_total",
+		"Writes refused because their namespace was at its quota.", "namespace")
+)
+
+// errQuotaExceeded is returned by writes that would take a namespace past
+// its quota.
+var errQuotaExceeded = errors.New("namespace is at its quota")
+
+// quotaWarning is the body of the SLC_QUOTA_WEBHOOK notification.
+type quotaWarning struct {
+	Namespace string `json:"namespace"`
+	Used      int    `json:"used"`
+	Quota     int    `json:"quota"`
+	// Threshold is the SLC_QUOTA_WARN_AT percent crossed.
+	Threshold int       `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+// quotaTracker remembers the highest threshold each namespace was warned
+// about, so a warning goes out once per crossing rather than per write.
+type quotaTracker struct {
+	mu     sync.Mutex
+	warned map[string]int
+}
+
+// cross records level as namespace ns's threshold and reports whether it
+// is higher than the last one. A lower level re-arms the higher ones.
+func (t *quotaTracker) cross(ns string, level int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.warned == nil {
+		t.warned = map[string]int{}
+	}
+	prev := t.warned[ns]
+	t.warned[ns] = level
+	return level > prev
+}
+
+// quotaWarnAt parses SLC_QUOTA_WARN_AT, the comma-separated percents of a
+// quota at which to warn (default 80,90).
+func quotaWarnAt() []int {
+	v := config.Get("SLC_QUOTA_WARN_AT")
+	if v == "" {
+		return []int{80, 90}
+	}
+	var out []int
+	for _, f := range strings.Split(v, ",") {
+		p, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || p <= 0 || p > 100 {
+			noteInvalid("SLC_QUOTA_WARN_AT", "a comma-separated list of percents")
+			return []int{80, 90}
+		}
+		out = append(out, p)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// namespaceSize counts the entries of namespace ns.
+func (s *Server) namespaceSize(ctx context.Context, ns string) (int, error) {
+	agg := store.Aggregate(s.backend)
+	if ns != models.DefaultNamespace {
+		return agg.CountEntries(ctx, map[string]string{models.MetaNamespace: ns})
+	}
+	// entries of the default namespace may not carry the key at all
+	counts, err := agg.CountByMetadata(ctx, models.MetaNamespace, nil)
+	return counts[""] + counts[models.DefaultNamespace], err
+}
+
+// admitEntry returns why another entry may not be written into namespace
+// ns: it is undeclared while SLC_REQUIRE_NAMESPACES is set, or at its
+// quota. Admitted writes count toward the quota's warnings.
+func (s *Server) admitEntry(ctx context.Context, ns string) error {
+	if !s.namespaceDeclared(ns) {
+		return fmt.Errorf("%w: %s", errUndeclaredNamespace, ns)
+	}
+	settings, ok := s.namespaces.get(ns)
+	if !ok || settings.Quota <= 0 {
+		return nil
+	}
+	used, err := s.namespaceSize(ctx, ns)
+	if err != nil {
+		return err
+	}
+	if used >= settings.Quota {
+		quotaRejections.Inc(ns)
+		return fmt.Errorf("%w: %s holds %d of %d entries", errQuotaExceeded, ns, used, settings.Quota)
+	}
+	s.noteQuotaUsage(ctx, ns, used+1, settings.Quota)
+	return nil
+}
+
+// noteQuotaUsage updates namespace ns's utilization and warns when it has
+// crossed a SLC_QUOTA_WARN_AT threshold since the last warning.
+func (s *Server) noteQuotaUsage(ctx context.Context, ns string, used, quota int) {
+	quotaUtilization.Set(float64(used)/float64(quota), ns)
+	level := 0
+	for _, p := range quotaWarnAt() {
+		if used*100 >= p*quota {
+			level = p
+		}
+	}
+	if !s.quotas.cross(ns, level) {
+		return
+	}
+	quotaWarnings.Inc(ns, strconv.Itoa(level))
+	log.Printf("server: namespace %s holds %d of its %d entries (%d%% threshold)", ns, used, quota, level)
+	warning := quotaWarning{Namespace: ns, Used: used, Quota: quota, Threshold: level, Time: time.Now().UTC()}
+	s.events.Emit(events.Event{Type: events.QuotaWarning, Time: warning.Time, Namespace: ns})
+	s.notifyQuota(ctx, &warning)
+}
+
+// notifyQuota posts the warning to SLC_QUOTA_WEBHOOK, through the outbox
+// when there is one.
+func (s *Server) notifyQuota(ctx context.Context, warning *quotaWarning) {
+	url := config.Get("SLC_QUOTA_WEBHOOK")
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(warning)
+	if s.outbox != nil {
+		s.outbox.enqueue(ctx, store.OutboxMessage{Sink: sinkWebhook, Target: url, Type: "quota_warning", Payload: body})
+		return
+	}
+	// the warning comes from a write, which shouldn't wait on the hook
+	go func() {
+		if err := postWebhook(context.WithoutCancel(ctx), url, body); err != nil {
+			log.Printf("server: quota webhook: %v", err)
+		}
+	}()
+}
+
+// checkQuotas refreshes the utilization of every namespace with a quota,
+// catching up with deletes, expiry and writes through other replicas.
+func (s *Server) checkQuotas(ctx context.Context) {
+	for _, ns := range s.namespaces.all() {
+		if ns.Quota <= 0 {
+			continue
+		}
+		if used, err := s.namespaceSize(ctx, ns.Name); err == nil {
+			s.noteQuotaUsage(ctx, ns.Name, used, ns.Quota)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/resp"
+)
+
+var rateLimitDecisions = metrics.NewCounter("slmcache_rate_limit_decisions_total",
+	"Rate limit checks by backend and result (allow, limit, error).", "backend", "result")
+
+// limiter decides whether one more request for key fits its quota and, if
+// not, how long the caller should wait.
+type limiter interface {
+	name() string
+	allow(ctx context.Context, key string, now time.Time) (ok bool, retryAfter time.Duration, err error)
+}
+
+// newLimiter builds the limiter selected by SLC_RATE_LIMIT_BACKEND, allowing
+// SLC_RATE_LIMIT requests per second per caller with bursts of
+// SLC_RATE_BURST (default: one second's worth). It returns nil when
+// SLC_RATE_LIMIT is unset or 0.
+func newLimiter() limiter {
+	rate, _ := strconv.ParseFloat(config.Get("SLC_RATE_LIMIT"), 64)
+	if rate <= 0 {
+		return nil
+	}
+	burst := intFromEnv("SLC_RATE_BURST", int(math.Ceil(rate)))
+	if burst < 1 {
+		burst = 1
+	}
+	local := &localLimiter{rate: rate, burst: float64(burst), buckets: map[string]*bucket{}}
+	switch backend := config.Get("SLC_RATE_LIMIT_BACKEND"); backend {
+	case "redis":
+		return &redisLimiter{
+			addr:     config.Get("SLC_RATE_LIMIT_REDIS"),
+			prefix:   "slmcache:rl:",
+			timeout:  durationFromEnv("SLC_RATE_LIMIT_REDIS_TIMEOUT", 50*time.Millisecond),
+			limit:    burst,
+			period:   time.Duration(float64(burst) / rate * float64(time.Second)),
+			fallback: local,
+			idle:     make(chan *limiterConn, limiterPool),
+		}
+	case "", "local":
+	default:
+		log.Printf("server: unknown SLC_RATE_LIMIT_BACKEND %q, limiting locally", backend)
+	}
+	return local
+}
+
+// localLimiter is a token bucket per caller. With several replicas each
+// enforces the quota on its own, so callers spread across them get more.
+type localLimiter struct {
+	rate, burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets bounds the callers tracked; beyond it, full buckets (idle
+// callers) are forgotten.
+const maxBuckets = 100000
+
+func (*localLimiter) name() string { return "local" }
+
+func (l *localLimiter) allow(_ context.Context, key string, now time.Time) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			for k, old := range l.buckets {
+				if old.tokens+now.Sub(old.last).Seconds()*l.rate >= l.burst {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+// redisLimiter enforces the quota across replicas with a sliding window
+// counter in Redis: limit requests per period, where the previous window
+// counts in proportion to how much of it the sliding window still covers.
+// It only needs INCR, PEXPIRE and GET, so any Redis-compatible server works.
+// After Redis fails it stops calling it for a backoff (1s, doubling up to
+// 30s) and limits with fallback, this replica's own buckets, meanwhile.
+type redisLimiter struct {
+	addr     string
+	prefix   string
+	timeout  time.Duration
+	limit    int
+	period   time.Duration
+	fallback *localLimiter
+
+	// idle holds connections between calls, which each take their own, so
+	// checks run concurrently.
+	idle chan *limiterConn
+
+	mu        sync.Mutex
+	failures  int       // calls failed in a row
+	openUntil time.Time // Redis isn't called before then
+}
+
+type limiterConn struct {
+	net.Conn
+	r *resp.Reader
+	w *resp.Writer
+}
+
+// limiterPool is how many idle Redis connections a redisLimiter keeps.
+const limiterPool = 16
+
+func (*redisLimiter) name() string { return "redis" }
+
+func (l *redisLimiter) allow(ctx context.Context, key string, now time.Time) (bool, time.Duration, error) {
+	if l.tripped(now) {
+		return l.fallback.allow(ctx, key, now)
+	}
+	window := now.UnixNano() / int64(l.period)
+	elapsed := float64(now.UnixNano()%int64(l.period)) / float64(l.period)
+	cur := fmt.Sprintf("%s%s:%d", l.prefix, key, window)
+	prev := fmt.Sprintf("%s%s:%d", l.prefix, key, window-1)
+	replies, err := l.do(ctx,
+		[]string{"INCR", cur},
+		[]string{"PEXPIRE", cur, strconv.FormatInt((2 * l.period).Milliseconds(), 10)},
+		[]string{"GET", prev},
+	)
+	l.record(err, time.Now())
+	if err != nil {
+		return false, 0, err
+	}
+	count := float64(replies[0].Int)
+	if !replies[2].Null {
+		p, _ := strconv.ParseFloat(replies[2].Str, 64)
+		count += p * (1 - elapsed)
+	}
+	if count > float64(l.limit) {
+		// a rejected request still counted; the window ending frees room
+		return false, time.Duration((1 - elapsed) * float64(l.period)), nil
+	}
+	return true, 0, nil
+}
+
+// tripped reports whether Redis is in its backoff. Once it ends, one call
+// probes Redis while the others keep to the fallback for its timeout.
+func (l *redisLimiter) tripped(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Before(l.openUntil) {
+		return true
+	}
+	if l.failures > 0 {
+		l.openUntil = now.Add(l.timeout)
+	}
+	return false
+}
+
+func (l *redisLimiter) record(err error, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil {
+		l.failures, l.openUntil = 0, time.Time{}
+		return
+	}
+	l.failures++
+	l.openUntil = now.Add(min(time.Second<<min(l.failures-1, 5), 30*time.Second))
+}
+
+// do pipelines cmds over an idle connection, or a new one (authenticated
+// with SLC_RATE_LIMIT_REDIS_PASSWORD). A connection that fails is closed
+// rather than put back, so the next call starts clean.
+func (l *redisLimiter) do(ctx context.Context, cmds ...[]string) ([]resp.Value, error) {
+	deadline := time.Now().Add(l.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	var c *limiterConn
+	select {
+	case c = <-l.idle:
+	default:
+		var err error
+		if c, err = l.dial(ctx, deadline); err != nil {
+			return nil, err
+		}
+	}
+	out, err := c.pipeline(deadline, cmds)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	select {
+	case l.idle <- c:
+	default:
+		_ = c.Close()
+	}
+	return out, nil
+}
+
+func (l *redisLimiter) dial(ctx context.Context, deadline time.Time) (*limiterConn, error) {
+	conn, err := (&net.Dialer{Deadline: deadline}).DialContext(ctx, "tcp", l.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &limiterConn{Conn: conn, r: resp.NewReader(conn), w: resp.NewWriter(conn)}
+	if pw := config.Secret("SLC_RATE_LIMIT_REDIS_PASSWORD"); pw != "" {
+		if _, err := c.pipeline(deadline, [][]string{{"AUTH", pw}}); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *limiterConn) pipeline(deadline time.Time, cmds [][]string) ([]resp.Value, error) {
+	_ = c.SetDeadline(deadline)
+	for _, cmd := range cmds {
+		c.w.WriteCommand(cmd...)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	out := make([]resp.Value, len(cmds))
+	for i := range cmds {
+		v, err := c.r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		if v.Type == resp.Error {
+			return nil, errors.New("redis: " + v.Str)
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (s *Server) getLimiter() limiter {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.limiter
+}
+
+// rateLimit applies the quota to data requests, per API key when keys are
+// in use and per client address otherwise, answering 429 with Retry-After
+// when it is exhausted. A request a limiter backend fails on is let
+// through.
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := s.getLimiter()
+		if l == nil || routeGroup(r) != groupData {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := ""
+		if p := principalFrom(r.Context()); p != nil {
+			key = "key:" + p.id
+		} else if addr, ok := clientAddr(r); ok {
+			key = "ip:" + addr.String()
+		}
+		ok, retry, err := l.allow(r.Context(), key, time.Now())
+		switch {
+		case err != nil:
+			rateLimitDecisions.Inc(l.name(), "error")
+			log.Printf("server: rate limiter unavailable, allowing request: %v", err)
+		case !ok:
+			rateLimitDecisions.Inc(l.name(), "limit")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		default:
+			rateLimitDecisions.Inc(l.name(), "allow")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
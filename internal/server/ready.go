@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var storeHealthy = metrics.NewGauge("slmcache_store_healthy",
+	"1 when the last store health check passed.")
+
+// readiness is the body of /readyz.
+type readiness struct {
+	Status string         `json:"status"` // "ready", "warming", "unavailable" or "draining"
+	Store  storeReadiness `json:"store"`
+}
+
+type storeReadiness struct {
+	Error        string             `json:"error,omitempty"`
+	Capabilities store.Capabilities `json:"capabilities"`
+}
+
+// checkStore runs the store's health check, bounded by SLC_READY_TIMEOUT
+// (default 2s), and logs when the result changes.
+func (s *Server) checkStore(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, durationFromEnv("SLC_READY_TIMEOUT", 2*time.Second))
+	defer cancel()
+	err := store.Health(ctx, s.backend)
+	healthy := err == nil
+	if wasDown := s.storeDown.Swap(!healthy); wasDown == healthy {
+		if healthy {
+			log.Printf("server: store healthy again")
+		} else {
+			log.Printf("server: store unhealthy: %v", err)
+		}
+	}
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	storeHealthy.Set(v)
+	return err
+}
+
+// GET /readyz
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	out := readiness{Status: "ready", Store: storeReadiness{Capabilities: store.CapabilitiesOf(s.backend)}}
+	status := http.StatusOK
+	if err := s.checkStore(r.Context()); err != nil {
+		out.Status, out.Store.Error = "unavailable", err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	if s.warming.Load() && status == http.StatusOK {
+		out.Status, status = "warming", http.StatusServiceUnavailable
+	}
+	if s.draining.Load() {
+		out.Status, status = "draining", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// storeUnavailable answers 503 for a request that needs a store that isn't
+// connected yet.
+func storeUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, store.ErrUnavailable.Error(), http.StatusServiceUnavailable)
+}
+
+// requireStore answers 503 while a lazily connected store is unavailable,
+// except on routes that don't touch it.
+func (s *Server) requireStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case store.Available(s.backend),
+			path == "/readyz", path == "/metrics", path == "/slm-backend", strings.HasPrefix(path, "/stats/"), strings.HasPrefix(path, "/cluster/"):
+			next.ServeHTTP(w, r)
+		default:
+			storeUnavailable(w)
+		}
+	})
+}
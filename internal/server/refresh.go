@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var refreshes = metrics.NewCounter("slmcache_refreshes_total",
+	"Scheduled regenerations of entries from their upstream, by target and result (ok, error).", "target", "result")
+
+var refreshClient = &http.Client{Timeout: time.Minute}
+
+// maxRefreshBody bounds what is read from an upstream's response.
+const maxRefreshBody = 8 << 20
+
+// refreshSpec is metadata.refresh: regenerate the response every Every by
+// sending Request to the named target.
+type refreshSpec struct {
+	Every   string          `json:"every"`
+	Target  string          `json:"target"`
+	Request json.RawMessage `json:"request"`
+
+	every time.Duration
+}
+
+// refreshTarget is an upstream entries may be regenerated from. Targets
+// are configured in SLC_REFRESH_TARGETS rather than in entries, so writing
+// an entry can neither aim the worker at an arbitrary URL nor see the
+// credentials it sends.
+type refreshTarget struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Key names the setting holding the bearer token sent upstream; it is
+	// resolved like any other secret.
+	Key string `json:"key,omitempty"`
+	// ResponsePath is the dotted path of the answer in the upstream's JSON
+	// response, e.g. choices.0.message.content; empty uses the whole body.
+	ResponsePath string `json:"response_path,omitempty"`
+}
+
+// refreshTargets parses SLC_REFRESH_TARGETS, a JSON object of targets by
+// name.
+func refreshTargets() map[string]refreshTarget {
+	raw := config.Get("SLC_REFRESH_TARGETS")
+	if raw == "" {
+		return nil
+	}
+	var targets map[string]refreshTarget
+	if err := json.Unmarshal([]byte(raw), &targets); err != nil {
+		log.Printf("server: ignoring SLC_REFRESH_TARGETS: %v", err)
+		return nil
+	}
+	return targets
+}
+
+// refreshOf returns e's refresh spec, nil when it has none.
+func refreshOf(e *models.Entry) (*refreshSpec, error) {
+	v, ok := e.Metadata[models.MetaRefresh]
+	if !ok {
+		return nil, nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var spec refreshSpec
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		return nil, fmt.Errorf("refresh: %w", err)
+	}
+	if spec.every, err = time.ParseDuration(spec.Every); err != nil || spec.every <= 0 {
+		return nil, errors.New("refresh: every must be a positive duration such as 1h")
+	}
+	if len(spec.Request) == 0 {
+		return nil, errors.New("refresh: request required")
+	}
+	return &spec, nil
+}
+
+// checkRefresh rejects entries declaring a malformed metadata.refresh or
+// one naming a target that isn't configured.
+func checkRefresh(e *models.Entry) error {
+	spec, err := refreshOf(e)
+	if err != nil || spec == nil {
+		return err
+	}
+	if _, ok := refreshTargets()[spec.Target]; !ok {
+		return fmt.Errorf("refresh: unknown target %q; targets are configured in SLC_REFRESH_TARGETS", spec.Target)
+	}
+	return nil
+}
+
+// refreshDue regenerates the entries whose refresh interval has passed since
+// they were last written, one at a time. An upstream failure leaves the
+// entry as it is, to be retried on the next run.
+func (s *Server) refreshDue(ctx context.Context) {
+	targets := refreshTargets()
+	if len(targets) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, id := range s.store.AllIDs() {
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil || e.Flag(models.MetaPinned) {
+			continue
+		}
+		spec, err := refreshOf(e)
+		if err != nil || spec == nil || now.Sub(entryWritten(e)) < spec.every {
+			continue
+		}
+		target, ok := targets[spec.Target]
+		if !ok {
+			continue
+		}
+		if err := s.refreshEntry(ctx, e, spec, target); err != nil {
+			refreshes.Inc(spec.Target, "error")
+			log.Printf("server: refreshing entry %d from %s: %v", id, spec.Target, err)
+			continue
+		}
+		refreshes.Inc(spec.Target, "ok")
+	}
+}
+
+// entryWritten is when e's response was last written.
+func entryWritten(e *models.Entry) time.Time {
+	if e.UpdatedAt.IsZero() || e.CreatedAt.After(e.UpdatedAt) {
+		return e.CreatedAt
+	}
+	return e.UpdatedAt
+}
+
+// refreshEntry asks the target for a new response to e and swaps it in,
+// keeping the prompt and its vector. A refreshed answer is no longer stale.
+func (s *Server) refreshEntry(ctx context.Context, e *models.Entry, spec *refreshSpec, target refreshTarget) error {
+	answer, err := regenerate(ctx, spec.Request, target)
+	if err != nil {
+		return err
+	}
+	vg, ok := s.backend.(store.VectorGetter)
+	if !ok {
+		return errors.New("the store doesn't expose vectors")
+	}
+	vec, err := vg.GetVector(ctx, e.ID)
+	if err != nil {
+		return err
+	}
+	// an edit made while the upstream answered wins
+	current, err := s.store.GetEntry(ctx, e.ID)
+	if err != nil {
+		return err
+	}
+	if !entryWritten(current).Equal(entryWritten(e)) {
+		return nil
+	}
+	current.Response = answer
+	delete(current.Metadata, models.MetaStale)
+	return s.store.UpdateEntryWithVector(ctx, e.ID, current, vec)
+}
+
+// regenerate sends request to target and returns the answer it holds.
+func regenerate(ctx context.Context, request json.RawMessage, target refreshTarget) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(request))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range target.Headers {
+		req.Header.Set(k, v)
+	}
+	if target.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Secret(target.Key))
+	}
+	resp, err := refreshClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRefreshBody))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("upstream: %s", resp.Status)
+	}
+	if target.ResponsePath == "" {
+		return string(body), nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return "", fmt.Errorf("upstream response: %w", err)
+	}
+	v, err := lookupPath(doc, target.ResponsePath)
+	if err != nil {
+		return "", err
+	}
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+	out, err := json.Marshal(v)
+	return string(out), err
+}
+
+// lookupPath walks a dotted path of object keys and array indexes.
+func lookupPath(doc interface{}, path string) (interface{}, error) {
+	for _, part := range strings.Split(path, ".") {
+		switch t := doc.(type) {
+		case map[string]interface{}:
+			v, ok := t[part]
+			if !ok {
+				return nil, fmt.Errorf("upstream response has no %q", path)
+			}
+			doc = v
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, fmt.Errorf("upstream response has no %q", path)
+			}
+			doc = t[i]
+		default:
+			return nil, fmt.Errorf("upstream response has no %q", path)
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/slm"
+)
+
+func (s *Server) getSLM() slm.SLM {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.slm
+}
+
+func (s *Server) getGenerator() slm.Generator {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.gen
+}
+
+func (s *Server) ttl() time.Duration {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.entryTTL
+}
+
+func (s *Server) toolTTL() map[string]time.Duration {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.toolTTLs
+}
+
+// reloadConfig applies hot-reloaded settings. Values read on every request
+// (such as SLM_MIN_SCORE) need no handling here; the SLM backend is rebuilt
+// when any SLM_* key changes so rotated URLs or credentials take effect
+// without a restart, the safety validators when any SLC_SAFETY_* key does,
+// the JWT verifier (with an empty key cache) on SLC_JWT_* changes, the
+// rate limiter, with fresh quotas, on SLC_RATE_* changes, and the token
+// fallback's analyzer on SLC_LEXICAL_* changes. SLC_SCORE_PROFILES is
+// re-parsed when it changes.
+func (s *Server) reloadConfig(changed []string) {
+	if config.HasPrefix(changed, "SLC_ENTRY_TTL") {
+		ttl := durationFromEnv("SLC_ENTRY_TTL", 24*time.Hour)
+		s.cfgMu.Lock()
+		s.entryTTL = ttl
+		s.cfgMu.Unlock()
+		log.Printf("server: entry ttl now %s", ttl)
+	}
+	if config.HasPrefix(changed, "SLC_TOOL_TTLS") {
+		tools := parseToolTTLs()
+		s.cfgMu.Lock()
+		s.toolTTLs = tools
+		s.cfgMu.Unlock()
+		log.Printf("server: tool ttls reloaded")
+	}
+	if config.HasPrefix(changed, "SLC_SAFETY_") {
+		c := newSafetyChecker()
+		s.cfgMu.Lock()
+		s.safety = c
+		s.cfgMu.Unlock()
+		log.Printf("server: safety checks reloaded")
+	}
+	if config.HasPrefix(changed, "SLC_JWT_") {
+		v := newJWTVerifier()
+		s.cfgMu.Lock()
+		s.jwt = v
+		s.cfgMu.Unlock()
+		log.Printf("server: jwt validation reloaded")
+	}
+	if config.HasPrefix(changed, "SLC_RATE_") {
+		l := newLimiter()
+		s.cfgMu.Lock()
+		s.limiter = l
+		s.cfgMu.Unlock()
+		log.Printf("server: rate limiter reloaded")
+	}
+	if config.HasPrefix(changed, "SLC_LEXICAL_") {
+		a := newAnalyzer()
+		s.cfgMu.Lock()
+		s.analyzer = a
+		s.cfgMu.Unlock()
+		s.lexicon.invalidate()
+		log.Printf("server: lexical analyzer reloaded")
+	}
+	if config.HasPrefix(changed, "SLC_SCORE_PROFILES") {
+		p := newScoreProfiles()
+		s.cfgMu.Lock()
+		s.scoreProfiles = p
+		s.cfgMu.Unlock()
+		log.Printf("server: score profiles reloaded")
+	}
+	if config.HasPrefix(changed, "SLC_UNCACHEABLE") {
+		rules := newUncacheableRules()
+		s.cfgMu.Lock()
+		s.uncacheable = rules
+		s.cfgMu.Unlock()
+		log.Printf("server: uncacheable rules reloaded")
+	}
+	if config.HasPrefix(changed, "SLM_") {
+		// building the backend may pull a model; don't block the watcher
+		go func() {
+			next := slm.NewDefaultSLM()
+			gen := slm.NewGeneratorFromEnv()
+			s.cfgMu.Lock()
+			s.slm = next
+			s.gen = gen
+			s.cfgMu.Unlock()
+			log.Printf("server: slm backend reloaded")
+		}()
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/resp"
+)
+
+// ServeRESP serves the Redis-protocol facade on ln until ln is closed:
+// GET does a semantic lookup of the key as a prompt, SET stores the value as
+// the key's response. Close drops open RESP connections. When SLC_API_KEYS
+// or SLC_JWT_ISSUER is set, a connection must send AUTH with an API key or
+// JWT first, and its commands are held to that key's role and namespaces.
+func (s *Server) ServeRESP(ln net.Listener) error {
+	return s.resp.Serve(ln)
+}
+
+// Until a connection authenticates, its commands are limited to a few
+// short arguments, enough for AUTH with an API key or JWT.
+const (
+	respPreAuthArgs = 3
+	respPreAuthBulk = 16 * 1024
+)
+
+// respConn is a RESP connection: p is who it authenticated as with AUTH,
+// and r reads its commands.
+type respConn struct {
+	s *Server
+	r *resp.Reader
+	p *principal
+}
+
+func (s *Server) newRESPConn(r *resp.Reader) resp.Handler {
+	c := &respConn{s: s, r: r}
+	if keys, err := apiKeys(); err != nil || len(keys) > 0 || s.getJWT() != nil {
+		r.MaxArgs, r.MaxBulk = respPreAuthArgs, respPreAuthBulk
+	}
+	return c.handle
+}
+
+// handle authenticates the connection's commands the way authenticate does
+// HTTP requests before running them as the connection's principal.
+func (c *respConn) handle(w *resp.Writer, args []string) bool {
+	cmd := strings.ToUpper(args[0])
+	if cmd == "AUTH" {
+		c.auth(w, args)
+		return true
+	}
+	if cmd == "QUIT" {
+		return c.s.handleRESP(context.Background(), w, args)
+	}
+	keys, err := apiKeys()
+	if err != nil {
+		log.Printf("audit: resp %s refused: %v", cmd, err)
+		w.WriteError("ERR API keys can't be resolved")
+		return true
+	}
+	if c.p == nil && len(keys) == 0 && c.s.getJWT() == nil {
+		return c.s.handleRESP(context.Background(), w, args)
+	}
+	if c.p == nil {
+		w.WriteError("NOAUTH Authentication required.")
+		return true
+	}
+	need := roleRead
+	if cmd == "SET" || cmd == "DEL" {
+		need = roleWrite
+	}
+	if !c.p.can(need) || (cmd == "GET" && c.p.role == roleRead && config.Get("SLC_REDACT_READ") == "true") {
+		authDecisions.Inc(c.p.label(), "deny")
+		log.Printf("audit: key=%s role=%s resp %s denied", c.p.id, c.p.role, cmd)
+		w.WriteError("NOPERM this API key has no permissions to run the '" + strings.ToLower(args[0]) + "' command")
+		return true
+	}
+	authDecisions.Inc(c.p.label(), "allow")
+	keep := c.s.handleRESP(context.WithValue(context.Background(), principalKey{}, c.p), w, args)
+	if need != roleRead {
+		log.Printf("audit: key=%s role=%s resp %s", c.p.id, c.p.role, cmd)
+	}
+	return keep
+}
+
+// auth handles AUTH [username] key. The username is ignored: the key alone
+// identifies the caller.
+func (c *respConn) auth(w *resp.Writer, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		arity(w, args, 2)
+		return
+	}
+	keys, err := apiKeys()
+	if err != nil {
+		log.Printf("audit: resp AUTH refused: %v", err)
+		w.WriteError("ERR API keys can't be resolved")
+		return
+	}
+	verifier := c.s.getJWT()
+	if len(keys) == 0 && verifier == nil {
+		w.WriteError("ERR AUTH called without any API keys configured")
+		return
+	}
+	p, err := resolveKey(context.Background(), keys, verifier, args[len(args)-1])
+	if err != nil {
+		log.Printf("audit: resp AUTH rejected token: %v", err)
+	}
+	if p == nil {
+		c.p = nil
+		c.r.MaxArgs, c.r.MaxBulk = respPreAuthArgs, respPreAuthBulk
+		w.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	c.p = p
+	c.r.MaxArgs, c.r.MaxBulk = 0, 0
+	w.WriteSimple("OK")
+}
+
+func (s *Server) handleRESP(ctx context.Context, w *resp.Writer, args []string) bool {
+	switch cmd := strings.ToUpper(args[0]); cmd {
+	case "PING":
+		if len(args) > 1 {
+			w.WriteBulk(args[1])
+		} else {
+			w.WriteSimple("PONG")
+		}
+	case "ECHO":
+		if !arity(w, args, 2) {
+			break
+		}
+		w.WriteBulk(args[1])
+	case "QUIT":
+		w.WriteSimple("OK")
+		return false
+	case "SELECT", "CLIENT":
+		// accepted so connection setup in common clients succeeds
+		w.WriteSimple("OK")
+	case "COMMAND":
+		w.WriteArray(0)
+	case "GET":
+		if !arity(w, args, 2) {
+			break
+		}
+		res, err := s.search(ctx, searchQuery{Text: args[1], Limit: 1, Source: "resp"})
+		if err != nil {
+			w.WriteError("ERR " + err.Error())
+			break
+		}
+		if len(res.Entries) == 0 {
+			w.WriteNull()
+			break
+		}
+		w.WriteBulk(res.Entries[0].Response)
+	case "SET":
+		s.respSet(ctx, w, args)
+	case "DEL":
+		if len(args) < 2 {
+			arity(w, args, 2)
+			break
+		}
+		var n int64
+		for _, key := range args[1:] {
+			e, err := s.respFind(ctx, key)
+			if err != nil {
+				w.WriteError("ERR " + err.Error())
+				return true
+			}
+			if e != nil && s.store.DeleteEntry(ctx, e.ID) == nil {
+				n++
+			}
+		}
+		w.WriteInt(n)
+	default:
+		w.WriteError("ERR unknown command '" + args[0] + "'")
+	}
+	return true
+}
+
+// respSet handles SET key value [NX|XX] [EX s|PX ms|KEEPTTL]. Expiry options
+// are accepted for compatibility but entries use the server-wide TTL.
+func (s *Server) respSet(ctx context.Context, w *resp.Writer, args []string) {
+	if len(args) < 3 {
+		arity(w, args, 3)
+		return
+	}
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 >= len(args) {
+				w.WriteError("ERR syntax error")
+				return
+			}
+			if _, err := strconv.ParseInt(args[i+1], 10, 64); err != nil {
+				w.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			i++
+		default:
+			w.WriteError("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		w.WriteError("ERR syntax error")
+		return
+	}
+	if nx || xx {
+		e, err := s.respFind(ctx, args[1])
+		if err != nil {
+			w.WriteError("ERR " + err.Error())
+			return
+		}
+		if (nx && e != nil) || (xx && e == nil) {
+			w.WriteNull()
+			return
+		}
+	}
+	if err := s.putCached(ctx, args[1], "", args[2], nil); err != nil {
+		w.WriteError("ERR " + err.Error())
+		return
+	}
+	w.WriteSimple("OK")
+}
+
+// respFind returns the entry SET stored for key, if any.
+func (s *Server) respFind(ctx context.Context, key string) (*models.Entry, error) {
+	vec, err := s.embed(ctx, key, stageQuery)
+	if err != nil {
+		return nil, err
+	}
+	return s.findCached(ctx, key, "", vec)
+}
+
+func arity(w *resp.Writer, args []string, n int) bool {
+	if len(args) != n {
+		w.WriteError("ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command")
+		return false
+	}
+	return true
+}
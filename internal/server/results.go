@@ -0,0 +1,182 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// resultCache remembers whole search results for a short TTL, so a hot
+// query repeated within it skips embedding and vector search. Writes drop
+// the results of their namespace: a create or update those of searches
+// filtered to the entry's namespace and of unfiltered ones, a delete those
+// containing the entry, and a metadata change (which may move an entry to
+// another namespace or state) everything. A nil *resultCache caches nothing.
+type resultCache struct {
+	ttl  time.Duration
+	size int
+
+	mu    sync.Mutex
+	ll    *list.List // front: most recently stored
+	items map[string]*list.Element
+	// gen counts invalidations, so a search racing a write doesn't store
+	// what it read before the write.
+	gen uint64
+}
+
+type cachedResult struct {
+	key       string
+	namespace string // "" when the search covered every namespace
+	expires   time.Time
+	res       *searchResult
+}
+
+// newResultCache caches up to SLC_RESULT_CACHE_SIZE results (default 1000)
+// for SLC_RESULT_CACHE_TTL. It returns nil when the TTL is unset or 0.
+func newResultCache() *resultCache {
+	ttl := durationFromEnv("SLC_RESULT_CACHE_TTL", 0)
+	size := intFromEnv("SLC_RESULT_CACHE_SIZE", 1000)
+	if ttl <= 0 || size <= 0 {
+		return nil
+	}
+	return &resultCache{ttl: ttl, size: size, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// resultKey identifies the searches sharing a result: the normalized query
+// with everything that changes what it finds, including the caller's key,
+// since keys may see different namespaces.
+func (s *Server) resultKey(q searchQuery, p *principal) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\x00%d\x00%t\x00%t\x00%s\x00%s\x00%t\x00%g", s.canonical(q.namespace(), q.Text), q.Limit,
+		q.IncludeStale, q.IncludeDrafts, q.Scope, q.Federation, q.Highlight, q.Oversample)
+	for _, k := range slices.Sorted(maps.Keys(q.Filters)) {
+		fmt.Fprintf(&b, "\x00%s=%s", k, q.Filters[k])
+	}
+	if p != nil {
+		b.WriteString("\x00" + p.id)
+	}
+	return b.String()
+}
+
+// cacheable reports whether q's result may be cached: session searches
+// depend on the conversation so far, and image searches on the image.
+func (q searchQuery) cacheable() bool {
+	return q.Session == "" && q.Image == nil
+}
+
+// get returns a copy of the result stored under key, and the generation a
+// search that misses must pass to put.
+func (c *resultCache) get(key string, now time.Time) (*searchResult, uint64) {
+	if c == nil {
+		return nil, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, c.gen
+	}
+	item := el.Value.(*cachedResult)
+	if now.After(item.expires) {
+		c.unlinkLocked(el)
+		return nil, c.gen
+	}
+	return item.res.clone(), c.gen
+}
+
+// put stores a copy of res unless a write invalidated results since gen.
+func (c *resultCache) put(key, namespace string, res *searchResult, gen uint64, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.unlinkLocked(el)
+	}
+	c.items[key] = c.ll.PushFront(&cachedResult{key: key, namespace: namespace, expires: now.Add(c.ttl), res: res.clone()})
+	for c.ll.Len() > c.size {
+		c.unlinkLocked(c.ll.Back())
+	}
+}
+
+func (c *resultCache) unlinkLocked(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cachedResult).key)
+}
+
+// onChange drops the results a write may have changed.
+func (c *resultCache) onChange(ch change) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	var drop func(*cachedResult) bool
+	switch {
+	case (ch.kind == changeCreated || ch.kind == changeUpdated) && ch.entry != nil:
+		ns := ch.entry.Namespace()
+		drop = func(item *cachedResult) bool {
+			// an update may also remove the entry from results elsewhere
+			return item.namespace == "" || item.namespace == ns || item.res.contains(ch.id)
+		}
+	case ch.kind == changeDeleted:
+		drop = func(item *cachedResult) bool { return item.res.contains(ch.id) }
+	default:
+		c.resetLocked()
+		return
+	}
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if drop(el.Value.(*cachedResult)) {
+			c.unlinkLocked(el)
+		}
+		el = next
+	}
+}
+
+// reset drops every result, after the store was replaced by a restore.
+func (c *resultCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.resetLocked()
+}
+
+func (c *resultCache) resetLocked() {
+	c.ll.Init()
+	clear(c.items)
+}
+
+// clone copies r and its entries, which handlers may modify (redaction).
+func (r *searchResult) clone() *searchResult {
+	out := &searchResult{Entries: make([]*models.Entry, len(r.Entries)), Scores: slices.Clone(r.Scores), Tier: r.Tier}
+	for i, e := range r.Entries {
+		c := *e
+		c.Metadata = maps.Clone(e.Metadata)
+		out.Entries[i] = &c
+	}
+	return out
+}
+
+func (r *searchResult) contains(id int64) bool {
+	for _, e := range r.Entries {
+		if e.ID == id && e.Region == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+type revalidateRequest struct {
+	// Sources maps source IDs to their current content hash. An empty hash
+	// means the source was removed.
+	Sources  map[string]string `json:"sources"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Action is "stale" (default) or "delete".
+	Action string `json:"action,omitempty"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+type revalidateResponse struct {
+	Action  string  `json:"action"`
+	Matched int     `json:"matched"`
+	IDs     []int64 `json:"ids"`
+	DryRun  bool    `json:"dry_run,omitempty"`
+}
+
+// outdated reports whether any source of e (metadata.sources, a map of
+// source ID to content hash) has a different hash in current. Sources
+// current doesn't mention are assumed unchanged.
+func outdated(e *models.Entry, current map[string]string) bool {
+	recorded, _ := e.Metadata[models.MetaSources].(map[string]interface{})
+	for src, h := range recorded {
+		if now, ok := current[src]; ok && now != h {
+			return true
+		}
+	}
+	return false
+}
+
+// POST /revalidate
+func (s *Server) handleRevalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req revalidateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request: expected JSON {sources,metadata?,action?}; "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Sources) == 0 {
+		http.Error(w, "sources required", http.StatusBadRequest)
+		return
+	}
+	if req.Action == "" {
+		req.Action = "stale"
+	}
+	if req.Action != "delete" && req.Action != "stale" {
+		http.Error(w, "action must be stale or delete", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	resp := revalidateResponse{Action: req.Action, IDs: []int64{}, DryRun: req.DryRun}
+	for _, id := range s.store.AllIDs() {
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil || !matchesFilters(e, req.Metadata) {
+			continue
+		}
+		if req.Action == "stale" && e.Flag(models.MetaStale) {
+			continue
+		}
+		if !outdated(e, req.Sources) {
+			continue
+		}
+		if !req.DryRun {
+			if req.Action == "stale" {
+				err = s.store.UpdateEntryMetadata(ctx, id, map[string]interface{}{models.MetaStale: true}, false)
+			} else {
+				err = s.store.DeleteEntry(ctx, id)
+			}
+			if err != nil {
+				continue
+			}
+		}
+		resp.IDs = append(resp.IDs, id)
+	}
+	resp.Matched = len(resp.IDs)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
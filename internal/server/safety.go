@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var safetyChecks = metrics.NewCounter("slmcache_safety_checks_total",
+	"Responses checked before being served, by validator and outcome (pass, block, error).", "validator", "result")
+
+var moderationClient = &http.Client{}
+
+// validator inspects a cached response before it is served. check returns
+// a non-empty reason to block it.
+type validator interface {
+	name() string
+	check(ctx context.Context, e *models.Entry) (reason string, err error)
+}
+
+// denylist blocks responses matching any of its patterns.
+type denylist struct {
+	patterns []*regexp.Regexp
+}
+
+func (denylist) name() string { return "denylist" }
+
+func (d denylist) check(_ context.Context, e *models.Entry) (string, error) {
+	for _, re := range d.patterns {
+		if re.MatchString(e.Response) {
+			return "denylist: " + re.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// moderator asks an OpenAI-compatible moderation endpoint whether a
+// response is flagged.
+type moderator struct {
+	url, model string
+	timeout    time.Duration
+}
+
+func (moderator) name() string { return "moderation" }
+
+func (m moderator) check(ctx context.Context, e *models.Entry) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	body, _ := json.Marshal(map[string]string{"model": m.model, "input": e.Response})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key := config.Secret("SLC_SAFETY_MODERATION_KEY"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := moderationClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("moderation: %s", resp.Status)
+	}
+	var out struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	for _, r := range out.Results {
+		if !r.Flagged {
+			continue
+		}
+		var cats []string
+		for c, on := range r.Categories {
+			if on {
+				cats = append(cats, c)
+			}
+		}
+		sort.Strings(cats)
+		return "moderation: " + strings.Join(cats, ","), nil
+	}
+	return "", nil
+}
+
+// safetyChecker runs the configured validators over hits and remembers
+// which entry versions passed, so an entry is checked once per update
+// rather than on every hit. It is rebuilt, with an empty memory, whenever
+// the SLC_SAFETY_* settings change.
+type safetyChecker struct {
+	validators []validator
+	action     string
+
+	mu       sync.Mutex
+	approved map[int64]time.Time // entry ID -> UpdatedAt that passed
+}
+
+// maxApproved bounds the approval memory; it is cleared when full.
+const maxApproved = 10000
+
+// newSafetyChecker builds the validators from SLC_SAFETY_DENYLIST (regular
+// expressions, one per line) and SLC_SAFETY_MODERATION_URL. It returns nil
+// when neither is set.
+func newSafetyChecker() *safetyChecker {
+	c := &safetyChecker{action: config.Get("SLC_SAFETY_ACTION"), approved: map[int64]time.Time{}}
+	var d denylist
+	for _, line := range strings.Split(config.Get("SLC_SAFETY_DENYLIST"), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			log.Printf("server: ignoring safety denylist pattern %q: %v", line, err)
+			continue
+		}
+		d.patterns = append(d.patterns, re)
+	}
+	if len(d.patterns) > 0 {
+		c.validators = append(c.validators, d)
+	}
+	if u := config.Get("SLC_SAFETY_MODERATION_URL"); u != "" {
+		c.validators = append(c.validators, moderator{
+			url:     u,
+			model:   config.Get("SLC_SAFETY_MODERATION_MODEL"),
+			timeout: durationFromEnv("SLC_SAFETY_MODERATION_TIMEOUT", 2*time.Second),
+		})
+	}
+	if len(c.validators) == 0 {
+		return nil
+	}
+	return c
+}
+
+// verdict returns why e must not be served, or "" if it may. A validator
+// that fails is counted and skipped, so an unreachable moderation service
+// doesn't take the cache down with it.
+func (c *safetyChecker) verdict(ctx context.Context, e *models.Entry) string {
+	c.mu.Lock()
+	at, ok := c.approved[e.ID]
+	c.mu.Unlock()
+	if ok && e.Region == "" && at.Equal(e.UpdatedAt) {
+		return ""
+	}
+	for _, v := range c.validators {
+		reason, err := v.check(ctx, e)
+		switch {
+		case err != nil:
+			safetyChecks.Inc(v.name(), "error")
+			log.Printf("server: safety check %s failed: %v", v.name(), err)
+		case reason != "":
+			safetyChecks.Inc(v.name(), "block")
+			return reason
+		default:
+			safetyChecks.Inc(v.name(), "pass")
+		}
+	}
+	if e.Region == "" {
+		c.mu.Lock()
+		if len(c.approved) >= maxApproved {
+			c.approved = map[int64]time.Time{}
+		}
+		c.approved[e.ID] = e.UpdatedAt
+		c.mu.Unlock()
+	}
+	return ""
+}
+
+func (s *Server) getSafety() *safetyChecker {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.safety
+}
+
+// screen removes the results that don't conform to their declared schema
+// or fail a safety check. Blocked local entries are marked stale with the
+// reason in metadata.safety (SLC_SAFETY_ACTION stale, the default), deleted
+// (delete), or left alone (drop).
+func (s *Server) screen(ctx context.Context, res *searchResult) {
+	s.conform(res)
+	c := s.getSafety()
+	if c == nil || len(res.Entries) == 0 {
+		return
+	}
+	entries := res.Entries[:0]
+	scores := res.Scores[:0]
+	for i, e := range res.Entries {
+		reason := c.verdict(ctx, e)
+		if reason == "" {
+			entries = append(entries, e)
+			scores = append(scores, res.Scores[i])
+			continue
+		}
+		if e.Region != "" {
+			continue
+		}
+		log.Printf("server: entry %d blocked: %s", e.ID, reason)
+		var err error
+		switch c.action {
+		case "drop":
+		case "delete":
+			err = s.store.DeleteEntry(ctx, e.ID)
+		default:
+			err = s.store.UpdateEntryMetadata(ctx, e.ID, map[string]interface{}{
+				models.MetaStale:  true,
+				models.MetaSafety: reason,
+			}, false)
+		}
+		if err != nil {
+			log.Printf("server: quarantining entry %d: %v", e.ID, err)
+		}
+	}
+	res.Entries, res.Scores = entries, scores
+}
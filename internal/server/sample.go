@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+const (
+	defaultSampleSize = 50
+	maxSampleSize     = 1000
+)
+
+// GET /entries/sample?n=50&strategy=random|stratified[&by=metadata.<key>][&seed=...]
+func (s *Server) handleEntriesSample(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	n := defaultSampleSize
+	if v := q.Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > maxSampleSize {
+			http.Error(w, fmt.Sprintf("n must be between 1 and %d", maxSampleSize), http.StatusBadRequest)
+			return
+		}
+		n = parsed
+	}
+	rng := rand.New(rand.NewSource(rand.Int63()))
+	if v := q.Get("seed"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid seed", http.StatusBadRequest)
+			return
+		}
+		rng = rand.New(rand.NewSource(seed))
+	}
+	key := ""
+	switch q.Get("strategy") {
+	case "", "random":
+	case "stratified":
+		key = models.MetaNamespace
+		if by := q.Get("by"); by != "" {
+			if !strings.HasPrefix(by, "metadata.") || by == "metadata." {
+				http.Error(w, "by must be metadata.<key>", http.StatusBadRequest)
+				return
+			}
+			key = strings.TrimPrefix(by, "metadata.")
+		}
+	default:
+		http.Error(w, "strategy must be random or stratified", http.StatusBadRequest)
+		return
+	}
+	entries, err := s.store.FindEntriesByMetadata(r.Context(), metadataFiltersFromQuery(q))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fresh := make([]*models.Entry, 0, len(entries))
+	for _, e := range entries {
+		if !s.expireIfNeeded(r.Context(), e) {
+			fresh = append(fresh, e)
+		}
+	}
+	var out []*models.Entry
+	if key == "" {
+		out = sampleRandom(rng, fresh, n)
+	} else {
+		out = sampleStratified(rng, fresh, n, key)
+	}
+	redact(r, out...)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// sampleRandom picks n entries uniformly without replacement.
+func sampleRandom(rng *rand.Rand, entries []*models.Entry, n int) []*models.Entry {
+	rng.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// sampleStratified groups entries by the value of metadata key and shares n
+// equally between the groups, so rare groups are reviewed as closely as
+// common ones. Slots a small group can't fill go to the larger ones.
+func sampleStratified(rng *rand.Rand, entries []*models.Entry, n int, key string) []*models.Entry {
+	groups := map[string][]*models.Entry{}
+	for _, e := range entries {
+		v := ""
+		if raw, ok := e.Metadata[key]; ok {
+			v = fmt.Sprint(raw)
+		}
+		groups[v] = append(groups[v], e)
+	}
+	names := make([]string, 0, len(groups))
+	for name, g := range groups {
+		rng.Shuffle(len(g), func(i, j int) { g[i], g[j] = g[j], g[i] })
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// deal one entry per group per round until n are picked or all run out
+	out := []*models.Entry{}
+	for round := 0; len(out) < n; round++ {
+		dealt := false
+		for _, name := range names {
+			if g := groups[name]; round < len(g) && len(out) < n {
+				out = append(out, g[round])
+				dealt = true
+			}
+		}
+		if !dealt {
+			break
+		}
+	}
+	return out
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/cron"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// schedule is a cron-driven maintenance job scoped to a namespace and
+// metadata filters, e.g. purge metadata.category=pricing nightly.
+type schedule struct {
+	Name      string            `json:"name"`
+	Cron      string            `json:"cron"`
+	Namespace string            `json:"namespace,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	// Action is "purge" (delete matches) or "refresh" (mark matches stale so
+	// orchestrators regenerate them on the next request).
+	Action       string    `json:"action"`
+	LastRun      time.Time `json:"last_run,omitempty"`
+	LastAffected int       `json:"last_affected"`
+	NextRun      time.Time `json:"next_run,omitempty"`
+
+	parsed *cron.Schedule
+	// from is the time the schedule was last evaluated; the next activation
+	// after it is due once now passes it.
+	from time.Time
+}
+
+func (sc *schedule) validate() error {
+	if sc.Name == "" || strings.Contains(sc.Name, "/") {
+		return errors.New("schedule name required (no slashes)")
+	}
+	if sc.Action == "" {
+		sc.Action = "purge"
+	}
+	if sc.Action != "purge" && sc.Action != "refresh" {
+		return errors.New("action must be purge or refresh")
+	}
+	parsed, err := cron.Parse(sc.Cron)
+	if err != nil {
+		return err
+	}
+	sc.parsed = parsed
+	return nil
+}
+
+// loadSchedules seeds schedules from SLC_SCHEDULES (a JSON array).
+func (s *Server) loadSchedules() {
+	raw := config.Get("SLC_SCHEDULES")
+	if raw == "" {
+		return
+	}
+	var list []*schedule
+	if err := json.Unmarshal([]byte(raw), &list); err != nil {
+		log.Printf("server: ignoring SLC_SCHEDULES: %v", err)
+		return
+	}
+	for _, sc := range list {
+		if err := s.putSchedule(sc, time.Now()); err != nil {
+			log.Printf("server: ignoring schedule %q: %v", sc.Name, err)
+		}
+	}
+}
+
+func (s *Server) putSchedule(sc *schedule, now time.Time) error {
+	if err := sc.validate(); err != nil {
+		return err
+	}
+	sc.from = now
+	sc.NextRun = sc.parsed.Next(now)
+	s.schedMu.Lock()
+	s.schedules[sc.Name] = sc
+	s.schedMu.Unlock()
+	return nil
+}
+
+// runSchedules executes every schedule whose next activation is due.
+func (s *Server) runSchedules(ctx context.Context, now time.Time) {
+	s.schedMu.Lock()
+	due := []*schedule{}
+	for _, sc := range s.schedules {
+		if next := sc.parsed.Next(sc.from); !next.IsZero() && !next.After(now) {
+			sc.from = now
+			sc.NextRun = sc.parsed.Next(now)
+			due = append(due, sc)
+		}
+	}
+	s.schedMu.Unlock()
+	for _, sc := range due {
+		n, err := s.applySchedule(ctx, sc)
+		if err != nil {
+			log.Printf("server: schedule %s failed: %v", sc.Name, err)
+		}
+		s.schedMu.Lock()
+		sc.LastRun = now
+		sc.LastAffected = n
+		s.schedMu.Unlock()
+	}
+}
+
+func (s *Server) applySchedule(ctx context.Context, sc *schedule) (int, error) {
+	entries, err := s.findEntries(ctx, sc.Namespace, sc.Metadata)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if e.Flag(models.MetaPinned) {
+			continue
+		}
+		if sc.Action == "refresh" {
+			err = s.store.UpdateEntryMetadata(ctx, e.ID, map[string]interface{}{models.MetaStale: true}, false)
+		} else {
+			err = s.store.DeleteEntry(ctx, e.ID)
+		}
+		if err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// findEntries lists entries in namespace (all namespaces when empty) that
+// match the metadata filters.
+func (s *Server) findEntries(ctx context.Context, namespace string, filters map[string]string) ([]*models.Entry, error) {
+	query := make(map[string]string, len(filters)+1)
+	for k, v := range filters {
+		query[k] = v
+	}
+	if namespace != "" && namespace != models.DefaultNamespace {
+		query[models.MetaNamespace] = namespace
+	}
+	if len(query) == 0 {
+		query = nil
+	}
+	entries, err := s.store.FindEntriesByMetadata(ctx, query)
+	if err != nil || namespace == "" {
+		return entries, err
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		if e.Namespace() == namespace {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// /admin/schedules and /admin/schedules/{name}
+func (s *Server) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/schedules"), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		s.schedMu.Lock()
+		out := make([]*schedule, 0, len(s.schedules))
+		for _, sc := range s.schedules {
+			out = append(out, sc)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		data, _ := json.Marshal(out)
+		s.schedMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(append(data, '\n'))
+	case r.Method == http.MethodGet:
+		s.schedMu.Lock()
+		sc, ok := s.schedules[name]
+		var data []byte
+		if ok {
+			data, _ = json.Marshal(sc)
+		}
+		s.schedMu.Unlock()
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(append(data, '\n'))
+	case r.Method == http.MethodPost && name == "", r.Method == http.MethodPut && name != "":
+		var sc schedule
+		if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+			http.Error(w, "bad request: expected JSON {name,cron,namespace?,metadata?,action?}; "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name != "" {
+			sc.Name = name
+		}
+		if err := s.putSchedule(&sc, time.Now()); err != nil {
+			http.Error(w, fmt.Sprintf("invalid schedule: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_ = json.NewEncoder(w).Encode(&sc)
+	case r.Method == http.MethodDelete && name != "":
+		s.schedMu.Lock()
+		_, ok := s.schedules[name]
+		delete(s.schedules, name)
+		s.schedMu.Unlock()
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"log"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/schema"
+)
+
+var schemaChecks = metrics.NewCounter("slmcache_schema_checks_total",
+	"Responses checked against their declared JSON schema before being served, by result (pass, fail).", "result")
+
+// checkSchema rejects entries declaring a metadata.json_schema that isn't
+// a schema.
+func checkSchema(e *models.Entry) error {
+	v, ok := e.Metadata[models.MetaSchema]
+	if !ok {
+		return nil
+	}
+	_, err := schema.Parse(v)
+	return err
+}
+
+// conformsTo reports why e's response doesn't conform to the JSON schema
+// it declares, or to fallback when it declares none, or "" if it does or
+// there is no schema.
+func conformsTo(e *models.Entry, fallback interface{}) string {
+	v, ok := e.Metadata[models.MetaSchema]
+	if !ok {
+		if v, ok = fallback, fallback != nil; !ok {
+			return ""
+		}
+	}
+	s, err := schema.Parse(v)
+	if err == nil {
+		err = schema.ValidateJSON(s, e.Response)
+	}
+	if err != nil {
+		schemaChecks.Inc("fail")
+		return err.Error()
+	}
+	schemaChecks.Inc("pass")
+	return ""
+}
+
+// conform removes the results whose response no longer conforms to their
+// declared schema: a structured-output consumer is better off with a miss
+// and a fresh generation than with a cached answer it can't parse.
+func (s *Server) conform(res *searchResult) {
+	entries := res.Entries[:0]
+	scores := res.Scores[:0]
+	for i, e := range res.Entries {
+		if reason := conformsTo(e, s.namespaceSchema(e)); reason != "" {
+			log.Printf("server: entry %d doesn't conform to its schema: %s", e.ID, reason)
+			continue
+		}
+		entries = append(entries, e)
+		scores = append(scores, res.Scores[i])
+	}
+	res.Entries, res.Scores = entries, scores
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// bindScope moves a scope supplied at store time into metadata.scope. An
+// entry's scope is part of its identity: lookups only see entries whose
+// scope matches their own, so answers never cross models or personas.
+func bindScope(e *models.Entry) {
+	h := e.Scope.Hash()
+	e.Scope = nil
+	if h == "" {
+		return
+	}
+	if e.Metadata == nil {
+		e.Metadata = map[string]interface{}{}
+	}
+	e.Metadata[models.MetaScope] = h
+}
+
+// scopeFromQuery reads the lookup scope of a /search request: either a
+// precomputed hash (scope=) or the system_prompt, model and temperature
+// parameters it was derived from.
+func scopeFromQuery(v url.Values) string {
+	if h := v.Get("scope"); h != "" {
+		return h
+	}
+	sc := &models.Scope{SystemPrompt: v.Get("system_prompt"), Model: v.Get("model")}
+	if t, err := strconv.ParseFloat(v.Get("temperature"), 64); err == nil {
+		sc.Temperature = &t
+	}
+	return sc.Hash()
+}
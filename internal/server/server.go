@@ -3,30 +3,101 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jeefy/slmcache/internal/blob"
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/events"
+	"github.com/jeefy/slmcache/internal/lexical"
+	"github.com/jeefy/slmcache/internal/metrics"
 	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/querylog"
+	"github.com/jeefy/slmcache/internal/resp"
 	"github.com/jeefy/slmcache/internal/slm"
 	"github.com/jeefy/slmcache/internal/store"
 )
 
 type Server struct {
-	store store.Store
-	slm   slm.SLM
-	mux   *http.ServeMux
+	// store is the observed view of backend used by handlers, limited to the
+	// namespaces of the request's API key; capability checks (optional
+	// interfaces) go against backend directly.
+	store    store.Store
+	backend  store.Store
+	observed *observedStore
+	slm      slm.SLM
+	gen      slm.Generator
+	img      slm.ImageEmbedder // nil unless SLM_IMAGE_URL is set
+	mux      *http.ServeMux
+	chaos    chaos
+
+	observers  []func(change)
+	exact      *exactTier
+	hits       *hitTracker
+	thrash     *thrashTracker // nil when SLC_THRASH_MAX=0
+	classifier *cacheability  // nil unless SLC_CACHEABILITY is set
+	resp       *resp.Server
+	queryLog   *querylog.Logger
+	prefetch   *prefetcher
+	sessions   *sessionTracker
+	slo        *sloTracker
+	shed       *shedder
+	storeDown  atomic.Bool // the last store health check failed
+	draining   atomic.Bool
+	warming    atomic.Bool // the startup warm-up is still running
+	dashboard  *dashboard
+	expansions expansionCache
+	synonyms   synonymCache
+	namespaces namespaceCache
+	quotas     quotaTracker
+	lexicon    *lexIndex
+	results    *resultCache
+	events     *events.Emitter
+	outbox     *outbox
+	embedGate  *priorityGate
+	blobs      blob.Store // nil unless SLC_BLOB_STORE is set
+
+	schedMu   sync.Mutex
+	schedules map[string]*schedule
+
+	driftMu   sync.Mutex
+	lastDrift *driftReport
+
+	asOf asOfStates
 
 	entryTTL      time.Duration
+	toolTTLs      map[string]time.Duration
 	purgeInterval time.Duration
 	janitorStop   chan struct{}
 	janitorWG     sync.WaitGroup
 	closeOnce     sync.Once
+
+	instanceID string
+	leaseMu    sync.Mutex
+	leases     map[string]struct{}
+
+	// cfgMu guards settings that can be hot-reloaded (slm, gen, entryTTL,
+	// toolTTLs, safety, jwt, limiter, analyzer, scoreProfiles, uncacheable).
+	cfgMu          sync.RWMutex
+	safety         *safetyChecker
+	jwt            *jwtVerifier
+	limiter        limiter
+	analyzer       lexical.Analyzer
+	scoreProfiles  []scoreProfile
+	uncacheable    []uncacheableRule
+	stopConfigSubs func()
+}
+
+// patchRequest is the body of PATCH /entries/{id}.
+type patchRequest struct {
+	Pinned *bool `json:"pinned,omitempty"`
 }
 
 type metadataRequest struct {
@@ -38,56 +109,209 @@ func New(st store.Store) *Server {
 	entryTTL := durationFromEnv("SLC_ENTRY_TTL", 24*time.Hour)
 	purgeEvery := durationFromEnv("SLC_PURGE_INTERVAL", time.Minute)
 	s := &Server{
-		store:         st,
+		backend:       st,
 		slm:           slm.NewDefaultSLM(),
+		gen:           slm.NewGeneratorFromEnv(),
+		img:           slm.NewImageEmbedderFromEnv(),
 		mux:           http.NewServeMux(),
 		entryTTL:      entryTTL,
+		toolTTLs:      parseToolTTLs(),
 		purgeInterval: purgeEvery,
 		janitorStop:   make(chan struct{}),
+		instanceID:    instanceID(),
+		leases:        make(map[string]struct{}),
+		hits:          newHitTracker(),
+		queryLog:      newQueryLogger(),
+		prefetch:      newPrefetcher(),
+		sessions:      newSessionTracker(),
+		safety:        newSafetyChecker(),
+		jwt:           newJWTVerifier(),
+		slo:           newSLOTracker(),
+		limiter:       newLimiter(),
+		shed:          newShedder(),
+		dashboard:     newDashboard(),
+		embedGate:     newEmbedGate(),
+		analyzer:      newAnalyzer(),
+		scoreProfiles: newScoreProfiles(),
+		uncacheable:   newUncacheableRules(),
+		lexicon:       newLexIndex(),
+		results:       newResultCache(),
+		blobs:         newBlobStore(),
+		schedules:     make(map[string]*schedule),
+		classifier:    newCacheability(),
+	}
+	s.exact = newExactTier(intFromEnv("SLC_L1_SIZE", 1024), s.entryKey)
+	s.observed = &observedStore{Store: st, notify: s.emit, journal: openJournal()}
+	s.store = authzStore{Store: s.observed, admit: s.admitEntry, encrypted: s.encryptedNamespace}
+	// with a write-ahead log, expiries must be journaled, so they stay with
+	// the janitor rather than the store
+	if ex, ok := st.(store.Expirer); ok && s.observed.journal == nil {
+		ex.SetExpiry(s.expiryOf)
 	}
+	s.observe(s.exact.onChange)
+	s.observe(s.hits.onChange)
+	if s.thrash = newThrashTracker(s.entryKey); s.thrash != nil {
+		s.observe(s.thrash.onChange)
+	}
+	s.observe(s.onLexicalChange)
+	s.observe(s.results.onChange)
+	s.observe(s.exportCompression)
+	if s.blobs != nil {
+		s.observe(s.onBlobChange)
+	}
+	s.exportCompression(change{})
+	s.outbox = newOutbox(st)
+	s.startEvents()
+	s.resp = &resp.Server{NewHandler: s.newRESPConn, Allow: allowRESP}
+	s.stopConfigSubs = config.OnChange(s.reloadConfig)
+	s.loadSchedules()
+	s.startSynonymRefresh()
+	s.startNamespaceRefresh()
+	s.startHitFlush()
 	s.routes()
 	s.startJanitor()
+	s.startPrefetcher()
+	s.startSLOExport()
+	s.startDashboard()
+	s.startReindex()
+	s.startWarmup()
+	s.startIngest()
 	return s
 }
 
 // Close stops background goroutines started by the server.
 func (s *Server) Close() {
 	s.closeOnce.Do(func() {
+		if s.stopConfigSubs != nil {
+			s.stopConfigSubs()
+		}
 		if s.janitorStop != nil {
 			close(s.janitorStop)
 		}
 		s.janitorWG.Wait()
+		s.releaseLeases()
+		s.resp.Close()
+		_ = s.queryLog.Close()
+		_ = s.events.Close()
+		_ = s.observed.journal.Close()
 	})
 }
 
-func (s *Server) Router() http.Handler { return s.mux }
+func (s *Server) Router() http.Handler {
+	return countInFlight(allowlist(traced(s.authenticate(prioritize(s.rateLimit(s.trackSLO(s.shedLoad(s.injectFaults(s.requireStore(s.mux))))))))))
+}
+
+// Handle routes pattern to h behind Router's middleware: the allowlists,
+// authentication and rate limits. Patterns under /cluster/ need an admin
+// key. It must be called before the router serves requests.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
 
 func (s *Server) routes() {
 	s.mux.HandleFunc("/entries", s.handleEntries)
 	s.mux.HandleFunc("/entries/", s.handleEntryByID)
+	s.mux.HandleFunc("/entries/batch", s.handleEntriesBatch)
+	s.mux.HandleFunc("/entries/count", s.handleEntriesCount)
+	s.mux.HandleFunc("/entries/aggregate", s.handleEntriesAggregate)
+	s.mux.HandleFunc("/entries/metadata", s.handleEntriesMetadata)
+	s.mux.HandleFunc("/entries/sample", s.handleEntriesSample)
+	s.mux.HandleFunc("/ns/", s.handleNamespaceEntries)
+	s.mux.HandleFunc("/namespaces", s.handleNamespaces)
+	s.mux.HandleFunc("/namespaces/", s.handleNamespaces)
 	s.mux.HandleFunc("/slm-backend", s.handleSLMBackend)
 	s.mux.HandleFunc("/search", s.handleSearch)
+	s.mux.HandleFunc("/search/batch", s.handleSearchBatch)
+	s.mux.HandleFunc("/encrypted/entries", s.handleEncryptedEntries)
+	s.mux.HandleFunc("/encrypted/search", s.handleEncryptedSearch)
+	s.mux.HandleFunc("/estimate", s.handleEstimate)
+	s.mux.HandleFunc("/invalidate", s.handleInvalidate)
+	s.mux.HandleFunc("/revalidate", s.handleRevalidate)
+	s.mux.HandleFunc("/stats/slo", s.handleSLOStats)
+	s.mux.HandleFunc("/stats/thrash", s.handleThrashStats)
+	s.mux.HandleFunc("/stats/dashboard", s.handleDashboard)
+	s.mux.HandleFunc("/stats/dashboard/grafana", handleGrafanaDashboard)
+	s.mux.HandleFunc("/get", s.handleCacheGet)
+	s.mux.HandleFunc("/put", s.handleCachePut)
+	s.mux.HandleFunc("/tools/get", s.handleToolGet)
+	s.mux.HandleFunc("/tools/put", s.handleToolPut)
+	s.mux.HandleFunc("/admin/schedules", s.handleSchedules)
+	s.mux.HandleFunc("/admin/schedules/", s.handleSchedules)
+	s.mux.HandleFunc("/admin/synonyms", s.handleSynonyms)
+	s.mux.HandleFunc("/admin/synonyms/", s.handleSynonyms)
+	s.mux.HandleFunc("/admin/uncacheable", s.handleUncacheable)
+	s.mux.HandleFunc("/admin/drift", s.handleDrift)
+	s.mux.HandleFunc("/admin/doctor", s.handleDoctor)
+	s.mux.HandleFunc("/admin/chaos", s.handleChaos)
+	s.mux.HandleFunc("/admin/garbage", s.handleGarbage)
+	s.mux.HandleFunc("/admin/backfill", s.handleBackfill)
+	s.mux.HandleFunc("/admin/backup", s.handleBackup)
+	s.mux.HandleFunc("/admin/restore", s.handleRestore)
+	s.mux.HandleFunc("/admin/sync", s.handleSync)
+	s.mux.HandleFunc("/admin/sync/", s.handleSync)
+	s.mux.Handle("/metrics", metrics.Handler())
+	s.mux.HandleFunc("/readyz", s.handleReady)
 }
 
-// POST /entries
+// POST /entries[?session_id=...]
 func (s *Server) handleEntries(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
 		var e models.Entry
-		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		image, err := decodeEntry(w, r, &e)
+		if errors.Is(err, errImageTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
 			// include a brief hint about expected JSON structure
-			http.Error(w, "bad request: expected JSON {prompt,response,metadata?}; "+err.Error(), http.StatusBadRequest)
+			http.Error(w, "bad request: expected JSON {prompt,response,metadata?,provenance?}; "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		// embed prompt using the local SLM
-		vec, err := s.slm.Embed(e.Prompt)
+		if err := e.Provenance.Validate(); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkReserved(&e); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := admitQuality(&e, "/entries"); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err := s.admitUncacheable(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err := s.admitThrash(&e, "/entries"); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		s.classify(r.Context(), &e)
+		if err := initialState(&e); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		bindScope(&e)
+		// embed prompt (and image) using the local SLM
+		vec, err := s.embedEntry(r.Context(), &e, image, stageInsert)
 		if err != nil {
-			http.Error(w, "embed error", http.StatusInternalServerError)
+			embedError(w, err)
 			return
 		}
-		id, err := s.store.CreateEntryWithVector(r.Context(), &e, vec)
+		// a turn of a conversation is stored where a session search for it
+		// looks, and kept out of plain exact-match lookups
+		if v, blended := s.sessions.contextualize(r.URL.Query().Get("session_id"), vec); blended && image == nil {
+			vec = v
+			if e.Metadata == nil {
+				e.Metadata = map[string]interface{}{}
+			}
+			e.Metadata[models.MetaContextual] = true
+		}
+		id, err := s.createEntry(r.Context(), &e, vec)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			s.respondStoreError(w, err)
 			return
 		}
 		e.ID = id
@@ -108,6 +332,7 @@ func (s *Server) handleEntries(w http.ResponseWriter, r *http.Request) {
 			}
 			fresh = append(fresh, entry)
 		}
+		redact(r, fresh...)
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(fresh)
 	default:
@@ -129,6 +354,18 @@ func (s *Server) handleEntryByID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid id", http.StatusBadRequest)
 		return
 	}
+	if len(parts) == 2 && parts[1] == "state" {
+		s.handleEntryState(w, r, id)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "blob" {
+		s.handleEntryBlob(w, r, id)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "response" {
+		s.handleEntryResponse(w, r, id)
+		return
+	}
 	if len(parts) > 1 {
 		s.handleEntryMetadata(w, r, id, parts[1:])
 		return
@@ -136,6 +373,13 @@ func (s *Server) handleEntryByID(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	switch r.Method {
 	case http.MethodGet:
+		if at, ok, err := parseAsOf(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if ok {
+			s.handleEntryAsOf(w, r, id, at)
+			return
+		}
 		e, err := s.store.GetEntry(ctx, id)
 		if err != nil {
 			http.Error(w, "not found", http.StatusNotFound)
@@ -145,33 +389,92 @@ func (s *Server) handleEntryByID(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		redact(r, e)
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(e)
 	case http.MethodPut:
-		if existing, err := s.store.GetEntry(ctx, id); err == nil {
-			if s.expireIfNeeded(ctx, existing) {
-				http.Error(w, "not found", http.StatusNotFound)
-				return
-			}
-		} else {
+		existing, err := s.store.GetEntry(ctx, id)
+		if err != nil || s.expireIfNeeded(ctx, existing) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
 		var e models.Entry
-		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		image, err := decodeEntry(w, r, &e)
+		if errors.Is(err, errImageTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		vec, err := s.slm.Embed(e.Prompt)
+		if image == nil && existing.ImageHash() != "" {
+			http.Error(w, "the entry is conditioned on an image; send it again as a multipart form with the image", http.StatusConflict)
+			return
+		}
+		if err := e.Provenance.Validate(); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkReserved(&e); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := admitQuality(&e, "/entries"); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err := s.admitUncacheable(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err := s.admitThrash(&e, "/entries"); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		s.classify(r.Context(), &e)
+		if err := keepState(existing, &e); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		keepBlob(existing, &e)
+		bindScope(&e)
+		vec, err := s.embedEntry(ctx, &e, image, stageInsert)
 		if err != nil {
-			http.Error(w, "embed error", http.StatusInternalServerError)
+			embedError(w, err)
 			return
 		}
-		if err := s.store.UpdateEntryWithVector(ctx, id, &e, vec); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := s.updateEntry(ctx, id, existing, &e, vec); err != nil {
+			s.respondStoreError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		var req patchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Pinned == nil {
+			http.Error(w, "bad request: expected JSON {pinned}", http.StatusBadRequest)
+			return
+		}
+		if e, err := s.store.GetEntry(ctx, id); err != nil || s.expireIfNeeded(ctx, e) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if *req.Pinned {
+			err = s.store.UpdateEntryMetadata(ctx, id, map[string]interface{}{models.MetaPinned: true}, false)
+		} else {
+			err = s.store.DeleteEntryMetadata(ctx, id, models.MetaPinned)
+		}
+		if err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(e)
 	case http.MethodDelete:
 		if err := s.store.DeleteEntry(ctx, id); err != nil {
 			http.Error(w, "not found", http.StatusNotFound)
@@ -220,11 +523,17 @@ func (s *Server) handleEntryMetadata(w http.ResponseWriter, r *http.Request, id
 			http.Error(w, "metadata payload required", http.StatusBadRequest)
 			return
 		}
-		if e, err := s.store.GetEntry(r.Context(), id); err != nil {
+		current, err := s.store.GetEntry(r.Context(), id)
+		if err != nil || s.expireIfNeeded(r.Context(), current) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
-		} else if s.expireIfNeeded(r.Context(), e) {
-			http.Error(w, "not found", http.StatusNotFound)
+		}
+		if err := keepState(current, &models.Entry{Metadata: payload.Metadata}); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err := checkReserved(&models.Entry{Metadata: payload.Metadata}); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 		if err := s.store.UpdateEntryMetadata(r.Context(), id, payload.Metadata, payload.Replace); err != nil {
@@ -255,15 +564,34 @@ func (s *Server) handleEntryMetadata(w http.ResponseWriter, r *http.Request, id
 		if len(extra) == 1 && extra[0] != "" {
 			keys = []string{extra[0]}
 		}
-		if e, err := s.store.GetEntry(r.Context(), id); err == nil {
-			if s.expireIfNeeded(r.Context(), e) {
-				http.Error(w, "not found", http.StatusNotFound)
-				return
-			}
-		} else {
+		current, err := s.store.GetEntry(r.Context(), id)
+		if err != nil || s.expireIfNeeded(r.Context(), current) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		if current.State() == models.StateArchived {
+			http.Error(w, errArchived.Error(), http.StatusConflict)
+			return
+		}
+		// the lifecycle state survives clearing metadata
+		if _, ok := current.Metadata[models.MetaState]; ok {
+			if len(keys) == 1 && keys[0] == models.MetaState {
+				http.Error(w, models.MetaState+" changes through POST /entries/{id}/state", http.StatusConflict)
+				return
+			}
+			if len(keys) == 0 {
+				keys = []string{}
+				for k := range current.Metadata {
+					if k != models.MetaState {
+						keys = append(keys, k)
+					}
+				}
+				if len(keys) == 0 {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+		}
 		if err := s.store.DeleteEntryMetadata(r.Context(), id, keys...); err != nil {
 			s.respondStoreError(w, err)
 			return
@@ -278,6 +606,22 @@ func (s *Server) respondStoreError(w http.ResponseWriter, err error) {
 	if err == nil {
 		return
 	}
+	if errors.Is(err, errForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errUndeclaredNamespace) || errors.Is(err, errEncryptedNamespace) || errors.Is(err, errNotEncrypted) {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if errors.Is(err, store.ErrUnavailable) {
+		storeUnavailable(w)
+		return
+	}
 	if strings.Contains(strings.ToLower(err.Error()), "not found") {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
@@ -285,70 +629,374 @@ func (s *Server) respondStoreError(w http.ResponseWriter, err error) {
 	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
-// DELETE /entries/{id}
-// and handler for /slm-backend
+// slmBackend is the body of GET /slm-backend. Dimensions and LatencyMS come
+// from embedding a probe prompt on each request; Error replaces them when the
+// probe failed.
+type slmBackend struct {
+	Backend    string  `json:"backend"`
+	Model      string  `json:"model,omitempty"`
+	Fallback   string  `json:"fallback,omitempty"` // why the mock replaced Ollama
+	Dimensions int     `json:"dimensions,omitempty"`
+	LatencyMS  float64 `json:"latency_ms,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// GET /slm-backend
 func (s *Server) handleSLMBackend(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	// try to assert BackendName method
-	type namer interface {
-		BackendName() string
-	}
-	if n, ok := s.slm.(namer); ok {
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]string{"backend": n.BackendName()})
+	m := s.getSLM()
+	n, ok := m.(interface{ BackendName() string })
+	if !ok {
+		http.Error(w, "unknown", http.StatusInternalServerError)
 		return
 	}
-	http.Error(w, "unknown", http.StatusInternalServerError)
+	out := slmBackend{Backend: n.BackendName(), Fallback: slm.Fallback(m)}
+	if mn, ok := m.(interface{ ModelName() string }); ok {
+		out.Model = mn.ModelName()
+	}
+	start := time.Now()
+	vec, err := m.Embed("slmcache backend probe")
+	if err != nil {
+		out.Error = err.Error()
+	} else {
+		out.Dimensions = len(vec)
+		out.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
 }
 
-// GET /search?q=...&limit=...
+// GET /search?q=...&limit=...[&session_id=...][&fields=id,prompt,score][&highlight=true][&oversample=3][&cursor=...]
 func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	var image []byte
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		// an image-conditioned search: a multipart form with the image
+		var err error
+		if image, err = readImage(w, r); errors.Is(err, errImageTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil || image == nil {
+			http.Error(w, "bad request: POST /search takes a multipart form with an image field", http.StatusBadRequest)
+			return
+		}
+	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	q := r.URL.Query().Get("q")
-	filters := metadataFiltersFromQuery(r.URL.Query())
-	limitStr := r.URL.Query().Get("limit")
-	limit := 10
-	if limitStr != "" {
-		if v, err := strconv.Atoi(limitStr); err == nil {
-			limit = v
+	if at, ok, err := parseAsOf(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if ok {
+		if image != nil {
+			http.Error(w, "as_of can't be combined with an image search", http.StatusBadRequest)
+			return
 		}
+		s.handleSearchAsOf(w, r, at)
+		return
 	}
-	// embed query and perform vector search
-	vec, err := s.slm.Embed(q)
-	if err != nil {
-		http.Error(w, "embed error", http.StatusInternalServerError)
+	q := searchQuery{
+		Text:          r.URL.Query().Get("q"),
+		Filters:       metadataFiltersFromQuery(r.URL.Query()),
+		Limit:         10,
+		IncludeStale:  r.URL.Query().Get("include_stale") == "true",
+		FromUpstream:  r.Header.Get(upstreamHeader) != "",
+		Source:        "search",
+		IncludeDrafts: r.URL.Query().Get("include_drafts") == "true",
+		Session:       r.URL.Query().Get("session_id"),
+		Scope:         scopeFromQuery(r.URL.Query()),
+		Highlight:     r.URL.Query().Get("highlight") == "true",
+		Oversample:    parseOversample(r.URL.Query().Get("oversample")),
+		Image:         image,
+	}
+	if image != nil && r.FormValue("q") != "" {
+		q.Text = r.FormValue("q")
+	}
+	if s.encryptedNamespace(q.namespace()) {
+		http.Error(w, "bad request: namespace "+q.namespace()+" is encrypted; search it with POST /encrypted/search", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Header.Get(federatedHeader) != "":
+		// a peer fanning out to us; don't fan out again
+		q.Federation = federationOff
+	case r.URL.Query().Get("federate") == "true":
+		q.Federation = federationAlways
+	case r.URL.Query().Get("federate") == "false":
+		q.Federation = federationOff
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+		q.Limit = v
+	}
+	var res *searchResult
+	var err error
+	if q.Budget, err = parseBudget(r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Has("cursor") {
+		// paged search for review tooling: vector matches in a stable order
+		if q.Limit <= 0 || q.Session != "" || q.Image != nil {
+			http.Error(w, "cursor requires a positive limit, no session_id and no image", http.StatusBadRequest)
+			return
+		}
+		cursor, cerr := decodeCursor(r.URL.Query().Get("cursor"), s.pageKey(q))
+		if cerr != nil {
+			http.Error(w, cerr.Error(), http.StatusBadRequest)
+			return
+		}
+		var next *searchCursor
+		if res, next, err = s.searchPage(r.Context(), q, cursor); err == nil && next != nil {
+			w.Header().Set(nextCursorHeader, next.encode())
+		}
+		if errors.Is(err, errDegenerate) {
+			embedError(w, err)
+			return
+		}
+	} else {
+		res, err = s.search(r.Context(), q)
+	}
+	if errors.Is(err, store.ErrUnavailable) {
+		storeUnavailable(w)
 		return
 	}
-	ctx := context.Background()
-	ids, scores, err := s.store.SearchByVector(ctx, vec, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	// build entries list (filter by a minimal similarity threshold)
-	minScore := 0.2
-	if v := strings.TrimSpace(os.Getenv("SLM_MIN_SCORE")); v != "" {
-		if parsed, err := strconv.ParseFloat(v, 64); err == nil {
-			minScore = parsed
+	redact(r, res.Entries...)
+	res.Entries = dropPartial(r.Context(), res.Entries)
+	out, err := selectFields(res.Entries, r.URL.Query().Get("fields"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setSearchDecision(w, res)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// searchQuery is a semantic lookup shared by /search and the cache
+// compatibility endpoints.
+type searchQuery struct {
+	Text         string
+	Filters      map[string]string
+	Limit        int
+	IncludeStale bool
+	// IncludeDrafts also serves entries in the draft state.
+	IncludeDrafts bool
+	// FromUpstream marks lookups made by a sidecar on our behalf, which must
+	// not be forwarded again.
+	FromUpstream bool
+	// Source names the front-end (search, get, resp) for the query log.
+	Source string
+	// Federation overrides SLC_FEDERATION for this query (off, miss or
+	// always); empty uses the server setting.
+	Federation string
+	// Session is the conversation the query belongs to; its earlier turns
+	// are blended into the query embedding.
+	Session string
+	// Scope is the hash of the system prompt and model parameters the
+	// caller generates with; only entries stored under it match.
+	Scope string
+	// Vector is Text's embedding when the caller already has it (batch
+	// search embeds every query at once); nil embeds Text.
+	Vector []float64
+	// Highlight marks the words lexically matched results matched on.
+	Highlight bool
+	// Oversample multiplies the vector search's k, so filtering still
+	// leaves Limit results; 0 lets the server decide (see oversample).
+	Oversample float64
+	// Image is the image the query refers to. Only entries stored with an
+	// image match such a query, and only by vector.
+	Image []byte
+	// Budget is the latency the caller can afford; stages that won't fit
+	// are skipped (see fits). 0 runs every stage.
+	Budget time.Duration
+	// Encrypted marks a lookup of an encrypted namespace by the client's
+	// vector; only such lookups match encrypted entries.
+	Encrypted bool
+}
+
+// values encodes q as /search query parameters for a remote instance.
+func (q searchQuery) values() url.Values {
+	v := url.Values{"q": {q.Text}, "limit": {strconv.Itoa(q.Limit)}}
+	for k, f := range q.Filters {
+		v.Set("metadata."+k, f)
+	}
+	if q.IncludeStale {
+		v.Set("include_stale", "true")
+	}
+	if q.IncludeDrafts {
+		v.Set("include_drafts", "true")
+	}
+	if q.Scope != "" {
+		v.Set("scope", q.Scope)
+	}
+	if q.Oversample > 0 {
+		v.Set("oversample", strconv.FormatFloat(q.Oversample, 'g', -1, 64))
+	}
+	return v
+}
+
+// matches reports whether e passes q's metadata filters and scope and is
+// in a servable lifecycle state.
+func (q searchQuery) matches(e *models.Entry) bool {
+	switch e.State() {
+	case models.StatePublished:
+	case models.StateDraft:
+		if !q.IncludeDrafts {
+			return false
 		}
+	default:
+		return false
 	}
-	if n, ok := s.slm.(interface{ BackendName() string }); ok {
-		if n.BackendName() == "ollama" && strings.TrimSpace(os.Getenv("SLM_MIN_SCORE")) == "" {
-			// Empirically, nomic-embed-text yields ~0.9 for paraphrases and ~0.4 for
-			// unrelated text, so we bias the default threshold higher when using
-			// the Ollama backend to reduce false positives.
-			minScore = 0.8
+	if (q.Image != nil) != (e.ImageHash() != "") || q.forTool() != (e.Tool() != "") || q.Encrypted != e.Flag(models.MetaEncrypted) {
+		return false
+	}
+	return e.ScopeHash() == q.Scope && matchesFilters(e, q.Filters)
+}
+
+// searchResult holds the matches of a search in rank order with their
+// similarity scores, and the tier that answered (cached, l1, l2,
+// federated, upstream, adapted or miss).
+type searchResult struct {
+	Entries []*models.Entry
+	Scores  []float64
+	Tier    string
+	// Skipped lists the stages left out to keep to the query's budget.
+	Skipped []string
+	// Uncacheable names the SLC_UNCACHEABLE rule that kept the query from
+	// the store.
+	Uncacheable string
+}
+
+func (r *searchResult) add(e *models.Entry, score float64) {
+	e.Score = score
+	r.Entries = append(r.Entries, e)
+	r.Scores = append(r.Scores, score)
+}
+
+// errEmbed is returned by search when the query cannot be embedded.
+var errEmbed = errors.New("embed error")
+
+// search runs the tiered lookup: L1 exact match, vector search with the
+// token fallback, then read-through to an upstream instance.
+func (s *Server) search(ctx context.Context, q searchQuery) (*searchResult, error) {
+	start := time.Now()
+	// answers to uncacheable prompts are never stored, so don't look
+	if rule := s.uncacheableQuery(q); rule != "" {
+		res := &searchResult{Entries: []*models.Entry{}, Scores: []float64{}, Tier: "miss", Uncacheable: rule}
+		s.logQuery(q, res, start)
+		return res, nil
+	}
+	// an encrypted namespace has no plaintext to match text queries against
+	if s.encryptedNamespace(q.namespace()) {
+		return &searchResult{Entries: []*models.Entry{}, Scores: []float64{}, Tier: "miss"}, nil
+	}
+	// recent results answer repeats of a hot query outright
+	var resultKey string
+	var resultGen uint64
+	if s.results != nil && q.cacheable() {
+		resultKey = s.resultKey(q, principalFrom(ctx))
+		cached, gen := s.results.get(resultKey, start)
+		if cached != nil {
+			s.consume(ctx, cached)
+			tierLookups.Inc("results", "hit")
+			tierLatency.ObserveExemplar(time.Since(start).Seconds(), traceIDFrom(ctx), "results")
+			for _, e := range cached.Entries {
+				if e.Region == "" {
+					s.hits.record(e.ID, start)
+				}
+			}
+			cached.Tier = "cached"
+			s.logQuery(q, cached, start)
+			s.emitSearch(q, cached, start)
+			pickVariants(q, cached)
+			return cached, nil
+		}
+		tierLookups.Inc("results", "miss")
+		resultGen = gen
+	}
+	res := &searchResult{Entries: []*models.Entry{}, Scores: []float64{}}
+	// L1: exact/normalized prompt match answers without embedding, unless
+	// earlier turns of the session change what the words refer to
+	var e *models.Entry
+	if s.sessions.history(q.Session) == 0 && q.Image == nil {
+		e = s.lookupExact(ctx, q)
+	}
+	if e != nil && q.matches(e) && (q.IncludeStale || !e.Flag(models.MetaStale)) {
+		res.add(e, 1)
+		// a hit failing a safety check or out of serves falls through to
+		// the vector search
+		s.screen(ctx, res)
+		if s.consume(ctx, res); len(res.Entries) > 0 {
+			tierLookups.Inc("l1", "hit")
+			tierLatency.ObserveExemplar(time.Since(start).Seconds(), traceIDFrom(ctx), "l1")
+			s.hits.record(e.ID, start)
+			res.Tier = "l1"
+			s.prefetchRelated(e)
+			s.logQuery(q, res, start)
+			s.emitSearch(q, res, start)
+			pickVariants(q, res)
+			return res, nil
+		}
+	}
+	tierLookups.Inc("l1", "miss")
+	// embed query and perform vector search; a degenerate query vector
+	// can't match anything, so only the token fallback below runs
+	var ids []int64
+	var scores []float64
+	vec, err := q.Vector, error(nil)
+	embedded := vec != nil || q.fits(res, start, stageEmbed, expectedEmbed())
+	if vec == nil && embedded {
+		vec, err = s.embedWithImage(ctx, q.Text, q.Image, stageQuery)
+	}
+	switch {
+	case !embedded:
+		// out of budget: only the token fallback below runs
+	case err == nil && q.Image != nil:
+		if ids, scores, err = s.searchVector(ctx, q, vec); err != nil {
+			return nil, err
+		}
+	case err == nil:
+		vec, _ = s.sessions.contextualize(q.Session, vec)
+		if ids, scores, err = s.searchVector(ctx, q, vec); err != nil {
+			return nil, err
+		}
+		// terse queries also search the generator's paraphrases of them
+		if s.expansionCount(q.Text) > 0 && q.fits(res, start, stageExpand, expectedEmbed()) {
+			ids, scores = s.searchExpanded(ctx, q, ids, scores)
+		}
+		if q.fits(res, start, stageRerank, 0) {
+			s.preferQuality(ctx, ids, scores)
 		}
+	case !errors.Is(err, errDegenerate):
+		return nil, err
 	}
-	out := []*models.Entry{}
+	// build entries list (filter by a minimal similarity threshold)
+	thresholds := s.thresholds()
+	margin := s.adaptMargin()
+	adaptFloor := thresholds.lowest() - margin
+	vecScore := make(map[int64]float64, len(ids))
+	for i, id := range ids {
+		vecScore[id] = scores[i]
+	}
+	// nearMiss is the best candidate just under the threshold, which may be
+	// adapted to the query if nothing else matches
+	var nearMiss *models.Entry
+	var nearScore float64
 	for i, id := range ids {
-		if scores[i] < minScore {
+		// the search was oversampled for filtering; keep the best Limit
+		if q.Limit > 0 && len(res.Entries) >= q.Limit {
+			break
+		}
+		if scores[i] < adaptFloor || (nearMiss != nil && scores[i] < thresholds.lowest()) {
 			continue
 		}
 		e, err := s.store.GetEntry(ctx, id)
@@ -358,18 +1006,37 @@ func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
 		if s.expireIfNeeded(ctx, e) {
 			continue
 		}
-		if matchesFilters(e, filters) {
-			out = append(out, e)
+		if !q.IncludeStale && e.Flag(models.MetaStale) {
+			continue
+		}
+		if !q.matches(e) {
+			continue
+		}
+		// the entry's category may ask for more than the global threshold
+		if minScore := thresholds.of(e); scores[i] < minScore {
+			if nearMiss == nil && scores[i] >= minScore-margin {
+				nearMiss, nearScore = e, scores[i]
+			}
+			continue
 		}
+		res.add(e, scores[i])
 	}
 	// fallback: if no results from vector similarity (e.g., zero vectors),
 	// do a simple substring/token match on stored prompts to help tests and
-	// provide reasonable behavior for very small/mock embeddings.
-	qlow := strings.ToLower(q)
-	qTokens := strings.Fields(qlow)
-	// collect fallback matches (token-based) in any case and append missing ones
+	// provide reasonable behavior for very small/mock embeddings. Terms are
+	// stemmed and stopwords dropped, so word forms don't defeat the match,
+	// and may differ by a typo or two. The trigram index narrows the entries
+	// to compare; each candidate is checked against its current prompt.
+	analyzer := s.getAnalyzer()
+	qTokens := s.lexicalTerms(q.namespace(), q.Text)
+	// collect fallback matches (token-based) in any case and append missing
+	// ones; words alone say nothing of an image
 	fallback := []*models.Entry{}
-	for _, sid := range s.store.AllIDs() {
+	var candidates []int64
+	if q.Image == nil && q.fits(res, start, stageLexical, 0) {
+		candidates = s.lexicalCandidates(ctx, analyzer, qTokens)
+	}
+	for _, sid := range candidates {
 		e, err := s.store.GetEntry(ctx, sid)
 		if err != nil {
 			continue
@@ -377,36 +1044,117 @@ func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
 		if s.expireIfNeeded(ctx, e) {
 			continue
 		}
-		etoks := strings.Fields(strings.ToLower(e.Prompt))
-		match := 0
-		for _, qt := range qTokens {
-			for _, et := range etoks {
-				if strings.Contains(et, qt) {
-					match++
-					break
-				}
-			}
+		if !q.IncludeStale && e.Flag(models.MetaStale) {
+			continue
 		}
-		if match == len(qTokens) {
+		if lexicalMatch(analyzer, qTokens, s.lexicalTerms(e.Namespace(), e.Prompt)) {
 			fallback = append(fallback, e)
 		}
 	}
 	// append fallback matches that aren't already in out
 	seen := map[int64]struct{}{}
-	for _, e := range out {
+	for _, e := range res.Entries {
 		seen[e.ID] = struct{}{}
 	}
+	lexicalHits := make(map[int64]bool, len(fallback))
 	for _, f := range fallback {
+		lexicalHits[f.ID] = true
 		if _, ok := seen[f.ID]; ok {
 			continue
 		}
-		if matchesFilters(f, filters) {
-			out = append(out, f)
+		if q.matches(f) {
+			res.add(f, vecScore[f.ID])
 			seen[f.ID] = struct{}{}
 		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(out)
+	if q.Highlight {
+		for _, e := range res.Entries {
+			if lexicalHits[e.ID] {
+				s.highlight(e, analyzer, qTokens)
+			}
+		}
+	}
+	res.Tier = "l2"
+	// federation: other regions answer what this one can't (or, in always
+	// mode, compete on score); peers only take text queries
+	if q.Image == nil && !q.forTool() && s.shouldFederate(q, len(res.Entries)) && q.fits(res, start, stageFederation, 0) {
+		if remote := visible(ctx, s.federate(ctx, q)); len(remote) > 0 {
+			res.merge(remote, q.Limit)
+		}
+	}
+	// sidecar tier: a local miss reads through to the central instance
+	if len(res.Entries) == 0 && !q.FromUpstream && q.Image == nil && !q.forTool() && upstreamURL() != "" && q.fits(res, start, stageUpstream, 0) {
+		for _, e := range visible(ctx, s.readThrough(ctx, q)) {
+			res.add(e, 0)
+			res.Tier = "upstream"
+		}
+	}
+	if len(res.Entries) == 0 && nearMiss != nil && q.Image == nil && !q.forTool() && s.getGenerator() != nil && q.fits(res, start, stageAdapt, 0) {
+		if e := s.adapt(ctx, q.Text, nearMiss, nearScore); e != nil {
+			res.add(e, nearScore)
+			res.Tier = "adapted"
+		}
+	}
+	s.screen(ctx, res)
+	s.consume(ctx, res)
+	result := "miss"
+	if len(res.Entries) > 0 {
+		result = "hit"
+		s.prefetchRelated(res.Entries[0])
+	} else {
+		res.Tier = "miss"
+	}
+	// promote exact matches found by the vector path (e.g. entries that
+	// predate this process) into L1
+	key := s.canonical(q.namespace(), q.Text)
+	for _, e := range res.Entries {
+		if e.Region == "" && !e.Opaque() && s.entryKey(e) == key {
+			s.exact.put(key, e.ID)
+			break
+		}
+	}
+	for _, e := range res.Entries {
+		if e.Region == "" {
+			s.hits.record(e.ID, start)
+		}
+	}
+	tierLookups.Inc("l2", result)
+	tierLatency.ObserveExemplar(time.Since(start).Seconds(), traceIDFrom(ctx), "l2")
+	s.logQuery(q, res, start)
+	s.emitSearch(q, res, start)
+	// adapted and read-through answers aren't cached here because they were
+	// just stored, so repeats find them there, and results a budget cut
+	// short aren't because a repeat with budget left should get them whole
+	if resultKey != "" && res.Tier != "adapted" && res.Tier != "upstream" && len(res.Skipped) == 0 {
+		s.results.put(resultKey, q.Filters[models.MetaNamespace], res, resultGen, time.Now())
+	}
+	// after caching the result, so every repeat picks its own variant
+	pickVariants(q, res)
+	return res, nil
+}
+
+// minScore is the similarity threshold a vector match must reach.
+func (s *Server) minScore() float64 {
+	minScore := 0.2
+	if v := config.Get("SLM_MIN_SCORE"); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+			minScore = parsed
+		}
+	}
+	if n, ok := s.getSLM().(interface{ BackendName() string }); ok {
+		name := n.BackendName()
+		// a replay stands in for the backend its fixture was recorded from
+		if r, ok := n.(interface{ RecordedBackend() string }); ok {
+			name = r.RecordedBackend()
+		}
+		if name == "ollama" && config.Get("SLM_MIN_SCORE") == "" {
+			// Empirically, nomic-embed-text yields ~0.9 for paraphrases and ~0.4 for
+			// unrelated text, so we bias the default threshold higher when using
+			// the Ollama backend to reduce false positives.
+			minScore = 0.8
+		}
+	}
+	return minScore
 }
 
 func metadataFiltersFromQuery(values url.Values) map[string]string {
@@ -440,6 +1188,21 @@ func metadataFiltersFromQuery(values url.Values) map[string]string {
 	return filters
 }
 
+// checkReserved rejects entries whose reserved metadata keys that take a
+// structured value (json_schema, refresh, canary, quality) don't hold a
+// valid one. It clears the statistics the server keeps, which entries read
+// back and written again carry.
+func checkReserved(e *models.Entry) error {
+	e.HitCount, e.LastHitAt, e.CreatedBy = 0, time.Time{}, ""
+	delete(e.Metadata, models.MetaEncrypted)
+	for _, check := range []func(*models.Entry) error{checkSchema, checkRefresh, checkCanary, checkQuality} {
+		if err := check(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func matchesFilters(entry *models.Entry, filters map[string]string) bool {
 	if len(filters) == 0 {
 		return true
@@ -474,22 +1237,66 @@ func toString(v interface{}) string {
 }
 
 func (s *Server) startJanitor() {
-	if s.entryTTL <= 0 || s.janitorStop == nil {
+	if s.janitorStop == nil {
 		return
 	}
 	interval := s.purgeInterval
 	if interval <= 0 {
 		interval = time.Minute
 	}
-	s.purgeExpired(context.Background())
+	s.startLoop("janitor", interval, func(ctx context.Context) {
+		s.purgeExpired(ctx)
+		s.evictNamespaces(ctx)
+		s.checkQuotas(ctx)
+	})
+	// schedules live on the replica they were created on, which may not be
+	// the lease holder, so each replica runs its own
+	s.every(time.Minute, func(ctx context.Context) {
+		s.runSchedules(ctx, time.Now())
+	})
+	s.startLoop("refresh", durationFromEnv("SLC_REFRESH_INTERVAL", time.Minute), s.refreshDue)
+	s.startLoop("garbage", durationFromEnv("SLC_GARBAGE_INTERVAL", 24*time.Hour), s.collectGarbage)
+	s.startLoop("backfill", durationFromEnv("SLC_BACKFILL_INTERVAL", 5*time.Minute), func(ctx context.Context) {
+		_, _ = s.backfillVectors(ctx)
+	})
+	if len(syncPeers()) > 0 {
+		s.startLoop("sync", durationFromEnv("SLC_SYNC_INTERVAL", 10*time.Minute), s.syncAll)
+	}
+	if s.outbox != nil {
+		s.startLoop("outbox", durationFromEnv("SLC_OUTBOX_INTERVAL", time.Second), s.deliverOutbox)
+	}
+	if intFromEnv("SLC_DRIFT_SAMPLE", 20) > 0 {
+		s.startLoop("drift", durationFromEnv("SLC_DRIFT_INTERVAL", time.Hour), func(ctx context.Context) {
+			s.checkDrift(ctx)
+		})
+	}
+}
+
+// startLoop runs fn like every does. When the store is shared between
+// replicas, fn only runs on the replica holding the lease for name; the
+// lease outlives three intervals so a missed tick does not cause a
+// leadership flap.
+func (s *Server) startLoop(name string, interval time.Duration, fn func(context.Context)) {
+	s.every(interval, func(ctx context.Context) {
+		if s.isLeader(ctx, name, 3*interval) {
+			fn(ctx)
+		}
+	})
+}
+
+// every runs fn in the background, once immediately and then every
+// interval until Close is called, so New doesn't wait on a slow store or
+// backend.
+func (s *Server) every(interval time.Duration, fn func(context.Context)) {
 	s.janitorWG.Add(1)
-	ticker := time.NewTicker(interval)
 	go func() {
 		defer s.janitorWG.Done()
+		fn(context.Background())
+		ticker := time.NewTicker(interval)
 		for {
 			select {
 			case <-ticker.C:
-				s.purgeExpired(context.Background())
+				fn(context.Background())
 			case <-s.janitorStop:
 				ticker.Stop()
 				return
@@ -499,17 +1306,21 @@ func (s *Server) startJanitor() {
 }
 
 func (s *Server) purgeExpired(ctx context.Context) int {
-	if s.entryTTL <= 0 {
+	tools := s.toolTTL()
+	if s.ttl() <= 0 && len(tools) == 0 && !s.namespaces.anyTTL() {
+		return 0
+	}
+	if s.expiryOffloaded() {
 		return 0
 	}
-	cutoff := time.Now().Add(-s.entryTTL)
+	now := time.Now()
 	removed := 0
 	for _, id := range s.store.AllIDs() {
 		e, err := s.store.GetEntry(ctx, id)
 		if err != nil || e == nil {
 			continue
 		}
-		if entryExpiredAt(e, cutoff) {
+		if ttl := s.ttlOf(e, tools); ttl > 0 && entryExpiredAt(e, now.Add(-ttl)) {
 			_ = s.store.DeleteEntry(ctx, id)
 			removed++
 		}
@@ -517,11 +1328,32 @@ func (s *Server) purgeExpired(ctx context.Context) int {
 	return removed
 }
 
+// expiryOf is the TTL policy handed to stores that expire entries
+// themselves: entries live ttlOf past their last write, pinned ones forever.
+func (s *Server) expiryOf(e *models.Entry) time.Duration {
+	if e.Flag(models.MetaPinned) {
+		return 0
+	}
+	return s.ttlOf(e, s.toolTTL())
+}
+
+// expiryOffloaded reports whether the store expires entries itself, so the
+// janitor needn't scan it for them. It never does with a write-ahead log,
+// which the store's own expiries would bypass.
+func (s *Server) expiryOffloaded() bool {
+	_, ok := s.backend.(store.Expirer)
+	return ok && store.CapabilitiesOf(s.backend).PurgeExpired && s.observed.journal == nil
+}
+
 func (s *Server) isExpired(e *models.Entry) bool {
-	if s.entryTTL <= 0 {
+	if e == nil {
+		return false
+	}
+	ttl := s.ttlOf(e, s.toolTTL())
+	if ttl <= 0 {
 		return false
 	}
-	cutoff := time.Now().Add(-s.entryTTL)
+	cutoff := time.Now().Add(-ttl)
 	return entryExpiredAt(e, cutoff)
 }
 
@@ -536,7 +1368,7 @@ func (s *Server) expireIfNeeded(ctx context.Context, e *models.Entry) bool {
 }
 
 func entryExpiredAt(e *models.Entry, cutoff time.Time) bool {
-	if e == nil {
+	if e == nil || e.Flag(models.MetaPinned) {
 		return false
 	}
 	ts := e.UpdatedAt
@@ -549,11 +1381,25 @@ func entryExpiredAt(e *models.Entry, cutoff time.Time) bool {
 	return ts.Before(cutoff)
 }
 
+func intFromEnv(key string, def int) int {
+	if v := config.Get(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+		noteInvalid(key, "non-negative integer")
+	}
+	return def
+}
+
 func durationFromEnv(key string, def time.Duration) time.Duration {
-	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
-		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+	if v := config.Get(key); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil && d > 0 {
 			return d
 		}
+		if err != nil {
+			noteInvalid(key, "duration")
+		}
 	}
 	return def
 }
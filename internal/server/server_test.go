@@ -3,16 +3,38 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/events"
 	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/querylog"
+	"github.com/jeefy/slmcache/internal/resp"
+	"github.com/jeefy/slmcache/internal/slm"
+	"github.com/jeefy/slmcache/internal/store"
+	"github.com/jeefy/slmcache/internal/wal"
 )
 
 // mockStore is a small in-memory mock implementing store.Store used by unit
@@ -93,6 +115,17 @@ func (m *mockStore) SearchByVector(ctx context.Context, vec []float64, limit int
 	return ids, scores, nil
 }
 
+func (m *mockStore) GetVector(ctx context.Context, id int64) ([]float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i, sid := range m.ids {
+		if sid == id {
+			return append([]float64(nil), m.vectors[i]...), nil
+		}
+	}
+	return nil, http.ErrMissingFile
+}
+
 func (m *mockStore) AllIDs() []int64 {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -192,6 +225,10 @@ func cloneEntry(e *models.Entry) *models.Entry {
 	if e.Metadata != nil {
 		copy.Metadata = cloneMetadata(e.Metadata)
 	}
+	if e.Provenance != nil {
+		p := *e.Provenance
+		copy.Provenance = &p
+	}
 	return &copy
 }
 
@@ -423,3 +460,4676 @@ func TestServer_PurgeExpiredEntries(t *testing.T) {
 		t.Fatalf("expected entry to be deleted")
 	}
 }
+
+func TestServer_JanitorLeaderElection(t *testing.T) {
+	t.Setenv("SLC_PURGE_INTERVAL", "10m")
+	st, err := store.New()
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Setenv("SLC_INSTANCE_ID", "replica-a")
+	a := New(st)
+	defer a.Close()
+	t.Setenv("SLC_INSTANCE_ID", "replica-b")
+	b := New(st)
+	defer b.Close()
+
+	ctx := context.Background()
+	if !a.isLeader(ctx, "janitor", time.Minute) {
+		t.Fatalf("expected first replica to hold the janitor lease")
+	}
+	if b.isLeader(ctx, "janitor", time.Minute) {
+		t.Fatalf("expected second replica to be a follower")
+	}
+	a.Close()
+	if !b.isLeader(ctx, "janitor", time.Minute) {
+		t.Fatalf("expected lease handover after leader closed")
+	}
+}
+
+func TestServer_SidecarReadThrough(t *testing.T) {
+	central := New(newMockStore())
+	defer central.Close()
+	cts := httptest.NewServer(central.Router())
+	defer cts.Close()
+	b, _ := json.Marshal(&models.Entry{Prompt: "Where is KubeCon", Response: "Chicago"})
+	res, err := http.Post(cts.URL+"/entries", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("seed central: %v", err)
+	}
+	res.Body.Close()
+
+	t.Setenv("SLC_UPSTREAM_URL", cts.URL)
+	ms := newMockStore()
+	sidecar := New(ms)
+	defer sidecar.Close()
+	sts := httptest.NewServer(sidecar.Router())
+	defer sts.Close()
+
+	resp, err := http.Get(sts.URL + "/search?q=kubecon")
+	if err != nil {
+		t.Fatalf("sidecar search: %v", err)
+	}
+	var out []*models.Entry
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if len(out) != 1 || out[0].Response != "Chicago" {
+		t.Fatalf("expected upstream hit, got %+v", out)
+	}
+	if len(ms.AllIDs()) != 1 {
+		t.Fatalf("expected upstream hit to be copied into the sidecar store")
+	}
+}
+
+func TestServer_ExactTierInvalidation(t *testing.T) {
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	b, _ := json.Marshal(&models.Entry{Prompt: "How to bake a cake", Response: "Use flour"})
+	res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var created models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+
+	hits := tierLookups.Value("l1", "hit")
+	if e := srv.lookupExact(context.Background(), searchQuery{Text: "how to BAKE a cake?"}); e == nil || e.ID != created.ID {
+		t.Fatalf("expected normalized prompt to hit L1")
+	}
+	resp, err := http.Get(ts.URL + "/search?q=How+to+bake+a+cake%3F")
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	resp.Body.Close()
+	if tierLookups.Value("l1", "hit") != hits+1 {
+		t.Fatalf("expected search to be answered by L1")
+	}
+
+	// rewriting the prompt must drop the old L1 key
+	b, _ = json.Marshal(&models.Entry{Prompt: "How to bake bread", Response: "Use yeast"})
+	req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/entries/%d", ts.URL, created.ID), bytes.NewReader(b))
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("update: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	if e := srv.lookupExact(context.Background(), searchQuery{Text: "how to bake a cake"}); e != nil {
+		t.Fatalf("expected stale L1 key to be invalidated on update")
+	}
+	if e := srv.lookupExact(context.Background(), searchQuery{Text: "how to bake bread"}); e == nil {
+		t.Fatalf("expected updated prompt to be cached in L1")
+	}
+	if err := srv.store.DeleteEntry(context.Background(), created.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if e := srv.lookupExact(context.Background(), searchQuery{Text: "how to bake bread"}); e != nil {
+		t.Fatalf("expected L1 entry removed on delete")
+	}
+}
+
+func TestServer_InvalidateBySimilarity(t *testing.T) {
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	post := func(prompt string) int64 {
+		b, _ := json.Marshal(&models.Entry{Prompt: prompt, Response: "answer"})
+		res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		defer res.Body.Close()
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return e.ID
+	}
+	moved := post("Where is KubeCon")
+	other := post("Best pizza toppings")
+
+	body := `{"prompt":"Where is KubeCon","radius":0.1,"action":"stale"}`
+	res, err := http.Post(ts.URL+"/invalidate", "application/json", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("invalidate: %v", err)
+	}
+	var out invalidateResponse
+	_ = json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	if out.Matched != 1 || out.IDs[0] != moved {
+		t.Fatalf("expected only %d invalidated, got %+v", moved, out)
+	}
+	e, _ := ms.GetEntry(context.Background(), moved)
+	if !e.Flag(models.MetaStale) {
+		t.Fatalf("expected entry marked stale")
+	}
+	if e, _ := ms.GetEntry(context.Background(), other); e.Flag(models.MetaStale) {
+		t.Fatalf("expected unrelated entry untouched")
+	}
+	resp, err := http.Get(ts.URL + "/search?q=Where+is+KubeCon")
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	var found []*models.Entry
+	_ = json.NewDecoder(resp.Body).Decode(&found)
+	resp.Body.Close()
+	if len(found) != 0 {
+		t.Fatalf("expected stale entry excluded from search, got %d results", len(found))
+	}
+}
+
+func TestServer_CronSchedulePurgesNamespace(t *testing.T) {
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	ctx := context.Background()
+	vec := []float64{1, 0}
+	pricing, _ := ms.CreateEntryWithVector(ctx, &models.Entry{Prompt: "price", Metadata: map[string]interface{}{"category": "pricing", "namespace": "shop"}}, vec)
+	otherNS, _ := ms.CreateEntryWithVector(ctx, &models.Entry{Prompt: "price", Metadata: map[string]interface{}{"category": "pricing"}}, vec)
+	faq, _ := ms.CreateEntryWithVector(ctx, &models.Entry{Prompt: "faq", Metadata: map[string]interface{}{"category": "faq", "namespace": "shop"}}, vec)
+
+	body := `{"cron":"@nightly","namespace":"shop","metadata":{"category":"pricing"},"action":"purge"}`
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/admin/schedules/pricing", bytes.NewReader([]byte(body)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("put schedule: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", resp.StatusCode)
+	}
+
+	srv.runSchedules(ctx, time.Now())
+	if _, err := ms.GetEntry(ctx, pricing); err != nil {
+		t.Fatalf("schedule ran before it was due")
+	}
+	srv.runSchedules(ctx, time.Now().Add(25*time.Hour))
+	if _, err := ms.GetEntry(ctx, pricing); err == nil {
+		t.Fatalf("expected pricing entry in namespace shop to be purged")
+	}
+	for _, id := range []int64{otherNS, faq} {
+		if _, err := ms.GetEntry(ctx, id); err != nil {
+			t.Fatalf("expected entry %d outside the schedule scope to survive", id)
+		}
+	}
+	if sc := srv.schedules["pricing"]; sc.LastAffected != 1 {
+		t.Fatalf("expected last run to report 1 affected entry, got %d", sc.LastAffected)
+	}
+}
+
+func TestServer_EntriesBatch(t *testing.T) {
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	body := `[{"prompt":"What is Kubernetes","response":"an orchestrator"},{"response":"no prompt"},{"prompt":"What is Envoy","response":"a proxy"}]`
+	res, err := http.Post(ts.URL+"/entries/batch", "application/json", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	var out []models.BatchResult
+	_ = json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	if len(out) != 3 {
+		t.Fatalf("expected 3 results got %d", len(out))
+	}
+	if out[0].ID == 0 || out[2].ID == 0 {
+		t.Fatalf("expected ids for valid rows, got %+v", out)
+	}
+	if out[1].Error == "" || out[1].ID != 0 {
+		t.Fatalf("expected error for row without prompt, got %+v", out[1])
+	}
+	if e, err := ms.GetEntry(context.Background(), out[2].ID); err != nil || e.Prompt != "What is Envoy" {
+		t.Fatalf("expected stored entry, got %+v err=%v", e, err)
+	}
+
+	t.Setenv("SLC_MAX_BATCH", "2")
+	res, err = http.Post(ts.URL+"/entries/batch", "application/json", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 got %d", res.StatusCode)
+	}
+}
+
+func TestServer_CacheGetPut(t *testing.T) {
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	call := func(path, body string) cacheData {
+		res, err := http.Post(ts.URL+path, "application/json", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200 got %d", path, res.StatusCode)
+		}
+		var out cacheData
+		if path == "/get" {
+			_ = json.NewDecoder(res.Body).Decode(&out)
+		}
+		return out
+	}
+	call("/put", `{"prompt":"What is Kubernetes","llm_string":"gpt-4 temp=0","answer":"an orchestrator"}`)
+	call("/put", `{"prompt":"What is Kubernetes","llm_string":"gpt-4 temp=0","answer":"a container orchestrator"}`)
+	if n := len(ms.AllIDs()); n != 1 {
+		t.Fatalf("expected put to replace the answer, got %d entries", n)
+	}
+	got := call("/get", `{"prompt":"What is Kubernetes","llm_string":"gpt-4 temp=0"}`)
+	if got.Answer == nil || *got.Answer != "a container orchestrator" {
+		t.Fatalf("expected cached answer, got %+v", got)
+	}
+	if got := call("/get", `{"prompt":"What is Kubernetes","llm_string":"llama3"}`); got.Answer != nil {
+		t.Fatalf("expected miss for a different llm_string, got %q", *got.Answer)
+	}
+	if got := call("/get", `{"prompt":"What is Kubernetes"}`); got.Answer == nil {
+		t.Fatalf("expected GPTCache-style lookup without llm_string to hit")
+	}
+}
+
+// scanCountingStore counts unfiltered listings of the whole store.
+type scanCountingStore struct {
+	*mockStore
+	scans atomic.Int32
+}
+
+func (c *scanCountingStore) FindEntriesByMetadata(ctx context.Context, filters map[string]string) ([]*models.Entry, error) {
+	if len(filters) == 0 {
+		c.scans.Add(1)
+	}
+	return c.mockStore.FindEntriesByMetadata(ctx, filters)
+}
+
+func TestServer_CachePutWithoutLLMString(t *testing.T) {
+	cs := &scanCountingStore{mockStore: newMockStore()}
+	srv := New(cs)
+	defer srv.Close()
+	ctx := context.Background()
+	for _, answer := range []string{"an orchestrator", "a container orchestrator"} {
+		if err := srv.putCached(ctx, "What is Kubernetes", "", answer, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(cs.AllIDs()); n != 1 {
+		t.Fatalf("expected put to replace the answer, got %d entries", n)
+	}
+	if n := cs.scans.Load(); n != 0 {
+		t.Fatalf("expected puts without an llm_string not to scan the store, got %d scans", n)
+	}
+}
+
+func TestServer_RESPFacade(t *testing.T) {
+	ms := newMockStore()
+	srv := New(ms)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = srv.ServeRESP(ln) }()
+	defer srv.Close()
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	w, r := resp.NewWriter(conn), resp.NewReader(conn)
+	do := func(args ...string) resp.Value {
+		w.WriteCommand(args...)
+		if err := w.Flush(); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		v, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return v
+	}
+	if v := do("PING"); v.Str != "PONG" {
+		t.Fatalf("expected PONG got %+v", v)
+	}
+	if v := do("GET", "What is Kubernetes"); !v.Null {
+		t.Fatalf("expected nil before SET, got %+v", v)
+	}
+	if v := do("SET", "What is Kubernetes", "an orchestrator", "EX", "60"); v.Str != "OK" {
+		t.Fatalf("expected OK got %+v", v)
+	}
+	if v := do("SET", "What is Kubernetes", "other", "NX"); !v.Null {
+		t.Fatalf("expected NX to refuse an existing key, got %+v", v)
+	}
+	if v := do("GET", "what is kubernetes?"); v.Str != "an orchestrator" {
+		t.Fatalf("expected semantic hit got %+v", v)
+	}
+	if v := do("DEL", "What is Kubernetes", "missing"); v.Int != 1 {
+		t.Fatalf("expected 1 deleted got %+v", v)
+	}
+	if v := do("FLUSHALL"); v.Type != resp.Error {
+		t.Fatalf("expected error for unknown command got %+v", v)
+	}
+}
+
+func TestServer_RESPRequiresAuth(t *testing.T) {
+	t.Setenv("SLC_API_KEYS", "w-key=write,r-key=read")
+	srv := New(newMockStore())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = srv.ServeRESP(ln) }()
+	defer srv.Close()
+	defer ln.Close()
+
+	dial := func() func(args ...string) resp.Value {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		w, r := resp.NewWriter(conn), resp.NewReader(conn)
+		return func(args ...string) resp.Value {
+			w.WriteCommand(args...)
+			if err := w.Flush(); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			v, err := r.ReadValue()
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			return v
+		}
+	}
+	do := dial()
+	if v := do("SET", "What is Kubernetes", "an orchestrator"); v.Type != resp.Error || !strings.HasPrefix(v.Str, "NOAUTH") {
+		t.Fatalf("expected NOAUTH for an unauthenticated SET got %+v", v)
+	}
+	if v := do("GET", "What is Kubernetes"); v.Type != resp.Error || !strings.HasPrefix(v.Str, "NOAUTH") {
+		t.Fatalf("expected NOAUTH for an unauthenticated GET got %+v", v)
+	}
+	// the connection is dropped, possibly before the error reaches us
+	big, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer big.Close()
+	bw := resp.NewWriter(big)
+	bw.WriteCommand("SET", "What is Kubernetes", strings.Repeat("x", 64*1024))
+	_ = bw.Flush()
+	if v, err := resp.NewReader(big).ReadValue(); err == nil && v.Type != resp.Error {
+		t.Fatalf("expected a large argument before AUTH to be refused got %+v", v)
+	}
+	if v := do("AUTH", "wrong"); v.Type != resp.Error || !strings.HasPrefix(v.Str, "WRONGPASS") {
+		t.Fatalf("expected WRONGPASS for an unknown key got %+v", v)
+	}
+	if v := do("AUTH", "default", "w-key"); v.Str != "OK" {
+		t.Fatalf("expected OK got %+v", v)
+	}
+	if v := do("SET", "What is Kubernetes", "an orchestrator"); v.Str != "OK" {
+		t.Fatalf("expected OK got %+v", v)
+	}
+
+	read := dial()
+	if v := read("AUTH", "r-key"); v.Str != "OK" {
+		t.Fatalf("expected OK got %+v", v)
+	}
+	if v := read("GET", "what is kubernetes?"); v.Str != "an orchestrator" {
+		t.Fatalf("expected a read key to GET got %+v", v)
+	}
+	if v := read("SET", "What is Kubernetes", "other"); v.Type != resp.Error || !strings.HasPrefix(v.Str, "NOPERM") {
+		t.Fatalf("expected NOPERM for a read key's SET got %+v", v)
+	}
+	if v := read("DEL", "What is Kubernetes"); v.Type != resp.Error || !strings.HasPrefix(v.Str, "NOPERM") {
+		t.Fatalf("expected NOPERM for a read key's DEL got %+v", v)
+	}
+}
+
+func TestServer_HandleMountsBehindAuth(t *testing.T) {
+	t.Setenv("SLC_API_KEYS", "r-key=read,a-key=admin")
+	srv := New(newMockStore())
+	defer srv.Close()
+	srv.Handle("/cluster/status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "{}")
+	}))
+	h := srv.Router()
+	for key, want := range map[string]int{"": http.StatusUnauthorized, "r-key": http.StatusForbidden, "a-key": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/cluster/status", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("key %q: expected %d got %d", key, want, rec.Code)
+		}
+	}
+}
+
+func TestServer_AuthFailsClosed(t *testing.T) {
+	config.RegisterSecretProvider("unreachable", config.SecretProviderFunc(func(context.Context, string) (string, error) {
+		return "", errors.New("connection refused")
+	}))
+	t.Setenv("SLC_API_KEYS", "unreachable:keys")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/search?q=What+is+Kubernetes")
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the API keys can't be resolved got %d", res.StatusCode)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = srv.ServeRESP(ln) }()
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	w, r := resp.NewWriter(conn), resp.NewReader(conn)
+	w.WriteCommand("GET", "What is Kubernetes")
+	if err := w.Flush(); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if v, err := r.ReadValue(); err != nil || v.Type != resp.Error {
+		t.Fatalf("expected an error for a RESP GET got %+v, %v", v, err)
+	}
+}
+
+type fakeGenerator struct{ prompts []string }
+
+func (g *fakeGenerator) Generate(_ context.Context, prompt string) (*slm.Generation, error) {
+	g.prompts = append(g.prompts, prompt)
+	return &slm.Generation{Text: "KubeCon is in Atlanta", Model: "fake", CompletionTokens: 6}, nil
+}
+
+func TestServer_AdaptsNearMiss(t *testing.T) {
+	t.Setenv("SLM_MIN_SCORE", "0.95")
+	t.Setenv("SLC_ADAPT_MARGIN", "0.9")
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	b, _ := json.Marshal(&models.Entry{Prompt: "Where is KubeCon EU", Response: "KubeCon EU is in London"})
+	res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var src models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&src)
+	res.Body.Close()
+
+	search := func() []*models.Entry {
+		resp, err := http.Get(ts.URL + "/search?q=Where+is+KubeCon+NA")
+		if err != nil {
+			t.Fatalf("search: %v", err)
+		}
+		defer resp.Body.Close()
+		var found []*models.Entry
+		_ = json.NewDecoder(resp.Body).Decode(&found)
+		return found
+	}
+	if found := search(); len(found) != 0 {
+		t.Fatalf("expected miss without a generator, got %d results", len(found))
+	}
+
+	gen := &fakeGenerator{}
+	srv.cfgMu.Lock()
+	srv.gen = gen
+	srv.cfgMu.Unlock()
+	found := search()
+	if len(found) != 1 || !found[0].Adapted || found[0].Response != "KubeCon is in Atlanta" {
+		t.Fatalf("expected one adapted answer, got %+v", found)
+	}
+	if len(gen.prompts) != 1 || !strings.Contains(gen.prompts[0], "KubeCon EU is in London") {
+		t.Fatalf("expected generator to see the cached answer, got %q", gen.prompts)
+	}
+	stored, _ := ms.FindEntriesByMetadata(context.Background(), map[string]string{models.MetaAdaptedFrom: fmt.Sprint(src.ID)})
+	if len(stored) != 1 || stored[0].Adapted || !stored[0].Flag(models.MetaAdapted) {
+		t.Fatalf("expected adapted answer stored flagged with its source noted, got %+v", stored)
+	}
+	if p := stored[0].Provenance; p == nil || p.Model != "fake" || p.CompletionTokens != 6 {
+		t.Fatalf("expected generator provenance on the adapted entry, got %+v", p)
+	}
+
+	// a generator that hangs doesn't hold the search up
+	t.Setenv("SLC_ADAPT_TIMEOUT", "20ms")
+	srv.cfgMu.Lock()
+	srv.gen = hangingGenerator{}
+	srv.cfgMu.Unlock()
+	start := time.Now()
+	if e := srv.adapt(context.Background(), "Where is KubeCon Japan", &src, 0.9); e != nil || time.Since(start) > time.Second {
+		t.Fatalf("expected adaptation to give up after its timeout got %+v in %s", e, time.Since(start))
+	}
+}
+
+type hangingGenerator struct{}
+
+func (hangingGenerator) Generate(ctx context.Context, _ string) (*slm.Generation, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestServer_DriftCheckAlerts(t *testing.T) {
+	alerts := make(chan driftReport, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rep driftReport
+		_ = json.NewDecoder(r.Body).Decode(&rep)
+		alerts <- rep
+	}))
+	defer hook.Close()
+	t.Setenv("SLC_DRIFT_WEBHOOK", hook.URL)
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	for _, p := range []string{"What is Kubernetes", "Where is KubeCon"} {
+		b, _ := json.Marshal(&models.Entry{Prompt: p, Response: "answer"})
+		res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		res.Body.Close()
+	}
+	check := func() driftReport {
+		res, err := http.Post(ts.URL+"/admin/drift", "application/json", nil)
+		if err != nil {
+			t.Fatalf("drift: %v", err)
+		}
+		defer res.Body.Close()
+		var rep driftReport
+		_ = json.NewDecoder(res.Body).Decode(&rep)
+		return rep
+	}
+	if rep := check(); rep.Sampled != 2 || rep.Drifted || rep.Mean > 1e-9 {
+		t.Fatalf("expected no drift with an unchanged model, got %+v", rep)
+	}
+	// simulate a model swapped behind the same name
+	ms.mu.Lock()
+	for i := range ms.vectors[0] {
+		ms.vectors[0][i] = -ms.vectors[0][i]
+	}
+	ms.mu.Unlock()
+	rep := check()
+	if !rep.Drifted || rep.WorstID != ms.ids[0] {
+		t.Fatalf("expected drift on entry %d, got %+v", ms.ids[0], rep)
+	}
+	select {
+	case got := <-alerts:
+		if !got.Drifted || got.Sampled != 2 {
+			t.Fatalf("expected drifted webhook payload, got %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected webhook alert")
+	}
+}
+
+func TestServer_GarbageReportAndCleanup(t *testing.T) {
+	t.Setenv("SLC_GARBAGE_MIN_AGE", "1ns")
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	ids := map[string]int64{}
+	for _, p := range []string{"What is Kubernetes", "what is Kubernetes", "Where is KubeCon", "Best pizza toppings"} {
+		b, _ := json.Marshal(&models.Entry{Prompt: p, Response: "answer"})
+		res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		res.Body.Close()
+		ids[p] = e.ID
+	}
+	// the same prompt for another tenant and another model is no duplicate
+	for key, meta := range map[string]map[string]interface{}{
+		"team": {models.MetaNamespace: "team"},
+		"llm":  {models.MetaLLMString: "gpt-x"},
+	} {
+		b, _ := json.Marshal(&models.Entry{Prompt: "What is Kubernetes", Response: "answer", Metadata: meta})
+		res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		res.Body.Close()
+		ids[key] = e.ID
+	}
+	// a failed embed stored as a zero vector
+	ms.mu.Lock()
+	for i, id := range ms.ids {
+		if id == ids["Best pizza toppings"] {
+			ms.vectors[i] = make([]float64, len(ms.vectors[i]))
+		}
+	}
+	ms.mu.Unlock()
+	res, err := http.Get(ts.URL + "/search?q=Where+is+KubeCon")
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	res.Body.Close()
+
+	report := func(method, query string) garbageReport {
+		req, _ := http.NewRequest(method, ts.URL+"/admin/garbage"+query, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("garbage: %v", err)
+		}
+		defer res.Body.Close()
+		var rep garbageReport
+		_ = json.NewDecoder(res.Body).Decode(&rep)
+		return rep
+	}
+	rep := report(http.MethodGet, "")
+	for _, g := range rep.NeverHit {
+		if g.ID == ids["Where is KubeCon"] {
+			t.Fatalf("expected hit entry not reported as never hit")
+		}
+	}
+	if len(rep.Degenerate) != 1 || rep.Degenerate[0].ID != ids["Best pizza toppings"] {
+		t.Fatalf("expected zero-vector entry flagged, got %+v", rep.Degenerate)
+	}
+	if len(rep.Duplicates) != 1 || len(rep.Duplicates[0]) != 2 {
+		t.Fatalf("expected one duplicate pair, got %+v", rep.Duplicates)
+	}
+
+	rep = report(http.MethodPost, "?cleanup=duplicates,degenerate")
+	if len(rep.Deleted) != 2 {
+		t.Fatalf("expected 2 deleted got %v", rep.Deleted)
+	}
+	if _, err := ms.GetEntry(context.Background(), ids["What is Kubernetes"]); err != nil {
+		t.Fatalf("expected the oldest duplicate kept: %v", err)
+	}
+	if _, err := ms.GetEntry(context.Background(), ids["what is Kubernetes"]); err == nil {
+		t.Fatalf("expected the newer duplicate removed")
+	}
+	for _, key := range []string{"team", "llm"} {
+		if _, err := ms.GetEntry(context.Background(), ids[key]); err != nil {
+			t.Fatalf("expected the %s copy kept: %v", key, err)
+		}
+	}
+}
+
+type nanSLM struct{ slm.SLM }
+
+func (nanSLM) Embed(prompt string) ([]float64, error) {
+	return []float64{math.NaN(), 1}, nil
+}
+
+func TestServer_RejectsDegenerateEmbeddings(t *testing.T) {
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	// the mock SLM embeds an empty prompt as a zero vector
+	before := degenerateVectors.Value(stageInsert, "zero norm")
+	res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader([]byte(`{"prompt":"","response":"x"}`)))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 got %d", res.StatusCode)
+	}
+	if got := degenerateVectors.Value(stageInsert, "zero norm"); got != before+1 {
+		t.Fatalf("expected degenerate counter to grow by 1, got %v -> %v", before, got)
+	}
+	if n := len(ms.AllIDs()); n != 0 {
+		t.Fatalf("expected nothing stored, got %d entries", n)
+	}
+
+	srv.cfgMu.Lock()
+	srv.slm = nanSLM{srv.slm}
+	srv.cfgMu.Unlock()
+	res, err = http.Post(ts.URL+"/entries/batch", "application/json", bytes.NewReader([]byte(`[{"prompt":"What is Kubernetes","response":"x"}]`)))
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	var out []models.BatchResult
+	_ = json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	if len(out) != 1 || !strings.Contains(out[0].Error, "non-finite") {
+		t.Fatalf("expected per-row degenerate error, got %+v", out)
+	}
+	resp, err := http.Get(ts.URL + "/search?q=What+is+Kubernetes")
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected degenerate query vector to fall back, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_QueryLogHashesText(t *testing.T) {
+	path := t.TempDir() + "/queries.jsonl"
+	t.Setenv("SLC_QUERY_LOG", path)
+	ms := newMockStore()
+	srv := New(ms)
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	b, _ := json.Marshal(&models.Entry{Prompt: "What is Kubernetes", Response: "answer"})
+	res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	res.Body.Close()
+	resp, err := http.Get(ts.URL + "/search?q=What+is+Kubernetes")
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	resp.Body.Close()
+	srv.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	var rec querylog.Record
+	if err := json.Unmarshal(bytes.TrimSpace(data), &rec); err != nil {
+		t.Fatalf("expected one JSON record, got %q: %v", data, err)
+	}
+	if rec.Source != "search" || len(rec.IDs) != 1 || len(rec.Scores) != 1 || rec.QueryHash == "" || rec.Query != "" {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+}
+
+func TestServer_EntryProvenance(t *testing.T) {
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	body := `{"prompt":"What is Kubernetes","response":"an orchestrator","provenance":{"model":"gpt-4o","latency_ms":1830.5,"prompt_tokens":12,"completion_tokens":140,"cost_usd":0.0021,"request_id":"chatcmpl-123"}}`
+	res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var created models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	got, err := http.Get(fmt.Sprintf("%s/entries/%d", ts.URL, created.ID))
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	var e models.Entry
+	_ = json.NewDecoder(got.Body).Decode(&e)
+	got.Body.Close()
+	want := models.Provenance{Model: "gpt-4o", LatencyMS: 1830.5, PromptTokens: 12, CompletionTokens: 140, CostUSD: 0.0021, RequestID: "chatcmpl-123"}
+	if e.Provenance == nil || *e.Provenance != want {
+		t.Fatalf("expected provenance %+v got %+v", want, e.Provenance)
+	}
+
+	res, err = http.Post(ts.URL+"/entries", "application/json", bytes.NewReader([]byte(`{"prompt":"x y","response":"z","provenance":{"prompt_tokens":-1}}`)))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for negative token count got %d", res.StatusCode)
+	}
+}
+
+func TestServer_BackupAndPointInTimeRestore(t *testing.T) {
+	t.Setenv("SLC_WAL_DIR", t.TempDir())
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	create := func(prompt string) {
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"`+prompt+`","response":"r"}`))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		res.Body.Close()
+	}
+	prompts := func() []string {
+		var out []string
+		for _, id := range st.AllIDs() {
+			e, _ := st.GetEntry(context.Background(), id)
+			out = append(out, e.Prompt)
+		}
+		return out
+	}
+
+	create("alpha")
+	res, err := http.Get(ts.URL + "/admin/backup")
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	var buf bytes.Buffer
+	_, _ = buf.ReadFrom(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", res.StatusCode)
+	}
+	snapshot := buf.Bytes()
+
+	create("bravo")
+	time.Sleep(5 * time.Millisecond)
+	mid := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	create("charlie")
+
+	restore := func(query string) models.RestoreResult {
+		res, err := http.Post(ts.URL+"/admin/restore"+query, "application/json", bytes.NewReader(snapshot))
+		if err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200 got %d", res.StatusCode)
+		}
+		var out models.RestoreResult
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return out
+	}
+
+	out := restore("?at=" + url.QueryEscape(mid.UTC().Format(time.RFC3339Nano)))
+	if got := prompts(); fmt.Sprint(got) != "[alpha bravo]" || out.Replayed != 1 {
+		t.Fatalf("expected [alpha bravo] after 1 replayed record got %v (%d)", got, out.Replayed)
+	}
+	// the restore itself is journaled, so rolling forward past it lands on
+	// the restored state rather than the pre-restore history
+	create("delta")
+	restore("?at=" + url.QueryEscape(time.Now().UTC().Format(time.RFC3339Nano)))
+	if got := prompts(); fmt.Sprint(got) != "[alpha bravo delta]" {
+		t.Fatalf("expected [alpha bravo delta] got %v", got)
+	}
+	restore("")
+	if got := prompts(); fmt.Sprint(got) != "[alpha]" {
+		t.Fatalf("expected [alpha] got %v", got)
+	}
+}
+
+func TestServer_AsOfReads(t *testing.T) {
+	t.Setenv("SLC_WAL_DIR", t.TempDir())
+	t.Setenv("SLC_AS_OF_RESOLUTION", "1ms")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"what is a pod","response":"v1"}`))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var created models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	entryURL := fmt.Sprintf("%s/entries/%d", ts.URL, created.ID)
+	pause := func() time.Time {
+		time.Sleep(5 * time.Millisecond)
+		at := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		return at
+	}
+	first := pause()
+	req, _ := http.NewRequest(http.MethodPut, entryURL, strings.NewReader(`{"prompt":"what is a pod","response":"v2"}`))
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	res.Body.Close()
+	second := pause()
+	req, _ = http.NewRequest(http.MethodDelete, entryURL, nil)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	res.Body.Close()
+	pause()
+	asOf := func(at time.Time) string {
+		return "as_of=" + url.QueryEscape(at.UTC().Format(time.RFC3339Nano))
+	}
+
+	for at, want := range map[time.Time]string{first: "v1", second: "v2"} {
+		res, err := http.Get(entryURL + "?" + asOf(at))
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || e.Response != want {
+			t.Fatalf("expected 200 with %s got %d with %q", want, res.StatusCode, e.Response)
+		}
+	}
+	res, _ = http.Get(entryURL + "?" + asOf(time.Now()))
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 after the delete got %d", res.StatusCode)
+	}
+
+	search := func(at time.Time) []models.Entry {
+		res, err := http.Get(ts.URL + "/search?q=" + url.QueryEscape("what is a pod") + "&" + asOf(at))
+		if err != nil {
+			t.Fatalf("search: %v", err)
+		}
+		defer res.Body.Close()
+		var out []models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return out
+	}
+	if got := search(first); len(got) != 1 || got[0].Response != "v1" {
+		t.Fatalf("expected v1 as of the first write got %+v", got)
+	}
+	if got := search(time.Now()); len(got) != 0 {
+		t.Fatalf("expected no results after the delete got %+v", got)
+	}
+
+	res, _ = http.Get(entryURL + "?as_of=yesterday")
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a malformed as_of got %d", res.StatusCode)
+	}
+
+	// rebuilt stores are reused for reads of the same moment
+	a, err := srv.storeAsOf(context.Background(), second)
+	if err != nil {
+		t.Fatalf("as of: %v", err)
+	}
+	if b, _ := srv.storeAsOf(context.Background(), second); a != b {
+		t.Fatalf("expected the cached store for the same moment")
+	}
+
+	t.Setenv("SLC_API_KEYS", "r-key=read")
+	req, _ = http.NewRequest(http.MethodGet, entryURL+"?"+asOf(first), nil)
+	req.Header.Set("Authorization", "Bearer r-key")
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for an as-of read with a read key got %d", res.StatusCode)
+	}
+}
+
+func TestServer_BulkMetadataUpdate(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	for prompt, source := range map[string]string{"what is a pod": "faq", "what is a node": "faq", "what is a service": "blog"} {
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"`+prompt+`","response":"r","metadata":{"source":"`+source+`"}}`))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		res.Body.Close()
+	}
+	patch := func(query, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPatch, ts.URL+"/entries/metadata"+query, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("patch: %v", err)
+		}
+		return res
+	}
+
+	res := patch("?metadata.source=faq", `{"metadata":{"source":"kb","reviewed":true}}`)
+	var out map[string]int
+	_ = json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || out["updated"] != 2 {
+		t.Fatalf("expected 200 with 2 updated got %d with %v", res.StatusCode, out)
+	}
+	for source, want := range map[string]int{"faq": 0, "kb": 2, "blog": 1} {
+		entries, _ := st.FindEntriesByMetadata(context.Background(), map[string]string{"source": source})
+		if len(entries) != want {
+			t.Fatalf("expected %d entries from %s got %d", want, source, len(entries))
+		}
+	}
+
+	for _, tc := range []struct{ query, body string }{
+		{"", `{"metadata":{"source":"kb"}}`},
+		{"?metadata.source=kb", `{"metadata":{"state":"published"}}`},
+		{"?metadata.source=kb", `{"metadata":{"source":"kb"},"replace":true}`},
+	} {
+		res := patch(tc.query, tc.body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s %s got %d", tc.query, tc.body, res.StatusCode)
+		}
+	}
+}
+
+func TestServer_CopyAcrossNamespaces(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	ids := map[string]int64{}
+	for prompt, source := range map[string]string{"what is a pod": "faq", "what is a node": "faq", "what is a service": "blog"} {
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"`+prompt+`","response":"r","metadata":{"namespace":"staging","source":"`+source+`"}}`))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		res.Body.Close()
+		ids[prompt] = e.ID
+	}
+	post := func(path string) *http.Response {
+		res, err := http.Post(ts.URL+path, "application/json", nil)
+		if err != nil {
+			t.Fatalf("copy: %v", err)
+		}
+		return res
+	}
+	inProd := func() int {
+		entries, _ := st.FindEntriesByMetadata(context.Background(), map[string]string{"namespace": "prod"})
+		return len(entries)
+	}
+
+	res := post(fmt.Sprintf("/ns/staging/entries/%d/copy?to=prod", ids["what is a pod"]))
+	var c models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&c)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated || c.Namespace() != "prod" || c.ID == ids["what is a pod"] {
+		t.Fatalf("expected 201 with a new entry in prod got %d with %+v", res.StatusCode, c)
+	}
+	// promoting again replaces the copy
+	res = post(fmt.Sprintf("/ns/staging/entries/%d/copy?to=prod", ids["what is a pod"]))
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || inProd() != 1 {
+		t.Fatalf("expected 200 and one entry in prod got %d and %d", res.StatusCode, inProd())
+	}
+
+	res = post("/ns/staging/entries/copy?to=prod&metadata.source=faq")
+	var rep copyReport
+	_ = json.NewDecoder(res.Body).Decode(&rep)
+	res.Body.Close()
+	if rep.Copied != 2 || rep.Reused != 2 || inProd() != 2 {
+		t.Fatalf("expected 2 copied with their vectors reused and 2 in prod got %+v and %d", rep, inProd())
+	}
+	// without a metadata filter every entry of the namespace is copied
+	res = post("/ns/staging/entries/copy?to=archive")
+	rep = copyReport{}
+	_ = json.NewDecoder(res.Body).Decode(&rep)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || rep.Copied != 3 {
+		t.Fatalf("expected all 3 entries copied got %d with %+v", res.StatusCode, rep)
+	}
+
+	for path, want := range map[string]int{
+		fmt.Sprintf("/ns/staging/entries/%d/copy", ids["what is a pod"]):            http.StatusBadRequest,
+		fmt.Sprintf("/ns/other/entries/%d/copy?to=prod", ids["what is a pod"]):      http.StatusNotFound,
+		fmt.Sprintf("/ns/staging/entries/%d/copy?to=staging", ids["what is a pod"]): http.StatusBadRequest,
+	} {
+		res := post(path)
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Fatalf("expected %d for %s got %d", want, path, res.StatusCode)
+		}
+	}
+}
+
+func TestServer_NamespaceLifecycle(t *testing.T) {
+	t.Setenv("SLC_REQUIRE_NAMESPACES", "true")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		res.Body.Close()
+		return res
+	}
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/namespaces", `{"name":"prod","ttl":"1h","max_entries":1}`, http.StatusCreated},
+		{http.MethodPost, "/namespaces", `{"name":"prod"}`, http.StatusConflict},
+		{http.MethodPost, "/namespaces", `{"name":"bad","ttl":"soon"}`, http.StatusBadRequest},
+		{http.MethodPost, "/entries", `{"prompt":"what is a pod","response":"r","metadata":{"namespace":"staging"}}`, http.StatusBadRequest},
+		{http.MethodPost, "/entries", `{"prompt":"what is a pod","response":"r","metadata":{"namespace":"prod"}}`, http.StatusCreated},
+		{http.MethodPost, "/entries", `{"prompt":"what is a node","response":"r","metadata":{"namespace":"prod"}}`, http.StatusCreated},
+		{http.MethodPost, "/entries", `{"prompt":"what is a service","response":"r"}`, http.StatusCreated},
+	} {
+		if res := do(tc.method, tc.path, tc.body); res.StatusCode != tc.want {
+			t.Fatalf("expected %d for %s %s %s got %d", tc.want, tc.method, tc.path, tc.body, res.StatusCode)
+		}
+	}
+
+	entries, _ := srv.findEntries(context.Background(), "prod", nil)
+	if ttl := srv.ttlOf(entries[0], nil); ttl != time.Hour {
+		t.Fatalf("expected the namespace's 1h TTL got %s", ttl)
+	}
+	// max_entries evicts the oldest
+	srv.evictNamespaces(context.Background())
+	if entries, _ = srv.findEntries(context.Background(), "prod", nil); len(entries) != 1 || entries[0].Prompt != "what is a node" {
+		t.Fatalf("expected only the newest entry left in prod got %d", len(entries))
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/namespaces/prod", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	var out map[string]int
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if out["deleted"] != 1 || len(st.AllIDs()) != 1 {
+		t.Fatalf("expected the namespace's one entry deleted and the other kept got %v and %d", out, len(st.AllIDs()))
+	}
+	if res := do(http.MethodGet, "/namespaces/prod", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a deleted namespace got %d", res.StatusCode)
+	}
+	if res := do(http.MethodDelete, "/namespaces/default", ""); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 deleting the default namespace got %d", res.StatusCode)
+	}
+}
+
+func TestServer_NamespaceQuotaWarnings(t *testing.T) {
+	warnings := make(chan quotaWarning, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var warning quotaWarning
+		_ = json.NewDecoder(r.Body).Decode(&warning)
+		warnings <- warning
+	}))
+	defer hook.Close()
+	t.Setenv("SLC_QUOTA_WEBHOOK", hook.URL)
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	post := func(path, body string) int {
+		res, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := post("/namespaces", `{"name":"team","quota":5}`); code != http.StatusCreated {
+		t.Fatalf("expected 201 declaring the namespace got %d", code)
+	}
+	for i := 0; i < 5; i++ {
+		body := fmt.Sprintf(`{"prompt":"question %d","response":"r","metadata":{"namespace":"team"}}`, i)
+		if code := post("/entries", body); code != http.StatusCreated {
+			t.Fatalf("expected entry %d within the quota got %d", i, code)
+		}
+	}
+	if code := post("/entries", `{"prompt":"one too many","response":"r","metadata":{"namespace":"team"}}`); code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 past the quota got %d", code)
+	}
+	if code := post("/entries", `{"prompt":"elsewhere","response":"r"}`); code != http.StatusCreated {
+		t.Fatalf("expected other namespaces unaffected got %d", code)
+	}
+	// the hooks are posted concurrently, so they may arrive in either order
+	seen := map[int]bool{}
+	for range 2 {
+		select {
+		case w := <-warnings:
+			if w.Namespace != "team" || w.Quota != 5 {
+				t.Fatalf("expected a warning for team got %+v", w)
+			}
+			seen[w.Threshold] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected two warnings got %v", seen)
+		}
+	}
+	if !seen[80] || !seen[90] {
+		t.Fatalf("expected warnings at 80%% and 90%% got %v", seen)
+	}
+	// a full namespace is only warned about once
+	srv.checkQuotas(context.Background())
+	select {
+	case w := <-warnings:
+		t.Fatalf("expected no repeated warning got %+v", w)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_Estimate(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	for _, body := range []string{
+		`{"prompt":"what is a pod","response":"r","metadata":{"namespace":"prod"}}`,
+		`{"prompt":"what is a node","response":"r","metadata":{"namespace":"prod"}}`,
+		`{"prompt":"what is a service","response":"r"}`,
+	} {
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(body))
+		if err != nil || res.StatusCode != http.StatusCreated {
+			t.Fatalf("create: %v", err)
+		}
+		res.Body.Close()
+	}
+	estimate := func(query string) searchEstimate {
+		res, err := http.Get(ts.URL + "/estimate?" + query)
+		if err != nil {
+			t.Fatalf("estimate: %v", err)
+		}
+		defer res.Body.Close()
+		var est searchEstimate
+		_ = json.NewDecoder(res.Body).Decode(&est)
+		return est
+	}
+	if est := estimate("q=What+is+a+service%3F"); est.Tier != "l1" || est.Embeds || est.Candidates != 0 {
+		t.Fatalf("expected an exact match without embedding got %+v", est)
+	}
+	if est := estimate("q=how+do+deployments+roll+out&limit=2&oversample=1"); est.Tier != "l2" || !est.Embeds || est.Candidates != 3 || est.K != 2 {
+		t.Fatalf("expected a vector search over 3 entries got %+v", est)
+	}
+	if est := estimate("q=how+do+deployments+roll+out&metadata.namespace=prod"); est.Candidates != 2 {
+		t.Fatalf("expected the filter to narrow the search to 2 got %+v", est)
+	}
+	if res, _ := http.Get(ts.URL + "/estimate"); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without q got %d", res.StatusCode)
+	}
+}
+
+func TestServer_SearchBudget(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"how are pods scheduled","response":"by the scheduler"}`))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %v", err)
+	}
+	res.Body.Close()
+	// query embeds have mostly been taking seconds
+	for range embedLatency.Count(stageQuery) + 10 {
+		embedLatency.Observe(5, stageQuery)
+	}
+	search := func(query string) *http.Response {
+		res, err := http.Get(ts.URL + "/search?" + query)
+		if err != nil {
+			t.Fatalf("search: %v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := search("q=how+are+pods+scheduled&budget_ms=20"); !strings.Contains(res.Header.Get("X-SLMCache"), "tier=l1") || strings.Contains(res.Header.Get("X-SLMCache"), "skipped") {
+		t.Fatalf("expected an exact match within the budget got %q", res.Header.Get("X-SLMCache"))
+	}
+	res = search("q=scheduling+pods&budget_ms=20")
+	if got := res.Header.Get("X-SLMCache"); !strings.HasPrefix(got, "HIT") || !strings.HasSuffix(got, "skipped=embed") {
+		t.Fatalf("expected a lexical hit with the embedding skipped got %q", got)
+	}
+	if res := search("q=scheduling+pods"); strings.Contains(res.Header.Get("X-SLMCache"), "skipped") {
+		t.Fatalf("expected no stage skipped without a budget got %q", res.Header.Get("X-SLMCache"))
+	}
+	if res := search("q=pods&budget_ms=soon"); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a malformed budget got %d", res.StatusCode)
+	}
+}
+
+func TestServer_HitStatisticsPersist(t *testing.T) {
+	t.Setenv("SLC_API_KEYS", "w-key=write")
+	st, _ := store.New()
+	srv := New(st)
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	call := func(method, path, body string) models.Entry {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer w-key")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer res.Body.Close()
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return e
+	}
+	created := call(http.MethodPost, "/entries", `{"prompt":"What is Kubernetes","response":"an orchestrator","hit_count":99,"created_by":"someone"}`)
+	path := fmt.Sprintf("/entries/%d", created.ID)
+	if e := call(http.MethodGet, path, ""); e.HitCount != 0 || e.CreatedBy == "" || e.CreatedBy == "someone" {
+		t.Fatalf("expected no hits and the key's fingerprint as creator got %d, %q", e.HitCount, e.CreatedBy)
+	}
+	for i := 0; i < 2; i++ {
+		call(http.MethodGet, "/search?q=What+is+Kubernetes", "")
+	}
+	srv.flushHits(context.Background())
+	e := call(http.MethodGet, path, "")
+	if e.HitCount != 2 || e.LastHitAt.IsZero() {
+		t.Fatalf("expected 2 recorded hits got %d at %v", e.HitCount, e.LastHitAt)
+	}
+	// rewriting the entry keeps its statistics
+	call(http.MethodPut, path, `{"prompt":"What is Kubernetes","response":"a container orchestrator","hit_count":0}`)
+	if updated := call(http.MethodGet, path, ""); updated.HitCount != 2 || updated.CreatedBy != e.CreatedBy {
+		t.Fatalf("expected the update to keep 2 hits by %q got %d by %q", e.CreatedBy, updated.HitCount, updated.CreatedBy)
+	}
+
+	// hits since the last flush are recorded on Close, and travel with
+	// the entry into a snapshot
+	call(http.MethodGet, "/search?q=What+is+Kubernetes", "")
+	srv.Close()
+	snap, err := st.(store.Snapshotter).Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	restarted, _ := store.New()
+	if err := restarted.(store.Snapshotter).Restore(context.Background(), snap); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	got, err := restarted.GetEntry(context.Background(), created.ID)
+	if err != nil || got.HitCount != 3 || got.CreatedBy != e.CreatedBy {
+		t.Fatalf("expected 3 hits by %q after a restart got %+v (%v)", e.CreatedBy, got, err)
+	}
+}
+
+func TestServer_ThrashingPromptsAreReportedAndSkipped(t *testing.T) {
+	t.Setenv("SLC_THRASH_CHANGES", "2")
+	t.Setenv("SLC_THRASH_POLICY", "skip")
+	st, _ := store.New()
+	srv := New(st)
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	post := func(prompt, response string) int {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(fmt.Sprintf(`{"prompt":%q,"response":%q}`, prompt, response)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// the same answer again isn't a change
+	for _, r := range []string{"12:00", "12:00", "12:05", "12:10"} {
+		if code := post("What time is it", r); code != http.StatusCreated {
+			t.Fatalf("expected 201 for %s got %d", r, code)
+		}
+	}
+	if code := post("what time is  it", "12:15"); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected the thrashing prompt to be refused got %d", code)
+	}
+	if code := post("What is Kubernetes", "an orchestrator"); code != http.StatusCreated {
+		t.Fatalf("expected a settled prompt to be stored got %d", code)
+	}
+
+	res, err := http.Get(ts.URL + "/stats/thrash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var report thrashReport
+	_ = json.NewDecoder(res.Body).Decode(&report)
+	if report.Policy != "skip" || len(report.Prompts) != 1 || report.Prompts[0].Changes != 3 {
+		t.Fatalf("expected one prompt with 3 changes, the refused write included, got %+v", report)
+	}
+}
+
+func TestServer_UncacheablePrompts(t *testing.T) {
+	t.Setenv("SLC_UNCACHEABLE", `[{"name":"clock","pattern":"(?i)what time"},{"name":"greeting","max_tokens":1,"metadata":{"source":"chat"}}]`)
+	st, _ := store.New()
+	srv := New(st)
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	post := func(body string) (int, string) {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(msg)
+	}
+	if code, msg := post(`{"prompt":"What time is it","response":"12:00"}`); code != http.StatusUnprocessableEntity || !strings.Contains(msg, `"clock"`) {
+		t.Fatalf("expected 422 naming the clock rule got %d %s", code, msg)
+	}
+	if code, _ := post(`{"prompt":"hi","response":"hello","metadata":{"source":"chat"}}`); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected a one-word chat prompt to be refused got %d", code)
+	}
+	// every condition of a rule must hold
+	if code, _ := post(`{"prompt":"hi","response":"hello","metadata":{"source":"faq"}}`); code != http.StatusCreated {
+		t.Fatalf("expected a one-word faq prompt to be stored got %d", code)
+	}
+
+	_, _ = st.CreateEntryWithVector(context.Background(), &models.Entry{Prompt: "what time is it", Response: "12:00"}, []float64{0.1, 0.2})
+	res, err := http.Get(ts.URL + "/search?q=what+time+is+it")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var found []models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&found)
+	if len(found) != 0 || res.Header.Get(decisionHeader) != "MISS; uncacheable=clock" {
+		t.Fatalf("expected the lookup to skip the store got %d results, %q", len(found), res.Header.Get(decisionHeader))
+	}
+}
+
+func TestServer_CacheabilityClassifierLearnsVolatilePrompts(t *testing.T) {
+	t.Setenv("SLC_CACHEABILITY", "rules")
+	t.Setenv("SLC_CACHEABILITY_LEARN", "2")
+	st, _ := store.New()
+	srv := New(st)
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	post := func(prompt string) (int, models.Entry) {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(fmt.Sprintf(`{"prompt":%q,"response":"r"}`, prompt)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return res.StatusCode, e
+	}
+	if code, e := post("What is Kubernetes"); code != http.StatusCreated || e.Metadata[models.MetaCacheability] != 1.0 {
+		t.Fatalf("expected a stable prompt scored 1 got %d %v", code, e.Metadata)
+	}
+	for i := 0; i < 2; i++ {
+		if code, e := post("What is the weather today"); code != http.StatusCreated || e.Metadata[models.MetaCacheability].(float64) >= 0.5 {
+			t.Fatalf("expected a volatile prompt to be stored with a low score got %d %v", code, e.Metadata)
+		}
+	}
+	if code, _ := post("what is the weather  today?"); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected the learned prompt to be refused got %d", code)
+	}
+	res, err := http.Get(ts.URL + "/search?q=What+is+the+weather+today")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get(decisionHeader); got != "MISS; uncacheable=learned" {
+		t.Fatalf("expected the lookup to skip the store got %q", got)
+	}
+
+	res, err = http.Get(ts.URL + "/admin/uncacheable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if !strings.Contains(string(body), `"prompt":"What is the weather today"`) {
+		t.Fatalf("expected the learned prompt to be listed got %s", body)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/admin/uncacheable", nil)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 got %v (%v)", res, err)
+	}
+	if code, _ := post("What is the weather today"); code != http.StatusCreated {
+		t.Fatalf("expected a forgotten prompt to be stored again got %d", code)
+	}
+}
+
+// expiringStore stands in for a store that expires entries natively.
+type expiringStore struct {
+	*mockStore
+	ttl func(*models.Entry) time.Duration
+}
+
+func (e *expiringStore) SetExpiry(ttl func(*models.Entry) time.Duration) { e.ttl = ttl }
+
+func (e *expiringStore) Health(ctx context.Context) error { return nil }
+
+func (e *expiringStore) Capabilities() store.Capabilities {
+	return store.Capabilities{PurgeExpired: true}
+}
+
+func TestServer_ExpiryIsOffloadedToTheStore(t *testing.T) {
+	t.Setenv("SLC_ENTRY_TTL", "1s")
+	t.Setenv("SLC_PURGE_INTERVAL", "10m")
+	t.Setenv("SLC_TOOL_TTLS", "weather=5m")
+	ms := &expiringStore{mockStore: newMockStore()}
+	srv := New(ms)
+	defer srv.Close()
+	if ms.ttl == nil {
+		t.Fatalf("expected the server to hand its TTL policy to the store")
+	}
+	if got := ms.ttl(&models.Entry{Prompt: "p"}); got != time.Second {
+		t.Fatalf("expected 1s got %s", got)
+	}
+	if got := ms.ttl(&models.Entry{Prompt: "p", Metadata: map[string]interface{}{models.MetaTool: "weather"}}); got != 5*time.Minute {
+		t.Fatalf("expected the tool TTL got %s", got)
+	}
+	if got := ms.ttl(&models.Entry{Prompt: "p", Metadata: map[string]interface{}{models.MetaPinned: true}}); got != 0 {
+		t.Fatalf("expected pinned entries to never expire got %s", got)
+	}
+
+	past := time.Now().Add(-2 * time.Second)
+	if _, err := ms.CreateEntryWithVector(context.Background(), &models.Entry{Prompt: "old", Response: "data", CreatedAt: past}, []float64{1, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if removed := srv.purgeExpired(context.Background()); removed != 0 {
+		t.Fatalf("expected the janitor to leave expiry to the store got %d removed", removed)
+	}
+}
+
+func TestServer_JournalsEvictionsAndExpiries(t *testing.T) {
+	t.Setenv("SLC_WAL_DIR", t.TempDir())
+	t.Setenv("SLC_ENTRY_TTL", "1s")
+	t.Setenv("SLC_PURGE_INTERVAL", "10m")
+	ctx := context.Background()
+	deletes := func(srv *Server) []int64 {
+		var out []int64
+		_ = srv.observed.journal.Replay(0, func(rec wal.Record) error {
+			if rec.Op == wal.OpDelete {
+				out = append(out, rec.ID)
+			}
+			return nil
+		})
+		return out
+	}
+
+	st, _ := store.NewWithOptions(store.Options{MaxEntries: 2})
+	srv := New(st)
+	var ids []int64
+	for _, p := range []string{"one", "two", "three"} {
+		id, err := srv.store.CreateEntryWithVector(ctx, &models.Entry{Prompt: p, Response: "r"}, []float64{1, 0, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if got := deletes(srv); fmt.Sprint(got) != fmt.Sprint(ids[:1]) {
+		t.Fatalf("expected the eviction of %d journaled got %v", ids[0], got)
+	}
+	srv.Close()
+
+	t.Setenv("SLC_WAL_DIR", t.TempDir())
+	ms := &expiringStore{mockStore: newMockStore()}
+	srv = New(ms)
+	defer srv.Close()
+	if ms.ttl != nil {
+		t.Fatalf("expected expiry to stay with the server when a WAL is configured")
+	}
+	id, err := ms.CreateEntryWithVector(ctx, &models.Entry{Prompt: "old", Response: "data", CreatedAt: time.Now().Add(-2 * time.Second)}, []float64{1, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed := srv.purgeExpired(ctx); removed != 1 {
+		t.Fatalf("expected the janitor to expire the entry got %d removed", removed)
+	}
+	if got := deletes(srv); len(got) != 1 || got[0] != id {
+		t.Fatalf("expected the expiry of %d journaled got %v", id, got)
+	}
+}
+
+func TestServer_SummarizesOversizedResponses(t *testing.T) {
+	t.Setenv("SLC_BLOB_STORE", "fs")
+	t.Setenv("SLC_BLOB_DIR", t.TempDir())
+	t.Setenv("SLC_SUMMARIZE_ABOVE", "10")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	gen := &fakeGenerator{}
+	srv.cfgMu.Lock()
+	srv.gen = gen
+	srv.cfgMu.Unlock()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	post := func(body string) models.Entry {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return e
+	}
+	long := strings.Repeat("KubeCon North America moves to Atlanta this year. ", 4)
+	e := post(fmt.Sprintf(`{"prompt":"Where is KubeCon","response":%q}`, long))
+	if e.Response != "KubeCon is in Atlanta" || e.Metadata[models.MetaSummarized] == nil {
+		t.Fatalf("expected the response stored summarized got %q %v", e.Response, e.Metadata)
+	}
+	if len(gen.prompts) != 1 || !strings.Contains(gen.prompts[0], long) {
+		t.Fatalf("expected the generator to see the full response got %q", gen.prompts)
+	}
+	res, err := http.Get(fmt.Sprintf("%s/entries/%d/response", ts.URL, e.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != long {
+		t.Fatalf("expected the full response got %d %q", res.StatusCode, body)
+	}
+
+	if short := post(`{"prompt":"Who runs KubeCon","response":"The CNCF"}`); short.Response != "The CNCF" || short.Metadata[models.MetaSummarized] != nil {
+		t.Fatalf("expected a short response stored whole got %q %v", short.Response, short.Metadata)
+	}
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/namespaces/verbatim", strings.NewReader(`{"summarize_above":0}`))
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode >= 300 {
+		t.Fatalf("expected the namespace declared got %v (%v)", res, err)
+	}
+	kept := post(fmt.Sprintf(`{"prompt":"Where is KubeCon","response":%q,"metadata":{"namespace":"verbatim"}}`, long))
+	if kept.Response != long {
+		t.Fatalf("expected the namespace to turn summarization off got %q", kept.Response)
+	}
+
+	// other write paths summarize too
+	for path, body := range map[string]string{
+		"/entries/batch": fmt.Sprintf(`[{"prompt":"Where is KubeCon EU","response":%q}]`, long),
+		"/put":           fmt.Sprintf(`{"prompt":"Where is KubeCon NA","llm_string":"m","answer":%q}`, long),
+	} {
+		res, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	entries, _ := st.FindEntriesByMetadata(context.Background(), nil)
+	summarizedCount := 0
+	for _, e := range entries {
+		if e.Response == long {
+			continue
+		}
+		if e.Metadata[models.MetaSummarized] != nil {
+			summarizedCount++
+		}
+	}
+	if summarizedCount != 3 {
+		t.Fatalf("expected /entries, /entries/batch and /put responses summarized got %d", summarizedCount)
+	}
+}
+
+func TestServer_EncryptedNamespace(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	do := func(method, path, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := do(http.MethodPost, "/namespaces", `{"name":"vault","encrypted":true}`); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the namespace declared got %d", res.StatusCode)
+	}
+	res := do(http.MethodPost, "/encrypted/entries", `{"namespace":"vault","prompt_hash":"h1","ciphertext":"c2VjcmV0","vector":[0.6,0.8,0]}`)
+	var e models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&e)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated || e.Prompt != "h1" || !e.Flag(models.MetaEncrypted) || e.Embedder != nil {
+		t.Fatalf("expected the entry stored as sent got %d %+v", res.StatusCode, e)
+	}
+	if res := do(http.MethodPost, "/entries", `{"prompt":"secret","response":"plain","metadata":{"namespace":"vault"}}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a plaintext write refused got %d", res.StatusCode)
+	}
+	if res := do(http.MethodPost, "/encrypted/entries", `{"namespace":"default","prompt_hash":"h2","ciphertext":"x","vector":[1,0,0]}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an encrypted write outside an encrypted namespace refused got %d", res.StatusCode)
+	}
+	if res := do(http.MethodPatch, fmt.Sprintf("/entries/%d/metadata", e.ID), `{"metadata":{"namespace":"default"}}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected moving the entry out refused got %d", res.StatusCode)
+	}
+
+	res = do(http.MethodPost, "/encrypted/search", `{"namespace":"vault","vector":[0.6,0.8,0]}`)
+	var found []models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&found)
+	res.Body.Close()
+	if len(found) != 1 || found[0].ID != e.ID || found[0].Response != "c2VjcmV0" {
+		t.Fatalf("expected the ciphertext back got %d %+v", res.StatusCode, found)
+	}
+	if res := do(http.MethodGet, "/search?q=h1&metadata.namespace=vault", ""); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected text search of the namespace refused got %d", res.StatusCode)
+	}
+	res = do(http.MethodGet, "/search?q=h1", "")
+	found = nil
+	_ = json.NewDecoder(res.Body).Decode(&found)
+	res.Body.Close()
+	if len(found) != 0 {
+		t.Fatalf("expected text search to skip encrypted entries got %+v", found)
+	}
+	if res := do(http.MethodPut, "/namespaces/vault", `{"encrypted":false}`); res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected turning encryption off with entries refused got %d", res.StatusCode)
+	}
+}
+
+func TestServer_AntiEntropySync(t *testing.T) {
+	newNode := func() (*Server, store.Store, *httptest.Server) {
+		st, _ := store.New()
+		srv := New(st)
+		ts := httptest.NewServer(srv.Router())
+		t.Cleanup(func() { ts.Close(); srv.Close() })
+		return srv, st, ts
+	}
+	_, stA, tsA := newNode()
+	_, stB, tsB := newNode()
+	post := func(ts *httptest.Server, prompt, response string) {
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"`+prompt+`","response":"`+response+`"}`))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		res.Body.Close()
+	}
+	answers := func(st store.Store) map[string]string {
+		out := map[string]string{}
+		for _, id := range st.AllIDs() {
+			e, _ := st.GetEntry(context.Background(), id)
+			out[e.Prompt] = e.Response
+		}
+		return out
+	}
+	post(tsA, "only on a", "1")
+	post(tsA, "shared", "old")
+	post(tsB, "only on b", "2")
+	time.Sleep(5 * time.Millisecond)
+	post(tsB, "shared", "new")
+
+	sync := func() syncReport {
+		res, err := http.Post(tsA.URL+"/admin/sync?peer="+url.QueryEscape(tsB.URL), "application/json", nil)
+		if err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		defer res.Body.Close()
+		var rep syncReport
+		_ = json.NewDecoder(res.Body).Decode(&rep)
+		return rep
+	}
+	rep := sync()
+	if len(rep.Errors) > 0 || rep.Pulled != 2 || rep.Pushed != 1 {
+		t.Fatalf("expected 2 pulled and 1 pushed got %+v", rep)
+	}
+	want := map[string]string{"only on a": "1", "only on b": "2", "shared": "new"}
+	for name, st := range map[string]store.Store{"a": stA, "b": stB} {
+		if got := answers(st); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("instance %s: expected %v got %v", name, want, got)
+		}
+	}
+	if rep := sync(); rep.DifferingBuckets != 0 || rep.Pulled+rep.Pushed != 0 {
+		t.Fatalf("expected converged instances got %+v", rep)
+	}
+}
+
+func TestServer_FederatedSearch(t *testing.T) {
+	remoteStore, _ := store.New()
+	remote := New(remoteStore)
+	defer remote.Close()
+	rts := httptest.NewServer(remote.Router())
+	defer rts.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte(`[{"id":9,"prompt":"too late","response":"x","score":1}]`))
+	}))
+	defer slow.Close()
+	res, err := http.Post(rts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"Where is KubeCon Japan","response":"Tokyo"}`))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	res.Body.Close()
+
+	t.Setenv("SLC_FEDERATION_PEERS", "apac="+rts.URL+",slow="+slow.URL)
+	t.Setenv("SLC_FEDERATION_BUDGET", "100ms")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	start := time.Now()
+	res, err = http.Get(ts.URL + "/search?q=" + url.QueryEscape("Where is KubeCon Japan"))
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	var out []models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("expected the slow region to be cut off by the budget, took %s", elapsed)
+	}
+	if len(out) != 1 || out[0].Response != "Tokyo" || out[0].Region != "apac" || out[0].Score <= 0 {
+		t.Fatalf("expected the apac answer with a score got %+v", out)
+	}
+
+	res, _ = http.Get(ts.URL + "/search?federate=false&q=" + url.QueryEscape("Where is KubeCon Japan"))
+	out = nil
+	_ = json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	if len(out) != 0 {
+		t.Fatalf("expected no results with federate=false got %+v", out)
+	}
+}
+
+func TestServer_PrefetchWarmsRelatedQueries(t *testing.T) {
+	t.Setenv("SLC_PREFETCH", "true")
+	t.Setenv("SLC_PREFETCH_TEMPLATES", `["How do I install {metadata.product}?", "{metadata.missing} docs"]`)
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	// follow-ups stored behind the server's back are not in L1 yet
+	for _, p := range []string{"What about pricing?", "How do I install Kubernetes?"} {
+		vec, _ := srv.embed(context.Background(), p, stageInsert)
+		if _, err := st.CreateEntryWithVector(context.Background(), &models.Entry{Prompt: p, Response: "r"}, vec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"What is Kubernetes","response":"an orchestrator","metadata":{"related":["What about pricing?"],"product":"Kubernetes"}}`))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	res.Body.Close()
+
+	e := &models.Entry{Prompt: "What is Kubernetes", Metadata: map[string]interface{}{"related": []interface{}{"What about pricing?"}, "product": "Kubernetes"}}
+	if got := relatedQueries(e, srv.prefetch.templates); fmt.Sprint(got) != "[What about pricing? How do I install Kubernetes?]" {
+		t.Fatalf("unexpected related queries %q", got)
+	}
+
+	res, err = http.Get(ts.URL + "/search?q=" + url.QueryEscape("What is Kubernetes"))
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	res.Body.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for _, q := range []string{"what about pricing", "how do i install kubernetes"} {
+		for {
+			if _, ok := srv.exact.get(q); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %q to be prefetched into L1", q)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// topicSLM embeds a prompt as the sum of the topics it mentions.
+type topicSLM struct{ slm.SLM }
+
+func (topicSLM) Embed(prompt string) ([]float64, error) {
+	vec := make([]float64, 3)
+	for i, topic := range []string{"paris", "tokyo", "weather"} {
+		if strings.Contains(strings.ToLower(prompt), topic) {
+			vec[i] = 1
+		}
+	}
+	return vec, nil
+}
+
+func TestServer_SessionContextResolvesFollowUps(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	srv.slm = topicSLM{srv.slm}
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	for _, p := range []string{"What is the weather in Paris?", "What is the weather in Tokyo?"} {
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"`+p+`","response":"r"}`))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		res.Body.Close()
+	}
+	search := func(q, session string) []*models.Entry {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/search?" + url.Values{"q": {q}, "session_id": {session}}.Encode())
+		if err != nil {
+			t.Fatalf("search: %v", err)
+		}
+		defer res.Body.Close()
+		var out []*models.Entry
+		if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return out
+	}
+	// the in-memory store doesn't rank its results
+	best := func(got []*models.Entry) *models.Entry {
+		var top *models.Entry
+		for _, e := range got {
+			if top == nil || e.Score > top.Score {
+				top = e
+			}
+		}
+		return top
+	}
+
+	search("Tell me about Tokyo", "s1")
+	if e := best(search("And the weather there?", "s1")); e == nil || e.Prompt != "What is the weather in Tokyo?" {
+		t.Fatalf("expected the Tokyo entry to rank first, got %+v", e)
+	}
+	search("Tell me about Paris", "s2")
+	if e := best(search("And the weather there?", "s2")); e == nil || e.Prompt != "What is the weather in Paris?" {
+		t.Fatalf("expected the Paris entry to rank first, got %+v", e)
+	}
+	// without a session both are equally good
+	if got := search("And the weather there?", ""); len(got) != 2 || got[0].Score != got[1].Score {
+		t.Fatalf("expected a tie without session context, got %+v", got)
+	}
+
+	// a miss stored in the session lands where the session search looked
+	res, err := http.Post(ts.URL+"/entries?session_id=s1", "application/json", strings.NewReader(`{"prompt":"And the weather there?","response":"rainy"}`))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var stored models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&stored)
+	res.Body.Close()
+	if !stored.Flag(models.MetaContextual) {
+		t.Fatalf("expected entry stored in a session to be contextual, got %+v", stored.Metadata)
+	}
+	if e := best(search("And the weather there?", "s1")); e == nil || e.ID != stored.ID {
+		t.Fatalf("expected the session entry to rank first, got %+v", e)
+	}
+}
+
+func TestServer_ScopedEntriesOnlyMatchTheirScope(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"How do I greet someone?","response":"Ahoy, matey!","scope":{"system_prompt":"You are a pirate.","model":"gpt-4o","temperature":0.7}}`))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var pirate models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&pirate)
+	res.Body.Close()
+	hash := pirate.ScopeHash()
+	if hash == "" || pirate.Scope != nil {
+		t.Fatalf("expected only the scope hash to be stored, got %+v", pirate)
+	}
+	res, err = http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"How do I greet someone?","response":"Hello!"}`))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	res.Body.Close()
+
+	search := func(params url.Values) []string {
+		t.Helper()
+		params.Set("q", "How do I greet someone?")
+		res, err := http.Get(ts.URL + "/search?" + params.Encode())
+		if err != nil {
+			t.Fatalf("search: %v", err)
+		}
+		defer res.Body.Close()
+		var out []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		var responses []string
+		for _, e := range out {
+			responses = append(responses, e.Response)
+		}
+		return responses
+	}
+	scoped := url.Values{"system_prompt": {"You are a pirate."}, "model": {"gpt-4o"}, "temperature": {"0.7"}}
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+		want   string
+	}{
+		{"matching scope", scoped, "[Ahoy, matey!]"},
+		{"precomputed hash", url.Values{"scope": {hash}}, "[Ahoy, matey!]"},
+		{"other model", url.Values{"system_prompt": {"You are a pirate."}, "model": {"llama3.2"}, "temperature": {"0.7"}}, "[]"},
+		{"unscoped", url.Values{}, "[Hello!]"},
+	} {
+		// run twice so the second lookup goes through L1
+		for i := 0; i < 2; i++ {
+			if got := fmt.Sprint(search(tc.params)); got != tc.want {
+				t.Fatalf("%s: expected %s got %s", tc.name, tc.want, got)
+			}
+		}
+	}
+}
+
+func TestServer_SafetyChecksFilterHits(t *testing.T) {
+	moderation := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Input string }
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		flagged := strings.Contains(req.Input, "insult")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": []map[string]interface{}{
+			{"flagged": flagged, "categories": map[string]bool{"harassment": flagged, "violence": false}},
+		}})
+	}))
+	defer moderation.Close()
+	t.Setenv("SLC_SAFETY_DENYLIST", "(?i)internal use only\n[invalid")
+	t.Setenv("SLC_SAFETY_MODERATION_URL", moderation.URL)
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	ids := map[string]int64{}
+	for prompt, response := range map[string]string{
+		"What is the VPN password": "INTERNAL USE ONLY: hunter2",
+		"Roast my code":            "here is an insult",
+		"What is Kubernetes":       "an orchestrator",
+	} {
+		body, _ := json.Marshal(models.Entry{Prompt: prompt, Response: response})
+		res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		res.Body.Close()
+		ids[prompt] = e.ID
+	}
+	search := func(q string) map[int64]bool {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/search?include_stale=true&q=" + url.QueryEscape(q))
+		if err != nil {
+			t.Fatalf("search: %v", err)
+		}
+		defer res.Body.Close()
+		var out []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		found := map[int64]bool{}
+		for _, e := range out {
+			found[e.ID] = true
+		}
+		return found
+	}
+	// twice, so the second lookup comes through L1
+	for i := 0; i < 2; i++ {
+		if !search("What is Kubernetes")[ids["What is Kubernetes"]] {
+			t.Fatal("expected the safe entry to be served")
+		}
+	}
+	for prompt, want := range map[string]string{
+		"What is the VPN password": "denylist: (?i)internal use only",
+		"Roast my code":            "moderation: harassment",
+	} {
+		if search(prompt)[ids[prompt]] {
+			t.Fatalf("expected %q to be blocked", prompt)
+		}
+		e, err := st.GetEntry(context.Background(), ids[prompt])
+		if err != nil || !e.Flag(models.MetaStale) || e.Metadata[models.MetaSafety] != want {
+			t.Fatalf("expected %q to be quarantined with %q got %+v (%v)", prompt, want, e, err)
+		}
+	}
+}
+
+func TestServer_RevalidateMarksEntriesOfChangedSources(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	ids := make([]int64, 3)
+	for i, body := range []string{
+		`{"prompt":"How do I install it?","response":"apt install","metadata":{"sources":{"install.md":"h1","faq.md":"f1"}}}`,
+		`{"prompt":"What does it cost?","response":"free","metadata":{"sources":{"pricing.md":"p1"}}}`,
+		`{"prompt":"Who wrote it?","response":"us"}`,
+	} {
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		var e models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		res.Body.Close()
+		ids[i] = e.ID
+	}
+	revalidate := func(body string) revalidateResponse {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/revalidate", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("revalidate: %v", err)
+		}
+		defer res.Body.Close()
+		var out revalidateResponse
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return out
+	}
+	// unchanged and unknown sources outdate nothing
+	if out := revalidate(`{"sources":{"install.md":"h1","other.md":"x"}}`); out.Matched != 0 {
+		t.Fatalf("expected no matches got %+v", out)
+	}
+	if out := revalidate(`{"sources":{"faq.md":"f2","pricing.md":"p1"},"dry_run":true}`); out.Matched != 1 || out.IDs[0] != ids[0] {
+		t.Fatalf("expected dry run to match entry %d got %+v", ids[0], out)
+	}
+	if e, _ := st.GetEntry(context.Background(), ids[0]); e.Flag(models.MetaStale) {
+		t.Fatal("dry run must not modify entries")
+	}
+	if out := revalidate(`{"sources":{"faq.md":"f2","pricing.md":"p1"}}`); out.Matched != 1 {
+		t.Fatalf("expected one entry marked stale got %+v", out)
+	}
+	for i, want := range []bool{true, false, false} {
+		if e, _ := st.GetEntry(context.Background(), ids[i]); e.Flag(models.MetaStale) != want {
+			t.Fatalf("entry %d: expected stale=%v got %+v", ids[i], want, e.Metadata)
+		}
+	}
+	// re-running the refresh is idempotent; removing a source deletes on request
+	if out := revalidate(`{"sources":{"faq.md":"f2"}}`); out.Matched != 0 {
+		t.Fatalf("expected already stale entries to be skipped got %+v", out)
+	}
+	if out := revalidate(`{"sources":{"pricing.md":""},"action":"delete"}`); out.Matched != 1 || out.IDs[0] != ids[1] {
+		t.Fatalf("expected entry %d to be deleted got %+v", ids[1], out)
+	}
+	if _, err := st.GetEntry(context.Background(), ids[1]); err == nil {
+		t.Fatal("expected entry to be deleted")
+	}
+}
+
+func TestServer_CountAndAggregate(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, source := range []string{"faq", "faq", "blog", ""} {
+		e := &models.Entry{Prompt: fmt.Sprint("q", i), Response: "r", CreatedAt: day.AddDate(0, 0, i/2)}
+		if source != "" {
+			e.Metadata = map[string]interface{}{"source": source, "lang": "en"}
+		}
+		if _, err := st.CreateEntryWithVector(context.Background(), e, []float64{1, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(path string, out interface{}) int {
+		t.Helper()
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		defer res.Body.Close()
+		_ = json.NewDecoder(res.Body).Decode(out)
+		return res.StatusCode
+	}
+	var count map[string]int
+	if get("/entries/count?metadata.source=faq", &count); count["count"] != 2 {
+		t.Fatalf("expected 2 faq entries got %v", count)
+	}
+	if get("/entries/count", &count); count["count"] != 4 {
+		t.Fatalf("expected 4 entries got %v", count)
+	}
+	var agg aggregateResponse
+	if get("/entries/aggregate?by=metadata.source", &agg); agg.Total != 4 || fmt.Sprint(agg.Buckets) != "map[:1 blog:1 faq:2]" {
+		t.Fatalf("unexpected source buckets %+v", agg)
+	}
+	agg = aggregateResponse{}
+	if get("/entries/aggregate?by=day&metadata.lang=en", &agg); agg.Total != 3 || fmt.Sprint(agg.Buckets) != "map[2026-03-01:2 2026-03-02:1]" {
+		t.Fatalf("unexpected day buckets %+v", agg)
+	}
+	if code := get("/entries/aggregate?by=prompt", &agg); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown grouping got %d", code)
+	}
+}
+
+func TestServer_SampleEntries(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	for i := 0; i < 23; i++ {
+		e := &models.Entry{Prompt: fmt.Sprint("q", i), Response: "r"}
+		switch {
+		case i < 20:
+			e.Metadata = map[string]interface{}{"source": "faq"}
+		case i < 22:
+			e.Metadata = map[string]interface{}{"source": "blog"}
+		}
+		if _, err := st.CreateEntryWithVector(context.Background(), e, []float64{1, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sample := func(query string) ([]*models.Entry, int) {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/entries/sample?" + query)
+		if err != nil {
+			t.Fatalf("sample: %v", err)
+		}
+		defer res.Body.Close()
+		var out []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return out, res.StatusCode
+	}
+	ids := func(entries []*models.Entry) string {
+		var out []int64
+		for _, e := range entries {
+			out = append(out, e.ID)
+		}
+		return fmt.Sprint(out)
+	}
+
+	random, _ := sample("n=5&seed=7")
+	seen := map[int64]bool{}
+	for _, e := range random {
+		seen[e.ID] = true
+	}
+	if len(random) != 5 || len(seen) != 5 {
+		t.Fatalf("expected 5 distinct entries got %s", ids(random))
+	}
+	if again, _ := sample("n=5&seed=7"); ids(again) != ids(random) {
+		t.Fatalf("expected the same seed to give the same sample, got %s and %s", ids(random), ids(again))
+	}
+	if faq, _ := sample("n=50&metadata.source=faq"); len(faq) != 20 {
+		t.Fatalf("expected every faq entry got %d", len(faq))
+	}
+
+	stratified, _ := sample("n=6&strategy=stratified&by=metadata.source")
+	counts := map[string]int{}
+	for _, e := range stratified {
+		counts[fmt.Sprint(e.Metadata["source"])]++
+	}
+	if fmt.Sprint(counts) != "map[<nil>:1 blog:2 faq:3]" {
+		t.Fatalf("expected rare sources to be represented got %v", counts)
+	}
+	for _, query := range []string{"strategy=weighted", "n=0", "strategy=stratified&by=prompt"} {
+		if _, code := sample(query); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400 got %d", query, code)
+		}
+	}
+}
+
+func TestServer_SearchFieldsAndReadKeyRedaction(t *testing.T) {
+	t.Setenv("SLC_API_KEYS", "w-key=write,r-key=read")
+	t.Setenv("SLC_REDACT_READ", "true")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	call := func(method, path, key, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res, string(b)
+	}
+	if res, _ := call(http.MethodPost, "/entries", "", `{"prompt":"What is Kubernetes","response":"an orchestrator"}`); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a key got %d", res.StatusCode)
+	}
+	if res, _ := call(http.MethodPost, "/entries", "r-key", `{"prompt":"What is Kubernetes","response":"an orchestrator"}`); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a write with a read key got %d", res.StatusCode)
+	}
+	if res, _ := call(http.MethodPost, "/entries", "w-key", `{"prompt":"What is Kubernetes","response":"an orchestrator"}`); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 with a write key got %d", res.StatusCode)
+	}
+	if res, _ := call(http.MethodGet, "/admin/backup", "r-key", ""); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected read keys to be kept out of /admin got %d", res.StatusCode)
+	}
+
+	q := "/search?q=" + url.QueryEscape("What is Kubernetes")
+	if _, body := call(http.MethodGet, q, "w-key", ""); !strings.Contains(body, "an orchestrator") {
+		t.Fatalf("expected write keys to see responses got %s", body)
+	}
+	if _, body := call(http.MethodGet, q, "r-key", ""); strings.Contains(body, "an orchestrator") || !strings.Contains(body, "What is Kubernetes") {
+		t.Fatalf("expected read keys to see the hit without its response got %s", body)
+	}
+	if _, body := call(http.MethodPost, "/get", "r-key", `{"prompt":"What is Kubernetes"}`); !strings.Contains(body, `"answer":""`) {
+		t.Fatalf("expected /get to confirm the hit without the answer got %s", body)
+	}
+
+	_, body := call(http.MethodGet, q+"&fields=id,prompt,score", "w-key", "")
+	var got []map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &got); err != nil || len(got) != 1 {
+		t.Fatalf("decode %s: %v", body, err)
+	}
+	keys := make([]string, 0, len(got[0]))
+	for k := range got[0] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if fmt.Sprint(keys) != "[id prompt score]" {
+		t.Fatalf("expected only the requested fields got %v", keys)
+	}
+	if res, _ := call(http.MethodGet, q+"&fields=id,secret", "w-key", ""); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown field got %d", res.StatusCode)
+	}
+}
+
+func TestServer_PinnedEntriesSurviveExpiry(t *testing.T) {
+	t.Setenv("SLC_ENTRY_TTL", "1s")
+	t.Setenv("SLC_PURGE_INTERVAL", "10m")
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	ids := make([]int64, 2)
+	for i := range ids {
+		id, err := ms.CreateEntryWithVector(context.Background(), &models.Entry{Prompt: fmt.Sprint("q", i), Response: "r"}, []float64{1, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	patch := func(id int64, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/entries/%d", ts.URL, id), strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("patch: %v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := patch(ids[0], `{"pinned":true}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", res.StatusCode)
+	}
+	if res := patch(ids[0], `{}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without pinned got %d", res.StatusCode)
+	}
+	ms.mu.Lock()
+	past := time.Now().Add(-2 * time.Second)
+	for _, id := range ids {
+		ms.entries[id].CreatedAt, ms.entries[id].UpdatedAt = past, past
+	}
+	ms.mu.Unlock()
+	if removed := srv.purgeExpired(context.Background()); removed != 1 {
+		t.Fatalf("expected only the unpinned entry to expire, removed %d", removed)
+	}
+	if _, err := ms.GetEntry(context.Background(), ids[0]); err != nil {
+		t.Fatalf("expected pinned entry to survive: %v", err)
+	}
+
+	// unpinning makes it subject to the TTL again
+	ms.mu.Lock()
+	ms.entries[ids[0]].CreatedAt, ms.entries[ids[0]].UpdatedAt = past, past
+	ms.mu.Unlock()
+	patch(ids[0], `{"pinned":false}`)
+	if e, err := ms.GetEntry(context.Background(), ids[0]); err != nil || e.Flag(models.MetaPinned) {
+		t.Fatalf("expected entry to be unpinned got %+v (%v)", e, err)
+	}
+}
+
+func TestServer_DraftPublishLifecycle(t *testing.T) {
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	call := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	found := func(extra string) bool {
+		t.Helper()
+		_, body := call(http.MethodGet, "/search?q="+url.QueryEscape("How do refunds work")+extra, "")
+		return strings.Contains(body, "30 days")
+	}
+	if code, _ := call(http.MethodPost, "/entries", `{"prompt":"x","response":"y","metadata":{"state":"published"}}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for creating a published entry got %d", code)
+	}
+	code, body := call(http.MethodPost, "/entries", `{"prompt":"How do refunds work","response":"within 30 days","metadata":{"state":"draft"}}`)
+	if code != http.StatusCreated {
+		t.Fatalf("create draft: %d %s", code, body)
+	}
+	var draft models.Entry
+	_ = json.Unmarshal([]byte(body), &draft)
+	path := fmt.Sprintf("/entries/%d", draft.ID)
+
+	if found("") || !found("&include_drafts=true") {
+		t.Fatal("expected the draft to be searchable only with include_drafts")
+	}
+	// drafts are editable, but not publishable through metadata
+	if code, _ := call(http.MethodPut, path, `{"prompt":"How do refunds work","response":"within 30 days, no questions asked"}`); code != http.StatusNoContent {
+		t.Fatalf("expected draft to be editable got %d", code)
+	}
+	if code, _ := call(http.MethodPatch, path+"/metadata", `{"metadata":{"state":"published"}}`); code != http.StatusConflict {
+		t.Fatalf("expected 409 publishing through metadata got %d", code)
+	}
+	if code, _ := call(http.MethodPatch, path+"/metadata", `{"metadata":{"owner":"support"},"replace":true}`); code != http.StatusOK {
+		t.Fatalf("replace metadata: %d", code)
+	}
+	if e, _ := st.GetEntry(context.Background(), draft.ID); e.State() != models.StateDraft {
+		t.Fatalf("expected replacing metadata to keep the state got %+v", e.Metadata)
+	}
+
+	if code, _ := call(http.MethodPost, path+"/state", `{"state":"published"}`); code != http.StatusOK {
+		t.Fatalf("publish: %d", code)
+	}
+	if !found("") {
+		t.Fatal("expected the published entry to be served")
+	}
+	if code, _ := call(http.MethodPost, path+"/state", `{"state":"draft"}`); code != http.StatusConflict {
+		t.Fatalf("expected published -> draft to be refused got %d", code)
+	}
+	if code, _ := call(http.MethodPost, path+"/state", `{"state":"archived"}`); code != http.StatusOK {
+		t.Fatalf("archive: %d", code)
+	}
+	if found("&include_drafts=true") {
+		t.Fatal("expected archived entries not to be served")
+	}
+	if code, _ := call(http.MethodPut, path, `{"prompt":"p","response":"r"}`); code != http.StatusConflict {
+		t.Fatalf("expected archived entries to be read-only got %d", code)
+	}
+	if code, _ := call(http.MethodPost, path+"/state", `{"state":"draft"}`); code != http.StatusOK {
+		t.Fatalf("reopen: %d", code)
+	}
+}
+
+func TestServer_NamespaceRoles(t *testing.T) {
+	t.Setenv("SLC_API_KEYS", "sup-key=read@support,int-key=admin@internal,w-key=write,root-key")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	call := func(method, path, key, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	create := func(key, ns string) (int, int64) {
+		t.Helper()
+		code, body := call(http.MethodPost, "/entries", key,
+			fmt.Sprintf(`{"prompt":"How do I reset my %s password","response":"ask %s","metadata":{"namespace":%q}}`, ns, ns, ns))
+		var e models.Entry
+		_ = json.Unmarshal([]byte(body), &e)
+		return code, e.ID
+	}
+
+	code, internalID := create("int-key", "internal")
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201 in the key's namespace got %d", code)
+	}
+	if code, _ := create("int-key", "support"); code != http.StatusForbidden {
+		t.Fatalf("expected 403 outside the key's namespaces got %d", code)
+	}
+	if code, _ := create("sup-key", "support"); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a write with a read key got %d", code)
+	}
+	code, supportID := create("root-key", "support")
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201 with an unrestricted key got %d", code)
+	}
+
+	if _, body := call(http.MethodGet, "/entries", "sup-key", ""); strings.Contains(body, "ask internal") || !strings.Contains(body, "ask support") {
+		t.Fatalf("expected only support entries got %s", body)
+	}
+	if _, body := call(http.MethodGet, "/search?q="+url.QueryEscape("reset password"), "sup-key", ""); strings.Contains(body, "ask internal") || !strings.Contains(body, "ask support") {
+		t.Fatalf("expected searches to see only support entries got %s", body)
+	}
+	if code, _ := call(http.MethodGet, fmt.Sprintf("/entries/%d", internalID), "sup-key", ""); code != http.StatusNotFound {
+		t.Fatalf("expected entries of other namespaces to be hidden got %d", code)
+	}
+	if _, body := call(http.MethodGet, "/entries/count", "int-key", ""); strings.TrimSpace(body) != `{"count":1}` {
+		t.Fatalf("expected counts limited to the key's namespaces got %s", body)
+	}
+
+	if code, _ := call(http.MethodPatch, fmt.Sprintf("/entries/%d", supportID), "w-key", `{"pinned":true}`); code != http.StatusForbidden {
+		t.Fatalf("expected pinning to need an admin key got %d", code)
+	}
+	if code, _ := call(http.MethodPatch, fmt.Sprintf("/entries/%d", supportID), "int-key", `{"pinned":true}`); code != http.StatusNotFound {
+		t.Fatalf("expected 404 pinning another namespace's entry got %d", code)
+	}
+	if code, _ := call(http.MethodPatch, fmt.Sprintf("/entries/%d", internalID), "int-key", `{"pinned":true}`); code != http.StatusOK {
+		t.Fatalf("expected a namespace admin to pin its entries got %d", code)
+	}
+	if code, _ := call(http.MethodGet, "/admin/schedules", "int-key", ""); code != http.StatusForbidden {
+		t.Fatalf("expected namespaced keys to be kept out of /admin got %d", code)
+	}
+	if code, _ := call(http.MethodGet, "/admin/schedules", "root-key", ""); code != http.StatusOK {
+		t.Fatalf("expected unrestricted admin keys to reach /admin got %d", code)
+	}
+}
+
+func TestServer_JWTBearerTokens(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	var idp *httptest.Server
+	var fetches atomic.Int32
+	idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer":%q,"jwks_uri":%q}`, idp.URL, idp.URL+"/keys")
+		case "/keys":
+			fetches.Add(1)
+			time.Sleep(20 * time.Millisecond)
+			fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","use":"sig","n":%q,"e":%q}]}`,
+				b64(key.N.Bytes()), b64(big.NewInt(int64(key.E)).Bytes()))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+	sign := func(claims map[string]interface{}) string {
+		t.Helper()
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		digest := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + b64(sig)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	t.Setenv("SLC_JWT_ISSUER", idp.URL)
+	t.Setenv("SLC_JWT_AUDIENCE", "slmcache")
+	t.Setenv("SLC_JWT_ROLE_CLAIM", "groups")
+	t.Setenv("SLC_JWT_ROLE_MAP", "cache-editors=write,cache-viewers=read")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	post := func(token, ns string) int {
+		t.Helper()
+		body := fmt.Sprintf(`{"prompt":"What is Kubernetes","response":"an orchestrator","metadata":{"namespace":%q}}`, ns)
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/entries", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	editor := map[string]interface{}{"iss": idp.URL, "aud": "slmcache", "sub": "alice", "exp": exp,
+		"groups": []string{"staff", "cache-editors"}, "slmcache_namespaces": []string{"support"}}
+	// concurrent first requests share one key set fetch
+	token := sign(editor)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := post(token, "support"); code != http.StatusCreated {
+				t.Errorf("expected 201 for a valid editor token got %d", code)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected one key set fetch got %d", n)
+	}
+	if authDecisions.Value("jwt:alice", "allow") != 0 || authDecisions.Value("jwt:write", "allow") < 8 {
+		t.Fatal("expected token decisions to be counted by role, not subject")
+	}
+	if code := post(sign(editor), "internal"); code != http.StatusForbidden {
+		t.Fatalf("expected 403 outside the token's namespaces got %d", code)
+	}
+	viewer := map[string]interface{}{"iss": idp.URL, "aud": "slmcache", "sub": "bob", "exp": exp, "groups": "cache-viewers"}
+	if code := post(sign(viewer), "support"); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a write with a viewer token got %d", code)
+	}
+	for name, claims := range map[string]map[string]interface{}{
+		"expired":        {"iss": idp.URL, "aud": "slmcache", "exp": time.Now().Add(-time.Hour).Unix(), "groups": "cache-editors"},
+		"wrong audience": {"iss": idp.URL, "aud": "other", "exp": exp, "groups": "cache-editors"},
+		"wrong issuer":   {"iss": "https://evil.example", "aud": "slmcache", "exp": exp, "groups": "cache-editors"},
+		"no role":        {"iss": idp.URL, "aud": "slmcache", "exp": exp, "groups": "staff"},
+	} {
+		if code := post(sign(claims), "support"); code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401 got %d", name, code)
+		}
+	}
+	forged := sign(editor)
+	forged = forged[:len(forged)-4] + "AAAA"
+	if code := post(forged, "support"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad signature got %d", code)
+	}
+}
+
+func TestServer_AddressAllowlists(t *testing.T) {
+	t.Setenv("SLC_ALLOW_ADMIN", "10.0.0.0/8,fd00::/8")
+	t.Setenv("SLC_TRUSTED_PROXIES", "192.168.0.1")
+	srv := New(newMockStore())
+	defer srv.Close()
+	h := srv.Router()
+
+	do := func(path, remote, forwarded string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	cases := []struct {
+		path, remote, forwarded string
+		want                    int
+	}{
+		{"/admin/schedules", "10.1.2.3:5000", "", http.StatusOK},
+		{"/admin/schedules", "[fd00::1]:5000", "", http.StatusOK},
+		{"/admin/schedules", "203.0.113.5:5000", "", http.StatusForbidden},
+		{"/metrics", "203.0.113.5:5000", "", http.StatusForbidden},
+		{"/entries", "203.0.113.5:5000", "", http.StatusOK},
+		// admin-only routes outside /admin/ are in the admin group too
+		{"/invalidate", "203.0.113.5:5000", "", http.StatusForbidden},
+		{"/entries?as_of=2024-01-01T00:00:00Z", "203.0.113.5:5000", "", http.StatusForbidden},
+		// forwarded addresses count only behind a trusted proxy
+		{"/admin/schedules", "203.0.113.5:5000", "10.1.2.3", http.StatusForbidden},
+		{"/admin/schedules", "192.168.0.1:5000", "10.1.2.3", http.StatusOK},
+		{"/admin/schedules", "192.168.0.1:5000", "10.1.2.3, 203.0.113.5", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if got := do(c.path, c.remote, c.forwarded); got != c.want {
+			t.Fatalf("%s from %s (%q): expected %d got %d", c.path, c.remote, c.forwarded, c.want, got)
+		}
+	}
+
+	t.Setenv("SLC_ALLOW_DATA", "127.0.0.1")
+	if code := do("/entries", "203.0.113.5:5000", ""); code != http.StatusForbidden {
+		t.Fatalf("expected the data allowlist to apply got %d", code)
+	}
+	if !allowRESP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6379}) || allowRESP(&net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 6379}) {
+		t.Fatal("expected Redis protocol connections to follow the data allowlist")
+	}
+}
+
+func TestServer_SLOStats(t *testing.T) {
+	t.Setenv("SLC_SLOS", "/search=1ns@99")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(ts.URL + "/search?q=hello&metadata.namespace=support")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	res, err := http.Get(ts.URL + "/stats/slo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var got []sloStatus
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].SLO != "/search" || got[0].Namespace != "support" {
+		t.Fatalf("expected one /search series for support got %+v", got)
+	}
+	w := got[0].Windows["5m"]
+	if w.Total != 2 || w.Slow != 2 || w.Compliance != 0 || math.Abs(w.BurnRate-100) > 1e-9 || got[0].Alert != "page" {
+		t.Fatalf("expected every request to miss a 1ns objective got %+v (alert %q)", w, got[0].Alert)
+	}
+
+	// old minutes only count towards the longer windows
+	t.Setenv("SLC_SLOS", "/search=50ms@99")
+	tr := newSLOTracker()
+	now := time.Now()
+	k := sloKey{route: "/search", namespace: "default"}
+	tr.record(k, time.Millisecond, false, now.Add(-2*time.Hour))
+	tr.record(k, time.Millisecond, true, now)
+	st := tr.status(now)[0]
+	if st.Windows["5m"].Total != 1 || st.Windows["1h"].Total != 1 || st.Windows["6h"].Total != 2 || st.Windows["6h"].Compliance != 0.5 {
+		t.Fatalf("unexpected windows %+v", st.Windows)
+	}
+}
+
+func TestServer_RateLimits(t *testing.T) {
+	get := func(url string) *http.Response {
+		t.Helper()
+		res, err := http.Get(url + "/slm-backend")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	t.Setenv("SLC_RATE_LIMIT", "1")
+	local := New(newMockStore())
+	defer local.Close()
+	lts := httptest.NewServer(local.Router())
+	defer lts.Close()
+	if res := get(lts.URL); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the first request through got %d", res.StatusCode)
+	}
+	if res := get(lts.URL); res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After got %d", res.StatusCode)
+	}
+
+	// replicas sharing Redis enforce one quota between them
+	var mu sync.Mutex
+	kv := map[string]int64{}
+	fake := &resp.Server{Handler: func(w *resp.Writer, args []string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "INCR":
+			kv[args[1]]++
+			w.WriteInt(kv[args[1]])
+		case "PEXPIRE":
+			w.WriteInt(1)
+		case "GET":
+			if v, ok := kv[args[1]]; ok {
+				w.WriteBulk(fmt.Sprint(v))
+			} else {
+				w.WriteNull()
+			}
+		default:
+			w.WriteError("ERR unknown command")
+		}
+		return true
+	}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fake.Serve(ln)
+	defer func() { ln.Close(); fake.Close() }()
+
+	t.Setenv("SLC_RATE_LIMIT_BACKEND", "redis")
+	t.Setenv("SLC_RATE_LIMIT_REDIS", ln.Addr().String())
+	t.Setenv("SLC_RATE_BURST", "2")
+	var urls []string
+	for i := 0; i < 2; i++ {
+		srv := New(newMockStore())
+		defer srv.Close()
+		ts := httptest.NewServer(srv.Router())
+		defer ts.Close()
+		urls = append(urls, ts.URL)
+	}
+	if get(urls[0]).StatusCode != http.StatusOK || get(urls[1]).StatusCode != http.StatusOK {
+		t.Fatal("expected the burst to be allowed")
+	}
+	if res := get(urls[0]); res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the shared quota to be exhausted got %d", res.StatusCode)
+	}
+
+	// a request Redis fails on is let through, and later ones are limited
+	// locally until Redis is tried again
+	ln.Close()
+	fake.Close()
+	if res := get(urls[1]); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the request Redis failed on through got %d", res.StatusCode)
+	}
+	for i := 0; i < 2; i++ {
+		if res := get(urls[1]); res.StatusCode != http.StatusOK {
+			t.Fatalf("expected the local burst to be allowed got %d", res.StatusCode)
+		}
+	}
+	if res := get(urls[1]); res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the local fallback to limit got %d", res.StatusCode)
+	}
+}
+
+func TestServer_ShedsQueuedLookups(t *testing.T) {
+	t.Setenv("SLC_SHED_CONCURRENCY", "1")
+	t.Setenv("SLC_SHED_TARGET", "5ms")
+	t.Setenv("SLC_SHED_INTERVAL", "40ms")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	sh := srv.shed
+	ctx := context.Background()
+
+	if !sh.acquire(ctx) {
+		t.Fatal("expected a free slot")
+	}
+	res, err := http.Get(ts.URL + "/search?q=hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After while the slot is busy got %d", res.StatusCode)
+	}
+	// a standing queue for a whole interval switches to fast rejection
+	for i := 0; i < 4 && !sh.overloaded; i++ {
+		if sh.acquire(ctx) {
+			t.Fatal("expected the queued lookup to be shed")
+		}
+	}
+	if !sh.overloaded {
+		t.Fatal("expected the shedder to detect the standing queue")
+	}
+	start := time.Now()
+	if sh.acquire(ctx) {
+		t.Fatal("expected the queued lookup to be shed")
+	}
+	if took := time.Since(start); took > 30*time.Millisecond {
+		t.Fatalf("expected an overloaded shedder to reject within its target, took %s", took)
+	}
+
+	// a released slot goes straight to the waiting request
+	got := make(chan bool)
+	sh.overloaded = false
+	go func() { got <- sh.acquire(ctx) }()
+	time.Sleep(5 * time.Millisecond)
+	sh.release()
+	if !<-got {
+		t.Fatal("expected the waiter to get the released slot")
+	}
+	sh.release()
+	if !sh.acquire(ctx) {
+		t.Fatal("expected a free slot after release")
+	}
+	sh.release()
+}
+
+func TestServer_PriorityClasses(t *testing.T) {
+	var got priority
+	h := prioritize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = priorityFrom(r.Context())
+	}))
+	low := priorityLow
+	cases := []struct {
+		path, header string
+		key          *principal
+		want         priority
+	}{
+		{"/search", "", nil, priorityNormal},
+		{"/entries/batch", "", nil, priorityLow},
+		{"/entries/batch", "high", nil, priorityHigh},
+		{"/search", "low", nil, priorityLow},
+		{"/search", "", &principal{priority: &low}, priorityLow},
+		{"/search", "high", &principal{priority: &low}, priorityLow},
+		{"/search", "bogus", nil, priorityNormal},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.header != "" {
+			req.Header.Set("X-Priority", c.header)
+		}
+		if c.key != nil {
+			req = req.WithContext(context.WithValue(req.Context(), principalKey{}, c.key))
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != c.want {
+			t.Fatalf("%s X-Priority=%q: expected %s got %s", c.path, c.header, c.want, got)
+		}
+	}
+
+	// a freed slot goes to the high priority waiter even when low queued first
+	g := newPriorityGate(1)
+	ctx := context.Background()
+	if !g.acquire(ctx, priorityNormal, 0) {
+		t.Fatal("expected a free slot")
+	}
+	order := make(chan priority, 2)
+	waitQueued := func(n int) {
+		for i := 0; i < 100; i++ {
+			g.mu.Lock()
+			q := g.queued()
+			g.mu.Unlock()
+			if q == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("expected %d waiters", n)
+	}
+	for i, p := range []priority{priorityLow, priorityHigh} {
+		go func() {
+			if g.acquire(ctx, p, -1) {
+				order <- p
+				g.release()
+			}
+		}()
+		waitQueued(i + 1)
+	}
+	g.release()
+	if first, second := <-order, <-order; first != priorityHigh || second != priorityLow {
+		t.Fatalf("expected high then low got %s then %s", first, second)
+	}
+
+	// an overloaded shedder turns low priority lookups away without queueing
+	t.Setenv("SLC_SHED_CONCURRENCY", "1")
+	t.Setenv("SLC_SHED_TARGET", "5ms")
+	t.Setenv("SLC_SHED_INTERVAL", "40ms")
+	sh := newShedder()
+	if !sh.acquire(ctx) {
+		t.Fatal("expected a free slot")
+	}
+	sh.overloaded = true
+	start := time.Now()
+	if sh.acquire(withPriority(ctx, priorityLow)) {
+		t.Fatal("expected the low priority lookup to be shed")
+	}
+	if took := time.Since(start); took >= sh.target {
+		t.Fatalf("expected low priority to be shed without waiting, took %s", took)
+	}
+	sh.overloaded = true
+	granted := make(chan bool)
+	go func() { granted <- sh.acquire(withPriority(ctx, priorityHigh)) }()
+	time.Sleep(15 * time.Millisecond)
+	sh.release()
+	if !<-granted {
+		t.Fatal("expected a high priority lookup to wait past the target for the slot")
+	}
+	sh.release()
+}
+
+func TestServer_DashboardAndExemplars(t *testing.T) {
+	t.Setenv("SLC_DASHBOARD_INTERVAL", "1h") // sampled by hand below
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/search?q=hello", nil)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/openmetrics-text") ||
+		!strings.Contains(string(body), `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`) {
+		t.Fatalf("expected latency exemplars with the request's trace ID got %s", body)
+	}
+
+	srv.dashboard.last.at = start.Add(-time.Second)
+	srv.dashboard.sample(time.Now())
+	res, err = http.Get(ts.URL + "/stats/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Interval string           `json:"interval"`
+		Points   []dashboardPoint `json:"points"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&got)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Interval != "1h0m0s" || len(got.Points) != 1 || got.Points[0].LookupsPerSecond <= 0 || got.Points[0].LatencyMs.P99 <= 0 {
+		t.Fatalf("expected one point covering the lookups got %+v", got)
+	}
+
+	res, err = http.Get(ts.URL + "/stats/dashboard/grafana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grafana map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&grafana)
+	res.Body.Close()
+	if err != nil || grafana["uid"] != "slmcache" {
+		t.Fatalf("expected the Grafana dashboard got %v (%v)", grafana["uid"], err)
+	}
+
+	for _, h := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-xyz-00f067aa0ba902b7-01"} {
+		if id, ok := parseTraceparent(h); ok {
+			t.Fatalf("expected %q to be rejected got %q", h, id)
+		}
+	}
+}
+
+// reportingStore wraps a store with a health check the test controls.
+type reportingStore struct {
+	store.Store
+	mu  sync.Mutex
+	err error
+}
+
+func (r *reportingStore) Health(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *reportingStore) Capabilities() store.Capabilities {
+	return store.Capabilities{Pagination: true}
+}
+
+func TestServer_Readyz(t *testing.T) {
+	t.Setenv("SLC_API_KEYS", "secret")
+	mem, _ := store.New()
+	srv := New(mem)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	ready := func(ts *httptest.Server) (int, readiness) {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out readiness
+		if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, out
+	}
+	code, out := ready(ts)
+	if code != http.StatusOK || out.Status != "ready" || !out.Store.Capabilities.FilteredSearch {
+		t.Fatalf("expected a ready in-memory store with filtered search, without a key, got %d %+v", code, out)
+	}
+
+	rs := &reportingStore{Store: newMockStore()}
+	srv2 := New(rs)
+	defer srv2.Close()
+	ts2 := httptest.NewServer(srv2.Router())
+	defer ts2.Close()
+	rs.mu.Lock()
+	rs.err = errors.New("connection refused")
+	rs.mu.Unlock()
+	code, out = ready(ts2)
+	if code != http.StatusServiceUnavailable || out.Status != "unavailable" || out.Store.Error != "connection refused" || !out.Store.Capabilities.Pagination {
+		t.Fatalf("expected 503 with the store's error got %d %+v", code, out)
+	}
+	if storeHealthy.Value() != 0 {
+		t.Fatal("expected slmcache_store_healthy to drop to 0")
+	}
+	rs.mu.Lock()
+	rs.err = nil
+	rs.mu.Unlock()
+	if code, _ = ready(ts2); code != http.StatusOK {
+		t.Fatalf("expected the server to be ready again got %d", code)
+	}
+	if got := store.CapabilitiesOf(newMockStore()); got.FilteredSearch {
+		t.Fatalf("expected no capabilities for a plain store got %+v", got)
+	}
+}
+
+func TestServer_UnavailableStore(t *testing.T) {
+	var mu sync.Mutex
+	up := false
+	lazy := store.NewLazy(func(ctx context.Context) (store.Store, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			return nil, errors.New("dial tcp: connection refused")
+		}
+		return store.New()
+	}, store.LazyOptions{MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+	defer lazy.Close()
+	srv := New(lazy)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	status := func(path string) int {
+		t.Helper()
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	for _, path := range []string{"/search?q=hello", "/entries", "/readyz"} {
+		if code := status(path); code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: expected 503 while the store is down got %d", path, code)
+		}
+	}
+	if code := status("/stats/slo"); code != http.StatusOK {
+		t.Fatalf("expected routes without the store to keep working got %d", code)
+	}
+
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	deadline := time.Now().Add(2 * time.Second)
+	for status("/readyz") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the server to recover once the store connects")
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if code := status("/search?q=hello"); code != http.StatusOK {
+		t.Fatalf("expected search to work after reconnecting got %d", code)
+	}
+}
+
+func TestServer_ConnectionLimitAndDraining(t *testing.T) {
+	srv := New(newMockStore())
+	defer srv.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &httptest.Server{Listener: LimitListener(ln, 1), Config: &http.Server{Handler: srv.Router()}}
+	ts.Start()
+	defer ts.Close()
+
+	// the first client holds the only slot until it hangs up
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int)
+	go func() {
+		res, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get(ts.URL + "/readyz")
+		if err != nil {
+			done <- 0
+			return
+		}
+		res.Body.Close()
+		done <- res.StatusCode
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the second connection to wait for a free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if openConns.Value() != 1 || connWaits.Value() == 0 {
+		t.Fatalf("expected 1 open connection and a wait got %v open, %v waits", openConns.Value(), connWaits.Value())
+	}
+	first.Close()
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected the waiting client to be served got %d", code)
+	}
+
+	srv.Drain()
+	res, err := http.Get(ts.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out readiness
+	_ = json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || out.Status != "draining" {
+		t.Fatalf("expected 503 draining got %d %q", res.StatusCode, out.Status)
+	}
+	if inFlight.Value() != 0 {
+		t.Fatalf("expected no requests in flight got %v", inFlight.Value())
+	}
+}
+
+func TestServer_SearchBatch(t *testing.T) {
+	t.Setenv("SLC_API_KEYS", "admin-key,r-key=read")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	post := func(path, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", "admin-key")
+		if path == "/search/batch" {
+			req.Header.Set("X-API-Key", "r-key")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res := post("/entries/batch", `[{"prompt":"What is Kubernetes","response":"an orchestrator","metadata":{"team":"infra"}},
+		{"prompt":"What is Envoy","response":"a proxy","metadata":{"team":"infra"}},
+		{"prompt":"What is Envoy","response":"a bird","metadata":{"team":"zoo"}}]`)
+	res.Body.Close()
+
+	res = post("/search/batch", `{"queries":["What is Kubernetes","What is Envoy","Who won the 1998 World Cup"],"limit":5,"metadata":{"team":"infra"}}`)
+	var got [][]*models.Entry
+	err := json.NewDecoder(res.Body).Decode(&got)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for a read key got %d (%v)", res.StatusCode, err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected a result array per query got %d", len(got))
+	}
+	if len(got[0]) == 0 || got[0][0].Response != "an orchestrator" {
+		t.Fatalf("expected the Kubernetes entry first got %+v", got[0])
+	}
+	proxy := false
+	for _, e := range got[1] {
+		if e.Metadata["team"] != "infra" {
+			t.Fatalf("expected the shared filter on every query got %+v", e)
+		}
+		proxy = proxy || e.Response == "a proxy"
+	}
+	if !proxy {
+		t.Fatalf("expected the infra Envoy entry got %d results", len(got[1]))
+	}
+
+	for body, want := range map[string]int{
+		`{"queries":[]}`:            http.StatusBadRequest,
+		`{"queries":"one"}`:         http.StatusBadRequest,
+		`{"queries":["a","b","c"]}`: http.StatusRequestEntityTooLarge,
+	} {
+		t.Setenv("SLC_MAX_SEARCH_BATCH", "2")
+		if res := post("/search/batch", body); res.StatusCode != want {
+			t.Fatalf("%s: expected %d got %d", body, want, res.StatusCode)
+		} else {
+			res.Body.Close()
+		}
+	}
+}
+
+// paraphraser answers every generation with fixed text.
+type paraphraser struct {
+	mu    sync.Mutex
+	text  string
+	calls int
+}
+
+func (p *paraphraser) Generate(_ context.Context, prompt string) (*slm.Generation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	return &slm.Generation{Text: p.text, Model: "fake"}, nil
+}
+
+func TestServer_QueryExpansion(t *testing.T) {
+	t.Setenv("SLM_MIN_SCORE", "0.95")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	b, _ := json.Marshal(&models.Entry{Prompt: "Where is KubeCon 2025 held", Response: "Atlanta"})
+	res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	search := func(q string) []*models.Entry {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/search?q=" + url.QueryEscape(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var found []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&found)
+		return found
+	}
+	gen := &paraphraser{text: "1. KubeCon 2025 city\n2. Where is KubeCon 2025 held\n- Which city hosts KubeCon in 2025?\n- extra line"}
+	srv.cfgMu.Lock()
+	srv.gen = gen
+	srv.cfgMu.Unlock()
+	if found := search("KubeCon 2025 city"); len(found) != 0 {
+		t.Fatalf("expected a miss with expansion off got %d results", len(found))
+	}
+
+	t.Setenv("SLC_QUERY_EXPANSION", "2")
+	found := search("KubeCon 2025 city")
+	if len(found) != 1 || found[0].Response != "Atlanta" {
+		t.Fatalf("expected a paraphrase to find the entry got %+v", found)
+	}
+	if v, _ := srv.expansions.get("2:" + canonicalize("KubeCon 2025 city")); len(v) != 2 || v[0] != "Where is KubeCon 2025 held" {
+		t.Fatalf("expected the query itself and extra lines dropped got %q", v)
+	}
+	search("kubecon 2025 city?")
+	if long := search("In which city will the KubeCon conference take place in 2025"); len(long) != 0 || gen.calls != 1 {
+		t.Fatalf("expected one generation for the repeated query and none for a long one got %d", gen.calls)
+	}
+}
+
+func TestServer_Synonyms(t *testing.T) {
+	t.Setenv("SLM_MIN_SCORE", "0.99")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	put := func(ns, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/admin/synonyms/"+ns, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := put("default", `{"K8s": "Kubernetes", "CNCF": ""}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty term got %d", res.StatusCode)
+	}
+	if res := put("default", `{"K8s": "Kubernetes", "k-8-s": "kubernetes"}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a multi-word alias got %d", res.StatusCode)
+	}
+	if res := put("default", `{"K8s": "Kubernetes", "kcd": "Kubernetes Community Days"}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", res.StatusCode)
+	}
+
+	b, _ := json.Marshal(&models.Entry{Prompt: "What is Kubernetes?", Response: "A container orchestrator"})
+	res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if e := srv.lookupExact(context.Background(), searchQuery{Text: "what is K8s"}); e == nil {
+		t.Fatalf("expected the alias to share the exact-match key")
+	}
+	if e := srv.lookupExact(context.Background(), searchQuery{Text: "what is k8s", Filters: map[string]string{models.MetaNamespace: "infra"}}); e != nil {
+		t.Fatalf("expected synonyms to apply only in their namespace")
+	}
+	res, err = http.Get(ts.URL + "/search?q=k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []*models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&found)
+	res.Body.Close()
+	if len(found) != 1 {
+		t.Fatalf("expected the token fallback to match the alias got %d results", len(found))
+	}
+
+	// the dictionary is kept in the store, so another instance sees it
+	other := New(st)
+	defer other.Close()
+	if got := other.synonyms.get("default"); got["kcd"] != "kubernetes community days" {
+		t.Fatalf("expected persisted synonyms got %v", got)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/admin/synonyms/default", nil)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 deleting synonyms got %v %v", res, err)
+	}
+	if e := srv.lookupExact(context.Background(), searchQuery{Text: "what is k8s"}); e != nil {
+		t.Fatalf("expected deleted synonyms to stop matching")
+	}
+}
+
+func TestServer_LexicalStemming(t *testing.T) {
+	t.Setenv("SLM_MIN_SCORE", "0.99")
+	search := func(srv *Server, q string) int {
+		t.Helper()
+		ts := httptest.NewServer(srv.Router())
+		defer ts.Close()
+		res, err := http.Get(ts.URL + "/search?q=" + url.QueryEscape(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var found []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&found)
+		return len(found)
+	}
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	if _, err := srv.store.CreateEntryWithVector(context.Background(), &models.Entry{Prompt: "How do I deploy pods?", Response: "kubectl apply"}, []float64{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if n := search(srv, "deploying a pod"); n != 1 {
+		t.Fatalf("expected stemmed terms to match got %d results", n)
+	}
+
+	t.Setenv("SLC_LEXICAL_LANGUAGE", "none")
+	t.Setenv("SLC_LEXICAL_STOPWORDS", "none")
+	plain := New(st)
+	defer plain.Close()
+	if n := search(plain, "deploying a pod"); n != 0 {
+		t.Fatalf("expected no match without stemming got %d results", n)
+	}
+}
+
+func TestServer_FuzzyLexicalMatch(t *testing.T) {
+	t.Setenv("SLM_MIN_SCORE", "0.99")
+	st, _ := store.New()
+	if _, err := st.CreateEntryWithVector(context.Background(), &models.Entry{Prompt: "Explain quantum entanglement", Response: "Spooky action"}, []float64{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		fuzziness string
+		want      int
+	}{{"", 1}, {"0", 0}} {
+		t.Setenv("SLC_LEXICAL_FUZZINESS", c.fuzziness)
+		srv := New(st)
+		ts := httptest.NewServer(srv.Router())
+		res, err := http.Get(ts.URL + "/search?q=" + url.QueryEscape("quantun entanglment"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&found)
+		res.Body.Close()
+		ts.Close()
+		srv.Close()
+		if len(found) != c.want {
+			t.Fatalf("fuzziness %q: expected %d results got %d", c.fuzziness, c.want, len(found))
+		}
+	}
+}
+
+func TestServer_LexicalIndex(t *testing.T) {
+	t.Setenv("SLM_MIN_SCORE", "0.99")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	search := func(q string) int {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/search?q=" + url.QueryEscape(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var found []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&found)
+		return len(found)
+	}
+	ctx := context.Background()
+	id, err := srv.store.CreateEntryWithVector(ctx, &models.Entry{Prompt: "How do I deploy pods?", Response: "kubectl apply"}, []float64{1, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := search("deploying pods"); n != 1 {
+		t.Fatalf("expected the indexed entry got %d results", n)
+	}
+
+	// writes that bypass this server show up after a reindex
+	if _, err := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "How do I roll back a release?", Response: "helm rollback"}, []float64{0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n := search("rollback release"); n != 0 {
+		t.Fatalf("expected an unindexed entry to be missed got %d results", n)
+	}
+	srv.reindex(ctx)
+	if n := search("roll back release"); n != 1 {
+		t.Fatalf("expected the reindexed entry got %d results", n)
+	}
+
+	if err := srv.store.DeleteEntry(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if n := search("deploying pods"); n != 0 || srv.lexicon.idx.Len() != 1 {
+		t.Fatalf("expected the deleted entry dropped from the index got %d results", n)
+	}
+}
+
+func TestServer_SearchHighlight(t *testing.T) {
+	t.Setenv("SLM_MIN_SCORE", "0.99")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	if _, err := srv.store.CreateEntryWithVector(context.Background(), &models.Entry{Prompt: "How do I deploy <b>Pods</b>?", Response: "kubectl apply"}, []float64{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	search := func(query string) []*models.Entry {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/search?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var found []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&found)
+		return found
+	}
+	if found := search("q=deploying+pods"); len(found) != 1 || found[0].Highlight != nil {
+		t.Fatalf("expected no highlight unless asked for got %+v", found)
+	}
+	found := search("q=deploying+pods&highlight=true")
+	if len(found) != 1 || found[0].Highlight == nil {
+		t.Fatalf("expected a highlighted result got %+v", found)
+	}
+	h := found[0].Highlight
+	if h.Prompt != "How do I <em>deploy</em> &lt;b&gt;<em>Pods</em>&lt;/b&gt;?" || len(h.Offsets) != 2 || found[0].Prompt[h.Offsets[1][0]:h.Offsets[1][1]] != "Pods" {
+		t.Fatalf("unexpected highlight %+v", h)
+	}
+}
+
+func TestServer_ScoreProfiles(t *testing.T) {
+	t.Setenv("SLM_MIN_SCORE", "0.92")
+	t.Setenv("SLC_SCORE_PROFILES", "category=legal:0.95, namespace=smalltalk:0.8, bogus")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ctx := context.Background()
+	vec := []float64{0.9, math.Sqrt(1 - 0.81)} // cosine 0.9 to the query
+	for _, e := range []*models.Entry{
+		{Prompt: "Can I break my lease?", Response: "Ask a lawyer", Metadata: map[string]interface{}{"category": "legal"}},
+		{Prompt: "How are you?", Response: "Great", Metadata: map[string]interface{}{models.MetaNamespace: "smalltalk"}},
+		{Prompt: "What time is it?", Response: "Noon"},
+	} {
+		if _, err := srv.store.CreateEntryWithVector(ctx, e, vec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := srv.search(ctx, searchQuery{Text: "zzz", Limit: 10, Vector: []float64{1, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, e := range res.Entries {
+		got[e.Response] = true
+	}
+	if len(got) != 1 || !got["Great"] {
+		t.Fatalf("expected only the smalltalk answer to pass its lower threshold got %v", got)
+	}
+}
+
+func TestServer_ResultCache(t *testing.T) {
+	t.Setenv("SLC_RESULT_CACHE_TTL", "1m")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	post := func(prompt string, meta map[string]interface{}) {
+		t.Helper()
+		b, _ := json.Marshal(&models.Entry{Prompt: prompt, Response: "ok", Metadata: meta})
+		res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	search := func(query string) int {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/search?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var found []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&found)
+		return len(found)
+	}
+	post("What is Envoy", nil)
+	hits := tierLookups.Value("results", "hit")
+	if n := search("q=envoy+proxy+guide"); n != 0 {
+		t.Fatalf("expected a miss got %d", n)
+	}
+	if search("q=Envoy+proxy+guide%3F"); tierLookups.Value("results", "hit") != hits+1 {
+		t.Fatalf("expected the normalized repeat to be served from the result cache")
+	}
+
+	// a write to another namespace leaves filtered results alone, while
+	// unfiltered ones are dropped
+	if search("q=envoy+proxy+guide&metadata.namespace=docs"); tierLookups.Value("results", "hit") != hits+1 {
+		t.Fatalf("expected the filtered search to miss the cache first")
+	}
+	post("Envoy proxy guide", map[string]interface{}{models.MetaNamespace: "blog"})
+	if search("q=envoy+proxy+guide&metadata.namespace=docs"); tierLookups.Value("results", "hit") != hits+2 {
+		t.Fatalf("expected a write to another namespace to keep the cached result")
+	}
+	if n := search("q=envoy+proxy+guide"); n != 1 {
+		t.Fatalf("expected the new entry after the write got %d results", n)
+	}
+}
+
+// warmingStore wraps a store whose warm-up the test releases.
+type warmingStore struct {
+	store.Store
+	release chan struct{}
+	warmed  atomic.Bool
+}
+
+func (w *warmingStore) Warm(ctx context.Context) error {
+	select {
+	case <-w.release:
+		w.warmed.Store(true)
+	case <-ctx.Done():
+	}
+	return ctx.Err()
+}
+
+func TestServer_Warmup(t *testing.T) {
+	t.Setenv("SLC_WARMUP_QUERIES", "2")
+	mem, _ := store.New()
+	for _, p := range []string{"alpha", "beta", "gamma"} {
+		vec, _ := slm.NewDefaultSLM().Embed(p)
+		if _, err := mem.CreateEntryWithVector(context.Background(), &models.Entry{Prompt: p, Response: "r"}, vec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws := &warmingStore{Store: mem, release: make(chan struct{})}
+	srv := New(ws)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	status := func() string {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out readiness
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return out.Status
+	}
+	if got := status(); got != "warming" {
+		t.Fatalf("expected warming until the store is warm got %q", got)
+	}
+	close(ws.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for status() != "ready" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected ready after the warm-up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ws.warmed.Load() {
+		t.Fatalf("expected the store to be warmed")
+	}
+}
+
+// truncatingStore ranks every entry equally and returns the first limit,
+// like an index that can't filter on metadata.
+type truncatingStore struct{ *mockStore }
+
+func (t truncatingStore) SearchByVector(ctx context.Context, vec []float64, limit int) ([]int64, []float64, error) {
+	ids, _, _ := t.mockStore.SearchByVector(ctx, vec, limit)
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	scores := make([]float64, len(ids))
+	for i := range scores {
+		scores[i] = 1
+	}
+	return ids, scores, nil
+}
+
+func TestServer_SearchOversample(t *testing.T) {
+	ts0 := truncatingStore{newMockStore()}
+	for i := 0; i < 12; i++ {
+		team := "a"
+		if i%4 != 3 {
+			team = "b"
+		}
+		_, _ = ts0.CreateEntryWithVector(context.Background(), &models.Entry{
+			Prompt: fmt.Sprintf("question %d", i), Response: "r", Metadata: map[string]interface{}{"team": team},
+		}, []float64{1, 0})
+	}
+	srv := New(ts0)
+	defer srv.Close()
+	count := func(q searchQuery) int {
+		t.Helper()
+		q.Text, q.Vector, q.Filters = "zzz", []float64{1, 0}, map[string]string{"team": "a"}
+		res, err := srv.search(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res.Entries)
+	}
+	if n := count(searchQuery{Limit: 2, Oversample: 1}); n != 0 {
+		t.Fatalf("expected the first 2 neighbours to be filtered out without oversampling got %d", n)
+	}
+	if n := count(searchQuery{Limit: 2}); n != 1 {
+		t.Fatalf("expected the default factor of 3 to find 1 match in 6 neighbours got %d", n)
+	}
+	if n := count(searchQuery{Limit: 2, Oversample: 4}); n != 2 {
+		t.Fatalf("expected a factor of 4 to fill the limit got %d", n)
+	}
+	t.Setenv("SLC_SEARCH_OVERSAMPLE", "6")
+	if n := count(searchQuery{Limit: 2}); n != 2 {
+		t.Fatalf("expected SLC_SEARCH_OVERSAMPLE to fill the limit got %d", n)
+	}
+	if n := count(searchQuery{Limit: 2, Oversample: 100}); n != 2 {
+		t.Fatalf("expected results cut to the limit got %d", n)
+	}
+}
+
+func TestServer_SearchCursor(t *testing.T) {
+	t.Setenv("SLM_MIN_SCORE", "-1")
+	mem, _ := store.New()
+	srv := New(mem)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	post := func(prompt string) {
+		t.Helper()
+		b, _ := json.Marshal(&models.Entry{Prompt: prompt, Response: "r"})
+		res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	for i := 0; i < 7; i++ {
+		post(fmt.Sprintf("topic number %d", i))
+	}
+	page := func(cursor string) ([]*models.Entry, string) {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/search?q=topic&limit=2&cursor=" + url.QueryEscape(cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200 got %d", res.StatusCode)
+		}
+		var found []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&found)
+		return found, res.Header.Get(nextCursorHeader)
+	}
+	seen := map[int64]bool{}
+	last := math.Inf(1)
+	cursor, pages := "", 0
+	for {
+		found, next := page(cursor)
+		pages++
+		for _, e := range found {
+			if seen[e.ID] || e.Score > last {
+				t.Fatalf("expected each entry once in score order, got %d (%v) again or after %v", e.ID, e.Score, last)
+			}
+			seen[e.ID], last = true, e.Score
+		}
+		if pages == 1 {
+			// a write between pages must not shift what follows
+			post("topic number 7")
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if pages != 4 || len(seen) < 7 {
+		t.Fatalf("expected the 7 entries over 4 pages got %d entries over %d pages", len(seen), pages)
+	}
+
+	res, err := http.Get(ts.URL + "/search?q=another&limit=2&cursor=" + url.QueryEscape(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a cursor of another search to be rejected got %d", res.StatusCode)
+	}
+}
+
+// eventRecorder is an events.Publisher that keeps what it was sent.
+type eventRecorder struct {
+	mu    sync.Mutex
+	types []string
+}
+
+func (r *eventRecorder) Publish(ctx context.Context, msgs []events.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range msgs {
+		r.types = append(r.types, m.Type)
+	}
+	return nil
+}
+
+func (r *eventRecorder) Close() error { return nil }
+
+func TestServer_Events(t *testing.T) {
+	srv := New(newMockStore())
+	rec := &eventRecorder{}
+	srv.events = events.NewEmitter(rec, "test", 0, 0)
+	srv.observe(srv.onEventChange)
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	b, _ := json.Marshal(&models.Entry{Prompt: "What is Envoy", Response: "a proxy"})
+	res, err := http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	for _, q := range []string{"What+is+Envoy", "unrelated+words"} {
+		res, err := http.Get(ts.URL + "/search?q=" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	srv.Close()
+	want := []string{events.EntryCreated, events.SearchHit, events.SearchMiss}
+	if fmt.Sprint(rec.types) != fmt.Sprint(want) {
+		t.Fatalf("expected %v got %v", want, rec.types)
+	}
+}
+
+func TestServer_Ingest(t *testing.T) {
+	st := newMockStore()
+	srv := New(st)
+	defer srv.Close()
+	msg := []byte(`{"prompt": "What is Envoy?", "response": "a proxy", "metadata": {"namespace": "docs"}}`)
+	for i := 0; i < 2; i++ {
+		if err := srv.ingest(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := st.AllIDs(); len(ids) != 1 {
+		t.Fatalf("expected a redelivered message to replace its entry got %d entries", len(ids))
+	}
+	if err := srv.ingest(context.Background(), []byte(`{"prompt": `)); !errors.Is(err, events.ErrPermanent) {
+		t.Fatalf("expected malformed messages to fail permanently got %v", err)
+	}
+	if err := srv.ingest(context.Background(), []byte(`{"response": "x"}`)); !errors.Is(err, events.ErrPermanent) {
+		t.Fatalf("expected a message without prompt to fail permanently got %v", err)
+	}
+}
+
+// flakyPublisher fails until told otherwise and keeps what it delivered.
+type flakyPublisher struct {
+	eventRecorder
+	fail bool
+}
+
+func (f *flakyPublisher) Publish(ctx context.Context, msgs []events.Message) error {
+	if f.fail {
+		return errors.New("broker down")
+	}
+	return f.eventRecorder.Publish(ctx, msgs)
+}
+
+func TestServer_Outbox(t *testing.T) {
+	t.Setenv("SLC_OUTBOX", "true")
+	t.Setenv("SLC_OUTBOX_INTERVAL", "1h")
+	mem, _ := store.New()
+	srv := New(mem)
+	defer srv.Close()
+	pub := &flakyPublisher{fail: true}
+	srv.outbox.events = pub
+	srv.observe(srv.onEventChange)
+	ctx := context.Background()
+	for _, p := range []string{"first", "second"} {
+		if _, err := srv.store.CreateEntryWithVector(ctx, &models.Entry{Prompt: p, Response: "r"}, []float64{1, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ob := mem.(store.Outbox)
+	srv.deliverOutbox(ctx)
+	if pending, _ := ob.PendingOutbox(ctx, 0); len(pending) != 2 || len(pub.types) != 0 {
+		t.Fatalf("expected both events kept while the broker is down got %d pending", len(pending))
+	}
+	// the lane backs off after a failure
+	pub.fail = false
+	srv.deliverOutbox(ctx)
+	if len(pub.types) != 0 {
+		t.Fatalf("expected no delivery during the backoff got %v", pub.types)
+	}
+	srv.outbox.delivered(sinkEvents + "\x00")
+	srv.deliverOutbox(ctx)
+	if pending, _ := ob.PendingOutbox(ctx, 0); len(pending) != 0 || fmt.Sprint(pub.types) != "[entry.created entry.created]" {
+		t.Fatalf("expected the events delivered in order and acknowledged got %v (%d pending)", pub.types, len(pending))
+	}
+}
+
+func TestServer_Doctor(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	t.Setenv("SLC_DOCTOR_TEST_TIMEOUT", "soon")
+	durationFromEnv("SLC_DOCTOR_TEST_TIMEOUT", time.Second)
+	mem, _ := store.New()
+	vec, _ := slm.NewMockSLM().Embed("alpha")
+	for _, v := range [][]float64{vec, {0.6, 0.8}} {
+		if _, err := mem.CreateEntryWithVector(context.Background(), &models.Entry{Prompt: "alpha", Response: "r"}, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := New(mem)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/admin/doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var rep models.DoctorReport
+	if err := json.NewDecoder(res.Body).Decode(&rep); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, c := range rep.Checks {
+		got[c.Name] = c.Status
+	}
+	want := map[string]string{"config": models.CheckFail, "store": models.CheckOK, "slm": models.CheckWarn, "dimensions": models.CheckFail}
+	if rep.OK || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %v got %v (ok=%v)", want, got, rep.OK)
+	}
+
+	t.Setenv("SLC_DOCTOR_TEST_TIMEOUT", "5s")
+	if c := checkConfig(); c.Status != models.CheckOK {
+		t.Fatalf("expected a fixed setting to clear got %+v", c)
+	}
+}
+
+func TestServer_SLMBackend(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/slm-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var out slmBackend
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Backend != "mock" || out.Dimensions != 64 || out.Error != "" || out.Fallback != "" {
+		t.Fatalf("expected the mock backend with 64 dimensions got %+v", out)
+	}
+}
+
+func TestServer_Chaos(t *testing.T) {
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	do := func(method, path, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	search := func() (int, *http.Response) {
+		t.Helper()
+		res := do(http.MethodGet, "/search?q=deploy", "")
+		defer res.Body.Close()
+		var found []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&found)
+		return len(found), res
+	}
+	if res := do(http.MethodPut, "/admin/chaos", `{"error_rate":1}`); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected fault injection off by default got %d", res.StatusCode)
+	}
+	t.Setenv("SLC_CHAOS", "true")
+	for _, p := range []string{"deploy pods", "deploy services", "deploy nodes", "deploy charts"} {
+		b, _ := json.Marshal(&models.Entry{Prompt: p, Response: "ok"})
+		do(http.MethodPost, "/entries", string(b)).Body.Close()
+	}
+	all, _ := search()
+	if all != 4 {
+		t.Fatalf("expected 4 results without faults got %d", all)
+	}
+
+	if res := do(http.MethodPut, "/admin/chaos", `{"routes":["/search"],"error_rate":1,"error_status":502,"latency_ms":20}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the faults set got %d", res.StatusCode)
+	}
+	start := time.Now()
+	if _, res := search(); res.StatusCode != http.StatusBadGateway || res.Header.Get(faultHeader) != "latency,error" || time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("expected a delayed 502 got %d %q after %s", res.StatusCode, res.Header.Get(faultHeader), time.Since(start))
+	}
+	if res := do(http.MethodGet, "/entries", ""); res.StatusCode != http.StatusOK || res.Header.Get(faultHeader) != "" {
+		t.Fatalf("expected other routes untouched got %d", res.StatusCode)
+	}
+
+	do(http.MethodPut, "/admin/chaos", `{"partial_rate":1}`).Body.Close()
+	if n, res := search(); n != all/2 || res.Header.Get(faultHeader) != "partial" {
+		t.Fatalf("expected half the results got %d (%q)", n, res.Header.Get(faultHeader))
+	}
+	do(http.MethodDelete, "/admin/chaos", "").Body.Close()
+	if n, _ := search(); n != all {
+		t.Fatalf("expected every result once cleared got %d", n)
+	}
+	if res := do(http.MethodPut, "/admin/chaos", `{"error_rate":2}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a rate above 1 rejected got %d", res.StatusCode)
+	}
+}
+
+func TestServer_EntryBlob(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SLC_BLOB_STORE", "fs")
+	t.Setenv("SLC_BLOB_DIR", dir)
+	t.Setenv("SLC_BLOB_MAX_BYTES", "1024")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	do := func(method, path, contentType string, body []byte) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	b, _ := json.Marshal(&models.Entry{Prompt: "draw a cat", Response: "here is a cat"})
+	res := do(http.MethodPost, "/entries", "application/json", b)
+	var created models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	path := fmt.Sprintf("/entries/%d/blob", created.ID)
+	if res := do(http.MethodGet, path, "", nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 before an upload got %d", res.StatusCode)
+	}
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{7}, 100)...)
+	if res := do(http.MethodPut, path, "image/png", png); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the upload accepted got %d", res.StatusCode)
+	}
+	if res := do(http.MethodPut, path, "image/png", make([]byte, 2048)); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a blob over SLC_BLOB_MAX_BYTES refused got %d", res.StatusCode)
+	}
+	res = do(http.MethodGet, path, "", nil)
+	got, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !bytes.Equal(got, png) || res.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("expected the png back got %d bytes of %s", len(got), res.Header.Get("Content-Type"))
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	req.Header.Set("If-None-Match", res.Header.Get("ETag"))
+	if res, _ := http.DefaultClient.Do(req); res.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected a matching ETag to give 304 got %d", res.StatusCode)
+	}
+	// a full update keeps the attachment
+	b, _ = json.Marshal(&models.Entry{Prompt: "draw a cat", Response: "a better cat"})
+	do(http.MethodPut, fmt.Sprintf("/entries/%d", created.ID), "application/json", b).Body.Close()
+	e, _ := srv.store.GetEntry(context.Background(), created.ID)
+	if ref := e.Blob(); ref == nil || ref.Size != int64(len(png)) || ref.ContentType != "image/png" {
+		t.Fatalf("expected the blob reference kept got %v", e.Metadata)
+	}
+	if res := do(http.MethodDelete, fmt.Sprintf("/entries/%d", created.ID), "", nil); res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %d", res.StatusCode)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(dir + "/" + blobKey(created.ID)); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the blob removed with its entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_ImageQueries(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	t.Setenv("SLM_MIN_SCORE", "0.8")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	cat := []byte(strings.Repeat("\x89PNG a tabby cat on a sofa ", 30))
+	dog := []byte(strings.Repeat("GIF89a a dog chasing a ball! ", 30))
+	form := func(method, path string, fields map[string]string, image []byte) *http.Response {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for k, v := range fields {
+			_ = mw.WriteField(k, v)
+		}
+		fw, _ := mw.CreateFormFile("image", "image.png")
+		_, _ = fw.Write(image)
+		_ = mw.Close()
+		req, _ := http.NewRequest(method, ts.URL+path, &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	search := func(res *http.Response) []*models.Entry {
+		t.Helper()
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("search: %d", res.StatusCode)
+		}
+		var found []*models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&found)
+		return found
+	}
+	res := form(http.MethodPost, "/entries", map[string]string{"entry": `{"prompt":"what animal is this","response":"a cat"}`}, cat)
+	var created models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated || created.ImageHash() == "" {
+		t.Fatalf("expected an image-conditioned entry got %d %v", res.StatusCode, created.Metadata)
+	}
+	b, _ := json.Marshal(&models.Entry{Prompt: "what animal is this", Response: "no idea, there is no picture"})
+	http.Post(ts.URL+"/entries", "application/json", bytes.NewReader(b))
+
+	found := search(form(http.MethodPost, "/search", map[string]string{"q": "what animal is this"}, cat))
+	if len(found) != 1 || found[0].Response != "a cat" {
+		t.Fatalf("expected the cat entry for the cat image got %v", found)
+	}
+	if found := search(form(http.MethodPost, "/search", map[string]string{"q": "what animal is this"}, dog)); len(found) != 0 {
+		t.Fatalf("expected another image to miss got %v", found)
+	}
+	res, _ = http.Get(ts.URL + "/search?q=" + url.QueryEscape("what animal is this"))
+	if found := search(res); len(found) != 1 || found[0].ImageHash() != "" {
+		t.Fatalf("expected a text search to skip image entries got %v", found)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/entries/%d", ts.URL, created.ID), bytes.NewReader(b))
+	if res, _ := http.DefaultClient.Do(req); res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected updating an image entry without its image refused got %d", res.StatusCode)
+	}
+	t.Setenv("SLC_IMAGE_MAX_BYTES", "100")
+	if res := form(http.MethodPost, "/search", map[string]string{"q": "what animal is this"}, cat); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected an image over SLC_IMAGE_MAX_BYTES refused got %d", res.StatusCode)
+	}
+}
+
+func TestServer_ToolCache(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	t.Setenv("SLM_MIN_SCORE", "0.5")
+	t.Setenv("SLC_TOOL_TTLS", "get_weather=1s")
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	call := func(path, body string) (int, toolCall) {
+		t.Helper()
+		res, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out toolCall
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return res.StatusCode, out
+	}
+	if code, _ := call("/tools/put", `{"tool":"get_weather","args":{"unit":"c","city":"Paris","days":1.0},"result":{"temp":21}}`); code != http.StatusOK {
+		t.Fatalf("expected put to succeed got %d", code)
+	}
+	// key order, whitespace and number formatting don't change the key
+	_, got := call("/tools/get", `{"tool":"get_weather","args":{ "city":"Paris","days":1,"unit":"c" }}`)
+	if string(got.Result) != `{"temp":21}` || got.Match != "exact" {
+		t.Fatalf("expected exact hit got %+v", got)
+	}
+	if _, got = call("/tools/get", `{"tool":"get_weather","args":{"city":"Paris","days":1,"unit":"f"}}`); string(got.Result) != "null" {
+		t.Fatalf("expected exact miss on other args got %s", got.Result)
+	}
+	if _, got = call("/tools/get", `{"tool":"get_weather","args":{"city":"Paris","days":1,"unit":"f"},"match":"semantic"}`); string(got.Result) != `{"temp":21}` {
+		t.Fatalf("expected semantic hit got %s", got.Result)
+	}
+	// another tool with the same arguments doesn't share results, and
+	// ordinary searches don't see tool entries
+	if _, got = call("/tools/get", `{"tool":"get_forecast","args":{"city":"Paris","days":1,"unit":"c"},"match":"semantic"}`); string(got.Result) != "null" {
+		t.Fatalf("expected miss for another tool got %s", got.Result)
+	}
+	res, err := http.Get(ts.URL + "/search?q=" + url.QueryEscape("get_weather city Paris days 1 unit c"))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("search: %v", err)
+	}
+	var found []*models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&found)
+	res.Body.Close()
+	if len(found) != 0 {
+		t.Fatalf("expected search to skip tool entries got %d", len(found))
+	}
+	// putting the same call again replaces its result
+	call("/tools/put", `{"tool":"get_weather","args":{"city":"Paris","days":1,"unit":"c"},"result":{"temp":23}}`)
+	if _, got = call("/tools/get", `{"tool":"get_weather","args":{"city":"Paris","days":1,"unit":"c"}}`); string(got.Result) != `{"temp":23}` {
+		t.Fatalf("expected replaced result got %s", got.Result)
+	}
+	if n := len(ms.AllIDs()); n != 1 {
+		t.Fatalf("expected 1 entry got %d", n)
+	}
+	if code, _ := call("/tools/put", `{"tool":"get_weather","args":{}}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without result got %d", code)
+	}
+	// get_weather results live for SLC_TOOL_TTLS' 1s, not SLC_ENTRY_TTL
+	ms.mu.Lock()
+	for _, e := range ms.entries {
+		e.CreatedAt = time.Now().Add(-2 * time.Second)
+		e.UpdatedAt = e.CreatedAt
+	}
+	ms.mu.Unlock()
+	if removed := srv.purgeExpired(context.Background()); removed != 1 {
+		t.Fatalf("expected the tool result purged got %d", removed)
+	}
+}
+
+func TestServer_SchemaValidatedOnHit(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	t.Setenv("SLM_MIN_SCORE", "0.9")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	schema := `{"type":"object","required":["city","temp"],"properties":{"temp":{"type":"number"}}}`
+	post := func(body string) int {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := post(`{"prompt":"weather in paris as json","response":"{\"city\":\"paris\",\"temp\":21}","metadata":{"json_schema":` + schema + `}}`); code != http.StatusCreated && code != http.StatusOK {
+		t.Fatalf("create: %d", code)
+	}
+	// drifted output: temp became a string; the schema may also be JSON text
+	if code := post(`{"prompt":"weather in rome as json","response":"{\"city\":\"rome\",\"temp\":\"warm\"}","metadata":{"json_schema":"{\"type\":\"object\",\"required\":[\"city\",\"temp\"],\"properties\":{\"temp\":{\"type\":\"number\"}}}"}}`); code != http.StatusCreated && code != http.StatusOK {
+		t.Fatalf("create: %d", code)
+	}
+	if code := post(`{"prompt":"bad","response":"{}","metadata":{"json_schema":[1,2]}}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid schema got %d", code)
+	}
+	get := func(prompt string) interface{} {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/get", "application/json", strings.NewReader(`{"prompt":"`+prompt+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out struct {
+			Answer interface{} `json:"answer"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return out.Answer
+	}
+	if got := get("weather in paris as json"); got != `{"city":"paris","temp":21}` {
+		t.Fatalf("expected conforming hit got %v", got)
+	}
+	if got := get("weather in rome as json"); got != nil {
+		t.Fatalf("expected non-conforming entry to miss got %v", got)
+	}
+}
+
+func TestServer_MaxHits(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"spring promo code","response":"SPRING-42","metadata":{"max_hits":2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	get := func() interface{} {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/get", "application/json", strings.NewReader(`{"prompt":"spring promo code"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out struct {
+			Answer interface{} `json:"answer"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return out.Answer
+	}
+	for i := 0; i < 2; i++ {
+		if got := get(); got != "SPRING-42" {
+			t.Fatalf("serve %d: expected a hit got %v", i+1, got)
+		}
+	}
+	if got := get(); got != nil {
+		t.Fatalf("expected a miss after max_hits got %v", got)
+	}
+	if _, err := st.GetEntry(context.Background(), created.ID); err == nil {
+		t.Fatalf("expected the exhausted entry to be deleted")
+	}
+}
+
+func TestServer_RefreshFromUpstream(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	t.Setenv("UPSTREAM_KEY", "sk-test")
+	var got struct {
+		auth string
+		body map[string]interface{}
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.auth = r.Header.Get("Authorization")
+		_ = json.NewDecoder(r.Body).Decode(&got.body)
+		_, _ = io.WriteString(w, `{"choices":[{"message":{"content":"fresh answer"}}]}`)
+	}))
+	defer upstream.Close()
+	t.Setenv("SLC_REFRESH_TARGETS", `{"llm":{"url":"`+upstream.URL+`","key":"UPSTREAM_KEY","response_path":"choices.0.message.content"}}`)
+	ms := newMockStore()
+	srv := New(ms)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	post := func(body string) *http.Response {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	if res := post(`{"prompt":"p","response":"r","metadata":{"refresh":{"every":"1h","target":"nope","request":{}}}}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown target got %d", res.StatusCode)
+	}
+	res := post(`{"prompt":"latest release notes","response":"old answer","metadata":{"stale":true,"refresh":{"every":"1h","target":"llm","request":{"model":"m","messages":[{"role":"user","content":"latest release notes"}]}}}}`)
+	var created models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	// not due yet; the mock store doesn't stamp writes
+	ms.mu.Lock()
+	ms.entries[created.ID].CreatedAt = time.Now()
+	ms.mu.Unlock()
+	srv.refreshDue(context.Background())
+	if e, _ := ms.GetEntry(context.Background(), created.ID); e.Response != "old answer" {
+		t.Fatalf("expected no refresh before the interval got %q", e.Response)
+	}
+	ms.mu.Lock()
+	ms.entries[created.ID].CreatedAt = time.Now().Add(-2 * time.Hour)
+	ms.entries[created.ID].UpdatedAt = time.Now().Add(-2 * time.Hour)
+	ms.mu.Unlock()
+	srv.refreshDue(context.Background())
+	e, _ := ms.GetEntry(context.Background(), created.ID)
+	if e.Response != "fresh answer" || e.Flag(models.MetaStale) {
+		t.Fatalf("expected a fresh, non-stale answer got %q stale=%v", e.Response, e.Flag(models.MetaStale))
+	}
+	if got.auth != "Bearer sk-test" || got.body["model"] != "m" {
+		t.Fatalf("expected the stored request with the target's key got %q %v", got.auth, got.body)
+	}
+}
+
+func TestServer_CanaryVariants(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	t.Setenv("SLM_MIN_SCORE", "0.9")
+	t.Setenv("SLC_RESULT_CACHE_TTL", "1m")
+	srv := New(newMockStore())
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	post := func(path, body string) *http.Response {
+		t.Helper()
+		res, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	if res := post("/entries", `{"prompt":"p","response":"r","metadata":{"canary":{"response":"r2","percent":150}}}`); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a percent over 100 got %d", res.StatusCode)
+	}
+	post("/entries", `{"prompt":"how do I reset my password","response":"old steps","metadata":{"canary":{"response":"new steps","percent":100,"label":"v2"}}}`).Body.Close()
+	post("/entries", `{"prompt":"how do I close my account","response":"close it","metadata":{"canary":{"response":"never","percent":0}}}`).Body.Close()
+	get := func(prompt string) cacheData {
+		t.Helper()
+		res := post("/get", `{"prompt":"`+prompt+`"}`)
+		defer res.Body.Close()
+		var out cacheData
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return out
+	}
+	// twice, so the second is answered by the result cache
+	for i := 0; i < 2; i++ {
+		if got := get("how do I reset my password"); got.Answer == nil || *got.Answer != "new steps" || got.Variant != "v2" {
+			t.Fatalf("expected the canary got %+v", got)
+		}
+		if got := get("how do I close my account"); got.Answer == nil || *got.Answer != "close it" || got.Variant != "control" {
+			t.Fatalf("expected the control got %+v", got)
+		}
+	}
+}
+
+func TestPickVariantsStickyPerSession(t *testing.T) {
+	entry := func() *models.Entry {
+		return &models.Entry{ID: 7, Response: "a", Metadata: map[string]interface{}{
+			models.MetaCanary: map[string]interface{}{"response": "b", "percent": float64(50)},
+		}}
+	}
+	served := map[string]int{}
+	for i := 0; i < 200; i++ {
+		session := fmt.Sprintf("s%d", i)
+		var first string
+		for j := 0; j < 3; j++ {
+			res := &searchResult{Entries: []*models.Entry{entry()}, Scores: []float64{1}}
+			pickVariants(searchQuery{Session: session}, res)
+			if j == 0 {
+				first = res.Entries[0].Variant
+			} else if res.Entries[0].Variant != first {
+				t.Fatalf("session %s flipped variants", session)
+			}
+		}
+		served[first]++
+	}
+	if served["canary"] < 60 || served["control"] < 60 {
+		t.Fatalf("expected about half of sessions on each variant got %v", served)
+	}
+}
+
+func TestServer_DecisionHeader(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	res, _ := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"what is a pod","response":"a group of containers"}`))
+	res.Body.Close()
+	res, err := http.Post(ts.URL+"/get", "application/json", strings.NewReader(`{"prompt":"what is a pod"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get("X-SLMCache"); got != "HIT; score=1.00; id=1; age=0; tier=l1" {
+		t.Fatalf("expected an l1 hit header got %q", got)
+	}
+	res, err = http.Get(ts.URL + "/search?q=" + url.QueryEscape("completely unrelated zebra question"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get("X-SLMCache"); got != "MISS" {
+		t.Fatalf("expected a miss header got %q", got)
+	}
+}
+
+func TestServer_QualityFloor(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	t.Setenv("SLC_MIN_QUALITY", "0.5")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		{`{"prompt":"what is a pod","response":"no idea","metadata":{"quality":0.2}}`, http.StatusUnprocessableEntity},
+		{`{"prompt":"what is a pod","response":"no idea","metadata":{"quality":1.5}}`, http.StatusBadRequest},
+		{`{"prompt":"what is a pod","response":"a group of containers","metadata":{"quality":0.6}}`, http.StatusCreated},
+		{`{"prompt":"what is a pod","response":"the smallest deployable unit","metadata":{"quality":0.9}}`, http.StatusCreated},
+	} {
+		res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != c.want {
+			t.Fatalf("expected %d for %s got %d", c.want, c.body, res.StatusCode)
+		}
+	}
+	res, err := http.Post(ts.URL+"/put", "application/json", strings.NewReader(`{"prompt":"what is a node","answer":"a machine","quality":0.1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected /put below the floor to be refused got %d", res.StatusCode)
+	}
+	// both answers match equally well; the better rated one leads
+	res, err = http.Get(ts.URL + "/search?q=" + url.QueryEscape("what is a pod here"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var out []models.Entry
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) == 0 || out[0].Response != "the smallest deployable unit" {
+		t.Fatalf("expected the higher quality answer first got %+v", out)
+	}
+}
+
+func TestServer_BackfillFallbackVectors(t *testing.T) {
+	// nothing listens here, so the mock stands in for Ollama
+	t.Setenv("SLM_BACKEND", "ollama")
+	t.Setenv("SLM_OLLAMA_URL", "http://127.0.0.1:1")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	res, err := http.Post(ts.URL+"/entries", "application/json", strings.NewReader(`{"prompt":"what is a pod","response":"a group of containers"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	if created.Embedder == nil || !created.Embedder.Fallback {
+		t.Fatalf("expected the entry marked as embedded by the fallback got %+v", created.Embedder)
+	}
+	res, err = http.Post(ts.URL+"/admin/backfill", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a backfill to wait for the backend got %d", res.StatusCode)
+	}
+
+	// the real backend is back
+	srv.cfgMu.Lock()
+	srv.slm = slm.NewMockSLMWithOptions(slm.MockOptions{Hash: slm.HashBag})
+	srv.cfgMu.Unlock()
+	res, err = http.Post(ts.URL+"/admin/backfill", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep backfillReport
+	_ = json.NewDecoder(res.Body).Decode(&rep)
+	res.Body.Close()
+	if rep.ReEmbedded != 1 || rep.Pending != 0 {
+		t.Fatalf("expected one entry re-embedded got %+v", rep)
+	}
+	e, _ := st.GetEntry(context.Background(), created.ID)
+	if e.Embedder == nil || e.Embedder.Fallback || e.Embedder.Version != "bag-64" {
+		t.Fatalf("expected the entry marked as embedded by the backend got %+v", e.Embedder)
+	}
+	// the new vector matches what the backend makes of a reordered query
+	res, err = http.Get(ts.URL + "/search?q=" + url.QueryEscape("pod is a what"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var found []models.Entry
+	_ = json.NewDecoder(res.Body).Decode(&found)
+	if len(found) != 1 || found[0].Score < 0.99 {
+		t.Fatalf("expected the re-embedded entry found got %+v", found)
+	}
+}
+
+func TestServer_SkipsVectorsFromAnotherModel(t *testing.T) {
+	t.Setenv("SLM_BACKEND", "mock")
+	st, _ := store.New()
+	srv := New(st)
+	defer srv.Close()
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+	ctx := context.Background()
+	vec, _ := srv.getSLM().Embed("what is a pod")
+	// the vector lines up with the query, but another model made it
+	foreign := &models.Entry{Prompt: "qué es eso", Response: "un grupo de contenedores",
+		Embedder: &models.Embedder{Backend: "ollama", Model: "nomic-embed-text"}}
+	if _, err := st.CreateEntryWithVector(ctx, foreign, vec); err != nil {
+		t.Fatal(err)
+	}
+	search := func() []models.Entry {
+		res, err := http.Get(ts.URL + "/search?q=" + url.QueryEscape("what is a pod"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var out []models.Entry
+		_ = json.NewDecoder(res.Body).Decode(&out)
+		return out
+	}
+	if found := search(); len(found) != 0 {
+		t.Fatalf("expected the foreign vector skipped got %+v", found)
+	}
+	// entries from before embedders were tracked still match
+	legacy := &models.Entry{Prompt: "pod?", Response: "a group of containers"}
+	if _, err := st.CreateEntryWithVector(ctx, legacy, vec); err != nil {
+		t.Fatal(err)
+	}
+	if found := search(); len(found) != 1 || found[0].Prompt != "pod?" {
+		t.Fatalf("expected the untracked entry found got %+v", found)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var servesExhausted = metrics.NewCounter("slmcache_serves_exhausted_total",
+	"Entries expired by using up their max_hits, and hits on them refused since, by outcome (expired, refused).", "outcome")
+
+// consumeServe counts a serve of id against its max_hits and journals the
+// new count. Observers aren't told: the count changes neither what the
+// entry matches nor what it says, and every serve is counted anew, cached
+// results included.
+func (o *observedStore) consumeServe(ctx context.Context, id int64) (int, error) {
+	sl, ok := o.Store.(store.ServeLimiter)
+	if !ok {
+		return -1, nil
+	}
+	o.gate.RLock()
+	defer o.gate.RUnlock()
+	left, err := sl.ConsumeServe(ctx, id)
+	if err == nil && left >= 0 {
+		o.record(ctx, id, false)
+	}
+	return left, err
+}
+
+// consume counts a serve of each result limited by max_hits and removes the
+// ones with no serves left. The entry is deleted once its last serve is
+// counted, so it expires like any other. A count that fails, such as on a
+// cluster follower, leaves the result out: a one-time answer served twice
+// is worse than a miss.
+func (s *Server) consume(ctx context.Context, res *searchResult) {
+	entries := res.Entries[:0]
+	scores := res.Scores[:0]
+	for i, e := range res.Entries {
+		if e.Region == "" && e.Count(models.MetaMaxHits) > 0 {
+			left, err := s.observed.consumeServe(ctx, e.ID)
+			switch {
+			case errors.Is(err, store.ErrExhausted):
+				servesExhausted.Inc("refused")
+				_ = s.store.DeleteEntry(ctx, e.ID)
+				continue
+			case err != nil:
+				log.Printf("server: counting a serve of entry %d: %v", e.ID, err)
+				continue
+			case left == 0:
+				servesExhausted.Inc("expired")
+				_ = s.store.DeleteEntry(ctx, e.ID)
+			}
+		}
+		entries = append(entries, e)
+		scores = append(scores, res.Scores[i])
+	}
+	res.Entries, res.Scores = entries, scores
+}
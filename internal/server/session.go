@@ -0,0 +1,166 @@
+package server
+
+import (
+	"container/list"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+)
+
+// sessionTracker remembers the last few query embeddings of each
+// conversation (session_id) so a follow-up such as "what about 2026?" is
+// searched, and stored, together with the turns that gave it meaning. A
+// nil *sessionTracker disables session context.
+type sessionTracker struct {
+	turns  int
+	weight float64
+	ttl    time.Duration
+	max    int
+
+	mu   sync.Mutex
+	ll   *list.List // most recently used first
+	byID map[string]*list.Element
+}
+
+type session struct {
+	id   string
+	vecs [][]float64 // most recent last
+	used time.Time
+}
+
+// newSessionTracker keeps SLC_SESSION_TURNS (default 3) previous turns per
+// session, weighting the turn k steps back by SLC_SESSION_WEIGHT^k (default
+// 0.5). Sessions idle for SLC_SESSION_TTL (default 30m) are forgotten, and at
+// most SLC_SESSION_MAX (default 10000) are kept.
+func newSessionTracker() *sessionTracker {
+	turns := intFromEnv("SLC_SESSION_TURNS", 3)
+	if turns == 0 {
+		return nil
+	}
+	weight := 0.5
+	if v := config.Get("SLC_SESSION_WEIGHT"); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed >= 0 {
+			weight = parsed
+		}
+	}
+	return &sessionTracker{
+		turns:  turns,
+		weight: weight,
+		ttl:    durationFromEnv("SLC_SESSION_TTL", 30*time.Minute),
+		max:    intFromEnv("SLC_SESSION_MAX", 10000),
+		ll:     list.New(),
+		byID:   map[string]*list.Element{},
+	}
+}
+
+// history returns how many earlier turns session id has.
+func (t *sessionTracker) history(id string) int {
+	if t == nil || id == "" {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.getLocked(id, time.Now()); s != nil {
+		return len(s.vecs)
+	}
+	return 0
+}
+
+// contextualize blends vec with the session's earlier turns and records vec
+// as the newest turn. A vec equal to the newest turn (a miss being stored
+// right after its search) is blended with the turns before it, so the entry
+// lands where the search looked. blended is false when there was no earlier
+// turn and vec is returned unchanged.
+func (t *sessionTracker) contextualize(id string, vec []float64) (out []float64, blended bool) {
+	if t == nil || id == "" {
+		return vec, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	s := t.getLocked(id, now)
+	if s == nil {
+		s = &session{id: id}
+		t.byID[id] = t.ll.PushFront(s)
+		for t.max > 0 && t.ll.Len() > t.max {
+			old := t.ll.Back()
+			t.ll.Remove(old)
+			delete(t.byID, old.Value.(*session).id)
+		}
+	}
+	s.used = now
+	prev := s.vecs
+	repeat := len(prev) > 0 && equalVec(prev[len(prev)-1], vec)
+	if repeat {
+		prev = prev[:len(prev)-1]
+	} else {
+		s.vecs = append(s.vecs, vec)
+		if len(s.vecs) > t.turns {
+			s.vecs = s.vecs[len(s.vecs)-t.turns:]
+		}
+	}
+	if len(prev) == 0 {
+		return vec, false
+	}
+	out = unit(vec)
+	w := 1.0
+	for i := len(prev) - 1; i >= 0; i-- {
+		w *= t.weight
+		turn := unit(prev[i])
+		if len(turn) != len(out) {
+			continue
+		}
+		for j := range out {
+			out[j] += w * turn[j]
+		}
+	}
+	return out, true
+}
+
+// getLocked returns a live session, dropping it if it idled out.
+func (t *sessionTracker) getLocked(id string, now time.Time) *session {
+	el, ok := t.byID[id]
+	if !ok {
+		return nil
+	}
+	s := el.Value.(*session)
+	if t.ttl > 0 && now.Sub(s.used) > t.ttl {
+		t.ll.Remove(el)
+		delete(t.byID, id)
+		return nil
+	}
+	t.ll.MoveToFront(el)
+	return s
+}
+
+func equalVec(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// unit returns a normalized copy of v.
+func unit(v []float64) []float64 {
+	var n float64
+	for _, x := range v {
+		n += x * x
+	}
+	out := make([]float64, len(v))
+	if n == 0 {
+		return out
+	}
+	n = math.Sqrt(n)
+	for i, x := range v {
+		out[i] = x / n
+	}
+	return out
+}
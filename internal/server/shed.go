@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+)
+
+var (
+	shedRequests = metrics.NewCounter("slmcache_shed_total",
+		"Lookups rejected with 503 because they queued longer than the shedder allowed, by route.", "route")
+	shedQueueDelay = metrics.NewHistogram("slmcache_shed_queue_seconds",
+		"Time lookups waited for a free slot.", nil)
+	shedOverloaded = metrics.NewGauge("slmcache_shed_overloaded",
+		"1 while the shedder is in its overloaded state.")
+)
+
+// shedder admits at most limit concurrent lookups and queues the rest,
+// shedding by queueing delay in the manner of CoDel: while the queue drains
+// normally a request may wait up to interval, but once a whole interval
+// passes without any request getting through in under target, the queue is
+// standing and waits are cut to target. Excess traffic is then rejected fast
+// instead of every request getting slow. Low priority lookups go first
+// (they don't queue at all while overloaded) and high priority ones last
+// (they always get the full interval). A nil *shedder admits everything.
+type shedder struct {
+	gate             *priorityGate
+	target, interval time.Duration
+
+	mu         sync.Mutex
+	overloaded bool
+	windowEnd  time.Time
+	windowMin  time.Duration // smallest delay seen in the current interval
+}
+
+// newShedder limits lookups to SLC_SHED_CONCURRENCY at a time with a target
+// queueing delay of SLC_SHED_TARGET (default 5ms) measured over
+// SLC_SHED_INTERVAL (default 100ms). It returns nil when
+// SLC_SHED_CONCURRENCY is unset or 0.
+func newShedder() *shedder {
+	limit := intFromEnv("SLC_SHED_CONCURRENCY", 0)
+	if limit <= 0 {
+		return nil
+	}
+	return &shedder{
+		gate:      newPriorityGate(limit),
+		target:    durationFromEnv("SLC_SHED_TARGET", 5*time.Millisecond),
+		interval:  durationFromEnv("SLC_SHED_INTERVAL", 100*time.Millisecond),
+		windowMin: -1,
+	}
+}
+
+// acquire waits for a slot. It returns false when the request waited longer
+// than its priority allows in the current state, or ctx ended first;
+// otherwise the caller must call release.
+func (sh *shedder) acquire(ctx context.Context) bool {
+	p := priorityFrom(ctx)
+	start := time.Now()
+	sh.mu.Lock()
+	wait := sh.interval
+	if sh.overloaded {
+		switch p {
+		case priorityNormal:
+			wait = sh.target
+		case priorityLow:
+			wait = 0
+		}
+	}
+	sh.mu.Unlock()
+	ok := sh.gate.acquire(ctx, p, wait)
+	now := time.Now()
+	sh.mu.Lock()
+	sh.observeLocked(now.Sub(start), now)
+	sh.mu.Unlock()
+	return ok
+}
+
+func (sh *shedder) release() { sh.gate.release() }
+
+// observeLocked records a queueing delay and, at the end of each interval,
+// decides whether the queue is standing: overloaded when even the fastest
+// request of the interval waited longer than target.
+func (sh *shedder) observeLocked(delay time.Duration, now time.Time) {
+	shedQueueDelay.Observe(delay.Seconds())
+	if sh.windowMin < 0 || delay < sh.windowMin {
+		sh.windowMin = delay
+	}
+	if sh.windowEnd.IsZero() {
+		sh.windowEnd = now.Add(sh.interval)
+	}
+	if now.Before(sh.windowEnd) {
+		return
+	}
+	sh.overloaded = sh.windowMin > sh.target
+	overloaded := 0.0
+	if sh.overloaded {
+		overloaded = 1
+	}
+	shedOverloaded.Set(overloaded)
+	sh.windowMin = -1
+	sh.windowEnd = now.Add(sh.interval)
+}
+
+// shedLoad passes lookups (/search, /search/batch and /get) through the
+// shedder, answering 503 with Retry-After when one is shed. Writes and admin
+// requests are never shed.
+func (s *Server) shedLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.shed == nil || (r.URL.Path != "/search" && r.URL.Path != "/search/batch" && r.URL.Path != "/get") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.shed.acquire(r.Context()) {
+			shedRequests.Inc(r.URL.Path)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "overloaded, try again", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.shed.release()
+		next.ServeHTTP(w, r)
+	})
+}
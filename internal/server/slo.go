@@ -0,0 +1,258 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var (
+	sloCompliance = metrics.NewGauge("slmcache_slo_compliance",
+		"Fraction of requests within the latency objective over the window.", "slo", "namespace", "key", "window")
+	sloBurnRate = metrics.NewGauge("slmcache_slo_burn_rate",
+		"Rate the error budget is being spent over the window (1 = exactly on budget).", "slo", "namespace", "key", "window")
+)
+
+// sloWindows are the rolling windows reported for every objective, paired
+// as in multi-window burn-rate alerting: 5m/1h pages, 30m/6h opens a ticket.
+var sloWindows = []struct {
+	name string
+	d    time.Duration
+}{{"5m", 5 * time.Minute}, {"30m", 30 * time.Minute}, {"1h", time.Hour}, {"6h", 6 * time.Hour}}
+
+const (
+	sloMinutes   = 360 // the longest window, in one-minute buckets
+	sloMaxSeries = 1000
+	pageBurn     = 14.4
+	ticketBurn   = 6
+)
+
+// sloTarget is one latency objective: target of the requests to route
+// finish within threshold without a server error.
+type sloTarget struct {
+	route     string
+	threshold time.Duration
+	target    float64
+}
+
+type sloKey struct{ route, namespace, key string }
+
+type sloBucket struct {
+	minute      int64
+	total, slow uint64
+}
+
+// sloTracker keeps per-minute good/bad counts for every route, namespace
+// and API key with an objective, over the last six hours. A nil
+// *sloTracker tracks nothing.
+type sloTracker struct {
+	targets map[string]sloTarget
+
+	mu     sync.Mutex
+	series map[sloKey]*[sloMinutes]sloBucket
+	alerts map[sloKey]string
+}
+
+// newSLOTracker parses SLC_SLOS: comma-separated route=threshold@percent
+// objectives, by default /search=50ms@99. "off" disables tracking.
+func newSLOTracker() *sloTracker {
+	spec := config.Get("SLC_SLOS")
+	if spec == "off" {
+		return nil
+	}
+	if spec == "" {
+		spec = "/search=50ms@99"
+	}
+	t := &sloTracker{targets: map[string]sloTarget{}, series: map[sloKey]*[sloMinutes]sloBucket{}, alerts: map[sloKey]string{}}
+	for _, item := range strings.Split(spec, ",") {
+		route, objective, ok := strings.Cut(strings.TrimSpace(item), "=")
+		threshold, percent, ok2 := strings.Cut(objective, "@")
+		d, err := time.ParseDuration(threshold)
+		p, err2 := strconv.ParseFloat(percent, 64)
+		if !ok || !ok2 || err != nil || err2 != nil || d <= 0 || p <= 0 || p >= 100 {
+			log.Printf("server: ignoring SLC_SLOS objective %q", item)
+			continue
+		}
+		t.targets[route] = sloTarget{route: route, threshold: d, target: p / 100}
+	}
+	if len(t.targets) == 0 {
+		return nil
+	}
+	return t
+}
+
+// record counts one request; it is slow when it took longer than the
+// objective allows or failed with a server error.
+func (t *sloTracker) record(k sloKey, took time.Duration, failed bool, now time.Time) {
+	target := t.targets[k.route]
+	minute := now.Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.series[k]
+	if !ok {
+		// namespaces come from the request; don't let them grow without bound
+		if len(t.series) >= sloMaxSeries {
+			k.namespace = "other"
+			if s, ok = t.series[k]; !ok {
+				s = &[sloMinutes]sloBucket{}
+				t.series[k] = s
+			}
+		} else {
+			s = &[sloMinutes]sloBucket{}
+			t.series[k] = s
+		}
+	}
+	b := &s[minute%sloMinutes]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if failed || took > target.threshold {
+		b.slow++
+	}
+}
+
+// sloWindowStats summarizes one series over one window.
+type sloWindowStats struct {
+	Total      uint64  `json:"total"`
+	Slow       uint64  `json:"slow"`
+	Compliance float64 `json:"compliance"`
+	BurnRate   float64 `json:"burn_rate"`
+}
+
+type sloStatus struct {
+	SLO       string                    `json:"slo"`
+	Threshold string                    `json:"threshold"`
+	Target    float64                   `json:"target"`
+	Namespace string                    `json:"namespace"`
+	Key       string                    `json:"key,omitempty"`
+	Windows   map[string]sloWindowStats `json:"windows"`
+	// Alert is "page" when both the 5m and 1h burn rates exceed 14.4, and
+	// "ticket" when both the 30m and 6h burn rates exceed 6.
+	Alert string `json:"alert,omitempty"`
+}
+
+// status computes every series' windows, refreshes the gauges and logs
+// alerts as they start.
+func (t *sloTracker) status(now time.Time) []sloStatus {
+	if t == nil {
+		return []sloStatus{}
+	}
+	minute := now.Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]sloStatus, 0, len(t.series))
+	for k, s := range t.series {
+		target := t.targets[k.route]
+		st := sloStatus{SLO: k.route, Threshold: target.threshold.String(), Target: target.target,
+			Namespace: k.namespace, Key: k.key, Windows: map[string]sloWindowStats{}}
+		for _, w := range sloWindows {
+			var ws sloWindowStats
+			for m := minute - int64(w.d/time.Minute) + 1; m <= minute; m++ {
+				if b := s[m%sloMinutes]; b.minute == m {
+					ws.Total += b.total
+					ws.Slow += b.slow
+				}
+			}
+			ws.Compliance = 1
+			if ws.Total > 0 {
+				bad := float64(ws.Slow) / float64(ws.Total)
+				ws.Compliance = 1 - bad
+				ws.BurnRate = bad / (1 - target.target)
+			}
+			st.Windows[w.name] = ws
+			sloCompliance.Set(ws.Compliance, k.route, k.namespace, k.key, w.name)
+			sloBurnRate.Set(ws.BurnRate, k.route, k.namespace, k.key, w.name)
+		}
+		switch {
+		case st.Windows["5m"].BurnRate > pageBurn && st.Windows["1h"].BurnRate > pageBurn:
+			st.Alert = "page"
+		case st.Windows["30m"].BurnRate > ticketBurn && st.Windows["6h"].BurnRate > ticketBurn:
+			st.Alert = "ticket"
+		}
+		if st.Alert != "" && t.alerts[k] != st.Alert {
+			log.Printf("server: slo %s (namespace %s) burning error budget: %s", k.route, k.namespace, st.Alert)
+		}
+		t.alerts[k] = st.Alert
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].SLO != out[j].SLO {
+			return out[i].SLO < out[j].SLO
+		}
+		if out[i].Namespace != out[j].Namespace {
+			return out[i].Namespace < out[j].Namespace
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// trackSLO times the requests to routes with an objective. The namespace is
+// the request's metadata.namespace filter, and the key is the caller's API
+// key fingerprint when keys are in use.
+func (s *Server) trackSLO(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.slo == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := s.slo.targets[r.URL.Path]; !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		k := sloKey{route: r.URL.Path, namespace: models.DefaultNamespace}
+		if ns := metadataFiltersFromQuery(r.URL.Query())[models.MetaNamespace]; ns != "" {
+			k.namespace = ns
+		}
+		if p := principalFrom(r.Context()); p != nil {
+			k.key = p.id
+		}
+		s.slo.record(k, time.Since(start), sw.status >= 500, start)
+	})
+}
+
+// startSLOExport refreshes the SLO gauges every SLC_SLO_EXPORT_INTERVAL
+// (default 15s). Every replica exports its own view.
+func (s *Server) startSLOExport() {
+	if s.slo == nil {
+		return
+	}
+	interval := durationFromEnv("SLC_SLO_EXPORT_INTERVAL", 15*time.Second)
+	s.janitorWG.Add(1)
+	go func() {
+		defer s.janitorWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.slo.status(time.Now())
+			case <-s.janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+// GET /stats/slo
+func (s *Server) handleSLOStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.slo.status(time.Now()))
+}
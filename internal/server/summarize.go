@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/blob"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var summarizations = metrics.NewCounter("slmcache_summarizations_total",
+	"Oversized responses sent to the generator for summarization, by result (summarized, kept, error).", "result")
+
+const summarizeTemplate = `Summarize the answer below to the question in at most %d words, keeping
+every fact a reader needs. Reply with the summary only.
+
+Question: %s
+
+Answer: %s`
+
+// estimateTokens approximates the token count of text at four bytes a
+// token.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// summarizeAbove is the token count over which responses in namespace ns
+// are summarized: the namespace's summarize_above, or SLC_SUMMARIZE_ABOVE
+// (default 0, off).
+func (s *Server) summarizeAbove(ns string) int {
+	if n, ok := s.namespaces.get(ns); ok && n.SummarizeAbove != nil {
+		return *n.SummarizeAbove
+	}
+	return intFromEnv("SLC_SUMMARIZE_ABOVE", 0)
+}
+
+// fullResponseKey is where the full response of summarized entry id is
+// kept, next to its attachment.
+func fullResponseKey(id int64) string {
+	return blobKey(id) + ".response"
+}
+
+// summarize replaces e's response with a summary when it is over its
+// namespace's threshold, recording the original's size and digest in
+// metadata.summarized, and returns the full response for the caller to
+// keep in the blob store; it returns "" when e is left as it was. Nothing
+// is summarized without a blob store and a generator, nor are responses
+// that must stay exact: tool results and those with a JSON Schema.
+func (s *Server) summarize(ctx context.Context, e *models.Entry) string {
+	delete(e.Metadata, models.MetaSummarized)
+	limit := s.summarizeAbove(e.Namespace())
+	gen := s.getGenerator()
+	if limit <= 0 || s.blobs == nil || gen == nil || e.Tool() != "" || e.Metadata[models.MetaSchema] != nil || s.namespaceSchema(e) != nil {
+		return ""
+	}
+	tokens := estimateTokens(e.Response)
+	if tokens <= limit {
+		return ""
+	}
+	g, err := gen.Generate(ctx, fmt.Sprintf(summarizeTemplate, limit*3/4, e.Prompt, e.Response))
+	if err != nil {
+		summarizations.Inc("error")
+		log.Printf("server: summarize response: %v", err)
+		return ""
+	}
+	summary := strings.TrimSpace(g.Text)
+	if summary == "" || len(summary) >= len(e.Response) {
+		summarizations.Inc("kept")
+		return ""
+	}
+	summarizations.Inc("summarized")
+	full := e.Response
+	sum := sha256.Sum256([]byte(full))
+	if e.Metadata == nil {
+		e.Metadata = map[string]interface{}{}
+	}
+	e.Metadata[models.MetaSummarized] = map[string]interface{}{
+		"tokens": tokens, "size": len(full), "sha256": hex.EncodeToString(sum[:]),
+	}
+	e.Response = summary
+	return full
+}
+
+// createEntry stores new entry e with vector vec, summarizing its response
+// first when it is over its namespace's threshold. Every write of a new
+// answer goes through it or updateEntry.
+func (s *Server) createEntry(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
+	full := s.summarize(ctx, e)
+	id, err := s.store.CreateEntryWithVector(ctx, e, vec)
+	if err != nil {
+		return 0, err
+	}
+	if full != "" && !s.keepFullResponse(ctx, id, e, full) {
+		if err := s.store.UpdateEntryWithVector(ctx, id, e, vec); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// updateEntry replaces entry id, which was existing, with e and vec like
+// createEntry, deleting a full response the new one doesn't need.
+func (s *Server) updateEntry(ctx context.Context, id int64, existing, e *models.Entry, vec []float64) error {
+	if full := s.summarize(ctx, e); full != "" {
+		s.keepFullResponse(ctx, id, e, full)
+	}
+	if err := s.store.UpdateEntryWithVector(ctx, id, e, vec); err != nil {
+		return err
+	}
+	if summarized(existing) && !summarized(e) {
+		s.dropFullResponse(ctx, id)
+	}
+	return nil
+}
+
+// keepFullResponse writes the full response of summarized entry id to the
+// blob store. When that fails it puts the response back into e, since a
+// summary can't stand in for a response that is lost, and returns false.
+func (s *Server) keepFullResponse(ctx context.Context, id int64, e *models.Entry, full string) bool {
+	if err := s.blobs.Put(ctx, fullResponseKey(id), []byte(full)); err != nil {
+		log.Printf("server: keep full response of entry %d: %v", id, err)
+		e.Response = full
+		delete(e.Metadata, models.MetaSummarized)
+		return false
+	}
+	return true
+}
+
+// dropFullResponse deletes the full response of entry id, whose response
+// is no longer a summary.
+func (s *Server) dropFullResponse(ctx context.Context, id int64) {
+	if s.blobs == nil {
+		return
+	}
+	if err := s.blobs.Delete(ctx, fullResponseKey(id)); err != nil {
+		log.Printf("server: delete full response of entry %d: %v", id, err)
+	}
+}
+
+// summarized reports whether e's response is a summary.
+func summarized(e *models.Entry) bool {
+	return e != nil && e.Metadata != nil && e.Metadata[models.MetaSummarized] != nil
+}
+
+// responseDigest is what tells e's response apart from others: the digest
+// of the original when it was summarized, since summaries of the same
+// response can differ, or the response itself.
+func responseDigest(e *models.Entry) string {
+	if m, ok := e.Metadata[models.MetaSummarized].(map[string]interface{}); ok {
+		if sum, ok := m["sha256"].(string); ok {
+			return sum
+		}
+	}
+	return e.Response
+}
+
+// GET /entries/{id}/response
+//
+// Returns the entry's full response as text: the original of a summarized
+// response, read from the blob store, or the response itself.
+func (s *Server) handleEntryResponse(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	e, err := s.store.GetEntry(ctx, id)
+	if err != nil || s.expireIfNeeded(ctx, e) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if redacted(r) {
+		http.Error(w, "responses are redacted for read keys", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !summarized(e) || s.blobs == nil {
+		_, _ = io.WriteString(w, e.Response)
+		return
+	}
+	body, err := s.blobs.Get(ctx, fullResponseKey(id))
+	if errors.Is(err, blob.ErrNotFound) {
+		http.Error(w, "full response is missing from the blob store", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "blob store: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+	_, _ = io.Copy(w, body)
+}
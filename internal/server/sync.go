@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// Anti-entropy sync keeps independent instances (e.g. one per region)
+// loosely consistent. Entries are identified across instances by a key
+// derived from namespace, llm_string and prompt, since IDs are local. Each
+// side hashes its entries into syncBuckets buckets and a root, a two-level
+// Merkle tree; only buckets whose hashes differ are compared leaf by leaf,
+// and only differing entries are transferred. When both sides changed an
+// entry the more recently updated copy wins. Deletes are not propagated.
+
+const syncBuckets = 256
+
+var syncClient = &http.Client{Timeout: 30 * time.Second}
+
+type syncDigest struct {
+	Root    string   `json:"root"`
+	Buckets []string `json:"buckets"`
+}
+
+type syncLeaf struct {
+	Key       string    `json:"key"`
+	Hash      string    `json:"hash"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type syncReport struct {
+	Peer             string   `json:"peer"`
+	DifferingBuckets int      `json:"differing_buckets"`
+	Pulled           int      `json:"pulled"`
+	Pushed           int      `json:"pushed"`
+	Errors           []string `json:"errors,omitempty"`
+}
+
+type syncItem struct {
+	leaf  syncLeaf
+	entry *models.Entry
+}
+
+// syncKey identifies an entry across instances.
+func syncKey(e *models.Entry) string {
+	llm, _ := e.Metadata[models.MetaLLMString].(string)
+	sum := sha256.Sum256([]byte(e.Namespace() + "\x00" + llm + "\x00" + e.ScopeHash() + "\x00" + e.Prompt))
+	return hex.EncodeToString(sum[:])
+}
+
+// syncHash covers the replicated content of an entry but not its local ID
+// or timestamps, so two instances holding the same answer agree.
+func syncHash(e *models.Entry) string {
+	b, _ := json.Marshal(struct {
+		Prompt     string                 `json:"p"`
+		Response   string                 `json:"r"`
+		Metadata   map[string]interface{} `json:"m,omitempty"`
+		Provenance *models.Provenance     `json:"v,omitempty"`
+	}{e.Prompt, e.Response, e.Metadata, e.Provenance})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func syncBucket(key string) int {
+	b, _ := strconv.ParseUint(key[:2], 16, 8)
+	return int(b)
+}
+
+// syncIndex returns every live entry keyed by sync key.
+func (s *Server) syncIndex(ctx context.Context) map[string]syncItem {
+	out := map[string]syncItem{}
+	for _, id := range s.store.AllIDs() {
+		e, err := s.store.GetEntry(ctx, id)
+		if err != nil || s.isExpired(e) {
+			continue
+		}
+		key := syncKey(e)
+		// with duplicates under one key, the newest copy represents it
+		if cur, ok := out[key]; ok && !e.UpdatedAt.After(cur.leaf.UpdatedAt) {
+			continue
+		}
+		out[key] = syncItem{leaf: syncLeaf{Key: key, Hash: syncHash(e), UpdatedAt: e.UpdatedAt}, entry: e}
+	}
+	return out
+}
+
+func digestOf(index map[string]syncItem) syncDigest {
+	buckets := make([][]syncLeaf, syncBuckets)
+	for _, it := range index {
+		b := syncBucket(it.leaf.Key)
+		buckets[b] = append(buckets[b], it.leaf)
+	}
+	d := syncDigest{Buckets: make([]string, syncBuckets)}
+	root := sha256.New()
+	for i, leaves := range buckets {
+		if len(leaves) == 0 {
+			continue
+		}
+		sort.Slice(leaves, func(a, b int) bool { return leaves[a].Key < leaves[b].Key })
+		h := sha256.New()
+		for _, l := range leaves {
+			h.Write([]byte(l.Key + l.Hash))
+		}
+		d.Buckets[i] = hex.EncodeToString(h.Sum(nil))
+		root.Write([]byte(d.Buckets[i]))
+	}
+	d.Root = hex.EncodeToString(root.Sum(nil))
+	return d
+}
+
+// syncWith pulls entries that are missing or older locally from peer and
+// pushes entries that are missing or older there.
+func (s *Server) syncWith(ctx context.Context, peer string) *syncReport {
+	peer = strings.TrimRight(peer, "/")
+	rep := &syncReport{Peer: peer}
+	fail := func(err error) *syncReport {
+		rep.Errors = append(rep.Errors, err.Error())
+		return rep
+	}
+	var remote syncDigest
+	if err := syncCall(ctx, http.MethodGet, peer+"/admin/sync/digest", nil, &remote); err != nil {
+		return fail(err)
+	}
+	index := s.syncIndex(ctx)
+	local := digestOf(index)
+	if len(remote.Buckets) != syncBuckets {
+		return fail(fmt.Errorf("peer digest has %d buckets", len(remote.Buckets)))
+	}
+	if remote.Root == local.Root {
+		return rep
+	}
+	var differing []string
+	for i := range local.Buckets {
+		if local.Buckets[i] != remote.Buckets[i] {
+			differing = append(differing, strconv.Itoa(i))
+		}
+	}
+	rep.DifferingBuckets = len(differing)
+	var remoteLeaves []syncLeaf
+	if err := syncCall(ctx, http.MethodGet, peer+"/admin/sync/leaves?buckets="+strings.Join(differing, ","), nil, &remoteLeaves); err != nil {
+		return fail(err)
+	}
+
+	var pull []string
+	var push []*models.Entry
+	seen := map[string]bool{}
+	for _, rl := range remoteLeaves {
+		seen[rl.Key] = true
+		it, ok := index[rl.Key]
+		switch {
+		case !ok:
+			pull = append(pull, rl.Key)
+		case it.leaf.Hash == rl.Hash:
+		case rl.UpdatedAt.After(it.leaf.UpdatedAt):
+			pull = append(pull, rl.Key)
+		default:
+			push = append(push, it.entry)
+		}
+	}
+	wanted := map[int]bool{}
+	for _, b := range differing {
+		n, _ := strconv.Atoi(b)
+		wanted[n] = true
+	}
+	for key, it := range index {
+		if wanted[syncBucket(key)] && !seen[key] {
+			push = append(push, it.entry)
+		}
+	}
+
+	if len(pull) > 0 {
+		var entries []*models.Entry
+		if err := syncCall(ctx, http.MethodPost, peer+"/admin/sync/entries", map[string][]string{"keys": pull}, &entries); err != nil {
+			fail(err)
+		} else {
+			rep.Pulled = s.applySynced(ctx, entries, index)
+		}
+	}
+	if len(push) > 0 {
+		var res struct {
+			Applied int `json:"applied"`
+		}
+		if err := syncCall(ctx, http.MethodPost, peer+"/admin/sync/apply", push, &res); err != nil {
+			fail(err)
+		} else {
+			rep.Pushed = res.Applied
+		}
+	}
+	return rep
+}
+
+// applySynced stores entries received from a peer unless the local copy is
+// identical or newer, and returns how many were written. Replication is
+// bulk work, so it embeds at low priority.
+func (s *Server) applySynced(ctx context.Context, entries []*models.Entry, index map[string]syncItem) int {
+	ctx = withPriority(ctx, priorityLow)
+	applied := 0
+	for _, e := range entries {
+		// image-conditioned entries can't be embedded without their image,
+		// nor encrypted ones without their client
+		if e == nil || strings.TrimSpace(e.Prompt) == "" || e.Provenance.Validate() != nil || e.ImageHash() != "" || e.Flag(models.MetaEncrypted) {
+			continue
+		}
+		key := syncKey(e)
+		cur, exists := index[key]
+		if exists && (cur.leaf.Hash == syncHash(e) || !e.UpdatedAt.After(cur.leaf.UpdatedAt)) {
+			continue
+		}
+		in := &models.Entry{Prompt: e.Prompt, Response: e.Response, Metadata: e.Metadata, Provenance: e.Provenance, CreatedAt: e.CreatedAt}
+		vec, err := s.embedEntry(ctx, in, nil, stageInsert)
+		if err != nil {
+			log.Printf("server: sync: embed %q: %v", e.Prompt, err)
+			continue
+		}
+		if exists {
+			err = s.store.UpdateEntryWithVector(ctx, cur.entry.ID, in, vec)
+		} else {
+			_, err = s.store.CreateEntryWithVector(ctx, in, vec)
+		}
+		if err != nil {
+			log.Printf("server: sync: store %q: %v", e.Prompt, err)
+			continue
+		}
+		index[key] = syncItem{leaf: syncLeaf{Key: key, Hash: syncHash(in), UpdatedAt: in.UpdatedAt}, entry: in}
+		applied++
+	}
+	return applied
+}
+
+func syncCall(ctx context.Context, method, u string, body, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setPeerKey(req)
+	resp, err := syncClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: status %d", method, u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// syncPeers lists the instances the periodic sync loop reconciles with
+// (SLC_SYNC_PEERS, comma-separated base URLs).
+func syncPeers() []string {
+	var out []string
+	for _, p := range strings.Split(config.Get("SLC_SYNC_PEERS"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (s *Server) syncAll(ctx context.Context) {
+	for _, peer := range syncPeers() {
+		rep := s.syncWith(ctx, peer)
+		if len(rep.Errors) > 0 {
+			log.Printf("server: sync with %s: %s", peer, strings.Join(rep.Errors, "; "))
+		} else if rep.Pulled+rep.Pushed > 0 {
+			log.Printf("server: sync with %s: pulled %d, pushed %d", peer, rep.Pulled, rep.Pushed)
+		}
+	}
+}
+
+// POST /admin/sync?peer=<url>, GET /admin/sync/digest,
+// GET /admin/sync/leaves?buckets=1,2, POST /admin/sync/entries,
+// POST /admin/sync/apply
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	var out interface{}
+	switch sub := strings.TrimPrefix(r.URL.Path, "/admin/sync"); {
+	case sub == "" && r.Method == http.MethodPost:
+		peer := r.URL.Query().Get("peer")
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "bad request: peer must be an http(s) base URL", http.StatusBadRequest)
+			return
+		}
+		out = s.syncWith(r.Context(), peer)
+	case sub == "/digest" && r.Method == http.MethodGet:
+		out = digestOf(s.syncIndex(r.Context()))
+	case sub == "/leaves" && r.Method == http.MethodGet:
+		wanted := map[int]bool{}
+		for _, b := range strings.Split(r.URL.Query().Get("buckets"), ",") {
+			if n, err := strconv.Atoi(b); err == nil {
+				wanted[n] = true
+			}
+		}
+		leaves := []syncLeaf{}
+		for key, it := range s.syncIndex(r.Context()) {
+			if wanted[syncBucket(key)] {
+				leaves = append(leaves, it.leaf)
+			}
+		}
+		out = leaves
+	case sub == "/entries" && r.Method == http.MethodPost:
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		index := s.syncIndex(r.Context())
+		entries := []*models.Entry{}
+		for _, k := range req.Keys {
+			if it, ok := index[k]; ok {
+				entries = append(entries, it.entry)
+			}
+		}
+		out = entries
+	case sub == "/apply" && r.Method == http.MethodPost:
+		var entries []*models.Entry
+		if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		out = map[string]int{"applied": s.applySynced(r.Context(), entries, s.syncIndex(r.Context()))}
+	case sub == "" || sub == "/digest" || sub == "/leaves" || sub == "/entries" || sub == "/apply":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// synonymCache holds each namespace's synonym dictionary, alias to term,
+// both canonicalized. Stores implementing store.SynonymStore persist the
+// dictionaries and the cache is refreshed from them; other stores keep them
+// on each instance only.
+type synonymCache struct {
+	mu    sync.RWMutex
+	dicts map[string]map[string]string
+}
+
+func (c *synonymCache) get(ns string) map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dicts[ns]
+}
+
+func (c *synonymCache) all() map[string]map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make(map[string]map[string]string, len(c.dicts))
+	for ns, dict := range c.dicts {
+		out[ns] = dict
+	}
+	return out
+}
+
+// set replaces the dictionaries and reports whether they changed.
+func (c *synonymCache) set(dicts map[string]map[string]string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := !maps.EqualFunc(c.dicts, dicts, func(a, b map[string]string) bool { return maps.Equal(a, b) })
+	c.dicts = dicts
+	return changed
+}
+
+// setOne replaces namespace ns's dictionary; an empty one removes it.
+func (c *synonymCache) setOne(ns string, dict map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dicts == nil {
+		c.dicts = map[string]map[string]string{}
+	}
+	if len(dict) == 0 {
+		delete(c.dicts, ns)
+		return
+	}
+	c.dicts[ns] = dict
+}
+
+// normalizeSynonyms canonicalizes a dictionary. Aliases must be single
+// words, since they replace one word of a prompt; terms may be several.
+func normalizeSynonyms(dict map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(dict))
+	for alias, term := range dict {
+		a, t := canonicalize(alias), canonicalize(term)
+		if a == "" || strings.Contains(a, " ") {
+			return nil, fmt.Errorf("alias %q must be a single word", alias)
+		}
+		if t == "" {
+			return nil, fmt.Errorf("term for %q is empty", alias)
+		}
+		if a != t {
+			out[a] = t
+		}
+	}
+	return out, nil
+}
+
+// canonical is canonicalize with namespace ns's synonyms applied, so "what
+// is k8s" and "What is Kubernetes?" share an exact-match key when "k8s" is
+// an alias of "kubernetes".
+func (s *Server) canonical(ns, text string) string {
+	key := canonicalize(text)
+	dict := s.synonyms.get(ns)
+	if len(dict) == 0 || key == "" {
+		return key
+	}
+	words := strings.Split(key, " ")
+	for i, w := range words {
+		if t, ok := dict[w]; ok {
+			words[i] = t
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// entryKey is e's exact-match key.
+func (s *Server) entryKey(e *models.Entry) string {
+	return s.canonical(e.Namespace(), e.Prompt)
+}
+
+// synonymTokens replaces the tokens of ns's aliases with the words of their
+// terms, for the token fallback.
+func (s *Server) synonymTokens(ns string, tokens []string) []string {
+	dict := s.synonyms.get(ns)
+	if len(dict) == 0 {
+		return tokens
+	}
+	out := make([]string, 0, len(tokens))
+	for _, tok := range tokens {
+		if t, ok := dict[canonicalize(tok)]; ok {
+			out = append(out, strings.Fields(t)...)
+			continue
+		}
+		out = append(out, tok)
+	}
+	return out
+}
+
+// namespace is the namespace q searches, which selects its synonyms.
+func (q searchQuery) namespace() string {
+	if ns := q.Filters[models.MetaNamespace]; ns != "" {
+		return ns
+	}
+	return models.DefaultNamespace
+}
+
+// loadSynonyms refreshes the dictionaries from the store. Exact-match keys
+// computed with the old ones are dropped when they changed.
+func (s *Server) loadSynonyms(ctx context.Context) {
+	ss, ok := s.backend.(store.SynonymStore)
+	if !ok {
+		return
+	}
+	stored, err := ss.Synonyms(ctx)
+	if err != nil {
+		if !errors.Is(err, store.ErrUnavailable) {
+			log.Printf("server: load synonyms: %v", err)
+		}
+		return
+	}
+	if s.synonyms.set(stored) {
+		s.exact.reset()
+		s.lexicon.invalidate()
+	}
+}
+
+// startSynonymRefresh reloads the dictionaries every SLC_SYNONYM_REFRESH
+// (default 30s), picking up changes made through other replicas. Every
+// replica refreshes, so this doesn't use startLoop's lease.
+func (s *Server) startSynonymRefresh() {
+	if _, ok := s.backend.(store.SynonymStore); !ok {
+		return
+	}
+	s.loadSynonyms(context.Background())
+	interval := durationFromEnv("SLC_SYNONYM_REFRESH", 30*time.Second)
+	if interval <= 0 {
+		return
+	}
+	s.janitorWG.Add(1)
+	go func() {
+		defer s.janitorWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.loadSynonyms(context.Background())
+			case <-s.janitorStop:
+				return
+			}
+		}
+	}()
+}
+
+// putSynonyms stores namespace ns's dictionary and applies it.
+func (s *Server) putSynonyms(ctx context.Context, ns string, dict map[string]string) error {
+	if ss, ok := s.backend.(store.SynonymStore); ok {
+		if err := ss.SetSynonyms(ctx, ns, dict); err != nil {
+			return err
+		}
+	}
+	s.synonyms.setOne(ns, dict)
+	s.exact.reset()
+	s.lexicon.invalidate()
+	return nil
+}
+
+// /admin/synonyms and /admin/synonyms/{namespace}
+func (s *Server) handleSynonyms(w http.ResponseWriter, r *http.Request) {
+	ns := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/synonyms"), "/")
+	switch {
+	case r.Method == http.MethodGet && ns == "":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.synonyms.all())
+	case r.Method == http.MethodGet:
+		dict := s.synonyms.get(ns)
+		if dict == nil {
+			dict = map[string]string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(dict)
+	case r.Method == http.MethodPut && ns != "":
+		var dict map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&dict); err != nil {
+			http.Error(w, `bad request: expected JSON {"alias": "term", ...}; `+err.Error(), http.StatusBadRequest)
+			return
+		}
+		dict, err := normalizeSynonyms(dict)
+		if err != nil {
+			http.Error(w, "invalid synonyms: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.putSynonyms(r.Context(), ns, dict); err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(dict)
+	case r.Method == http.MethodDelete && ns != "":
+		if err := s.putSynonyms(r.Context(), ns, nil); err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var (
+	thrashingPrompts = metrics.NewGauge("slmcache_thrashing_prompts",
+		"Prompts whose response changed at least SLC_THRASH_CHANGES times within SLC_THRASH_WINDOW.")
+	thrashRejections = metrics.NewCounter("slmcache_thrash_rejections_total",
+		"Writes refused because their prompt is thrashing (SLC_THRASH_POLICY=skip), by route.", "route")
+)
+
+// errThrashing is returned for writes of a thrashing prompt when
+// SLC_THRASH_POLICY=skip.
+var errThrashing = errors.New("the prompt's response keeps changing (see GET /stats/thrash); not cached")
+
+// thrashStat is the recent history of one prompt's responses.
+type thrashStat struct {
+	namespace string
+	prompt    string
+	response  uint64      // hash of the last response written
+	changes   []time.Time // when the response changed, oldest first
+}
+
+// thrashTracker spots prompts that are written again and again with a
+// different response, such as questions about the time or the weather:
+// caching them wastes an embedding per write and serves stale answers.
+type thrashTracker struct {
+	window    time.Duration
+	threshold int
+	skip      bool
+	max       int
+	// keyOf is the server's exact-match key, so prompts differing only in
+	// case, spacing or synonyms count as one.
+	keyOf func(*models.Entry) string
+
+	mu    sync.Mutex
+	stats map[string]*thrashStat
+}
+
+// newThrashTracker counts a prompt as thrashing once its response changed
+// SLC_THRASH_CHANGES times (default 3) within SLC_THRASH_WINDOW (default
+// 1h). With SLC_THRASH_POLICY=skip, writes of thrashing prompts are refused
+// until they settle; the default, report, only lists them. At most
+// SLC_THRASH_MAX (default 10000) prompts are tracked; 0 disables tracking.
+func newThrashTracker(keyOf func(*models.Entry) string) *thrashTracker {
+	max := intFromEnv("SLC_THRASH_MAX", 10000)
+	if max == 0 {
+		return nil
+	}
+	t := &thrashTracker{
+		window:    durationFromEnv("SLC_THRASH_WINDOW", time.Hour),
+		threshold: intFromEnv("SLC_THRASH_CHANGES", 3),
+		max:       max,
+		keyOf:     keyOf,
+		stats:     make(map[string]*thrashStat),
+	}
+	if t.threshold == 0 {
+		t.threshold = 1
+	}
+	switch p := config.Get("SLC_THRASH_POLICY"); p {
+	case "skip":
+		t.skip = true
+	case "", "report":
+	default:
+		noteInvalid("SLC_THRASH_POLICY", "report or skip")
+	}
+	return t
+}
+
+func responseHash(response string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(response))
+	return h.Sum64()
+}
+
+// record notes that key was written with response at now. The first write
+// of a prompt isn't a change; later writes are when the response differs
+// from the previous one.
+func (t *thrashTracker) record(key string, e *models.Entry, now time.Time) {
+	sum := responseHash(responseDigest(e))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.stats[key]
+	if !ok {
+		if len(t.stats) >= t.max {
+			t.pruneLocked(now)
+		}
+		t.stats[key] = &thrashStat{namespace: e.Namespace(), prompt: e.Prompt, response: sum}
+		return
+	}
+	st.prompt = e.Prompt
+	if st.response == sum {
+		return
+	}
+	st.response = sum
+	st.changes = append(trimChanges(st.changes, now.Add(-t.window)), now)
+	thrashingPrompts.Set(float64(t.countLocked(now)))
+}
+
+// trimChanges drops the changes before cutoff.
+func trimChanges(changes []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(changes) && changes[i].Before(cutoff) {
+		i++
+	}
+	return changes[i:]
+}
+
+// thrashing reports whether key's response changed often enough lately.
+func (t *thrashTracker) thrashing(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.stats[key]
+	return ok && len(trimChanges(st.changes, now.Add(-t.window))) >= t.threshold
+}
+
+func (t *thrashTracker) countLocked(now time.Time) int {
+	n := 0
+	for _, st := range t.stats {
+		if len(trimChanges(st.changes, now.Add(-t.window))) >= t.threshold {
+			n++
+		}
+	}
+	return n
+}
+
+// pruneLocked makes room for a new prompt: it forgets the prompts with no
+// change in the window and, if that frees nothing, the one that changed
+// longest ago.
+func (t *thrashTracker) pruneLocked(now time.Time) {
+	cutoff := now.Add(-t.window)
+	oldestKey, oldest := "", now
+	for key, st := range t.stats {
+		st.changes = trimChanges(st.changes, cutoff)
+		if len(st.changes) == 0 {
+			delete(t.stats, key)
+			continue
+		}
+		if last := st.changes[len(st.changes)-1]; last.Before(oldest) {
+			oldestKey, oldest = key, last
+		}
+	}
+	if len(t.stats) >= t.max {
+		delete(t.stats, oldestKey)
+	}
+}
+
+func (t *thrashTracker) onChange(c change) {
+	if (c.kind != changeCreated && c.kind != changeUpdated) || c.entry == nil {
+		return
+	}
+	t.record(t.keyOf(c.entry), c.entry, time.Now())
+}
+
+// admitThrash refuses e when its prompt is thrashing and the policy is
+// skip. The refused write still counts, so a prompt that keeps changing
+// stays refused until it settles for a window.
+func (s *Server) admitThrash(e *models.Entry, route string) error {
+	t := s.thrash
+	if t == nil || !t.skip {
+		return nil
+	}
+	key, now := t.keyOf(e), time.Now()
+	if !t.thrashing(key, now) {
+		return nil
+	}
+	t.record(key, e, now)
+	thrashRejections.Inc(route)
+	return errThrashing
+}
+
+// thrashEntry is one prompt in GET /stats/thrash.
+type thrashEntry struct {
+	Namespace  string    `json:"namespace,omitempty"`
+	Prompt     string    `json:"prompt"`
+	Changes    int       `json:"changes"`
+	LastChange time.Time `json:"last_change"`
+}
+
+// thrashReport is the body of GET /stats/thrash.
+type thrashReport struct {
+	Window    string        `json:"window"`
+	Threshold int           `json:"threshold"`
+	Policy    string        `json:"policy"`
+	Prompts   []thrashEntry `json:"prompts"`
+}
+
+// report lists the thrashing prompts, those that changed most first.
+func (t *thrashTracker) report(now time.Time) thrashReport {
+	out := thrashReport{Window: t.window.String(), Threshold: t.threshold, Policy: "report", Prompts: []thrashEntry{}}
+	if t.skip {
+		out.Policy = "skip"
+	}
+	t.mu.Lock()
+	for _, st := range t.stats {
+		changes := trimChanges(st.changes, now.Add(-t.window))
+		if len(changes) < t.threshold {
+			continue
+		}
+		out.Prompts = append(out.Prompts, thrashEntry{Namespace: st.namespace, Prompt: st.prompt, Changes: len(changes), LastChange: changes[len(changes)-1]})
+	}
+	t.mu.Unlock()
+	sort.Slice(out.Prompts, func(i, j int) bool {
+		a, b := out.Prompts[i], out.Prompts[j]
+		if a.Changes != b.Changes {
+			return a.Changes > b.Changes
+		}
+		return a.LastChange.After(b.LastChange)
+	})
+	thrashingPrompts.Set(float64(len(out.Prompts)))
+	return out
+}
+
+// GET /stats/thrash
+func (s *Server) handleThrashStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.thrash == nil {
+		http.Error(w, "thrash detection is disabled (SLC_THRASH_MAX=0)", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.thrash.report(time.Now()))
+}
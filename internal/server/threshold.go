@@ -0,0 +1,85 @@
+package server
+
+import (
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// scoreProfile is a similarity threshold for the entries whose metadata key
+// has value, e.g. category=legal answers needing 0.95.
+type scoreProfile struct {
+	key, value string
+	minScore   float64
+}
+
+func (p scoreProfile) matches(e *models.Entry) bool {
+	if p.key == models.MetaNamespace {
+		return e.Namespace() == p.value
+	}
+	v, ok := e.Metadata[p.key]
+	return ok && toString(v) == p.value
+}
+
+// newScoreProfiles parses SLC_SCORE_PROFILES: comma-separated
+// key=value:threshold items, such as
+// "category=legal:0.95,namespace=chitchat:0.8". The first profile an entry
+// matches sets its threshold; others use SLM_MIN_SCORE.
+func newScoreProfiles() []scoreProfile {
+	var out []scoreProfile
+	for _, item := range strings.Split(config.Get("SLC_SCORE_PROFILES"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		match, threshold, ok := strings.Cut(item, ":")
+		key, value, ok2 := strings.Cut(match, "=")
+		score, err := strconv.ParseFloat(threshold, 64)
+		if !ok || !ok2 || key == "" || err != nil {
+			log.Printf("server: ignoring SLC_SCORE_PROFILES item %q", item)
+			continue
+		}
+		out = append(out, scoreProfile{key: key, value: value, minScore: score})
+	}
+	return out
+}
+
+func (s *Server) getScoreProfiles() []scoreProfile {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.scoreProfiles
+}
+
+// thresholds resolves the similarity thresholds of a request: lowest is the
+// least any entry needs, for discarding candidates before they are read,
+// and of gives an entry's own.
+type thresholds struct {
+	base     float64
+	profiles []scoreProfile
+}
+
+// SLC_SCORE_PROFILES come first, so a category's threshold holds in every
+// namespace; the thresholds of declared namespaces follow.
+func (s *Server) thresholds() thresholds {
+	return thresholds{base: s.minScore(), profiles: slices.Concat(s.getScoreProfiles(), s.namespaceProfiles())}
+}
+
+func (t thresholds) lowest() float64 {
+	low := t.base
+	for _, p := range t.profiles {
+		low = min(low, p.minScore)
+	}
+	return low
+}
+
+func (t thresholds) of(e *models.Entry) float64 {
+	for _, p := range t.profiles {
+		if p.matches(e) {
+			return p.minScore
+		}
+	}
+	return t.base
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var (
+	tierLookups = metrics.NewCounter("slmcache_tier_lookups_total",
+		"Search lookups per cache tier and outcome.", "tier", "result")
+	tierLatency = metrics.NewHistogram("slmcache_tier_duration_seconds",
+		"Search latency by the tier that answered (l2 includes the l1 miss).", nil, "tier")
+)
+
+// canonicalize normalizes a prompt for exact matching: case, punctuation and
+// whitespace differences are ignored, so "What is KubeCon?" and
+// "what is kubecon" share a key.
+func canonicalize(prompt string) string {
+	fields := strings.FieldsFunc(strings.ToLower(prompt), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	return strings.Join(fields, " ")
+}
+
+// exactTier is the L1 cache: a bounded LRU from canonical prompt to entry ID
+// that answers repeated questions without embedding or vector search. A nil
+// *exactTier is a disabled tier.
+type exactTier struct {
+	keyOf func(*models.Entry) string // the entry's key, synonyms applied
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	byKey map[string]*list.Element
+	byID  map[int64]*list.Element
+}
+
+type tierItem struct {
+	key string
+	id  int64
+}
+
+func newExactTier(size int, keyOf func(*models.Entry) string) *exactTier {
+	if size <= 0 {
+		return nil
+	}
+	return &exactTier{
+		keyOf: keyOf,
+		size:  size,
+		ll:    list.New(),
+		byKey: map[string]*list.Element{},
+		byID:  map[int64]*list.Element{},
+	}
+}
+
+func (t *exactTier) get(key string) (int64, bool) {
+	if t == nil || key == "" {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el, ok := t.byKey[key]
+	if !ok {
+		return 0, false
+	}
+	t.ll.MoveToFront(el)
+	return el.Value.(*tierItem).id, true
+}
+
+func (t *exactTier) put(key string, id int64) {
+	if t == nil || key == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(id)
+	if el, ok := t.byKey[key]; ok {
+		t.unlinkLocked(el)
+	}
+	el := t.ll.PushFront(&tierItem{key: key, id: id})
+	t.byKey[key] = el
+	t.byID[id] = el
+	for t.ll.Len() > t.size {
+		t.unlinkLocked(t.ll.Back())
+	}
+}
+
+func (t *exactTier) remove(id int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(id)
+}
+
+// reset forgets every key, after the synonyms that computed them changed.
+func (t *exactTier) reset() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ll.Init()
+	clear(t.byKey)
+	clear(t.byID)
+}
+
+func (t *exactTier) removeLocked(id int64) {
+	if el, ok := t.byID[id]; ok {
+		t.unlinkLocked(el)
+	}
+}
+
+func (t *exactTier) unlinkLocked(el *list.Element) {
+	item := el.Value.(*tierItem)
+	t.ll.Remove(el)
+	delete(t.byKey, item.key)
+	delete(t.byID, item.id)
+}
+
+// onChange keeps the tier consistent with the store.
+func (t *exactTier) onChange(c change) {
+	switch c.kind {
+	case changeCreated, changeUpdated:
+		t.remove(c.id)
+		if c.entry != nil {
+			t.put(t.keyOf(c.entry), c.id)
+		}
+	case changeDeleted:
+		t.remove(c.id)
+	}
+}
+
+// lookupExact answers q from the L1 tier. Stale mappings (entries evicted or
+// rewritten behind the tier's back) are dropped; entries that merely fail the
+// request's filters fall through to vector search.
+func (s *Server) lookupExact(ctx context.Context, q searchQuery) *models.Entry {
+	key := s.canonical(q.namespace(), q.Text)
+	id, ok := s.exact.get(key)
+	if !ok {
+		return nil
+	}
+	e, err := s.store.GetEntry(ctx, id)
+	if err != nil || s.entryKey(e) != key || e.Opaque() {
+		s.exact.remove(id)
+		return nil
+	}
+	if s.expireIfNeeded(ctx, e) || !matchesFilters(e, q.Filters) {
+		return nil
+	}
+	return e
+}
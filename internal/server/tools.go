@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var toolLookups = metrics.NewCounter("slmcache_tool_lookups_total",
+	"Tool result lookups by tool, match mode (exact, semantic) and result (hit, miss).", "tool", "match", "result")
+
+// Tool lookup match modes.
+const (
+	matchExact    = "exact"
+	matchSemantic = "semantic"
+)
+
+// toolCall is the body of /tools/get and /tools/put: a function call and,
+// for /tools/put, its result. Results are any JSON value.
+type toolCall struct {
+	Tool      string          `json:"tool"`
+	Args      json.RawMessage `json:"args,omitempty"`
+	Namespace string          `json:"namespace,omitempty"`
+	// Match is exact (the default: same canonical arguments) or semantic
+	// (similar argument text, above the similarity threshold).
+	Match  string          `json:"match,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	// set on /tools/get responses
+	ID    int64   `json:"id,omitempty"`
+	Score float64 `json:"score,omitempty"`
+}
+
+func decodeToolCall(w http.ResponseWriter, r *http.Request) (*toolCall, string, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, "", false
+	}
+	var call toolCall
+	if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	if strings.TrimSpace(call.Tool) == "" {
+		http.Error(w, "tool required", http.StatusBadRequest)
+		return nil, "", false
+	}
+	args, err := canonicalArgs(call.Args)
+	if err != nil {
+		http.Error(w, "bad request: args: "+err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	return &call, args, true
+}
+
+// canonicalArgs re-encodes a JSON value with sorted object keys, no
+// whitespace and normalized numbers (1.0 is 1), so calls differing only in
+// formatting share a key. Absent arguments are {}.
+func canonicalArgs(raw json.RawMessage) (string, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return "{}", nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(normalizeNumbers(v))
+	return string(out), err
+}
+
+func normalizeNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, x := range t {
+			t[k] = normalizeNumbers(x)
+		}
+	case []interface{}:
+		for i, x := range t {
+			t[i] = normalizeNumbers(x)
+		}
+	}
+	return v
+}
+
+// toolPrompt is the text a tool call is embedded as: the tool name and its
+// argument keys and values in order, which is what a semantic match
+// compares.
+func toolPrompt(tool, args string) string {
+	var v interface{}
+	_ = json.Unmarshal([]byte(args), &v)
+	words := []string{tool}
+	var walk func(interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for _, k := range slices.Sorted(maps.Keys(t)) {
+				words = append(words, k)
+				walk(t[k])
+			}
+		case []interface{}:
+			for _, x := range t {
+				walk(x)
+			}
+		case nil:
+		default:
+			words = append(words, fmt.Sprint(t))
+		}
+	}
+	walk(v)
+	return strings.Join(words, " ")
+}
+
+// parseToolTTLs parses SLC_TOOL_TTLS: comma-separated tool=duration items, such
+// as "get_weather=10m,get_stock_price=30s". Other entries live for
+// SLC_ENTRY_TTL.
+func parseToolTTLs() map[string]time.Duration {
+	out := map[string]time.Duration{}
+	for _, item := range strings.Split(config.Get("SLC_TOOL_TTLS"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		tool, d, ok := strings.Cut(item, "=")
+		ttl, err := time.ParseDuration(strings.TrimSpace(d))
+		if !ok || tool == "" || err != nil || ttl < 0 {
+			log.Printf("server: ignoring SLC_TOOL_TTLS item %q", item)
+			continue
+		}
+		out[strings.TrimSpace(tool)] = ttl
+	}
+	return out
+}
+
+// ttlOf returns how long e lives: its tool's TTL when SLC_TOOL_TTLS sets
+// one, SLC_ENTRY_TTL otherwise.
+func (s *Server) ttlOf(e *models.Entry, tools map[string]time.Duration) time.Duration {
+	if ttl, ok := tools[e.Tool()]; ok && e.Tool() != "" {
+		return ttl
+	}
+	if ttl := s.namespaces.ttl(e.Namespace()); ttl > 0 {
+		return ttl
+	}
+	return s.ttl()
+}
+
+// forTool reports whether q looks up tool results, which only results
+// stored here answer: peers, the upstream and the generator know nothing
+// of them.
+func (q searchQuery) forTool() bool {
+	_, ok := q.Filters[models.MetaTool]
+	return ok
+}
+
+// namespace is the namespace a call's result is stored in.
+func (c *toolCall) namespace() string {
+	if c.Namespace != "" {
+		return c.Namespace
+	}
+	return models.DefaultNamespace
+}
+
+// findToolResult returns the entry caching exactly this call, if any.
+func (s *Server) findToolResult(ctx context.Context, call *toolCall, args string) (*models.Entry, error) {
+	entries, err := s.findEntries(ctx, call.namespace(), map[string]string{models.MetaTool: call.Tool, models.MetaToolArgs: args})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !s.expireIfNeeded(ctx, e) && e.State() == models.StatePublished {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// POST /tools/get
+//
+// Returns the cached result of a tool call as the call with result set;
+// result is null on a miss.
+func (s *Server) handleToolGet(w http.ResponseWriter, r *http.Request) {
+	call, args, ok := decodeToolCall(w, r)
+	if !ok {
+		return
+	}
+	if call.Match == "" {
+		call.Match = matchExact
+	}
+	var hit *models.Entry
+	tier := "exact"
+	switch call.Match {
+	case matchExact:
+		e, err := s.findToolResult(r.Context(), call, args)
+		if err != nil {
+			s.respondStoreError(w, err)
+			return
+		}
+		if hit = e; hit != nil {
+			hit.Score = 1
+		}
+	case matchSemantic:
+		q := searchQuery{Text: toolPrompt(call.Tool, args), Limit: 1, Source: "tools",
+			Filters: map[string]string{models.MetaTool: call.Tool}}
+		if ns := call.namespace(); ns != models.DefaultNamespace {
+			q.Filters[models.MetaNamespace] = ns
+		}
+		res, err := s.search(r.Context(), q)
+		if err != nil {
+			if errors.Is(err, errEmbed) || errors.Is(err, errDegenerate) {
+				embedError(w, err)
+				return
+			}
+			s.respondStoreError(w, err)
+			return
+		}
+		if len(res.Entries) > 0 {
+			hit = res.Entries[0]
+		}
+		tier = res.Tier
+	default:
+		http.Error(w, "match must be exact or semantic", http.StatusBadRequest)
+		return
+	}
+	out := toolCall{Tool: call.Tool, Args: json.RawMessage(args), Namespace: call.Namespace, Match: call.Match, Result: json.RawMessage("null")}
+	result := "miss"
+	if hit != nil {
+		result = "hit"
+		out.Result, out.ID, out.Score = json.RawMessage(hit.Response), hit.ID, hit.Score
+	}
+	toolLookups.Inc(call.Tool, call.Match, result)
+	setDecision(w, hit, tier)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// POST /tools/put
+//
+// Stores the result of a tool call, replacing the result previously stored
+// for the same call.
+func (s *Server) handleToolPut(w http.ResponseWriter, r *http.Request) {
+	call, args, ok := decodeToolCall(w, r)
+	if !ok {
+		return
+	}
+	if len(call.Result) == 0 || !json.Valid(call.Result) {
+		http.Error(w, "result required (any JSON value)", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	e := &models.Entry{Prompt: toolPrompt(call.Tool, args), Response: string(call.Result), Metadata: map[string]interface{}{
+		models.MetaTool: call.Tool, models.MetaToolArgs: args,
+	}}
+	if call.Namespace != "" {
+		e.Metadata[models.MetaNamespace] = call.Namespace
+	}
+	if err := s.admitUncacheable(e); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := s.admitThrash(e, "/tools/put"); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	vec, err := s.embedEntry(ctx, e, nil, stageInsert)
+	if err != nil {
+		embedError(w, err)
+		return
+	}
+	existing, err := s.findToolResult(ctx, call, args)
+	if err == nil && existing != nil {
+		err = s.updateEntry(ctx, existing.ID, existing, e, vec)
+		e.ID = existing.ID
+	} else if err == nil {
+		e.ID, err = s.createEntry(ctx, e, vec)
+	}
+	if err != nil {
+		s.respondStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"id": strconv.FormatInt(e.ID, 10)})
+}
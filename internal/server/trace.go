@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type traceKey struct{}
+
+// traceIDFrom returns the W3C trace ID of the request ctx belongs to, or ""
+// when the caller didn't send one.
+func traceIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(traceKey{}).(string)
+	return id
+}
+
+// parseTraceparent extracts the trace ID from a W3C traceparent header
+// ("00-<32 hex trace id>-<16 hex span id>-<flags>").
+func parseTraceparent(h string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", false
+	}
+	id := strings.ToLower(parts[1])
+	if strings.Trim(id, "0123456789abcdef") != "" || strings.Trim(id, "0") == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// traced records the caller's trace ID in the request context, so latency
+// metrics can link slow requests to their traces as exemplars.
+func traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			r = r.WithContext(context.WithValue(r.Context(), traceKey{}, id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+var uncacheableRequests = metrics.NewCounter("slmcache_uncacheable_total",
+	"Lookups and writes matching an SLC_UNCACHEABLE rule, by rule and op (lookup, store).", "rule", "op")
+
+// uncacheableRule marks prompts whose answers shouldn't be cached, such as
+// "what time is it". Every condition the rule sets must hold.
+type uncacheableRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern,omitempty"`
+	// Metadata must all equal the entry's metadata, or a lookup's filters.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// MinTokens and MaxTokens bound the prompt's length in words; 0 is
+	// unbounded.
+	MinTokens int `json:"min_tokens,omitempty"`
+	MaxTokens int `json:"max_tokens,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// newUncacheableRules parses SLC_UNCACHEABLE, a JSON array of rules, e.g.
+// [{"name":"clock","pattern":"(?i)\\bwhat time\\b"}]. Rules that don't
+// compile or set no condition are ignored.
+func newUncacheableRules() []uncacheableRule {
+	raw := config.Get("SLC_UNCACHEABLE")
+	if raw == "" {
+		return nil
+	}
+	var rules []uncacheableRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		log.Printf("server: ignoring SLC_UNCACHEABLE: %v", err)
+		return nil
+	}
+	out := rules[:0]
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", i)
+		}
+		if r.Pattern == "" && len(r.Metadata) == 0 && r.MinTokens == 0 && r.MaxTokens == 0 {
+			log.Printf("server: ignoring SLC_UNCACHEABLE rule %q: it sets no condition", r.Name)
+			continue
+		}
+		if r.Pattern != "" {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				log.Printf("server: ignoring SLC_UNCACHEABLE rule %q: %v", r.Name, err)
+				continue
+			}
+			r.re = re
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// matches reports whether the rule covers prompt in namespace ns with
+// metadata values meta.
+func (r uncacheableRule) matches(prompt, ns string, meta func(key string) (string, bool)) bool {
+	if r.re != nil && !r.re.MatchString(prompt) {
+		return false
+	}
+	for k, want := range r.Metadata {
+		if k == models.MetaNamespace {
+			if ns != want {
+				return false
+			}
+			continue
+		}
+		if got, ok := meta(k); !ok || got != want {
+			return false
+		}
+	}
+	if r.MinTokens > 0 || r.MaxTokens > 0 {
+		n := len(strings.Fields(prompt))
+		if n < r.MinTokens || (r.MaxTokens > 0 && n > r.MaxTokens) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) getUncacheable() []uncacheableRule {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.uncacheable
+}
+
+// uncacheableQuery returns the name of the first rule covering q, "learned"
+// when the classifier put its prompt on the deny list, or "".
+func (s *Server) uncacheableQuery(q searchQuery) string {
+	for _, r := range s.getUncacheable() {
+		if r.matches(q.Text, q.namespace(), func(k string) (string, bool) {
+			v, ok := q.Filters[k]
+			return v, ok
+		}) {
+			uncacheableRequests.Inc(r.Name, "lookup")
+			return r.Name
+		}
+	}
+	if s.learnedUncacheable(q.namespace(), q.Text) {
+		uncacheableRequests.Inc("learned", "lookup")
+		return "learned"
+	}
+	return ""
+}
+
+// admitUncacheable refuses e when a rule covers it or the classifier put
+// its prompt on the deny list.
+func (s *Server) admitUncacheable(e *models.Entry) error {
+	for _, r := range s.getUncacheable() {
+		if r.matches(e.Prompt, e.Namespace(), func(k string) (string, bool) {
+			v, ok := e.Metadata[k]
+			return toString(v), ok
+		}) {
+			uncacheableRequests.Inc(r.Name, "store")
+			return fmt.Errorf("prompt matches uncacheable rule %q; not cached", r.Name)
+		}
+	}
+	if s.learnedUncacheable(e.Namespace(), e.Prompt) {
+		uncacheableRequests.Inc("learned", "store")
+		return fmt.Errorf("prompt was classified as volatile; not cached")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// upstreamHeader marks requests made by a sidecar to its central instance so
+// a misconfigured loop (central pointing back at a sidecar) stops after one hop.
+const upstreamHeader = "X-SLMCache-Upstream"
+
+var upstreamClient = &http.Client{Timeout: 2 * time.Second}
+
+// upstreamURL is the central slmcache instance a sidecar reads through to on
+// a local miss (SLC_UPSTREAM_URL). Empty disables read-through.
+func upstreamURL() string {
+	return strings.TrimRight(config.Get("SLC_UPSTREAM_URL"), "/")
+}
+
+// readThrough forwards a missed search to the upstream instance and copies
+// any hits into the local store so the next lookup is served from the
+// sidecar tier.
+func (s *Server) readThrough(ctx context.Context, q searchQuery) []*models.Entry {
+	base := upstreamURL()
+	if base == "" {
+		return nil
+	}
+	found, err := fetchUpstream(ctx, base, q.values(), upstreamHeader)
+	if err != nil {
+		log.Printf("server: upstream search failed: %v", err)
+		return nil
+	}
+	out := make([]*models.Entry, 0, len(found))
+	for _, remote := range found {
+		local := &models.Entry{Prompt: remote.Prompt, Response: remote.Response, Metadata: maps.Clone(remote.Metadata), Provenance: remote.Provenance}
+		vec, err := s.embedEntry(ctx, local, nil, stageInsert)
+		if err != nil {
+			out = append(out, remote)
+			continue
+		}
+		if _, err := s.store.CreateEntryWithVector(ctx, local, vec); err != nil {
+			out = append(out, remote)
+			continue
+		}
+		out = append(out, local)
+	}
+	return out
+}
+
+// fetchUpstream runs a search on another instance, marking the request with
+// hdr so the remote side doesn't forward it again.
+func fetchUpstream(ctx context.Context, base string, query url.Values, hdr string) ([]*models.Entry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/search?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(hdr, "1")
+	setPeerKey(req)
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var out []*models.Entry
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
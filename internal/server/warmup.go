@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/metrics"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+var warmupSeconds = metrics.NewGauge("slmcache_warmup_seconds",
+	"How long the startup warm-up took.")
+
+// startWarmup warms the store and the search path in the background, and
+// keeps /readyz at "warming" until it's done, so a deploy doesn't route
+// traffic to a cold instance. Stores implementing store.Warmer touch their
+// mapped files and index entry points; then up to SLC_WARMUP_QUERIES
+// (default 0) stored entries are searched for, spread over the ID space, to
+// load the embedding model and the index paths real queries take. The pass
+// is bounded by SLC_WARMUP_TIMEOUT (default 1m).
+func (s *Server) startWarmup() {
+	_, warmer := s.backend.(store.Warmer)
+	queries := intFromEnv("SLC_WARMUP_QUERIES", 0)
+	if !warmer && queries <= 0 {
+		return
+	}
+	s.warming.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), durationFromEnv("SLC_WARMUP_TIMEOUT", time.Minute))
+	s.janitorWG.Add(1)
+	go func() {
+		defer s.janitorWG.Done()
+		defer cancel()
+		go func() {
+			select {
+			case <-s.janitorStop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		start := time.Now()
+		n := s.warmup(ctx, queries)
+		s.warming.Store(false)
+		warmupSeconds.Set(time.Since(start).Seconds())
+		log.Printf("server: warmed up in %s (%d queries)", time.Since(start).Round(time.Millisecond), n)
+	}()
+}
+
+// warmup runs the warm-up pass and returns how many queries it searched.
+func (s *Server) warmup(ctx context.Context, queries int) int {
+	if err := store.Warm(ctx, s.backend); err != nil {
+		log.Printf("server: store warm-up failed: %v", err)
+	}
+	if queries <= 0 || !store.Available(s.backend) {
+		return 0
+	}
+	ids := s.backend.AllIDs()
+	if len(ids) == 0 {
+		return 0
+	}
+	vg, _ := s.backend.(store.VectorGetter)
+	step := max(len(ids)/queries, 1)
+	n := 0
+	for i := 0; i < len(ids) && n < queries && ctx.Err() == nil; i += step {
+		var vec []float64
+		if vg != nil {
+			vec, _ = vg.GetVector(ctx, ids[i])
+		}
+		// the first query also loads the embedding model, which remote
+		// backends may have unloaded while idle
+		if vec == nil || n == 0 {
+			e, err := s.backend.GetEntry(ctx, ids[i])
+			if err != nil {
+				continue
+			}
+			if v, err := s.embed(withPriority(ctx, priorityLow), e.Prompt, stageQuery); err == nil && vec == nil {
+				vec = v
+			}
+		}
+		if vec == nil {
+			continue
+		}
+		if _, _, err := s.backend.SearchByVector(ctx, vec, 10); err == nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,77 @@
+package slm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// BatchEmbedder is implemented by backends that can embed several prompts in
+// one call, which bulk ingestion uses to cut per-request overhead.
+type BatchEmbedder interface {
+	EmbedBatch(prompts []string) ([][]float64, error)
+}
+
+// EmbedAll embeds prompts with m, batching when the backend supports it.
+func EmbedAll(m SLM, prompts []string) ([][]float64, error) {
+	if b, ok := m.(BatchEmbedder); ok {
+		return b.EmbedBatch(prompts)
+	}
+	out := make([][]float64, len(prompts))
+	for i, p := range prompts {
+		v, err := m.Embed(p)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (m *mockSLM) EmbedBatch(prompts []string) ([][]float64, error) {
+	out := make([][]float64, len(prompts))
+	for i, p := range prompts {
+		v, _ := m.Embed(p)
+		out[i] = v
+	}
+	return out, nil
+}
+
+type embedBatchResponse struct {
+	Embeddings [][]float64 `json:"embeddings"`
+}
+
+// EmbedBatch uses Ollama's /api/embed, which accepts an input array. Older
+// servers without it fall back to one request per prompt.
+func (o *ollamaSLM) EmbedBatch(prompts []string) ([][]float64, error) {
+	if len(prompts) == 0 {
+		return [][]float64{}, nil
+	}
+	body, _ := json.Marshal(map[string]interface{}{"model": o.model, "input": prompts})
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, o.baseURL+"/api/embed", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err == nil {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		var out embedBatchResponse
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 && json.Unmarshal(data, &out) == nil && len(out.Embeddings) == len(prompts) {
+			return out.Embeddings, nil
+		}
+	}
+	vecs := make([][]float64, len(prompts))
+	for i, p := range prompts {
+		v, err := o.Embed(p)
+		if err != nil {
+			return nil, fmt.Errorf("embed prompt %d: %w", i, err)
+		}
+		vecs[i] = v
+	}
+	return vecs, nil
+}
@@ -0,0 +1,102 @@
+package slm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+)
+
+// Generator produces text with a generative model. Caching itself only
+// needs embeddings; a generator is optional and used to adapt near-miss
+// answers to a new query.
+type Generator interface {
+	Generate(ctx context.Context, prompt string) (*Generation, error)
+}
+
+// Generation is a generated text with the accounting needed to record its
+// provenance.
+type Generation struct {
+	Text             string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// NewGeneratorFromEnv returns an Ollama generator for SLM_GENERATE_MODEL, or
+// nil when no generative model is configured. SLM_GENERATE_URL defaults to
+// SLM_OLLAMA_URL.
+func NewGeneratorFromEnv() Generator {
+	model := config.Get("SLM_GENERATE_MODEL")
+	if model == "" {
+		return nil
+	}
+	baseURL := config.Get("SLM_GENERATE_URL")
+	if baseURL == "" {
+		baseURL = config.Get("SLM_OLLAMA_URL")
+	}
+	if baseURL == "" {
+		baseURL = "http://localhost:11434"
+	}
+	return NewOllamaGenerator(baseURL, model)
+}
+
+type ollamaGenerator struct {
+	baseURL string
+	model   string
+	client  *http.Client
+}
+
+// NewOllamaGenerator returns a Generator backed by Ollama's /api/generate.
+func NewOllamaGenerator(baseURL, model string) Generator {
+	return &ollamaGenerator{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		model:   model,
+		client:  &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+type generateResponse struct {
+	Model           string `json:"model"`
+	Response        string `json:"response"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+}
+
+func (o *ollamaGenerator) Generate(ctx context.Context, prompt string) (*Generation, error) {
+	body, _ := json.Marshal(map[string]interface{}{"model": o.model, "prompt": prompt, "stream": false})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/api/generate", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("ollama generate status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var out generateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	g := &Generation{
+		Text:             strings.TrimSpace(out.Response),
+		Model:            out.Model,
+		PromptTokens:     out.PromptEvalCount,
+		CompletionTokens: out.EvalCount,
+	}
+	if g.Model == "" {
+		g.Model = o.model
+	}
+	return g, nil
+}
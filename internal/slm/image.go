@@ -0,0 +1,134 @@
+package slm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+)
+
+// ImageEmbedder is implemented by backends that embed images with a
+// CLIP-style model, so prompts conditioned on an image can be cached.
+type ImageEmbedder interface {
+	EmbedImage(data []byte) ([]float64, error)
+}
+
+// NewImageEmbedderFromEnv returns an embedder for the service at
+// SLM_IMAGE_URL, asking for SLM_IMAGE_MODEL (default clip), or nil when no
+// image service is configured.
+func NewImageEmbedderFromEnv() ImageEmbedder {
+	url := config.Get("SLM_IMAGE_URL")
+	if url == "" {
+		return nil
+	}
+	model := config.Get("SLM_IMAGE_MODEL")
+	if model == "" {
+		model = "clip"
+	}
+	return NewRemoteImageEmbedder(url, model)
+}
+
+type remoteImageEmbedder struct {
+	url    string
+	model  string
+	client *http.Client
+}
+
+// NewRemoteImageEmbedder returns an ImageEmbedder that posts
+// {"model", "image": <base64>} to url and reads the embedding from an
+// Ollama-style {"embedding"} or {"embeddings"} or an OpenAI-style {"data"}
+// response.
+func NewRemoteImageEmbedder(url, model string) ImageEmbedder {
+	return &remoteImageEmbedder{url: url, model: model, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (r *remoteImageEmbedder) EmbedImage(data []byte) ([]float64, error) {
+	body, _ := json.Marshal(map[string]string{"model": r.model, "image": base64.StdEncoding.EncodeToString(data)})
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		embedErrors.Inc("image")
+		return nil, fmt.Errorf("image embedding failed: %w", err)
+	}
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		embedErrors.Inc("image")
+		return nil, fmt.Errorf("image embedding failed: status %d: %s", resp.StatusCode, out)
+	}
+	var shapes struct {
+		Embedding  []float64       `json:"embedding"`
+		Embeddings [][]float64     `json:"embeddings"`
+		Data       []embedDataItem `json:"data"`
+	}
+	if err := json.Unmarshal(out, &shapes); err == nil {
+		switch {
+		case len(shapes.Embedding) > 0:
+			return shapes.Embedding, nil
+		case len(shapes.Embeddings) > 0:
+			return shapes.Embeddings[0], nil
+		case len(shapes.Data) > 0:
+			return shapes.Data[0].Embedding, nil
+		}
+	}
+	embedErrors.Inc("image")
+	return nil, fmt.Errorf("image embedding failed: unrecognized response shape")
+}
+
+// EmbedImage hashes 16-byte blocks of the image into the mock's dimension:
+// the same image always embeds the same, and images sharing most of their
+// bytes come out close.
+func (m *mockSLM) EmbedImage(data []byte) ([]float64, error) {
+	v := make([]float64, m.dim)
+	for i := 0; i < len(data); i += 16 {
+		h := hashBytes(string(data[i:min(i+16, len(data))]))
+		v[h%uint64(m.dim)] += float64(h%10 + 1)
+	}
+	var norm float64
+	for _, x := range v {
+		norm += x * x
+	}
+	if norm == 0 {
+		return v, nil
+	}
+	norm = math.Sqrt(norm)
+	for i := range v {
+		v[i] /= norm
+	}
+	return v, nil
+}
+
+// CombineImage joins the embeddings of a prompt and of the image it refers
+// to into one vector, weighting the image by weight (0 to 1). Both halves
+// are normalized, so the cosine similarity of two combined vectors is the
+// weighted mean of their prompts' and their images' similarities.
+func CombineImage(text, image []float64, weight float64) []float64 {
+	out := make([]float64, 0, len(text)+len(image))
+	out = appendScaled(out, text, math.Sqrt(1-weight))
+	return appendScaled(out, image, math.Sqrt(weight))
+}
+
+func appendScaled(dst, v []float64, scale float64) []float64 {
+	var norm float64
+	for _, x := range v {
+		norm += x * x
+	}
+	if norm > 0 {
+		scale /= math.Sqrt(norm)
+	}
+	for _, x := range v {
+		dst = append(dst, x*scale)
+	}
+	return dst
+}
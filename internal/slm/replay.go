@@ -0,0 +1,172 @@
+package slm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jeefy/slmcache/internal/config"
+)
+
+// A replay fixture is a JSON Lines file with one recorded embedding per
+// line. Backend and Model describe what produced it, so a replay behaves
+// like that backend (e.g. its default similarity threshold).
+type recording struct {
+	Prompt    string    `json:"prompt"`
+	Backend   string    `json:"backend,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Embedding []float64 `json:"embedding"`
+}
+
+// replaySLM serves embeddings from a fixture. With a recorder set, prompts
+// missing from the fixture are embedded by it and appended to the file;
+// without one they fail, so a test never silently runs on other vectors.
+type replaySLM struct {
+	path     string
+	recorder SLM
+
+	mu        sync.Mutex
+	vecs      map[string][]float64
+	backend   string
+	model     string
+	threshold float64
+}
+
+// NewReplaySLM loads the fixture at path. A non-nil recorder switches to
+// capture mode: missing prompts are embedded by the recorder and appended
+// to the fixture, which is created if needed.
+func NewReplaySLM(path string, recorder SLM) (SLM, error) {
+	r := &replaySLM{path: path, recorder: recorder, vecs: map[string][]float64{}, threshold: 0.75}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && recorder != nil {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var rec recording
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		r.vecs[rec.Prompt] = rec.Embedding
+		if rec.Backend != "" {
+			r.backend, r.model = rec.Backend, rec.Model
+		}
+	}
+	return r, sc.Err()
+}
+
+// replayFromEnv replays SLM_REPLAY_FILE. SLM_REPLAY_MODE=record captures
+// missing prompts from SLM_REPLAY_BACKEND (default ollama).
+func replayFromEnv() SLM {
+	path := config.Get("SLM_REPLAY_FILE")
+	if path == "" {
+		path = "testdata/embeddings.jsonl"
+	}
+	var recorder SLM
+	if strings.ToLower(config.Get("SLM_REPLAY_MODE")) == "record" {
+		name := strings.ToLower(config.Get("SLM_REPLAY_BACKEND"))
+		if name == "" || name == "replay" {
+			name = "ollama"
+		}
+		recorder = newBackend(name)
+	}
+	r, err := NewReplaySLM(path, recorder)
+	if err != nil {
+		// every embed fails, which names the fixture problem in each error
+		log.Printf("slm: replay fixture %s: %v", path, err)
+		return &replaySLM{path: path, vecs: map[string][]float64{}, threshold: 0.75}
+	}
+	return r
+}
+
+func (r *replaySLM) Embed(prompt string) ([]float64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.vecs[prompt]; ok {
+		return append([]float64(nil), v...), nil
+	}
+	if r.recorder == nil {
+		embedErrors.Inc("replay")
+		return nil, fmt.Errorf("replay: no embedding recorded in %s for %q; record it with SLM_REPLAY_MODE=record", r.path, prompt)
+	}
+	v, err := r.recorder.Embed(prompt)
+	if err != nil {
+		return nil, err
+	}
+	rec := recording{Prompt: prompt, Embedding: v}
+	if n, ok := r.recorder.(interface{ BackendName() string }); ok {
+		rec.Backend = n.BackendName()
+	}
+	if n, ok := r.recorder.(interface{ ModelName() string }); ok {
+		rec.Model = n.ModelName()
+	}
+	if err := r.appendLocked(rec); err != nil {
+		return nil, fmt.Errorf("replay: record %q: %w", prompt, err)
+	}
+	r.vecs[prompt] = v
+	r.backend, r.model = rec.Backend, rec.Model
+	return append([]float64(nil), v...), nil
+}
+
+func (r *replaySLM) appendLocked(rec recording) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (r *replaySLM) Decide(prompt string, candidateIDs []int64, candidateEmbeddings [][]float64, candidateScores []float64) (int64, bool, string, error) {
+	bestIdx := -1
+	best := -1.0
+	for i, s := range candidateScores {
+		if s > best {
+			best = s
+			bestIdx = i
+		}
+	}
+	if bestIdx == -1 || best < r.threshold {
+		return 0, false, "no candidate exceeded threshold", nil
+	}
+	return candidateIDs[bestIdx], true, "similarity above threshold (replay)", nil
+}
+
+// BackendName identifies the replay backend.
+func (r *replaySLM) BackendName() string { return "replay" }
+
+// ModelName is the model the fixture was recorded from.
+func (r *replaySLM) ModelName() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.model
+}
+
+// RecordedBackend is the backend the fixture was recorded from, which the
+// replay stands in for.
+func (r *replaySLM) RecordedBackend() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backend
+}
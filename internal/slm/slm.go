@@ -6,13 +6,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"math"
+	"math/rand/v2"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jeefy/slmcache/internal/config"
+	"github.com/jeefy/slmcache/internal/metrics"
 )
 
 // SLM defines the small language model interface used for embedding and decision.
@@ -23,48 +28,78 @@ type SLM interface {
 }
 
 // NewMockSLM returns a deterministic lightweight SLM suitable for tests and local use.
-func NewMockSLM() SLM { return &mockSLM{dim: 64, threshold: 0.75} }
+func NewMockSLM() SLM { return NewMockSLMWithOptions(MockOptions{}) }
 
 const minOllamaEmbeddingsVersion = "0.1.25"
 
+var (
+	embedErrors = metrics.NewCounter("slmcache_embedding_errors_total",
+		"Embedding calls the SLM backend failed, by backend.", "backend")
+	fallbacks = metrics.NewCounter("slmcache_slm_fallbacks_total",
+		"Times the mock backend took over from an unusable Ollama, by the check that failed (model, embed).", "reason")
+	fallbackActive = metrics.NewGauge("slmcache_slm_fallback",
+		"1 while the mock backend stands in for Ollama.")
+)
+
 // NewDefaultSLM returns the default SLM backend. By default it will try to use
 // Ollama (local HTTP API). If Ollama is unreachable or embedding calls fail,
 // it gracefully falls back to the deterministic mock SLM so tests and local
-// runs keep working.
+// runs keep working. SLM_FALLBACK=none keeps Ollama regardless, so embeds
+// fail loudly instead of storing mock vectors that match nothing Ollama
+// embedded. SLM_BACKEND=replay serves embeddings recorded in a file; see
+// NewReplaySLM.
 func NewDefaultSLM() SLM {
-	backend := strings.ToLower(strings.TrimSpace(os.Getenv("SLM_BACKEND")))
+	backend := strings.ToLower(config.Get("SLM_BACKEND"))
 	if backend == "" {
 		backend = "ollama"
 	}
+	fallbackActive.Set(0)
+	return newBackend(backend)
+}
+
+func newBackend(backend string) SLM {
 	switch backend {
 	case "mock":
-		return NewMockSLM()
+		return mockFromEnv()
+	case "replay":
+		return replayFromEnv()
 	case "ollama":
-		require := os.Getenv("SLM_REQUIRE_OLLAMA") == "1"
-		baseURL := strings.TrimSpace(os.Getenv("SLM_OLLAMA_URL"))
+		require := config.Get("SLM_REQUIRE_OLLAMA") == "1"
+		noFallback := strings.ToLower(config.Get("SLM_FALLBACK")) == "none"
+		baseURL := config.Get("SLM_OLLAMA_URL")
 		if baseURL == "" {
 			baseURL = "http://localhost:11434"
 		}
-		model := os.Getenv("SLM_OLLAMA_MODEL")
+		model := config.Get("SLM_OLLAMA_MODEL")
 		if model == "" {
 			model = "nomic-embed-text"
 		}
-		if err := ensureOllamaModel(baseURL, model); err != nil {
+		s := NewOllamaSLM(baseURL, model).(*ollamaSLM)
+		digest, err := ensureOllamaModel(baseURL, model)
+		if err != nil {
 			if require {
 				panic(fmt.Sprintf("ollama model %s required but unavailable: %v", model, err))
 			}
+			if noFallback {
+				log.Printf("slm: ollama model check failed (%v); SLM_FALLBACK=none, keeping ollama", err)
+				return s
+			}
 			log.Printf("slm: ollama model check failed (%v), falling back to mock", err)
-			return NewMockSLM()
+			return fallback("model")
 		}
-		s := NewOllamaSLM(baseURL, model)
+		s.digest = digest
 		// quick sanity embed to ensure Ollama is reachable; if not, handle per requirement flag
 		if _, err := s.Embed("health-check"); err != nil {
 			msg := fmt.Sprintf("ollama embed failed (SLM_OLLAMA_URL=%s): %v", baseURL, err)
 			if require {
 				panic(fmt.Sprintf("ollama backend required but embed failed: %s. Ensure 'ollama serve' is running and reachable at %s", err, baseURL))
 			}
+			if noFallback {
+				log.Printf("slm: %s; SLM_FALLBACK=none, keeping ollama", msg)
+				return s
+			}
 			log.Printf("slm: %s; falling back to mock", msg)
-			return NewMockSLM()
+			return fallback("embed")
 		}
 		return s
 	default:
@@ -72,11 +107,92 @@ func NewDefaultSLM() SLM {
 	}
 }
 
+// fallback returns the mock backend standing in for Ollama, counting why.
+func fallback(reason string) SLM {
+	fallbacks.Inc(reason)
+	fallbackActive.Set(1)
+	m := mockFromEnv()
+	m.fallback = reason
+	return m
+}
+
+// Fallback returns why m is the mock standing in for Ollama ("model" or
+// "embed"), or "" when m is the backend that was asked for.
+func Fallback(m SLM) string {
+	if mock, ok := m.(*mockSLM); ok {
+		return mock.fallback
+	}
+	return ""
+}
+
 // --- mockSLM (existing deterministic implementation) ---
 
+// Mock hashing schemes, which decide how similar two prompts come out.
+const (
+	// HashPosition hashes each word together with its position, so the same
+	// words in another order score lower. The default.
+	HashPosition = "position"
+	// HashBag hashes words regardless of position: word order doesn't matter.
+	HashBag = "bag"
+	// HashTrigram hashes the character trigrams of each word, so typos and
+	// inflections still score high, closer to a real embedding model.
+	HashTrigram = "trigram"
+)
+
+// MockOptions configure the mock backend. The zero value is the default mock.
+type MockOptions struct {
+	// Dim is the vector dimension (default 64).
+	Dim int
+	// Hash is the hashing scheme: HashPosition (default), HashBag or
+	// HashTrigram.
+	Hash string
+	// Noise is the standard deviation of the Gaussian noise added to each
+	// component before normalizing, which spreads the scores of unrelated
+	// prompts like a real model's. The noise is seeded by Seed and the
+	// prompt, so a prompt always embeds to the same vector.
+	Noise float64
+	Seed  uint64
+}
+
 type mockSLM struct {
 	dim       int
 	threshold float64
+	hash      string
+	noise     float64
+	seed      uint64
+	// fallback is why the mock replaced Ollama, if it did
+	fallback string
+}
+
+// NewMockSLMWithOptions returns a mock backend configured by opts.
+func NewMockSLMWithOptions(opts MockOptions) SLM {
+	m := &mockSLM{dim: opts.Dim, threshold: 0.75, hash: opts.Hash, noise: opts.Noise, seed: opts.Seed}
+	if m.dim <= 0 {
+		m.dim = 64
+	}
+	if m.hash == "" {
+		m.hash = HashPosition
+	}
+	return m
+}
+
+// mockFromEnv configures the mock from SLM_MOCK_DIM, SLM_MOCK_HASH,
+// SLM_MOCK_NOISE and SLM_MOCK_SEED.
+func mockFromEnv() *mockSLM {
+	var opts MockOptions
+	opts.Dim, _ = strconv.Atoi(config.Get("SLM_MOCK_DIM"))
+	switch h := strings.ToLower(config.Get("SLM_MOCK_HASH")); h {
+	case HashBag, HashTrigram:
+		opts.Hash = h
+	case "", HashPosition:
+	default:
+		log.Printf("slm: unknown SLM_MOCK_HASH %q, using %s", h, HashPosition)
+	}
+	if v, err := strconv.ParseFloat(config.Get("SLM_MOCK_NOISE"), 64); err == nil && v > 0 {
+		opts.Noise = v
+	}
+	opts.Seed, _ = strconv.ParseUint(config.Get("SLM_MOCK_SEED"), 10, 64)
+	return NewMockSLMWithOptions(opts).(*mockSLM)
 }
 
 // simple deterministic embedding: token hashing into dim-sized vector
@@ -85,16 +201,34 @@ func (m *mockSLM) Embed(prompt string) ([]float64, error) {
 	// lower-case, split tokens
 	toks := strings.Fields(strings.ToLower(prompt))
 	for i, t := range toks {
-		// simple hash: sum of bytes + position
-		h := 0
-		for j := 0; j < len(t); j++ {
-			h = h*31 + int(t[j])
+		switch m.hash {
+		case HashTrigram:
+			// pad so short words and word boundaries have trigrams too
+			w := "#" + t + "#"
+			for j := 0; j+3 <= len(w); j++ {
+				v[hashBytes(w[j:j+3])%uint64(m.dim)]++
+			}
+		case HashBag:
+			h := hashBytes(t)
+			v[h%uint64(m.dim)] += float64(h%10 + 1)
+		default:
+			// simple hash: sum of bytes + position
+			h := 0
+			for j := 0; j < len(t); j++ {
+				h = h*31 + int(t[j])
+			}
+			idx := (i + h) % m.dim
+			if idx < 0 {
+				idx += m.dim
+			}
+			v[idx] += float64(h%10 + 1)
 		}
-		idx := (i + h) % m.dim
-		if idx < 0 {
-			idx += m.dim
+	}
+	if m.noise > 0 {
+		rng := rand.New(rand.NewPCG(m.seed, hashBytes(prompt)))
+		for i := range v {
+			v[i] += m.noise * rng.NormFloat64()
 		}
-		v[idx] += float64(h%10 + 1)
 	}
 	// normalize
 	norm := 0.0
@@ -111,6 +245,13 @@ func (m *mockSLM) Embed(prompt string) ([]float64, error) {
 	return v, nil
 }
 
+// hashBytes is 64-bit FNV-1a.
+func hashBytes(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
 func (m *mockSLM) Decide(prompt string, candidateIDs []int64, candidateEmbeddings [][]float64, candidateScores []float64) (int64, bool, string, error) {
 	// pick highest score and compare to threshold
 	bestIdx := -1
@@ -130,12 +271,18 @@ func (m *mockSLM) Decide(prompt string, candidateIDs []int64, candidateEmbedding
 // BackendName identifies the mock backend.
 func (m *mockSLM) BackendName() string { return "mock" }
 
+// ModelVersion names the hashing scheme and dimension, which decide whether
+// two mock vectors are comparable.
+func (m *mockSLM) ModelVersion() string { return m.hash + "-" + strconv.Itoa(m.dim) }
+
 // --- Ollama-backed SLM ---
 
 type ollamaSLM struct {
 	baseURL string
 	model   string
-	client  *http.Client
+	// digest identifies the model's weights, as reported by /api/tags
+	digest string
+	client *http.Client
 	// threshold used for Decide fallback selection
 	threshold float64
 }
@@ -213,6 +360,7 @@ func (o *ollamaSLM) Embed(prompt string) ([]float64, error) {
 		lastErr = errors.New("unrecognized embedding response shape")
 	}
 	// nothing worked; return error for caller to handle (caller may fallback)
+	embedErrors.Inc("ollama")
 	return nil, fmt.Errorf("ollama embedding failed: %v", lastErr)
 }
 
@@ -235,60 +383,77 @@ func (o *ollamaSLM) Decide(prompt string, candidateIDs []int64, candidateEmbeddi
 // BackendName identifies the ollama backend.
 func (o *ollamaSLM) BackendName() string { return "ollama" }
 
+// ModelName is the Ollama model embeddings are requested from.
+func (o *ollamaSLM) ModelName() string { return o.model }
+
+// ModelVersion is the digest of the model, which changes when a tag is
+// re-pulled with new weights; "" when Ollama didn't report one.
+func (o *ollamaSLM) ModelVersion() string { return o.digest }
+
 type ollamaTagsResponse struct {
 	Models []struct {
-		Name  string `json:"name"`
-		Model string `json:"model"`
+		Name   string `json:"name"`
+		Model  string `json:"model"`
+		Digest string `json:"digest"`
 	} `json:"models"`
 }
 
-func ensureOllamaModel(baseURL, model string) error {
+// ensureOllamaModel checks that Ollama can embed with model, pulling it when
+// missing, and returns the model's digest.
+func ensureOllamaModel(baseURL, model string) (string, error) {
 	trimmed := strings.TrimRight(baseURL, "/")
 	if trimmed == "" {
 		trimmed = baseURL
 	}
 	if model == "" {
-		return errors.New("missing model name")
+		return "", errors.New("missing model name")
 	}
 	if err := ensureOllamaSupportsEmbeddings(trimmed); err != nil {
-		return err
+		return "", err
 	}
-	exists, err := ollamaModelExists(trimmed, model)
+	digest, exists, err := ollamaModelDigest(trimmed, model)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if exists {
-		return nil
+		return digest, nil
+	}
+	if err := pullOllamaModel(trimmed, model); err != nil {
+		return "", err
 	}
-	return pullOllamaModel(trimmed, model)
+	// the digest of a fresh pull is only known once it's listed
+	digest, _, _ = ollamaModelDigest(trimmed, model)
+	return digest, nil
 }
 
-func ollamaModelExists(baseURL, model string) (bool, error) {
+// ollamaModelDigest looks model up among the models Ollama has and returns
+// its digest.
+func ollamaModelDigest(baseURL, model string) (string, bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/api/tags", nil)
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(resp.Body)
-		return false, fmt.Errorf("ollama tags status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		return "", false, fmt.Errorf("ollama tags status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
 	}
 	var tags ollamaTagsResponse
 	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
-		return false, err
+		return "", false, err
 	}
 	for _, m := range tags.Models {
 		if modelMatches(m.Name, model) || modelMatches(m.Model, model) {
-			return true, nil
+			return m.Digest, true, nil
 		}
 	}
-	return false, nil
+	return "", false, nil
 }
 
 func pullOllamaModel(baseURL, model string) error {
@@ -1,9 +1,14 @@
 package slm
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync/atomic"
 	"testing"
 )
@@ -18,8 +23,9 @@ func TestEnsureOllamaModelTriggersPull(t *testing.T) {
 		case "/api/tags":
 			w.Header().Set("Content-Type", "application/json")
 			_ = json.NewEncoder(w).Encode(ollamaTagsResponse{Models: []struct {
-				Name  string `json:"name"`
-				Model string `json:"model"`
+				Name   string `json:"name"`
+				Model  string `json:"model"`
+				Digest string `json:"digest"`
 			}{{Name: "other-model"}}})
 		case "/api/pull":
 			atomic.AddInt32(&pulled, 1)
@@ -31,7 +37,7 @@ func TestEnsureOllamaModelTriggersPull(t *testing.T) {
 		}
 	}))
 	defer srv.Close()
-	if err := ensureOllamaModel(srv.URL, "nomic-embed-text"); err != nil {
+	if _, err := ensureOllamaModel(srv.URL, "nomic-embed-text"); err != nil {
 		t.Fatalf("ensure model failed: %v", err)
 	}
 	if atomic.LoadInt32(&pulled) != 1 {
@@ -49,9 +55,10 @@ func TestEnsureOllamaModelSkipsPullWhenPresent(t *testing.T) {
 		case "/api/tags":
 			w.Header().Set("Content-Type", "application/json")
 			_ = json.NewEncoder(w).Encode(ollamaTagsResponse{Models: []struct {
-				Name  string `json:"name"`
-				Model string `json:"model"`
-			}{{Name: "nomic-embed-text"}}})
+				Name   string `json:"name"`
+				Model  string `json:"model"`
+				Digest string `json:"digest"`
+			}{{Name: "nomic-embed-text", Digest: "0a109f422b47"}}})
 		case "/api/pull":
 			atomic.AddInt32(&pulled, 1)
 			w.WriteHeader(http.StatusOK)
@@ -60,9 +67,13 @@ func TestEnsureOllamaModelSkipsPullWhenPresent(t *testing.T) {
 		}
 	}))
 	defer srv.Close()
-	if err := ensureOllamaModel(srv.URL, "nomic-embed-text"); err != nil {
+	digest, err := ensureOllamaModel(srv.URL, "nomic-embed-text")
+	if err != nil {
 		t.Fatalf("ensure model failed: %v", err)
 	}
+	if digest != "0a109f422b47" {
+		t.Fatalf("expected the model's digest got %q", digest)
+	}
 	if atomic.LoadInt32(&pulled) != 0 {
 		t.Fatalf("expected no pull when model already present")
 	}
@@ -90,3 +101,170 @@ func TestCompareSemver(t *testing.T) {
 		t.Fatalf("expected equal versions with leading v")
 	}
 }
+
+func TestOllamaGenerator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/api/generate" || req["model"] != "llama3.2" || req["stream"] != false {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"response": "  adapted answer\n", "prompt_eval_count": 12, "eval_count": 5})
+	}))
+	defer srv.Close()
+	out, err := NewOllamaGenerator(srv.URL, "llama3.2").Generate(context.Background(), "hi")
+	if err != nil || out.Text != "adapted answer" {
+		t.Fatalf("expected adapted answer got %+v err=%v", out, err)
+	}
+	if out.Model != "llama3.2" || out.PromptTokens != 12 || out.CompletionTokens != 5 {
+		t.Fatalf("expected model and token counts, got %+v", out)
+	}
+}
+
+func TestDefaultSLMFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	t.Setenv("SLM_BACKEND", "ollama")
+	t.Setenv("SLM_OLLAMA_URL", srv.URL)
+
+	before := fallbacks.Value("model")
+	if n := NewDefaultSLM().(interface{ BackendName() string }).BackendName(); n != "mock" {
+		t.Fatalf("expected the mock fallback got %s", n)
+	}
+	if fallbacks.Value("model")-before != 1 || fallbackActive.Value() != 1 {
+		t.Fatalf("expected the fallback counted and flagged got %v and %v", fallbacks.Value("model")-before, fallbackActive.Value())
+	}
+
+	t.Setenv("SLM_FALLBACK", "none")
+	m := NewDefaultSLM()
+	if n := m.(interface{ BackendName() string }).BackendName(); n != "ollama" || fallbackActive.Value() != 0 {
+		t.Fatalf("expected ollama kept with SLM_FALLBACK=none got %s (fallback %v)", n, fallbackActive.Value())
+	}
+	errs := embedErrors.Value("ollama")
+	if _, err := m.Embed("hello"); err == nil {
+		t.Fatalf("expected the embed to fail")
+	}
+	if embedErrors.Value("ollama")-errs != 1 {
+		t.Fatalf("expected the failed embed counted got %v", embedErrors.Value("ollama")-errs)
+	}
+}
+
+func TestMockOptions(t *testing.T) {
+	cos := func(m SLM, a, b string) float64 {
+		va, _ := m.Embed(a)
+		vb, _ := m.Embed(b)
+		var dot float64
+		for i := range va {
+			dot += va[i] * vb[i]
+		}
+		return dot
+	}
+	if v, _ := NewMockSLMWithOptions(MockOptions{Dim: 384}).Embed("hello"); len(v) != 384 {
+		t.Fatalf("expected 384 dimensions got %d", len(v))
+	}
+	bag := NewMockSLMWithOptions(MockOptions{Hash: HashBag})
+	if s := cos(bag, "deploy the pods", "pods the deploy"); s < 0.999 {
+		t.Fatalf("expected word order ignored by the bag hash got %.3f", s)
+	}
+	tri := NewMockSLMWithOptions(MockOptions{Hash: HashTrigram, Dim: 256})
+	if typo, words := cos(tri, "kubernetes", "kubernetse"), cos(bag, "kubernetes", "kubernetse"); typo <= words || typo < 0.5 {
+		t.Fatalf("expected the trigram hash to tolerate typos got %.3f (bag %.3f)", typo, words)
+	}
+
+	noisy := NewMockSLMWithOptions(MockOptions{Noise: 0.2, Seed: 7})
+	if s := cos(noisy, "hello world", "hello world"); s < 0.999 {
+		t.Fatalf("expected a prompt to embed the same every time got %.3f", s)
+	}
+	if s := cos(noisy, "hello world", "goodbye moon"); s == cos(NewMockSLM(), "hello world", "goodbye moon") {
+		t.Fatalf("expected the noise to move scores")
+	}
+	other := NewMockSLMWithOptions(MockOptions{Noise: 0.2, Seed: 8})
+	a, _ := noisy.Embed("hello world")
+	b, _ := other.Embed("hello world")
+	if a[0] == b[0] {
+		t.Fatalf("expected another seed to give other noise")
+	}
+
+	t.Setenv("SLM_BACKEND", "mock")
+	t.Setenv("SLM_MOCK_DIM", "16")
+	if v, _ := NewDefaultSLM().Embed("hello"); len(v) != 16 {
+		t.Fatalf("expected SLM_MOCK_DIM to apply got %d", len(v))
+	}
+}
+
+func TestReplaySLM(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "embeddings.jsonl")
+	rec, err := NewReplaySLM(path, NewMockSLM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := rec.Embed("how do I deploy pods")
+	if _, err := rec.Embed("how do I deploy pods"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SLM_BACKEND", "replay")
+	t.Setenv("SLM_REPLAY_FILE", path)
+	m := NewDefaultSLM()
+	got, err := m.Embed("how do I deploy pods")
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the recorded vector got %v err=%v", got, err)
+	}
+	if b := m.(*replaySLM).RecordedBackend(); b != "mock" {
+		t.Fatalf("expected the recording backend noted got %q", b)
+	}
+	if _, err := m.Embed("never recorded"); err == nil || !strings.Contains(err.Error(), "SLM_REPLAY_MODE=record") {
+		t.Fatalf("expected a miss to fail got %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 1 {
+		t.Fatalf("expected one recorded line got %d", n)
+	}
+}
+
+func TestImageEmbedding(t *testing.T) {
+	dot := func(a, b []float64) float64 {
+		var d float64
+		for i := range a {
+			d += a[i] * b[i]
+		}
+		return d
+	}
+	m := NewMockSLM().(ImageEmbedder)
+	img := []byte(strings.Repeat("\x89PNG pixels and more pixels ", 20))
+	a, _ := m.EmbedImage(img)
+	b, _ := m.EmbedImage(img)
+	if s := dot(a, b); s < 0.999 {
+		t.Fatalf("expected an image to embed the same every time got %.3f", s)
+	}
+	other, _ := m.EmbedImage([]byte(strings.Repeat("GIF89a other bytes entirely ", 20)))
+	if s := dot(a, other); s > 0.5 {
+		t.Fatalf("expected different images apart got %.3f", s)
+	}
+
+	// the combined similarity is the weighted mean of both
+	t1, t2 := []float64{1, 0}, []float64{0.6, 0.8}
+	i1, i2 := []float64{0, 2}, []float64{0, 1}
+	got := dot(CombineImage(t1, i1, 0.25), CombineImage(t2, i2, 0.25))
+	if want := 0.75*0.6 + 0.25*1; got < want-1e-9 || got > want+1e-9 {
+		t.Fatalf("expected %.3f got %.3f", want, got)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req["model"] != "clip" || req["image"] == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string][][]float64{"embeddings": {{0.5, 0.5}}})
+	}))
+	defer srv.Close()
+	t.Setenv("SLM_IMAGE_URL", srv.URL)
+	if v, err := NewImageEmbedderFromEnv().EmbedImage(img); err != nil || !reflect.DeepEqual(v, []float64{0.5, 0.5}) {
+		t.Fatalf("expected the remote embedding got %v (%v)", v, err)
+	}
+}
@@ -9,13 +9,19 @@ import (
 
 // ExternalVectorDB is an adapter skeleton for a production vector database.
 // It's a minimal example showing how to satisfy the Store interface. Fill in
-// the TODOs with real client code (Milvus, Faiss, Pinecone, etc.).
+// the TODOs with real client code (Faiss, Pinecone, etc.); the postgres, milvus
+// and redis packages are complete adapters to start from.
 type ExternalVectorDB struct {
 	// add client fields here, e.g. HTTP client or SDK handle
 }
 
 // NewExternalVectorDB constructs a new ExternalVectorDB adapter. Replace the
-// connection params with whatever your backend needs.
+// connection params with whatever your backend needs. To start before the
+// database is reachable, and reconnect after outages, wrap it:
+//
+//	st := NewLazy(func(ctx context.Context) (Store, error) {
+//		return NewExternalVectorDB(conn)
+//	}, LazyOptions{})
 func NewExternalVectorDB(conn string) (Store, error) {
 	_ = conn
 	// TODO: initialize client and return adapter
@@ -66,3 +72,19 @@ func (e *ExternalVectorDB) FindEntriesByMetadata(ctx context.Context, filters ma
 	// TODO: run metadata-only query in backend store
 	return nil, errors.New("not implemented: FindEntriesByMetadata")
 }
+
+func (e *ExternalVectorDB) Health(ctx context.Context) error {
+	// TODO: ping the backend, e.g. a cheap status or count request
+	return errors.New("not implemented: Health")
+}
+
+func (e *ExternalVectorDB) Capabilities() Capabilities {
+	// TODO: report what the backend supports
+	return Capabilities{}
+}
+
+func (e *ExternalVectorDB) Warm(ctx context.Context) error {
+	// Optional: touch memory-mapped files or load index entry points so the
+	// first searches are fast; remove the method if there's nothing to warm
+	return nil
+}
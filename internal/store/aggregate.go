@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// Aggregator is implemented by stores that can count entries without
+// returning them. Use Aggregate to get one for any Store.
+type Aggregator interface {
+	// CountEntries counts the entries matching filters.
+	CountEntries(ctx context.Context, filters map[string]string) (int, error)
+	// CountByMetadata counts the entries matching filters per value of the
+	// metadata key; entries without it are counted under "".
+	CountByMetadata(ctx context.Context, key string, filters map[string]string) (map[string]int, error)
+	// CountByDay counts the entries matching filters per UTC creation day
+	// (YYYY-MM-DD).
+	CountByDay(ctx context.Context, filters map[string]string) (map[string]int, error)
+}
+
+// Aggregate returns st's own Aggregator, or one that scans
+// FindEntriesByMetadata for stores without aggregation support.
+func Aggregate(st Store) Aggregator {
+	if a, ok := st.(Aggregator); ok {
+		return a
+	}
+	return scanAggregator{st}
+}
+
+type scanAggregator struct{ st Store }
+
+func (a scanAggregator) CountEntries(ctx context.Context, filters map[string]string) (int, error) {
+	entries, err := a.st.FindEntriesByMetadata(ctx, filters)
+	return len(entries), err
+}
+
+func (a scanAggregator) CountByMetadata(ctx context.Context, key string, filters map[string]string) (map[string]int, error) {
+	entries, err := a.st.FindEntriesByMetadata(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]int{}
+	for _, e := range entries {
+		out[metadataBucket(e, key)]++
+	}
+	return out, nil
+}
+
+func (a scanAggregator) CountByDay(ctx context.Context, filters map[string]string) (map[string]int, error) {
+	entries, err := a.st.FindEntriesByMetadata(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]int{}
+	for _, e := range entries {
+		out[dayBucket(e.CreatedAt)]++
+	}
+	return out, nil
+}
+
+func metadataBucket(e *models.Entry, key string) string {
+	v, ok := e.Metadata[key]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func dayBucket(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// matchingLocked calls fn for every entry matching filters, using the
+// metadata index when there are filters. Callers must hold s.mu.
+func (s *inMemoryStore) matchingLocked(filters map[string]string, fn func(*models.Entry)) {
+	if len(filters) == 0 {
+		for _, e := range s.entries {
+			fn(e)
+		}
+		return
+	}
+	for _, id := range s.index.candidates(filters) {
+		if e, ok := s.entries[id]; ok && matchesMetadata(e, filters) {
+			fn(e)
+		}
+	}
+}
+
+func (s *inMemoryStore) CountEntries(ctx context.Context, filters map[string]string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	s.matchingLocked(filters, func(*models.Entry) { n++ })
+	return n, nil
+}
+
+func (s *inMemoryStore) CountByMetadata(ctx context.Context, key string, filters map[string]string) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := map[string]int{}
+	s.matchingLocked(filters, func(e *models.Entry) { out[metadataBucket(e, key)]++ })
+	return out, nil
+}
+
+func (s *inMemoryStore) CountByDay(ctx context.Context, filters map[string]string) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := map[string]int{}
+	s.matchingLocked(filters, func(e *models.Entry) { out[dayBucket(e.CreatedAt)]++ })
+	return out, nil
+}
@@ -0,0 +1,113 @@
+package store
+
+import "slices"
+
+// Slab sizes of the vector arena, in float64s: slabs start small so empty
+// stores stay cheap, and double up to 1M floats (8 MiB).
+const (
+	minSlab = 1 << 12
+	maxSlab = 1 << 20
+)
+
+// vectorArena packs the stored vectors into a few large slabs, addressed
+// by position. A slice per vector would give the garbage collector one
+// object to track per entry; the positions here hold offsets only, so the
+// collector sees a handful of pointer-free slabs however many entries are
+// stored, and the vectors don't fragment the heap.
+type vectorArena struct {
+	slabs [][]float64
+	refs  []vecRef
+	// used is how much of the last slab is taken.
+	used int
+	// garbage counts the floats of deleted or resized vectors, reclaimed
+	// by compact.
+	garbage int
+	live    int
+}
+
+// vecRef locates a vector: n floats at off in slab.
+type vecRef struct {
+	slab, off, n int32
+}
+
+// newVectorArena returns an arena with room for n vectors of floats
+// floats in all.
+func newVectorArena(n, floats int) vectorArena {
+	return vectorArena{refs: make([]vecRef, 0, n), slabs: [][]float64{make([]float64, max(floats, minSlab))}}
+}
+
+func (a *vectorArena) len() int { return len(a.refs) }
+
+// at returns the vector at position i. It aliases the arena, so callers
+// must copy it before releasing the store's lock.
+func (a *vectorArena) at(i int) []float64 {
+	r := a.refs[i]
+	return a.slabs[r.slab][r.off : r.off+r.n : r.off+r.n]
+}
+
+// view returns a copy of the arena that keeps reading the vectors as they
+// are now. Slabs are only ever written past what is in use, and compaction
+// moves vectors into new slabs, so the view needs no lock.
+func (a *vectorArena) view() vectorArena {
+	v := *a
+	v.slabs = slices.Clone(a.slabs)
+	v.refs = slices.Clone(a.refs)
+	return v
+}
+
+// add appends a copy of vec as the last position.
+func (a *vectorArena) add(vec []float64) {
+	a.refs = append(a.refs, a.place(vec))
+}
+
+// set replaces the vector at position i with a copy of vec. The old one is
+// left where it is, for views taken before.
+func (a *vectorArena) set(i int, vec []float64) {
+	a.drop(a.refs[i])
+	a.refs[i] = a.place(vec)
+	a.maybeCompact()
+}
+
+// remove deletes position i, shifting the later positions down by one.
+func (a *vectorArena) remove(i int) {
+	a.drop(a.refs[i])
+	a.refs = slices.Delete(a.refs, i, i+1)
+	a.maybeCompact()
+}
+
+// place copies vec into the arena, starting a new slab when the last one
+// is full.
+func (a *vectorArena) place(vec []float64) vecRef {
+	n := len(vec)
+	if len(a.slabs) == 0 || a.used+n > len(a.slabs[len(a.slabs)-1]) {
+		size := minSlab
+		if len(a.slabs) > 0 {
+			size = min(2*len(a.slabs[len(a.slabs)-1]), maxSlab)
+		}
+		a.slabs = append(a.slabs, make([]float64, max(size, n)))
+		a.used = 0
+	}
+	r := vecRef{slab: int32(len(a.slabs) - 1), off: int32(a.used), n: int32(n)}
+	copy(a.slabs[r.slab][a.used:], vec)
+	a.used += n
+	a.live += n
+	return r
+}
+
+func (a *vectorArena) drop(r vecRef) {
+	a.garbage += int(r.n)
+	a.live -= int(r.n)
+}
+
+// maybeCompact rewrites the live vectors into fresh slabs once deleted
+// ones take more room than they do.
+func (a *vectorArena) maybeCompact() {
+	if a.garbage < minSlab || a.garbage < a.live {
+		return
+	}
+	old := *a
+	*a = newVectorArena(len(old.refs), old.live)
+	for i := range old.refs {
+		a.add(old.at(i))
+	}
+}
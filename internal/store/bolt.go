@@ -0,0 +1,348 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// Buckets of the BoltDB file. Entries and vectors are keyed by the entry's
+// big-endian ID, so they load back in ID order.
+var (
+	bucketEntries = []byte("entries")
+	bucketVectors = []byte("vectors")
+	// bucketState holds the next ID and everything else a snapshot has.
+	bucketState = []byte("state")
+
+	keyNextID = []byte("next_id")
+	keyState  = []byte("state")
+)
+
+// boltState is the part of a snapshot kept under keyState.
+type boltState struct {
+	Synonyms   map[string]map[string]string `json:"synonyms,omitempty"`
+	Namespaces []models.Namespace           `json:"namespaces,omitempty"`
+	Outbox     []OutboxMessage              `json:"outbox,omitempty"`
+}
+
+// boltStore is the in-memory store with every write also kept in a BoltDB
+// file, which is loaded back on open, so the cache survives restarts.
+// Reads and searches are served from memory as before; the file only
+// costs writes a transaction each.
+type boltStore struct {
+	*inMemoryStore
+	db *bolt.DB
+	// mu serializes writes, so the file takes them in the order memory did.
+	mu sync.Mutex
+	// evicted collects the entries the write in progress evicted to fit
+	// the limits. Guarded by mu.
+	evicted []int64
+}
+
+// OpenBolt opens, or creates, the BoltDB file at path and returns a store
+// holding its contents, bounded by opts like NewWithOptions. The file is
+// locked while the store is open, so only one process can use it; Close
+// releases it.
+func OpenBolt(path string, opts Options) (Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("store: open %s: %w", path, err)
+	}
+	mem, _ := NewWithOptions(opts)
+	s := &boltStore{inMemoryStore: mem.(*inMemoryStore), db: db}
+	s.onEvict = func(id int64) { s.evicted = append(s.evicted, id) }
+	snap, err := s.load()
+	if err == nil {
+		err = s.inMemoryStore.Restore(context.Background(), snap)
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("store: load %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *boltStore) Close() error { return s.db.Close() }
+
+// load reads the whole file into a snapshot.
+func (s *boltStore) load() (*Snapshot, error) {
+	snap := &Snapshot{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketEntries, bucketVectors, bucketState} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		vectors := tx.Bucket(bucketVectors)
+		err := tx.Bucket(bucketEntries).ForEach(func(k, v []byte) error {
+			var e models.Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("entry %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			snap.Entries = append(snap.Entries, SnapshotEntry{Entry: &e, Vector: decodeVector(vectors.Get(k))})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		state := tx.Bucket(bucketState)
+		if v := state.Get(keyNextID); len(v) == 8 {
+			snap.NextID = int64(binary.BigEndian.Uint64(v))
+		}
+		if v := state.Get(keyState); v != nil {
+			var st boltState
+			if err := json.Unmarshal(v, &st); err != nil {
+				return err
+			}
+			snap.Synonyms, snap.Namespaces, snap.Outbox = st.Synonyms, st.Namespaces, st.Outbox
+		}
+		return nil
+	})
+	return snap, err
+}
+
+// persist writes entries ids, and the ones the write evicted, to the file
+// as memory has them now, deleting those memory no longer holds. Callers
+// must hold s.mu.
+func (s *boltStore) persist(ids ...int64) error {
+	ids = append(ids, s.evicted...)
+	s.evicted = s.evicted[:0]
+	type record struct {
+		id    int64
+		entry []byte
+		vec   []byte
+	}
+	records := make([]record, 0, len(ids))
+	s.inMemoryStore.mu.RLock()
+	nextID := s.nextID
+	for _, id := range ids {
+		r := record{id: id}
+		if _, ok := s.entries[id]; ok {
+			e, err := s.loadLocked(id)
+			if err != nil {
+				s.inMemoryStore.mu.RUnlock()
+				return err
+			}
+			r.entry, _ = json.Marshal(e)
+			r.vec = encodeVector(s.vectors.at(s.pos[id]))
+		}
+		records = append(records, r)
+	}
+	s.inMemoryStore.mu.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entries, vectors := tx.Bucket(bucketEntries), tx.Bucket(bucketVectors)
+		for _, r := range records {
+			key := idKey(r.id)
+			if r.entry == nil {
+				if err := entries.Delete(key); err != nil {
+					return err
+				}
+				if err := vectors.Delete(key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := entries.Put(key, r.entry); err != nil {
+				return err
+			}
+			if err := vectors.Put(key, r.vec); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketState).Put(keyNextID, idKey(nextID))
+	})
+}
+
+// persistState writes the synonyms, namespaces and outbox to the file.
+// Callers must hold s.mu.
+func (s *boltStore) persistState() error {
+	s.inMemoryStore.mu.RLock()
+	st := boltState{Synonyms: s.synonyms, Namespaces: sortedNamespaces(s.namespaces), Outbox: s.outbox}
+	data, err := json.Marshal(st)
+	s.inMemoryStore.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketState).Put(keyState, data)
+	})
+}
+
+func (s *boltStore) CreateEntryWithVector(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := s.inMemoryStore.CreateEntryWithVector(ctx, e, vec)
+	if err != nil {
+		return 0, err
+	}
+	return id, s.persist(id)
+}
+
+func (s *boltStore) UpdateEntryWithVector(ctx context.Context, id int64, e *models.Entry, vec []float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.UpdateEntryWithVector(ctx, id, e, vec); err != nil {
+		return err
+	}
+	return s.persist(id)
+}
+
+func (s *boltStore) DeleteEntry(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.DeleteEntry(ctx, id); err != nil {
+		return err
+	}
+	return s.persist(id)
+}
+
+func (s *boltStore) UpdateEntryMetadata(ctx context.Context, id int64, metadata map[string]interface{}, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.UpdateEntryMetadata(ctx, id, metadata, replace); err != nil {
+		return err
+	}
+	return s.persist(id)
+}
+
+func (s *boltStore) DeleteEntryMetadata(ctx context.Context, id int64, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.DeleteEntryMetadata(ctx, id, keys...); err != nil {
+		return err
+	}
+	return s.persist(id)
+}
+
+func (s *boltStore) UpdateMetadataWhere(ctx context.Context, filters map[string]string, metadata map[string]interface{}) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.inMemoryStore.UpdateMetadataWhere(ctx, filters, metadata)
+	if err != nil {
+		return ids, err
+	}
+	return ids, s.persist(ids...)
+}
+
+func (s *boltStore) ConsumeServe(ctx context.Context, id int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	left, err := s.inMemoryStore.ConsumeServe(ctx, id)
+	if err != nil || left < 0 {
+		return left, err
+	}
+	return left, s.persist(id)
+}
+
+func (s *boltStore) RecordHits(ctx context.Context, hits map[int64]Hits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.RecordHits(ctx, hits); err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(hits))
+	for id := range hits {
+		ids = append(ids, id)
+	}
+	return s.persist(ids...)
+}
+
+func (s *boltStore) PutNamespace(ctx context.Context, ns models.Namespace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.PutNamespace(ctx, ns); err != nil {
+		return err
+	}
+	return s.persistState()
+}
+
+func (s *boltStore) DeleteNamespace(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.DeleteNamespace(ctx, name); err != nil {
+		return err
+	}
+	return s.persistState()
+}
+
+func (s *boltStore) SetSynonyms(ctx context.Context, namespace string, synonyms map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.SetSynonyms(ctx, namespace, synonyms); err != nil {
+		return err
+	}
+	return s.persistState()
+}
+
+func (s *boltStore) AppendOutbox(ctx context.Context, msgs []OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.AppendOutbox(ctx, msgs); err != nil {
+		return err
+	}
+	return s.persistState()
+}
+
+func (s *boltStore) AckOutbox(ctx context.Context, seqs ...uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.AckOutbox(ctx, seqs...); err != nil {
+		return err
+	}
+	return s.persistState()
+}
+
+// Restore replaces the file's contents along with memory's.
+func (s *boltStore) Restore(ctx context.Context, snap *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inMemoryStore.Restore(ctx, snap); err != nil {
+		return err
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketEntries, bucketVectors} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.persist(s.inMemoryStore.AllIDs()...); err != nil {
+		return err
+	}
+	return s.persistState()
+}
+
+func idKey(id int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+func encodeVector(vec []float64) []byte {
+	out := make([]byte, 0, 8*len(vec))
+	for _, f := range vec {
+		out = binary.LittleEndian.AppendUint64(out, math.Float64bits(f))
+	}
+	return out
+}
+
+func decodeVector(b []byte) []float64 {
+	out := make([]float64, len(b)/8)
+	for i := range out {
+		out[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	return out
+}
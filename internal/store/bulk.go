@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// BulkUpdater is implemented by stores that can patch the metadata of many
+// entries in one operation. Use BulkUpdate to get one for any Store.
+type BulkUpdater interface {
+	// UpdateMetadataWhere merges metadata into the metadata of every entry
+	// matching filters and returns the IDs it changed. Archived entries are
+	// left alone, since they can't be edited. On error the IDs changed so
+	// far are returned with it.
+	UpdateMetadataWhere(ctx context.Context, filters map[string]string, metadata map[string]interface{}) ([]int64, error)
+}
+
+// BulkUpdate returns st's own BulkUpdater, or one that patches the entries
+// FindEntriesByMetadata returns one at a time for stores without bulk
+// support.
+func BulkUpdate(st Store) BulkUpdater {
+	if b, ok := st.(BulkUpdater); ok {
+		return b
+	}
+	return scanUpdater{st}
+}
+
+type scanUpdater struct{ st Store }
+
+func (u scanUpdater) UpdateMetadataWhere(ctx context.Context, filters map[string]string, metadata map[string]interface{}) ([]int64, error) {
+	entries, err := u.st.FindEntriesByMetadata(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, e := range entries {
+		if e.State() == models.StateArchived {
+			continue
+		}
+		if err := u.st.UpdateEntryMetadata(ctx, e.ID, metadata, false); err != nil {
+			return ids, err
+		}
+		ids = append(ids, e.ID)
+	}
+	return ids, nil
+}
+
+func (s *inMemoryStore) UpdateMetadataWhere(ctx context.Context, filters map[string]string, metadata map[string]interface{}) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []int64
+	s.matchingLocked(filters, func(e *models.Entry) {
+		if e.State() != models.StateArchived {
+			ids = append(ids, e.ID)
+		}
+	})
+	now := time.Now().UTC()
+	for _, id := range ids {
+		entry := s.entries[id]
+		updated := cloneEntry(entry)
+		if updated.Metadata == nil {
+			updated.Metadata = make(map[string]interface{}, len(metadata))
+		}
+		for k, v := range metadata {
+			updated.Metadata[k] = v
+		}
+		updated.UpdatedAt = now
+		s.index.remove(id, entry.Metadata)
+		s.entries[id] = updated
+		s.index.add(id, updated.Metadata)
+	}
+	return ids, nil
+}
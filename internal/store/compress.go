@@ -0,0 +1,106 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// CompressionStats describes the responses a store keeps compressed.
+type CompressionStats struct {
+	// Entries is how many responses are stored compressed.
+	Entries int `json:"entries"`
+	// RawBytes and StoredBytes are their sizes before and after
+	// compression.
+	RawBytes    int64 `json:"raw_bytes"`
+	StoredBytes int64 `json:"stored_bytes"`
+}
+
+// CompressionReporter is implemented by stores that compress responses at
+// rest.
+type CompressionReporter interface {
+	CompressionStats() CompressionStats
+}
+
+// packedResponse is a response compressed at rest.
+type packedResponse struct {
+	data []byte
+	raw  int
+}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// codecs returns the shared zstd encoder and decoder; EncodeAll and
+// DecodeAll are safe for concurrent use.
+func codecs() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEnc, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		zstdDec, _ = zstd.NewReader(nil)
+	})
+	return zstdEnc, zstdDec
+}
+
+// putLocked stores a copy of e under id, compressing its response when it
+// is at least Options.CompressAbove bytes and compresses to less, and
+// tracks the stored size. Callers must hold s.mu.
+func (s *inMemoryStore) putLocked(id int64, e *models.Entry, vec []float64) {
+	stored := cloneEntry(e)
+	s.unpackLocked(id)
+	var extra int64
+	if n := s.opts.CompressAbove; n > 0 && len(e.Response) >= n {
+		enc, _ := codecs()
+		if data := enc.EncodeAll([]byte(e.Response), nil); len(data) < len(e.Response) {
+			s.packed[id] = packedResponse{data: data, raw: len(e.Response)}
+			s.packedRaw += int64(len(e.Response))
+			s.packedBytes += int64(len(data))
+			stored.Response = ""
+			extra = int64(len(data))
+		}
+	}
+	s.entries[id] = stored
+	s.track(id, entrySize(stored, vec)+extra)
+}
+
+// unpackLocked forgets the compressed response of id. Callers must hold
+// s.mu.
+func (s *inMemoryStore) unpackLocked(id int64) {
+	if p, ok := s.packed[id]; ok {
+		s.packedRaw -= int64(p.raw)
+		s.packedBytes -= int64(len(p.data))
+		delete(s.packed, id)
+	}
+}
+
+// loadLocked returns a copy of the entry stored under id with its response
+// decompressed. Callers must hold s.mu for reading.
+func (s *inMemoryStore) loadLocked(id int64) (*models.Entry, error) {
+	p, ok := s.packed[id]
+	return loadEntry(s.entries[id], p, ok)
+}
+
+// loadEntry returns a copy of stored with its response decompressed from p
+// when packed is set.
+func loadEntry(stored *models.Entry, p packedResponse, packed bool) (*models.Entry, error) {
+	e := cloneEntry(stored)
+	if packed {
+		_, dec := codecs()
+		raw, err := dec.DecodeAll(p.data, make([]byte, 0, p.raw))
+		if err != nil {
+			return nil, err
+		}
+		e.Response = string(raw)
+	}
+	return e, nil
+}
+
+func (s *inMemoryStore) CompressionStats() CompressionStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return CompressionStats{Entries: len(s.packed), RawBytes: s.packedRaw, StoredBytes: s.packedBytes}
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"context"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// EmbedderSearcher is implemented by stores that can restrict a vector
+// search to the entries embedded by a model comparable with the query's
+// (see models.Embedder), so after a model change the old vectors, whose
+// scores mean nothing, neither outrank nor crowd out comparable ones.
+// Entries without an embedder are searched as before.
+type EmbedderSearcher interface {
+	SearchByVectorFrom(ctx context.Context, vec []float64, limit int, embedder *models.Embedder, filters map[string]string) ([]int64, []float64, error)
+}
+
+func (s *inMemoryStore) SearchByVectorFrom(ctx context.Context, vec []float64, limit int, embedder *models.Embedder, filters map[string]string) ([]int64, []float64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := s.ids
+	if len(filters) > 0 {
+		ids = s.index.candidates(filters)
+	}
+	positions := make([]int, 0, len(ids))
+	for _, id := range ids {
+		e, ok := s.entries[id]
+		if !ok || !embedder.Comparable(e.Embedder) || !matchesMetadata(e, filters) {
+			continue
+		}
+		positions = append(positions, s.pos[id])
+	}
+	accept := func(id int64) bool {
+		e := s.entries[id]
+		return embedder.Comparable(e.Embedder) && matchesMetadata(e, filters)
+	}
+	if ids, scores, ok := s.approxLocked(vec, limit, len(positions), accept); ok {
+		return ids, scores, nil
+	}
+	ids, scores := s.topLocked(vec, limit, positions)
+	return ids, scores, nil
+}
@@ -0,0 +1,18 @@
+package store
+
+// Evicter is implemented by stores that drop entries on their own to fit
+// their size limits (Options.MaxEntries, Options.MaxBytes). Wrappers that
+// keep derived state or a journal of the store's contents drain it after
+// each write, so the entries don't live on there.
+type Evicter interface {
+	// Evicted returns the IDs of the entries evicted since the last call.
+	Evicted() []int64
+}
+
+func (s *inMemoryStore) Evicted() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.dropped
+	s.dropped = nil
+	return out
+}
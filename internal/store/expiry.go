@@ -0,0 +1,29 @@
+package store
+
+import (
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// Expirer is implemented by stores that expire entries natively and report
+// Capabilities.PurgeExpired. The server hands them its TTL policy and stops
+// sweeping for expired entries itself; reads still check the TTL.
+type Expirer interface {
+	// SetExpiry sets how long an entry lives after it was last written,
+	// applied from the next write of each entry. ttl returns 0 for entries
+	// that never expire.
+	SetExpiry(ttl func(*models.Entry) time.Duration)
+}
+
+// SetExpiry hands ttl to the backend, now if it is connected and again on
+// every reconnect.
+func (l *LazyStore) SetExpiry(ttl func(*models.Entry) time.Duration) {
+	l.mu.Lock()
+	l.expiry = ttl
+	st := l.st
+	l.mu.Unlock()
+	if ex, ok := st.(Expirer); ok {
+		ex.SetExpiry(ttl)
+	}
+}
@@ -0,0 +1,58 @@
+package store
+
+import "context"
+
+// Capabilities describes optional features of a store's backend, so the
+// server can pick the best way to run a request and report what it relies
+// on.
+type Capabilities struct {
+	// FilteredSearch: vector search can be restricted by metadata filters
+	// (see FilteredSearcher) instead of filtering the top results afterwards.
+	FilteredSearch bool `json:"filtered_search"`
+	// EmbedderSearch: vector search can skip entries embedded by another
+	// model (see EmbedderSearcher).
+	EmbedderSearch bool `json:"embedder_search"`
+	// Pagination: listings can be read in pages rather than all at once.
+	Pagination bool `json:"pagination"`
+	// PurgeExpired: the backend expires entries on its own (e.g. with a
+	// native TTL), so the server's janitor is only a safety net.
+	PurgeExpired bool `json:"purge_expired"`
+	// Transactions: an entry and its vector are written atomically.
+	Transactions bool `json:"transactions"`
+}
+
+// Reporter is implemented by stores that can check their backend and
+// describe what it supports. Adapters for remote databases should implement
+// it so /readyz reflects whether the database is reachable.
+type Reporter interface {
+	// Health returns nil when the backend can serve requests.
+	Health(ctx context.Context) error
+	Capabilities() Capabilities
+}
+
+// Health checks st's backend. Stores that don't implement Reporter are
+// assumed healthy.
+func Health(ctx context.Context, st Store) error {
+	if r, ok := st.(Reporter); ok {
+		return r.Health(ctx)
+	}
+	return nil
+}
+
+// CapabilitiesOf returns what st reports, or for stores that don't
+// implement Reporter, what its optional interfaces show.
+func CapabilitiesOf(st Store) Capabilities {
+	if r, ok := st.(Reporter); ok {
+		return r.Capabilities()
+	}
+	_, filtered := st.(FilteredSearcher)
+	return Capabilities{FilteredSearch: filtered}
+}
+
+// Health only fails once ctx is done: the in-memory store has no backend
+// to lose.
+func (s *inMemoryStore) Health(ctx context.Context) error { return ctx.Err() }
+
+func (s *inMemoryStore) Capabilities() Capabilities {
+	return Capabilities{FilteredSearch: true, EmbedderSearch: true, Transactions: true}
+}
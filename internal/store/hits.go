@@ -0,0 +1,42 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Hits are the serves of one entry since its statistics were last recorded.
+type Hits struct {
+	Count int64     `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+// HitRecorder is implemented by stores that keep each entry's hit_count
+// and last_hit_at, so they survive restarts along with the entry. Servers
+// count hits in memory and record them in batches.
+type HitRecorder interface {
+	// RecordHits adds each entry's hits to its hit_count and moves its
+	// last_hit_at forward. Entries that no longer exist are skipped.
+	RecordHits(ctx context.Context, hits map[int64]Hits) error
+}
+
+func (s *inMemoryStore) RecordHits(ctx context.Context, hits map[int64]Hits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, h := range hits {
+		entry, ok := s.entries[id]
+		if !ok {
+			continue
+		}
+		// a hit isn't an edit: UpdatedAt, and so the TTL, stay put. Stored
+		// entries are never changed in place, so the copy can share the
+		// metadata.
+		updated := *entry
+		updated.HitCount += h.Count
+		if h.Last.After(updated.LastHitAt) {
+			updated.LastHitAt = h.Last
+		}
+		s.entries[id] = &updated
+	}
+	return nil
+}
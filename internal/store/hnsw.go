@@ -0,0 +1,343 @@
+package store
+
+import (
+	"container/heap"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sort"
+)
+
+// HNSWOptions tunes the in-memory store's approximate nearest neighbour
+// index, a hierarchical navigable small world graph over the vectors.
+type HNSWOptions struct {
+	// M is how many neighbours a vector links to on each layer, twice as
+	// many on the bottom one. 0 turns the index off and every search scans.
+	M int
+	// EfConstruction is how many candidates an insert considers for its
+	// links (default 100). More build a better graph, more slowly.
+	EfConstruction int
+	// EfSearch is how many candidates a search keeps (default 64, at least
+	// the search's limit). More find more of the true neighbours, more
+	// slowly.
+	EfSearch int
+	// ExactBelow is the number of candidate vectors under which a search
+	// scans them all instead (default 10000): exact, and as fast at that
+	// size.
+	ExactBelow int
+}
+
+func (o HNSWOptions) withDefaults() HNSWOptions {
+	if o.EfConstruction <= 0 {
+		o.EfConstruction = 100
+	}
+	if o.EfSearch <= 0 {
+		o.EfSearch = 64
+	}
+	if o.ExactBelow <= 0 {
+		o.ExactBelow = 10000
+	}
+	return o
+}
+
+// maxLevel bounds a node's layer, which is drawn at random.
+const maxLevel = 16
+
+// hnsw is the graph. Nodes are entry IDs, so they survive the position
+// shifts of deletes, and vectors are read from the store's arena through
+// vec rather than copied. It is changed under the store's write lock and
+// searched under its read lock.
+type hnsw struct {
+	opts  HNSWOptions
+	vec   func(id int64) []float64
+	nodes map[int64][][]int64 // id -> neighbours on each of its layers
+	// entry is the node searches start from, on layer top; 0 when empty.
+	entry int64
+	top   int
+	rng   *rand.Rand
+	mult  float64
+}
+
+func newHNSW(opts HNSWOptions, vec func(id int64) []float64) *hnsw {
+	opts = opts.withDefaults()
+	return &hnsw{
+		opts:  opts,
+		vec:   vec,
+		nodes: make(map[int64][][]int64),
+		rng:   rand.New(rand.NewPCG(1, uint64(opts.M))),
+		mult:  1 / math.Log(float64(max(opts.M, 2))),
+	}
+}
+
+// candidate is a node and its distance to the vector being looked up.
+type candidate struct {
+	id   int64
+	dist float64
+}
+
+func distance(a, b []float64) float64 { return 1 - cosine(a, b) }
+
+func (h *hnsw) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * h.opts.M
+	}
+	return h.opts.M
+}
+
+// insert adds node id, whose vector must already be readable through vec.
+func (h *hnsw) insert(id int64) {
+	level := min(int(-math.Log(1-h.rng.Float64())*h.mult), maxLevel)
+	links := make([][]int64, level+1)
+	h.nodes[id] = links
+	if h.entry == 0 {
+		h.entry, h.top = id, level
+		return
+	}
+	q := h.vec(id)
+	cur := candidate{h.entry, distance(q, h.vec(h.entry))}
+	for l := h.top; l > level; l-- {
+		cur = h.greedy(q, cur, l)
+	}
+	for l := min(level, h.top); l >= 0; l-- {
+		found := h.searchLayer(q, cur, h.opts.EfConstruction, l, nil)
+		if len(found) == 0 {
+			continue
+		}
+		links[l] = h.selectNeighbours(found, h.maxLinks(l))
+		for _, n := range links[l] {
+			h.link(n, id, l)
+		}
+		cur = found[0]
+	}
+	if level > h.top {
+		h.entry, h.top = id, level
+	}
+}
+
+// link adds to from's neighbours on layer l, pruning them back to the
+// layer's limit.
+func (h *hnsw) link(from, to int64, l int) {
+	layers := h.nodes[from]
+	if l >= len(layers) || slices.Contains(layers[l], to) {
+		return
+	}
+	layers[l] = append(layers[l], to)
+	if len(layers[l]) > h.maxLinks(l) {
+		layers[l] = h.relink(from, layers[l], l)
+	}
+}
+
+// relink picks from's best neighbours on layer l among ids, leaving out
+// duplicates and those no longer in the graph.
+func (h *hnsw) relink(from int64, ids []int64, l int) []int64 {
+	v := h.vec(from)
+	seen := make(map[int64]bool, len(ids))
+	cands := make([]candidate, 0, len(ids))
+	for _, n := range ids {
+		if n != from && !seen[n] && h.onLayer(n, l) {
+			seen[n] = true
+			cands = append(cands, candidate{n, distance(v, h.vec(n))})
+		}
+	}
+	sortCandidates(cands)
+	return h.selectNeighbours(cands, h.maxLinks(l))
+}
+
+func (h *hnsw) onLayer(id int64, l int) bool {
+	layers, ok := h.nodes[id]
+	return ok && l < len(layers)
+}
+
+// selectNeighbours picks up to m of cands, closest first, preferring
+// candidates closer to the node than to the neighbours already picked, so
+// links spread across clusters instead of crowding into the nearest one.
+// Candidates passed over fill the remaining slots.
+func (h *hnsw) selectNeighbours(cands []candidate, m int) []int64 {
+	out := make([]int64, 0, m)
+	var skipped []int64
+	for _, c := range cands {
+		if len(out) == m {
+			break
+		}
+		v := h.vec(c.id)
+		diverse := true
+		for _, n := range out {
+			if distance(v, h.vec(n)) < c.dist {
+				diverse = false
+				break
+			}
+		}
+		if diverse {
+			out = append(out, c.id)
+		} else {
+			skipped = append(skipped, c.id)
+		}
+	}
+	for _, n := range skipped {
+		if len(out) == m {
+			break
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// remove drops node id. Its vector need not be readable any more. Each
+// neighbour linking back to it is relinked among its other neighbours and
+// id's; links to id from nodes it didn't link to are skipped by searches
+// until those nodes are relinked.
+func (h *hnsw) remove(id int64) {
+	links, ok := h.nodes[id]
+	if !ok {
+		return
+	}
+	delete(h.nodes, id)
+	for l, ns := range links {
+		for _, n := range ns {
+			if !h.onLayer(n, l) || !slices.Contains(h.nodes[n][l], id) {
+				continue
+			}
+			h.nodes[n][l] = h.relink(n, append(slices.Clone(h.nodes[n][l]), ns...), l)
+		}
+	}
+	if h.entry != id {
+		return
+	}
+	h.entry, h.top = 0, 0
+	for n, layers := range h.nodes {
+		if h.entry == 0 || len(layers)-1 > h.top || (len(layers)-1 == h.top && n < h.entry) {
+			h.entry, h.top = n, len(layers)-1
+		}
+	}
+}
+
+// greedy walks layer l from cur to the node closest to q.
+func (h *hnsw) greedy(q []float64, cur candidate, l int) candidate {
+	for moved := true; moved; {
+		moved = false
+		for _, n := range h.nodes[cur.id][l] {
+			if !h.onLayer(n, l) {
+				continue
+			}
+			if d := distance(q, h.vec(n)); d < cur.dist {
+				cur, moved = candidate{n, d}, true
+			}
+		}
+	}
+	return cur
+}
+
+// searchLayer returns up to ef of the nodes accept takes on layer l,
+// closest to q first, exploring from start. Rejected nodes are still
+// walked through.
+func (h *hnsw) searchLayer(q []float64, start candidate, ef, l int, accept func(int64) bool) []candidate {
+	visited := map[int64]struct{}{start.id: {}}
+	frontier := &candidateHeap{less: func(a, b candidate) bool { return a.dist < b.dist }}
+	found := &candidateHeap{less: func(a, b candidate) bool { return a.dist > b.dist }}
+	heap.Push(frontier, start)
+	if accept == nil || accept(start.id) {
+		heap.Push(found, start)
+	}
+	for frontier.Len() > 0 {
+		c := heap.Pop(frontier).(candidate)
+		if found.Len() >= ef && c.dist > found.items[0].dist {
+			break
+		}
+		for _, n := range h.nodes[c.id][l] {
+			if _, seen := visited[n]; seen || !h.onLayer(n, l) {
+				continue
+			}
+			visited[n] = struct{}{}
+			d := distance(q, h.vec(n))
+			if found.Len() >= ef && d >= found.items[0].dist {
+				continue
+			}
+			heap.Push(frontier, candidate{n, d})
+			if accept == nil || accept(n) {
+				heap.Push(found, candidate{n, d})
+				if found.Len() > ef {
+					heap.Pop(found)
+				}
+			}
+		}
+	}
+	out := slices.Clone(found.items)
+	sortCandidates(out)
+	return out
+}
+
+// search returns the IDs of up to limit nodes accept takes (nil takes
+// all), closest to q first, with their cosine similarity, keeping ef
+// candidates.
+func (h *hnsw) search(q []float64, limit, ef int, accept func(int64) bool) ([]int64, []float64) {
+	ids, scores := []int64{}, []float64{}
+	if h.entry == 0 {
+		return ids, scores
+	}
+	cur := candidate{h.entry, distance(q, h.vec(h.entry))}
+	for l := h.top; l > 0; l-- {
+		cur = h.greedy(q, cur, l)
+	}
+	for i, c := range h.searchLayer(q, cur, max(ef, limit), 0, accept) {
+		if i == limit {
+			break
+		}
+		ids = append(ids, c.id)
+		scores = append(scores, 1-c.dist)
+	}
+	return ids, scores
+}
+
+func sortCandidates(cs []candidate) {
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].dist != cs[j].dist {
+			return cs[i].dist < cs[j].dist
+		}
+		return cs[i].id < cs[j].id
+	})
+}
+
+type candidateHeap struct {
+	items []candidate
+	less  func(a, b candidate) bool
+}
+
+func (h *candidateHeap) Len() int           { return len(h.items) }
+func (h *candidateHeap) Less(i, j int) bool { return h.less(h.items[i], h.items[j]) }
+func (h *candidateHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *candidateHeap) Push(x any)         { h.items = append(h.items, x.(candidate)) }
+func (h *candidateHeap) Pop() any {
+	old := h.items
+	c := old[len(old)-1]
+	h.items = old[:len(old)-1]
+	return c
+}
+
+// minSelectivity is the share of the store a filtered search must match
+// to use the graph. Below it most of the graph walk is through rejected
+// nodes, and the search returns too few or the wrong neighbours.
+const minSelectivity = 0.1
+
+// approxLocked answers a search of n candidate vectors from the graph,
+// when there is one, n is past HNSWOptions.ExactBelow and, for a filtered
+// search, at least minSelectivity of the store; ok is false when the
+// caller should scan instead. A filtered search keeps more candidates,
+// in proportion to how few nodes it accepts. Callers must hold s.mu.
+func (s *inMemoryStore) approxLocked(vec []float64, limit, n int, accept func(int64) bool) (ids []int64, scores []float64, ok bool) {
+	if s.ann == nil || n < s.ann.opts.ExactBelow {
+		return nil, nil, false
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	ef := max(s.ann.opts.EfSearch, limit)
+	if accept != nil && n < len(s.ids) {
+		selectivity := float64(n) / float64(len(s.ids))
+		if selectivity < minSelectivity {
+			return nil, nil, false
+		}
+		ef = int(math.Ceil(float64(ef) / selectivity))
+	}
+	ids, scores = s.ann.search(vec, limit, ef, accept)
+	return ids, scores, true
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// FilteredSearcher is implemented by stores that can restrict a vector
+// search to the entries matching metadata filters, so a filtered search
+// neither scans unrelated vectors nor loses matches ranked below unrelated
+// ones.
+type FilteredSearcher interface {
+	SearchByVectorFiltered(ctx context.Context, vec []float64, limit int, filters map[string]string) ([]int64, []float64, error)
+}
+
+// metaIndex is an inverted index from metadata key and value to entry IDs.
+// Scalar values (strings, bools, numbers) are indexed by their fmt.Sprint
+// form, the form filters compare against; entries holding anything else
+// under a key are kept aside and checked one by one.
+type metaIndex struct {
+	values    map[string]map[string]map[int64]struct{}
+	unindexed map[string]map[int64]struct{}
+}
+
+func newMetaIndex() metaIndex {
+	return metaIndex{
+		values:    make(map[string]map[string]map[int64]struct{}),
+		unindexed: make(map[string]map[int64]struct{}),
+	}
+}
+
+func indexable(v interface{}) (string, bool) {
+	switch v.(type) {
+	case string, bool, float64, float32, int, int32, int64, uint, uint32, uint64:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+func (x metaIndex) add(id int64, md map[string]interface{}) {
+	for k, v := range md {
+		val, ok := indexable(v)
+		if !ok {
+			if x.unindexed[k] == nil {
+				x.unindexed[k] = make(map[int64]struct{})
+			}
+			x.unindexed[k][id] = struct{}{}
+			continue
+		}
+		if x.values[k] == nil {
+			x.values[k] = make(map[string]map[int64]struct{})
+		}
+		if x.values[k][val] == nil {
+			x.values[k][val] = make(map[int64]struct{})
+		}
+		x.values[k][val][id] = struct{}{}
+	}
+}
+
+func (x metaIndex) remove(id int64, md map[string]interface{}) {
+	for k, v := range md {
+		val, ok := indexable(v)
+		if !ok {
+			delete(x.unindexed[k], id)
+			if len(x.unindexed[k]) == 0 {
+				delete(x.unindexed, k)
+			}
+			continue
+		}
+		delete(x.values[k][val], id)
+		if len(x.values[k][val]) == 0 {
+			delete(x.values[k], val)
+			if len(x.values[k]) == 0 {
+				delete(x.values, k)
+			}
+		}
+	}
+}
+
+// candidates returns, in ID order, the entries that may match filters: those
+// of the most selective filter. Callers still check every filter.
+func (x metaIndex) candidates(filters map[string]string) []int64 {
+	var best []map[int64]struct{}
+	bestSize := -1
+	for k, v := range filters {
+		sets := []map[int64]struct{}{x.values[k][v], x.unindexed[k]}
+		size := len(sets[0]) + len(sets[1])
+		if bestSize < 0 || size < bestSize {
+			best, bestSize = sets, size
+		}
+	}
+	out := make([]int64, 0, bestSize)
+	for _, set := range best {
+		for id := range set {
+			out = append(out, id)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func (s *inMemoryStore) SearchByVectorFiltered(ctx context.Context, vec []float64, limit int, filters map[string]string) ([]int64, []float64, error) {
+	if len(filters) == 0 {
+		return s.SearchByVector(ctx, vec, limit)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	positions := []int{}
+	for _, id := range s.index.candidates(filters) {
+		if e, ok := s.entries[id]; ok && matchesMetadata(e, filters) {
+			positions = append(positions, s.pos[id])
+		}
+	}
+	accept := func(id int64) bool { return matchesMetadata(s.entries[id], filters) }
+	if ids, scores, ok := s.approxLocked(vec, limit, len(positions), accept); ok {
+		return ids, scores, nil
+	}
+	ids, scores := s.topLocked(vec, limit, positions)
+	return ids, scores, nil
+}
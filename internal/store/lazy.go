@@ -0,0 +1,508 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// ErrUnavailable is returned by a LazyStore while its backend isn't
+// connected. The server answers 503 for it.
+var ErrUnavailable = errors.New("store unavailable: backend not connected")
+
+// Connector opens a store, typically by dialing a remote database.
+type Connector func(ctx context.Context) (Store, error)
+
+// LazyOptions tunes a LazyStore. Zero values select the defaults.
+type LazyOptions struct {
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// connection attempts (default 500ms and 30s).
+	MinBackoff, MaxBackoff time.Duration
+	// HealthInterval is how often a connected backend is checked (default
+	// 10s); a failed check drops the connection and reconnects. Only
+	// stores implementing Reporter are checked.
+	HealthInterval time.Duration
+	// Exclusive declares this process the backend's only user, so a
+	// backend that can't grant leases needn't: every lease is this
+	// process's. Otherwise such a backend grants none.
+	Exclusive bool
+}
+
+// LazyStore lets an adapter for a remote database start before the
+// database is reachable. It connects in the background with backoff,
+// returns ErrUnavailable meanwhile, and reconnects when the backend's health
+// check fails, so an outage never needs a process restart.
+type LazyStore struct {
+	connect Connector
+	opts    LazyOptions
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu      sync.RWMutex
+	st      Store
+	lastErr error
+	// expiry is the TTL policy handed to backends implementing Expirer.
+	expiry func(*models.Entry) time.Duration
+}
+
+// NewLazy returns a LazyStore and starts connecting. Close stops it.
+func NewLazy(connect Connector, opts LazyOptions) *LazyStore {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = 10 * time.Second
+	}
+	l := &LazyStore{connect: connect, opts: opts, stop: make(chan struct{}), done: make(chan struct{}), lastErr: ErrUnavailable}
+	go l.run()
+	return l
+}
+
+func (l *LazyStore) run() {
+	defer close(l.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-l.stop
+		cancel()
+	}()
+	for {
+		if !l.dial(ctx) {
+			return
+		}
+		if !l.watch(ctx) {
+			return
+		}
+	}
+}
+
+// dial connects with exponential backoff and jitter. It returns false when
+// the store is closed first.
+func (l *LazyStore) dial(ctx context.Context) bool {
+	backoff := l.opts.MinBackoff
+	for attempt := 1; ; attempt++ {
+		st, err := l.connect(ctx)
+		if err == nil {
+			// a reconnected backend is as cold as a new one; warm it before
+			// serving from it
+			if err := Warm(ctx, st); err != nil {
+				log.Printf("store: warm-up failed: %v", err)
+			}
+			l.mu.Lock()
+			if ex, ok := st.(Expirer); ok && l.expiry != nil {
+				ex.SetExpiry(l.expiry)
+			}
+			l.st, l.lastErr = st, nil
+			l.mu.Unlock()
+			if attempt > 1 {
+				log.Printf("store: connected after %d attempts", attempt)
+			}
+			return true
+		}
+		l.mu.Lock()
+		l.lastErr = err
+		l.mu.Unlock()
+		wait := backoff/2 + rand.N(backoff/2+1)
+		log.Printf("store: connect attempt %d failed, retrying in %s: %v", attempt, wait.Round(time.Millisecond), err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return false
+		}
+		backoff = min(2*backoff, l.opts.MaxBackoff)
+	}
+}
+
+// watch checks the connected backend until a check fails, then drops the
+// connection. It returns false when the store is closed first.
+func (l *LazyStore) watch(ctx context.Context) bool {
+	ticker := time.NewTicker(l.opts.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			l.disconnect(nil)
+			return false
+		}
+		l.mu.RLock()
+		st := l.st
+		l.mu.RUnlock()
+		if err := Health(ctx, st); err != nil {
+			if ctx.Err() != nil {
+				l.disconnect(nil)
+				return false
+			}
+			log.Printf("store: health check failed, reconnecting: %v", err)
+			l.disconnect(err)
+			return true
+		}
+	}
+}
+
+func (l *LazyStore) disconnect(err error) {
+	l.mu.Lock()
+	st := l.st
+	l.st = nil
+	l.lastErr = ErrUnavailable
+	if err != nil {
+		l.lastErr = err
+	}
+	l.mu.Unlock()
+	if c, ok := st.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// Close stops connecting and closes the backend store if it is an
+// io.Closer.
+func (l *LazyStore) Close() error {
+	select {
+	case <-l.stop:
+	default:
+		close(l.stop)
+	}
+	<-l.done
+	return nil
+}
+
+// Available reports whether the backend is connected.
+func (l *LazyStore) Available() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.st != nil
+}
+
+// Available reports whether st can serve requests now. Only a LazyStore
+// can be unavailable.
+func Available(st Store) bool {
+	if a, ok := st.(interface{ Available() bool }); ok {
+		return a.Available()
+	}
+	return true
+}
+
+// current returns the connected store or ErrUnavailable.
+func (l *LazyStore) current() (Store, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.st == nil {
+		return nil, ErrUnavailable
+	}
+	return l.st, nil
+}
+
+// Health fails with the last connection error while disconnected.
+func (l *LazyStore) Health(ctx context.Context) error {
+	l.mu.RLock()
+	st, lastErr := l.st, l.lastErr
+	l.mu.RUnlock()
+	if st == nil {
+		if errors.Is(lastErr, ErrUnavailable) {
+			return lastErr
+		}
+		return errors.Join(ErrUnavailable, lastErr)
+	}
+	return Health(ctx, st)
+}
+
+// Capabilities are the backend's, or none while disconnected.
+func (l *LazyStore) Capabilities() Capabilities {
+	st, err := l.current()
+	if err != nil {
+		return Capabilities{}
+	}
+	return CapabilitiesOf(st)
+}
+
+// CompressionStats reports the backend's, or nothing while disconnected.
+func (l *LazyStore) CompressionStats() CompressionStats {
+	st, err := l.current()
+	if err != nil {
+		return CompressionStats{}
+	}
+	if cr, ok := st.(CompressionReporter); ok {
+		return cr.CompressionStats()
+	}
+	return CompressionStats{}
+}
+
+func (l *LazyStore) CreateEntryWithVector(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
+	st, err := l.current()
+	if err != nil {
+		return 0, err
+	}
+	return st.CreateEntryWithVector(ctx, e, vec)
+}
+
+func (l *LazyStore) UpdateEntryWithVector(ctx context.Context, id int64, e *models.Entry, vec []float64) error {
+	st, err := l.current()
+	if err != nil {
+		return err
+	}
+	return st.UpdateEntryWithVector(ctx, id, e, vec)
+}
+
+func (l *LazyStore) GetEntry(ctx context.Context, id int64) (*models.Entry, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.GetEntry(ctx, id)
+}
+
+func (l *LazyStore) SearchByVector(ctx context.Context, vec []float64, limit int) ([]int64, []float64, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, nil, err
+	}
+	return st.SearchByVector(ctx, vec, limit)
+}
+
+// AllIDs is empty while disconnected.
+func (l *LazyStore) AllIDs() []int64 {
+	st, err := l.current()
+	if err != nil {
+		return []int64{}
+	}
+	return st.AllIDs()
+}
+
+func (l *LazyStore) DeleteEntry(ctx context.Context, id int64) error {
+	st, err := l.current()
+	if err != nil {
+		return err
+	}
+	return st.DeleteEntry(ctx, id)
+}
+
+func (l *LazyStore) UpdateEntryMetadata(ctx context.Context, id int64, metadata map[string]interface{}, replace bool) error {
+	st, err := l.current()
+	if err != nil {
+		return err
+	}
+	return st.UpdateEntryMetadata(ctx, id, metadata, replace)
+}
+
+func (l *LazyStore) DeleteEntryMetadata(ctx context.Context, id int64, keys ...string) error {
+	st, err := l.current()
+	if err != nil {
+		return err
+	}
+	return st.DeleteEntryMetadata(ctx, id, keys...)
+}
+
+func (l *LazyStore) FindEntriesByMetadata(ctx context.Context, filters map[string]string) ([]*models.Entry, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, err
+	}
+	return st.FindEntriesByMetadata(ctx, filters)
+}
+
+// SearchByVectorFiltered forwards to the backend; the server only calls it
+// when Capabilities reports filtered search.
+func (l *LazyStore) SearchByVectorFiltered(ctx context.Context, vec []float64, limit int, filters map[string]string) ([]int64, []float64, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, nil, err
+	}
+	fs, ok := st.(FilteredSearcher)
+	if !ok {
+		return nil, nil, errors.New("store does not support filtered search")
+	}
+	return fs.SearchByVectorFiltered(ctx, vec, limit, filters)
+}
+
+// SearchByVectorFrom forwards to the backend; the server only calls it
+// when Capabilities reports embedder search.
+func (l *LazyStore) SearchByVectorFrom(ctx context.Context, vec []float64, limit int, embedder *models.Embedder, filters map[string]string) ([]int64, []float64, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, nil, err
+	}
+	es, ok := st.(EmbedderSearcher)
+	if !ok {
+		return nil, nil, errors.New("store does not support embedder search")
+	}
+	return es.SearchByVectorFrom(ctx, vec, limit, embedder, filters)
+}
+
+// UpdateMetadataWhere forwards to the backend, patching entries one at a
+// time when it has no bulk support.
+func (l *LazyStore) UpdateMetadataWhere(ctx context.Context, filters map[string]string, metadata map[string]interface{}) ([]int64, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, err
+	}
+	return BulkUpdate(st).UpdateMetadataWhere(ctx, filters, metadata)
+}
+
+func (l *LazyStore) GetVector(ctx context.Context, id int64) ([]float64, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, err
+	}
+	vg, ok := st.(VectorGetter)
+	if !ok {
+		return nil, errors.New("store does not expose vectors")
+	}
+	return vg.GetVector(ctx, id)
+}
+
+func (l *LazyStore) Namespaces(ctx context.Context) ([]models.Namespace, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, err
+	}
+	ns, ok := st.(NamespaceStore)
+	if !ok {
+		return nil, errors.New("store does not persist namespaces")
+	}
+	return ns.Namespaces(ctx)
+}
+
+func (l *LazyStore) PutNamespace(ctx context.Context, namespace models.Namespace) error {
+	st, err := l.current()
+	if err != nil {
+		return err
+	}
+	ns, ok := st.(NamespaceStore)
+	if !ok {
+		return errors.New("store does not persist namespaces")
+	}
+	return ns.PutNamespace(ctx, namespace)
+}
+
+func (l *LazyStore) DeleteNamespace(ctx context.Context, name string) error {
+	st, err := l.current()
+	if err != nil {
+		return err
+	}
+	ns, ok := st.(NamespaceStore)
+	if !ok {
+		return errors.New("store does not persist namespaces")
+	}
+	return ns.DeleteNamespace(ctx, name)
+}
+
+func (l *LazyStore) Synonyms(ctx context.Context) (map[string]map[string]string, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, err
+	}
+	ss, ok := st.(SynonymStore)
+	if !ok {
+		return nil, errors.New("store does not persist synonyms")
+	}
+	return ss.Synonyms(ctx)
+}
+
+func (l *LazyStore) SetSynonyms(ctx context.Context, namespace string, synonyms map[string]string) error {
+	st, err := l.current()
+	if err != nil {
+		return err
+	}
+	ss, ok := st.(SynonymStore)
+	if !ok {
+		return errors.New("store does not persist synonyms")
+	}
+	return ss.SetSynonyms(ctx, namespace, synonyms)
+}
+
+func (l *LazyStore) AppendOutbox(ctx context.Context, msgs []OutboxMessage) error {
+	ob, err := l.outbox()
+	if err != nil {
+		return err
+	}
+	return ob.AppendOutbox(ctx, msgs)
+}
+
+func (l *LazyStore) PendingOutbox(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	ob, err := l.outbox()
+	if err != nil {
+		return nil, err
+	}
+	return ob.PendingOutbox(ctx, limit)
+}
+
+func (l *LazyStore) AckOutbox(ctx context.Context, seqs ...uint64) error {
+	ob, err := l.outbox()
+	if err != nil {
+		return err
+	}
+	return ob.AckOutbox(ctx, seqs...)
+}
+
+func (l *LazyStore) outbox() (Outbox, error) {
+	st, err := l.current()
+	if err != nil {
+		return nil, err
+	}
+	ob, ok := st.(Outbox)
+	if !ok {
+		return nil, errors.New("store does not persist an outbox")
+	}
+	return ob, nil
+}
+
+// ConsumeServe fails while disconnected; a backend without serve limits
+// reports every entry as unlimited.
+func (l *LazyStore) ConsumeServe(ctx context.Context, id int64) (int, error) {
+	st, err := l.current()
+	if err != nil {
+		return 0, err
+	}
+	if sl, ok := st.(ServeLimiter); ok {
+		return sl.ConsumeServe(ctx, id)
+	}
+	return -1, nil
+}
+
+// RecordHits fails while disconnected, so the server keeps the hits for
+// the next flush; a backend without hit statistics drops them.
+func (l *LazyStore) RecordHits(ctx context.Context, hits map[int64]Hits) error {
+	st, err := l.current()
+	if err != nil {
+		return err
+	}
+	if hr, ok := st.(HitRecorder); ok {
+		return hr.RecordHits(ctx, hits)
+	}
+	return nil
+}
+
+// AcquireLease fails while disconnected, so no replica runs maintenance
+// against a backend it can't reach. A remote backend without leases may be
+// shared with other replicas, which would all run maintenance at once, so
+// it grants none unless LazyOptions.Exclusive is set.
+func (l *LazyStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	st, err := l.current()
+	if err != nil {
+		return false, err
+	}
+	if ls, ok := st.(Leaser); ok {
+		return ls.AcquireLease(ctx, name, holder, ttl)
+	}
+	return l.opts.Exclusive, nil
+}
+
+func (l *LazyStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	st, err := l.current()
+	if err != nil {
+		return err
+	}
+	if ls, ok := st.(Leaser); ok {
+		return ls.ReleaseLease(ctx, name, holder)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Leaser is implemented by stores that can be shared between replicas and
+// grant named, expiring leases. The server uses it to elect a single replica
+// to run maintenance loops (such as the TTL janitor). Postgres-backed stores
+// would map this onto advisory locks and Redis-backed stores onto SET NX PX.
+type Leaser interface {
+	// AcquireLease grants or renews the named lease for holder until ttl
+	// elapses and reports whether holder owns the lease after the call.
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease gives up the named lease if holder currently owns it.
+	ReleaseLease(ctx context.Context, name, holder string) error
+}
+
+type lease struct {
+	holder  string
+	expires time.Time
+}
+
+func (s *inMemoryStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if name == "" || holder == "" {
+		return false, errors.New("lease name and holder required")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if cur, ok := s.leases[name]; ok && cur.holder != holder && now.Before(cur.expires) {
+		return false, nil
+	}
+	s.leases[name] = lease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *inMemoryStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.leases[name]; ok && cur.holder == holder {
+		delete(s.leases, name)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"slices"
 	"sync"
 	"time"
 
@@ -25,25 +26,92 @@ type Store interface {
 	FindEntriesByMetadata(ctx context.Context, filters map[string]string) ([]*models.Entry, error)
 }
 
+// Options tunes the in-memory store.
+type Options struct {
+	// MaxEntries caps the number of stored entries (0 = unlimited).
+	MaxEntries int
+	// MaxBytes caps the approximate memory used by prompts, responses,
+	// metadata and vectors (0 = unlimited).
+	MaxBytes int64
+	// CompressAbove compresses responses of at least this many bytes at
+	// rest (0 = never). They are decompressed on every read, trading CPU
+	// for memory in caches of long completions.
+	CompressAbove int
+	// HNSW indexes the vectors for approximate search of large stores.
+	// The zero value leaves it off.
+	HNSW HNSWOptions
+}
+
 // inMemoryStore is the in-memory implementation of Store used for testing and
 // local development.
 type inMemoryStore struct {
 	mu      sync.RWMutex
 	entries map[int64]*models.Entry
-	vectors [][]float64
-	ids     []int64
-	nextID  int64
+	vectors vectorArena
+	// ann is the approximate nearest neighbour index, nil when off.
+	ann    *hnsw
+	ids    []int64
+	pos    map[int64]int // id -> index into ids and vectors
+	index  metaIndex
+	nextID int64
+	leases map[string]lease
+	// synonyms holds each namespace's dictionary, alias to term.
+	synonyms map[string]map[string]string
+	// namespaces holds the declared namespaces by name.
+	namespaces map[string]models.Namespace
+	// outbox holds undelivered outbound messages in sequence order.
+	outbox    []OutboxMessage
+	outboxSeq uint64
+
+	opts       Options
+	sizes      map[int64]int64
+	totalBytes int64
+	// packed holds the compressed responses; their entries keep an empty
+	// Response.
+	packed      map[int64]packedResponse
+	packedRaw   int64
+	packedBytes int64
+	// onEvict, when set, is told of every entry evicted to fit the limits.
+	// It is called with s.mu held.
+	onEvict func(id int64)
+	// dropped holds the entries evicted since the last Evicted call.
+	dropped []int64
 }
 
 // New returns a new in-memory Store implementation. To swap in a real vector
 // DB, implement the Store interface and provide an alternative constructor.
 func New() (Store, error) {
-	return &inMemoryStore{
-		entries: make(map[int64]*models.Entry),
-		vectors: [][]float64{},
-		ids:     []int64{},
-		nextID:  1,
-	}, nil
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions returns an in-memory Store bounded by opts. When a limit is
+// exceeded the oldest entries are evicted first, which keeps sidecar
+// deployments within a small memory ceiling.
+func NewWithOptions(opts Options) (Store, error) {
+	s := &inMemoryStore{
+		entries:    make(map[int64]*models.Entry),
+		vectors:    newVectorArena(0, 0),
+		ids:        []int64{},
+		pos:        make(map[int64]int),
+		index:      newMetaIndex(),
+		nextID:     1,
+		leases:     make(map[string]lease),
+		synonyms:   make(map[string]map[string]string),
+		namespaces: make(map[string]models.Namespace),
+		opts:       opts,
+		sizes:      make(map[int64]int64),
+		packed:     make(map[int64]packedResponse),
+	}
+	if opts.HNSW.M > 0 {
+		s.ann = newHNSW(opts.HNSW, s.vectorOf)
+	}
+	return s, nil
+}
+
+// vectorOf returns the vector of entry id, aliasing the arena. Callers
+// must hold s.mu.
+func (s *inMemoryStore) vectorOf(id int64) []float64 {
+	return s.vectors.at(s.pos[id])
 }
 
 func (s *inMemoryStore) CreateEntryWithVector(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
@@ -60,11 +128,15 @@ func (s *inMemoryStore) CreateEntryWithVector(ctx context.Context, e *models.Ent
 	}
 	e.UpdatedAt = now
 	e.ID = id
-	s.entries[id] = cloneEntry(e)
+	s.putLocked(id, e, vec)
+	s.index.add(id, e.Metadata)
+	s.pos[id] = len(s.ids)
 	s.ids = append(s.ids, id)
-	v := make([]float64, len(vec))
-	copy(v, vec)
-	s.vectors = append(s.vectors, v)
+	s.vectors.add(vec)
+	if s.ann != nil {
+		s.ann.insert(id)
+	}
+	s.evictLocked(id)
 	return id, nil
 }
 
@@ -83,69 +155,45 @@ func (s *inMemoryStore) UpdateEntryWithVector(ctx context.Context, id int64, e *
 		e.CreatedAt = now
 	}
 	e.UpdatedAt = now
-	s.entries[id] = cloneEntry(e)
-	for i, sid := range s.ids {
-		if sid == id {
-			v := make([]float64, len(vec))
-			copy(v, vec)
-			s.vectors[i] = v
-			return nil
+	// statistics belong to the entry, not to what it says
+	e.HitCount, e.LastHitAt, e.CreatedBy = current.HitCount, current.LastHitAt, current.CreatedBy
+	s.index.remove(id, current.Metadata)
+	s.putLocked(id, e, vec)
+	s.index.add(id, e.Metadata)
+	defer s.evictLocked(id)
+	if i, ok := s.pos[id]; ok {
+		if s.ann != nil {
+			s.ann.remove(id)
 		}
+		s.vectors.set(i, vec)
+	} else {
+		s.pos[id] = len(s.ids)
+		s.ids = append(s.ids, id)
+		s.vectors.add(vec)
+	}
+	if s.ann != nil {
+		s.ann.insert(id)
 	}
-	s.ids = append(s.ids, id)
-	v := make([]float64, len(vec))
-	copy(v, vec)
-	s.vectors = append(s.vectors, v)
 	return nil
 }
 
 func (s *inMemoryStore) GetEntry(ctx context.Context, id int64) (*models.Entry, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	e, ok := s.entries[id]
-	if !ok {
+	if _, ok := s.entries[id]; !ok {
 		return nil, errors.New("not found")
 	}
-	return cloneEntry(e), nil
+	return s.loadLocked(id)
 }
 
 func (s *inMemoryStore) SearchByVector(ctx context.Context, vec []float64, limit int) ([]int64, []float64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if limit <= 0 {
-		limit = 10
-	}
-	scores := make([]float64, len(s.vectors))
-	for i, v := range s.vectors {
-		scores[i] = cosine(vec, v)
-	}
-	type pair struct {
-		idx   int
-		score float64
+	if ids, scores, ok := s.approxLocked(vec, limit, len(s.ids), nil); ok {
+		return ids, scores, nil
 	}
-	sel := []pair{}
-	for i, sc := range scores {
-		if len(sel) < limit {
-			sel = append(sel, pair{i, sc})
-			continue
-		}
-		minIdx := 0
-		for j := 1; j < len(sel); j++ {
-			if sel[j].score < sel[minIdx].score {
-				minIdx = j
-			}
-		}
-		if sc > sel[minIdx].score {
-			sel[minIdx] = pair{i, sc}
-		}
-	}
-	ids := []int64{}
-	outScores := []float64{}
-	for _, p := range sel {
-		ids = append(ids, s.ids[p.idx])
-		outScores = append(outScores, p.score)
-	}
-	return ids, outScores, nil
+	ids, scores := s.topLocked(vec, limit, nil)
+	return ids, scores, nil
 }
 
 func cosine(a, b []float64) float64 {
@@ -181,20 +229,83 @@ func (s *inMemoryStore) DeleteEntry(ctx context.Context, id int64) error {
 	if _, ok := s.entries[id]; !ok {
 		return errors.New("not found")
 	}
+	s.removeLocked(id)
+	return nil
+}
+
+// removeLocked drops id from every index. Callers must hold s.mu.
+func (s *inMemoryStore) removeLocked(id int64) {
+	if e, ok := s.entries[id]; ok {
+		s.index.remove(id, e.Metadata)
+	}
 	delete(s.entries, id)
+	s.unpackLocked(id)
+	s.totalBytes -= s.sizes[id]
+	delete(s.sizes, id)
 	// remove from ids and vectors keeping order
-	newIDs := make([]int64, 0, len(s.ids))
-	newVecs := make([][]float64, 0, len(s.vectors))
-	for i, sid := range s.ids {
-		if sid == id {
-			continue
+	i, ok := s.pos[id]
+	if !ok {
+		return
+	}
+	if s.ann != nil {
+		s.ann.remove(id)
+	}
+	delete(s.pos, id)
+	s.ids = slices.Delete(s.ids, i, i+1)
+	s.vectors.remove(i)
+	for j := i; j < len(s.ids); j++ {
+		s.pos[s.ids[j]] = j
+	}
+}
+
+// track records the approximate size of id. Callers must hold s.mu.
+func (s *inMemoryStore) track(id int64, size int64) {
+	s.totalBytes += size - s.sizes[id]
+	s.sizes[id] = size
+}
+
+// evictLocked removes the oldest entries until the store fits its limits,
+// never evicting keep (the entry being written) or pinned entries. Callers
+// must hold s.mu.
+func (s *inMemoryStore) evictLocked(keep int64) {
+	over := func() bool {
+		if s.opts.MaxEntries > 0 && len(s.entries) > s.opts.MaxEntries {
+			return true
+		}
+		return s.opts.MaxBytes > 0 && s.totalBytes > s.opts.MaxBytes
+	}
+	for over() {
+		victim := int64(0)
+		for _, id := range s.ids {
+			if id != keep && !s.entries[id].Flag(models.MetaPinned) {
+				victim = id
+				break
+			}
+		}
+		if victim == 0 {
+			return
+		}
+		s.removeLocked(victim)
+		s.dropped = append(s.dropped, victim)
+		if s.onEvict != nil {
+			s.onEvict(victim)
 		}
-		newIDs = append(newIDs, sid)
-		newVecs = append(newVecs, s.vectors[i])
 	}
-	s.ids = newIDs
-	s.vectors = newVecs
-	return nil
+}
+
+// entrySize approximates the heap footprint of an entry and its vector.
+func entrySize(e *models.Entry, vec []float64) int64 {
+	size := int64(len(e.Prompt) + len(e.Response) + 8*len(vec) + 64)
+	for k, v := range e.Metadata {
+		size += int64(len(k) + len(fmt.Sprint(v)))
+	}
+	if e.Provenance != nil {
+		size += int64(64 + len(e.Provenance.Model) + len(e.Provenance.RequestID))
+	}
+	if e.Embedder != nil {
+		size += int64(48 + len(e.Embedder.Backend) + len(e.Embedder.Model) + len(e.Embedder.Version))
+	}
+	return size
 }
 
 func (s *inMemoryStore) UpdateEntryMetadata(ctx context.Context, id int64, metadata map[string]interface{}, replace bool) error {
@@ -220,7 +331,9 @@ func (s *inMemoryStore) UpdateEntryMetadata(ctx context.Context, id int64, metad
 		}
 	}
 	updated.UpdatedAt = time.Now().UTC()
+	s.index.remove(id, entry.Metadata)
 	s.entries[id] = updated
+	s.index.add(id, updated.Metadata)
 	return nil
 }
 
@@ -240,7 +353,9 @@ func (s *inMemoryStore) DeleteEntryMetadata(ctx context.Context, id int64, keys
 		}
 	}
 	updated.UpdatedAt = time.Now().UTC()
+	s.index.remove(id, entry.Metadata)
 	s.entries[id] = updated
+	s.index.add(id, updated.Metadata)
 	return nil
 }
 
@@ -248,13 +363,21 @@ func (s *inMemoryStore) FindEntriesByMetadata(ctx context.Context, filters map[s
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	out := []*models.Entry{}
-	for _, id := range s.ids {
+	ids := s.ids
+	if len(filters) > 0 {
+		ids = s.index.candidates(filters)
+	}
+	for _, id := range ids {
 		entry, ok := s.entries[id]
 		if !ok {
 			continue
 		}
 		if matchesMetadata(entry, filters) {
-			out = append(out, cloneEntry(entry))
+			e, err := s.loadLocked(id)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, e)
 		}
 	}
 	return out, nil
@@ -279,6 +402,14 @@ func cloneEntry(e *models.Entry) *models.Entry {
 	if e.Metadata != nil {
 		copy.Metadata = cloneMetadata(e.Metadata)
 	}
+	if e.Provenance != nil {
+		p := *e.Provenance
+		copy.Provenance = &p
+	}
+	if e.Embedder != nil {
+		m := *e.Embedder
+		copy.Embedder = &m
+	}
 	return &copy
 }
 
@@ -0,0 +1,224 @@
+// Package migrate applies versioned schema migrations to SQL-backed stores.
+//
+// Each store backend declares its schema history as an ordered list of
+// Migrations. On startup the backend calls Up, which applies every migration
+// newer than the version recorded in the schema_migrations table, one
+// transaction per step. A database whose recorded version is newer than the
+// binary knows about is refused rather than silently misread.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Migration is one schema step. Up and Down hold SQL (several statements
+// are allowed if the driver accepts them in one Exec); UpFunc and DownFunc
+// run after the SQL for data migrations that need Go code.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	UpFunc   func(ctx context.Context, tx *sql.Tx) error
+	DownFunc func(ctx context.Context, tx *sql.Tx) error
+}
+
+// Dialect captures the SQL differences between supported databases.
+type Dialect struct {
+	Name string
+	// Placeholder returns the bind parameter for the n-th (1-based) argument.
+	Placeholder func(n int) string
+	// Lock, when set, runs first in every migration transaction so replicas
+	// starting together don't apply the same step twice.
+	Lock string
+}
+
+var (
+	SQLite = Dialect{
+		Name:        "sqlite",
+		Placeholder: func(int) string { return "?" },
+	}
+	Postgres = Dialect{
+		Name:        "postgres",
+		Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		// arbitrary application-wide key for the transaction-scoped lock
+		Lock: "SELECT pg_advisory_xact_lock(727274)",
+	}
+)
+
+// ErrNewerSchema is returned when the database was migrated by a newer
+// binary than this one.
+var ErrNewerSchema = errors.New("migrate: database schema is newer than this binary")
+
+// Migrator applies a backend's migrations to one database.
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+// New validates migrations (positive, unique versions) and returns a
+// Migrator for db. Migrations may be given in any order.
+func New(db *sql.DB, d Dialect, migrations []Migration) (*Migrator, error) {
+	ms := append([]Migration(nil), migrations...)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	for i, m := range ms {
+		if m.Version <= 0 {
+			return nil, fmt.Errorf("migrate: version must be positive (got %d)", m.Version)
+		}
+		if i > 0 && ms[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migrate: duplicate version %d", m.Version)
+		}
+	}
+	return &Migrator{db: db, dialect: d, migrations: ms}, nil
+}
+
+// Latest is the highest known migration version (0 if there are none).
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`)
+	return err
+}
+
+// Current returns the version the database is at (0 for a fresh database).
+func (m *Migrator) Current(ctx context.Context) (int, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return 0, err
+	}
+	return current(ctx, m.db)
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func current(ctx context.Context, q queryer) (int, error) {
+	var v sql.NullInt64
+	if err := q.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&v); err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+// Up migrates to the latest version and returns the versions applied.
+func (m *Migrator) Up(ctx context.Context) ([]int, error) {
+	return m.To(ctx, m.Latest())
+}
+
+// To migrates up or down to target, which must be 0 or a known version, and
+// returns the versions applied (or reverted, in order).
+func (m *Migrator) To(ctx context.Context, target int) ([]int, error) {
+	if target != 0 && m.find(target) < 0 {
+		return nil, fmt.Errorf("migrate: unknown version %d", target)
+	}
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	var done []int
+	for {
+		step, err := m.step(ctx, target)
+		if err != nil {
+			return done, err
+		}
+		if step == 0 {
+			return done, nil
+		}
+		done = append(done, step)
+	}
+}
+
+// step applies the next migration toward target in its own transaction and
+// returns its version, or 0 once the database is at target. The current
+// version is re-read under the lock so concurrent migrators never repeat a
+// step.
+func (m *Migrator) step(ctx context.Context, target int) (int, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if m.dialect.Lock != "" {
+		if _, err := tx.ExecContext(ctx, m.dialect.Lock); err != nil {
+			return 0, fmt.Errorf("migrate: lock: %w", err)
+		}
+	}
+	cur, err := current(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	if cur > m.Latest() {
+		return 0, fmt.Errorf("%w (database at %d, binary knows %d)", ErrNewerSchema, cur, m.Latest())
+	}
+	if cur == target {
+		return 0, nil
+	}
+	ph := m.dialect.Placeholder
+	if cur < target {
+		next := m.migrations[m.nextAfter(cur)]
+		if err := run(ctx, tx, next.Up, next.UpFunc); err != nil {
+			return 0, fmt.Errorf("migrate: up %d (%s): %w", next.Version, next.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ("+ph(1)+", "+ph(2)+", "+ph(3)+")",
+			next.Version, next.Name, time.Now().UTC()); err != nil {
+			return 0, err
+		}
+		return next.Version, tx.Commit()
+	}
+	i := m.find(cur)
+	if i < 0 {
+		return 0, fmt.Errorf("migrate: database at unknown version %d", cur)
+	}
+	prev := m.migrations[i]
+	if prev.Down == "" && prev.DownFunc == nil {
+		return 0, fmt.Errorf("migrate: version %d (%s) is irreversible", prev.Version, prev.Name)
+	}
+	if err := run(ctx, tx, prev.Down, prev.DownFunc); err != nil {
+		return 0, fmt.Errorf("migrate: down %d (%s): %w", prev.Version, prev.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = "+ph(1), prev.Version); err != nil {
+		return 0, err
+	}
+	return prev.Version, tx.Commit()
+}
+
+func run(ctx context.Context, tx *sql.Tx, stmt string, fn func(context.Context, *sql.Tx) error) error {
+	if stmt != "" {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if fn != nil {
+		return fn(ctx, tx)
+	}
+	return nil
+}
+
+func (m *Migrator) find(version int) int {
+	for i, mg := range m.migrations {
+		if mg.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextAfter returns the index of the first migration newer than version.
+func (m *Migrator) nextAfter(version int) int {
+	return sort.Search(len(m.migrations), func(i int) bool { return m.migrations[i].Version > version })
+}
@@ -0,0 +1,103 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+var history = []Migration{
+	{Version: 1, Name: "entries",
+		Up:   `CREATE TABLE entries (id INTEGER PRIMARY KEY, prompt TEXT NOT NULL)`,
+		Down: `DROP TABLE entries`},
+	{Version: 2, Name: "provenance",
+		Up:   `ALTER TABLE entries ADD COLUMN model TEXT; UPDATE entries SET model = 'unknown'`,
+		Down: `ALTER TABLE entries DROP COLUMN model`},
+}
+
+func TestMigrator_UpAndDown(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	m, err := New(db, SQLite, history[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := m.Up(ctx); err != nil || len(applied) != 1 {
+		t.Fatalf("expected [1] got %v (%v)", applied, err)
+	}
+	if _, err := db.Exec(`INSERT INTO entries (prompt) VALUES ('hello')`); err != nil {
+		t.Fatal(err)
+	}
+
+	// a newer binary upgrades existing data in place
+	m, _ = New(db, SQLite, history)
+	applied, err := m.Up(ctx)
+	if err != nil || len(applied) != 1 || applied[0] != 2 {
+		t.Fatalf("expected [2] got %v (%v)", applied, err)
+	}
+	var model string
+	if err := db.QueryRow(`SELECT model FROM entries`).Scan(&model); err != nil || model != "unknown" {
+		t.Fatalf("expected backfilled model got %q (%v)", model, err)
+	}
+	if applied, _ := m.Up(ctx); len(applied) != 0 {
+		t.Fatalf("expected no-op got %v", applied)
+	}
+
+	// the old binary refuses the newer schema
+	old, _ := New(db, SQLite, history[:1])
+	if _, err := old.Up(ctx); !errors.Is(err, ErrNewerSchema) {
+		t.Fatalf("expected ErrNewerSchema got %v", err)
+	}
+
+	reverted, err := m.To(ctx, 0)
+	if err != nil || len(reverted) != 2 || reverted[0] != 2 {
+		t.Fatalf("expected [2 1] got %v (%v)", reverted, err)
+	}
+	if v, _ := m.Current(ctx); v != 0 {
+		t.Fatalf("expected version 0 got %d", v)
+	}
+}
+
+func TestMigrator_FailedStepRollsBack(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	bad := append(append([]Migration(nil), history...), Migration{
+		Version: 3, Name: "broken",
+		Up: `CREATE TABLE tags (id INTEGER); INSERT INTO nope VALUES (1)`,
+	})
+	m, _ := New(db, SQLite, bad)
+	applied, err := m.Up(ctx)
+	if err == nil || len(applied) != 2 {
+		t.Fatalf("expected failure after [1 2] got %v (%v)", applied, err)
+	}
+	if v, _ := m.Current(ctx); v != 2 {
+		t.Fatalf("expected version 2 got %d", v)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'tags'`).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("expected partial step rolled back, tags tables=%d (%v)", n, err)
+	}
+}
+
+func TestNew_RejectsBadVersions(t *testing.T) {
+	if _, err := New(nil, SQLite, []Migration{{Version: 1}, {Version: 1}}); err == nil {
+		t.Fatal("expected duplicate version error")
+	}
+	if _, err := New(nil, SQLite, []Migration{{Version: 0}}); err == nil {
+		t.Fatal("expected non-positive version error")
+	}
+}
@@ -0,0 +1,593 @@
+// Package milvus is a Store backed by a Milvus collection, spoken to over
+// Milvus's RESTful API (v2), so it needs no SDK. Each entry is a row holding
+// its ID, its embedding and the entry itself as JSON; metadata keys named
+// in Options.Fields are also copied into indexed scalar fields, which
+// filtered searches use instead of the JSON.
+package milvus
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// Options configures the collection. Dim is required: a Milvus vector field
+// has a fixed dimension, so changing the embedding model needs a new
+// collection.
+type Options struct {
+	// URL is the Milvus endpoint, e.g. http://localhost:19530.
+	URL string
+	// Token is sent as a bearer token: "user:password" or an API key.
+	Token      string
+	Collection string
+	Dim        int
+	// Index is the vector index built with the collection: HNSW (the
+	// default) or IVF_FLAT.
+	Index string
+	// Fields are the metadata keys kept in scalar fields as well, for
+	// filtered search. They can't be changed once the collection exists.
+	Fields []string
+}
+
+const (
+	// queryLimit is the most rows Milvus returns from one query.
+	queryLimit = 16384
+	// maxFieldLen is the length of the scalar metadata fields; longer
+	// values are only kept in the JSON.
+	maxFieldLen = 512
+	// fieldPrefix names the scalar field of a metadata key.
+	fieldPrefix = "meta_"
+)
+
+var fieldName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Store is the Milvus Store. Besides the Store interface it implements the
+// filtered search and vector reads. Namespaces, synonyms, serve limits and
+// hit statistics aren't kept, as with any store lacking those interfaces.
+type Store struct {
+	opts   Options
+	client *http.Client
+	ids    *idGenerator
+}
+
+// Open connects to Milvus and creates the collection, with its vector and
+// scalar indexes, unless it exists; an existing one is checked to have the
+// configured dimension and fields, then loaded. Wrap it in store.NewLazy to
+// start before Milvus is reachable.
+func Open(ctx context.Context, opts Options) (*Store, error) {
+	if opts.Dim <= 0 {
+		return nil, errors.New("milvus: the vector dimension is required")
+	}
+	if opts.Collection == "" {
+		opts.Collection = "slmcache"
+	}
+	switch opts.Index {
+	case "":
+		opts.Index = "HNSW"
+	case "HNSW", "IVF_FLAT":
+	default:
+		return nil, fmt.Errorf("milvus: unknown index %q (want HNSW or IVF_FLAT)", opts.Index)
+	}
+	for _, k := range opts.Fields {
+		if !fieldName.MatchString(k) {
+			return nil, fmt.Errorf("milvus: metadata key %q can't name a field", k)
+		}
+	}
+	opts.URL = strings.TrimRight(opts.URL, "/")
+	s := &Store{opts: opts, client: &http.Client{Timeout: 30 * time.Second}, ids: newIDGenerator()}
+	var has struct {
+		Has bool `json:"has"`
+	}
+	if err := s.call(ctx, "collections/has", nil, &has); err != nil {
+		return nil, err
+	}
+	if !has.Has {
+		return s, s.call(ctx, "collections/create", s.schema(), nil)
+	}
+	if err := s.check(ctx); err != nil {
+		return nil, err
+	}
+	return s, s.call(ctx, "collections/load", nil, nil)
+}
+
+// schema is the body creating the collection. Strong consistency lets a
+// write be read back at once, as the other stores allow.
+func (s *Store) schema() map[string]any {
+	fields := []map[string]any{
+		{"fieldName": "id", "dataType": "Int64", "isPrimary": true},
+		{"fieldName": "vector", "dataType": "FloatVector", "elementTypeParams": map[string]any{"dim": s.opts.Dim}},
+		{"fieldName": "entry", "dataType": "JSON"},
+	}
+	vectorParams := map[string]any{"M": 16, "efConstruction": 200}
+	if s.opts.Index == "IVF_FLAT" {
+		vectorParams = map[string]any{"nlist": 1024}
+	}
+	indexes := []map[string]any{
+		{"fieldName": "vector", "indexName": "vector", "metricType": "COSINE", "indexType": s.opts.Index, "params": vectorParams},
+	}
+	for _, k := range s.opts.Fields {
+		fields = append(fields, map[string]any{"fieldName": fieldPrefix + k, "dataType": "VarChar", "elementTypeParams": map[string]any{"max_length": maxFieldLen}})
+		indexes = append(indexes, map[string]any{"fieldName": fieldPrefix + k, "indexName": fieldPrefix + k, "indexType": "INVERTED"})
+	}
+	return map[string]any{
+		"schema":      map[string]any{"autoId": false, "enableDynamicField": false, "fields": fields},
+		"indexParams": indexes,
+		"params":      map[string]any{"consistencyLevel": "Strong"},
+	}
+}
+
+// check compares an existing collection with the options.
+func (s *Store) check(ctx context.Context) error {
+	var desc struct {
+		Fields []struct {
+			Name   string `json:"name"`
+			Params []struct {
+				Key   string `json:"key"`
+				Value any    `json:"value"`
+			} `json:"params"`
+		} `json:"fields"`
+	}
+	if err := s.call(ctx, "collections/describe", nil, &desc); err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for _, f := range desc.Fields {
+		have[f.Name] = true
+		if f.Name != "vector" {
+			continue
+		}
+		for _, p := range f.Params {
+			if p.Key == "dim" && fmt.Sprint(p.Value) != strconv.Itoa(s.opts.Dim) {
+				return fmt.Errorf("milvus: collection %s holds %v-dimensional vectors, not %d", s.opts.Collection, p.Value, s.opts.Dim)
+			}
+		}
+	}
+	for _, k := range s.opts.Fields {
+		if !have[fieldPrefix+k] {
+			return fmt.Errorf("milvus: collection %s has no field for metadata key %q; fields can't be added to an existing collection", s.opts.Collection, k)
+		}
+	}
+	return nil
+}
+
+// call posts body, with the collection's name added, to a v2 endpoint and
+// decodes the response's data into out.
+func (s *Store) call(ctx context.Context, endpoint string, body map[string]any, out any) error {
+	if body == nil {
+		body = map[string]any{}
+	}
+	body["collectionName"] = s.opts.Collection
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.URL+"/v2/vectordb/"+endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.opts.Token)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("milvus: %s: %s", endpoint, res.Status)
+	}
+	var reply struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("milvus: %s: %w", endpoint, err)
+	}
+	if reply.Code != 0 {
+		return fmt.Errorf("milvus: %s: %s (code %d)", endpoint, reply.Message, reply.Code)
+	}
+	if out == nil || len(reply.Data) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(reply.Data))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
+
+func (s *Store) Health(ctx context.Context) error {
+	return s.call(ctx, "collections/has", nil, nil)
+}
+
+func (s *Store) Capabilities() store.Capabilities {
+	return store.Capabilities{FilteredSearch: true, Transactions: true}
+}
+
+var errNotFound = errors.New("not found")
+
+// row is an entry as Milvus returns it.
+type row struct {
+	ID     rowID           `json:"id"`
+	Entry  json.RawMessage `json:"entry"`
+	Vector []float64       `json:"vector"`
+}
+
+// rowID takes an Int64 primary key sent as a number or a string.
+type rowID int64
+
+func (id *rowID) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*id = rowID(n)
+	return err
+}
+
+func (r row) entry() (*models.Entry, error) {
+	var e models.Entry
+	if err := json.Unmarshal(r.Entry, &e); err != nil {
+		return nil, fmt.Errorf("milvus: entry %d: %w", r.ID, err)
+	}
+	e.ID = int64(r.ID)
+	return &e, nil
+}
+
+// record is the row written for e.
+func (s *Store) record(id int64, e *models.Entry, vec []float64) (map[string]any, error) {
+	if len(vec) != s.opts.Dim {
+		return nil, fmt.Errorf("milvus: the collection holds %d-dimensional vectors, not %d", s.opts.Dim, len(vec))
+	}
+	e.ID = id
+	doc, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	rec := map[string]any{"id": id, "vector": vec, "entry": json.RawMessage(doc)}
+	for _, k := range s.opts.Fields {
+		rec[fieldPrefix+k] = fieldValue(e.Metadata[k])
+	}
+	return rec, nil
+}
+
+// fieldValue is v as its scalar field holds it: the fmt.Sprint form filters
+// compare against, or "" for values that aren't scalars or are too long.
+func fieldValue(v any) string {
+	switch v.(type) {
+	case string, bool, float64, float32, int, int32, int64, uint, uint32, uint64:
+		if s := fmt.Sprint(v); len(s) <= maxFieldLen {
+			return s
+		}
+	}
+	return ""
+}
+
+func (s *Store) CreateEntryWithVector(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
+	if e == nil {
+		return 0, errors.New("nil entry")
+	}
+	now := time.Now().UTC()
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = now
+	}
+	e.UpdatedAt = now
+	rec, err := s.record(s.ids.next(), e, vec)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.call(ctx, "entities/insert", map[string]any{"data": []any{rec}}, nil); err != nil {
+		return 0, err
+	}
+	return e.ID, nil
+}
+
+func (s *Store) UpdateEntryWithVector(ctx context.Context, id int64, e *models.Entry, vec []float64) error {
+	return s.modify(ctx, id, vec, func(current *models.Entry) error {
+		now := time.Now().UTC()
+		if !current.CreatedAt.IsZero() {
+			e.CreatedAt = current.CreatedAt
+		} else if e.CreatedAt.IsZero() {
+			e.CreatedAt = now
+		}
+		e.UpdatedAt = now
+		// statistics belong to the entry, not to what it says
+		e.HitCount, e.LastHitAt, e.CreatedBy = current.HitCount, current.LastHitAt, current.CreatedBy
+		*current = *e
+		return nil
+	})
+}
+
+// modify reads entry id, lets fn change it and upserts it, with vec as its
+// new embedding unless nil. Milvus has no row locks, so concurrent changes
+// to one entry can overwrite each other; the last upsert wins.
+func (s *Store) modify(ctx context.Context, id int64, vec []float64, fn func(*models.Entry) error) error {
+	rows, err := s.get(ctx, []int64{id}, vec == nil)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return errNotFound
+	}
+	e, err := rows[0].entry()
+	if err != nil {
+		return err
+	}
+	if err := fn(e); err != nil {
+		return err
+	}
+	if vec == nil {
+		vec = rows[0].Vector
+	}
+	rec, err := s.record(id, e, vec)
+	if err != nil {
+		return err
+	}
+	return s.call(ctx, "entities/upsert", map[string]any{"data": []any{rec}}, nil)
+}
+
+// get reads rows by ID, with their vectors when withVector is set.
+func (s *Store) get(ctx context.Context, ids []int64, withVector bool) ([]row, error) {
+	fields := []string{"id", "entry"}
+	if withVector {
+		fields = append(fields, "vector")
+	}
+	var rows []row
+	err := s.call(ctx, "entities/get", map[string]any{"id": ids, "outputFields": fields}, &rows)
+	return rows, err
+}
+
+func (s *Store) GetEntry(ctx context.Context, id int64) (*models.Entry, error) {
+	rows, err := s.get(ctx, []int64{id}, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errNotFound
+	}
+	return rows[0].entry()
+}
+
+func (s *Store) GetVector(ctx context.Context, id int64) ([]float64, error) {
+	rows, err := s.get(ctx, []int64{id}, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errNotFound
+	}
+	return rows[0].Vector, nil
+}
+
+func (s *Store) SearchByVector(ctx context.Context, vec []float64, limit int) ([]int64, []float64, error) {
+	return s.SearchByVectorFiltered(ctx, vec, limit, nil)
+}
+
+// SearchByVectorFiltered returns the limit entries closest to vec by cosine
+// similarity among those matching filters. Vectors of another dimension
+// can't be compared, so they match nothing, as in the other stores.
+func (s *Store) SearchByVectorFiltered(ctx context.Context, vec []float64, limit int, filters map[string]string) ([]int64, []float64, error) {
+	if limit <= 0 || len(vec) != s.opts.Dim {
+		return nil, nil, nil
+	}
+	body := map[string]any{
+		"data":         [][]float64{vec},
+		"annsField":    "vector",
+		"limit":        min(limit, queryLimit),
+		"outputFields": []string{"id"},
+		"searchParams": map[string]any{"metricType": "COSINE", "params": map[string]any{"ef": max(limit, 64), "nprobe": 16}},
+	}
+	if expr := s.filterExpr(filters); expr != "" {
+		body["filter"] = expr
+	}
+	var hits []struct {
+		ID       rowID       `json:"id"`
+		Distance json.Number `json:"distance"`
+	}
+	if err := s.call(ctx, "entities/search", body, &hits); err != nil {
+		return nil, nil, err
+	}
+	ids := make([]int64, 0, len(hits))
+	scores := make([]float64, 0, len(hits))
+	for _, h := range hits {
+		// with the COSINE metric, the distance is the similarity
+		score, _ := h.Distance.Float64()
+		ids = append(ids, int64(h.ID))
+		scores = append(scores, score)
+	}
+	return ids, scores, nil
+}
+
+// filterExpr is the Milvus boolean expression for filters. Keys with a
+// scalar field compare against it; the rest, and values too long for the
+// field, against the JSON, where a number or bool matches its text form.
+// An empty value only needs the key to be present, as in the other stores.
+func (s *Store) filterExpr(filters map[string]string) string {
+	keys := make([]string, 0, len(filters))
+	for k := range filters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	mapped := map[string]bool{}
+	for _, k := range s.opts.Fields {
+		mapped[k] = true
+	}
+	conds := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := filters[k]
+		path := `entry["metadata"][` + quote(k) + `]`
+		switch {
+		case v == "":
+			conds = append(conds, "exists "+path)
+		case mapped[k] && len(v) <= maxFieldLen:
+			conds = append(conds, fieldPrefix+k+" == "+quote(v))
+		default:
+			alts := []string{path + " == " + quote(v)}
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				alts = append(alts, path+" == "+v)
+			}
+			if v == "true" || v == "false" {
+				alts = append(alts, path+" == "+v)
+			}
+			conds = append(conds, "("+strings.Join(alts, " or ")+")")
+		}
+	}
+	return strings.Join(conds, " and ")
+}
+
+// quote is v as a Milvus string literal.
+func quote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// AllIDs returns every entry's ID in ascending order, or none when Milvus
+// can't be read.
+func (s *Store) AllIDs() []int64 {
+	rows, err := s.scan(context.Background(), "", []string{"id"})
+	if err != nil {
+		return []int64{}
+	}
+	ids := make([]int64, len(rows))
+	for i, r := range rows {
+		ids[i] = int64(r.ID)
+	}
+	return ids
+}
+
+func (s *Store) FindEntriesByMetadata(ctx context.Context, filters map[string]string) ([]*models.Entry, error) {
+	rows, err := s.scan(ctx, s.filterExpr(filters), []string{"id", "entry"})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*models.Entry, 0, len(rows))
+	for _, r := range rows {
+		e, err := r.entry()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// scan returns every row matching expr in ID order. A query returns at most
+// queryLimit rows, and not necessarily the lowest IDs, so a range that
+// fills a page is split in two and each half read on its own.
+func (s *Store) scan(ctx context.Context, expr string, fields []string) ([]row, error) {
+	var out []row
+	var read func(lo, hi int64) error
+	read = func(lo, hi int64) error {
+		cond := fmt.Sprintf("id > %d and id <= %d", lo, hi)
+		if expr != "" {
+			cond += " and (" + expr + ")"
+		}
+		var rows []row
+		if err := s.call(ctx, "entities/query", map[string]any{"filter": cond, "limit": queryLimit, "outputFields": fields}, &rows); err != nil {
+			return err
+		}
+		if len(rows) < queryLimit || hi-lo <= queryLimit {
+			out = append(out, rows...)
+			return nil
+		}
+		mid := lo + (hi-lo)/2
+		if err := read(lo, mid); err != nil {
+			return err
+		}
+		return read(mid, hi)
+	}
+	if err := read(0, maxID); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (s *Store) DeleteEntry(ctx context.Context, id int64) error {
+	if _, err := s.GetEntry(ctx, id); err != nil {
+		return err
+	}
+	return s.call(ctx, "entities/delete", map[string]any{"filter": fmt.Sprintf("id in [%d]", id)}, nil)
+}
+
+func (s *Store) UpdateEntryMetadata(ctx context.Context, id int64, metadata map[string]interface{}, replace bool) error {
+	return s.modify(ctx, id, nil, func(e *models.Entry) error {
+		if replace {
+			e.Metadata = metadata
+		} else {
+			if e.Metadata == nil {
+				e.Metadata = make(map[string]interface{}, len(metadata))
+			}
+			for k, v := range metadata {
+				e.Metadata[k] = v
+			}
+		}
+		e.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+func (s *Store) DeleteEntryMetadata(ctx context.Context, id int64, keys ...string) error {
+	return s.modify(ctx, id, nil, func(e *models.Entry) error {
+		if len(keys) == 0 {
+			e.Metadata = nil
+		}
+		for _, k := range keys {
+			delete(e.Metadata, k)
+		}
+		e.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+// IDs are made by the store, since Milvus only generates keys it won't let
+// an upsert keep. They are time ordered, like the sequences of the other
+// stores, and unique across replicas: 41 bits of milliseconds since idEpoch,
+// 10 bits of a node number picked at random per process, and 12 of a
+// counter.
+var idEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const maxID = math.MaxInt64
+
+type idGenerator struct {
+	mu   sync.Mutex
+	node int64
+	last int64 // milliseconds since idEpoch of the last ID
+	seq  int64
+}
+
+func newIDGenerator() *idGenerator {
+	var b [2]byte
+	_, _ = rand.Read(b[:])
+	return &idGenerator{node: int64(binary.BigEndian.Uint16(b[:]) & 0x3ff)}
+}
+
+func (g *idGenerator) next() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := time.Since(idEpoch).Milliseconds()
+	if ms <= g.last {
+		// the same millisecond, or the clock went back: keep counting
+		ms = g.last
+		g.seq++
+		if g.seq > 0xfff {
+			ms++
+			g.seq = 0
+		}
+	} else {
+		g.seq = 0
+	}
+	g.last = ms
+	return ms<<22 | g.node<<12 | g.seq
+}
@@ -0,0 +1,107 @@
+package milvus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+func TestFilterExpr(t *testing.T) {
+	s := &Store{opts: Options{Fields: []string{"source"}}}
+	expr := s.filterExpr(map[string]string{"source": "faq", "max_hits": "1", "tag": `say "hi"`, "pinned": ""})
+	want := `(entry["metadata"]["max_hits"] == "1" or entry["metadata"]["max_hits"] == 1) and exists entry["metadata"]["pinned"] and meta_source == "faq" and (entry["metadata"]["tag"] == "say \"hi\"")`
+	if expr != want {
+		t.Fatalf("expected %s got %s", want, expr)
+	}
+	if s.filterExpr(nil) != "" {
+		t.Fatalf("expected no expression without filters")
+	}
+}
+
+func TestRecordCopiesMappedMetadata(t *testing.T) {
+	s := &Store{opts: Options{Dim: 2, Fields: []string{"source", "max_hits", "tags"}}}
+	rec, err := s.record(7, &models.Entry{Prompt: "p", Metadata: map[string]interface{}{"source": "faq", "max_hits": float64(3), "tags": []interface{}{"a"}}}, []float64{1, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["meta_source"] != "faq" || rec["meta_max_hits"] != "3" || rec["meta_tags"] != "" {
+		t.Fatalf("expected scalar values in their text form got %v", rec)
+	}
+	if _, err := s.record(7, &models.Entry{}, []float64{1, 0, 0}); err == nil {
+		t.Fatalf("expected a vector of another dimension to be refused")
+	}
+}
+
+func TestIDsAreUniqueAndOrdered(t *testing.T) {
+	g := newIDGenerator()
+	last := int64(0)
+	for i := 0; i < 10000; i++ {
+		id := g.next()
+		if id <= last {
+			t.Fatalf("expected ids to grow, got %d after %d", id, last)
+		}
+		last = id
+	}
+	var r struct{ ID rowID }
+	if err := json.Unmarshal([]byte(fmt.Sprintf(`{"ID":"%d"}`, last)), &r); err != nil || int64(r.ID) != last {
+		t.Fatalf("expected a string id to decode exactly got %d (%v)", r.ID, err)
+	}
+}
+
+// TestStore runs against the Milvus at SLC_TEST_MILVUS_URL, in a collection
+// it drops first, and is skipped without one.
+func TestStore(t *testing.T) {
+	url := os.Getenv("SLC_TEST_MILVUS_URL")
+	if url == "" {
+		t.Skip("SLC_TEST_MILVUS_URL not set")
+	}
+	ctx := context.Background()
+	opts := Options{URL: url, Token: os.Getenv("SLC_TEST_MILVUS_TOKEN"), Collection: "slmcache_test", Dim: 3, Fields: []string{"source"}}
+	drop := &Store{opts: opts, client: http.DefaultClient}
+	_ = drop.call(ctx, "collections/drop", nil, nil)
+	st, err := Open(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	faq, err := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "What is Kubernetes", Response: "an orchestrator", Metadata: map[string]interface{}{"source": "faq", "max_hits": 1}}, []float64{1, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blog, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "What is a pod", Response: "a group of containers", Metadata: map[string]interface{}{"source": "blog"}}, []float64{0.9, 0.1, 0})
+
+	ids, scores, err := st.SearchByVector(ctx, []float64{1, 0, 0}, 5)
+	if err != nil || fmt.Sprint(ids) != fmt.Sprint([]int64{faq, blog}) || scores[0] < 0.999 {
+		t.Fatalf("expected %d then %d got %v %v (%v)", faq, blog, ids, scores, err)
+	}
+	if ids, _, _ := st.SearchByVectorFiltered(ctx, []float64{1, 0, 0}, 5, map[string]string{"source": "blog"}); fmt.Sprint(ids) != fmt.Sprint([]int64{blog}) {
+		t.Fatalf("expected only %d with source=blog got %v", blog, ids)
+	}
+	if found, _ := st.FindEntriesByMetadata(ctx, map[string]string{"max_hits": "1"}); len(found) != 1 || found[0].ID != faq {
+		t.Fatalf("expected numbers to match their text form got %v", found)
+	}
+	if all := st.AllIDs(); fmt.Sprint(all) != fmt.Sprint([]int64{faq, blog}) {
+		t.Fatalf("expected both ids in order got %v", all)
+	}
+
+	if err := st.UpdateEntryMetadata(ctx, blog, map[string]interface{}{"source": "docs"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _, _ := st.SearchByVectorFiltered(ctx, []float64{1, 0, 0}, 5, map[string]string{"source": "docs"}); fmt.Sprint(ids) != fmt.Sprint([]int64{blog}) {
+		t.Fatalf("expected the scalar field to follow the metadata got %v", ids)
+	}
+	if vec, _ := st.GetVector(ctx, blog); fmt.Sprint(vec) != "[0.9 0.1 0]" {
+		t.Fatalf("expected a metadata update to keep the vector got %v", vec)
+	}
+	if err := st.DeleteEntry(ctx, faq); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.GetEntry(ctx, faq); err == nil {
+		t.Fatalf("expected %d to be gone", faq)
+	}
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// ErrNamespaceNotFound is returned by DeleteNamespace for a namespace that
+// was never declared.
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+// NamespaceStore is implemented by stores that persist the namespaces
+// declared through the API, so every replica shares their settings and they
+// survive restarts.
+type NamespaceStore interface {
+	// Namespaces returns every declared namespace, ordered by name.
+	Namespaces(ctx context.Context) ([]models.Namespace, error)
+	// PutNamespace declares ns or replaces its settings.
+	PutNamespace(ctx context.Context, ns models.Namespace) error
+	// DeleteNamespace forgets the namespace's settings; its entries are
+	// the caller's to delete.
+	DeleteNamespace(ctx context.Context, name string) error
+}
+
+func (s *inMemoryStore) Namespaces(ctx context.Context) ([]models.Namespace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedNamespaces(s.namespaces), nil
+}
+
+func (s *inMemoryStore) PutNamespace(ctx context.Context, ns models.Namespace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.namespaces[ns.Name] = ns
+	return nil
+}
+
+func (s *inMemoryStore) DeleteNamespace(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.namespaces[name]; !ok {
+		return ErrNamespaceNotFound
+	}
+	delete(s.namespaces, name)
+	return nil
+}
+
+func sortedNamespaces(m map[string]models.Namespace) []models.Namespace {
+	out := make([]models.Namespace, 0, len(m))
+	for _, ns := range m {
+		out = append(out, ns)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func namespacesByName(list []models.Namespace) map[string]models.Namespace {
+	out := make(map[string]models.Namespace, len(list))
+	for _, ns := range list {
+		out[ns.Name] = ns
+	}
+	return out
+}
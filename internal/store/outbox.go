@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// OutboxMessage is an outbound message (an event or a webhook call) waiting
+// to be delivered.
+type OutboxMessage struct {
+	// Seq orders messages; the store assigns it on append.
+	Seq uint64 `json:"seq"`
+	// Sink names the delivery channel, e.g. "events" or "webhook"; messages
+	// of one sink are delivered in Seq order.
+	Sink string `json:"sink"`
+	// Target is the sink's destination, such as a webhook URL.
+	Target  string          `json:"target,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Key     string          `json:"key,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+	Created time.Time       `json:"created"`
+}
+
+// Outbox is implemented by stores that persist outbound messages until
+// they are delivered, so deliveries survive restarts (and, in cluster mode,
+// leader changes) instead of living in one process's memory.
+type Outbox interface {
+	// AppendOutbox adds msgs after every pending message, assigning their
+	// sequence numbers.
+	AppendOutbox(ctx context.Context, msgs []OutboxMessage) error
+	// PendingOutbox returns up to limit pending messages in sequence order;
+	// limit <= 0 returns all of them.
+	PendingOutbox(ctx context.Context, limit int) ([]OutboxMessage, error)
+	// AckOutbox removes delivered messages.
+	AckOutbox(ctx context.Context, seqs ...uint64) error
+}
+
+func (s *inMemoryStore) AppendOutbox(ctx context.Context, msgs []OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range msgs {
+		s.outboxSeq++
+		m.Seq = s.outboxSeq
+		s.outbox = append(s.outbox, m)
+	}
+	return nil
+}
+
+func (s *inMemoryStore) PendingOutbox(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if limit <= 0 || limit > len(s.outbox) {
+		limit = len(s.outbox)
+	}
+	return slices.Clone(s.outbox[:limit]), nil
+}
+
+func (s *inMemoryStore) AckOutbox(ctx context.Context, seqs ...uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outbox = slices.DeleteFunc(s.outbox, func(m OutboxMessage) bool { return slices.Contains(seqs, m.Seq) })
+	return nil
+}
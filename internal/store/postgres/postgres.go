@@ -0,0 +1,577 @@
+// Package postgres is a Store backed by Postgres with the pgvector
+// extension. Entries are kept as JSONB next to their embedding, vector
+// search orders by pgvector's cosine distance (<=>), and metadata filters
+// query the JSONB, so any number of replicas can share one database.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+	"github.com/jeefy/slmcache/internal/store/migrate"
+)
+
+// migrations is the schema history. The embedding column takes vectors of
+// any dimension, so changing the embedding model needs no migration; see
+// the README for pinning it to add an HNSW index.
+var migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "entries",
+		Up: `CREATE EXTENSION IF NOT EXISTS vector;
+CREATE TABLE entries (
+	id BIGSERIAL PRIMARY KEY,
+	entry JSONB NOT NULL,
+	embedding vector NOT NULL
+);
+CREATE TABLE namespaces (name TEXT PRIMARY KEY, settings JSONB NOT NULL);
+CREATE TABLE synonyms (namespace TEXT PRIMARY KEY, dictionary JSONB NOT NULL);
+CREATE TABLE outbox (seq BIGSERIAL PRIMARY KEY, message JSONB NOT NULL);
+CREATE TABLE leases (name TEXT PRIMARY KEY, holder TEXT NOT NULL, expires TIMESTAMPTZ NOT NULL);`,
+		Down: `DROP TABLE leases, outbox, synonyms, namespaces, entries;`,
+	},
+}
+
+// Store is the Postgres Store. Besides the Store interface it implements
+// the filtered and embedder searches, vector reads, namespaces, synonyms,
+// the outbox, serve limits, hit statistics and leases, so replicas sharing
+// the database also share all of those.
+type Store struct {
+	db *sql.DB
+}
+
+// Open connects to the database at dsn, a lib/pq connection string or URL,
+// and migrates its schema to the latest version. Wrap it in store.NewLazy to
+// start before the database is reachable.
+func Open(ctx context.Context, dsn string) (*Store, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	m, err := migrate.New(db, migrate.Postgres, migrations)
+	if err == nil {
+		_, err = m.Up(ctx)
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("postgres: migrate: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error { return s.db.Close() }
+
+func (s *Store) Health(ctx context.Context) error { return s.db.PingContext(ctx) }
+
+func (s *Store) Capabilities() store.Capabilities {
+	return store.Capabilities{FilteredSearch: true, EmbedderSearch: true, Transactions: true}
+}
+
+var errNotFound = errors.New("not found")
+
+func (s *Store) CreateEntryWithVector(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
+	if e == nil {
+		return 0, errors.New("nil entry")
+	}
+	now := time.Now().UTC()
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = now
+	}
+	e.UpdatedAt = now
+	doc, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = s.db.QueryRowContext(ctx, `INSERT INTO entries (entry, embedding) VALUES ($1, $2) RETURNING id`, string(doc), vectorText(vec)).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	e.ID = id
+	return id, nil
+}
+
+func (s *Store) UpdateEntryWithVector(ctx context.Context, id int64, e *models.Entry, vec []float64) error {
+	return s.modify(ctx, id, vec, func(current *models.Entry) error {
+		now := time.Now().UTC()
+		e.ID = id
+		if !current.CreatedAt.IsZero() {
+			e.CreatedAt = current.CreatedAt
+		} else if e.CreatedAt.IsZero() {
+			e.CreatedAt = now
+		}
+		e.UpdatedAt = now
+		// statistics belong to the entry, not to what it says
+		e.HitCount, e.LastHitAt, e.CreatedBy = current.HitCount, current.LastHitAt, current.CreatedBy
+		*current = *e
+		return nil
+	})
+}
+
+// modify reads entry id under a row lock, lets fn change it and writes it
+// back, with vec as its new embedding unless nil.
+func (s *Store) modify(ctx context.Context, id int64, vec []float64, fn func(*models.Entry) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var doc []byte
+	if err := tx.QueryRowContext(ctx, `SELECT entry FROM entries WHERE id = $1 FOR UPDATE`, id).Scan(&doc); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotFound
+		}
+		return err
+	}
+	var e models.Entry
+	if err := json.Unmarshal(doc, &e); err != nil {
+		return err
+	}
+	e.ID = id
+	if err := fn(&e); err != nil {
+		return err
+	}
+	if doc, err = json.Marshal(&e); err != nil {
+		return err
+	}
+	if vec != nil {
+		_, err = tx.ExecContext(ctx, `UPDATE entries SET entry = $2, embedding = $3 WHERE id = $1`, id, string(doc), vectorText(vec))
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE entries SET entry = $2 WHERE id = $1`, id, string(doc))
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) GetEntry(ctx context.Context, id int64) (*models.Entry, error) {
+	entries, err := s.query(ctx, `SELECT id, entry FROM entries WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errNotFound
+	}
+	return entries[0], nil
+}
+
+func (s *Store) SearchByVector(ctx context.Context, vec []float64, limit int) ([]int64, []float64, error) {
+	return s.search(ctx, vec, limit, nil, nil)
+}
+
+func (s *Store) SearchByVectorFiltered(ctx context.Context, vec []float64, limit int, filters map[string]string) ([]int64, []float64, error) {
+	return s.search(ctx, vec, limit, nil, filters)
+}
+
+func (s *Store) SearchByVectorFrom(ctx context.Context, vec []float64, limit int, embedder *models.Embedder, filters map[string]string) ([]int64, []float64, error) {
+	return s.search(ctx, vec, limit, embedder, filters)
+}
+
+// search returns the limit entries closest to vec by cosine similarity,
+// among those matching filters and, when embedder is set, embedded by a
+// comparable model. Vectors of another dimension can't be compared and
+// are skipped, as the in-memory store scores them 0.
+func (s *Store) search(ctx context.Context, vec []float64, limit int, embedder *models.Embedder, filters map[string]string) ([]int64, []float64, error) {
+	if limit <= 0 || len(vec) == 0 {
+		return nil, nil, nil
+	}
+	args := []any{vectorText(vec), len(vec), limit}
+	conds := []string{"vector_dims(embedding) = $2"}
+	conds, args = metadataConds(conds, args, filters)
+	if embedder != nil {
+		args = append(args, embedder.Backend, embedder.Model, embedder.Version)
+		n := len(args)
+		conds = append(conds, fmt.Sprintf(`(entry->'embedder' IS NULL OR (entry->'embedder'->>'backend' = $%d::text AND coalesce(entry->'embedder'->>'model', '') = $%d::text AND ($%d::text = '' OR coalesce(entry->'embedder'->>'version', '') IN ('', $%d::text))))`, n-2, n-1, n, n))
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, 1 - (embedding <=> $1::vector) FROM entries WHERE `+strings.Join(conds, " AND ")+` ORDER BY embedding <=> $1::vector LIMIT $3`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	var scores []float64
+	for rows.Next() {
+		var id int64
+		var score sql.NullFloat64
+		if err := rows.Scan(&id, &score); err != nil {
+			return nil, nil, err
+		}
+		// zero vectors have no direction; pgvector scores them NaN and
+		// ranks them last, the in-memory store scores them 0
+		if math.IsNaN(score.Float64) {
+			score.Float64 = 0
+		}
+		ids = append(ids, id)
+		scores = append(scores, score.Float64)
+	}
+	return ids, scores, rows.Err()
+}
+
+// AllIDs returns every entry's ID in ascending order, or none when the
+// database can't be read.
+func (s *Store) AllIDs() []int64 {
+	rows, err := s.db.Query(`SELECT id FROM entries ORDER BY id`)
+	if err != nil {
+		return []int64{}
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (s *Store) DeleteEntry(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM entries WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *Store) UpdateEntryMetadata(ctx context.Context, id int64, metadata map[string]interface{}, replace bool) error {
+	return s.modify(ctx, id, nil, func(e *models.Entry) error {
+		if replace {
+			e.Metadata = metadata
+		} else {
+			if e.Metadata == nil {
+				e.Metadata = make(map[string]interface{}, len(metadata))
+			}
+			for k, v := range metadata {
+				e.Metadata[k] = v
+			}
+		}
+		e.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+func (s *Store) DeleteEntryMetadata(ctx context.Context, id int64, keys ...string) error {
+	return s.modify(ctx, id, nil, func(e *models.Entry) error {
+		if len(keys) == 0 {
+			e.Metadata = nil
+		}
+		for _, k := range keys {
+			delete(e.Metadata, k)
+		}
+		e.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+func (s *Store) FindEntriesByMetadata(ctx context.Context, filters map[string]string) ([]*models.Entry, error) {
+	conds, args := metadataConds([]string{"TRUE"}, nil, filters)
+	return s.query(ctx, `SELECT id, entry FROM entries WHERE `+strings.Join(conds, " AND ")+` ORDER BY id`, args...)
+}
+
+func (s *Store) GetVector(ctx context.Context, id int64) ([]float64, error) {
+	var text string
+	err := s.db.QueryRowContext(ctx, `SELECT embedding::text FROM entries WHERE id = $1`, id).Scan(&text)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseVector(text)
+}
+
+// ConsumeServe counts the serve under the entry's row lock, so replicas
+// sharing the database never serve it more often than max_hits allows.
+func (s *Store) ConsumeServe(ctx context.Context, id int64) (int, error) {
+	left := -1
+	err := s.modify(ctx, id, nil, func(e *models.Entry) error {
+		limit := e.Count(models.MetaMaxHits)
+		if limit == 0 {
+			return errUnlimited
+		}
+		served := e.Count(models.MetaServed)
+		if served >= limit {
+			return store.ErrExhausted
+		}
+		e.Metadata[models.MetaServed] = served + 1
+		left = limit - served - 1
+		return nil
+	})
+	if errors.Is(err, errUnlimited) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return left, nil
+}
+
+// errUnlimited rolls back ConsumeServe on entries without max_hits.
+var errUnlimited = errors.New("no serve limit")
+
+func (s *Store) RecordHits(ctx context.Context, hits map[int64]store.Hits) error {
+	ids := make([]int64, 0, len(hits))
+	for id := range hits {
+		ids = append(ids, id)
+	}
+	// a fixed order keeps concurrent flushes from deadlocking on row locks
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		h := hits[id]
+		err := s.modify(ctx, id, nil, func(e *models.Entry) error {
+			e.HitCount += h.Count
+			if h.Last.After(e.LastHitAt) {
+				e.LastHitAt = h.Last
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) Namespaces(ctx context.Context) ([]models.Namespace, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT settings FROM namespaces ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []models.Namespace{}
+	for rows.Next() {
+		var doc []byte
+		var ns models.Namespace
+		if err := rows.Scan(&doc); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(doc, &ns); err != nil {
+			return nil, err
+		}
+		out = append(out, ns)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) PutNamespace(ctx context.Context, ns models.Namespace) error {
+	doc, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO namespaces (name, settings) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET settings = EXCLUDED.settings`, ns.Name, string(doc))
+	return err
+}
+
+func (s *Store) DeleteNamespace(ctx context.Context, name string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM namespaces WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrNamespaceNotFound
+	}
+	return nil
+}
+
+func (s *Store) Synonyms(ctx context.Context) (map[string]map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT namespace, dictionary FROM synonyms`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]map[string]string{}
+	for rows.Next() {
+		var ns string
+		var doc []byte
+		if err := rows.Scan(&ns, &doc); err != nil {
+			return nil, err
+		}
+		var dict map[string]string
+		if err := json.Unmarshal(doc, &dict); err != nil {
+			return nil, err
+		}
+		out[ns] = dict
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) SetSynonyms(ctx context.Context, namespace string, synonyms map[string]string) error {
+	if len(synonyms) == 0 {
+		_, err := s.db.ExecContext(ctx, `DELETE FROM synonyms WHERE namespace = $1`, namespace)
+		return err
+	}
+	doc, err := json.Marshal(synonyms)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO synonyms (namespace, dictionary) VALUES ($1, $2) ON CONFLICT (namespace) DO UPDATE SET dictionary = EXCLUDED.dictionary`, namespace, string(doc))
+	return err
+}
+
+func (s *Store) AppendOutbox(ctx context.Context, msgs []store.OutboxMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range msgs {
+		doc, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO outbox (message) VALUES ($1)`, string(doc)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) PendingOutbox(ctx context.Context, limit int) ([]store.OutboxMessage, error) {
+	var lim any // NULL is no limit
+	if limit > 0 {
+		lim = limit
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, message FROM outbox ORDER BY seq LIMIT $1`, lim)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []store.OutboxMessage
+	for rows.Next() {
+		var seq int64
+		var doc []byte
+		var m store.OutboxMessage
+		if err := rows.Scan(&seq, &doc); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(doc, &m); err != nil {
+			return nil, err
+		}
+		m.Seq = uint64(seq)
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) AckOutbox(ctx context.Context, seqs ...uint64) error {
+	ids := make([]int64, len(seqs))
+	for i, seq := range seqs {
+		ids[i] = int64(seq)
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM outbox WHERE seq = ANY($1)`, pq.Array(ids))
+	return err
+}
+
+// AcquireLease takes the lease when it is free, expired or already
+// holder's, in one statement, so replicas racing for it can't both win.
+func (s *Store) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if name == "" || holder == "" {
+		return false, errors.New("lease name and holder required")
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO leases (name, holder, expires) VALUES ($1, $2, now() + $3::float8 * interval '1 millisecond')
+ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires = EXCLUDED.expires
+WHERE leases.holder = EXCLUDED.holder OR leases.expires < now()`, name, holder, ttl.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *Store) ReleaseLease(ctx context.Context, name, holder string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM leases WHERE name = $1 AND holder = $2`, name, holder)
+	return err
+}
+
+// query runs a SELECT of id and entry columns.
+func (s *Store) query(ctx context.Context, q string, args ...any) ([]*models.Entry, error) {
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*models.Entry
+	for rows.Next() {
+		var id int64
+		var doc []byte
+		if err := rows.Scan(&id, &doc); err != nil {
+			return nil, err
+		}
+		var e models.Entry
+		if err := json.Unmarshal(doc, &e); err != nil {
+			return nil, fmt.Errorf("postgres: entry %d: %w", id, err)
+		}
+		e.ID = id
+		out = append(out, &e)
+	}
+	return out, rows.Err()
+}
+
+// metadataConds appends a condition per filter to conds, with its
+// parameters to args. Values compare against the text form of the stored
+// metadata, which for strings, numbers and booleans is the form filters
+// use. Keys are sorted so the same filters give the same statement.
+func metadataConds(conds []string, args []any, filters map[string]string) ([]string, []any) {
+	keys := make([]string, 0, len(filters))
+	for k := range filters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, k, filters[k])
+		conds = append(conds, fmt.Sprintf("entry->'metadata'->>$%d::text = $%d::text", len(args)-1, len(args)))
+	}
+	return conds, args
+}
+
+// vectorText is vec in pgvector's text form. pgvector keeps single
+// precision floats, so vectors read back are rounded.
+func vectorText(vec []float64) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, f := range vec {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(f, 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+func parseVector(text string) ([]float64, error) {
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "["), "]")
+	if text == "" {
+		return []float64{}, nil
+	}
+	fields := strings.Split(text, ",")
+	out := make([]float64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: bad vector: %w", err)
+		}
+		out[i] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,115 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+func TestMetadataConds(t *testing.T) {
+	conds, args := metadataConds([]string{"TRUE"}, []any{"x"}, map[string]string{"source": "faq", "namespace": "team"})
+	if fmt.Sprint(conds) != "[TRUE entry->'metadata'->>$2::text = $3::text entry->'metadata'->>$4::text = $5::text]" {
+		t.Fatalf("expected a condition per filter after the first argument got %v", conds)
+	}
+	if fmt.Sprint(args) != "[x namespace team source faq]" {
+		t.Fatalf("expected the filters' keys and values in key order got %v", args)
+	}
+}
+
+func TestVectorText(t *testing.T) {
+	text := vectorText([]float64{1, -0.5, 0.25})
+	if text != "[1,-0.5,0.25]" {
+		t.Fatalf("expected [1,-0.5,0.25] got %s", text)
+	}
+	vec, err := parseVector(text)
+	if err != nil || fmt.Sprint(vec) != "[1 -0.5 0.25]" {
+		t.Fatalf("expected the vector back got %v (%v)", vec, err)
+	}
+}
+
+// TestStore runs against the database at SLC_TEST_POSTGRES_DSN, which
+// needs the pgvector extension available, and is skipped without one.
+func TestStore(t *testing.T) {
+	dsn := os.Getenv("SLC_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SLC_TEST_POSTGRES_DSN not set")
+	}
+	ctx := context.Background()
+	st, err := Open(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for _, id := range st.AllIDs() {
+		_ = st.DeleteEntry(ctx, id)
+	}
+
+	faq, err := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "What is Kubernetes", Response: "an orchestrator", Metadata: map[string]interface{}{"source": "faq", "max_hits": 1}}, []float64{1, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blog, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "What is a pod", Response: "a group of containers", Metadata: map[string]interface{}{"source": "blog"}}, []float64{0.9, 0.1, 0})
+	_, _ = st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "other model", Response: "r"}, []float64{1, 0})
+
+	ids, scores, err := st.SearchByVector(ctx, []float64{1, 0, 0}, 5)
+	if err != nil || fmt.Sprint(ids) != fmt.Sprint([]int64{faq, blog}) || scores[0] < 0.999 {
+		t.Fatalf("expected %d then %d, skipping the other dimension, got %v %v (%v)", faq, blog, ids, scores, err)
+	}
+	if ids, _, _ := st.SearchByVectorFiltered(ctx, []float64{1, 0, 0}, 5, map[string]string{"source": "blog"}); fmt.Sprint(ids) != fmt.Sprint([]int64{blog}) {
+		t.Fatalf("expected only %d with source=blog got %v", blog, ids)
+	}
+	if found, _ := st.FindEntriesByMetadata(ctx, map[string]string{"max_hits": "1"}); len(found) != 1 || found[0].ID != faq {
+		t.Fatalf("expected numbers to match their text form got %v", found)
+	}
+
+	if err := st.UpdateEntryMetadata(ctx, faq, map[string]interface{}{"tag": "k8s"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RecordHits(ctx, map[int64]store.Hits{faq: {Count: 2, Last: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateEntryWithVector(ctx, faq, &models.Entry{Prompt: "What is Kubernetes", Response: "a container orchestrator", Metadata: map[string]interface{}{"source": "faq", "max_hits": 1}}, []float64{0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	e, err := st.GetEntry(ctx, faq)
+	if err != nil || e.Response != "a container orchestrator" || e.HitCount != 2 || e.Metadata["tag"] != nil {
+		t.Fatalf("expected the updated entry keeping its hits got %+v (%v)", e, err)
+	}
+	if vec, _ := st.GetVector(ctx, faq); fmt.Sprint(vec) != "[0 0 1]" {
+		t.Fatalf("expected the new vector got %v", vec)
+	}
+
+	if left, err := st.ConsumeServe(ctx, faq); left != 0 || err != nil {
+		t.Fatalf("expected the last serve to be counted got %d (%v)", left, err)
+	}
+	if _, err := st.ConsumeServe(ctx, faq); err != store.ErrExhausted {
+		t.Fatalf("expected ErrExhausted got %v", err)
+	}
+	if left, _ := st.ConsumeServe(ctx, blog); left != -1 {
+		t.Fatalf("expected an unlimited entry got %d", left)
+	}
+
+	if ok, _ := st.AcquireLease(ctx, "janitor", "a", time.Minute); !ok {
+		t.Fatalf("expected a free lease to be granted")
+	}
+	if ok, _ := st.AcquireLease(ctx, "janitor", "b", time.Minute); ok {
+		t.Fatalf("expected a held lease to be refused")
+	}
+	_ = st.ReleaseLease(ctx, "janitor", "a")
+	if ok, _ := st.AcquireLease(ctx, "janitor", "b", time.Minute); !ok {
+		t.Fatalf("expected a released lease to be granted")
+	}
+	_ = st.ReleaseLease(ctx, "janitor", "b")
+
+	if err := st.DeleteEntry(ctx, blog); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.GetEntry(ctx, blog); err == nil {
+		t.Fatalf("expected %d to be gone", blog)
+	}
+}
@@ -0,0 +1,152 @@
+package redis
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/resp"
+)
+
+// redisError is an error reply. The connection that received it is still
+// in step and can be reused.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// conn is one connection to Redis.
+type conn struct {
+	net.Conn
+	r *resp.Reader
+	w *resp.Writer
+}
+
+// do pipelines cmds and returns their replies. All replies are read even
+// when one is an error, so the connection stays in step; the first error
+// reply is returned.
+func (c *conn) do(ctx context.Context, cmds ...[]string) ([]resp.Value, error) {
+	deadline := time.Now().Add(callTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.SetDeadline(deadline)
+	for _, cmd := range cmds {
+		c.w.WriteCommand(cmd...)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	out := make([]resp.Value, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		v, err := c.r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		if v.Type == resp.Error && replyErr == nil {
+			replyErr = redisError(v.Str)
+		}
+		out[i] = v
+	}
+	return out, replyErr
+}
+
+// callTimeout bounds a call whose context has no earlier deadline.
+const callTimeout = 30 * time.Second
+
+// client is a small pool of connections to one server.
+type client struct {
+	opts Options
+	idle chan *conn
+}
+
+func newClient(opts Options) *client {
+	return &client{opts: opts, idle: make(chan *conn, opts.PoolSize)}
+}
+
+// dial connects, authenticates and selects the database.
+func (c *client) dial(ctx context.Context) (*conn, error) {
+	var nc net.Conn
+	var err error
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if c.opts.TLS {
+		nc, err = (&tls.Dialer{NetDialer: d}).DialContext(ctx, "tcp", c.opts.Addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", c.opts.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: resp.NewReader(nc), w: resp.NewWriter(nc)}
+	var setup [][]string
+	if c.opts.Password != "" {
+		if c.opts.Username != "" {
+			setup = append(setup, []string{"AUTH", c.opts.Username, c.opts.Password})
+		} else {
+			setup = append(setup, []string{"AUTH", c.opts.Password})
+		}
+	}
+	if c.opts.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.opts.DB)})
+	}
+	if len(setup) > 0 {
+		if _, err := cn.do(ctx, setup...); err != nil {
+			_ = cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// with runs fn on a pooled connection. A connection fn failed on for any
+// reason but an error reply is closed rather than pooled, since it may be
+// out of step.
+func (c *client) with(ctx context.Context, fn func(*conn) error) error {
+	var cn *conn
+	select {
+	case cn = <-c.idle:
+	default:
+		var err error
+		if cn, err = c.dial(ctx); err != nil {
+			return err
+		}
+	}
+	err := fn(cn)
+	var re redisError
+	if err != nil && !errors.As(err, &re) && !errors.Is(err, errNotFound) && !errors.Is(err, errConflict) {
+		_ = cn.Close()
+		return err
+	}
+	select {
+	case c.idle <- cn:
+	default:
+		_ = cn.Close()
+	}
+	return err
+}
+
+// do pipelines cmds on a pooled connection.
+func (c *client) do(ctx context.Context, cmds ...[]string) ([]resp.Value, error) {
+	var out []resp.Value
+	err := c.with(ctx, func(cn *conn) error {
+		var err error
+		out, err = cn.do(ctx, cmds...)
+		return err
+	})
+	return out, err
+}
+
+// close closes the idle connections.
+func (c *client) close() {
+	for {
+		select {
+		case cn := <-c.idle:
+			_ = cn.Close()
+		default:
+			return
+		}
+	}
+}
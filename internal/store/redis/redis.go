@@ -0,0 +1,608 @@
+// Package redis is a Store backed by Redis Stack, searched with RediSearch's
+// vector similarity. Each entry is a hash holding the entry as JSON, its
+// embedding, and a tag per metadata key and value, which filtered searches
+// match. Entries expire through Redis key expirations, so the server needn't
+// sweep for them.
+package redis
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/resp"
+	"github.com/jeefy/slmcache/internal/store"
+)
+
+// Options configures the connection and the index. Dim is required: a
+// RediSearch vector field has a fixed dimension, so changing the embedding
+// model needs a new index.
+type Options struct {
+	// Addr is host:port of the Redis Stack server.
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	TLS      bool
+	// Prefix starts every key the store uses (default "slmcache:"), so
+	// several caches can share a server.
+	Prefix string
+	Dim    int
+	// Index is the vector index: HNSW (the default) or FLAT.
+	Index string
+	// PoolSize is the most idle connections kept (default 8).
+	PoolSize int
+}
+
+const (
+	// pageSize is how many rows a cursor or SCAN call returns at once.
+	pageSize = 1000
+	// maxRetries bounds the attempts of a change that keeps racing another.
+	maxRetries = 10
+)
+
+var (
+	errNotFound = errors.New("not found")
+	// errConflict is a change that kept being interrupted by others.
+	errConflict = errors.New("redis: entry changed concurrently")
+)
+
+// Store is the Redis Store. Besides the Store interface it implements the
+// filtered search, vector reads, native expiry and maintenance leases. Namespaces, synonyms,
+// serve limits and hit statistics aren't kept, as with any store lacking
+// those interfaces.
+type Store struct {
+	opts Options
+	c    *client
+
+	mu     sync.RWMutex
+	expiry func(*models.Entry) time.Duration
+}
+
+// Open connects to Redis and creates the search index unless it exists; an
+// existing one is checked to have the configured dimension. Wrap it in
+// store.NewLazy to start before Redis is reachable.
+func Open(ctx context.Context, opts Options) (*Store, error) {
+	if opts.Dim <= 0 {
+		return nil, errors.New("redis: the vector dimension is required")
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "slmcache:"
+	}
+	switch opts.Index {
+	case "":
+		opts.Index = "HNSW"
+	case "HNSW", "FLAT":
+	default:
+		return nil, fmt.Errorf("redis: unknown index %q (want HNSW or FLAT)", opts.Index)
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 8
+	}
+	s := &Store{opts: opts, c: newClient(opts)}
+	info, err := s.c.do(ctx, []string{"FT.INFO", s.index()})
+	switch {
+	case err == nil:
+		if dim := infoDim(info[0]); dim != 0 && dim != opts.Dim {
+			s.c.close()
+			return nil, fmt.Errorf("redis: index %s holds %d-dimensional vectors, not %d", s.index(), dim, opts.Dim)
+		}
+		return s, nil
+	case isUnknownIndex(err):
+		_, err = s.c.do(ctx, s.createIndex())
+		if err == nil || strings.Contains(strings.ToLower(err.Error()), "already exists") {
+			return s, nil
+		}
+	case strings.Contains(strings.ToLower(err.Error()), "unknown command"):
+		err = errors.New("redis: the server lacks RediSearch; use Redis Stack")
+	}
+	s.c.close()
+	return nil, err
+}
+
+func isUnknownIndex(err error) bool {
+	var re redisError
+	if !errors.As(err, &re) {
+		return false
+	}
+	msg := strings.ToLower(string(re))
+	return strings.Contains(msg, "unknown index") || strings.Contains(msg, "no such index")
+}
+
+// infoDim finds the vector dimension in an FT.INFO reply, whose layout
+// varies between versions, or returns 0.
+func infoDim(v resp.Value) int {
+	for i, item := range v.Array {
+		if item.Type == resp.Array {
+			if dim := infoDim(item); dim != 0 {
+				return dim
+			}
+			continue
+		}
+		if strings.EqualFold(item.Str, "dim") && i+1 < len(v.Array) {
+			next := v.Array[i+1]
+			if next.Type == resp.Integer {
+				return int(next.Int)
+			}
+			n, _ := strconv.Atoi(next.Str)
+			return n
+		}
+	}
+	return 0
+}
+
+// createIndex is the FT.CREATE command for the store's hashes: the vector
+// compared by cosine distance and the metadata tags.
+func (s *Store) createIndex() []string {
+	cmd := []string{"FT.CREATE", s.index(), "ON", "HASH", "PREFIX", "1", s.opts.Prefix + "entry:",
+		"SCHEMA", "vector", "VECTOR", s.opts.Index}
+	params := []string{"TYPE", "FLOAT32", "DIM", strconv.Itoa(s.opts.Dim), "DISTANCE_METRIC", "COSINE"}
+	if s.opts.Index == "HNSW" {
+		params = append(params, "M", "16", "EF_CONSTRUCTION", "200")
+	}
+	cmd = append(cmd, strconv.Itoa(len(params)))
+	cmd = append(cmd, params...)
+	return append(cmd, "tags", "TAG", "SEPARATOR", ",")
+}
+
+func (s *Store) index() string       { return s.opts.Prefix + "idx" }
+func (s *Store) key(id int64) string { return s.opts.Prefix + "entry:" + strconv.FormatInt(id, 10) }
+
+// idOf parses the ID out of an entry's key.
+func (s *Store) idOf(key string) (int64, bool) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(key, s.opts.Prefix+"entry:"), 10, 64)
+	return id, err == nil
+}
+
+// Close closes the pooled connections.
+func (s *Store) Close() error {
+	s.c.close()
+	return nil
+}
+
+func (s *Store) Health(ctx context.Context) error {
+	_, err := s.c.do(ctx, []string{"PING"})
+	return err
+}
+
+func (s *Store) Capabilities() store.Capabilities {
+	return store.Capabilities{FilteredSearch: true, PurgeExpired: true, Transactions: true}
+}
+
+func (s *Store) SetExpiry(ttl func(*models.Entry) time.Duration) {
+	s.mu.Lock()
+	s.expiry = ttl
+	s.mu.Unlock()
+}
+
+// tag is the tag an entry with metadata key k set to v carries: a hash of
+// both, so keys and values need no escaping in queries. v is in the
+// fmt.Sprint form filters compare against.
+func tag(k, v string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(k))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(v))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+func tags(metadata map[string]interface{}) string {
+	out := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		out = append(out, tag(k, fmt.Sprint(v)))
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+// filterQuery is the RediSearch query matching filters, "*" for none.
+func filterQuery(filters map[string]string) string {
+	if len(filters) == 0 {
+		return "*"
+	}
+	conds := make([]string, 0, len(filters))
+	for k, v := range filters {
+		conds = append(conds, "@tags:{"+tag(k, v)+"}")
+	}
+	sort.Strings(conds)
+	return "(" + strings.Join(conds, " ") + ")"
+}
+
+// matches checks e against filters itself, since distinct tags can hash
+// alike.
+func matches(e *models.Entry, filters map[string]string) bool {
+	for k, v := range filters {
+		got, ok := e.Metadata[k]
+		if !ok || fmt.Sprint(got) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeVector(vec []float64) string {
+	b := make([]byte, 4*len(vec))
+	for i, f := range vec {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(float32(f)))
+	}
+	return string(b)
+}
+
+func decodeVector(b string) []float64 {
+	vec := make([]float64, len(b)/4)
+	for i := range vec {
+		vec[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32([]byte(b[4*i : 4*i+4]))))
+	}
+	return vec
+}
+
+func decodeEntry(id int64, doc string) (*models.Entry, error) {
+	var e models.Entry
+	if err := json.Unmarshal([]byte(doc), &e); err != nil {
+		return nil, fmt.Errorf("redis: entry %d: %w", id, err)
+	}
+	e.ID = id
+	return &e, nil
+}
+
+// write is the transaction storing e, with vec as its embedding unless
+// nil, and setting the key's expiry from the TTL policy.
+func (s *Store) write(id int64, e *models.Entry, vec []float64) ([][]string, error) {
+	if vec != nil && len(vec) != s.opts.Dim {
+		return nil, fmt.Errorf("redis: the index holds %d-dimensional vectors, not %d", s.opts.Dim, len(vec))
+	}
+	e.ID = id
+	doc, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	key := s.key(id)
+	hset := []string{"HSET", key, "entry", string(doc), "tags", tags(e.Metadata)}
+	if vec != nil {
+		hset = append(hset, "vector", encodeVector(vec))
+	}
+	return [][]string{{"MULTI"}, hset, s.expire(key, e), {"EXEC"}}, nil
+}
+
+// expire is the command giving key the expiry e's TTL calls for, counted
+// from its last write as the server's janitor would.
+func (s *Store) expire(key string, e *models.Entry) []string {
+	s.mu.RLock()
+	expiry := s.expiry
+	s.mu.RUnlock()
+	var ttl time.Duration
+	if expiry != nil {
+		ttl = expiry(e)
+	}
+	if ttl <= 0 {
+		return []string{"PERSIST", key}
+	}
+	ts := e.UpdatedAt
+	if ts.IsZero() || e.CreatedAt.After(ts) {
+		ts = e.CreatedAt
+	}
+	return []string{"PEXPIREAT", key, strconv.FormatInt(ts.Add(ttl).UnixMilli(), 10)}
+}
+
+// execResult checks the EXEC reply ending a transaction: null when a
+// watched key changed, or holding the commands' replies.
+func execResult(replies []resp.Value) error {
+	exec := replies[len(replies)-1]
+	if exec.Null {
+		return errConflict
+	}
+	for _, v := range exec.Array {
+		if v.Type == resp.Error {
+			return redisError(v.Str)
+		}
+	}
+	return nil
+}
+
+func (s *Store) CreateEntryWithVector(ctx context.Context, e *models.Entry, vec []float64) (int64, error) {
+	if e == nil {
+		return 0, errors.New("nil entry")
+	}
+	if len(vec) != s.opts.Dim {
+		return 0, fmt.Errorf("redis: the index holds %d-dimensional vectors, not %d", s.opts.Dim, len(vec))
+	}
+	next, err := s.c.do(ctx, []string{"INCR", s.opts.Prefix + "next"})
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = now
+	}
+	e.UpdatedAt = now
+	cmds, err := s.write(next[0].Int, e, vec)
+	if err != nil {
+		return 0, err
+	}
+	replies, err := s.c.do(ctx, cmds...)
+	if err != nil {
+		return 0, err
+	}
+	return e.ID, execResult(replies)
+}
+
+func (s *Store) UpdateEntryWithVector(ctx context.Context, id int64, e *models.Entry, vec []float64) error {
+	return s.modify(ctx, id, vec, func(current *models.Entry) error {
+		now := time.Now().UTC()
+		if !current.CreatedAt.IsZero() {
+			e.CreatedAt = current.CreatedAt
+		} else if e.CreatedAt.IsZero() {
+			e.CreatedAt = now
+		}
+		e.UpdatedAt = now
+		// statistics belong to the entry, not to what it says
+		e.HitCount, e.LastHitAt, e.CreatedBy = current.HitCount, current.LastHitAt, current.CreatedBy
+		*current = *e
+		return nil
+	})
+}
+
+// modify reads entry id, lets fn change it and writes it back, with vec as
+// its new embedding unless nil. The key is watched, so a change made
+// meanwhile by another replica restarts it rather than being overwritten.
+func (s *Store) modify(ctx context.Context, id int64, vec []float64, fn func(*models.Entry) error) error {
+	key := s.key(id)
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		err := s.c.with(ctx, func(cn *conn) error {
+			replies, err := cn.do(ctx, []string{"WATCH", key}, []string{"HGET", key, "entry"})
+			if err == nil && replies[1].Null {
+				err = errNotFound
+			}
+			var e *models.Entry
+			if err == nil {
+				e, err = decodeEntry(id, replies[1].Str)
+			}
+			if err == nil {
+				err = fn(e)
+			}
+			var cmds [][]string
+			if err == nil {
+				cmds, err = s.write(id, e, vec)
+			}
+			if err != nil {
+				_, _ = cn.do(ctx, []string{"UNWATCH"})
+				return err
+			}
+			if replies, err = cn.do(ctx, cmds...); err != nil {
+				return err
+			}
+			return execResult(replies)
+		})
+		if !errors.Is(err, errConflict) {
+			return err
+		}
+	}
+	return errConflict
+}
+
+func (s *Store) GetEntry(ctx context.Context, id int64) (*models.Entry, error) {
+	replies, err := s.c.do(ctx, []string{"HGET", s.key(id), "entry"})
+	if err != nil {
+		return nil, err
+	}
+	if replies[0].Null {
+		return nil, errNotFound
+	}
+	return decodeEntry(id, replies[0].Str)
+}
+
+func (s *Store) GetVector(ctx context.Context, id int64) ([]float64, error) {
+	replies, err := s.c.do(ctx, []string{"HGET", s.key(id), "vector"})
+	if err != nil {
+		return nil, err
+	}
+	if replies[0].Null {
+		return nil, errNotFound
+	}
+	return decodeVector(replies[0].Str), nil
+}
+
+func (s *Store) SearchByVector(ctx context.Context, vec []float64, limit int) ([]int64, []float64, error) {
+	return s.SearchByVectorFiltered(ctx, vec, limit, nil)
+}
+
+// SearchByVectorFiltered returns the limit entries closest to vec by cosine
+// similarity among those matching filters. Vectors of another dimension
+// can't be compared, so they match nothing, as in the other stores.
+func (s *Store) SearchByVectorFiltered(ctx context.Context, vec []float64, limit int, filters map[string]string) ([]int64, []float64, error) {
+	if limit <= 0 || len(vec) != s.opts.Dim {
+		return nil, nil, nil
+	}
+	n := strconv.Itoa(limit)
+	query := filterQuery(filters) + "=>[KNN " + n + " @vector $vec AS score]"
+	replies, err := s.c.do(ctx, []string{"FT.SEARCH", s.index(), query,
+		"PARAMS", "2", "vec", encodeVector(vec),
+		"SORTBY", "score", "ASC", "RETURN", "2", "score", "entry",
+		"LIMIT", "0", n, "DIALECT", "2"})
+	if err != nil {
+		return nil, nil, err
+	}
+	// the reply is the total, then each key followed by its fields
+	res := replies[0].Array
+	ids := make([]int64, 0, len(res)/2)
+	scores := make([]float64, 0, len(res)/2)
+	for i := 1; i+1 < len(res); i += 2 {
+		id, ok := s.idOf(res[i].Str)
+		if !ok {
+			continue
+		}
+		fields := fieldMap(res[i+1])
+		if len(filters) > 0 {
+			e, err := decodeEntry(id, fields["entry"])
+			if err != nil || !matches(e, filters) {
+				continue
+			}
+		}
+		// RediSearch reports the cosine distance
+		dist, _ := strconv.ParseFloat(fields["score"], 64)
+		ids = append(ids, id)
+		scores = append(scores, 1-dist)
+	}
+	return ids, scores, nil
+}
+
+// fieldMap reads a field, value, field, value... reply.
+func fieldMap(v resp.Value) map[string]string {
+	out := make(map[string]string, len(v.Array)/2)
+	for i := 0; i+1 < len(v.Array); i += 2 {
+		out[v.Array[i].Str] = v.Array[i+1].Str
+	}
+	return out
+}
+
+// AllIDs returns every entry's ID in ascending order, or none when Redis
+// can't be read.
+func (s *Store) AllIDs() []int64 {
+	ids := []int64{}
+	cursor := "0"
+	for {
+		replies, err := s.c.do(context.Background(), []string{"SCAN", cursor, "MATCH", s.opts.Prefix + "entry:*", "COUNT", strconv.Itoa(pageSize)})
+		if err != nil || len(replies[0].Array) != 2 {
+			return []int64{}
+		}
+		for _, k := range replies[0].Array[1].Array {
+			if id, ok := s.idOf(k.Str); ok {
+				ids = append(ids, id)
+			}
+		}
+		if cursor = replies[0].Array[0].Str; cursor == "0" {
+			break
+		}
+	}
+	// SCAN can return a key more than once
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	out := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// FindEntriesByMetadata reads the matching entries through an aggregation
+// cursor, a page at a time, and returns them in ID order.
+func (s *Store) FindEntriesByMetadata(ctx context.Context, filters map[string]string) ([]*models.Entry, error) {
+	cmd := []string{"FT.AGGREGATE", s.index(), filterQuery(filters), "LOAD", "2", "@__key", "@entry",
+		"WITHCURSOR", "COUNT", strconv.Itoa(pageSize), "DIALECT", "2"}
+	var out []*models.Entry
+	for {
+		replies, err := s.c.do(ctx, cmd)
+		if err != nil {
+			return nil, err
+		}
+		if len(replies[0].Array) != 2 {
+			return nil, errors.New("redis: unexpected FT.AGGREGATE reply")
+		}
+		rows := replies[0].Array[0].Array
+		for i := 1; i < len(rows); i++ {
+			fields := fieldMap(rows[i])
+			id, ok := s.idOf(fields["__key"])
+			if !ok {
+				continue
+			}
+			e, err := decodeEntry(id, fields["entry"])
+			if err != nil {
+				return nil, err
+			}
+			if matches(e, filters) {
+				out = append(out, e)
+			}
+		}
+		cursor := replies[0].Array[1]
+		if cursor.Int == 0 {
+			break
+		}
+		cmd = []string{"FT.CURSOR", "READ", s.index(), strconv.FormatInt(cursor.Int, 10), "COUNT", strconv.Itoa(pageSize)}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (s *Store) DeleteEntry(ctx context.Context, id int64) error {
+	replies, err := s.c.do(ctx, []string{"DEL", s.key(id)})
+	if err != nil {
+		return err
+	}
+	if replies[0].Int == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *Store) UpdateEntryMetadata(ctx context.Context, id int64, metadata map[string]interface{}, replace bool) error {
+	return s.modify(ctx, id, nil, func(e *models.Entry) error {
+		if replace {
+			e.Metadata = metadata
+		} else {
+			if e.Metadata == nil {
+				e.Metadata = make(map[string]interface{}, len(metadata))
+			}
+			for k, v := range metadata {
+				e.Metadata[k] = v
+			}
+		}
+		e.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+func (s *Store) DeleteEntryMetadata(ctx context.Context, id int64, keys ...string) error {
+	return s.modify(ctx, id, nil, func(e *models.Entry) error {
+		if len(keys) == 0 {
+			e.Metadata = nil
+		}
+		for _, k := range keys {
+			delete(e.Metadata, k)
+		}
+		e.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+}
+
+// acquireScript takes the lease key with SET NX PX, or extends it when
+// holder already owns it, atomically so racing replicas can't both win.
+const acquireScript = `if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then return 1 end
+if redis.call('GET', KEYS[1]) == ARGV[1] then redis.call('PEXPIRE', KEYS[1], ARGV[2]) return 1 end
+return 0`
+
+// releaseScript deletes the lease key only while holder owns it.
+const releaseScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end
+return 0`
+
+func (s *Store) leaseKey(name string) string { return s.opts.Prefix + "lease:" + name }
+
+// AcquireLease takes the lease when it is free or expired, or renews it
+// when holder owns it. Redis expires the key, so a crashed holder's lease
+// lapses on its own.
+func (s *Store) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if name == "" || holder == "" {
+		return false, errors.New("lease name and holder required")
+	}
+	ms := strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+	out, err := s.c.do(ctx, []string{"EVAL", acquireScript, "1", s.leaseKey(name), holder, ms})
+	if err != nil {
+		return false, err
+	}
+	return out[0].Int == 1, nil
+}
+
+func (s *Store) ReleaseLease(ctx context.Context, name, holder string) error {
+	_, err := s.c.do(ctx, []string{"EVAL", releaseScript, "1", s.leaseKey(name), holder})
+	return err
+}
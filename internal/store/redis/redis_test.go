@@ -0,0 +1,168 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+	"github.com/jeefy/slmcache/internal/resp"
+)
+
+func TestFilterQueryMatchesTags(t *testing.T) {
+	got := tags(map[string]interface{}{"source": "faq", "max_hits": float64(3)})
+	for _, want := range []string{tag("source", "faq"), tag("max_hits", "3")} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %s among the tags got %s", want, got)
+		}
+	}
+	q := filterQuery(map[string]string{"source": "faq", "max_hits": "3"})
+	if !strings.Contains(q, "@tags:{"+tag("source", "faq")+"}") || !strings.Contains(q, "@tags:{"+tag("max_hits", "3")+"}") {
+		t.Fatalf("expected both filters in the query got %s", q)
+	}
+	if filterQuery(nil) != "*" {
+		t.Fatalf("expected * without filters")
+	}
+	if tag("a", "b,c") == tag("a,b", "c") {
+		t.Fatalf("expected key and value to be kept apart")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	s := &Store{opts: Options{Prefix: "p:"}}
+	written := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := &models.Entry{CreatedAt: written, UpdatedAt: written}
+	if got := s.expire("k", e); fmt.Sprint(got) != "[PERSIST k]" {
+		t.Fatalf("expected no expiry without a policy got %v", got)
+	}
+	s.SetExpiry(func(e *models.Entry) time.Duration {
+		if e.Flag(models.MetaPinned) {
+			return 0
+		}
+		return time.Hour
+	})
+	want := fmt.Sprintf("[PEXPIREAT k %d]", written.Add(time.Hour).UnixMilli())
+	if got := s.expire("k", e); fmt.Sprint(got) != want {
+		t.Fatalf("expected %s got %v", want, got)
+	}
+	e.Metadata = map[string]interface{}{models.MetaPinned: true}
+	if got := s.expire("k", e); fmt.Sprint(got) != "[PERSIST k]" {
+		t.Fatalf("expected a pinned entry to persist got %v", got)
+	}
+}
+
+func TestVectorAndInfo(t *testing.T) {
+	vec := decodeVector(encodeVector([]float64{1, -0.5, 0.25}))
+	if fmt.Sprint(vec) != "[1 -0.5 0.25]" {
+		t.Fatalf("expected the vector back got %v", vec)
+	}
+	info := resp.Value{Type: resp.Array, Array: []resp.Value{
+		{Type: resp.BulkString, Str: "index_name"}, {Type: resp.BulkString, Str: "slmcache:idx"},
+		{Type: resp.BulkString, Str: "attributes"}, {Type: resp.Array, Array: []resp.Value{
+			{Type: resp.Array, Array: []resp.Value{
+				{Type: resp.BulkString, Str: "identifier"}, {Type: resp.BulkString, Str: "vector"},
+				{Type: resp.BulkString, Str: "dim"}, {Type: resp.Integer, Int: 768},
+			}},
+		}},
+	}}
+	if dim := infoDim(info); dim != 768 {
+		t.Fatalf("expected 768 got %d", dim)
+	}
+}
+
+// TestStore runs against the Redis Stack server at SLC_TEST_REDIS_ADDR,
+// under a key prefix whose index and entries it drops first, and is
+// skipped without one.
+func TestStore(t *testing.T) {
+	addr := os.Getenv("SLC_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("SLC_TEST_REDIS_ADDR not set")
+	}
+	ctx := context.Background()
+	opts := Options{Addr: addr, Password: os.Getenv("SLC_TEST_REDIS_PASSWORD"), Prefix: "slmcache_test:", Dim: 3, PoolSize: 2}
+	drop := &Store{opts: opts, c: newClient(opts)}
+	_, _ = drop.c.do(ctx, []string{"FT.DROPINDEX", drop.index(), "DD"}, []string{"DEL", opts.Prefix + "next"})
+	drop.c.close()
+	st, err := Open(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.SetExpiry(func(e *models.Entry) time.Duration {
+		if e.Metadata["source"] == "news" {
+			return time.Millisecond
+		}
+		return 0
+	})
+
+	faq, err := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "What is Kubernetes", Response: "an orchestrator", Metadata: map[string]interface{}{"source": "faq", "max_hits": 1}}, []float64{1, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blog, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "What is a pod", Response: "a group of containers", Metadata: map[string]interface{}{"source": "blog"}}, []float64{0.9, 0.1, 0})
+	news, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "Who won", Response: "us", Metadata: map[string]interface{}{"source": "news"}}, []float64{0, 1, 0})
+
+	ids, scores, err := st.SearchByVector(ctx, []float64{1, 0, 0}, 5)
+	if err != nil || len(ids) < 2 || ids[0] != faq || ids[1] != blog || scores[0] < 0.999 {
+		t.Fatalf("expected %d then %d got %v %v (%v)", faq, blog, ids, scores, err)
+	}
+	ids, _, err = st.SearchByVectorFiltered(ctx, []float64{1, 0, 0}, 5, map[string]string{"source": "blog"})
+	if err != nil || fmt.Sprint(ids) != fmt.Sprint([]int64{blog}) {
+		t.Fatalf("expected only %d got %v (%v)", blog, ids, err)
+	}
+	found, err := st.FindEntriesByMetadata(ctx, map[string]string{"max_hits": "1"})
+	if err != nil || len(found) != 1 || found[0].ID != faq {
+		t.Fatalf("expected %d got %v (%v)", faq, found, err)
+	}
+
+	if err := st.UpdateEntryMetadata(ctx, faq, map[string]interface{}{"source": "docs"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := st.GetEntry(ctx, faq); err != nil || e.Metadata["source"] != "docs" || e.Response != "an orchestrator" {
+		t.Fatalf("expected the merged metadata got %+v (%v)", e, err)
+	}
+	if vec, err := st.GetVector(ctx, faq); err != nil || fmt.Sprint(vec) != "[1 0 0]" {
+		t.Fatalf("expected the vector kept got %v (%v)", vec, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := st.GetEntry(ctx, news); err == nil {
+		t.Fatalf("expected %d to have expired", news)
+	}
+	if ids := st.AllIDs(); fmt.Sprint(ids) != fmt.Sprint([]int64{faq, blog}) {
+		t.Fatalf("expected %d and %d got %v", faq, blog, ids)
+	}
+	if err := st.DeleteEntry(ctx, blog); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteEntry(ctx, blog); err == nil {
+		t.Fatalf("expected deleting a missing entry to fail")
+	}
+
+	_ = st.ReleaseLease(ctx, "janitor", "a")
+	if ok, err := st.AcquireLease(ctx, "janitor", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("expected a to take the free lease (%v)", err)
+	}
+	if ok, _ := st.AcquireLease(ctx, "janitor", "b", time.Minute); ok {
+		t.Fatalf("expected b refused while a holds the lease")
+	}
+	if ok, _ := st.AcquireLease(ctx, "janitor", "a", time.Minute); !ok {
+		t.Fatalf("expected a to renew its lease")
+	}
+	if err := st.ReleaseLease(ctx, "janitor", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := st.AcquireLease(ctx, "janitor", "b", time.Minute); ok {
+		t.Fatalf("expected b's release to leave a's lease alone")
+	}
+	if err := st.ReleaseLease(ctx, "janitor", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := st.AcquireLease(ctx, "janitor", "b", time.Minute); !ok {
+		t.Fatalf("expected b to take the released lease")
+	}
+	_ = st.ReleaseLease(ctx, "janitor", "b")
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"container/heap"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// parallelScanMin is the fewest vectors a scan shard takes; smaller
+// searches aren't worth the goroutines.
+var parallelScanMin = 4096
+
+// scored is a vector position with its similarity to the query.
+type scored struct {
+	idx   int
+	score float64
+}
+
+// topLocked scores vec against the vectors at positions (all of them when
+// positions is nil) and returns the best limit, best first. Large scans are split into
+// shards scored on up to GOMAXPROCS cores, and the shards' best merged.
+// Callers must hold s.mu.
+func (s *inMemoryStore) topLocked(vec []float64, limit int, positions []int) ([]int64, []float64) {
+	if limit <= 0 {
+		limit = 10
+	}
+	if positions == nil {
+		positions = make([]int, s.vectors.len())
+		for i := range positions {
+			positions[i] = i
+		}
+	}
+	var best *topK
+	if shards := min(runtime.GOMAXPROCS(0), len(positions)/parallelScanMin); shards > 1 {
+		best = s.scanParallel(vec, limit, positions, shards)
+	} else {
+		best = s.scan(vec, limit, positions)
+	}
+	ids := []int64{}
+	outScores := []float64{}
+	for _, p := range best.sorted() {
+		ids = append(ids, s.ids[p.idx])
+		outScores = append(outScores, p.score)
+	}
+	return ids, outScores
+}
+
+// scan returns the best limit of the vectors at positions.
+func (s *inMemoryStore) scan(vec []float64, limit int, positions []int) *topK {
+	best := &topK{k: limit}
+	for _, i := range positions {
+		best.offer(scored{i, cosine(vec, s.vectors.at(i))})
+	}
+	return best
+}
+
+// scanParallel scans positions in shards concurrently and merges the best
+// limit of each.
+func (s *inMemoryStore) scanParallel(vec []float64, limit int, positions []int, shards int) *topK {
+	best := make([]*topK, shards)
+	size := (len(positions) + shards - 1) / shards
+	var wg sync.WaitGroup
+	for n := range shards {
+		lo, hi := n*size, min((n+1)*size, len(positions))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			best[n] = s.scan(vec, limit, positions[lo:hi])
+		}()
+	}
+	wg.Wait()
+	merged := &topK{k: limit}
+	for _, shard := range best {
+		for _, p := range shard.h {
+			merged.offer(p)
+		}
+	}
+	return merged
+}
+
+// topK keeps the best k candidates offered in a min-heap with the worst of
+// them on top, so each candidate costs O(log k) rather than O(k), which adds
+// up for the large limits of oversampled searches.
+type topK struct {
+	k int
+	h scoredHeap
+}
+
+// offer keeps p if it is among the best k so far. A candidate only tying
+// the worst kept doesn't replace it.
+func (t *topK) offer(p scored) {
+	if len(t.h) < t.k {
+		heap.Push(&t.h, p)
+		return
+	}
+	if p.score > t.h[0].score {
+		t.h[0] = p
+		heap.Fix(&t.h, 0)
+	}
+}
+
+// sorted returns the candidates kept, best first.
+func (t *topK) sorted() []scored {
+	out := append([]scored(nil), t.h...)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].score != out[j].score {
+			return out[i].score > out[j].score
+		}
+		return out[i].idx < out[j].idx
+	})
+	return out
+}
+
+type scoredHeap []scored
+
+func (h scoredHeap) Len() int           { return len(h) }
+func (h scoredHeap) Less(i, j int) bool { return h[i].score < h[j].score }
+func (h scoredHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *scoredHeap) Push(x any)        { *h = append(*h, x.(scored)) }
+func (h *scoredHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// ErrExhausted is returned by ConsumeServe for an entry that has been
+// served max_hits times.
+var ErrExhausted = errors.New("entry has no serves left")
+
+// ServeLimiter is implemented by stores that enforce metadata.max_hits.
+// Counting happens under the store's own serialization, so replicas sharing
+// the store can't together serve an entry more often than it allows.
+type ServeLimiter interface {
+	// ConsumeServe counts one serve of entry id in metadata.served and
+	// returns how many serves remain, -1 for an entry without max_hits. An
+	// entry with none left is not counted again and returns ErrExhausted.
+	ConsumeServe(ctx context.Context, id int64) (int, error)
+}
+
+func (s *inMemoryStore) ConsumeServe(ctx context.Context, id int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[id]
+	if !ok {
+		return 0, errors.New("not found")
+	}
+	limit := entry.Count(models.MetaMaxHits)
+	if limit == 0 {
+		return -1, nil
+	}
+	served := entry.Count(models.MetaServed)
+	if served >= limit {
+		return 0, ErrExhausted
+	}
+	// the count isn't an edit: UpdatedAt, and so the TTL, stay put
+	updated := cloneEntry(entry)
+	updated.Metadata[models.MetaServed] = served + 1
+	s.index.remove(id, entry.Metadata)
+	s.entries[id] = updated
+	s.index.add(id, updated.Metadata)
+	return limit - served - 1, nil
+}
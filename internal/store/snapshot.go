@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// Snapshotter is implemented by stores that can dump and reload their full
+// contents. The server uses it for backups and restores; callers are expected
+// to quiesce writes around both calls.
+type Snapshotter interface {
+	Snapshot(ctx context.Context) (*Snapshot, error)
+	// Restore replaces the store's contents with snap. Entry IDs are kept.
+	Restore(ctx context.Context, snap *Snapshot) error
+}
+
+// Freezer is implemented by stores that can snapshot without holding writes
+// back while the copy is made. Freeze pins the current state, which is
+// cheap, and build copies it out while writes go on, so callers quiesce
+// writes around Freeze alone.
+type Freezer interface {
+	Freeze(ctx context.Context) (build func() (*Snapshot, error), err error)
+}
+
+// Freeze freezes st if it is a Freezer. Other stores are snapshotted
+// straight away, and build returns that snapshot.
+func Freeze(ctx context.Context, st Snapshotter) (build func() (*Snapshot, error), err error) {
+	if f, ok := st.(Freezer); ok {
+		return f.Freeze(ctx)
+	}
+	snap, err := st.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func() (*Snapshot, error) { return snap, nil }, nil
+}
+
+// Snapshot is a point-in-time copy of a store.
+type Snapshot struct {
+	TakenAt time.Time       `json:"taken_at"`
+	NextID  int64           `json:"next_id"`
+	Entries []SnapshotEntry `json:"entries"`
+	// Synonyms are the per-namespace synonym dictionaries.
+	Synonyms map[string]map[string]string `json:"synonyms,omitempty"`
+	// Outbox holds the undelivered outbound messages.
+	Outbox []OutboxMessage `json:"outbox,omitempty"`
+	// Namespaces are the declared namespaces.
+	Namespaces []models.Namespace `json:"namespaces,omitempty"`
+}
+
+// SnapshotEntry is one entry with its stored vector.
+type SnapshotEntry struct {
+	Entry  *models.Entry `json:"entry"`
+	Vector []float64     `json:"vector"`
+}
+
+func (s *inMemoryStore) Snapshot(ctx context.Context) (*Snapshot, error) {
+	build, err := s.Freeze(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return build()
+}
+
+// Freeze copies out the store's pointers under the read lock, copy-on-write
+// style: stored entries are never changed in place, since every write
+// stores a new copy, and vectors are never overwritten in their slabs. The
+// deep copy and decompression then happen without the lock.
+func (s *inMemoryStore) Freeze(ctx context.Context) (func() (*Snapshot, error), error) {
+	s.mu.RLock()
+	snap := &Snapshot{TakenAt: time.Now().UTC(), NextID: s.nextID, Entries: make([]SnapshotEntry, 0, len(s.ids)), Synonyms: cloneSynonyms(s.synonyms), Outbox: slices.Clone(s.outbox), Namespaces: sortedNamespaces(s.namespaces)}
+	ids := slices.Clone(s.ids)
+	entries := make([]*models.Entry, len(ids))
+	for i, id := range ids {
+		entries[i] = s.entries[id]
+	}
+	packed := maps.Clone(s.packed)
+	vectors := s.vectors.view()
+	s.mu.RUnlock()
+	return func() (*Snapshot, error) {
+		for i, id := range ids {
+			p, ok := packed[id]
+			e, err := loadEntry(entries[i], p, ok)
+			if err != nil {
+				return nil, err
+			}
+			snap.Entries = append(snap.Entries, SnapshotEntry{Entry: e, Vector: slices.Clone(vectors.at(i))})
+		}
+		return snap, nil
+	}, nil
+}
+
+func (s *inMemoryStore) Restore(ctx context.Context, snap *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = make(map[int64]*models.Entry, len(snap.Entries))
+	s.ids = make([]int64, 0, len(snap.Entries))
+	s.pos = make(map[int64]int, len(snap.Entries))
+	s.index = newMetaIndex()
+	floats := 0
+	for _, se := range snap.Entries {
+		floats += len(se.Vector)
+	}
+	s.vectors = newVectorArena(len(snap.Entries), floats)
+	if s.ann != nil {
+		s.ann = newHNSW(s.opts.HNSW, s.vectorOf)
+	}
+	s.sizes = make(map[int64]int64, len(snap.Entries))
+	s.totalBytes = 0
+	s.packed = make(map[int64]packedResponse)
+	s.packedRaw, s.packedBytes = 0, 0
+	s.nextID = max(snap.NextID, 1)
+	s.synonyms = cloneSynonyms(snap.Synonyms)
+	s.namespaces = namespacesByName(snap.Namespaces)
+	s.outbox = slices.Clone(snap.Outbox)
+	for _, m := range s.outbox {
+		s.outboxSeq = max(s.outboxSeq, m.Seq)
+	}
+	for _, se := range snap.Entries {
+		if se.Entry == nil {
+			continue
+		}
+		id := se.Entry.ID
+		if _, dup := s.entries[id]; dup {
+			continue
+		}
+		s.putLocked(id, se.Entry, se.Vector)
+		s.index.add(id, se.Entry.Metadata)
+		s.pos[id] = len(s.ids)
+		s.ids = append(s.ids, id)
+		s.vectors.add(se.Vector)
+		if s.ann != nil {
+			s.ann.insert(id)
+		}
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	return nil
+}
@@ -2,7 +2,16 @@ package store_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jeefy/slmcache/internal/models"
 	"github.com/jeefy/slmcache/internal/store"
@@ -69,3 +78,715 @@ func TestMetadataOperations(t *testing.T) {
 		t.Fatalf("expected no entries after metadata removal")
 	}
 }
+
+func TestMaxEntriesEvictsOldest(t *testing.T) {
+	st, err := store.NewWithOptions(store.Options{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	ctx := context.Background()
+	var ids []int64
+	for _, p := range []string{"one", "two", "three"} {
+		id, err := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: p}, []float64{1, 0})
+		if err != nil {
+			t.Fatalf("create %s: %v", p, err)
+		}
+		ids = append(ids, id)
+	}
+	if got := st.AllIDs(); len(got) != 2 || got[0] != ids[1] || got[1] != ids[2] {
+		t.Fatalf("expected oldest entry evicted, got ids %v", got)
+	}
+	if _, err := st.GetEntry(ctx, ids[0]); err == nil {
+		t.Fatalf("expected evicted entry to be gone")
+	}
+	ev, ok := st.(store.Evicter)
+	if !ok {
+		t.Fatalf("expected the memory store to report evictions")
+	}
+	if got := ev.Evicted(); len(got) != 1 || got[0] != ids[0] {
+		t.Fatalf("expected evicted ids [%d] got %v", ids[0], got)
+	}
+	if got := ev.Evicted(); len(got) != 0 {
+		t.Fatalf("expected evictions drained got %v", got)
+	}
+}
+
+func TestMetadataIndex(t *testing.T) {
+	st, err := store.New()
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	ctx := context.Background()
+	create := func(md map[string]interface{}, vec []float64) int64 {
+		t.Helper()
+		id, err := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "p", Metadata: md}, vec)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		return id
+	}
+	find := func(filters map[string]string) []int64 {
+		t.Helper()
+		entries, err := st.FindEntriesByMetadata(ctx, filters)
+		if err != nil {
+			t.Fatalf("find: %v", err)
+		}
+		ids := []int64{}
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	a := create(map[string]interface{}{"source": "faq", "rank": float64(1), "pinned": true}, []float64{1, 0})
+	b := create(map[string]interface{}{"source": "faq", "tags": []interface{}{"x"}}, []float64{0, 1})
+	c := create(map[string]interface{}{"source": "blog", "rank": float64(1)}, []float64{1, 0.1})
+
+	for _, tc := range []struct {
+		filters map[string]string
+		want    string
+	}{
+		{map[string]string{"source": "faq"}, fmt.Sprint([]int64{a, b})},
+		{map[string]string{"source": "faq", "rank": "1"}, fmt.Sprint([]int64{a})},
+		{map[string]string{"pinned": "true"}, fmt.Sprint([]int64{a})},
+		{map[string]string{"tags": "[x]"}, fmt.Sprint([]int64{b})},
+		{map[string]string{"source": "none"}, "[]"},
+	} {
+		if got := fmt.Sprint(find(tc.filters)); got != tc.want {
+			t.Fatalf("find %v: expected %s got %s", tc.filters, tc.want, got)
+		}
+	}
+
+	// the index follows metadata updates, replacements and deletes
+	if err := st.UpdateEntryMetadata(ctx, c, map[string]interface{}{"source": "faq"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateEntryWithVector(ctx, a, &models.Entry{Prompt: "p", Metadata: map[string]interface{}{"source": "docs"}}, []float64{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteEntry(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(find(map[string]string{"source": "faq"})), fmt.Sprint([]int64{c}); got != want {
+		t.Fatalf("expected %s got %s", want, got)
+	}
+	if got := find(map[string]string{"rank": "1"}); len(got) != 1 || got[0] != c {
+		t.Fatalf("expected only entry %d to keep rank=1 got %v", c, got)
+	}
+
+	// a filtered search ranks only the matching entries
+	fs, ok := st.(store.FilteredSearcher)
+	if !ok {
+		t.Fatal("expected the in-memory store to implement FilteredSearcher")
+	}
+	ids, _, err := fs.SearchByVectorFiltered(ctx, []float64{1, 0}, 1, map[string]string{"source": "faq"})
+	if err != nil || len(ids) != 1 || ids[0] != c {
+		t.Fatalf("expected entry %d got %v (%v)", c, ids, err)
+	}
+	if ids, _, _ := fs.SearchByVectorFiltered(ctx, []float64{1, 0}, 5, map[string]string{"source": "none"}); len(ids) != 0 {
+		t.Fatalf("expected no matches got %v", ids)
+	}
+
+	// and is rebuilt on restore
+	snap, err := st.(store.Snapshotter).Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := store.New()
+	if err := restored.(store.Snapshotter).Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := restored.FindEntriesByMetadata(ctx, map[string]string{"source": "docs"}); len(entries) != 1 || entries[0].ID != a {
+		t.Fatalf("expected restored index to find entry %d got %v", a, entries)
+	}
+}
+
+func TestEvictionSkipsPinned(t *testing.T) {
+	st, err := store.NewWithOptions(store.Options{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	ctx := context.Background()
+	pinned, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "canonical", Metadata: map[string]interface{}{models.MetaPinned: true}}, []float64{1, 0})
+	second, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "two"}, []float64{1, 0})
+	third, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "three"}, []float64{1, 0})
+	if got := st.AllIDs(); len(got) != 2 || got[0] != pinned || got[1] != third {
+		t.Fatalf("expected entry %d evicted instead of the pinned one, got ids %v", second, got)
+	}
+}
+
+// flakyBackend is an in-memory store whose health the test controls.
+type flakyBackend struct {
+	store.Store
+	mu   sync.Mutex
+	down bool
+}
+
+func (f *flakyBackend) Health(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errors.New("connection reset")
+	}
+	return nil
+}
+
+func (f *flakyBackend) Capabilities() store.Capabilities { return store.Capabilities{} }
+
+func TestLazyStoreReconnects(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	var backends []*flakyBackend
+	lazy := store.NewLazy(func(ctx context.Context) (store.Store, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("dial tcp: connection refused")
+		}
+		mem, _ := store.New()
+		b := &flakyBackend{Store: mem}
+		backends = append(backends, b)
+		return b, nil
+	}, store.LazyOptions{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, HealthInterval: 5 * time.Millisecond})
+	defer lazy.Close()
+
+	ctx := context.Background()
+	waitFor := func(available bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for store.Available(lazy) != available {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected available=%v", available)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(true)
+	if _, err := lazy.CreateEntryWithVector(ctx, &models.Entry{Prompt: "p", Response: "r"}, []float64{1, 0}); err != nil {
+		t.Fatalf("create after connecting: %v", err)
+	}
+	// the backend grants no leases, and may be shared
+	if held, err := lazy.AcquireLease(ctx, "janitor", "a", time.Minute); err != nil || held {
+		t.Fatalf("expected no lease from a backend without leases got %v (%v)", held, err)
+	}
+	mu.Lock()
+	if attempts != 3 {
+		t.Fatalf("expected 3 connection attempts got %d", attempts)
+	}
+	backends[0].mu.Lock()
+	backends[0].down = true
+	backends[0].mu.Unlock()
+	mu.Unlock()
+
+	// a failed health check drops the connection and dials again
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(backends)
+		mu.Unlock()
+		if n == 2 && store.Available(lazy) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the store to reconnect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := lazy.Health(ctx); err != nil {
+		t.Fatalf("expected a healthy store after reconnecting got %v", err)
+	}
+
+	exclusive := store.NewLazy(func(ctx context.Context) (store.Store, error) {
+		mem, _ := store.New()
+		return &flakyBackend{Store: mem}, nil
+	}, store.LazyOptions{MinBackoff: time.Millisecond, Exclusive: true})
+	defer exclusive.Close()
+	for !store.Available(exclusive) {
+		time.Sleep(time.Millisecond)
+	}
+	if held, err := exclusive.AcquireLease(ctx, "janitor", "a", time.Minute); err != nil || !held {
+		t.Fatalf("expected an exclusive backend to grant the lease got %v (%v)", held, err)
+	}
+
+	never := store.NewLazy(func(ctx context.Context) (store.Store, error) {
+		return nil, errors.New("dial tcp: connection refused")
+	}, store.LazyOptions{MinBackoff: time.Millisecond})
+	defer never.Close()
+	if _, err := never.GetEntry(ctx, 1); !errors.Is(err, store.ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable got %v", err)
+	}
+	if err := never.Health(ctx); !errors.Is(err, store.ErrUnavailable) {
+		t.Fatalf("expected an unhealthy store got %v", err)
+	}
+}
+
+func TestSynonymsSnapshot(t *testing.T) {
+	ctx := context.Background()
+	st, _ := store.New()
+	ss := st.(store.SynonymStore)
+	if err := ss.SetSynonyms(ctx, "infra", map[string]string{"k8s": "kubernetes"}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := st.(store.Snapshotter).Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ss.SetSynonyms(ctx, "infra", nil)
+	if got, _ := ss.Synonyms(ctx); len(got) != 0 {
+		t.Fatalf("expected an empty dictionary to be removed got %v", got)
+	}
+	if err := st.(store.Snapshotter).Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ss.Synonyms(ctx); got["infra"]["k8s"] != "kubernetes" {
+		t.Fatalf("expected synonyms restored from the snapshot got %v", got)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	st, _ := store.New()
+	ob := st.(store.Outbox)
+	msg := func(typ string) store.OutboxMessage {
+		return store.OutboxMessage{Sink: "events", Type: typ, Payload: []byte(`{}`)}
+	}
+	if err := ob.AppendOutbox(ctx, []store.OutboxMessage{msg("a"), msg("b"), msg("c")}); err != nil {
+		t.Fatal(err)
+	}
+	snap, _ := st.(store.Snapshotter).Snapshot(ctx)
+	if err := ob.AckOutbox(ctx, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ob.PendingOutbox(ctx, 0); len(got) != 1 || got[0].Seq != 2 || got[0].Type != "b" {
+		t.Fatalf("expected only message 2 pending got %+v", got)
+	}
+	if err := st.(store.Snapshotter).Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	_ = ob.AppendOutbox(ctx, []store.OutboxMessage{msg("d")})
+	got, _ := ob.PendingOutbox(ctx, 2)
+	all, _ := ob.PendingOutbox(ctx, 0)
+	if len(got) != 2 || got[0].Seq != 1 || len(all) != 4 || all[3].Seq != 4 {
+		t.Fatalf("expected the restored messages followed by a new one got %+v", all)
+	}
+}
+
+func TestCompressLargeResponses(t *testing.T) {
+	ctx := context.Background()
+	st, _ := store.NewWithOptions(store.Options{CompressAbove: 1024})
+	long := strings.Repeat("Pods are scheduled onto nodes by the kube-scheduler. ", 100)
+	big, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "long", Response: long, Metadata: map[string]interface{}{"ns": "a"}}, []float64{1, 0})
+	small, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "short", Response: "yes"}, []float64{0, 1})
+	cr := st.(store.CompressionReporter)
+	stats := cr.CompressionStats()
+	if stats.Entries != 1 || stats.RawBytes != int64(len(long)) || stats.StoredBytes >= stats.RawBytes/4 {
+		t.Fatalf("expected only the long response compressed got %+v", stats)
+	}
+	if e, _ := st.GetEntry(ctx, big); e.Response != long {
+		t.Fatalf("expected the response decompressed on read got %d bytes", len(e.Response))
+	}
+	if e, _ := st.GetEntry(ctx, small); e.Response != "yes" {
+		t.Fatalf("expected a short response kept as is got %q", e.Response)
+	}
+	if err := st.UpdateEntryMetadata(ctx, big, map[string]interface{}{"ns": "b"}, false); err != nil {
+		t.Fatal(err)
+	}
+	found, _ := st.FindEntriesByMetadata(ctx, map[string]string{"ns": "b"})
+	if len(found) != 1 || found[0].Response != long {
+		t.Fatalf("expected a metadata change to keep the compressed response got %v", found)
+	}
+	snap, _ := st.(store.Snapshotter).Snapshot(ctx)
+	if snap.Entries[0].Entry.Response != long {
+		t.Fatalf("expected snapshots to hold the raw response")
+	}
+	if err := st.(store.Snapshotter).Restore(ctx, snap); err != nil {
+		t.Fatal(err)
+	}
+	if got := cr.CompressionStats(); got != stats {
+		t.Fatalf("expected a restore to compress the same responses: expected %+v got %+v", stats, got)
+	}
+	if err := st.DeleteEntry(ctx, big); err != nil {
+		t.Fatal(err)
+	}
+	if got := cr.CompressionStats(); got.Entries != 0 || got.RawBytes != 0 || got.StoredBytes != 0 {
+		t.Fatalf("expected a delete to drop the compressed response got %+v", got)
+	}
+}
+
+func TestConsumeServeIsAtomic(t *testing.T) {
+	st, _ := store.New()
+	ctx := context.Background()
+	id, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "promo", Response: "CODE-123", Metadata: map[string]interface{}{models.MetaMaxHits: float64(3)}}, []float64{1, 0})
+	sl := st.(store.ServeLimiter)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	allowed, exhausted := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := sl.ConsumeServe(ctx, id)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				allowed++
+			case errors.Is(err, store.ErrExhausted):
+				exhausted++
+			default:
+				t.Errorf("consume: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 || exhausted != 17 {
+		t.Fatalf("expected 3 serves and 17 refusals got %d and %d", allowed, exhausted)
+	}
+	e, _ := st.GetEntry(ctx, id)
+	if e.Count(models.MetaServed) != 3 {
+		t.Fatalf("expected served 3 got %v", e.Metadata[models.MetaServed])
+	}
+	other, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "plain", Response: "x"}, []float64{0, 1})
+	if left, err := sl.ConsumeServe(ctx, other); err != nil || left != -1 {
+		t.Fatalf("expected an unlimited entry got %d, %v", left, err)
+	}
+}
+
+func TestSearchByVectorFromSkipsOtherModels(t *testing.T) {
+	st, _ := store.New()
+	ctx := context.Background()
+	nomic := &models.Embedder{Backend: "ollama", Model: "nomic-embed-text", Version: "0a109f422b47"}
+	same, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "a", Embedder: nomic}, []float64{1, 0})
+	other, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "b", Embedder: &models.Embedder{Backend: "mock", Version: "position-64"}}, []float64{1, 0})
+	untracked, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "c"}, []float64{1, 0})
+	repulled, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "d", Embedder: &models.Embedder{Backend: "ollama", Model: "nomic-embed-text", Version: "970aa74c0a90"}}, []float64{1, 0})
+	ids, _, err := st.(store.EmbedderSearcher).SearchByVectorFrom(ctx, []float64{1, 0}, 10, nomic, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[int64]bool{}
+	for _, id := range ids {
+		found[id] = true
+	}
+	if len(ids) != 2 || !found[same] || !found[untracked] {
+		t.Fatalf("expected entries %d and %d got %v (skipping %d and %d)", same, untracked, ids, other, repulled)
+	}
+	// the embedder is stored with the entry
+	if e, _ := st.GetEntry(ctx, same); e.Embedder == nil || *e.Embedder != *nomic {
+		t.Fatalf("expected the embedder kept got %+v", e.Embedder)
+	}
+}
+
+func TestUpdateMetadataWhere(t *testing.T) {
+	st, _ := store.New()
+	ctx := context.Background()
+	create := func(md map[string]interface{}) int64 {
+		t.Helper()
+		id, err := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "p", Metadata: md}, []float64{1, 0})
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		return id
+	}
+	a := create(map[string]interface{}{"category": "k8s"})
+	create(map[string]interface{}{"category": "k8s", "state": "archived"})
+	create(map[string]interface{}{"category": "docker"})
+
+	ids, err := st.(store.BulkUpdater).UpdateMetadataWhere(ctx, map[string]string{"category": "k8s"}, map[string]interface{}{"category": "kubernetes"})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint([]int64{a}) {
+		t.Fatalf("expected only the unarchived entry %d changed got %v", a, ids)
+	}
+	// the index follows the new values
+	for filter, want := range map[string]int{"kubernetes": 1, "k8s": 1, "docker": 1} {
+		entries, _ := st.FindEntriesByMetadata(ctx, map[string]string{"category": filter})
+		if len(entries) != want {
+			t.Fatalf("expected %d entries in %s got %d", want, filter, len(entries))
+		}
+	}
+}
+
+func TestNamespacesSurviveSnapshots(t *testing.T) {
+	st, _ := store.New()
+	ctx := context.Background()
+	ns := st.(store.NamespaceStore)
+	for _, name := range []string{"prod", "staging"} {
+		if err := ns.PutNamespace(ctx, models.Namespace{Name: name, TTL: "1h"}); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	if err := ns.DeleteNamespace(ctx, "staging"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := ns.DeleteNamespace(ctx, "staging"); !errors.Is(err, store.ErrNamespaceNotFound) {
+		t.Fatalf("expected ErrNamespaceNotFound got %v", err)
+	}
+	snap, _ := st.(store.Snapshotter).Snapshot(ctx)
+	restored, _ := store.New()
+	if err := restored.(store.Snapshotter).Restore(ctx, snap); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got, _ := restored.(store.NamespaceStore).Namespaces(ctx); len(got) != 1 || got[0].Name != "prod" || got[0].TTL != "1h" {
+		t.Fatalf("expected prod restored got %+v", got)
+	}
+}
+
+func TestSearchByVectorAcrossShards(t *testing.T) {
+	st, _ := store.New()
+	ctx := context.Background()
+	// enough vectors to be scanned in parallel; the best are spread over
+	// every shard
+	const n = 20000
+	want := map[int64]bool{}
+	for i := range n {
+		rank := i * 7919 % n
+		id, err := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: fmt.Sprint(i)}, []float64{1, float64(rank)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rank >= n-5 {
+			want[id] = true
+		}
+	}
+	ids, scores, err := st.SearchByVector(ctx, []float64{0, 1}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		if !want[id] || scores[i] <= 0.99 {
+			t.Fatalf("expected the 5 closest of %d entries got %v with %v", n, ids, scores)
+		}
+	}
+	if len(ids) != 5 {
+		t.Fatalf("expected 5 results got %d", len(ids))
+	}
+}
+
+func TestSearchByVectorSortsBestFirst(t *testing.T) {
+	st, _ := store.New()
+	ctx := context.Background()
+	for i := range 200 {
+		_, _ = st.CreateEntryWithVector(ctx, &models.Entry{Prompt: fmt.Sprint(i)}, []float64{1, float64(i * 37 % 200)})
+	}
+	_, scores, err := st.SearchByVector(ctx, []float64{0, 1}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 60 {
+		t.Fatalf("expected 60 results got %d", len(scores))
+	}
+	for i := 1; i < len(scores); i++ {
+		if scores[i] > scores[i-1] {
+			t.Fatalf("expected scores best first got %v", scores)
+		}
+	}
+}
+
+func TestHNSWFindsNearestNeighbours(t *testing.T) {
+	ctx := context.Background()
+	approx, _ := store.NewWithOptions(store.Options{HNSW: store.HNSWOptions{M: 12, ExactBelow: 1}})
+	exact, _ := store.New()
+	rng := rand.New(rand.NewPCG(7, 7))
+	random := func() []float64 {
+		v := make([]float64, 16)
+		for i := range v {
+			v[i] = rng.NormFloat64()
+		}
+		return v
+	}
+	const n = 2000
+	for i := range n {
+		vec := random()
+		md := map[string]interface{}{"shard": fmt.Sprint(i % 4)}
+		_, _ = approx.CreateEntryWithVector(ctx, &models.Entry{Prompt: fmt.Sprint(i), Metadata: md}, vec)
+		_, _ = exact.CreateEntryWithVector(ctx, &models.Entry{Prompt: fmt.Sprint(i), Metadata: md}, vec)
+	}
+	// deletes and moved vectors must leave the graph searchable
+	for id := int64(1); id <= n; id += 5 {
+		_ = approx.DeleteEntry(ctx, id)
+		_ = exact.DeleteEntry(ctx, id)
+	}
+	for id := int64(2); id <= n; id += 50 {
+		vec := random()
+		_ = approx.UpdateEntryWithVector(ctx, id, &models.Entry{Metadata: map[string]interface{}{"shard": "moved"}}, vec)
+		_ = exact.UpdateEntryWithVector(ctx, id, &models.Entry{Metadata: map[string]interface{}{"shard": "moved"}}, vec)
+	}
+
+	found, total := 0, 0
+	for range 50 {
+		q := random()
+		want, _, _ := exact.SearchByVector(ctx, q, 10)
+		got, scores, err := approx.SearchByVector(ctx, q, 10)
+		if err != nil || len(got) != 10 {
+			t.Fatalf("expected 10 results got %v (%v)", got, err)
+		}
+		for i := 1; i < len(scores); i++ {
+			if scores[i] > scores[i-1] {
+				t.Fatalf("expected scores best first got %v", scores)
+			}
+		}
+		for _, id := range got {
+			if id%5 == 1 {
+				t.Fatalf("expected deleted entry %d to be gone", id)
+			}
+			if slices.Contains(want, id) {
+				found++
+			}
+		}
+		total += len(want)
+	}
+	if recall := float64(found) / float64(total); recall < 0.9 {
+		t.Fatalf("expected a recall of at least 0.9 got %.2f", recall)
+	}
+
+	fs := approx.(store.FilteredSearcher)
+	ids, _, err := fs.SearchByVectorFiltered(ctx, random(), 5, map[string]string{"shard": "2"})
+	if err != nil || len(ids) != 5 {
+		t.Fatalf("expected 5 filtered results got %v (%v)", ids, err)
+	}
+	for _, id := range ids {
+		if e, _ := approx.GetEntry(ctx, id); e.Metadata["shard"] != "2" {
+			t.Fatalf("expected only shard 2 got %v", e.Metadata)
+		}
+	}
+	// a filter matching a few percent of the store must still find its
+	// true nearest neighbours
+	efs := exact.(store.FilteredSearcher)
+	for range 10 {
+		q := random()
+		want, _, _ := efs.SearchByVectorFiltered(ctx, q, 10, map[string]string{"shard": "moved"})
+		got, _, err := fs.SearchByVectorFiltered(ctx, q, 10, map[string]string{"shard": "moved"})
+		if err != nil || len(want) != 10 || !slices.Equal(got, want) {
+			t.Fatalf("expected the selective search to return %v got %v (%v)", want, got, err)
+		}
+	}
+}
+
+func TestVectorsSurviveDeletesAndResizes(t *testing.T) {
+	st, _ := store.New()
+	ctx := context.Background()
+	vecOf := func(i int) []float64 { return []float64{float64(i), 1, 2, 3} }
+	var ids []int64
+	for i := range 3000 {
+		id, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: fmt.Sprint(i)}, vecOf(i))
+		ids = append(ids, id)
+	}
+	// deleting most entries reclaims their space in the arena
+	for i, id := range ids {
+		if i%3 != 0 {
+			_ = st.DeleteEntry(ctx, id)
+		}
+	}
+	// a vector of another dimension is moved rather than overwritten
+	if err := st.UpdateEntryWithVector(ctx, ids[3], &models.Entry{Prompt: "3"}, []float64{9, 9, 9, 9, 9, 9, 9, 9}); err != nil {
+		t.Fatal(err)
+	}
+	vg := st.(store.VectorGetter)
+	for i := 0; i < len(ids); i += 3 {
+		want := vecOf(i)
+		if i == 3 {
+			want = []float64{9, 9, 9, 9, 9, 9, 9, 9}
+		}
+		got, err := vg.GetVector(ctx, ids[i])
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("expected entry %d's vector %v got %v (%v)", ids[i], want, got, err)
+		}
+	}
+	if ids, _, _ := st.SearchByVector(ctx, vecOf(2997), 1); len(ids) != 1 || ids[0] != 2998 {
+		t.Fatalf("expected entry 2998 closest got %v", ids)
+	}
+}
+
+func TestFrozenSnapshotIgnoresLaterWrites(t *testing.T) {
+	st, _ := store.NewWithOptions(store.Options{CompressAbove: 64})
+	ctx := context.Background()
+	long := strings.Repeat("a long answer ", 20)
+	kept, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "kept", Response: long}, []float64{1, 0})
+	deleted, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "deleted", Response: "r"}, []float64{0, 1})
+	build, err := st.(store.Freezer).Freeze(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes go on while the snapshot is built
+	_ = st.UpdateEntryWithVector(ctx, kept, &models.Entry{Prompt: "kept", Response: "changed"}, []float64{0.5, 0.5})
+	_ = st.UpdateEntryMetadata(ctx, kept, map[string]interface{}{"k": "v"}, false)
+	_ = st.DeleteEntry(ctx, deleted)
+	_, _ = st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "added"}, []float64{1, 1})
+	snap, err := build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Entries) != 2 {
+		t.Fatalf("expected the 2 entries frozen got %d", len(snap.Entries))
+	}
+	first := snap.Entries[0]
+	if first.Entry.Response != long || first.Entry.Metadata["k"] != nil || fmt.Sprint(first.Vector) != "[1 0]" {
+		t.Fatalf("expected entry %d as frozen got %q %v %v", kept, first.Entry.Response, first.Entry.Metadata, first.Vector)
+	}
+}
+
+func TestRecordHitsKeepsStatisticsAcrossUpdates(t *testing.T) {
+	st, _ := store.New()
+	ctx := context.Background()
+	id, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "p", Response: "r", CreatedBy: "abc"}, []float64{1, 0})
+	first, last := time.Now().Add(-time.Minute).UTC(), time.Now().UTC()
+	hr := st.(store.HitRecorder)
+	_ = hr.RecordHits(ctx, map[int64]store.Hits{id: {Count: 2, Last: last}, 99: {Count: 1, Last: last}})
+	_ = hr.RecordHits(ctx, map[int64]store.Hits{id: {Count: 1, Last: first}})
+	_ = st.UpdateEntryWithVector(ctx, id, &models.Entry{Prompt: "p", Response: "changed"}, []float64{0, 1})
+	e, err := st.GetEntry(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.HitCount != 3 || !e.LastHitAt.Equal(last) || e.CreatedBy != "abc" {
+		t.Fatalf("expected 3 hits, the latest at %v, by abc got %d at %v by %q", last, e.HitCount, e.LastHitAt, e.CreatedBy)
+	}
+	if _, err := st.GetEntry(ctx, 99); err == nil {
+		t.Fatalf("expected hits on a missing entry to be skipped")
+	}
+}
+
+func TestBoltStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slmcache.db")
+	ctx := context.Background()
+	st, err := store.OpenBolt(path, store.Options{MaxEntries: 2, CompressAbove: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evicted, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "evicted", Response: "r"}, []float64{1, 0})
+	kept, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "kept", Response: strings.Repeat("long answer ", 4)}, []float64{0, 1})
+	_ = st.UpdateEntryMetadata(ctx, kept, map[string]interface{}{"tag": "x"}, false)
+	_ = st.(store.HitRecorder).RecordHits(ctx, map[int64]store.Hits{kept: {Count: 3, Last: time.Now()}})
+	deleted, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "deleted", Response: "r"}, []float64{1, 1})
+	_ = st.DeleteEntry(ctx, deleted)
+	_ = st.(store.NamespaceStore).PutNamespace(ctx, models.Namespace{Name: "team"})
+	if _, err := store.OpenBolt(path, store.Options{}); err == nil {
+		t.Fatalf("expected the file to be locked while open")
+	}
+	_ = st.(io.Closer).Close()
+
+	st, err = store.OpenBolt(path, store.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.(io.Closer).Close()
+	if ids := st.AllIDs(); fmt.Sprint(ids) != fmt.Sprint([]int64{kept}) {
+		t.Fatalf("expected only entry %d (not %d or %d) after reopening got %v", kept, evicted, deleted, ids)
+	}
+	e, err := st.GetEntry(ctx, kept)
+	if err != nil || e.Response != strings.Repeat("long answer ", 4) || e.Metadata["tag"] != "x" || e.HitCount != 3 {
+		t.Fatalf("expected entry %d as written got %+v (%v)", kept, e, err)
+	}
+	if ids, _, _ := st.SearchByVector(ctx, []float64{0, 1}, 1); len(ids) != 1 || ids[0] != kept {
+		t.Fatalf("expected its vector to be searchable got %v", ids)
+	}
+	if ns, _ := st.(store.NamespaceStore).Namespaces(ctx); len(ns) != 1 || ns[0].Name != "team" {
+		t.Fatalf("expected namespace team got %v", ns)
+	}
+	// IDs aren't reused
+	if id, _ := st.CreateEntryWithVector(ctx, &models.Entry{Prompt: "new"}, []float64{1, 0}); id <= deleted {
+		t.Fatalf("expected an ID past %d got %d", deleted, id)
+	}
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"context"
+	"maps"
+)
+
+// SynonymStore is implemented by stores that persist the per-namespace
+// synonym dictionaries the server applies to queries and prompts, so every
+// replica shares them and they survive restarts. Dictionaries map an alias
+// (e.g. "k8s") to the term it stands for ("kubernetes").
+type SynonymStore interface {
+	// Synonyms returns the dictionary of every namespace that has one.
+	Synonyms(ctx context.Context) (map[string]map[string]string, error)
+	// SetSynonyms replaces namespace's dictionary; an empty one removes it.
+	SetSynonyms(ctx context.Context, namespace string, synonyms map[string]string) error
+}
+
+func (s *inMemoryStore) Synonyms(ctx context.Context) (map[string]map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return cloneSynonyms(s.synonyms), nil
+}
+
+func (s *inMemoryStore) SetSynonyms(ctx context.Context, namespace string, synonyms map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(synonyms) == 0 {
+		delete(s.synonyms, namespace)
+		return nil
+	}
+	s.synonyms[namespace] = maps.Clone(synonyms)
+	return nil
+}
+
+func cloneSynonyms(m map[string]map[string]string) map[string]map[string]string {
+	out := make(map[string]map[string]string, len(m))
+	for ns, dict := range m {
+		out[ns] = maps.Clone(dict)
+	}
+	return out
+}
@@ -0,0 +1,24 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+// VectorGetter is implemented by stores that can return the embedding stored
+// for an entry. Maintenance jobs use it to compare stored vectors with fresh
+// embeddings (drift detection) or to inspect vector health.
+type VectorGetter interface {
+	GetVector(ctx context.Context, id int64) ([]float64, error)
+}
+
+func (s *inMemoryStore) GetVector(ctx context.Context, id int64) ([]float64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.pos[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return slices.Clone(s.vectors.at(i)), nil
+}
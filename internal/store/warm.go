@@ -0,0 +1,21 @@
+package store
+
+import "context"
+
+// Warmer is implemented by stores whose data only becomes fast to read once
+// it has been touched, such as file-backed indexes that memory-map their
+// vectors or load graph layers on first use. Warm faults the mapped pages in
+// and primes the index (e.g. HNSW entry points and upper layers), so the
+// first requests after a deploy don't pay for it. The server warms the store
+// at startup and reports not ready until it's done.
+type Warmer interface {
+	Warm(ctx context.Context) error
+}
+
+// Warm warms st if it implements Warmer.
+func Warm(ctx context.Context, st Store) error {
+	if w, ok := st.(Warmer); ok {
+		return w.Warm(ctx)
+	}
+	return nil
+}
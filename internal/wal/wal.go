@@ -0,0 +1,295 @@
+// Package wal is an append-only journal of store mutations. Combined with a
+// snapshot that records the journal position it was taken at, the journal
+// lets an operator restore the store to any later point in time.
+//
+// Records are JSON lines in segment files named after the first sequence
+// number they hold (00000000000000000001.wal, ...). Segments are never
+// deleted by this package; archiving or pruning old ones is left to the
+// operator.
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+// Op is the kind of mutation a record describes.
+type Op string
+
+const (
+	// OpPut stores Entry and Vector under ID, replacing any previous value.
+	OpPut Op = "put"
+	// OpDelete removes ID.
+	OpDelete Op = "delete"
+	// OpReset empties the store (a restore); the puts that follow rebuild it.
+	OpReset Op = "reset"
+)
+
+// Record is one journaled mutation.
+type Record struct {
+	Seq    uint64        `json:"seq"`
+	Time   time.Time     `json:"time"`
+	Op     Op            `json:"op"`
+	ID     int64         `json:"id,omitempty"`
+	Entry  *models.Entry `json:"entry,omitempty"`
+	Vector []float64     `json:"vector,omitempty"`
+}
+
+const segmentExt = ".wal"
+
+// Log appends records to segment files in a directory. Appends are written
+// but not fsynced individually; a torn final record is discarded on Open.
+type Log struct {
+	dir        string
+	maxSegment int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	seq  uint64
+}
+
+// Open opens the journal in dir, creating it if needed, and positions it
+// after the last complete record. Segments grow up to maxSegment bytes
+// (0 = unbounded) before a new one is started.
+func Open(dir string, maxSegment int64) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, maxSegment: maxSegment}
+	segs, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) == 0 {
+		return l, nil
+	}
+	last := segs[len(segs)-1]
+	good, seq, err := scanTail(last.path)
+	if err != nil {
+		return nil, err
+	}
+	if seq == 0 {
+		seq = last.first - 1
+	}
+	f, err := os.OpenFile(last.path, os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// drop a torn record left by a crash mid-write
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f, l.size, l.seq = f, good, seq
+	return l, nil
+}
+
+// scanTail returns the byte length of the complete records in path and the
+// sequence number of the last one.
+func scanTail(path string) (int64, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var good int64
+	var seq uint64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return good, seq, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		var rec Record
+		if json.Unmarshal(line, &rec) != nil {
+			return good, seq, nil
+		}
+		good += int64(len(line))
+		seq = rec.Seq
+	}
+}
+
+type segment struct {
+	path  string
+	first uint64
+}
+
+func (l *Log) segments() ([]segment, error) {
+	ents, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []segment
+	for _, e := range ents {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, segment{path: filepath.Join(l.dir, name), first: first})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].first < out[j].first })
+	return out, nil
+}
+
+// Seq returns the sequence number of the last appended record (0 if none).
+func (l *Log) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Append assigns rec the next sequence number (and the current time if
+// unset), writes it, and returns the sequence number.
+func (l *Log) Append(rec Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec.Seq = l.seq + 1
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+	if l.f == nil || (l.maxSegment > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSegment) {
+		if err := l.startSegment(rec.Seq); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	l.seq = rec.Seq
+	return rec.Seq, nil
+}
+
+func (l *Log) startSegment(first uint64) error {
+	if l.f != nil {
+		if err := l.f.Close(); err != nil {
+			return err
+		}
+		l.f = nil
+	}
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", first, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	l.f, l.size = f, 0
+	return nil
+}
+
+// ErrGap is returned by Replay when the records following the requested
+// position are no longer in the journal (segments were pruned).
+var ErrGap = errors.New("wal: journal does not cover the requested position")
+
+// Replay calls fn for every record with a sequence number greater than
+// after, in order. Returning io.EOF from fn stops the replay without error.
+func (l *Log) Replay(after uint64, fn func(Record) error) error {
+	l.mu.Lock()
+	segs, err := l.segments()
+	end := l.seq
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if end <= after {
+		return nil
+	}
+	// skip segments that end before after+1
+	start := 0
+	for i, s := range segs {
+		if s.first <= after+1 {
+			start = i
+		}
+	}
+	if len(segs) == 0 || segs[start].first > after+1 {
+		return ErrGap
+	}
+	for _, s := range segs[start:] {
+		if err := replaySegment(s.path, after, end, fn); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func replaySegment(path string, after, end uint64, fn func(Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec Record
+		if err := json.Unmarshal(bytes.TrimSpace(line), &rec); err != nil {
+			return fmt.Errorf("wal: %s: %w", filepath.Base(path), err)
+		}
+		if rec.Seq <= after {
+			continue
+		}
+		if rec.Seq > end {
+			return io.EOF
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Close flushes and closes the current segment.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
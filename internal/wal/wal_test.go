@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jeefy/slmcache/internal/models"
+)
+
+func collect(t *testing.T, l *Log, after uint64) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	if err := l.Replay(after, func(r Record) error { seqs = append(seqs, r.Seq); return nil }); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return seqs
+}
+
+func TestLog_RotatesAndReplays(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if _, err := l.Append(Record{Op: OpPut, ID: int64(i), Entry: &models.Entry{ID: int64(i), Prompt: "some prompt text"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(segs) < 2 {
+		t.Fatalf("expected rotation into several segments got %d", len(segs))
+	}
+	if got := collect(t, l, 2); len(got) != 3 || got[0] != 3 {
+		t.Fatalf("expected [3 4 5] got %v", got)
+	}
+	l.Close()
+
+	// reopening continues the sequence
+	l, err = Open(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if seq, _ := l.Append(Record{Op: OpDelete, ID: 1}); seq != 6 {
+		t.Fatalf("expected seq 6 got %d", seq)
+	}
+
+	// a pruned first segment leaves a gap for early positions
+	os.Remove(segs[0])
+	if err := l.Replay(0, func(Record) error { return nil }); !errors.Is(err, ErrGap) {
+		t.Fatalf("expected ErrGap got %v", err)
+	}
+}
+
+func TestOpen_DropsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := Open(dir, 0)
+	l.Append(Record{Op: OpDelete, ID: 1})
+	l.Close()
+	f, _ := os.OpenFile(filepath.Join(dir, "00000000000000000001.wal"), os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"seq":2,"op":"del`)
+	f.Close()
+
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if seq, _ := l.Append(Record{Op: OpDelete, ID: 2}); seq != 2 {
+		t.Fatalf("expected seq 2 got %d", seq)
+	}
+	if got := collect(t, l, 0); len(got) != 2 {
+		t.Fatalf("expected 2 records got %v", got)
+	}
+}